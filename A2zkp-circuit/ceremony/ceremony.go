@@ -0,0 +1,413 @@
+// Package ceremony runs the multi-party Groth16 setup of the authentication circuit and checks its
+// transcript.
+//
+// The setup follows the two-phase MPC of https://eprint.iacr.org/2017/1050: a powers of tau phase,
+// independent of the circuit, then a phase bound to the compiled constraint system. Every
+// participant adds a contribution of their own randomness and proves knowledge of it; the keys are
+// sound as long as one participant destroyed their randomness. A Manifest lists the contributions
+// with their hashes and the participants' attestations, and the transcript holds the initial
+// parameters of each phase and those after each contribution, so anyone can replay the chain with Verify and check it ends in the
+// keys a server deploys. Only BN254 circuits can be set up this way.
+package ceremony
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs "github.com/consensys/gnark/constraint/bn254"
+)
+
+// Files a ceremony is saved in, and that keygen -ceremony copies next to the keys it extracts
+const (
+	ManifestFile   = "ceremony.json"
+	TranscriptFile = "ceremony.transcript"
+)
+
+// ErrTranscript is returned for a transcript whose contributions don't chain, don't match the
+// manifest or don't end in the keys it is checked against
+var ErrTranscript = errors.New("invalid setup ceremony transcript")
+
+// maxAttestationLength bounds an attestation, which is published as is
+const maxAttestationLength = 4096
+
+// Contribution records one participant's contribution
+type Contribution struct {
+	Phase       int    `json:"phase"` // Phase is 1 for powers of tau, 2 for the circuit-specific phase
+	Participant string `json:"participant"`
+	// Attestation is the participant's own statement about how they contributed, typically signed
+	// and naming Hash
+	Attestation string `json:"attestation,omitempty"`
+	// Hash is the hex SHA-256 of the parameters after the contribution, which the next
+	// participant's proof of knowledge is bound to
+	Hash          string    `json:"hash"`
+	ContributedAt time.Time `json:"contributed_at"`
+}
+
+// Manifest describes a ceremony: the circuit it sets up and its contributions, phase 1 ones first
+type Manifest struct {
+	CircuitVersion string         `json:"circuit_version"`
+	Curve          string         `json:"curve"`
+	Power          int            `json:"power"` // Power is the log2 of the number of powers of tau
+	Contributions  []Contribution `json:"contributions"`
+	// VerifyingKeyHash and ProvingKeyHash are the "sha256:" hex digests of the keys' gnark
+	// encodings, set once Keys extracts them
+	VerifyingKeyHash string `json:"verifying_key_hash,omitempty"`
+	ProvingKeyHash   string `json:"proving_key_hash,omitempty"`
+}
+
+// Ceremony is a setup in progress: the parameters after the latest contribution of each phase and
+// the transcript of every contribution so far
+type Ceremony struct {
+	Manifest Manifest
+
+	r1cs       *cs.R1CS
+	phase1     *mpcsetup.Phase1
+	phase2     *mpcsetup.Phase2 // phase2 is nil until the first phase 2 contribution
+	evals      mpcsetup.Phase2Evaluations
+	transcript bytes.Buffer
+}
+
+// New starts the ceremony of a circuit compiled over BN254, with no contribution yet
+func New(ccs constraint.ConstraintSystem, circuitVersion string) (*Ceremony, error) {
+	r1cs, isR1CS := ccs.(*cs.R1CS)
+	if !isR1CS {
+		return nil, fmt.Errorf("setup ceremonies only run for Groth16 circuits over %s", ecc.BN254)
+	}
+	// The powers of tau must cover the FFT domain of the constraints
+	power := max(bits.Len(uint(r1cs.GetNbConstraints()-1)), 1)
+	initial := mpcsetup.InitPhase1(power)
+	c := &Ceremony{
+		Manifest: Manifest{CircuitVersion: circuitVersion, Curve: ecc.BN254.String(), Power: power},
+		r1cs:     r1cs,
+		phase1:   &initial,
+	}
+	// The initial public keys are random, so the transcript starts with the initial parameters
+	if _, writeErr := initial.WriteTo(&c.transcript); writeErr != nil {
+		return nil, writeErr
+	}
+	return c, nil
+}
+
+// Open resumes the ceremony saved in dir, replaying and checking every contribution so far
+func Open(dir string, ccs constraint.ConstraintSystem) (*Ceremony, error) {
+	encoded, readErr := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if readErr != nil {
+		return nil, readErr
+	}
+	var manifest Manifest
+	if decodeErr := json.Unmarshal(encoded, &manifest); decodeErr != nil {
+		return nil, fmt.Errorf("parsing %s: %w", ManifestFile, decodeErr)
+	}
+	transcript, openErr := os.Open(filepath.Join(dir, TranscriptFile))
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer transcript.Close()
+	return replay(manifest, transcript, ccs)
+}
+
+// Contribute adds a contribution of fresh randomness to a phase. Phase 1 takes contributions until
+// the first phase 2 one, which needs at least one phase 1 contribution before it.
+func (c *Ceremony) Contribute(phase int, participant, attestation string) (Contribution, error) {
+	participant = strings.TrimSpace(participant)
+	switch {
+	case participant == "":
+		return Contribution{}, errors.New("a contribution needs a participant")
+	case len(attestation) > maxAttestationLength:
+		return Contribution{}, fmt.Errorf("attestations are limited to %d bytes", maxAttestationLength)
+	case phase != 1 && phase != 2:
+		return Contribution{}, fmt.Errorf("unknown ceremony phase %d, want 1 or 2", phase)
+	case phase == 1 && c.phase2 != nil:
+		return Contribution{}, errors.New("phase 1 is closed once phase 2 has begun")
+	case phase == 2 && c.contributions(1) == 0:
+		return Contribution{}, errors.New("phase 2 needs at least one phase 1 contribution")
+	}
+
+	// Contributions update the parameters in place, so they work on a copy
+	start := c.transcript.Len()
+	var hash []byte
+	if phase == 1 {
+		next := new(mpcsetup.Phase1)
+		if copyErr := copyPhase(c.phase1, next); copyErr != nil {
+			return Contribution{}, copyErr
+		}
+		next.Contribute()
+		if _, writeErr := next.WriteTo(&c.transcript); writeErr != nil {
+			c.transcript.Truncate(start)
+			return Contribution{}, writeErr
+		}
+		c.phase1, hash = next, next.Hash
+	} else {
+		if beginErr := c.beginPhase2(nil); beginErr != nil {
+			return Contribution{}, beginErr
+		}
+		next := new(mpcsetup.Phase2)
+		if copyErr := copyPhase(c.phase2, next); copyErr != nil {
+			return Contribution{}, copyErr
+		}
+		next.Contribute()
+		if _, writeErr := next.WriteTo(&c.transcript); writeErr != nil {
+			c.transcript.Truncate(start)
+			return Contribution{}, writeErr
+		}
+		c.phase2, hash = next, next.Hash
+	}
+	contribution := Contribution{Phase: phase, Participant: participant, Attestation: attestation, Hash: hex.EncodeToString(hash), ContributedAt: time.Now().UTC()}
+	c.Manifest.Contributions = append(c.Manifest.Contributions, contribution)
+	return contribution, nil
+}
+
+// Keys extracts the proving and verifying keys once both phases have a contribution, recording
+// their digests in the manifest
+func (c *Ceremony) Keys() (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	if c.contributions(2) == 0 {
+		return nil, nil, errors.New("the ceremony has no phase 2 contribution yet")
+	}
+	// Extraction reorders the parameters in place, so it works on copies
+	phase1, phase2 := new(mpcsetup.Phase1), new(mpcsetup.Phase2)
+	if copyErr := errors.Join(copyPhase(c.phase1, phase1), copyPhase(c.phase2, phase2)); copyErr != nil {
+		return nil, nil, copyErr
+	}
+	// The evaluations are only read, and VKK, which their encoding leaves out, can't be copied through it
+	evals := c.evals
+	provingKey, verifyingKey := mpcsetup.ExtractKeys(phase1, phase2, &evals, c.r1cs.GetNbConstraints())
+	provingKeyHash, provingErr := keyHash(&provingKey)
+	verifyingKeyHash, verifyingErr := verifier.KeyHash(&verifyingKey)
+	if hashErr := errors.Join(provingErr, verifyingErr); hashErr != nil {
+		return nil, nil, hashErr
+	}
+	c.Manifest.ProvingKeyHash, c.Manifest.VerifyingKeyHash = provingKeyHash, verifyingKeyHash
+	return &provingKey, &verifyingKey, nil
+}
+
+// Transcript returns the encoded parameters of the ceremony: the initial ones of phase 1, those after
+// each phase 1 contribution, the initial ones of phase 2 and those after each phase 2 contribution
+func (c *Ceremony) Transcript() []byte {
+	return c.transcript.Bytes()
+}
+
+// Save writes the manifest and transcript to dir, replacing those of an earlier save
+func (c *Ceremony) Save(dir string) error {
+	if mkdirErr := os.MkdirAll(dir, 0o755); mkdirErr != nil {
+		return mkdirErr
+	}
+	encoded, encodeErr := json.MarshalIndent(c.Manifest, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	// The transcript goes first: a manifest never names contributions its transcript lacks
+	if writeErr := writeFile(filepath.Join(dir, TranscriptFile), c.transcript.Bytes()); writeErr != nil {
+		return writeErr
+	}
+	return writeFile(filepath.Join(dir, ManifestFile), append(encoded, '\n'))
+}
+
+// Verify replays a published transcript against its manifest, the compiled circuit and the keys
+// a server deploys: every contribution must prove knowledge of its randomness, build on the one
+// before and hash to what the manifest lists, and the keys extracted at the end must be those
+// keys, byte for byte. It returns the manifest checked, with the digests of the keys.
+func Verify(manifest Manifest, transcript io.Reader, ccs constraint.ConstraintSystem, provingKey groth16.ProvingKey, verifyingKey groth16.VerifyingKey) (Manifest, error) {
+	replayed, replayErr := replay(manifest, transcript, ccs)
+	if replayErr != nil {
+		return Manifest{}, replayErr
+	}
+	if _, _, keysErr := replayed.Keys(); keysErr != nil {
+		return Manifest{}, fmt.Errorf("%w: %v", ErrTranscript, keysErr)
+	}
+	deployedProving, provingErr := keyHash(provingKey)
+	deployedVerifying, verifyingErr := verifier.KeyHash(verifyingKey)
+	if hashErr := errors.Join(provingErr, verifyingErr); hashErr != nil {
+		return Manifest{}, hashErr
+	}
+	switch {
+	case deployedVerifying != replayed.Manifest.VerifyingKeyHash:
+		return Manifest{}, fmt.Errorf("%w: it ends in the verifying key %s, not the deployed %s", ErrTranscript, replayed.Manifest.VerifyingKeyHash, deployedVerifying)
+	case deployedProving != replayed.Manifest.ProvingKeyHash:
+		return Manifest{}, fmt.Errorf("%w: it ends in the proving key %s, not the deployed %s", ErrTranscript, replayed.Manifest.ProvingKeyHash, deployedProving)
+	case manifest.VerifyingKeyHash != "" && manifest.VerifyingKeyHash != deployedVerifying,
+		manifest.ProvingKeyHash != "" && manifest.ProvingKeyHash != deployedProving:
+		return Manifest{}, fmt.Errorf("%w: the manifest names other keys than the ones it ends in", ErrTranscript)
+	}
+	return replayed.Manifest, nil
+}
+
+// replay rebuilds a ceremony from its manifest and transcript, checking each contribution
+func replay(manifest Manifest, transcript io.Reader, ccs constraint.ConstraintSystem) (*Ceremony, error) {
+	c, newErr := New(ccs, manifest.CircuitVersion)
+	if newErr != nil {
+		return nil, newErr
+	}
+	if manifest.Curve != c.Manifest.Curve || manifest.Power != c.Manifest.Power {
+		return nil, fmt.Errorf("%w: it is over %s with 2^%d powers of tau, the circuit needs %s with 2^%d", ErrTranscript, manifest.Curve, manifest.Power, c.Manifest.Curve, c.Manifest.Power)
+	}
+	// The contributions are recorded as they are read, which keeps the transcript exactly as published
+	c.transcript.Reset()
+	reader := io.TeeReader(transcript, &c.transcript)
+	initial := new(mpcsetup.Phase1)
+	if _, readErr := initial.ReadFrom(reader); readErr != nil {
+		return nil, fmt.Errorf("%w: reading the initial parameters: %v", ErrTranscript, readErr)
+	}
+	if initialErr := checkInitialPhase1(initial, c.phase1); initialErr != nil {
+		return nil, initialErr
+	}
+	c.phase1 = initial
+	for i, contribution := range manifest.Contributions {
+		var hash []byte
+		var verifyErr error
+		switch {
+		case contribution.Phase == 1 && c.phase2 == nil:
+			next := new(mpcsetup.Phase1)
+			if _, readErr := next.ReadFrom(reader); readErr != nil {
+				return nil, fmt.Errorf("%w: reading contribution %d: %v", ErrTranscript, i+1, readErr)
+			}
+			if verifyErr = checkPhase1Size(next, c.Manifest.Power); verifyErr == nil {
+				verifyErr = mpcsetup.VerifyPhase1(c.phase1, next)
+			}
+			c.phase1, hash = next, next.Hash
+		case contribution.Phase == 2 && c.contributions(1) > 0:
+			if beginErr := c.beginPhase2(reader); beginErr != nil {
+				return nil, beginErr
+			}
+			next := new(mpcsetup.Phase2)
+			if _, readErr := next.ReadFrom(reader); readErr != nil {
+				return nil, fmt.Errorf("%w: reading contribution %d: %v", ErrTranscript, i+1, readErr)
+			}
+			if verifyErr = checkPhase2Size(next, c.phase2); verifyErr == nil {
+				verifyErr = mpcsetup.VerifyPhase2(c.phase2, next)
+			}
+			c.phase2, hash = next, next.Hash
+		default:
+			return nil, fmt.Errorf("%w: contribution %d is to phase %d out of order", ErrTranscript, i+1, contribution.Phase)
+		}
+		if verifyErr != nil {
+			return nil, fmt.Errorf("%w: contribution %d by %s: %v", ErrTranscript, i+1, contribution.Participant, verifyErr)
+		}
+		if hex.EncodeToString(hash) != contribution.Hash {
+			return nil, fmt.Errorf("%w: contribution %d by %s hashes to %x, not the %s the manifest lists", ErrTranscript, i+1, contribution.Participant, hash, contribution.Hash)
+		}
+		c.Manifest.Contributions = append(c.Manifest.Contributions, contribution)
+	}
+	if trailing, _ := transcript.Read(make([]byte, 1)); trailing > 0 {
+		return nil, fmt.Errorf("%w: it holds more contributions than the manifest lists", ErrTranscript)
+	}
+	return c, nil
+}
+
+// beginPhase2 derives the initial phase 2 parameters from the last phase 1 contribution, once,
+// and records them. Replaying a transcript passes it to read the recorded ones from instead, which
+// must be those derived but for their random public key.
+func (c *Ceremony) beginPhase2(transcript io.Reader) error {
+	if c.phase2 != nil {
+		return nil
+	}
+	initial, evals := mpcsetup.InitPhase2(c.r1cs, c.phase1)
+	c.evals = evals
+	if transcript == nil {
+		c.phase2 = &initial
+		_, writeErr := initial.WriteTo(&c.transcript)
+		return writeErr
+	}
+	recorded := new(mpcsetup.Phase2)
+	if _, readErr := recorded.ReadFrom(transcript); readErr != nil {
+		return fmt.Errorf("%w: reading the initial phase 2 parameters: %v", ErrTranscript, readErr)
+	}
+	initial.PublicKey, initial.Hash = recorded.PublicKey, recorded.Hash
+	if !sameEncoding(recorded, &initial) {
+		return fmt.Errorf("%w: phase 2 doesn't start from the parameters phase 1 ended in", ErrTranscript)
+	}
+	c.phase2 = recorded
+	return nil
+}
+
+// contributions counts the contributions to a phase
+func (c *Ceremony) contributions(phase int) int {
+	count := 0
+	for _, contribution := range c.Manifest.Contributions {
+		if contribution.Phase == phase {
+			count++
+		}
+	}
+	return count
+}
+
+// checkInitialPhase1 refuses initial parameters other than those InitPhase1 starts from, the
+// generators with a τ, α and β of one; only their public keys are random
+func checkInitialPhase1(initial, fresh *mpcsetup.Phase1) error {
+	expected := *fresh
+	expected.PublicKeys, expected.Hash = initial.PublicKeys, initial.Hash
+	if !sameEncoding(initial, &expected) {
+		return fmt.Errorf("%w: it doesn't start from the initial powers of tau", ErrTranscript)
+	}
+	return nil
+}
+
+// checkPhase1Size refuses a phase 1 contribution with other than 2^power powers, which the
+// verification would index out of range on
+func checkPhase1Size(phase1 *mpcsetup.Phase1, power int) error {
+	size := 1 << power
+	parameters := phase1.Parameters
+	if len(parameters.G1.Tau) != 2*size-1 || len(parameters.G1.AlphaTau) != size || len(parameters.G1.BetaTau) != size || len(parameters.G2.Tau) != size {
+		return fmt.Errorf("the parameters aren't for 2^%d powers of tau", power)
+	}
+	return nil
+}
+
+// checkPhase2Size refuses a phase 2 contribution for another circuit than the one it follows
+func checkPhase2Size(phase2, previous *mpcsetup.Phase2) error {
+	if len(phase2.Parameters.G1.L) != len(previous.Parameters.G1.L) || len(phase2.Parameters.G1.Z) != len(previous.Parameters.G1.Z) {
+		return errors.New("the parameters are for another circuit")
+	}
+	return nil
+}
+
+// sameEncoding reports whether two sets of parameters encode to the same bytes
+func sameEncoding(a, b io.WriterTo) bool {
+	var encodedA, encodedB bytes.Buffer
+	_, writeErrA := a.WriteTo(&encodedA)
+	_, writeErrB := b.WriteTo(&encodedB)
+	return writeErrA == nil && writeErrB == nil && bytes.Equal(encodedA.Bytes(), encodedB.Bytes())
+}
+
+// copyPhase deep-copies the parameters of a phase through their encoding
+func copyPhase(from io.WriterTo, to io.ReaderFrom) error {
+	var encoded bytes.Buffer
+	if _, writeErr := from.WriteTo(&encoded); writeErr != nil {
+		return writeErr
+	}
+	_, readErr := to.ReadFrom(&encoded)
+	return readErr
+}
+
+// keyHash is the "sha256:" hex digest of a key's gnark encoding, as verifier.KeyHash writes it
+func keyHash(key io.WriterTo) (string, error) {
+	digest := sha256.New()
+	if _, writeErr := key.WriteTo(digest); writeErr != nil {
+		return "", writeErr
+	}
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// writeFile replaces a file through a rename, so an interrupted save leaves the previous one intact
+func writeFile(path string, data []byte) error {
+	temporary := path + ".tmp"
+	if writeErr := os.WriteFile(temporary, data, 0o644); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(temporary, path)
+}
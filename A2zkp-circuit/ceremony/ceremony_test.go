@@ -0,0 +1,109 @@
+package ceremony
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+func TestCeremony(t *testing.T) {
+	ccs, compileErr := circuit.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	setup, newErr := New(ccs, circuit.Version)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	if _, contributeErr := setup.Contribute(2, "alice", ""); contributeErr == nil {
+		t.Error("phase 2 began before any phase 1 contribution")
+	}
+	for _, step := range []struct {
+		phase       int
+		participant string
+	}{{1, "alice"}, {1, "bob"}, {2, "carol"}} {
+		if _, contributeErr := setup.Contribute(step.phase, step.participant, "I destroyed my toxic waste"); contributeErr != nil {
+			t.Fatal(contributeErr)
+		}
+	}
+	if _, contributeErr := setup.Contribute(1, "dave", ""); contributeErr == nil {
+		t.Error("phase 1 took a contribution after phase 2 began")
+	}
+
+	// A ceremony saved and resumed takes further contributions
+	dir := t.TempDir()
+	if saveErr := setup.Save(dir); saveErr != nil {
+		t.Fatal(saveErr)
+	}
+	resumed, openErr := Open(dir, ccs)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if _, contributeErr := resumed.Contribute(2, "dave", ""); contributeErr != nil {
+		t.Fatal(contributeErr)
+	}
+	provingKey, verifyingKey, keysErr := resumed.Keys()
+	if keysErr != nil {
+		t.Fatal(keysErr)
+	}
+
+	// The extracted keys prove and verify
+	fullWitness, witnessErr := circuit.NewWitness(secret.FromInt64(12345), big.NewInt(77))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	proof, proveErr := groth16.Prove(ccs, provingKey, fullWitness)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	publicWitness, _ := fullWitness.Public()
+	if verifyErr := groth16.Verify(proof, verifyingKey, publicWitness); verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+
+	verified, verifyErr := Verify(resumed.Manifest, bytes.NewReader(resumed.Transcript()), ccs, provingKey, verifyingKey)
+	if verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+	if len(verified.Contributions) != 4 || verified.Contributions[3].Participant != "dave" || verified.VerifyingKeyHash != resumed.Manifest.VerifyingKeyHash {
+		t.Errorf("verified manifest = %+v", verified)
+	}
+
+	// Tampering with the manifest, the transcript or the keys is caught
+	otherProving, otherVerifying, _ := groth16.Setup(ccs)
+	tamperedHash := resumed.Manifest
+	tamperedHash.Contributions = append([]Contribution(nil), tamperedHash.Contributions...)
+	tamperedHash.Contributions[1].Hash = tamperedHash.Contributions[0].Hash
+	dropped := resumed.Manifest
+	dropped.Contributions = dropped.Contributions[:3]
+	flipped := bytes.Clone(resumed.Transcript())
+	flipped[len(flipped)/2] ^= 1
+	for name, check := range map[string]func() error{
+		"other keys": func() error {
+			_, err := Verify(resumed.Manifest, bytes.NewReader(resumed.Transcript()), ccs, otherProving, otherVerifying)
+			return err
+		},
+		"wrong hash": func() error {
+			_, err := Verify(tamperedHash, bytes.NewReader(resumed.Transcript()), ccs, provingKey, verifyingKey)
+			return err
+		},
+		"unlisted contribution": func() error {
+			_, err := Verify(dropped, bytes.NewReader(resumed.Transcript()), ccs, provingKey, verifyingKey)
+			return err
+		},
+		"flipped bit": func() error {
+			_, err := Verify(resumed.Manifest, bytes.NewReader(flipped), ccs, provingKey, verifyingKey)
+			return err
+		},
+	} {
+		if err := check(); !errors.Is(err, ErrTranscript) {
+			t.Errorf("%s: %v, want ErrTranscript", name, err)
+		}
+	}
+}
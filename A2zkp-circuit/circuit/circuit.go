@@ -0,0 +1,137 @@
+// Package circuit defines the authentication circuit shared by the server and its clients
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	blsfr "github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// Version identifies the constraint system defined by Circuit
+const Version = "v1"
+
+// Curve is the elliptic curve whose scalar field the circuit is compiled over
+const Curve = ecc.BN254
+
+// Circuit defines the structure of the cryptographic circuit used for commitment generation
+type Circuit struct {
+	UserSecret       frontend.Variable `gnark:"user_secret,secret"`       // UserSecret is a private input to the circuit
+	CryptoCommitment frontend.Variable `gnark:"crypto_commitment,public"` // CryptoCommitment is the public output of the circuit
+	Nonce            frontend.Variable `gnark:"nonce,public"`             // Nonce is the server-issued challenge the proof is bound to
+}
+
+// Define specifies the constraint logic of the circuit
+func (c *Circuit) Define(api frontend.API) error {
+	// Constraint: CryptoCommitment = UserSecret^2
+	gadgets.SquareCommitment(api, c.CryptoCommitment, c.UserSecret)
+
+	// Tie the nonce into the constraint system so a proof only verifies for the challenge it was made for
+	gadgets.BindNonce(api, c.Nonce, c.UserSecret)
+	return nil
+}
+
+// Compile compiles the circuit into an R1CS over the scalar field of Curve
+func Compile() (constraint.ConstraintSystem, error) {
+	var circuit Circuit
+	return frontend.Compile(Curve.ScalarField(), r1cs.NewBuilder, &circuit)
+}
+
+// NewWitness assigns the secret, commitment and nonce into a full witness for proving. The
+// commitment is squared in the field, not in int64, so secrets beyond 32 bits don't overflow.
+// The caller still owns userSecret and should zero it once the witness is built.
+func NewWitness(userSecret *secret.Buffer, nonce *big.Int) (witness.Witness, error) {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	var value, square fr.Element
+	secretElement(userSecret, &value)
+	square.Square(&value)
+	fullWitness, witnessErr := fillWitness(&square, nonce, &value)
+
+	// Clear the copies of the values; the witness vector is the only representation left
+	value.SetZero()
+	square.SetZero()
+	return fullWitness, witnessErr
+}
+
+// fillWitness builds a witness laid out as Circuit and ComposedCircuit declare their inputs: the
+// public commitment and nonce, then the secret unless userSecret is nil, which builds the public
+// witness. Filling the vector directly skips the schema reflection and goroutine of
+// frontend.NewWitness, which made up most of the allocations of proving and verifying.
+func fillWitness(commitment any, nonce *big.Int, userSecret *fr.Element) (witness.Witness, error) {
+	if nonce == nil {
+		return nil, errors.New("missing nonce")
+	}
+	fullWitness, newErr := witness.New(Curve.ScalarField())
+	if newErr != nil {
+		return nil, newErr
+	}
+	nbSecret := 0
+	values := make(chan any, 3)
+	values <- commitment
+	values <- nonce
+	if userSecret != nil {
+		values <- userSecret
+		nbSecret = 1
+	}
+	close(values)
+	if fillErr := fullWitness.Fill(2, nbSecret, values); fillErr != nil {
+		return nil, fillErr
+	}
+	return fullWitness, nil
+}
+
+// WipeWitness zeroes every element of a witness vector so the secret doesn't outlive its use
+func WipeWitness(w witness.Witness) {
+	if w == nil {
+		return
+	}
+	switch values := w.Vector().(type) {
+	case fr.Vector:
+		for i := range values {
+			values[i].SetZero()
+		}
+	case blsfr.Vector:
+		for i := range values {
+			values[i].SetZero()
+		}
+	}
+}
+
+// NewPublicWitness assigns the public inputs a verifier knows: the stored commitment and the issued nonce
+func NewPublicWitness(cryptoCommitment string, nonce *big.Int) (witness.Witness, error) {
+	commitment, ok := new(big.Int).SetString(cryptoCommitment, 10)
+	if !ok {
+		return nil, fmt.Errorf("commitment %q is not a decimal field element", cryptoCommitment)
+	}
+	return fillWitness(commitment, nonce, nil)
+}
+
+// GenerateCryptoCommitment generates the commitment for a user secret as a decimal field element
+func GenerateCryptoCommitment(userSecret *secret.Buffer) (string, error) {
+	// Build a witness so the commitment is reduced into the scalar field exactly as the circuit sees it
+	fullWitness, witnessErr := NewWitness(userSecret, big.NewInt(0))
+	if witnessErr != nil {
+		return "", witnessErr
+	}
+	defer WipeWitness(fullWitness)
+	publicWitness, publicErr := fullWitness.Public()
+	if publicErr != nil {
+		return "", publicErr
+	}
+
+	// Public inputs are ordered as declared: crypto_commitment comes first
+	publicValues := publicWitness.Vector().(fr.Vector)
+	return publicValues[0].String(), nil
+}
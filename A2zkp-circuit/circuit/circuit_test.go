@@ -0,0 +1,528 @@
+package circuit
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	blsfr "github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/schema"
+)
+
+func TestGenerateCryptoCommitmentSquaresTheSecret(t *testing.T) {
+	commitment, commitErr := GenerateCryptoCommitment(secret.FromInt64(12345))
+	if commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	if commitment != "152399025" {
+		t.Errorf("commitment = %s, want 152399025", commitment)
+	}
+
+	// The square of a secret beyond 32 bits doesn't fit an int64
+	large, largeErr := GenerateCryptoCommitment(secret.FromInt64(9876543210))
+	if largeErr != nil || large != "97546105778997104100" {
+		t.Errorf("commitment = %s, %v, want 97546105778997104100", large, largeErr)
+	}
+
+	// The largest secret's commitment is its square reduced into the field
+	maxSecret := big.NewInt(secret.MaxInt)
+	want := new(big.Int).Mod(new(big.Int).Mul(maxSecret, maxSecret), fr.Modulus()).String()
+	if largest, largestErr := GenerateCryptoCommitment(secret.FromInt64(secret.MaxInt)); largestErr != nil || largest != want {
+		t.Errorf("commitment = %s, %v, want %s", largest, largestErr, want)
+	}
+}
+
+func TestSecretDomain(t *testing.T) {
+	// -s would share the commitment of s and 0 commits to 0, so neither is a secret
+	for _, value := range []int64{0, -1, -12345, math.MinInt64} {
+		if _, commitErr := GenerateCryptoCommitment(secret.FromInt64(value)); !errors.Is(commitErr, secret.ErrOutOfRange) {
+			t.Errorf("commitment of %d: %v, want ErrOutOfRange", value, commitErr)
+		}
+		if _, witnessErr := NewWitness(secret.FromInt64(value), big.NewInt(1)); !errors.Is(witnessErr, secret.ErrOutOfRange) {
+			t.Errorf("witness of %d: %v, want ErrOutOfRange", value, witnessErr)
+		}
+	}
+
+	for text, want := range map[string]error{
+		"1": nil, "+42": nil, "9223372036854775807": nil, "00000000000000000000042": nil,
+		"0": secret.ErrOutOfRange, "-5": secret.ErrOutOfRange, "-9223372036854775808": secret.ErrOutOfRange,
+		"9223372036854775808": secret.ErrOutOfRange, "18446744073709551621": secret.ErrOutOfRange, strings.Repeat("9", 100): secret.ErrOutOfRange,
+		"": secret.ErrInvalid, "-": secret.ErrInvalid, "12a": secret.ErrInvalid, "1.5": secret.ErrInvalid,
+	} {
+		parsed, parseErr := secret.Parse([]byte(text))
+		if !errors.Is(parseErr, want) || (parseErr == nil) != (want == nil) {
+			t.Errorf("Parse(%q) = %v, want %v", text, parseErr, want)
+		}
+		if parsed != nil && parsed.Check() != nil {
+			t.Errorf("Parse(%q) returned a secret that fails Check", text)
+		}
+	}
+
+	zeroed := secret.FromInt64(12345)
+	zeroed.Zero()
+	if _, commitErr := GenerateCryptoCommitment(zeroed); !errors.Is(commitErr, secret.ErrZeroed) {
+		t.Errorf("commitment of a zeroed secret: %v, want ErrZeroed", commitErr)
+	}
+}
+
+func TestWitnessSatisfiesCircuit(t *testing.T) {
+	ccs, compileErr := Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	fullWitness, witnessErr := NewWitness(secret.FromInt64(7), big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest witness rejected: %v", solveErr)
+	}
+}
+
+func TestWrongCommitmentDoesNotSatisfyCircuit(t *testing.T) {
+	ccs, compileErr := Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	assignment := Circuit{UserSecret: 7, CryptoCommitment: 50, Nonce: 99}
+	fullWitness, witnessErr := frontend.NewWitness(&assignment, Curve.ScalarField())
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if ccs.IsSolved(fullWitness) == nil {
+		t.Error("witness with 50 != 7^2 was accepted")
+	}
+}
+
+func TestPublicWitnessOrder(t *testing.T) {
+	publicWitness, witnessErr := NewPublicWitness("49", big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	values := publicWitness.Vector().(fr.Vector)
+	if len(values) != 2 || values[0].String() != "49" || values[1].String() != "99" {
+		t.Errorf("public inputs = %v, want [49 99]", values)
+	}
+
+	if _, badErr := NewPublicWitness("not a number", big.NewInt(1)); badErr == nil {
+		t.Error("non-decimal commitment accepted")
+	}
+}
+
+func TestWipeWitness(t *testing.T) {
+	fullWitness, witnessErr := NewWitness(secret.FromInt64(7), big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	WipeWitness(fullWitness)
+	for i, value := range fullWitness.Vector().(fr.Vector) {
+		if !value.IsZero() {
+			t.Errorf("element %d not wiped", i)
+		}
+	}
+	WipeWitness(nil)
+}
+
+func TestDeviceWitnessSatisfiesCircuit(t *testing.T) {
+	ccs, compileErr := CompileDevice()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	fullWitness, witnessErr := NewDeviceWitness(secret.FromInt64(7), "device-a", big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest device witness rejected: %v", solveErr)
+	}
+
+	commitment, commitErr := GenerateDeviceCommitment(secret.FromInt64(7), "device-a")
+	if commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	publicWitness, publicErr := fullWitness.Public()
+	if publicErr != nil {
+		t.Fatal(publicErr)
+	}
+	deviceA, _ := DeviceIDElement("device-a")
+	values := publicWitness.Vector().(fr.Vector)
+	if len(values) != 3 || values[0].String() != commitment || values[1].String() != "99" || values[2].String() != deviceA.String() {
+		t.Errorf("public inputs = %v, want [%s 99 %s]", values, commitment, deviceA)
+	}
+}
+
+func TestDeviceCommitmentBindsTheDevice(t *testing.T) {
+	ccs, compileErr := CompileDevice()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	commitmentA, _ := GenerateDeviceCommitment(secret.FromInt64(7), "device-a")
+	commitmentB, _ := GenerateDeviceCommitment(secret.FromInt64(7), "device-b")
+	if commitmentA == commitmentB {
+		t.Fatal("two devices got the same commitment")
+	}
+
+	// the commitment registered for device A doesn't hold for device B's identifier
+	deviceA, _ := DeviceIDElement("device-a")
+	deviceB, _ := DeviceIDElement("device-b")
+	commitment, _ := new(big.Int).SetString(commitmentA, 10)
+	for _, tt := range []struct {
+		name   string
+		device *big.Int
+		want   bool
+	}{{"same device", deviceA, true}, {"other device", deviceB, false}} {
+		assignment := DeviceCircuit{UserSecret: 7, CryptoCommitment: commitment, Nonce: 99, DeviceID: tt.device}
+		fullWitness, witnessErr := frontend.NewWitness(&assignment, Curve.ScalarField())
+		if witnessErr != nil {
+			t.Fatal(witnessErr)
+		}
+		if solved := ccs.IsSolved(fullWitness) == nil; solved != tt.want {
+			t.Errorf("%s: solved = %v, want %v", tt.name, solved, tt.want)
+		}
+	}
+
+	if _, emptyErr := NewDeviceWitness(secret.FromInt64(7), "", big.NewInt(1)); emptyErr == nil {
+		t.Error("empty device ID accepted")
+	}
+	if _, badErr := NewDevicePublicWitness("not a number", "device-a", big.NewInt(1)); badErr == nil {
+		t.Error("non-decimal commitment accepted")
+	}
+}
+
+func TestGroupWitnessSatisfiesCircuit(t *testing.T) {
+	ccs, compileErr := CompileGroup()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	var members []string
+	for _, value := range []int64{7, 11, 13} {
+		commitment, _ := GenerateCryptoCommitment(secret.FromInt64(value))
+		members = append(members, commitment)
+	}
+	tree, treeErr := NewGroupTree(append(members, members[0]))
+	if treeErr != nil {
+		t.Fatal(treeErr)
+	}
+	if got := tree.Members(); len(got) != 3 || got[0] != "49" {
+		t.Errorf("members = %v, want 3 distinct in ascending order", got)
+	}
+
+	fullWitness, witnessErr := NewGroupWitness(secret.FromInt64(11), tree, "acme", 5, big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest group witness rejected: %v", solveErr)
+	}
+	nullifier, _ := GroupNullifier(secret.FromInt64(11), "acme", 5)
+	publicWitness, publicErr := fullWitness.Public()
+	if publicErr != nil {
+		t.Fatal(publicErr)
+	}
+	values := publicWitness.Vector().(fr.Vector)
+	if len(values) != 5 || values[0].String() != tree.Root() || values[2].String() != "5" || values[4].String() != nullifier {
+		t.Errorf("public inputs = %v, want [%s group 5 99 %s]", values, tree.Root(), nullifier)
+	}
+
+	// The nullifier changes with the epoch and group, and non-members have no path
+	if other, _ := GroupNullifier(secret.FromInt64(11), "acme", 6); other == nullifier {
+		t.Error("nullifier is the same in two epochs")
+	}
+	if other, _ := GroupNullifier(secret.FromInt64(11), "globex", 5); other == nullifier {
+		t.Error("nullifier is the same in two groups")
+	}
+	if _, memberErr := NewGroupWitness(secret.FromInt64(12), tree, "acme", 5, big.NewInt(99)); memberErr == nil {
+		t.Error("built a witness for a non-member")
+	}
+	if empty, _ := NewGroupTree(nil); empty.Root() == tree.Root() {
+		t.Error("empty tree has the root of a populated one")
+	}
+}
+
+func TestPolicyCircuitRefusesWeakSecrets(t *testing.T) {
+	ccs, compileErr := CompilePolicy()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	policy := SecretPolicy{MinBits: 20, Denylist: []int64{1 << 20, 123456789}}
+	fullWitness, witnessErr := NewPolicyWitness(secret.FromInt64(987654321), policy)
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("strong secret rejected: %v", solveErr)
+	}
+
+	// Weak secrets are refused natively, zero already by the secret domain, and a witness built
+	// around the check doesn't solve
+	for _, weak := range []int64{0, 1000, 1 << 20, 123456789} {
+		wantErr := ErrWeakSecret
+		if weak < secret.MinInt {
+			wantErr = secret.ErrOutOfRange
+		}
+		if _, weakErr := NewPolicyWitness(secret.FromInt64(weak), policy); !errors.Is(weakErr, wantErr) {
+			t.Errorf("secret %d: NewPolicyWitness = %v, want %v", weak, weakErr, wantErr)
+		}
+		assignment := PolicyCircuit{UserSecret: weak, CryptoCommitment: weak * weak}
+		policy.assign(&assignment)
+		forged, forgeErr := frontend.NewWitness(&assignment, Curve.ScalarField())
+		if forgeErr != nil {
+			t.Fatal(forgeErr)
+		}
+		if ccs.IsSolved(forged) == nil {
+			t.Errorf("secret %d satisfies the policy circuit", weak)
+		}
+	}
+
+	// A weak secret's negation has the same commitment but is not the root the circuit accepts
+	negated := PolicyCircuit{UserSecret: new(big.Int).Sub(fr.Modulus(), big.NewInt(1000)), CryptoCommitment: 1000 * 1000}
+	policy.assign(&negated)
+	forged, _ := frontend.NewWitness(&negated, Curve.ScalarField())
+	if ccs.IsSolved(forged) == nil {
+		t.Error("the negation of a weak secret satisfies the policy circuit")
+	}
+	negatedStrong := new(big.Int).Sub(fr.Modulus(), big.NewInt(987654321)).FillBytes(make([]byte, fr.Bytes))
+	if strong, _ := NewPolicyWitness(secret.FromFieldBytes(negatedStrong), policy); strong == nil || ccs.IsSolved(strong) != nil {
+		t.Error("the negation of a strong secret is refused")
+	}
+
+	if (SecretPolicy{MinBits: MaxPolicyBits + 1}).Validate() == nil {
+		t.Error("min_bits beyond the field accepted")
+	}
+}
+
+func TestDefaultCompositionIsCircuit(t *testing.T) {
+	var encoded [2]bytes.Buffer
+	for i, compile := range []func() (constraint.ConstraintSystem, error){Compile, DefaultComposition.Compile} {
+		ccs, compileErr := compile()
+		if compileErr != nil {
+			t.Fatal(compileErr)
+		}
+		ccs.WriteTo(&encoded[i])
+	}
+	if !bytes.Equal(encoded[0].Bytes(), encoded[1].Bytes()) {
+		t.Error("the default composition compiles to another constraint system than Circuit")
+	}
+	if version := (Composition{BindNonce: true}).Version(); version != Version {
+		t.Errorf("default composition version = %s, want %s", version, Version)
+	}
+}
+
+func TestComposedCircuit(t *testing.T) {
+	composition := Composition{Commitment: CommitmentMiMC, BindNonce: true, Range: "0..999999"}
+	if version := composition.Version(); !strings.HasPrefix(version, "c-") || version == (Composition{Commitment: CommitmentMiMC}).Version() {
+		t.Errorf("version = %s, want a c- hash distinct from other compositions", version)
+	}
+	ccs, compileErr := composition.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	fullWitness, witnessErr := composition.NewWitness(secret.FromInt64(123456), big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest witness rejected: %v", solveErr)
+	}
+
+	// The committed value is the MiMC hash, matching the witness's public input
+	commitment, _ := composition.GenerateCommitment(secret.FromInt64(123456))
+	publicWitness, _ := fullWitness.Public()
+	if values := publicWitness.Vector().(fr.Vector); values[0].String() != commitment {
+		t.Errorf("witness commitment = %s, GenerateCommitment = %s", values[0].String(), commitment)
+	}
+
+	// Secrets outside the range are refused natively and by the constraints
+	if _, rangeErr := composition.NewWitness(secret.FromInt64(1000000), big.NewInt(99)); !errors.Is(rangeErr, ErrSecretOutOfRange) {
+		t.Errorf("out-of-range secret = %v, want ErrSecretOutOfRange", rangeErr)
+	}
+	var value, hashed fr.Element
+	value.SetInt64(1000000)
+	composition.commit(&value, &hashed)
+	forged, _ := composition.Circuit()
+	forged.UserSecret, forged.CryptoCommitment, forged.Nonce = 1000000, &hashed, 99
+	forgedWitness, _ := frontend.NewWitness(forged, Curve.ScalarField())
+	if ccs.IsSolved(forgedWitness) == nil {
+		t.Error("out-of-range secret satisfies the composed circuit")
+	}
+
+	// PublicInputs names the public fields of the circuit in witness order
+	circuitSchema, schemaErr := frontend.NewSchema(forged)
+	if schemaErr != nil {
+		t.Fatal(schemaErr)
+	}
+	var public []string
+	for _, field := range circuitSchema.Fields {
+		if field.Visibility == schema.Public {
+			public = append(public, field.NameTag)
+		}
+	}
+	inputs := composition.PublicInputs()
+	if len(public) != len(inputs) || len(public) != ccs.GetNbPublicVariables()-1 {
+		t.Fatalf("public fields = %v, PublicInputs = %v", public, inputs)
+	}
+	for i, input := range inputs {
+		if input.Name != public[i] || input.Encoding != EncodingDecimal {
+			t.Errorf("public input %d = %+v, want %s in decimal", i, input, public[i])
+		}
+	}
+
+	for _, invalid := range []Composition{{Commitment: "sha256"}, {Range: "9..1"}, {Range: "0-9"}, {Range: "-1..5"}} {
+		if invalid.Validate() == nil {
+			t.Errorf("composition %+v accepted", invalid)
+		}
+	}
+}
+
+func TestComposedDomain(t *testing.T) {
+	composition := Composition{Commitment: CommitmentMiMC, BindNonce: true, Domain: "com.example.auth"}
+	undomained := Composition{Commitment: CommitmentMiMC, BindNonce: true}
+	if composition.Version() == undomained.Version() || composition.Version() == (Composition{Commitment: CommitmentMiMC, BindNonce: true, Domain: "com.example.other"}).Version() {
+		t.Error("the domain doesn't change the circuit version")
+	}
+	ccs, compileErr := composition.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	fullWitness, witnessErr := composition.NewWitness(secret.FromInt64(123456), big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest witness rejected: %v", solveErr)
+	}
+
+	// The commitment is the hash of the tag and the secret, and differs from the untagged one
+	commitment, _ := composition.GenerateCommitment(secret.FromInt64(123456))
+	plain, _ := undomained.GenerateCommitment(secret.FromInt64(123456))
+	var value fr.Element
+	value.SetInt64(123456)
+	tag := gadgets.DomainTag("com.example.auth")
+	if want := gadgets.NativeMiMC(&tag, &value); commitment != want.String() || commitment == plain {
+		t.Errorf("commitment = %s, want MiMC(tag, secret) = %s distinct from %s", commitment, want.String(), plain)
+	}
+
+	// A commitment from another domain doesn't satisfy this circuit
+	forged, _ := composition.Circuit()
+	plainValue, _ := new(big.Int).SetString(plain, 10)
+	forged.UserSecret, forged.CryptoCommitment, forged.Nonce = 123456, plainValue, 99
+	forgedWitness, _ := frontend.NewWitness(forged, Curve.ScalarField())
+	if ccs.IsSolved(forgedWitness) == nil {
+		t.Error("an untagged commitment satisfies the domain-separated circuit")
+	}
+
+	for _, invalid := range []Composition{{Domain: "com.example.auth"}, {Commitment: CommitmentMiMC, Domain: "tab\there"}, {Commitment: CommitmentMiMC, Domain: strings.Repeat("a", MaxDomainLength+1)}} {
+		if invalid.Validate() == nil {
+			t.Errorf("composition %+v accepted", invalid)
+		}
+	}
+}
+
+func TestCircuitOnBLS12_381(t *testing.T) {
+	if curve, parseErr := ParseCurve("bls12_381"); parseErr != nil || curve != ecc.BLS12_381 {
+		t.Fatalf("ParseCurve(bls12_381) = %v, %v", curve, parseErr)
+	}
+	if _, parseErr := ParseCurve("bw6_761"); !errors.Is(parseErr, ErrCurveUnsupported) {
+		t.Errorf("ParseCurve(bw6_761) = %v, want ErrCurveUnsupported", parseErr)
+	}
+
+	composition := Composition{BindNonce: true, Range: "0..999999"}
+	ccs, compileErr := composition.CompileOn(ecc.BLS12_381)
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	fullWitness, witnessErr := composition.NewWitnessOn(ecc.BLS12_381, secret.FromInt64(123456), big.NewInt(99))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		t.Errorf("honest witness rejected: %v", solveErr)
+	}
+
+	// The public inputs are the commitment registered on the curve and the nonce
+	commitment, _ := composition.GenerateCommitmentOn(ecc.BLS12_381, secret.FromInt64(123456))
+	if commitment != "15241383936" {
+		t.Errorf("commitment = %s, want 123456^2", commitment)
+	}
+	publicWitness, _ := NewPublicWitnessOn(ecc.BLS12_381, commitment, big.NewInt(99))
+	if values := publicWitness.Vector().(blsfr.Vector); len(values) != 2 || values[0].String() != commitment || values[1].String() != "99" {
+		t.Errorf("public inputs = %v, want [%s 99]", values, commitment)
+	}
+
+	if _, rangeErr := composition.NewWitnessOn(ecc.BLS12_381, secret.FromInt64(1000000), big.NewInt(99)); !errors.Is(rangeErr, ErrSecretOutOfRange) {
+		t.Errorf("out-of-range secret = %v, want ErrSecretOutOfRange", rangeErr)
+	}
+	if _, mimcErr := (Composition{Commitment: CommitmentMiMC}).CompileOn(ecc.BLS12_381); !errors.Is(mimcErr, ErrCurveUnsupported) {
+		t.Errorf("MiMC commitment over BLS12-381 = %v, want ErrCurveUnsupported", mimcErr)
+	}
+
+	WipeWitness(fullWitness)
+	for i, value := range fullWitness.Vector().(blsfr.Vector) {
+		if !value.IsZero() {
+			t.Errorf("element %d not wiped", i)
+		}
+	}
+}
+
+func TestFilledWitnessMatchesAssignment(t *testing.T) {
+	fullWitness, _ := NewWitness(secret.FromInt64(7), big.NewInt(99))
+	assignment := Circuit{UserSecret: 7, CryptoCommitment: 49, Nonce: 99}
+	reflected, _ := frontend.NewWitness(&assignment, Curve.ScalarField())
+	filled, _ := fullWitness.MarshalBinary()
+	want, _ := reflected.MarshalBinary()
+	if !bytes.Equal(filled, want) {
+		t.Error("filled witness differs from the one frontend.NewWitness assigns")
+	}
+	if _, nonceErr := NewPublicWitness("49", nil); nonceErr == nil {
+		t.Error("public witness without a nonce accepted")
+	}
+}
+
+// BenchmarkNewWitness compares filling the witness vector with assigning it through
+// frontend.NewWitness, which walks the circuit's schema by reflection
+func BenchmarkNewWitness(b *testing.B) {
+	userSecret, nonce := secret.FromInt64(12345), big.NewInt(99)
+	b.Run("filled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			fullWitness, _ := NewWitness(userSecret, nonce)
+			WipeWitness(fullWitness)
+		}
+	})
+	b.Run("reflection", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			assignment := Circuit{UserSecret: 12345, CryptoCommitment: 12345 * 12345, Nonce: nonce}
+			fullWitness, _ := frontend.NewWitness(&assignment, Curve.ScalarField())
+			WipeWitness(fullWitness)
+		}
+	})
+}
+
+// BenchmarkNewPublicWitness measures the public witness a verifier builds for each pairing check
+func BenchmarkNewPublicWitness(b *testing.B) {
+	nonce := big.NewInt(99)
+	b.Run("filled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			NewPublicWitness("152399025", nonce)
+		}
+	})
+	b.Run("reflection", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			assignment := Circuit{CryptoCommitment: 152399025, Nonce: nonce}
+			frontend.NewWitness(&assignment, Curve.ScalarField(), frontend.PublicOnly())
+		}
+	})
+}
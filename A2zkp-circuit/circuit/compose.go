@@ -0,0 +1,291 @@
+package circuit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+)
+
+// Commitment gadgets a Composition may name
+const (
+	CommitmentSquare = "square" // CommitmentSquare commits to secret², as Circuit does
+	CommitmentMiMC   = "mimc"   // CommitmentMiMC commits to the MiMC hash of the secret
+)
+
+// composedVersionPrefix starts the version of every composition other than DefaultComposition
+const composedVersionPrefix = "c-"
+
+// MaxDomainLength bounds the domain of a Composition
+const MaxDomainLength = 128
+
+// ErrSecretOutOfRange is returned for a secret outside the range of a Composition
+var ErrSecretOutOfRange = errors.New("secret is outside the circuit's range")
+
+// Composition assembles an authentication circuit from named gadgets. Whatever the gadgets, the
+// circuit's public inputs are crypto_commitment then nonce, as for Circuit, so proofs, public
+// witnesses and verifiers work unchanged.
+type Composition struct {
+	Commitment string `json:"commitment"` // Commitment is CommitmentSquare (the default when empty) or CommitmentMiMC
+	BindNonce  bool   `json:"bind_nonce"` // BindNonce ties the nonce in; without it proofs replay against any challenge
+	// Range bounds the secret as "min..max", e.g. "0..999999"; empty for none
+	Range string `json:"range"`
+	// Domain separates the commitments of this service from those of other protocols hashing the
+	// same secret, e.g. "com.example.auth"; it needs CommitmentMiMC. Empty for none.
+	Domain string `json:"domain,omitempty"`
+}
+
+// DefaultComposition assembles Circuit: a square commitment bound to the nonce. It compiles to the
+// same constraint system and keeps the version Version.
+var DefaultComposition = Composition{Commitment: CommitmentSquare, BindNonce: true}
+
+// ComposedCircuit is the circuit a Composition assembles. Build it with Composition.Circuit, since
+// Define needs the composition.
+type ComposedCircuit struct {
+	UserSecret       frontend.Variable `gnark:"user_secret,secret"`
+	CryptoCommitment frontend.Variable `gnark:"crypto_commitment,public"`
+	Nonce            frontend.Variable `gnark:"nonce,public"`
+
+	composition Composition
+	min, max    *big.Int // min and max are the parsed range; nil without one
+	tag         *big.Int // tag is the domain tag; nil without a domain
+}
+
+// Define adds the constraints of each gadget of the composition, in the order Circuit does
+func (c *ComposedCircuit) Define(api frontend.API) error {
+	switch c.composition.commitment() {
+	case CommitmentSquare:
+		gadgets.SquareCommitment(api, c.CryptoCommitment, c.UserSecret)
+	case CommitmentMiMC:
+		var commitmentErr error
+		if c.tag != nil {
+			commitmentErr = gadgets.DomainCommitment(api, c.CryptoCommitment, c.tag, c.UserSecret)
+		} else {
+			commitmentErr = gadgets.MiMCCommitment(api, c.CryptoCommitment, c.UserSecret)
+		}
+		if commitmentErr != nil {
+			return commitmentErr
+		}
+	default:
+		return fmt.Errorf("unknown commitment gadget %q", c.composition.Commitment)
+	}
+	if c.composition.BindNonce {
+		gadgets.BindNonce(api, c.Nonce, c.UserSecret)
+	}
+	if c.min != nil {
+		gadgets.AssertInRange(api, c.UserSecret, c.min, c.max)
+	}
+	return nil
+}
+
+// commitment is the commitment gadget, CommitmentSquare when none is named
+func (c Composition) commitment() string {
+	if c.Commitment == "" {
+		return CommitmentSquare
+	}
+	return c.Commitment
+}
+
+// bounds parses Range, returning nil bounds when it is empty
+func (c Composition) bounds() (*big.Int, *big.Int, error) {
+	if c.Range == "" {
+		return nil, nil, nil
+	}
+	minText, maxText, found := strings.Cut(c.Range, "..")
+	min, minOK := new(big.Int).SetString(strings.TrimSpace(minText), 10)
+	max, maxOK := new(big.Int).SetString(strings.TrimSpace(maxText), 10)
+	switch {
+	case !found || !minOK || !maxOK:
+		return nil, nil, fmt.Errorf("range %q is not of the form min..max", c.Range)
+	case min.Sign() < 0 || max.Cmp(fr.Modulus()) >= 0:
+		return nil, nil, fmt.Errorf("range %q must lie within the scalar field", c.Range)
+	case min.Cmp(max) > 0:
+		return nil, nil, fmt.Errorf("range %q is empty", c.Range)
+	}
+	return min, max, nil
+}
+
+// Validate checks the gadget names, the range and the domain
+func (c Composition) Validate() error {
+	commitment := c.commitment()
+	if commitment != CommitmentSquare && commitment != CommitmentMiMC {
+		return fmt.Errorf("commitment must be %q or %q, not %q", CommitmentSquare, CommitmentMiMC, c.Commitment)
+	}
+	if _, _, rangeErr := c.bounds(); rangeErr != nil {
+		return rangeErr
+	}
+	switch {
+	case c.Domain == "":
+	case commitment != CommitmentMiMC:
+		// A square involves no hash another protocol could share, so there is nothing to separate
+		return fmt.Errorf("domain needs the %q commitment", CommitmentMiMC)
+	case len(c.Domain) > MaxDomainLength:
+		return fmt.Errorf("domain exceeds %d bytes", MaxDomainLength)
+	case !utf8.ValidString(c.Domain) || strings.ContainsFunc(c.Domain, unicode.IsControl):
+		return errors.New("domain must be UTF-8 text without control characters")
+	}
+	return nil
+}
+
+// String is the canonical form of the composition, e.g.
+// "commitment=mimc,bind_nonce=true,range=0..999999,domain="com.example.auth""
+func (c Composition) String() string {
+	text := fmt.Sprintf("commitment=%s,bind_nonce=%t", c.commitment(), c.BindNonce)
+	if min, max, rangeErr := c.bounds(); rangeErr == nil && min != nil {
+		text += fmt.Sprintf(",range=%s..%s", min, max)
+	}
+	if c.Domain != "" {
+		// Quoted, so a domain can't pass for further gadgets
+		text += fmt.Sprintf(",domain=%q", c.Domain)
+	}
+	return text
+}
+
+// Version identifies the composed constraint system: Version for DefaultComposition, otherwise
+// "c-" followed by a prefix of the SHA-256 of the canonical form. Compositions that differ only
+// in spelling, such as an empty commitment and "square", share a version.
+func (c Composition) Version() string {
+	if c.String() == DefaultComposition.String() {
+		return Version
+	}
+	digest := sha256.Sum256([]byte(c.String()))
+	return composedVersionPrefix + hex.EncodeToString(digest[:8])
+}
+
+// Statement describes in words what a proof of the composed circuit shows
+func (c Composition) Statement() string {
+	statement := "crypto_commitment = user_secret^2"
+	switch {
+	case c.commitment() == CommitmentMiMC && c.Domain != "":
+		statement = fmt.Sprintf("crypto_commitment = MiMC(SHA-256(%q), user_secret)", c.Domain)
+	case c.commitment() == CommitmentMiMC:
+		statement = "crypto_commitment = MiMC(user_secret)"
+	}
+	if c.BindNonce {
+		statement += ", bound to a public nonce"
+	}
+	if min, max, rangeErr := c.bounds(); rangeErr == nil && min != nil {
+		statement += fmt.Sprintf(", with %s <= user_secret <= %s", min, max)
+	}
+	return statement
+}
+
+// EncodingDecimal is how the API writes public inputs: a field element in base 10
+const EncodingDecimal = "decimal"
+
+// PublicInput is a public input of the composed circuit
+type PublicInput struct {
+	Name     string `json:"name"`     // Name is the input's gnark tag, e.g. "crypto_commitment"
+	Encoding string `json:"encoding"` // Encoding is how requests and responses write the input
+}
+
+// PublicInputs lists the public inputs in public witness order. Every composition has the same
+// two, so the list only changes along with the witness layout.
+func (c Composition) PublicInputs() []PublicInput {
+	return []PublicInput{
+		{Name: "crypto_commitment", Encoding: EncodingDecimal},
+		{Name: "nonce", Encoding: EncodingDecimal},
+	}
+}
+
+// Circuit returns the composed circuit, ready to compile or assign
+func (c Composition) Circuit() (*ComposedCircuit, error) {
+	if validateErr := c.Validate(); validateErr != nil {
+		return nil, validateErr
+	}
+	min, max, _ := c.bounds()
+	circuit := &ComposedCircuit{composition: c, min: min, max: max}
+	if c.Domain != "" {
+		tag := gadgets.DomainTag(c.Domain)
+		circuit.tag = tag.BigInt(new(big.Int))
+	}
+	return circuit, nil
+}
+
+// Compile compiles the composed circuit into an R1CS over the scalar field of Curve
+func (c Composition) Compile() (constraint.ConstraintSystem, error) {
+	circuit, circuitErr := c.Circuit()
+	if circuitErr != nil {
+		return nil, circuitErr
+	}
+	return frontend.Compile(Curve.ScalarField(), r1cs.NewBuilder, circuit)
+}
+
+// CompileSparse compiles the composed circuit into the sparse R1CS a PLONK setup takes, over the
+// scalar field of Curve. Witnesses are the same as for Compile.
+func (c Composition) CompileSparse() (constraint.ConstraintSystem, error) {
+	circuit, circuitErr := c.Circuit()
+	if circuitErr != nil {
+		return nil, circuitErr
+	}
+	return frontend.Compile(Curve.ScalarField(), scs.NewBuilder, circuit)
+}
+
+// commit writes the commitment of a secret element into dst, matching Define
+func (c Composition) commit(value, dst *fr.Element) {
+	if c.commitment() == CommitmentMiMC && c.Domain != "" {
+		tag := gadgets.DomainTag(c.Domain)
+		*dst = gadgets.NativeMiMC(&tag, value)
+		return
+	}
+	if c.commitment() == CommitmentMiMC {
+		*dst = gadgets.NativeMiMC(value)
+		return
+	}
+	dst.Square(value)
+}
+
+// GenerateCommitment computes the commitment to register for a secret under the composition
+func (c Composition) GenerateCommitment(userSecret *secret.Buffer) (string, error) {
+	if validateErr := c.Validate(); validateErr != nil {
+		return "", validateErr
+	}
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return "", checkErr
+	}
+	var value, commitment fr.Element
+	secretElement(userSecret, &value)
+	defer value.SetZero()
+	c.commit(&value, &commitment)
+	return commitment.String(), nil
+}
+
+// NewWitness assigns the secret, its commitment and the nonce into a full witness for the
+// composed circuit. A secret outside the range yields ErrSecretOutOfRange. The caller still owns
+// userSecret and should zero it once the witness is built.
+func (c Composition) NewWitness(userSecret *secret.Buffer, nonce *big.Int) (witness.Witness, error) {
+	assignment, circuitErr := c.Circuit()
+	if circuitErr != nil {
+		return nil, circuitErr
+	}
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	var value, commitment fr.Element
+	secretElement(userSecret, &value)
+	defer value.SetZero()
+	if assignment.min != nil {
+		number := value.BigInt(new(big.Int))
+		outside := number.Cmp(assignment.min) < 0 || number.Cmp(assignment.max) > 0
+		number.SetInt64(0)
+		if outside {
+			return nil, fmt.Errorf("%w %s", ErrSecretOutOfRange, c.Range)
+		}
+	}
+	c.commit(&value, &commitment)
+	return fillWitness(&commitment, nonce, &value)
+}
@@ -0,0 +1,124 @@
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// Curves lists the curves a Composition can be compiled over: Curve, and BLS12-381 for
+// deployments whose commitments were registered on it
+var Curves = []ecc.ID{Curve, ecc.BLS12_381}
+
+// ErrCurveUnsupported is returned for a curve a composition can't be compiled over
+var ErrCurveUnsupported = errors.New("unsupported curve")
+
+// ParseCurve returns the curve of Curves with a name as gnark spells it, e.g. "bn254" or "bls12_381"
+func ParseCurve(name string) (ecc.ID, error) {
+	curve, parseErr := ecc.IDFromString(name)
+	if parseErr != nil || !slices.Contains(Curves, curve) {
+		return ecc.UNKNOWN, fmt.Errorf("%w %q", ErrCurveUnsupported, name)
+	}
+	return curve, nil
+}
+
+// CheckCurve reports whether the composition can be compiled over a curve. Only the square
+// commitment exists on every curve: the MiMC one hashes with BN254 round constants outside the circuit.
+func (c Composition) CheckCurve(curve ecc.ID) error {
+	switch {
+	case !slices.Contains(Curves, curve):
+		return fmt.Errorf("%w %s", ErrCurveUnsupported, curve)
+	case curve != Curve && c.commitment() != CommitmentSquare:
+		return fmt.Errorf("%w: the %s commitment is only available on %s", ErrCurveUnsupported, c.commitment(), Curve)
+	}
+	return c.Validate()
+}
+
+// CompileOn compiles the composed circuit into an R1CS over the scalar field of curve
+func (c Composition) CompileOn(curve ecc.ID) (constraint.ConstraintSystem, error) {
+	if curve == Curve {
+		return c.Compile()
+	}
+	if curveErr := c.CheckCurve(curve); curveErr != nil {
+		return nil, curveErr
+	}
+	circuit, _ := c.Circuit()
+	return frontend.Compile(curve.ScalarField(), r1cs.NewBuilder, circuit)
+}
+
+// squareOn returns the secret as an integer and its square reduced into the scalar field of curve.
+// The secret is the element Curve's witnesses use, which is below every modulus of Curves.
+func squareOn(curve ecc.ID, userSecret *secret.Buffer) (*big.Int, *big.Int) {
+	var element fr.Element
+	secretElement(userSecret, &element)
+	value := element.BigInt(new(big.Int))
+	element.SetZero()
+	square := new(big.Int).Mul(value, value)
+	return value, square.Mod(square, curve.ScalarField())
+}
+
+// GenerateCommitmentOn computes the commitment to register for a secret under the composition on curve
+func (c Composition) GenerateCommitmentOn(curve ecc.ID, userSecret *secret.Buffer) (string, error) {
+	if curve == Curve {
+		return c.GenerateCommitment(userSecret)
+	}
+	if curveErr := c.CheckCurve(curve); curveErr != nil {
+		return "", curveErr
+	}
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return "", checkErr
+	}
+	value, commitment := squareOn(curve, userSecret)
+	value.SetInt64(0)
+	return commitment.String(), nil
+}
+
+// NewWitnessOn assigns the secret, its commitment and the nonce into a full witness for the
+// composed circuit compiled over curve. The caller still owns userSecret and should zero it once
+// the witness is built.
+func (c Composition) NewWitnessOn(curve ecc.ID, userSecret *secret.Buffer, nonce *big.Int) (witness.Witness, error) {
+	if curve == Curve {
+		return c.NewWitness(userSecret, nonce)
+	}
+	if curveErr := c.CheckCurve(curve); curveErr != nil {
+		return nil, curveErr
+	}
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	assignment, _ := c.Circuit()
+	value, commitment := squareOn(curve, userSecret)
+	defer value.SetInt64(0)
+	if assignment.min != nil && (value.Cmp(assignment.min) < 0 || value.Cmp(assignment.max) > 0) {
+		return nil, fmt.Errorf("%w %s", ErrSecretOutOfRange, c.Range)
+	}
+	assignment.UserSecret, assignment.CryptoCommitment, assignment.Nonce = value, commitment, nonce
+	return frontend.NewWitness(assignment, curve.ScalarField())
+}
+
+// NewPublicWitnessOn assigns the public inputs of a proof made over curve, as NewPublicWitness
+// does for Curve
+func NewPublicWitnessOn(curve ecc.ID, cryptoCommitment string, nonce *big.Int) (witness.Witness, error) {
+	if curve == Curve {
+		return NewPublicWitness(cryptoCommitment, nonce)
+	}
+	commitment, ok := new(big.Int).SetString(cryptoCommitment, 10)
+	if !ok {
+		return nil, fmt.Errorf("commitment %q is not a decimal field element", cryptoCommitment)
+	}
+	assignment := Circuit{
+		CryptoCommitment: commitment,
+		Nonce:            nonce,
+	}
+	return frontend.NewWitness(&assignment, curve.ScalarField(), frontend.PublicOnly())
+}
@@ -0,0 +1,135 @@
+package circuit
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// DeviceVersion identifies the constraint system defined by DeviceCircuit
+const DeviceVersion = "v1-device"
+
+// DeviceCircuit is the device-bound variant of Circuit: the commitment is the MiMC hash of the secret
+// and a device identifier, and the identifier is a public input, so a proof made for one device is
+// rejected when checked against the identifier of another. Public inputs are ordered
+// crypto_commitment, nonce, device_id, so the first two line up with Circuit's.
+type DeviceCircuit struct {
+	UserSecret       frontend.Variable `gnark:"user_secret,secret"`       // UserSecret is a private input to the circuit
+	CryptoCommitment frontend.Variable `gnark:"crypto_commitment,public"` // CryptoCommitment is MiMC(UserSecret, DeviceID)
+	Nonce            frontend.Variable `gnark:"nonce,public"`             // Nonce is the server-issued challenge the proof is bound to
+	DeviceID         frontend.Variable `gnark:"device_id,public"`         // DeviceID is the device identifier as mapped by DeviceIDElement
+}
+
+// Define specifies the constraint logic of the device-bound circuit
+func (c *DeviceCircuit) Define(api frontend.API) error {
+	// Constraint: CryptoCommitment = MiMC(UserSecret, DeviceID)
+	if commitmentErr := gadgets.MiMCCommitment(api, c.CryptoCommitment, c.UserSecret, c.DeviceID); commitmentErr != nil {
+		return commitmentErr
+	}
+
+	// Tie the nonce into the constraint system exactly as Circuit does
+	gadgets.BindNonce(api, c.Nonce, c.UserSecret)
+	return nil
+}
+
+// CompileDevice compiles the device-bound circuit into an R1CS over the scalar field of Curve
+func CompileDevice() (constraint.ConstraintSystem, error) {
+	var circuit DeviceCircuit
+	return frontend.Compile(Curve.ScalarField(), r1cs.NewBuilder, &circuit)
+}
+
+// DeviceIDElement maps a device identifier to the field element the circuit sees: the SHA-256
+// of the identifier reduced into the scalar field
+func DeviceIDElement(deviceID string) (*big.Int, error) {
+	if deviceID == "" {
+		return nil, errors.New("device ID is empty")
+	}
+	digest := sha256.Sum256([]byte(deviceID))
+	return new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), fr.Modulus()), nil
+}
+
+// deviceCommitment hashes a secret and a device element natively, matching DeviceCircuit.Define
+func deviceCommitment(value, device *fr.Element) fr.Element {
+	return gadgets.NativeMiMC(value, device)
+}
+
+// secretElement writes a secret into dst as the field element the circuits see
+func secretElement(userSecret *secret.Buffer, dst *fr.Element) {
+	if userSecret.IsFieldElement() {
+		userSecret.Element(dst)
+		return
+	}
+	dst.SetInt64(userSecret.Int64())
+}
+
+// NewDeviceWitness assigns the secret, device-bound commitment, nonce and device identifier into a
+// full witness for proving. The caller still owns userSecret and should zero it once the witness is built.
+func NewDeviceWitness(userSecret *secret.Buffer, deviceID string, nonce *big.Int) (witness.Witness, error) {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	deviceValue, deviceErr := DeviceIDElement(deviceID)
+	if deviceErr != nil {
+		return nil, deviceErr
+	}
+	var value, device fr.Element
+	secretElement(userSecret, &value)
+	device.SetBigInt(deviceValue)
+	commitment := deviceCommitment(&value, &device)
+	assignment := DeviceCircuit{
+		UserSecret:       &value,
+		CryptoCommitment: &commitment,
+		Nonce:            nonce,
+		DeviceID:         &device,
+	}
+	fullWitness, witnessErr := frontend.NewWitness(&assignment, Curve.ScalarField())
+
+	value.SetZero()
+	return fullWitness, witnessErr
+}
+
+// NewDevicePublicWitness assigns the public inputs a verifier knows: the commitment registered for
+// the device, the issued nonce and the device identifier
+func NewDevicePublicWitness(cryptoCommitment, deviceID string, nonce *big.Int) (witness.Witness, error) {
+	commitment, ok := new(big.Int).SetString(cryptoCommitment, 10)
+	if !ok {
+		return nil, fmt.Errorf("commitment %q is not a decimal field element", cryptoCommitment)
+	}
+	device, deviceErr := DeviceIDElement(deviceID)
+	if deviceErr != nil {
+		return nil, deviceErr
+	}
+	assignment := DeviceCircuit{
+		CryptoCommitment: commitment,
+		Nonce:            nonce,
+		DeviceID:         device,
+	}
+	return frontend.NewWitness(&assignment, Curve.ScalarField(), frontend.PublicOnly())
+}
+
+// GenerateDeviceCommitment generates the commitment binding a user secret to a device as a decimal field element
+func GenerateDeviceCommitment(userSecret *secret.Buffer, deviceID string) (string, error) {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return "", checkErr
+	}
+	deviceValue, deviceErr := DeviceIDElement(deviceID)
+	if deviceErr != nil {
+		return "", deviceErr
+	}
+	var value, device fr.Element
+	secretElement(userSecret, &value)
+	defer value.SetZero()
+	device.SetBigInt(deviceValue)
+	commitment := deviceCommitment(&value, &device)
+	return commitment.String(), nil
+}
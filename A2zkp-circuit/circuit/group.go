@@ -0,0 +1,246 @@
+package circuit
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// GroupVersion identifies the constraint system defined by GroupCircuit
+const GroupVersion = "v1-group"
+
+// GroupDepth is the height of the group membership tree, which holds up to 2^GroupDepth commitments
+const GroupDepth = 16
+
+// GroupCircuit proves the prover knows the secret behind one of the commitments of a group without
+// saying which: Circuit's commitment, UserSecret², is a leaf of the MiMC Merkle tree with root
+// MembersRoot. The nullifier, MiMC(UserSecret, Group, Epoch), is the same for every proof a member
+// makes in one epoch and unlinkable across epochs and groups. Public inputs are ordered
+// members_root, group, epoch, nonce, nullifier.
+type GroupCircuit struct {
+	UserSecret  frontend.Variable             `gnark:"user_secret,secret"`
+	Siblings    [GroupDepth]frontend.Variable `gnark:"siblings,secret"`  // Siblings are the nodes next to the path from the leaf, bottom first
+	PathBits    [GroupDepth]frontend.Variable `gnark:"path_bits,secret"` // PathBits are the leaf index in binary, lowest bit first; 1 means the path node is a right child
+	MembersRoot frontend.Variable             `gnark:"members_root,public"`
+	Group       frontend.Variable             `gnark:"group,public"` // Group is the group name as mapped by GroupElement
+	Epoch       frontend.Variable             `gnark:"epoch,public"`
+	Nonce       frontend.Variable             `gnark:"nonce,public"`
+	Nullifier   frontend.Variable             `gnark:"nullifier,public"`
+}
+
+// Define specifies the constraint logic of the group membership circuit
+func (c *GroupCircuit) Define(api frontend.API) error {
+	// Constraint: the commitment is a leaf under MembersRoot
+	leaf := api.Mul(c.UserSecret, c.UserSecret)
+	if memberErr := gadgets.AssertMerkleMember(api, c.MembersRoot, leaf, c.Siblings[:], c.PathBits[:]); memberErr != nil {
+		return memberErr
+	}
+
+	// Constraint: Nullifier = MiMC(UserSecret, Group, Epoch)
+	nullifier, hashErr := gadgets.MiMC(api, c.UserSecret, c.Group, c.Epoch)
+	if hashErr != nil {
+		return hashErr
+	}
+	api.AssertIsEqual(c.Nullifier, nullifier)
+
+	// Tie the nonce into the constraint system exactly as Circuit does
+	gadgets.BindNonce(api, c.Nonce, c.UserSecret)
+	return nil
+}
+
+// CompileGroup compiles the group membership circuit into an R1CS over the scalar field of Curve
+func CompileGroup() (constraint.ConstraintSystem, error) {
+	var circuit GroupCircuit
+	return frontend.Compile(Curve.ScalarField(), r1cs.NewBuilder, &circuit)
+}
+
+// GroupElement maps a group name to the field element the circuit sees: the SHA-256 of the name
+// reduced into the scalar field
+func GroupElement(group string) *big.Int {
+	digest := sha256.Sum256([]byte(group))
+	return new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), fr.Modulus())
+}
+
+// GroupTree is the Merkle tree of a group's commitments that GroupCircuit proves membership of.
+// Leaves are the distinct commitments in ascending numeric order, padded with zeros.
+type GroupTree struct {
+	leaves []string
+	levels [][]fr.Element // levels holds the non-empty prefix of each level, leaves first and the root last
+}
+
+// GroupPath locates a leaf in a GroupTree: its index and the sibling of each node on the way up
+type GroupPath struct {
+	Index    uint64
+	Siblings [GroupDepth]*big.Int
+}
+
+// NewGroupTree builds the tree of a group from its members' decimal commitments
+func NewGroupTree(commitments []string) (*GroupTree, error) {
+	values := make([]*big.Int, 0, len(commitments))
+	for _, commitment := range commitments {
+		value, ok := new(big.Int).SetString(commitment, 10)
+		if !ok || value.Sign() < 0 || value.Cmp(fr.Modulus()) >= 0 {
+			return nil, fmt.Errorf("commitment %q is not a decimal field element", commitment)
+		}
+		values = append(values, value)
+	}
+	slices.SortFunc(values, (*big.Int).Cmp)
+	values = slices.CompactFunc(values, func(a, b *big.Int) bool { return a.Cmp(b) == 0 })
+	if len(values) > 1<<GroupDepth {
+		return nil, fmt.Errorf("a group holds at most %d commitments", 1<<GroupDepth)
+	}
+
+	tree := &GroupTree{leaves: make([]string, len(values)), levels: make([][]fr.Element, GroupDepth+1)}
+	tree.levels[0] = make([]fr.Element, len(values))
+	for i, value := range values {
+		tree.leaves[i] = value.String()
+		tree.levels[0][i].SetBigInt(value)
+	}
+	for level := 0; level < GroupDepth; level++ {
+		below, empty := tree.levels[level], emptyNode(level)
+		above := make([]fr.Element, (len(below)+1)/2)
+		for i := range above {
+			right := empty
+			if 2*i+1 < len(below) {
+				right = below[2*i+1]
+			}
+			above[i] = gadgets.NativeMiMC(&below[2*i], &right)
+		}
+		tree.levels[level+1] = above
+	}
+	return tree, nil
+}
+
+// emptyNode is the node at a level of a subtree holding no commitments
+func emptyNode(level int) fr.Element {
+	var node fr.Element
+	for i := 0; i < level; i++ {
+		node = gadgets.NativeMiMC(&node, &node)
+	}
+	return node
+}
+
+// Members lists the tree's leaves as decimal commitments, in order
+func (t *GroupTree) Members() []string {
+	return slices.Clone(t.leaves)
+}
+
+// Root is the tree's root as a decimal field element
+func (t *GroupTree) Root() string {
+	if top := t.levels[GroupDepth]; len(top) > 0 {
+		return top[0].String()
+	}
+	empty := emptyNode(GroupDepth)
+	return empty.String()
+}
+
+// Path returns the path of a commitment, which must be one of the tree's leaves
+func (t *GroupTree) Path(commitment string) (GroupPath, error) {
+	value, ok := new(big.Int).SetString(commitment, 10)
+	if !ok {
+		return GroupPath{}, fmt.Errorf("commitment %q is not a decimal field element", commitment)
+	}
+	index, found := slices.BinarySearchFunc(t.leaves, value, func(leaf string, target *big.Int) int {
+		parsed, _ := new(big.Int).SetString(leaf, 10)
+		return parsed.Cmp(target)
+	})
+	if !found {
+		return GroupPath{}, errors.New("commitment is not a member of the group")
+	}
+	path := GroupPath{Index: uint64(index)}
+	for level := 0; level < GroupDepth; level++ {
+		sibling := emptyNode(level)
+		if position := index ^ 1; position < len(t.levels[level]) {
+			sibling = t.levels[level][position]
+		}
+		path.Siblings[level] = sibling.BigInt(new(big.Int))
+		index /= 2
+	}
+	return path, nil
+}
+
+// groupNullifier hashes a secret element with a group and epoch natively, matching GroupCircuit.Define
+func groupNullifier(value *fr.Element, group string, epoch uint64) fr.Element {
+	var groupValue, epochValue fr.Element
+	groupValue.SetBigInt(GroupElement(group))
+	epochValue.SetUint64(epoch)
+	return gadgets.NativeMiMC(value, &groupValue, &epochValue)
+}
+
+// GroupNullifier computes the nullifier of a member's proofs for a group and epoch as a decimal field element
+func GroupNullifier(userSecret *secret.Buffer, group string, epoch uint64) (string, error) {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return "", checkErr
+	}
+	var value fr.Element
+	secretElement(userSecret, &value)
+	defer value.SetZero()
+	nullifier := groupNullifier(&value, group, epoch)
+	return nullifier.String(), nil
+}
+
+// NewGroupWitness assigns a member's secret, its path in the group tree and the public inputs into
+// a full witness for proving. The commitment of userSecret must be a member of tree. The caller
+// still owns userSecret and should zero it once the witness is built.
+func NewGroupWitness(userSecret *secret.Buffer, tree *GroupTree, group string, epoch uint64, nonce *big.Int) (witness.Witness, error) {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	var value, commitment fr.Element
+	secretElement(userSecret, &value)
+	defer value.SetZero()
+	commitment.Square(&value)
+	path, pathErr := tree.Path(commitment.String())
+	commitment.SetZero()
+	if pathErr != nil {
+		return nil, pathErr
+	}
+
+	root, _ := new(big.Int).SetString(tree.Root(), 10)
+	nullifier := groupNullifier(&value, group, epoch)
+	assignment := GroupCircuit{
+		UserSecret:  &value,
+		MembersRoot: root,
+		Group:       GroupElement(group),
+		Epoch:       epoch,
+		Nonce:       nonce,
+		Nullifier:   &nullifier,
+	}
+	for level := 0; level < GroupDepth; level++ {
+		assignment.Siblings[level] = path.Siblings[level]
+		assignment.PathBits[level] = (path.Index >> level) & 1
+	}
+	return frontend.NewWitness(&assignment, Curve.ScalarField())
+}
+
+// NewGroupPublicWitness assigns the public inputs a verifier knows: the group's current root, the
+// group, the epoch, the issued nonce and the nullifier the prover claims
+func NewGroupPublicWitness(membersRoot, group string, epoch uint64, nonce *big.Int, nullifier string) (witness.Witness, error) {
+	root, rootOK := new(big.Int).SetString(membersRoot, 10)
+	if !rootOK {
+		return nil, fmt.Errorf("root %q is not a decimal field element", membersRoot)
+	}
+	nullifierValue, nullifierOK := new(big.Int).SetString(nullifier, 10)
+	if !nullifierOK {
+		return nil, fmt.Errorf("nullifier %q is not a decimal field element", nullifier)
+	}
+	assignment := GroupCircuit{
+		MembersRoot: root,
+		Group:       GroupElement(group),
+		Epoch:       epoch,
+		Nonce:       nonce,
+		Nullifier:   nullifierValue,
+	}
+	return frontend.NewWitness(&assignment, Curve.ScalarField(), frontend.PublicOnly())
+}
@@ -0,0 +1,182 @@
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/gadgets"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// PolicyVersion identifies the constraint system defined by PolicyCircuit
+const PolicyVersion = "v1-policy"
+
+// PolicyDenylistSize is how many denied secrets PolicyCircuit checks; shorter denylists are padded with 0
+const PolicyDenylistSize = 16
+
+// MaxPolicyBits is the largest minimum bit length a policy may ask for, that of the largest field element
+const MaxPolicyBits = 253
+
+// ErrWeakSecret is returned for a secret the policy forbids
+var ErrWeakSecret = errors.New("secret does not meet the policy")
+
+// SecretPolicy is what a secret must satisfy to be registered: a bit length of at least MinBits,
+// i.e. at least 2^(MinBits-1), and no value on Denylist. Zero is always denied. A secret s and its
+// negation -s have the same commitment, so the policy applies to the smaller of the two, the root
+// an attacker would guess.
+type SecretPolicy struct {
+	MinBits  int     `json:"min_bits"`
+	Denylist []int64 `json:"denylist"`
+}
+
+// PolicyCircuit proves the secret behind a commitment of Circuit satisfies a SecretPolicy, so a
+// server enforcing the policy can refuse commitments to weak secrets without learning the secret.
+// UserSecret is the root of the commitment no larger than (r-1)/2, r being the field modulus, so a
+// weak secret can't pass as its large negation. Public inputs are ordered crypto_commitment,
+// min_secret, denylist.
+type PolicyCircuit struct {
+	UserSecret       frontend.Variable                     `gnark:"user_secret,secret"`
+	CryptoCommitment frontend.Variable                     `gnark:"crypto_commitment,public"` // CryptoCommitment is UserSecret², as in Circuit
+	MinSecret        frontend.Variable                     `gnark:"min_secret,public"`        // MinSecret is the smallest secret allowed
+	Denylist         [PolicyDenylistSize]frontend.Variable `gnark:"denylist,public"`
+}
+
+// Define specifies the constraint logic of the policy circuit
+func (c *PolicyCircuit) Define(api frontend.API) error {
+	// Constraint: CryptoCommitment = UserSecret^2
+	gadgets.SquareCommitment(api, c.CryptoCommitment, c.UserSecret)
+
+	// Constraint: MinSecret <= UserSecret <= (r-1)/2
+	gadgets.AssertInRange(api, c.UserSecret, c.MinSecret, halfModulus())
+
+	// Constraint: UserSecret is none of Denylist
+	gadgets.AssertNoneOf(api, c.UserSecret, c.Denylist[:]...)
+	return nil
+}
+
+// CompilePolicy compiles the policy circuit into an R1CS over the scalar field of Curve
+func CompilePolicy() (constraint.ConstraintSystem, error) {
+	var circuit PolicyCircuit
+	return frontend.Compile(Curve.ScalarField(), r1cs.NewBuilder, &circuit)
+}
+
+// halfModulus is (r-1)/2, the largest of the smaller square roots
+func halfModulus() *big.Int {
+	return new(big.Int).Rsh(fr.Modulus(), 1)
+}
+
+// smallerRoot writes into dst whichever of value and -value is no larger than (r-1)/2
+func smallerRoot(value, dst *fr.Element) {
+	dst.Set(value)
+	if dst.LexicographicallyLargest() {
+		dst.Neg(dst)
+	}
+}
+
+// Validate checks the bit length bound and the denylist's size and values
+func (p SecretPolicy) Validate() error {
+	if p.MinBits < 0 || p.MinBits > MaxPolicyBits {
+		return fmt.Errorf("min_bits must be between 0 and %d", MaxPolicyBits)
+	}
+	if len(p.Denylist) > PolicyDenylistSize {
+		return fmt.Errorf("the denylist holds at most %d secrets", PolicyDenylistSize)
+	}
+	for _, denied := range p.Denylist {
+		if denied < 0 {
+			return errors.New("denylist values must not be negative; denying s also denies -s")
+		}
+	}
+	return nil
+}
+
+// MinSecret is the smallest secret with at least MinBits bits, 0 when no length is required
+func (p SecretPolicy) MinSecret() *big.Int {
+	if p.MinBits == 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(p.MinBits-1))
+}
+
+// Check reports ErrWeakSecret for a secret the policy forbids, so a client can refuse it before proving
+func (p SecretPolicy) Check(userSecret *secret.Buffer) error {
+	if checkErr := userSecret.Check(); checkErr != nil {
+		return checkErr
+	}
+	var value, root fr.Element
+	secretElement(userSecret, &value)
+	smallerRoot(&value, &root)
+	value.SetZero()
+	defer root.SetZero()
+	number := root.BigInt(new(big.Int))
+	defer number.SetInt64(0)
+	if number.Cmp(p.MinSecret()) < 0 {
+		return fmt.Errorf("%w: it is shorter than %d bits", ErrWeakSecret, p.MinBits)
+	}
+	if number.Sign() == 0 {
+		return fmt.Errorf("%w: it is zero", ErrWeakSecret)
+	}
+	for _, denied := range p.Denylist {
+		var deniedValue fr.Element
+		if deniedValue.SetInt64(denied); root.Equal(&deniedValue) {
+			return fmt.Errorf("%w: it is on the denylist", ErrWeakSecret)
+		}
+	}
+	return nil
+}
+
+// assign fills the policy's public inputs into a circuit assignment
+func (p SecretPolicy) assign(assignment *PolicyCircuit) {
+	assignment.MinSecret = p.MinSecret()
+	for i := range assignment.Denylist {
+		assignment.Denylist[i] = 0
+		if i < len(p.Denylist) {
+			assignment.Denylist[i] = p.Denylist[i]
+		}
+	}
+}
+
+// NewPolicyWitness assigns a secret and its commitment, with the policy's public inputs, into a
+// full witness for proving. A secret the policy forbids yields ErrWeakSecret. The caller still
+// owns userSecret and should zero it once the witness is built.
+func NewPolicyWitness(userSecret *secret.Buffer, policy SecretPolicy) (witness.Witness, error) {
+	if policyErr := policy.Validate(); policyErr != nil {
+		return nil, policyErr
+	}
+	if checkErr := policy.Check(userSecret); checkErr != nil {
+		return nil, checkErr
+	}
+	var value, root, square fr.Element
+	secretElement(userSecret, &value)
+	smallerRoot(&value, &root)
+	square.Square(&root)
+	assignment := PolicyCircuit{UserSecret: &root, CryptoCommitment: &square}
+	policy.assign(&assignment)
+	fullWitness, witnessErr := frontend.NewWitness(&assignment, Curve.ScalarField())
+
+	value.SetZero()
+	root.SetZero()
+	square.SetZero()
+	return fullWitness, witnessErr
+}
+
+// NewPolicyPublicWitness assigns the public inputs a verifier knows: the commitment being
+// registered and the policy it enforces
+func NewPolicyPublicWitness(cryptoCommitment string, policy SecretPolicy) (witness.Witness, error) {
+	if policyErr := policy.Validate(); policyErr != nil {
+		return nil, policyErr
+	}
+	commitment, ok := new(big.Int).SetString(cryptoCommitment, 10)
+	if !ok {
+		return nil, fmt.Errorf("commitment %q is not a decimal field element", cryptoCommitment)
+	}
+	assignment := PolicyCircuit{CryptoCommitment: commitment}
+	policy.assign(&assignment)
+	return frontend.NewWitness(&assignment, Curve.ScalarField(), frontend.PublicOnly())
+}
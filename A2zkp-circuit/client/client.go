@@ -0,0 +1,1622 @@
+// Package client is a Go SDK for the one-factor authentication server.
+//
+// Every endpoint has a typed method taking a context. Requests that the server
+// refused without processing (429, 503) and idempotent requests that failed in
+// transit are retried with exponential backoff.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/ceremony"
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/gorilla/websocket"
+)
+
+// APIError is returned when the server answers with a non-success status
+type APIError struct {
+	StatusCode int    // StatusCode is the HTTP status of the response
+	Code       string // Code is the stable problem code, such as "proof_invalid"; empty for non-problem responses
+	Message    string // Message is the problem detail, or the (trimmed) response body
+	// Reason refines a failed verification's Code: "unknown_user", "revoked", "expired_challenge",
+	// "proof_malformed", "pairing_check_failed" or "curve_mismatch". The server only reports the first,
+	// second and last when it reveals which users exist; otherwise they read "pairing_check_failed".
+	Reason string
+	// RequestID is the response's X-Request-ID, for matching the failure up with the server's logs
+	RequestID string
+	// InvalidParams lists each invalid field when Code is "invalid_request"
+	InvalidParams []validate.FieldError
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("server returned %d %s (%s): %s", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Message)
+	}
+	return fmt.Sprintf("server returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client talks to one server instance
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	adminToken   string
+	tenant       string // tenant selects the circuit tenant_circuits pins it to; empty for the configured one
+	maxRetries   int
+	retryBackoff time.Duration
+
+	proversMu sync.Mutex
+	provers   map[string]*prover.Prover // provers caches one prover per key version
+	// composition caches the server's circuit composition; nil until first fetched
+	composition *circuit.Composition
+	// groupProver caches the group circuit's prover for the key named groupKeyID
+	groupProver *prover.GroupProver
+	groupKeyID  string
+	// policyProver caches the policy circuit's prover for the key named policyKeyID
+	policyProver *prover.PolicyProver
+	policyKeyID  string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithTenant makes the client prove for users of a tenant: challenges, the circuit description and
+// keys follow the circuit the server's tenant_circuits pins the tenant to, if it does
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithHTTPClient replaces the underlying HTTP client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithTimeout bounds each individual HTTP attempt
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.httpClient.Timeout = timeout }
+}
+
+// WithRetries sets how many times a retryable request is repeated and the initial backoff between attempts
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithAdminToken sets the bearer token sent on /admin requests: the admin_token or an API key
+func WithAdminToken(token string) Option {
+	return func(c *Client) { c.adminToken = token }
+}
+
+// New creates a client for the server at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      baseURL,
+		httpClient:   &http.Client{Timeout: 60 * time.Second},
+		maxRetries:   2,
+		retryBackoff: 200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// VerifyCommitment compares two commitments on the server
+func (c *Client) VerifyCommitment(ctx context.Context, cryptoCommitment, storedCryptoCommitment string) (bool, error) {
+	body := map[string]string{"crypto_commitment": cryptoCommitment, "stored_crypto_commitment": storedCryptoCommitment}
+	doErr := c.do(ctx, http.MethodPost, "/verifyCommitment", body, nil)
+	var apiErr *APIError
+	if errors.As(doErr, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		return false, nil
+	}
+	return doErr == nil, doErr
+}
+
+// Register stores a new user's commitment
+func (c *Client) Register(ctx context.Context, registration Registration) error {
+	return c.do(ctx, http.MethodPost, "/v1/users", registration, nil)
+}
+
+// RegisterWithRecovery stores a new user's commitment and returns recovery shares, threshold of
+// which can replace the commitment through Recover should the secret be lost. The shares are
+// only returned here; hand them to separate custodians and zero each Value once stored.
+func (c *Client) RegisterWithRecovery(ctx context.Context, registration Registration, shares, threshold int) ([]secret.Share, error) {
+	registration.Recovery = &RecoveryOptions{Shares: shares, Threshold: threshold}
+	var response registrationResponse
+	if doErr := c.do(ctx, http.MethodPost, "/v1/users", registration, &response); doErr != nil {
+		return nil, doErr
+	}
+	return parseShares(response.RecoveryShares)
+}
+
+// Recover replaces a user's commitment with that of replacement, proving knowledge of the given
+// recovery shares against one challenge. Only replacement's commitment, salt, KDF, policy proof and DID binding are used. It
+// returns the fresh shares that supersede all the old ones.
+func (c *Client) Recover(ctx context.Context, userName string, shares []secret.Share, replacement Registration) ([]secret.Share, error) {
+	challenge, challengeErr := c.RequestChallenge(ctx, userName)
+	if challengeErr != nil {
+		return nil, challengeErr
+	}
+	keyProver, proverErr := c.proverFor(ctx, challenge.KeyID)
+	if proverErr != nil {
+		return nil, proverErr
+	}
+	nonce, nonceErr := challenge.NonceInt()
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+	req := RecoveryRequest{
+		Nonce:            challenge.Nonce,
+		KeyID:            challenge.KeyID,
+		CryptoCommitment: replacement.CryptoCommitment,
+		Salt:             replacement.Salt,
+		KDF:              replacement.KDF,
+		PolicyProof:      replacement.PolicyProof,
+		DIDBinding:       replacement.DIDBinding,
+	}
+	for _, share := range shares {
+		proof, proveErr := keyProver.Prove(ctx, share.Value, nonce)
+		if proveErr != nil {
+			return nil, fmt.Errorf("proving share %d: %w", share.Index, proveErr)
+		}
+		encoded, encodeErr := prover.EncodeProof(proof)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		req.Proofs = append(req.Proofs, ShareProof{Index: share.Index, Proof: encoded})
+	}
+	var response registrationResponse
+	if doErr := c.do(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/recovery", req, &response); doErr != nil {
+		return nil, doErr
+	}
+	return parseShares(response.RecoveryShares)
+}
+
+// ImportUsers imports users with legacy password hashes, each pending until Migrate replaces the
+// hash with a commitment; with dryRun the server only counts what the import would do
+func (c *Client) ImportUsers(ctx context.Context, users []LegacyUser, dryRun bool) (ImportReport, error) {
+	path := "/v1/users:import"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+	var report ImportReport
+	doErr := c.do(ctx, http.MethodPost, path, struct {
+		Users []LegacyUser `json:"users"`
+	}{users}, &report)
+	return report, doErr
+}
+
+// Migrate completes the migration of an imported user on their first login: the server checks
+// password against the user's legacy hash once, then stores replacement's commitment in its place
+// and logs the user in. Only replacement's commitment, salt, KDF, curve, policy proof and DID
+// binding are used; derive the secret from the password with secret.Derive so later logins need
+// nothing else. The session's Token is empty in tenants that require TOTP.
+func (c *Client) Migrate(ctx context.Context, userName, password string, replacement Registration) (Session, error) {
+	req := MigrationRequest{
+		Password:         password,
+		CryptoCommitment: replacement.CryptoCommitment,
+		Salt:             replacement.Salt,
+		KDF:              replacement.KDF,
+		Curve:            replacement.Curve,
+		PolicyProof:      replacement.PolicyProof,
+		DIDBinding:       replacement.DIDBinding,
+	}
+	var response migrationResponse
+	if doErr := c.do(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/migration", req, &response); doErr != nil {
+		return Session{}, doErr
+	}
+	session := Session{UserName: userName, KeyID: response.KeyID, Token: response.SessionToken}
+	if response.SessionToken != "" {
+		session.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return session, nil
+}
+
+// parseShares decodes the encoded recovery shares of a response
+func parseShares(encoded []string) ([]secret.Share, error) {
+	shares := make([]secret.Share, len(encoded))
+	for i, text := range encoded {
+		share, parseErr := secret.ParseShare([]byte(text))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// DeleteUser deletes a user and returns the server's deletion receipt. A server configured with a
+// deletion_retention only soft-deletes the user, until the receipt's PurgeAfter. It authenticates
+// with sessionToken, from LoginInteractive as that user, or with the admin token when sessionToken
+// is empty.
+func (c *Client) DeleteUser(ctx context.Context, userName, sessionToken string) (DeletionReceipt, error) {
+	return c.deleteUser(ctx, "/v1/users/"+url.PathEscape(userName), sessionToken)
+}
+
+// PurgeUser erases a user at once, soft-deleted or not, with the admin token
+func (c *Client) PurgeUser(ctx context.Context, userName string) (DeletionReceipt, error) {
+	return c.deleteUser(ctx, "/v1/users/"+url.PathEscape(userName)+"?purge=true", "")
+}
+
+// deleteUser sends a deletion and decodes its receipt
+func (c *Client) deleteUser(ctx context.Context, path, sessionToken string) (DeletionReceipt, error) {
+	if sessionToken == "" {
+		sessionToken = c.adminToken
+	}
+	header := http.Header{"Authorization": {"Bearer " + sessionToken}}
+	response, sendErr := c.send(ctx, http.MethodDelete, path, nil, header)
+	if sendErr != nil {
+		return DeletionReceipt{}, sendErr
+	}
+	defer response.Body.Close()
+	var receipt DeletionReceipt
+	decodeErr := json.NewDecoder(response.Body).Decode(&receipt)
+	return receipt, decodeErr
+}
+
+// RestoreUser brings back a soft-deleted user before the server purges them
+func (c *Client) RestoreUser(ctx context.Context, userName string) error {
+	return c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(userName)+"/restore", nil, nil)
+}
+
+// ListDevices lists a user's devices, authorized by a session token of that user or, when empty, the admin token
+func (c *Client) ListDevices(ctx context.Context, userName, sessionToken string) ([]Device, error) {
+	var list struct {
+		Devices []Device `json:"devices"`
+	}
+	doErr := c.doAs(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(userName)+"/devices", sessionToken, nil, &list)
+	return list.Devices, doErr
+}
+
+// AddDevice registers the commitment of another of a user's devices under a label; proofs for the
+// user then verify against it too. It is authorized like ListDevices.
+func (c *Client) AddDevice(ctx context.Context, userName, label, cryptoCommitment, sessionToken string) (Device, error) {
+	return c.AddDeviceWithPolicyProof(ctx, userName, label, cryptoCommitment, nil, sessionToken)
+}
+
+// AddDeviceWithPolicyProof is AddDevice on a server with a secret policy, sending the proof from
+// PolicyProof that the device's secret meets it
+func (c *Client) AddDeviceWithPolicyProof(ctx context.Context, userName, label, cryptoCommitment string, policyProof []byte, sessionToken string) (Device, error) {
+	var device Device
+	body := map[string]any{"label": label, "crypto_commitment": cryptoCommitment}
+	if policyProof != nil {
+		body["policy_proof"] = policyProof
+	}
+	doErr := c.doAs(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/devices", sessionToken, body, &device)
+	return device, doErr
+}
+
+// RevokeDevice revokes a device so proofs no longer match its commitment. It is authorized like ListDevices.
+func (c *Client) RevokeDevice(ctx context.Context, userName, label, sessionToken string) (Device, error) {
+	var device Device
+	path := "/v1/users/" + url.PathEscape(userName) + "/devices/" + url.PathEscape(label)
+	doErr := c.doAs(ctx, http.MethodDelete, path, sessionToken, nil, &device)
+	return device, doErr
+}
+
+// Logout revokes a session token from LoginInteractive, so it stops authorizing requests before it expires
+func (c *Client) Logout(ctx context.Context, sessionToken string) error {
+	header := http.Header{"Authorization": {"Bearer " + sessionToken}}
+	response, sendErr := c.send(ctx, http.MethodPost, "/v1/logout", nil, header)
+	if sendErr != nil {
+		return sendErr
+	}
+	return response.Body.Close()
+}
+
+// StepUp proves knowledge of the secret again within a session from LoginInteractive, against a
+// challenge bound to that session, and returns the step-up token elevating it
+func (c *Client) StepUp(ctx context.Context, userName string, userSecret *secret.Buffer, sessionToken string) (StepUp, error) {
+	var challenge Challenge
+	if doErr := c.doAs(ctx, http.MethodPost, "/v1/step-up/challenges", sessionToken, nil, &challenge); doErr != nil {
+		return StepUp{}, doErr
+	}
+	submission, proveErr := c.Prove(ctx, userName, userSecret, challenge)
+	if proveErr != nil {
+		return StepUp{}, proveErr
+	}
+	var stepUp StepUp
+	doErr := c.doAs(ctx, http.MethodPost, "/v1/step-up", sessionToken, submission, &stepUp)
+	return stepUp, doErr
+}
+
+// RevokeSessions revokes every session token issued to a user so far. It is authorized like ListDevices.
+func (c *Client) RevokeSessions(ctx context.Context, userName, sessionToken string) error {
+	return c.doAs(ctx, http.MethodDelete, "/v1/users/"+url.PathEscape(userName)+"/sessions", sessionToken, nil, nil)
+}
+
+// TOTP reports whether a user enrolled TOTP. It is authorized like ListDevices.
+func (c *Client) TOTP(ctx context.Context, userName, sessionToken string) (TOTPStatus, error) {
+	var status TOTPStatus
+	doErr := c.doAs(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(userName)+"/totp", sessionToken, nil, &status)
+	return status, doErr
+}
+
+// EnrollTOTP generates a TOTP secret for a user; logins ask for codes once ConfirmTOTP checked one.
+// It is authorized like ListDevices.
+func (c *Client) EnrollTOTP(ctx context.Context, userName, sessionToken string) (TOTPEnrollment, error) {
+	var enrollment TOTPEnrollment
+	doErr := c.doAs(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/totp", sessionToken, nil, &enrollment)
+	return enrollment, doErr
+}
+
+// ConfirmTOTP confirms a user's enrolment with a code from their authenticator app. It is
+// authorized like ListDevices.
+func (c *Client) ConfirmTOTP(ctx context.Context, userName, code, sessionToken string) (TOTPStatus, error) {
+	var status TOTPStatus
+	doErr := c.doAs(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/totp/confirm", sessionToken, map[string]string{"code": code}, &status)
+	return status, doErr
+}
+
+// RemoveTOTP removes a user's enrolment. It is authorized like ListDevices, though tenants requiring
+// TOTP only accept the admin token.
+func (c *Client) RemoveTOTP(ctx context.Context, userName, sessionToken string) error {
+	return c.doAs(ctx, http.MethodDelete, "/v1/users/"+url.PathEscape(userName)+"/totp", sessionToken, nil, nil)
+}
+
+// WebAuthnChallenge is the WebAuthn challenge to request an assertion over for a challenge nonce:
+// the SHA-256 of the decimal nonce
+func WebAuthnChallenge(nonce string) []byte {
+	digest := sha256.Sum256([]byte(nonce))
+	return digest[:]
+}
+
+// BindWebAuthn binds a hardware key to a user's registration, after which every proof needs an
+// assertion from it. It is authorized like ListDevices.
+func (c *Client) BindWebAuthn(ctx context.Context, userName string, binding WebAuthnBinding, sessionToken string) (WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	doErr := c.doAs(ctx, http.MethodPost, "/v1/users/"+url.PathEscape(userName)+"/webauthn", sessionToken, binding, &credential)
+	return credential, doErr
+}
+
+// WebAuthnCredential describes the hardware key bound to a user. It is authorized like ListDevices.
+func (c *Client) WebAuthnCredential(ctx context.Context, userName, sessionToken string) (WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	doErr := c.doAs(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(userName)+"/webauthn", sessionToken, nil, &credential)
+	return credential, doErr
+}
+
+// UnbindWebAuthn removes the hardware key bound to a user. It is authorized like ListDevices.
+func (c *Client) UnbindWebAuthn(ctx context.Context, userName, sessionToken string) error {
+	return c.doAs(ctx, http.MethodDelete, "/v1/users/"+url.PathEscape(userName)+"/webauthn", sessionToken, nil, nil)
+}
+
+// RegisterBatch stores many registrations in one request. Failed registrations are reported in the
+// result rather than as an error; those with code "batch_aborted" can be resubmitted as they are.
+func (c *Client) RegisterBatch(ctx context.Context, registrations []Registration) (BatchResult, error) {
+	var result BatchResult
+	doErr := c.do(ctx, http.MethodPost, "/v1/users:batch", map[string][]Registration{"users": registrations}, &result)
+	return result, doErr
+}
+
+// UserParams fetches the salt, KDF parameters, circuit version and curve a user registered with
+func (c *Client) UserParams(ctx context.Context, userName string) (UserParams, error) {
+	var params UserParams
+	doErr := c.do(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(userName)+"/params", nil, &params)
+	return params, doErr
+}
+
+// RequestChallenge obtains a single-use nonce for a user's next proof
+func (c *Client) RequestChallenge(ctx context.Context, userName string) (Challenge, error) {
+	var challenge Challenge
+	request := map[string]string{"user_name": userName}
+	if c.tenant != "" {
+		request["tenant"] = c.tenant
+	}
+	doErr := c.do(ctx, http.MethodPost, "/v1/challenges", request, &challenge)
+	return challenge, doErr
+}
+
+// Verify submits a proof; a rejected proof is reported as an *APIError with status 401
+func (c *Client) Verify(ctx context.Context, submission ProofSubmission) (Verdict, error) {
+	var verdict Verdict
+	doErr := c.do(ctx, http.MethodPost, "/v1/verify", submission, &verdict)
+	return verdict, doErr
+}
+
+// IssueCredential submits a proof and returns a Verifiable Credential attesting it, bound to holder when that DID is non-empty
+func (c *Client) IssueCredential(ctx context.Context, submission ProofSubmission, holder string) (Credential, error) {
+	var credential Credential
+	doErr := c.do(ctx, http.MethodPost, "/v1/credentials", CredentialRequest{ProofSubmission: submission, Holder: holder}, &credential)
+	return credential, doErr
+}
+
+// RevocationKey downloads the public key the server signs revocation lists with, to pin in
+// verifier.NewRevocationList. Trust it on first use at most: an attacker serving the list can serve the key.
+func (c *Client) RevocationKey(ctx context.Context) (crypto.PublicKey, error) {
+	var jwks json.RawMessage
+	if doErr := c.do(ctx, http.MethodGet, "/v1/revocations/jwks", nil, &jwks); doErr != nil {
+		return nil, doErr
+	}
+	return verifier.ParseJSONWebKey(jwks)
+}
+
+// SigningKeys downloads the current and previous Ed25519 keys the server signs verdicts and
+// webhook deliveries with. Fetch them from the server itself rather than through the
+// intermediaries a verdict is relayed by.
+func (c *Client) SigningKeys(ctx context.Context) (verifier.KeySet, error) {
+	var jwks json.RawMessage
+	if doErr := c.do(ctx, http.MethodGet, "/v1/signing-keys", nil, &jwks); doErr != nil {
+		return nil, doErr
+	}
+	return verifier.ParseJSONWebKeySet(jwks)
+}
+
+// SyncRevocations fetches the revocations list is missing and applies them
+func (c *Client) SyncRevocations(ctx context.Context, list *verifier.RevocationList) error {
+	var response struct {
+		List string `json:"list"`
+	}
+	path := "/v1/revocations?after=" + strconv.FormatUint(list.Sequence(), 10)
+	if doErr := c.do(ctx, http.MethodGet, path, nil, &response); doErr != nil {
+		return doErr
+	}
+	return list.Apply(response.List)
+}
+
+// ProvingKey downloads the Groth16 proving key of a key version; an empty keyID selects the current one
+func (c *Client) ProvingKey(ctx context.Context, keyID string) (groth16.ProvingKey, error) {
+	provingKey := groth16.NewProvingKey(circuit.Curve)
+	if fetchErr := c.fetchBinary(ctx, c.keyPath("/v1/keys/proving", keyID), provingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	return provingKey, nil
+}
+
+// VerifyingKey downloads the Groth16 verifying key of a key version; an empty keyID selects the current one
+func (c *Client) VerifyingKey(ctx context.Context, keyID string) (groth16.VerifyingKey, error) {
+	verifyingKey := groth16.NewVerifyingKey(circuit.Curve)
+	if fetchErr := c.fetchBinary(ctx, c.keyPath("/v1/keys/verifying", keyID), verifyingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	return verifyingKey, nil
+}
+
+// ProvingKeyOn downloads the Groth16 proving key of the circuit compiled over one of the server's
+// additional curves, listed by Circuit.Curves
+func (c *Client) ProvingKeyOn(ctx context.Context, curve ecc.ID) (groth16.ProvingKey, error) {
+	provingKey := groth16.NewProvingKey(curve)
+	if fetchErr := c.fetchBinary(ctx, "/v1/keys/proving?curve="+url.QueryEscape(curve.String()), provingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	return provingKey, nil
+}
+
+// VerifyingKeyOn downloads the Groth16 verifying key of the circuit compiled over one of the
+// server's additional curves
+func (c *Client) VerifyingKeyOn(ctx context.Context, curve ecc.ID) (groth16.VerifyingKey, error) {
+	verifyingKey := groth16.NewVerifyingKey(curve)
+	if fetchErr := c.fetchBinary(ctx, "/v1/keys/verifying?curve="+url.QueryEscape(curve.String()), verifyingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	return verifyingKey, nil
+}
+
+// SignedVerifyingKey downloads the verifying key of a circuit version and checks it against the
+// manifest the server signed, with the server's signing keys; an empty keyID selects the circuit's
+// current key. Embedded verifiers pin the manifest's key ID or digest once it checks out.
+func (c *Client) SignedVerifyingKey(ctx context.Context, circuitVersion, keyID string) (groth16.VerifyingKey, verifier.KeyManifest, error) {
+	path := "/v1/keys/" + url.PathEscape(circuitVersion)
+	if keyID != "" {
+		path += "?key_id=" + url.QueryEscape(keyID)
+	}
+	var document struct {
+		Gnark     []byte `json:"gnark"`
+		Signature string `json:"signature"`
+	}
+	if doErr := c.do(ctx, http.MethodGet, path, nil, &document); doErr != nil {
+		return nil, verifier.KeyManifest{}, doErr
+	}
+	keys, keysErr := c.SigningKeys(ctx)
+	if keysErr != nil {
+		return nil, verifier.KeyManifest{}, keysErr
+	}
+	publicKey, keyErr := keys.Key(document.Signature)
+	if keyErr != nil {
+		return nil, verifier.KeyManifest{}, keyErr
+	}
+	manifest, verifyErr := verifier.VerifyKeyManifest(document.Signature, publicKey, document.Gnark)
+	if verifyErr != nil {
+		return nil, verifier.KeyManifest{}, verifyErr
+	}
+	verifyingKey := groth16.NewVerifyingKey(circuit.Curve)
+	if _, readErr := verifyingKey.ReadFrom(bytes.NewReader(document.Gnark)); readErr != nil {
+		return nil, verifier.KeyManifest{}, fmt.Errorf("decoding verifying key %s: %w", manifest.KeyID, readErr)
+	}
+	return verifyingKey, manifest, nil
+}
+
+// VerifyCeremony checks the setup ceremony a key version comes from without trusting the server:
+// it replays the published transcript against the circuit compiled locally and the keys the server
+// deploys, and returns the manifest of the contributions it checked. An empty keyID selects the
+// current key version. A transcript that doesn't check out fails with ceremony.ErrTranscript.
+func (c *Client) VerifyCeremony(ctx context.Context, keyID string) (Ceremony, error) {
+	var published Ceremony
+	if doErr := c.do(ctx, http.MethodGet, c.keyPath("/v1/ceremony", keyID), nil, &published); doErr != nil {
+		return Ceremony{}, doErr
+	}
+	// Everything else is fetched by the key ID the manifest names, in case the keys rotate meanwhile
+	response, sendErr := c.send(ctx, http.MethodGet, c.keyPath("/v1/ceremony/transcript", published.KeyID), nil, nil)
+	if sendErr != nil {
+		return Ceremony{}, sendErr
+	}
+	transcript, readErr := io.ReadAll(response.Body)
+	response.Body.Close()
+	if readErr != nil {
+		return Ceremony{}, readErr
+	}
+	provingKey, provingErr := c.ProvingKey(ctx, published.KeyID)
+	if provingErr != nil {
+		return Ceremony{}, provingErr
+	}
+	verifyingKey, verifyingErr := c.VerifyingKey(ctx, published.KeyID)
+	if verifyingErr != nil {
+		return Ceremony{}, verifyingErr
+	}
+	c.proversMu.Lock()
+	composition, compositionErr := c.compositionLocked(ctx)
+	c.proversMu.Unlock()
+	if compositionErr != nil {
+		return Ceremony{}, compositionErr
+	}
+	if published.CircuitVersion != composition.Version() {
+		return Ceremony{}, fmt.Errorf("%w: it sets up circuit %s, not the server's %s", ceremony.ErrTranscript, published.CircuitVersion, composition.Version())
+	}
+	ccs, compileErr := composition.Compile()
+	if compileErr != nil {
+		return Ceremony{}, fmt.Errorf("compiling circuit %s: %w", composition.Version(), compileErr)
+	}
+	verified, verifyErr := ceremony.Verify(published.Manifest, bytes.NewReader(transcript), ccs, provingKey, verifyingKey)
+	if verifyErr != nil {
+		return Ceremony{}, verifyErr
+	}
+	return Ceremony{Manifest: verified, KeyID: published.KeyID}, nil
+}
+
+// keyPath adds the key_id query parameter when a specific key version is requested, and the
+// tenant one for a client of a tenant
+func (c *Client) keyPath(path, keyID string) string {
+	query := url.Values{}
+	if keyID != "" {
+		query.Set("key_id", keyID)
+	}
+	if c.tenant != "" {
+		query.Set("tenant", c.tenant)
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// Prove produces a proof for a challenge locally; the secret never leaves the process.
+// The proving key of the challenge's key version is downloaded on first use and reused afterwards.
+func (c *Client) Prove(ctx context.Context, userName string, userSecret *secret.Buffer, challenge Challenge) (ProofSubmission, error) {
+	keyProver, proverErr := c.proverFor(ctx, challenge.KeyID)
+	if proverErr != nil {
+		return ProofSubmission{}, proverErr
+	}
+	nonce, nonceErr := challenge.NonceInt()
+	if nonceErr != nil {
+		return ProofSubmission{}, nonceErr
+	}
+
+	proof, proveErr := keyProver.Prove(ctx, userSecret, nonce)
+	if proveErr != nil {
+		return ProofSubmission{}, proveErr
+	}
+	commitment, commitErr := keyProver.Commitment(userSecret)
+	if commitErr != nil {
+		return ProofSubmission{}, commitErr
+	}
+	submission, submissionErr := NewProofSubmission(userName, nonce, challenge.KeyID, proof)
+	if submissionErr != nil {
+		return ProofSubmission{}, submissionErr
+	}
+	submission.CryptoCommitment = commitment
+	return submission, nil
+}
+
+// proverFor returns the cached prover for a key version, downloading its proving key if needed
+func (c *Client) proverFor(ctx context.Context, keyID string) (*prover.Prover, error) {
+	c.proversMu.Lock()
+	defer c.proversMu.Unlock()
+	if cached, exists := c.provers[keyID]; exists {
+		return cached, nil
+	}
+	provingKey, keyErr := c.ProvingKey(ctx, keyID)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	composition, compositionErr := c.keyCompositionLocked(ctx, keyID)
+	if compositionErr != nil {
+		return nil, compositionErr
+	}
+	loaded, newErr := prover.NewComposed(ctx, provingKey, composition)
+	if newErr != nil {
+		return nil, newErr
+	}
+	if c.provers == nil {
+		c.provers = make(map[string]*prover.Prover)
+	}
+	c.provers[keyID] = loaded
+	return loaded, nil
+}
+
+// Circuit fetches the description of the server's authentication circuit, the one of the client's
+// tenant when WithTenant names one
+func (c *Client) Circuit(ctx context.Context) (Circuit, error) {
+	var description Circuit
+	path := "/v1/circuit"
+	if c.tenant != "" {
+		path += "?tenant=" + url.QueryEscape(c.tenant)
+	}
+	doErr := c.do(ctx, http.MethodGet, path, nil, &description)
+	return description, doErr
+}
+
+// Commitment computes the commitment to register for a secret under the server's circuit
+func (c *Client) Commitment(ctx context.Context, userSecret *secret.Buffer) (string, error) {
+	c.proversMu.Lock()
+	composition, compositionErr := c.compositionLocked(ctx)
+	c.proversMu.Unlock()
+	if compositionErr != nil {
+		return "", compositionErr
+	}
+	return composition.GenerateCommitment(userSecret)
+}
+
+// UserCommitment computes the commitment to register for a secret of userName: under the canary
+// circuit when the server routes the user's new registrations to one, under its circuit otherwise
+func (c *Client) UserCommitment(ctx context.Context, userName string, userSecret *secret.Buffer) (string, error) {
+	query := url.Values{"user_name": {userName}}
+	if c.tenant != "" {
+		query.Set("tenant", c.tenant)
+	}
+	var description Circuit
+	doErr := c.do(ctx, http.MethodGet, "/v1/circuit?"+query.Encode(), nil, &description)
+	var apiErr *APIError
+	switch {
+	case errors.As(doErr, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		return c.Commitment(ctx, userSecret)
+	case doErr != nil:
+		return "", doErr
+	}
+	return description.Composition.GenerateCommitment(userSecret)
+}
+
+// keyCompositionLocked returns the composition of the circuit keyID was set up for: the server's,
+// unless GET /v1/circuit?key_id= describes another, as it does for the keys of a canary circuit.
+// The caller holds proversMu.
+func (c *Client) keyCompositionLocked(ctx context.Context, keyID string) (circuit.Composition, error) {
+	composition, compositionErr := c.compositionLocked(ctx)
+	if compositionErr != nil || keyID == "" {
+		return composition, compositionErr
+	}
+	var description Circuit
+	doErr := c.do(ctx, http.MethodGet, c.keyPath("/v1/circuit", keyID), nil, &description)
+	var apiErr *APIError
+	switch {
+	case errors.As(doErr, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		return composition, nil
+	case doErr != nil:
+		return circuit.Composition{}, doErr
+	}
+	return description.Composition, nil
+}
+
+// compositionLocked returns the server's circuit composition, fetching it on first use. Servers
+// that predate GET /v1/circuit run circuit.DefaultComposition. The caller holds proversMu.
+func (c *Client) compositionLocked(ctx context.Context) (circuit.Composition, error) {
+	if c.composition != nil {
+		return *c.composition, nil
+	}
+	description, circuitErr := c.Circuit(ctx)
+	var apiErr *APIError
+	switch {
+	case errors.As(circuitErr, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		description.Composition = circuit.DefaultComposition
+	case circuitErr != nil:
+		return circuit.Composition{}, circuitErr
+	}
+	c.composition = &description.Composition
+	return description.Composition, nil
+}
+
+// Login runs the whole flow: request a challenge, prove locally and submit the proof
+func (c *Client) Login(ctx context.Context, userName string, userSecret *secret.Buffer) (Verdict, error) {
+	challenge, challengeErr := c.RequestChallenge(ctx, userName)
+	if challengeErr != nil {
+		return Verdict{}, challengeErr
+	}
+	submission, proveErr := c.Prove(ctx, userName, userSecret, challenge)
+	if proveErr != nil {
+		return Verdict{}, proveErr
+	}
+	return c.Verify(ctx, submission)
+}
+
+// LoginWithTOTP is Login for users who enrolled TOTP, sending the code of their authenticator app
+// with the proof
+func (c *Client) LoginWithTOTP(ctx context.Context, userName string, userSecret *secret.Buffer, code string) (Verdict, error) {
+	challenge, challengeErr := c.RequestChallenge(ctx, userName)
+	if challengeErr != nil {
+		return Verdict{}, challengeErr
+	}
+	submission, proveErr := c.Prove(ctx, userName, userSecret, challenge)
+	if proveErr != nil {
+		return Verdict{}, proveErr
+	}
+	submission.TOTPCode = code
+	return c.Verify(ctx, submission)
+}
+
+// Time fetches the server's clock, with Offset set to how far the local clock is behind it,
+// measured from the middle of the round trip
+func (c *Client) Time(ctx context.Context) (ServerTime, error) {
+	var serverTime ServerTime
+	sent := time.Now()
+	if doErr := c.do(ctx, http.MethodGet, "/v1/time", nil, &serverTime); doErr != nil {
+		return ServerTime{}, doErr
+	}
+	received := time.Now()
+	serverTime.Offset = serverTime.Time.Sub(sent.Add(received.Sub(sent) / 2))
+	return serverTime, nil
+}
+
+// GroupLogin proves the secret belongs to one of a group's members without revealing which and
+// returns the group token. The group's members are fetched so the proof is built locally; each
+// member can log in once per epoch. Groups are tenants, "-" being the default one.
+func (c *Client) GroupLogin(ctx context.Context, group string, userSecret *secret.Buffer) (GroupSession, error) {
+	groupPath := "/v1/groups/" + url.PathEscape(group)
+	var description Group
+	if doErr := c.do(ctx, http.MethodGet, groupPath, nil, &description); doErr != nil {
+		return GroupSession{}, doErr
+	}
+	tree, treeErr := circuit.NewGroupTree(description.Members)
+	if treeErr != nil {
+		return GroupSession{}, treeErr
+	}
+	if tree.Root() != description.MembersRoot {
+		return GroupSession{}, fmt.Errorf("group %q: members don't match the root the server reports", group)
+	}
+	var challenge Challenge
+	if doErr := c.do(ctx, http.MethodPost, groupPath+"/challenges", nil, &challenge); doErr != nil {
+		return GroupSession{}, doErr
+	}
+	nonce, nonceErr := challenge.NonceInt()
+	if nonceErr != nil {
+		return GroupSession{}, nonceErr
+	}
+	groupProver, proverErr := c.groupProverFor(ctx, challenge.KeyID)
+	if proverErr != nil {
+		return GroupSession{}, proverErr
+	}
+	nullifier, nullifierErr := prover.Nullifier(userSecret, group, description.Epoch)
+	if nullifierErr != nil {
+		return GroupSession{}, nullifierErr
+	}
+	proof, proveErr := groupProver.Prove(ctx, userSecret, tree, group, description.Epoch, nonce)
+	if proveErr != nil {
+		return GroupSession{}, proveErr
+	}
+	encoded, encodeErr := prover.EncodeProof(proof)
+	if encodeErr != nil {
+		return GroupSession{}, encodeErr
+	}
+
+	request := GroupLoginRequest{Nonce: challenge.Nonce, Epoch: description.Epoch, MembersRoot: description.MembersRoot, Nullifier: nullifier, Proof: encoded}
+	var response struct {
+		GroupToken string `json:"group_token"`
+		ExpiresIn  int64  `json:"expires_in"`
+	}
+	if doErr := c.do(ctx, http.MethodPost, groupPath+"/login", request, &response); doErr != nil {
+		return GroupSession{}, doErr
+	}
+	return GroupSession{
+		Group:     group,
+		Nullifier: nullifier,
+		Token:     response.GroupToken,
+		ExpiresAt: time.Now().Add(time.Duration(response.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// groupProverFor returns the cached group prover, downloading the group proving key when the
+// server names another key than the cached one
+func (c *Client) groupProverFor(ctx context.Context, keyID string) (*prover.GroupProver, error) {
+	c.proversMu.Lock()
+	defer c.proversMu.Unlock()
+	if c.groupProver != nil && c.groupKeyID == keyID {
+		return c.groupProver, nil
+	}
+	provingKey := groth16.NewProvingKey(circuit.Curve)
+	if fetchErr := c.fetchBinary(ctx, "/v1/keys/group/proving", provingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	loaded, newErr := prover.NewGroup(ctx, provingKey)
+	if newErr != nil {
+		return nil, newErr
+	}
+	c.groupProver, c.groupKeyID = loaded, keyID
+	return loaded, nil
+}
+
+// SecretPolicy fetches the policy the server holds new secrets to
+func (c *Client) SecretPolicy(ctx context.Context) (Policy, error) {
+	var policy Policy
+	doErr := c.do(ctx, http.MethodGet, "/v1/policy", nil, &policy)
+	return policy, doErr
+}
+
+// PolicyProof proves the secret meets the server's secret policy, for the PolicyProof field of a
+// registration, recovery or new device. A secret the policy forbids fails with
+// circuit.ErrWeakSecret before anything is proven.
+func (c *Client) PolicyProof(ctx context.Context, userSecret *secret.Buffer) ([]byte, error) {
+	served, policyErr := c.SecretPolicy(ctx)
+	if policyErr != nil {
+		return nil, policyErr
+	}
+	policy := circuit.SecretPolicy{MinBits: served.MinBits, Denylist: served.Denylist}
+	if checkErr := policy.Check(userSecret); checkErr != nil {
+		return nil, checkErr
+	}
+	policyProver, proverErr := c.policyProverFor(ctx, served.KeyID)
+	if proverErr != nil {
+		return nil, proverErr
+	}
+	proof, proveErr := policyProver.Prove(ctx, userSecret, policy)
+	if proveErr != nil {
+		return nil, proveErr
+	}
+	return prover.EncodeProof(proof)
+}
+
+// policyProverFor returns the cached policy prover, downloading the policy proving key when the
+// server names another key than the cached one
+func (c *Client) policyProverFor(ctx context.Context, keyID string) (*prover.PolicyProver, error) {
+	c.proversMu.Lock()
+	defer c.proversMu.Unlock()
+	if c.policyProver != nil && c.policyKeyID == keyID {
+		return c.policyProver, nil
+	}
+	provingKey := groth16.NewProvingKey(circuit.Curve)
+	if fetchErr := c.fetchBinary(ctx, "/v1/keys/policy/proving", provingKey); fetchErr != nil {
+		return nil, fetchErr
+	}
+	loaded, newErr := prover.NewPolicy(ctx, provingKey)
+	if newErr != nil {
+		return nil, newErr
+	}
+	c.policyProver, c.policyKeyID = loaded, keyID
+	return loaded, nil
+}
+
+// LoginInteractive runs the login over one WebSocket connection to GET /v1/login/ws: the server
+// sends a challenge, the proof is generated locally and sent back before the challenge's deadline,
+// and the server answers with a session token. A rejected proof is reported as an *APIError.
+func (c *Client) LoginInteractive(ctx context.Context, userName string, userSecret *secret.Buffer) (Session, error) {
+	var tlsConfig *tls.Config
+	if transport, isTransport := c.httpClient.Transport.(*http.Transport); isTransport {
+		tlsConfig = transport.TLSClientConfig
+	}
+	wsURL := "ws" + strings.TrimPrefix(c.baseURL, "http") + "/v1/login/ws?user_name=" + url.QueryEscape(userName)
+	dialer := websocket.Dialer{TLSClientConfig: tlsConfig}
+	conn, response, dialErr := dialer.DialContext(ctx, wsURL, nil)
+	if errors.Is(dialErr, websocket.ErrBadHandshake) && response != nil && response.StatusCode != http.StatusSwitchingProtocols {
+		return Session{}, readAPIError(response)
+	}
+	if dialErr != nil {
+		return Session{}, dialErr
+	}
+	defer conn.Close()
+	defer conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	// Cancelling ctx unblocks a read waiting on the server
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	var challenge struct {
+		Type string `json:"type"`
+		Challenge
+	}
+	if readErr := conn.ReadJSON(&challenge); readErr != nil {
+		return Session{}, errors.Join(ctx.Err(), readErr)
+	}
+	if challenge.Type != "challenge" {
+		return Session{}, fmt.Errorf("expected a challenge message, got %q", challenge.Type)
+	}
+	proveCtx, cancel := context.WithDeadline(ctx, challenge.ExpiresAt)
+	defer cancel()
+	submission, proveErr := c.Prove(proveCtx, userName, userSecret, challenge.Challenge)
+	if proveErr != nil {
+		return Session{}, proveErr
+	}
+	proof := map[string]any{"type": "proof", "proof": submission.Proof, "key_id": submission.KeyID, "proof_encoding": submission.ProofEncoding}
+	if submission.CryptoCommitment != "" {
+		proof["crypto_commitment"] = submission.CryptoCommitment
+	}
+	if writeErr := conn.WriteJSON(proof); writeErr != nil {
+		return Session{}, writeErr
+	}
+
+	var verdict struct {
+		Type         string   `json:"type"`
+		Status       string   `json:"status"`
+		KeyID        string   `json:"key_id"`
+		SessionToken string   `json:"session_token"`
+		ExpiresIn    int64    `json:"expires_in"`
+		Problem      *Problem `json:"problem"`
+	}
+	if readErr := conn.ReadJSON(&verdict); readErr != nil {
+		return Session{}, errors.Join(ctx.Err(), readErr)
+	}
+	switch {
+	case verdict.Problem != nil:
+		return Session{}, &APIError{StatusCode: verdict.Problem.Status, Code: verdict.Problem.Code, Message: verdict.Problem.Detail, Reason: verdict.Problem.Reason}
+	case verdict.Status != "accepted":
+		return Session{}, fmt.Errorf("unexpected verdict %q", verdict.Status)
+	}
+	return Session{
+		UserName:  userName,
+		KeyID:     verdict.KeyID,
+		Token:     verdict.SessionToken,
+		ExpiresAt: time.Now().Add(time.Duration(verdict.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// SubmitProveJob queues server-side proof generation and returns the job without waiting for it
+func (c *Client) SubmitProveJob(ctx context.Context, req ProveJobRequest) (Job, error) {
+	var job Job
+	doErr := c.do(ctx, http.MethodPost, "/v1/prove", req, &job)
+	return job, doErr
+}
+
+// GetJob returns the current state of a proving job
+func (c *Client) GetJob(ctx context.Context, id string) (Job, error) {
+	var job Job
+	doErr := c.do(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(id), nil, &job)
+	return job, doErr
+}
+
+// WatchJob follows a proving job's Server-Sent Events until it reaches a final state (done, failed
+// or cancelled) and returns it, calling onChange, when non-nil, with each state and progress update on
+// the way. A stream cut short, for instance by the client timeout, is reopened; the server begins every
+// stream with the job's current state.
+func (c *Client) WatchJob(ctx context.Context, id string, onChange func(Job)) (Job, error) {
+	var last Job
+	emit := func(job Job) {
+		changed := job.Status != last.Status || job.Stage != last.Stage || job.Percent != last.Percent
+		if changed && onChange != nil {
+			onChange(job)
+		}
+		last = job
+	}
+	for {
+		finished, streamErr := c.streamJob(ctx, id, emit)
+		switch {
+		case streamErr != nil:
+			return last, streamErr
+		case finished:
+			return last, nil
+		}
+		select {
+		case <-ctx.Done():
+			return last, ctx.Err()
+		case <-time.After(c.retryBackoff):
+		}
+	}
+}
+
+// streamJob reads one event stream of a job, reporting whether it ended with a final state.
+// Failing to open the stream is an error; the stream breaking off afterwards is not.
+func (c *Client) streamJob(ctx context.Context, id string, emit func(Job)) (bool, error) {
+	response, sendErr := c.send(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(id)+"/events", nil, http.Header{"Accept": {"text/event-stream"}})
+	if sendErr != nil {
+		return false, sendErr
+	}
+	defer response.Body.Close()
+
+	lines := bufio.NewScanner(response.Body)
+	lines.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	var data []byte
+	for lines.Scan() {
+		line := lines.Text()
+		if value, isData := strings.CutPrefix(line, "data:"); isData {
+			data = append(data, strings.TrimPrefix(value, " ")...)
+			continue
+		}
+		// A blank line dispatches the event; comments and event names need no handling
+		if line != "" || data == nil {
+			continue
+		}
+		var job Job
+		if decodeErr := json.Unmarshal(data, &job); decodeErr != nil {
+			return false, fmt.Errorf("decoding job event: %w", decodeErr)
+		}
+		data = nil
+		emit(job)
+		if job.Status == "done" || job.Status == "failed" || job.Status == "cancelled" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CancelJob cancels a queued or running proving job
+func (c *Client) CancelJob(ctx context.Context, id string) (Job, error) {
+	var job Job
+	doErr := c.do(ctx, http.MethodDelete, "/v1/jobs/"+url.PathEscape(id), nil, &job)
+	return job, doErr
+}
+
+// Backup downloads a snapshot of every registration
+func (c *Client) Backup(ctx context.Context) (Snapshot, error) {
+	var snapshot Snapshot
+	doErr := c.do(ctx, http.MethodGet, "/admin/backup", nil, &snapshot)
+	return snapshot, doErr
+}
+
+// ListUsers returns a page of the registered users, in user name order. Pass the page's NextCursor
+// in the query for the next one.
+func (c *Client) ListUsers(ctx context.Context, query UserQuery) (UserPage, error) {
+	values := url.Values{}
+	if query.Tenant != "" {
+		values.Set("tenant", query.Tenant)
+	}
+	if !query.CreatedAfter.IsZero() {
+		values.Set("created_after", query.CreatedAfter.Format(time.RFC3339))
+	}
+	if !query.CreatedBefore.IsZero() {
+		values.Set("created_before", query.CreatedBefore.Format(time.RFC3339))
+	}
+	if query.Revoked != nil {
+		values.Set("revoked", strconv.FormatBool(*query.Revoked))
+	}
+	if query.Locked != nil {
+		values.Set("locked", strconv.FormatBool(*query.Locked))
+	}
+	if query.Deleted != nil {
+		values.Set("deleted", strconv.FormatBool(*query.Deleted))
+	}
+	if query.Cursor != "" {
+		values.Set("cursor", query.Cursor)
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	path := "/admin/users"
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	var page UserPage
+	doErr := c.do(ctx, http.MethodGet, path, nil, &page)
+	return page, doErr
+}
+
+// Restore uploads a snapshot; with dryRun the server only validates it.
+// A snapshot with validation problems returns the report together with an *APIError.
+func (c *Client) Restore(ctx context.Context, snapshot Snapshot, dryRun bool) (RestoreReport, error) {
+	var report RestoreReport
+	path := "/admin/restore"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+	doErr := c.do(ctx, http.MethodPost, path, snapshot, &report)
+	var apiErr *APIError
+	if errors.As(doErr, &apiErr) && apiErr.StatusCode == http.StatusUnprocessableEntity {
+		json.Unmarshal([]byte(apiErr.Message), &report)
+	}
+	return report, doErr
+}
+
+// VerifyBulk streams proofs to POST /admin/verify:bulk as NDJSON and calls onResult for each result
+// as the server returns it, which is in completion order rather than the order of proofs. Proofs
+// are checked against the stored commitments without challenges, so it suits re-validating proofs
+// accepted earlier. The whole exchange counts against the HTTP client's timeout; use WithTimeout(0)
+// for long streams.
+func (c *Client) VerifyBulk(ctx context.Context, proofs []BulkProof, onResult func(BulkResult)) error {
+	body, bodyWriter := io.Pipe()
+	go func() {
+		encoder := json.NewEncoder(bodyWriter)
+		for _, proof := range proofs {
+			if encodeErr := encoder.Encode(proof); encodeErr != nil {
+				bodyWriter.CloseWithError(encodeErr)
+				return
+			}
+		}
+		bodyWriter.Close()
+	}()
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/admin/verify:bulk", body)
+	if requestErr != nil {
+		body.Close()
+		return requestErr
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if c.adminToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+	response, doErr := c.httpClient.Do(request)
+	if doErr != nil {
+		return doErr
+	}
+	if response.StatusCode >= 300 {
+		return readAPIError(response)
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var result BulkResult
+		decodeErr := decoder.Decode(&result)
+		if errors.Is(decodeErr, io.EOF) {
+			return nil
+		}
+		if decodeErr != nil {
+			return decodeErr
+		}
+		onResult(result)
+	}
+}
+
+// LoadCommitments streams a file of commitments generated elsewhere to POST /admin/users:load,
+// as CSV with a header row (contentType "text/csv") or as NDJSON ("application/x-ndjson"), and
+// returns the summary of the load. onEvent, when set, is called for every record that wasn't
+// stored and every progress update as the server reports them. With dryRun nothing is stored. As
+// with VerifyBulk, use WithTimeout(0) for large files.
+func (c *Client) LoadCommitments(ctx context.Context, file io.Reader, contentType string, dryRun bool, onEvent func(LoadEvent)) (LoadCounts, error) {
+	path := "/admin/users:load"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, file)
+	if requestErr != nil {
+		return LoadCounts{}, requestErr
+	}
+	request.Header.Set("Content-Type", contentType)
+	if c.adminToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+	response, doErr := c.httpClient.Do(request)
+	if doErr != nil {
+		return LoadCounts{}, doErr
+	}
+	if response.StatusCode >= 300 {
+		return LoadCounts{}, readAPIError(response)
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event LoadEvent
+		decodeErr := decoder.Decode(&event)
+		if errors.Is(decodeErr, io.EOF) {
+			return LoadCounts{}, errors.New("the load report ended without a summary")
+		}
+		if decodeErr != nil {
+			return LoadCounts{}, decodeErr
+		}
+		if event.Event == "summary" {
+			return event.LoadCounts, nil
+		}
+		if onEvent != nil {
+			onEvent(event)
+		}
+	}
+}
+
+// KeyVersions lists the key versions proofs may target
+func (c *Client) KeyVersions(ctx context.Context) ([]KeyVersion, error) {
+	var versions []KeyVersion
+	doErr := c.do(ctx, http.MethodGet, "/admin/keys", nil, &versions)
+	return versions, doErr
+}
+
+// AddKeyVersion has the server run a new setup and make it the current key version
+func (c *Client) AddKeyVersion(ctx context.Context) (KeyVersion, error) {
+	var version KeyVersion
+	doErr := c.do(ctx, http.MethodPost, "/admin/keys", nil, &version)
+	return version, doErr
+}
+
+// RetireKeyVersion stops a replaced key version from verifying before its grace period ends
+func (c *Client) RetireKeyVersion(ctx context.Context, keyID string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/keys/"+url.PathEscape(keyID), nil, nil)
+}
+
+// RevokeSession revokes one session token by its ID, the token's "jti" claim
+func (c *Client) RevokeSession(ctx context.Context, tokenID string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/sessions/"+url.PathEscape(tokenID), nil, nil)
+}
+
+// APIKeys lists the API keys of the admin API and their roles
+func (c *Client) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	doErr := c.do(ctx, http.MethodGet, "/admin/api-keys", nil, &keys)
+	return keys, doErr
+}
+
+// CreateAPIKey creates an API key with a role; tenant is required for RoleTenantAdmin and empty
+// otherwise. The returned Key is the credential, which the server does not show again.
+func (c *Client) CreateAPIKey(ctx context.Context, name, role, tenant string) (APIKey, error) {
+	var key APIKey
+	doErr := c.do(ctx, http.MethodPost, "/admin/api-keys", apiKeyRequest{Name: name, Role: role, Tenant: tenant}, &key)
+	return key, doErr
+}
+
+// AssignRole replaces the role and tenant of an API key
+func (c *Client) AssignRole(ctx context.Context, keyID, role, tenant string) (APIKey, error) {
+	var key APIKey
+	doErr := c.do(ctx, http.MethodPut, "/admin/api-keys/"+url.PathEscape(keyID)+"/role", apiKeyRequest{Role: role, Tenant: tenant}, &key)
+	return key, doErr
+}
+
+// SetQuota replaces the daily and monthly request quotas of an API key; 0 leaves a period unbounded
+func (c *Client) SetQuota(ctx context.Context, keyID string, daily, monthly int64) (APIKey, error) {
+	var key APIKey
+	doErr := c.do(ctx, http.MethodPut, "/admin/api-keys/"+url.PathEscape(keyID)+"/quota", quotaRequest{DailyQuota: daily, MonthlyQuota: monthly}, &key)
+	return key, doErr
+}
+
+// Usage reports the requests of each API key today and this month; a non-empty tenant only
+// reports that tenant's keys
+func (c *Client) Usage(ctx context.Context, tenant string) (Usage, error) {
+	path := "/admin/usage"
+	if tenant != "" {
+		path += "?" + url.Values{"tenant": {tenant}}.Encode()
+	}
+	var usage Usage
+	doErr := c.do(ctx, http.MethodGet, path, nil, &usage)
+	return usage, doErr
+}
+
+// UsageRecords exports the daily usage records of the API keys from from up to but excluding to,
+// which name UTC days; zero times leave the server's defaults, this month so far
+func (c *Client) UsageRecords(ctx context.Context, from, to time.Time, tenant string) ([]UsageRecord, error) {
+	values := url.Values{}
+	if !from.IsZero() {
+		values.Set("from", from.UTC().Format("2006-01-02"))
+	}
+	if !to.IsZero() {
+		values.Set("to", to.UTC().Format("2006-01-02"))
+	}
+	if tenant != "" {
+		values.Set("tenant", tenant)
+	}
+	path := "/admin/usage/records"
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	var records usageRecords
+	doErr := c.do(ctx, http.MethodGet, path, nil, &records)
+	return records.Records, doErr
+}
+
+// AuthPolicies lists the authentication policies; a non-empty tenant only lists those of that
+// tenant and its users
+func (c *Client) AuthPolicies(ctx context.Context, tenant string) ([]AuthPolicy, error) {
+	path := "/admin/auth-policies"
+	if tenant != "" {
+		path += "?" + url.Values{"tenant": {tenant}}.Encode()
+	}
+	var policies authPolicies
+	doErr := c.do(ctx, http.MethodGet, path, nil, &policies)
+	return policies.Policies, doErr
+}
+
+// SetTenantAuthPolicy replaces the login rules every user of a tenant is held to; an empty
+// tenant is the default one
+func (c *Client) SetTenantAuthPolicy(ctx context.Context, tenant string, rules LoginRules) (AuthPolicy, error) {
+	var policy AuthPolicy
+	doErr := c.do(ctx, http.MethodPut, tenantPolicyPath(tenant), rules, &policy)
+	return policy, doErr
+}
+
+// DeleteTenantAuthPolicy removes the authentication policy of a tenant
+func (c *Client) DeleteTenantAuthPolicy(ctx context.Context, tenant string) error {
+	return c.do(ctx, http.MethodDelete, tenantPolicyPath(tenant), nil, nil)
+}
+
+// tenantPolicyPath is the path of a tenant's authentication policy, with "-" for the default tenant
+func tenantPolicyPath(tenant string) string {
+	if tenant == "" {
+		tenant = "-"
+	}
+	return "/admin/tenants/" + url.PathEscape(tenant) + "/auth-policy"
+}
+
+// SetUserAuthPolicy replaces the login rules a user is held to on top of their tenant's
+func (c *Client) SetUserAuthPolicy(ctx context.Context, userName string, rules LoginRules) (AuthPolicy, error) {
+	var policy AuthPolicy
+	doErr := c.do(ctx, http.MethodPut, "/admin/users/"+url.PathEscape(userName)+"/auth-policy", rules, &policy)
+	return policy, doErr
+}
+
+// DeleteUserAuthPolicy removes the authentication policy of a user
+func (c *Client) DeleteUserAuthPolicy(ctx context.Context, userName string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(userName)+"/auth-policy", nil, nil)
+}
+
+// Transcripts lists the proof transcripts of logins accepted from from up to but excluding to, of
+// one user when userName is non-empty; zero times leave the server's defaults, the last day
+func (c *Client) Transcripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	values := url.Values{}
+	if userName != "" {
+		values.Set("user_name", userName)
+	}
+	if !from.IsZero() {
+		values.Set("from", from.Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		values.Set("to", to.Format(time.RFC3339))
+	}
+	path := "/admin/transcripts"
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	var list transcripts
+	doErr := c.do(ctx, http.MethodGet, path, nil, &list)
+	return list.Transcripts, doErr
+}
+
+// Transcript downloads one proof transcript
+func (c *Client) Transcript(ctx context.Context, id string) (Transcript, error) {
+	var transcript Transcript
+	doErr := c.do(ctx, http.MethodGet, "/admin/transcripts/"+url.PathEscape(id), nil, &transcript)
+	return transcript, doErr
+}
+
+// VerifyTranscript has the server run the pairing check of a proof transcript again, under the
+// key version it verified with
+func (c *Client) VerifyTranscript(ctx context.Context, id string) (TranscriptVerification, error) {
+	var verification TranscriptVerification
+	doErr := c.do(ctx, http.MethodPost, "/admin/transcripts/"+url.PathEscape(id)+"/verify", nil, &verification)
+	return verification, doErr
+}
+
+// CommitmentCollisions reports the commitments more than one user registered, most users first
+func (c *Client) CommitmentCollisions(ctx context.Context) (CommitmentCollisions, error) {
+	var report CommitmentCollisions
+	doErr := c.do(ctx, http.MethodGet, "/admin/commitments/collisions", nil, &report)
+	return report, doErr
+}
+
+// DeleteAPIKey deletes an API key, which stops working at once
+func (c *Client) DeleteAPIKey(ctx context.Context, keyID string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/api-keys/"+url.PathEscape(keyID), nil, nil)
+}
+
+// ClientCredentials identify a registered OAuth client at the token endpoint; Secret is empty for public clients
+type ClientCredentials struct {
+	ID     string
+	Secret string
+}
+
+// ExchangeProof redeems a proof for access and refresh tokens with the zk-proof grant. An empty
+// scope asks for every scope the client is registered for.
+func (c *Client) ExchangeProof(ctx context.Context, credentials ClientCredentials, submission ProofSubmission, scope string) (TokenSet, error) {
+	form := url.Values{
+		"grant_type": {ProofGrantType},
+		"user_name":  {submission.UserName},
+		"nonce":      {submission.Nonce},
+		"proof":      {base64.StdEncoding.EncodeToString(submission.Proof)},
+	}
+	if submission.KeyID != "" {
+		form.Set("key_id", submission.KeyID)
+	}
+	if submission.CryptoCommitment != "" {
+		form.Set("crypto_commitment", submission.CryptoCommitment)
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	return c.requestTokens(ctx, credentials, form)
+}
+
+// RefreshTokens redeems a refresh token; the returned set carries its replacement
+func (c *Client) RefreshTokens(ctx context.Context, credentials ClientCredentials, refreshToken, scope string) (TokenSet, error) {
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	return c.requestTokens(ctx, credentials, form)
+}
+
+// AuthenticateForTokens runs the login flow and exchanges the proof for tokens instead of a verdict
+func (c *Client) AuthenticateForTokens(ctx context.Context, credentials ClientCredentials, userName string, userSecret *secret.Buffer, scope string) (TokenSet, error) {
+	challenge, challengeErr := c.RequestChallenge(ctx, userName)
+	if challengeErr != nil {
+		return TokenSet{}, challengeErr
+	}
+	submission, proveErr := c.Prove(ctx, userName, userSecret, challenge)
+	if proveErr != nil {
+		return TokenSet{}, proveErr
+	}
+	return c.ExchangeProof(ctx, credentials, submission, scope)
+}
+
+// Introspect asks whether an access or refresh token is active, as a resource server would. It
+// needs the credentials of a confidential client; refresh tokens are only reported to their own client.
+func (c *Client) Introspect(ctx context.Context, credentials ClientCredentials, token string) (TokenIntrospection, error) {
+	var introspection TokenIntrospection
+	postErr := c.postClientForm(ctx, credentials, "/v1/introspect", url.Values{"token": {token}}, &introspection)
+	return introspection, postErr
+}
+
+// requestTokens posts a form to the token endpoint
+func (c *Client) requestTokens(ctx context.Context, credentials ClientCredentials, form url.Values) (TokenSet, error) {
+	var tokens TokenSet
+	postErr := c.postClientForm(ctx, credentials, "/oauth/token", form, &tokens)
+	return tokens, postErr
+}
+
+// postClientForm posts a form as an OAuth client, authenticating confidential clients with HTTP
+// Basic, and decodes the JSON response into out
+func (c *Client) postClientForm(ctx context.Context, credentials ClientCredentials, path string, form url.Values, out any) error {
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	if credentials.Secret != "" {
+		basic := url.QueryEscape(credentials.ID) + ":" + url.QueryEscape(credentials.Secret)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basic)))
+	} else {
+		form.Set("client_id", credentials.ID)
+	}
+
+	response, sendErr := c.send(ctx, http.MethodPost, path, []byte(form.Encode()), header)
+	if sendErr != nil {
+		return sendErr
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// do sends a JSON request and decodes a JSON response into out when it is non-nil
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	return c.doAs(ctx, method, path, "", body, out)
+}
+
+// doAs is do authorized with a bearer token, the admin token when empty
+func (c *Client) doAs(ctx context.Context, method, path, token string, body, out any) error {
+	if token == "" {
+		token = c.adminToken
+	}
+	var payload []byte
+	if body != nil {
+		var marshalErr error
+		if payload, marshalErr = json.Marshal(body); marshalErr != nil {
+			return marshalErr
+		}
+	}
+
+	header := make(http.Header)
+	if payload != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	response, sendErr := c.send(ctx, method, path, payload, header)
+	if sendErr != nil {
+		return sendErr
+	}
+	defer response.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// fetchBinary downloads a gnark-encoded object into dst
+func (c *Client) fetchBinary(ctx context.Context, path string, dst io.ReaderFrom) error {
+	response, sendErr := c.send(ctx, http.MethodGet, path, nil, nil)
+	if sendErr != nil {
+		return sendErr
+	}
+	defer response.Body.Close()
+	_, readErr := dst.ReadFrom(response.Body)
+	return readErr
+}
+
+// send performs a request with retries, returning the first successful response
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, header http.Header) (*http.Response, error) {
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		request, requestErr := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(payload))
+		if requestErr != nil {
+			return nil, requestErr
+		}
+		for name, values := range header {
+			request.Header[name] = values
+		}
+
+		response, doErr := c.httpClient.Do(request)
+		retryable := false
+		var wait time.Duration
+		switch {
+		case doErr != nil:
+			// A transport failure may have happened after the server acted, so only idempotent requests are repeated
+			retryable = method == http.MethodGet
+		case response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable:
+			retryable = true
+			if seconds, parseErr := strconv.Atoi(response.Header.Get("Retry-After")); parseErr == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+
+		if doErr == nil && response.StatusCode < 300 {
+			return response, nil
+		}
+		if !retryable || attempt >= c.maxRetries {
+			if doErr != nil {
+				return nil, doErr
+			}
+			return nil, readAPIError(response)
+		}
+		if response != nil && response.StatusCode == http.StatusTooManyRequests {
+			// A used-up API key quota only frees up when the day or month ends, too late to wait for
+			var apiErr *APIError
+			if errors.As(readAPIError(response), &apiErr) && apiErr.Code == "quota_exceeded" {
+				return nil, apiErr
+			}
+		} else if response != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		if wait < backoff {
+			wait = backoff
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// readAPIError consumes an error response into an *APIError, decoding problem details when present
+func readAPIError(response *http.Response) error {
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	apiErr := &APIError{StatusCode: response.StatusCode, Message: string(bytes.TrimSpace(message)), RequestID: response.Header.Get("X-Request-ID")}
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType == "application/problem+json" {
+		var problem Problem
+		if json.Unmarshal(message, &problem) == nil && problem.Code != "" {
+			apiErr.Code, apiErr.Message, apiErr.Reason, apiErr.InvalidParams = problem.Code, problem.Detail, problem.Reason, problem.InvalidParams
+			if apiErr.Message == "" {
+				apiErr.Message = problem.Title
+			}
+		}
+	}
+	return apiErr
+}
+
+// ParseNonce is a helper for callers holding a nonce as text
+func ParseNonce(text string) (*big.Int, error) {
+	return Challenge{Nonce: text}.NonceInt()
+}
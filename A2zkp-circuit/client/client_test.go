@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"A2zkp-circuit/validate"
+)
+
+// fakeServer serves handler, passing it the number of the attempt from 1, and counts the attempts
+func fakeServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, attempt int)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, int(attempts.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+// dropConnection fails the request in transit, as a server crashing mid-request would
+func dropConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, hijackErr := http.NewResponseController(w).Hijack()
+	if hijackErr != nil {
+		t.Error(hijackErr)
+		return
+	}
+	conn.Close()
+}
+
+func TestRetryAfter(t *testing.T) {
+	var bodies []string
+	server, attempts := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if attempt == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"nonce":"42","key_id":"v1"}`))
+	})
+	sdk := New(server.URL, WithRetries(2, time.Millisecond))
+
+	// A 503 is refused before processing, so even a POST is sent again, once Retry-After has passed
+	started := time.Now()
+	challenge, challengeErr := sdk.RequestChallenge(context.Background(), "alice")
+	if challengeErr != nil || challenge.Nonce != "42" {
+		t.Fatalf("RequestChallenge = %+v, %v", challenge, challengeErr)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("retried after %s, before Retry-After", elapsed)
+	}
+	if attempts.Load() != 2 || bodies[0] != bodies[1] || !strings.Contains(bodies[1], `"alice"`) {
+		t.Errorf("%d attempts with bodies %q, want 2 of the same", attempts.Load(), bodies)
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	server, attempts := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	sdk := New(server.URL, WithRetries(2, time.Millisecond))
+	var apiErr *APIError
+	if _, circuitErr := sdk.Circuit(context.Background()); !errors.As(circuitErr, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Circuit = %v, want the last 503", circuitErr)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("%d attempts, want the first and 2 retries", attempts.Load())
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		call   func(*Client) error
+		status int // status is what the server answers; 0 drops the connection
+		want   int32
+	}{
+		{"400", func(sdk *Client) error { _, err := sdk.Circuit(context.Background()); return err }, http.StatusBadRequest, 1},
+		{"404", func(sdk *Client) error { _, err := sdk.Circuit(context.Background()); return err }, http.StatusNotFound, 1},
+		{"409 on a POST", func(sdk *Client) error { _, err := sdk.RequestChallenge(context.Background(), "alice"); return err }, http.StatusConflict, 1},
+		// The server may have acted before the connection dropped, so only a GET is sent again
+		{"dropped POST", func(sdk *Client) error { _, err := sdk.RequestChallenge(context.Background(), "alice"); return err }, 0, 1},
+		{"dropped GET", func(sdk *Client) error { _, err := sdk.Circuit(context.Background()); return err }, 0, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server, attempts := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+				if c.status == 0 {
+					dropConnection(t, w)
+					return
+				}
+				w.WriteHeader(c.status)
+			})
+			sdk := New(server.URL, WithRetries(2, time.Millisecond))
+			if callErr := c.call(sdk); callErr == nil {
+				t.Error("the call succeeded")
+			}
+			if attempts.Load() != c.want {
+				t.Errorf("%d attempts, want %d", attempts.Load(), c.want)
+			}
+		})
+	}
+}
+
+func TestQuotaExceededNoRetry(t *testing.T) {
+	// A used-up quota won't free up within any backoff, so the 429 is returned at once
+	server, attempts := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type":"about:blank","title":"Too Many Requests","status":429,"code":"quota_exceeded"}`))
+	})
+	sdk := New(server.URL, WithRetries(2, time.Millisecond))
+	var apiErr *APIError
+	if _, circuitErr := sdk.Circuit(context.Background()); !errors.As(circuitErr, &apiErr) || apiErr.Code != "quota_exceeded" {
+		t.Errorf("Circuit = %v, want quota_exceeded", circuitErr)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("%d attempts, want 1", attempts.Load())
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	server, attempts := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	sdk := New(server.URL, WithRetries(5, time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The wait for Retry-After ends with the context
+	started := time.Now()
+	if _, circuitErr := sdk.Circuit(ctx); !errors.Is(circuitErr, context.DeadlineExceeded) {
+		t.Errorf("Circuit = %v, want the context's error", circuitErr)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("%d attempts, want 1", attempts.Load())
+	}
+	if _, circuitErr := sdk.Circuit(ctx); !errors.Is(circuitErr, context.DeadlineExceeded) || attempts.Load() != 1 {
+		t.Errorf("Circuit with a cancelled context = %v after %d attempts, want no request", circuitErr, attempts.Load())
+	}
+}
+
+func TestProblemDecoding(t *testing.T) {
+	server, _ := fakeServer(t, func(w http.ResponseWriter, r *http.Request, attempt int) {
+		w.Header().Set("X-Request-ID", "req-1")
+		if r.URL.Path == "/v1/circuit" {
+			http.Error(w, "  upstream gone  ", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"https://ofa.dev/problems/invalid_request","title":"Bad Request","status":400,` +
+			`"detail":"The request is invalid","code":"invalid_request","reason":"proof_malformed",` +
+			`"invalid_params":[{"name":"user_name","reason":"is required"}]}`))
+	})
+	sdk := New(server.URL, WithRetries(0, time.Millisecond))
+
+	// RFC 7807 problems fill in the typed error
+	_, challengeErr := sdk.RequestChallenge(context.Background(), "")
+	var apiErr *APIError
+	if !errors.As(challengeErr, &apiErr) {
+		t.Fatalf("RequestChallenge = %v, want an *APIError", challengeErr)
+	}
+	want := &APIError{
+		StatusCode:    http.StatusBadRequest,
+		Code:          "invalid_request",
+		Message:       "The request is invalid",
+		Reason:        "proof_malformed",
+		RequestID:     "req-1",
+		InvalidParams: []validate.FieldError{{Name: "user_name", Reason: "is required"}},
+	}
+	if !reflect.DeepEqual(apiErr, want) {
+		t.Errorf("APIError = %+v, want %+v", apiErr, want)
+	}
+	if !strings.Contains(apiErr.Error(), "(invalid_request)") {
+		t.Errorf("Error() = %q, want the code", apiErr.Error())
+	}
+
+	// Other error bodies are kept as the message
+	_, circuitErr := sdk.Circuit(context.Background())
+	if !errors.As(circuitErr, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" || apiErr.Message != "upstream gone" {
+		t.Errorf("Circuit = %#v, want a 502 with the trimmed body", circuitErr)
+	}
+}
@@ -0,0 +1,710 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"A2zkp-circuit/ceremony"
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/did"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// Registration is the body of POST /v1/users
+type Registration struct {
+	UserName         string `json:"user_name"`         // The name the user will authenticate with
+	CryptoCommitment string `json:"crypto_commitment"` // The commitment generated from the user's secret
+	Salt             []byte `json:"salt,omitempty"`    // The optional salt used when deriving the secret
+	// KDF holds the parameters the secret was derived with, or names a set of Circuit.KDFs; leave nil
+	// for raw integer secrets
+	KDF    *secret.KDFParams `json:"kdf,omitempty"`
+	Tenant string            `json:"tenant,omitempty"` // The organisation the user belongs to; empty for the default tenant
+	// Recovery asks for recovery shares; set by RegisterWithRecovery
+	Recovery *RecoveryOptions `json:"recovery,omitempty"`
+	// ExpiresAt is when the registration stops authenticating; nil keeps it until deleted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PolicyProof proves the secret meets the server's secret policy; see Client.PolicyProof
+	PolicyProof []byte `json:"policy_proof,omitempty"`
+	// Curve is the curve the commitment was computed on, one of Circuit.Curves; empty for the circuit's own
+	Curve string `json:"curve,omitempty"`
+	// DIDBinding binds the commitment to a key of the DID document when UserName is a DID; see did.SignBinding
+	DIDBinding *did.Binding `json:"did_binding,omitempty"`
+}
+
+// RecoveryOptions asks for a recovery secret split into Shares shares, Threshold of which recover the account
+type RecoveryOptions struct {
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+}
+
+// registrationResponse is the body returned by registrations and recoveries
+type registrationResponse struct {
+	Status         string   `json:"status"`
+	RecoveryShares []string `json:"recovery_shares"`
+}
+
+// ShareProof proves knowledge of one recovery share
+type ShareProof struct {
+	Index int    `json:"index"`
+	Proof []byte `json:"proof"` // Proof is a Groth16 proof in gnark binary encoding with the share value as secret
+}
+
+// RecoveryRequest is the body of POST /v1/users/{id}/recovery
+type RecoveryRequest struct {
+	Nonce            string            `json:"nonce"` // The challenge nonce every proof was generated against
+	KeyID            string            `json:"key_id,omitempty"`
+	Proofs           []ShareProof      `json:"proofs"`
+	CryptoCommitment string            `json:"crypto_commitment"` // The commitment generated from the new secret
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	PolicyProof      []byte            `json:"policy_proof,omitempty"`
+	DIDBinding       *did.Binding      `json:"did_binding,omitempty"`
+}
+
+// MigrationRequest is the body of POST /v1/users/{id}/migration
+type MigrationRequest struct {
+	Password         string            `json:"password"`          // The password the legacy hash was made from
+	CryptoCommitment string            `json:"crypto_commitment"` // The commitment generated from the new secret
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	Curve            string            `json:"curve,omitempty"`
+	PolicyProof      []byte            `json:"policy_proof,omitempty"`
+	DIDBinding       *did.Binding      `json:"did_binding,omitempty"`
+}
+
+// migrationResponse is the body returned by a completed migration
+type migrationResponse struct {
+	Status       string `json:"status"`
+	KeyID        string `json:"key_id"`
+	SessionToken string `json:"session_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// LegacyUser is a user to import with a password hash from another system
+type LegacyUser struct {
+	UserName     string `json:"user_name"`
+	Tenant       string `json:"tenant,omitempty"`
+	PasswordHash string `json:"password_hash"` // PasswordHash is a bcrypt hash or an Argon2id or Argon2i one in PHC string format
+}
+
+// ImportReport is the outcome of POST /v1/users:import
+type ImportReport struct {
+	DryRun    bool `json:"dry_run"`
+	Total     int  `json:"total"`
+	Imported  int  `json:"imported"`
+	Existing  int  `json:"existing"`
+	Unmatched int  `json:"unmatched"`
+}
+
+// DeletionReceipt confirms that DeleteUser erased a user's data
+type DeletionReceipt struct {
+	UserName    string         `json:"user_name"`
+	DeletedAt   time.Time      `json:"deleted_at"`
+	Records     map[string]int `json:"records"`      // Records counts the removed records by kind, e.g. "challenge"
+	RecordsHash string         `json:"records_hash"` // RecordsHash commits to the IDs of the removed records
+	// PurgeAfter is when a soft-deleted user is erased unless restored; nil when the user was erased at once
+	PurgeAfter *time.Time `json:"purge_after"`
+}
+
+// Device is one of a user's devices as listed by /v1/users/{id}/devices; the commitment isn't returned
+type Device struct {
+	Label     string     `json:"label"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Active    bool       `json:"active"` // Active reports whether proofs may match the device's commitment
+}
+
+// TOTPEnrollment is the secret EnrollTOTP generated, to load into an authenticator app
+type TOTPEnrollment struct {
+	Secret    string `json:"secret"` // Secret is the key in unpadded base32
+	URI       string `json:"uri"`    // URI is the otpauth:// URI to show as a QR code
+	Digits    int    `json:"digits"`
+	Period    int    `json:"period"` // Period is the lifetime of a code in seconds
+	Algorithm string `json:"algorithm"`
+}
+
+// TOTPStatus describes a user's TOTP enrolment
+type TOTPStatus struct {
+	UserName    string     `json:"user_name"`
+	Policy      string     `json:"policy"`   // Policy is the user's tenant's: off, enrolled or required
+	Enrolled    bool       `json:"enrolled"` // Enrolled reports whether logins ask the user for a code
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// WebAuthnAssertion is the response of navigator.credentials.get(), or of any FIDO2 authenticator
+// asked for an assertion, for a bound credential
+type WebAuthnAssertion struct {
+	CredentialID      []byte `json:"credential_id"`
+	AuthenticatorData []byte `json:"authenticator_data"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	Signature         []byte `json:"signature"`
+}
+
+// WebAuthnBinding binds a credential to a registration: its public key as a DER
+// SubjectPublicKeyInfo, its COSE algorithm and an assertion over a challenge nonce of the user
+type WebAuthnBinding struct {
+	CredentialID []byte            `json:"credential_id"`
+	PublicKey    []byte            `json:"public_key"`
+	Algorithm    int               `json:"algorithm"` // Algorithm is -7 (ES256), -8 (EdDSA) or -257 (RS256)
+	Nonce        string            `json:"nonce"`
+	Assertion    WebAuthnAssertion `json:"assertion"`
+}
+
+// WebAuthnCredential describes the hardware key bound to a user
+type WebAuthnCredential struct {
+	UserName     string    `json:"user_name"`
+	CredentialID []byte    `json:"credential_id"`
+	Algorithm    int       `json:"algorithm"`
+	SignCount    uint32    `json:"sign_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// BatchResult is the response of POST /v1/users:batch
+type BatchResult struct {
+	Created   int               `json:"created"`
+	Failed    int               `json:"failed"`
+	ChunkSize int               `json:"chunk_size"` // ChunkSize is how many consecutive registrations were stored all or none
+	Results   []BatchItemResult `json:"results"`    // Results follow the order of the submitted registrations
+}
+
+// BatchItemResult is the outcome of one registration of a batch
+type BatchItemResult struct {
+	Index    int      `json:"index"`
+	UserName string   `json:"user_name"`
+	Status   string   `json:"status"`  // Status is "created" or "failed"
+	Problem  *Problem `json:"problem"` // Problem explains a failure; code "batch_aborted" marks registrations failed by a chunk neighbour
+}
+
+// Challenge is a single-use nonce issued by POST /v1/challenges
+type Challenge struct {
+	Nonce     string    `json:"nonce"`      // Nonce is a decimal field element
+	ExpiresAt time.Time `json:"expires_at"` // ExpiresAt is when the server stops accepting the nonce
+	KeyID     string    `json:"key_id"`     // KeyID is the key version to prove with
+}
+
+// NonceInt parses the challenge nonce as a field element
+func (c Challenge) NonceInt() (*big.Int, error) {
+	nonce, ok := new(big.Int).SetString(c.Nonce, 10)
+	if !ok {
+		return nil, fmt.Errorf("nonce %q is not a decimal integer", c.Nonce)
+	}
+	return nonce, nil
+}
+
+// ProofSubmission is the body of POST /v1/verify
+type ProofSubmission struct {
+	UserName string `json:"user_name"`        // The user the proof is claimed for
+	Nonce    string `json:"nonce"`            // The challenge nonce the proof was generated against
+	Proof    []byte `json:"proof,omitempty"`  // The Groth16 proof in gnark binary encoding
+	KeyID    string `json:"key_id,omitempty"` // The key version the proof was generated with
+	Device   string `json:"device,omitempty"` // The label of the device whose commitment the proof is for; any active one when empty
+	// CryptoCommitment is the commitment the proof is for, which a server with commitment_blinding
+	// checks against the keyed hash it stores
+	CryptoCommitment string `json:"crypto_commitment,omitempty"`
+	// SnarkJSProof replaces Proof with a snarkjs proof of an equivalent circom circuit, on servers with a snarkjs_verifying_key
+	SnarkJSProof *verifier.SnarkJSProof `json:"snarkjs_proof,omitempty"`
+	Curve        string                 `json:"curve,omitempty"` // The curve the proof was made over, the user's; empty for the circuit's own
+	// ProofEncoding is Proof's point encoding, verifier.ProofCompressed or verifier.ProofUncompressed;
+	// empty is compressed
+	ProofEncoding string `json:"proof_encoding,omitempty"`
+	// Envelope replaces Proof, Curve and ProofEncoding with a versioned envelope, on servers that
+	// read them; InEnvelope moves them into one
+	Envelope *verifier.ProofEnvelope `json:"proof_envelope,omitempty"`
+	// TOTPCode is the user's one-time code, for users who enrolled TOTP in tenants that check it
+	TOTPCode string `json:"totp_code,omitempty"`
+	// WebAuthn is the assertion of the hardware key the user's registration is bound to, if it is,
+	// made over WebAuthnChallenge(Nonce)
+	WebAuthn *WebAuthnAssertion `json:"webauthn,omitempty"`
+}
+
+// NewProofSubmission serializes a gnark proof made with key version keyID for submission
+func NewProofSubmission(userName string, nonce *big.Int, keyID string, proof groth16.Proof) (ProofSubmission, error) {
+	encoded, encodeErr := prover.EncodeProof(proof)
+	if encodeErr != nil {
+		return ProofSubmission{}, encodeErr
+	}
+	return ProofSubmission{UserName: userName, Nonce: nonce.String(), Proof: encoded, KeyID: keyID, ProofEncoding: verifier.ProofCompressed}, nil
+}
+
+// InEnvelope returns the submission with its proof wrapped in a verifier.ProofEnvelope declaring
+// the circuit version it is for, so a server that can't read it says why
+func (s ProofSubmission) InEnvelope(circuitVersion string) ProofSubmission {
+	curve := s.Curve
+	if curve == "" {
+		curve = circuit.Curve.String()
+	}
+	s.Envelope = &verifier.ProofEnvelope{
+		FormatVersion:  verifier.ProofEnvelopeVersion,
+		Curve:          curve,
+		Backend:        verifier.BackendGroth16,
+		CircuitVersion: circuitVersion,
+		Encoding:       s.ProofEncoding,
+		Payload:        s.Proof,
+	}
+	s.Proof, s.Curve, s.ProofEncoding = nil, "", ""
+	return s
+}
+
+// Verdict is the response of a successful verification
+type Verdict struct {
+	Status string `json:"status"`
+	KeyID  string `json:"key_id"` // KeyID is the key version the proof was checked against
+	// Signed is the verdict signed by a server with verdict_signing enabled, for services it is
+	// relayed to; they check it with verifier.VerifyVerdict and a key of SigningKeys
+	Signed string `json:"verdict,omitempty"`
+}
+
+// BulkProof is one proof sent to VerifyBulk
+type BulkProof struct {
+	ID string `json:"id,omitempty"` // ID is echoed in the proof's result to match the two up
+	ProofSubmission
+}
+
+// BulkResult is the outcome of one proof sent to VerifyBulk
+type BulkResult struct {
+	Index    int      `json:"index"` // Index is the proof's position in the stream; -1 when the server stopped reading it
+	ID       string   `json:"id"`
+	UserName string   `json:"user_name"`
+	Valid    bool     `json:"valid"`
+	KeyID    string   `json:"key_id"`  // KeyID is the key version a valid proof verified under
+	Problem  *Problem `json:"problem"` // Problem explains why the proof isn't valid
+}
+
+// LoadEvent is one line of the report LoadCommitments streams back
+type LoadEvent struct {
+	Event    string   `json:"event"` // Event is "failed", "progress" or "summary"
+	Row      int      `json:"row"`   // Row is a failed record's number in the file, from 1; 0 when the file itself broke off
+	UserName string   `json:"user_name"`
+	Problem  *Problem `json:"problem"`
+	LoadCounts
+}
+
+// LoadCounts tally the records of a load the server has handled
+type LoadCounts struct {
+	DryRun    bool `json:"dry_run"`
+	Processed int  `json:"processed"`
+	Loaded    int  `json:"loaded"` // Loaded counts the records stored, or for a dry run those that would be
+	Failed    int  `json:"failed"`
+}
+
+// UserQuery selects the users ListUsers returns; zero fields don't filter
+type UserQuery struct {
+	Tenant        string    // Tenant lists the users of one tenant only
+	CreatedAfter  time.Time // CreatedAfter lists users registered at or after it
+	CreatedBefore time.Time // CreatedBefore lists users registered before it
+	Revoked       *bool     // Revoked lists only expired or deactivated users, or only those still verifying
+	Locked        *bool     // Locked lists only users under a brute-force lockout, or only the others
+	Deleted       *bool     // Deleted lists only soft-deleted users, or only the others
+	Cursor        string    // Cursor is the NextCursor of the previous page
+	Limit         int       // Limit caps the users of the page; 0 takes the server's default
+}
+
+// UserSummary describes a registered user, as ListUsers returns them
+type UserSummary struct {
+	UserName       string     `json:"user_name"`
+	Tenant         string     `json:"tenant"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CircuitVersion string     `json:"circuit_version"`
+	Curve          string     `json:"curve"`
+	KeyID          string     `json:"key_id"`
+	Devices        int        `json:"devices"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+	Revoked        bool       `json:"revoked"`
+	Locked         bool       `json:"locked"`
+	Pending        bool       `json:"pending"`
+	TOTP           bool       `json:"totp"`
+	WebAuthn       bool       `json:"webauthn"`
+}
+
+// UserPage is one page of ListUsers
+type UserPage struct {
+	Users      []UserSummary `json:"users"`
+	NextCursor string        `json:"next_cursor"` // NextCursor continues the listing; empty on the last page
+}
+
+// Session is the outcome of a successful LoginInteractive
+type Session struct {
+	UserName  string
+	KeyID     string    // KeyID is the key version the proof verified under
+	Token     string    // Token is the session JWT signed by the server
+	ExpiresAt time.Time // ExpiresAt is when the token stops being valid
+}
+
+// StepUp is the outcome of a successful StepUp: a short-lived token attesting that the holder of
+// a session proved knowledge of the secret again, for operations that ask for a fresh proof
+type StepUp struct {
+	Token          string `json:"step_up_token"`
+	AssuranceLevel string `json:"acr"`
+	SessionID      string `json:"session_id"` // SessionID is the "jti" of the session token elevated
+	KeyID          string `json:"key_id"`
+	ExpiresIn      int64  `json:"expires_in"` // ExpiresIn is the token's lifetime in seconds, at most the session's
+}
+
+// Ceremony is the manifest of the setup ceremony a key version comes from, as served by GET /v1/ceremony
+type Ceremony struct {
+	ceremony.Manifest
+	KeyID string `json:"key_id"`
+}
+
+// Circuit describes the server's authentication circuit as served by GET /v1/circuit
+type Circuit struct {
+	Version     string              `json:"version"`
+	Composition circuit.Composition `json:"composition"` // Composition names the gadgets commitments and proofs must match
+	Curve       string              `json:"curve"`
+	Curves      []string            `json:"curves"`  // Curves lists every curve the server verifies proofs over, Curve first
+	Backend     string              `json:"backend"` // Backend is "groth16", or "mock" for a server in mock_prover mode
+	Statement   string              `json:"statement"`
+	Constraints int                 `json:"constraints"`
+	// PublicInputs lists the public inputs in witness order; a client proving with another layout is
+	// proving another statement
+	PublicInputs []circuit.PublicInput `json:"public_inputs"`
+	KeyID        string                `json:"key_id"`
+	// VerifyingKeyHash is "sha256:" and the hex SHA-256 of the current verifying key, as verifier.KeyHash computes it
+	VerifyingKeyHash string `json:"verifying_key_hash"`
+	Mock             bool   `json:"mock,omitempty"` // Mock is set by a server in mock_prover mode, whose proofs prove nothing
+	// KDFs lists the KDF parameter sets the server registers secrets under, its default first.
+	// Registering with one needs only its name and version; proving uses what UserParams returns.
+	KDFs []secret.KDFParams `json:"kdfs"`
+}
+
+// UserParams are the public parameters of a registration served by GET /v1/users/{id}/params:
+// what a client needs besides the secret to rebuild the witness. Unless the server reveals user
+// existence, an unknown user gets plausible decoy parameters rather than an error.
+type UserParams struct {
+	UserName       string            `json:"user_name"`
+	Salt           []byte            `json:"salt,omitempty"`
+	KDF            *secret.KDFParams `json:"kdf,omitempty"` // KDF is nil for raw integer secrets
+	CircuitVersion string            `json:"circuit_version"`
+	Curve          string            `json:"curve"`
+}
+
+// Policy is the secret policy served by GET /v1/policy
+type Policy struct {
+	CircuitVersion string  `json:"circuit_version"`
+	MinBits        int     `json:"min_bits"`
+	MinSecret      string  `json:"min_secret"`
+	Denylist       []int64 `json:"denylist"`
+	KeyID          string  `json:"key_id"` // KeyID names the policy circuit's key
+}
+
+// ServerTime is the server's clock as served by GET /v1/time
+type ServerTime struct {
+	Time             time.Time `json:"time"`
+	UnixMillis       int64     `json:"unix_millis"`
+	ClockSkewSeconds float64   `json:"clock_skew_seconds"` // ClockSkewSeconds is how far off the local clock may be
+	// ClockOffsetSeconds is how far the server's clock was behind its NTP server at startup, when checked
+	ClockOffsetSeconds *float64   `json:"clock_offset_seconds,omitempty"`
+	Epoch              uint64     `json:"epoch,omitempty"` // Epoch is the current group epoch, when groups are enabled
+	EpochEndsAt        *time.Time `json:"epoch_ends_at,omitempty"`
+	EpochSeconds       int64      `json:"epoch_seconds,omitempty"`
+	// Offset is how far the local clock is behind the server's, measured by Client.Time
+	Offset time.Duration `json:"-"`
+}
+
+// Group describes a group as served by GET /v1/groups/{group}
+type Group struct {
+	Group       string    `json:"group"`
+	Epoch       uint64    `json:"epoch"`         // Epoch is the epoch proofs must be made for
+	EpochEndsAt time.Time `json:"epoch_ends_at"` // EpochEndsAt is when a member may log in again with a fresh nullifier
+	MembersRoot string    `json:"members_root"`
+	Members     []string  `json:"members"` // Members are the group's commitments, from which the membership path is built
+	KeyID       string    `json:"key_id"`  // KeyID names the group circuit's key
+}
+
+// GroupLoginRequest is the body of POST /v1/groups/{group}/login
+type GroupLoginRequest struct {
+	Nonce       string `json:"nonce"`
+	Epoch       uint64 `json:"epoch"`
+	MembersRoot string `json:"members_root"`
+	Nullifier   string `json:"nullifier"`
+	Proof       []byte `json:"proof"`
+}
+
+// GroupSession is the outcome of an anonymous group login
+type GroupSession struct {
+	Group     string
+	Nullifier string    // Nullifier is the token's subject, the same for every login of this member in the epoch
+	Token     string    // Token is the group JWT signed by the server
+	ExpiresAt time.Time // ExpiresAt is when the token stops being valid
+}
+
+// KeyVersion describes a Groth16 key version on the admin API
+type KeyVersion struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // ExpiresAt is when a replaced version stops verifying
+	Current   bool       `json:"current"`
+}
+
+// Roles of API keys on the admin API
+const (
+	RoleViewer      = "viewer"
+	RoleOperator    = "operator"
+	RoleTenantAdmin = "tenant-admin"
+	RoleSuperAdmin  = "super-admin"
+)
+
+// APIKey describes an API key of the admin API
+type APIKey struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+	Key    string `json:"key,omitempty"` // Key is the credential, only returned by CreateAPIKey
+	// DailyQuota and MonthlyQuota bound the key's requests per UTC day and month; 0 is unbounded
+	DailyQuota   int64     `json:"daily_quota,omitempty"`
+	MonthlyQuota int64     `json:"monthly_quota,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// apiKeyRequest is the body creating an API key or assigning it a role
+type apiKeyRequest struct {
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// quotaRequest is the body setting the quotas of an API key
+type quotaRequest struct {
+	DailyQuota   int64 `json:"daily_quota"`
+	MonthlyQuota int64 `json:"monthly_quota"`
+}
+
+// LoginRules are the conditions an authentication policy puts on logins; each is left out at its
+// zero value
+type LoginRules struct {
+	AllowedHours *HourWindow `json:"allowed_hours,omitempty"` // AllowedHours is when logins are accepted
+	MaxSessions  int         `json:"max_sessions,omitempty"`  // MaxSessions bounds the session tokens a user holds at once
+	// CircuitVersion is the circuit proofs must verify under
+	CircuitVersion string `json:"circuit_version,omitempty"`
+	// RequireDevice requires proofs from a registered device, or a WebAuthn-bound user
+	RequireDevice bool `json:"require_device,omitempty"`
+	// AllowedCountries and BlockedCountries are ISO 3166-1 alpha-2 codes of the client's country
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+}
+
+// HourWindow is a daily span of local time, such as office hours
+type HourWindow struct {
+	From     string   `json:"from"`                // From is when the window opens, as "09:00"
+	To       string   `json:"to"`                  // To is when it closes; before From, the window spans midnight
+	TimeZone string   `json:"time_zone,omitempty"` // TimeZone is an IANA zone such as "Europe/Berlin"; UTC when empty
+	Weekdays []string `json:"weekdays,omitempty"`  // Weekdays are the days the window opens on, as "mon"; every day when empty
+}
+
+// AuthPolicy holds the logins of a tenant's users, or of one user, to LoginRules
+type AuthPolicy struct {
+	Tenant   string `json:"tenant,omitempty"`
+	UserName string `json:"user_name,omitempty"` // UserName is set for the policy of one user
+	LoginRules
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// authPolicies is the body listing authentication policies
+type authPolicies struct {
+	Policies []AuthPolicy `json:"policies"`
+}
+
+// Transcript is the record of a proof a login was accepted on, with what it verified against
+type Transcript struct {
+	ID             string `json:"id"`
+	UserName       string `json:"user_name"`
+	Tenant         string `json:"tenant,omitempty"`
+	KeyID          string `json:"key_id"` // KeyID is the key version the proof verified under
+	CircuitVersion string `json:"circuit_version"`
+	Curve          string `json:"curve"`
+	// Proof is the proof in gnark binary encoding, in ProofEncoding; SnarkJSProof holds the
+	// proof.json of a snarkjs proof instead
+	Proof         []byte          `json:"proof,omitempty"`
+	ProofEncoding string          `json:"proof_encoding,omitempty"`
+	SnarkJSProof  json.RawMessage `json:"snarkjs_proof,omitempty"`
+	// Commitment and Nonce are the public inputs the proof verified against, as decimal strings
+	Commitment string    `json:"commitment"`
+	Nonce      string    `json:"nonce"`
+	Verdict    string    `json:"verdict"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// transcripts is the body listing proof transcripts
+type transcripts struct {
+	Transcripts []Transcript `json:"transcripts"`
+}
+
+// TranscriptVerification is the outcome of running the pairing check of a transcript again
+type TranscriptVerification struct {
+	TranscriptID string    `json:"transcript_id"`
+	Verdict      string    `json:"verdict"`          // Verdict is "valid" or "invalid"
+	Reason       string    `json:"reason,omitempty"` // Reason is why an invalid proof failed
+	KeyID        string    `json:"key_id"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// CommitmentCollision is a commitment held by more than one user, who registered the same secret
+type CommitmentCollision struct {
+	Fingerprint string   `json:"fingerprint"` // Fingerprint is the hex of the first 8 bytes of the commitment's SHA-256
+	Users       []string `json:"users"`
+	Unsalted    bool     `json:"unsalted"` // Unsalted is set when none of the users registered with a salt
+}
+
+// CommitmentCollisions is the collision report of the stored registrations
+type CommitmentCollisions struct {
+	Collisions []CommitmentCollision `json:"collisions"`
+	Users      int                   `json:"users"` // Users adds up the users of the collisions
+}
+
+// KeyUsage is the usage of an API key today and this month, UTC, against its quotas
+type KeyUsage struct {
+	APIKeyID     string `json:"api_key_id"`
+	Name         string `json:"name"`
+	Tenant       string `json:"tenant,omitempty"`
+	Daily        int64  `json:"daily"`
+	DailyQuota   int64  `json:"daily_quota,omitempty"`
+	Monthly      int64  `json:"monthly"`
+	MonthlyQuota int64  `json:"monthly_quota,omitempty"`
+}
+
+// Usage is the usage of the API keys as of Day, e.g. "2024-05-01"
+type Usage struct {
+	Day  string     `json:"day"`
+	Keys []KeyUsage `json:"keys"`
+}
+
+// UsageRecord is the usage of an API key on one UTC day, for billing
+type UsageRecord struct {
+	Day      string `json:"day"`
+	APIKeyID string `json:"api_key_id"`
+	Tenant   string `json:"tenant,omitempty"`
+	Requests int64  `json:"requests"`
+}
+
+// usageRecords is the response of the usage export
+type usageRecords struct {
+	Records []UsageRecord `json:"records"`
+}
+
+// User is a registration as exported in snapshots
+type User struct {
+	UserName         string            `json:"user_name"`
+	CryptoCommitment string            `json:"crypto_commitment"`
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	CircuitVersion   string            `json:"circuit_version"`
+	Curve            string            `json:"curve,omitempty"`
+	KeyID            string            `json:"key_id,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+// CircuitMetadata describes a circuit version referenced by a snapshot
+type CircuitMetadata struct {
+	Version   string `json:"version"`
+	Curve     string `json:"curve"`
+	Statement string `json:"statement"`
+}
+
+// Snapshot is the document served by GET /admin/backup and accepted by POST /admin/restore
+type Snapshot struct {
+	FormatVersion int               `json:"format_version"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Circuits      []CircuitMetadata `json:"circuits"`
+	Users         []User            `json:"users"`
+}
+
+// RestoreReport is the outcome of POST /admin/restore
+type RestoreReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Total    int      `json:"total"`
+	Created  int      `json:"created"`
+	Replaced int      `json:"replaced"`
+	Problems []string `json:"problems"`
+}
+
+// ProveJobRequest is the body of POST /v1/prove. It carries the secret, so only use it
+// against a server the user already trusts with it.
+type ProveJobRequest struct {
+	UserSecret *secret.Buffer `json:"user_secret"`
+	Nonce      string         `json:"nonce"`
+	// ProofEncoding asks for the proof in verifier.ProofUncompressed rather than the default compressed points
+	ProofEncoding string `json:"proof_encoding,omitempty"`
+}
+
+// Job is the state of an asynchronous proving job
+type Job struct {
+	ID               string     `json:"id"`
+	Status           string     `json:"status"` // queued, proving, done, failed or cancelled
+	CreatedAt        time.Time  `json:"created_at"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+	CryptoCommitment string     `json:"crypto_commitment,omitempty"`
+	Nonce            string     `json:"nonce,omitempty"`
+	Proof            []byte     `json:"proof,omitempty"`
+	ProofEncoding    string     `json:"proof_encoding,omitempty"` // ProofEncoding is Proof's point encoding, to submit it with
+	KeyID            string     `json:"key_id,omitempty"`
+	Stage            string     `json:"stage,omitempty"`   // Stage is how far proving got: witness, proving or done
+	Percent          float64    `json:"percent,omitempty"` // Percent is the server's estimate of the proving work done
+	Error            string     `json:"error,omitempty"`
+}
+
+// ProofGrantType is the OAuth grant_type under which a proof is exchanged for tokens
+const ProofGrantType = "urn:ofa:params:oauth:grant-type:zk-proof"
+
+// TokenSet is the response of the token endpoint
+type TokenSet struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`              // ExpiresIn is the access token lifetime in seconds
+	RefreshToken string `json:"refresh_token,omitempty"` // RefreshToken replaces the one just redeemed, if any
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// TokenIntrospection is the response of POST /v1/introspect; only Active is set for inactive tokens
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"` // Subject is the user the token was issued for
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"` // ExpiresAt is when the token lapses, in Unix seconds
+	IssuedAt  int64  `json:"iat,omitempty"`
+	JWTID     string `json:"jti,omitempty"`
+	// AssuranceLevel is set for step-up tokens. SessionID is the session they elevate, the one an
+	// access token belongs to, or a session token's own jti
+	AssuranceLevel string `json:"acr,omitempty"`
+	SessionID      string `json:"sid,omitempty"`
+}
+
+// CredentialRequest is the body of POST /v1/credentials
+type CredentialRequest struct {
+	ProofSubmission
+	Holder string `json:"holder,omitempty"` // Holder is the DID the credential is issued to
+}
+
+// Credential is a Verifiable Credential issued by POST /v1/credentials
+type Credential struct {
+	Format     string    `json:"format"`     // Format is "jwt_vc"
+	Credential string    `json:"credential"` // Credential is the signed JWT-VC
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Problem is the RFC 7807 body of an error response
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"` // Code is stable across releases, unlike Title and Detail
+	// Reason tells why a proof_invalid or challenge_expired verification failed, e.g. "proof_malformed"
+	Reason string `json:"reason,omitempty"`
+	// InvalidParams lists each invalid field of an invalid_request
+	InvalidParams []validate.FieldError `json:"invalid_params,omitempty"`
+}
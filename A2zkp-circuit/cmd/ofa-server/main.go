@@ -0,0 +1,26 @@
+// Command ofa-server runs the one-factor authentication server.
+//
+// Usage:
+//
+//	ofa-server [serve] [-config FILE] [-addr ADDR] [-db PATH]
+//	ofa-server keygen  [-out DIR] [-seal] [-ceremony DIR] [-config FILE]
+//	ofa-server ceremony -participant NAME [-phase 1|2] [-attestation TEXT] [-dir DIR] [-config FILE]
+//	ofa-server backup  [-out FILE] [-db PATH | -config FILE]
+//	ofa-server restore [-in FILE] [-db PATH | -config FILE] [-dry-run]
+//	ofa-server import  [-in FILE] [-format csv|jsonl] [-db PATH | -config FILE] [-dry-run]
+//	ofa-server load    [-in FILE] [-format csv|jsonl] [-report FILE] [-db PATH | -config FILE] [-dry-run]
+//	ofa-server openapi
+package main
+
+import (
+	"log"
+	"os"
+
+	"A2zkp-circuit/server"
+)
+
+func main() {
+	if commandErr := server.Main(os.Args[1:]); commandErr != nil {
+		log.Fatal("Error: ", commandErr)
+	}
+}
@@ -0,0 +1,155 @@
+//go:build js && wasm
+
+// Command ofa-wasm is the browser build of the prover.
+//
+// Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o web/prover.wasm ./cmd/ofa-wasm
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" web/
+//
+// and load it with wasm_exec.js. Once started it installs a global "ofa" object:
+//
+//	ofa.generateCommitment(secret)           -> string
+//	ofa.loadProvingKey(provingKeyBytes)      -> Promise<void>
+//	ofa.prove(secret, nonce)                 -> Promise<Uint8Array>
+//
+// Secrets are passed as a Uint8Array of decimal digits, which is zero-filled once read, and
+// nonces as decimal strings so JavaScript numbers never lose precision.
+// The proof bytes can be base64-encoded and posted to /v1/verify as-is.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"syscall/js"
+
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/logger"
+)
+
+// activeProver is set by loadProvingKey and used by prove
+var activeProver *prover.Prover
+
+func main() {
+	logger.Disable()
+
+	js.Global().Set("ofa", js.ValueOf(map[string]any{
+		"generateCommitment": js.FuncOf(generateCommitment),
+		"loadProvingKey":     js.FuncOf(loadProvingKey),
+		"prove":              js.FuncOf(prove),
+	}))
+
+	// Keep the Go runtime alive so the exported functions stay callable
+	select {}
+}
+
+// generateCommitment returns the commitment for a secret, or throws
+func generateCommitment(this js.Value, args []js.Value) any {
+	if len(args) != 1 {
+		panic(js.Global().Get("Error").New("generateCommitment(secret) takes one argument"))
+	}
+	userSecret, parseErr := secretArg(args[0])
+	if parseErr != nil {
+		panic(js.Global().Get("Error").New(parseErr.Error()))
+	}
+	defer userSecret.Zero()
+	cryptoCommitment, commitErr := prover.Commitment(userSecret)
+	if commitErr != nil {
+		panic(js.Global().Get("Error").New(commitErr.Error()))
+	}
+	return cryptoCommitment
+}
+
+// loadProvingKey decodes the proving key served at /v1/keys/proving and compiles the circuit
+func loadProvingKey(this js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("loadProvingKey(bytes) takes one argument")
+		}
+		raw := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(raw, args[0])
+
+		provingKey, readErr := prover.ReadProvingKey(bytes.NewReader(raw))
+		if readErr != nil {
+			return nil, readErr
+		}
+		loaded, newErr := prover.New(context.Background(), provingKey)
+		if newErr != nil {
+			return nil, newErr
+		}
+		activeProver = loaded
+		return js.Undefined(), nil
+	})
+}
+
+// prove generates a proof for a secret and challenge nonce with the loaded proving key
+func prove(this js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if activeProver == nil {
+			return nil, errors.New("call loadProvingKey first")
+		}
+		if len(args) != 2 {
+			return nil, errors.New("prove(secret, nonce) takes two arguments")
+		}
+		userSecret, parseErr := secretArg(args[0])
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		defer userSecret.Zero()
+		nonce, nonceOK := new(big.Int).SetString(args[1].String(), 10)
+		if !nonceOK {
+			return nil, errors.New("invalid nonce value")
+		}
+
+		proof, proveErr := activeProver.Prove(context.Background(), userSecret, nonce)
+		if proveErr != nil {
+			return nil, proveErr
+		}
+		encoded, encodeErr := prover.EncodeProof(proof)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		result := js.Global().Get("Uint8Array").New(len(encoded))
+		js.CopyBytesToJS(result, encoded)
+		return result, nil
+	})
+}
+
+// promise runs work on a new goroutine and settles a JavaScript Promise with its result
+func promise(work func() (any, error)) any {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			result, workErr := work()
+			if workErr != nil {
+				reject.Invoke(js.Global().Get("Error").New(workErr.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+// secretArg copies the decimal digits of a secret out of a Uint8Array and wipes both copies.
+// Strings are rejected because neither Go nor JavaScript can erase them.
+func secretArg(value js.Value) (*secret.Buffer, error) {
+	if !value.InstanceOf(js.Global().Get("Uint8Array")) {
+		return nil, errors.New("secret must be a Uint8Array of decimal digits, e.g. new TextEncoder().encode(secret)")
+	}
+	digits := make([]byte, value.Get("length").Int())
+	js.CopyBytesToGo(digits, value)
+	defer secret.WipeBytes(digits)
+	value.Call("fill", 0)
+
+	userSecret, parseErr := secret.Parse(digits)
+	if parseErr != nil {
+		return nil, errors.New("invalid secret value")
+	}
+	return userSecret, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// benchPhase summarizes the timings of one phase of a benchmark
+type benchPhase struct {
+	Phase      string        `json:"phase"`
+	Count      int           `json:"count"`
+	Wall       time.Duration `json:"wall_ns"`          // Wall is the elapsed time of the whole phase
+	Throughput float64       `json:"throughput_per_s"` // Throughput is Count over Wall
+	P50        time.Duration `json:"p50_ns"`
+	P90        time.Duration `json:"p90_ns"`
+	P99        time.Duration `json:"p99_ns"`
+	Max        time.Duration `json:"max_ns"`
+}
+
+// benchRegistration is a synthetic user: a secret and the commitment registered for it
+type benchRegistration struct {
+	secret     *secret.Buffer
+	commitment string
+	nonce      *big.Int
+	proof      []byte
+}
+
+// runBench measures compiling the circuit, proving and verifying locally, with no server, to size
+// a deployment. Proving and verifying run over -n synthetic registrations on -concurrency workers.
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	count := flags.Int("n", 100, "number of synthetic registrations to prove and verify")
+	concurrency := flags.Int("concurrency", runtime.GOMAXPROCS(0), "number of proofs generated or verified at once")
+	compileRuns := flags.Int("compile-runs", 3, "number of times the circuit is compiled")
+	compositionFlag := flags.String("circuit", "", `circuit composition as the server's "circuit" JSON; the default circuit when empty`)
+	jsonOutput := flags.Bool("json", false, "print the results as JSON instead of a table")
+	flags.Parse(args)
+	if *count < 1 || *concurrency < 1 || *compileRuns < 1 {
+		return errors.New("bench: -n, -concurrency and -compile-runs must be positive")
+	}
+	composition := circuit.DefaultComposition
+	if *compositionFlag != "" {
+		if decodeErr := json.Unmarshal([]byte(*compositionFlag), &composition); decodeErr != nil {
+			return fmt.Errorf("bench: -circuit: %w", decodeErr)
+		}
+	}
+	if validateErr := composition.Validate(); validateErr != nil {
+		return fmt.Errorf("bench: -circuit: %w", validateErr)
+	}
+	ctx := context.Background()
+
+	var ccs constraint.ConstraintSystem
+	compile, compileErr := timePhase("compile", *compileRuns, 1, func(int) error {
+		var compileErr error
+		ccs, compileErr = composition.Compile()
+		return compileErr
+	})
+	if compileErr != nil {
+		return fmt.Errorf("bench: compiling: %w", compileErr)
+	}
+	var provingKey groth16.ProvingKey
+	var verifyingKey groth16.VerifyingKey
+	setup, setupErr := timePhase("setup", 1, 1, func(int) error {
+		var setupErr error
+		provingKey, verifyingKey, setupErr = groth16.Setup(ccs)
+		return setupErr
+	})
+	if setupErr != nil {
+		return fmt.Errorf("bench: setup: %w", setupErr)
+	}
+
+	registrations, generateErr := benchRegistrations(composition, *count)
+	if generateErr != nil {
+		return fmt.Errorf("bench: generating registrations: %w", generateErr)
+	}
+	defer func() {
+		for _, registration := range registrations {
+			registration.secret.Zero()
+		}
+	}()
+	p, newErr := prover.NewComposed(ctx, provingKey, composition)
+	if newErr != nil {
+		return fmt.Errorf("bench: %w", newErr)
+	}
+	prove, proveErr := timePhase("prove", *count, *concurrency, func(i int) error {
+		registration := registrations[i]
+		proof, proveErr := p.Prove(ctx, registration.secret, registration.nonce)
+		if proveErr != nil {
+			return proveErr
+		}
+		var encodeErr error
+		registration.proof, encodeErr = prover.EncodeProof(proof)
+		return encodeErr
+	})
+	if proveErr != nil {
+		return fmt.Errorf("bench: proving: %w", proveErr)
+	}
+	v := verifier.New(verifyingKey)
+	verify, verifyErr := timePhase("verify", *count, *concurrency, func(i int) error {
+		registration := registrations[i]
+		return v.VerifyProof(ctx, registration.proof, verifier.PublicInputs{Commitment: registration.commitment, Nonce: registration.nonce})
+	})
+	if verifyErr != nil {
+		return fmt.Errorf("bench: verifying: %w", verifyErr)
+	}
+
+	phases := []benchPhase{compile, setup, prove, verify}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(phases)
+	}
+	fmt.Printf("circuit %s: %d constraints, %d registrations, concurrency %d\n", composition.Version(), ccs.GetNbConstraints(), *count, *concurrency)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "phase\tcount\twall\tper second\tp50\tp90\tp99\tmax\t")
+	for _, phase := range phases {
+		fmt.Fprintf(table, "%s\t%d\t%s\t%.1f\t%s\t%s\t%s\t%s\t\n", phase.Phase, phase.Count, roundDuration(phase.Wall),
+			phase.Throughput, roundDuration(phase.P50), roundDuration(phase.P90), roundDuration(phase.P99), roundDuration(phase.Max))
+	}
+	return table.Flush()
+}
+
+// benchRegistrations generates random secrets within the composition's range, their commitments
+// and a challenge nonce for each
+func benchRegistrations(composition circuit.Composition, count int) ([]*benchRegistration, error) {
+	low, high := big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 62)
+	if minText, maxText, hasRange := strings.Cut(composition.Range, ".."); hasRange {
+		low.SetString(minText, 10)
+		high.SetString(maxText, 10)
+	}
+	span := new(big.Int).Sub(high, low)
+	span.Add(span, big.NewInt(1))
+	registrations := make([]*benchRegistration, count)
+	for i := range registrations {
+		value, randErr := rand.Int(rand.Reader, span)
+		if randErr != nil {
+			return nil, randErr
+		}
+		nonce, nonceErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if nonceErr != nil {
+			return nil, nonceErr
+		}
+		userSecret, parseErr := secret.Parse([]byte(value.Add(value, low).String()))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		commitment, commitErr := composition.GenerateCommitment(userSecret)
+		if commitErr != nil {
+			userSecret.Zero()
+			return nil, commitErr
+		}
+		registrations[i] = &benchRegistration{secret: userSecret, commitment: commitment, nonce: nonce}
+	}
+	return registrations, nil
+}
+
+// timePhase runs operation count times on up to concurrency goroutines and summarizes the latency
+// of each run. The phase fails with the first error any run returns.
+func timePhase(name string, count, concurrency int, operation func(i int) error) (benchPhase, error) {
+	latencies := make([]time.Duration, count)
+	jobs := make(chan int)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(concurrency, count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				began := time.Now()
+				if operationErr := operation(i); operationErr != nil {
+					errOnce.Do(func() { firstErr = operationErr })
+					continue
+				}
+				latencies[i] = time.Since(began)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	wall := time.Since(start)
+	if firstErr != nil {
+		return benchPhase{}, firstErr
+	}
+	slices.Sort(latencies)
+	return benchPhase{
+		Phase:      name,
+		Count:      count,
+		Wall:       wall,
+		Throughput: float64(count) / wall.Seconds(),
+		P50:        percentile(latencies, 50),
+		P90:        percentile(latencies, 90),
+		P99:        percentile(latencies, 99),
+		Max:        latencies[count-1],
+	}, nil
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// roundDuration rounds a latency to three significant digits or so for the table
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
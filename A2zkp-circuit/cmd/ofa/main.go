@@ -0,0 +1,512 @@
+// Command ofa is a command-line client for the one-factor authentication server.
+//
+// Usage:
+//
+//	ofa commit   -secret N
+//	ofa register -server URL -user NAME -secret N
+//	ofa migrate  -server URL -user NAME -secret PASSWORD
+//	ofa prove    -server URL -user NAME -secret N [-nonce N] [-progress] > proof.json
+//	ofa verify   -server URL [-in proof.json]
+//	ofa token    -server URL -client-id ID [-scope S] [-in proof.json | -refresh TOKEN]
+//	ofa convert  -kind proof|public|vk -from gnark|snarkjs|raw -to gnark|snarkjs|raw [-in FILE] [-out FILE]
+//	ofa bench    [-n N] [-concurrency N] [-compile-runs N] [-circuit JSON] [-json]
+//	ofa ceremony -server URL [-key-id ID]
+//
+// With -password the secret is treated as a PIN or password and stretched with Argon2id
+// (tuned by -argon2-memory, -argon2-time and -argon2-parallelism) before it enters the
+// circuit. register picks a random salt unless -salt is given and prints it to stderr.
+// prove fetches the salt and parameters stored with the registration unless -salt is given, and
+// derives with the scrypt or PBKDF2 ones of registrations made under those. With -progress it
+// draws a bar of the proof generation on stderr, for devices where proving takes a while.
+//
+// The secret may also be supplied through the OFA_SECRET environment variable so it
+// doesn't show up in the process list, or piped on stdin when neither is set, which keeps
+// it out of Go strings entirely so it can be zeroed after use. It is only ever used
+// locally: the server receives the commitment at registration and a proof at login.
+//
+// migrate completes the migration of a user the server imported with a legacy password hash:
+// the password is sent this once for the server to check against the hash, and stretched as
+// -password would into the secret whose commitment replaces it, so later logins use prove -password.
+//
+// token exchanges a proof document for OAuth access and refresh tokens, or redeems a refresh
+// token; a confidential client's secret is read from $OFA_CLIENT_SECRET.
+//
+// convert translates a proof, public signals or verifying key between gnark's binary encoding,
+// snarkjs JSON and raw compressed points, so artifacts can be checked with either toolchain.
+//
+// bench compiles the circuit, sets up keys and proves and verifies -n synthetic registrations
+// locally, reporting throughput and latency percentiles of each phase for capacity planning.
+//
+// ceremony downloads the transcript of the setup ceremony the server's keys come from and replays
+// it locally against the circuit and the deployed keys, listing the contributions once it checks out.
+//
+// For golden-file tests and cross-implementation debugging, $OFA_DETERMINISTIC_SEED derives
+// every salt and proof from a seed instead of fresh randomness. Never set it for real users.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/client"
+	"A2zkp-circuit/convert"
+	"A2zkp-circuit/entropy"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/logger"
+)
+
+func main() {
+	log.SetFlags(0)
+	// gnark logs to stdout by default, which would corrupt the proof documents written there
+	logger.Disable()
+	if len(os.Args) < 2 {
+		log.Fatal("usage: ofa <commit|register|migrate|prove|verify|token|convert|bench|ceremony> [flags]")
+	}
+	if seed := os.Getenv("OFA_DETERMINISTIC_SEED"); seed != "" {
+		entropy.UseSeed(seed)
+	}
+
+	var commandErr error
+	switch os.Args[1] {
+	case "commit":
+		commandErr = runCommit(os.Args[2:])
+	case "register":
+		commandErr = runRegister(os.Args[2:])
+	case "migrate":
+		commandErr = runMigrate(os.Args[2:])
+	case "prove":
+		commandErr = runProve(os.Args[2:])
+	case "verify":
+		commandErr = runVerify(os.Args[2:])
+	case "token":
+		commandErr = runToken(os.Args[2:])
+	case "convert":
+		commandErr = runConvert(os.Args[2:])
+	case "bench":
+		commandErr = runBench(os.Args[2:])
+	case "ceremony":
+		commandErr = runCeremony(os.Args[2:])
+	default:
+		commandErr = fmt.Errorf("unknown command %q (want commit, register, migrate, prove, verify, token, convert, bench or ceremony)", os.Args[1])
+	}
+	if commandErr != nil {
+		log.Fatal("ofa: ", commandErr)
+	}
+}
+
+// runCommit prints the commitment for a secret without contacting the server
+func runCommit(args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	secretFlag := flags.String("secret", "", "the user secret (defaults to $OFA_SECRET, then stdin)")
+	kdf := addKDFFlags(flags)
+	flags.Parse(args)
+
+	userSecret, secretErr := kdf.load(*secretFlag, false)
+	if secretErr != nil {
+		return secretErr
+	}
+	defer userSecret.Zero()
+	cryptoCommitment, commitErr := prover.Commitment(userSecret)
+	if commitErr != nil {
+		return commitErr
+	}
+	fmt.Println(cryptoCommitment)
+	return nil
+}
+
+// runRegister computes the commitment locally and registers it for a user
+func runRegister(args []string) error {
+	flags := flag.NewFlagSet("register", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	userName := flags.String("user", "", "user name to register")
+	secretFlag := flags.String("secret", "", "the user secret (defaults to $OFA_SECRET, then stdin)")
+	policy := flags.Bool("policy", false, "prove the secret meets the server's secret policy")
+	kdf := addKDFFlags(flags)
+	flags.Parse(args)
+
+	userSecret, secretErr := kdf.load(*secretFlag, true)
+	if secretErr != nil {
+		return secretErr
+	}
+	defer userSecret.Zero()
+	// The commitment follows the server's circuit, which may commit other than by squaring
+	sdk := client.New(*serverURL)
+	cryptoCommitment, commitErr := sdk.Commitment(context.Background(), userSecret)
+	if commitErr != nil {
+		return commitErr
+	}
+
+	registration := client.Registration{UserName: *userName, CryptoCommitment: cryptoCommitment}
+	if kdf.password {
+		params := kdf.params()
+		registration.Salt, registration.KDF = kdf.salt, &params
+	}
+	if *policy {
+		var proofErr error
+		if registration.PolicyProof, proofErr = sdk.PolicyProof(context.Background(), userSecret); proofErr != nil {
+			return proofErr
+		}
+	}
+	if registerErr := sdk.Register(context.Background(), registration); registerErr != nil {
+		return registerErr
+	}
+	fmt.Printf("registered %s\n", *userName)
+	return nil
+}
+
+// runMigrate replaces the legacy password hash of an imported user with the commitment to the
+// password stretched with Argon2id, which logs the user in
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	userName := flags.String("user", "", "user name to migrate")
+	secretFlag := flags.String("secret", "", "the user's password (defaults to $OFA_SECRET, then stdin)")
+	policy := flags.Bool("policy", false, "prove the secret meets the server's secret policy")
+	kdf := addKDFFlags(flags)
+	flags.Parse(args)
+
+	password, readErr := readSecretInput(*secretFlag)
+	if readErr != nil {
+		return readErr
+	}
+	defer secret.WipeBytes(password)
+	// The password is always stretched: it is what the user typed into the legacy system
+	kdf.password = true
+	userSecret, secretErr := kdf.load(string(password), true)
+	if secretErr != nil {
+		return secretErr
+	}
+	defer userSecret.Zero()
+	sdk := client.New(*serverURL)
+	cryptoCommitment, commitErr := sdk.Commitment(context.Background(), userSecret)
+	if commitErr != nil {
+		return commitErr
+	}
+
+	params := kdf.params()
+	registration := client.Registration{UserName: *userName, CryptoCommitment: cryptoCommitment, Salt: kdf.salt, KDF: &params}
+	if *policy {
+		var proofErr error
+		if registration.PolicyProof, proofErr = sdk.PolicyProof(context.Background(), userSecret); proofErr != nil {
+			return proofErr
+		}
+	}
+	session, migrateErr := sdk.Migrate(context.Background(), *userName, string(password), registration)
+	if migrateErr != nil {
+		return migrateErr
+	}
+	fmt.Printf("migrated %s\n", *userName)
+	if session.Token != "" {
+		fmt.Println(session.Token)
+	}
+	return nil
+}
+
+// runProve requests a challenge (unless one is given) and writes a proof document to stdout
+func runProve(args []string) error {
+	flags := flag.NewFlagSet("prove", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	userName := flags.String("user", "", "user name to prove for")
+	secretFlag := flags.String("secret", "", "the user secret (defaults to $OFA_SECRET, then stdin)")
+	nonceFlag := flags.String("nonce", "", "challenge nonce to bind the proof to; requested from the server when empty")
+	showProgress := flags.Bool("progress", false, "draw a progress bar of the proof generation on stderr")
+	kdf := addKDFFlags(flags)
+	flags.Parse(args)
+
+	ctx := context.Background()
+	if *showProgress {
+		ctx = prover.WithProgress(ctx, drawProgress)
+	}
+	api := client.New(*serverURL)
+	if kdf.password && kdf.saltFlag == "" {
+		params, paramsErr := api.UserParams(ctx, *userName)
+		if paramsErr != nil {
+			return paramsErr
+		}
+		if adoptErr := kdf.adopt(params); adoptErr != nil {
+			return adoptErr
+		}
+	}
+	userSecret, secretErr := kdf.load(*secretFlag, false)
+	if secretErr != nil {
+		return secretErr
+	}
+	defer userSecret.Zero()
+
+	// Obtain the challenge the proof will be bound to
+	challenge := client.Challenge{Nonce: *nonceFlag}
+	if challenge.Nonce == "" {
+		var challengeErr error
+		if challenge, challengeErr = api.RequestChallenge(ctx, *userName); challengeErr != nil {
+			return challengeErr
+		}
+	}
+
+	submission, proveErr := api.Prove(ctx, *userName, userSecret, challenge)
+	if proveErr != nil {
+		return proveErr
+	}
+	return json.NewEncoder(os.Stdout).Encode(submission)
+}
+
+// progressBarWidth is how many cells the bar "ofa prove -progress" draws has
+const progressBarWidth = 30
+
+// drawProgress redraws the proving progress bar in place on stderr, ending its line once the proof is done
+func drawProgress(progress prover.Progress) {
+	filled := int(progress.Percent) * progressBarWidth / 100
+	fmt.Fprintf(os.Stderr, "\r%-7s [%s%s] %3.0f%%", progress.Stage, strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), progress.Percent)
+	if progress.Stage == prover.StageDone {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// runVerify submits a proof document produced by "ofa prove"
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	inPath := flags.String("in", "-", "proof document to submit, - for stdin")
+	flags.Parse(args)
+
+	submission, readErr := readProofDocument(*inPath)
+	if readErr != nil {
+		return readErr
+	}
+
+	verdict, verifyErr := client.New(*serverURL).Verify(context.Background(), submission)
+	if verifyErr != nil {
+		return verifyErr
+	}
+	fmt.Println(verdict.Status)
+	return nil
+}
+
+// runToken exchanges a proof document or a refresh token for tokens and prints the token response
+func runToken(args []string) error {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	clientID := flags.String("client-id", "", "OAuth client ID registered in the server's oidc config")
+	scope := flags.String("scope", "", "space-separated scopes; defaults to every scope of the client")
+	inPath := flags.String("in", "-", "proof document to exchange, - for stdin")
+	refreshToken := flags.String("refresh", "", "redeem this refresh token instead of a proof")
+	flags.Parse(args)
+
+	api := client.New(*serverURL)
+	credentials := client.ClientCredentials{ID: *clientID, Secret: os.Getenv("OFA_CLIENT_SECRET")}
+	var tokens client.TokenSet
+	var tokenErr error
+	if *refreshToken != "" {
+		tokens, tokenErr = api.RefreshTokens(context.Background(), credentials, *refreshToken, *scope)
+	} else {
+		submission, readErr := readProofDocument(*inPath)
+		if readErr != nil {
+			return readErr
+		}
+		tokens, tokenErr = api.ExchangeProof(context.Background(), credentials, submission, *scope)
+	}
+	if tokenErr != nil {
+		return tokenErr
+	}
+	return json.NewEncoder(os.Stdout).Encode(tokens)
+}
+
+// runConvert re-encodes a proof, public signals or verifying key without contacting the server
+func runConvert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	kind := flags.String("kind", convert.KindProof, "what to convert: proof, public (signals) or vk")
+	from := flags.String("from", convert.Gnark, "input encoding: gnark, snarkjs or raw")
+	to := flags.String("to", convert.SnarkJS, "output encoding: gnark, snarkjs or raw")
+	inPath := flags.String("in", "-", "file to convert, - for stdin")
+	outPath := flags.String("out", "-", "file to write, - for stdout")
+	flags.Parse(args)
+
+	var input []byte
+	var readErr error
+	if *inPath == "-" {
+		input, readErr = io.ReadAll(os.Stdin)
+	} else {
+		input, readErr = os.ReadFile(*inPath)
+	}
+	if readErr != nil {
+		return readErr
+	}
+	output, convertErr := convert.Convert(*kind, *from, *to, input)
+	if convertErr != nil {
+		return convertErr
+	}
+	if *to == convert.SnarkJS {
+		output = append(output, '\n')
+	}
+	if *outPath == "-" {
+		_, writeErr := os.Stdout.Write(output)
+		return writeErr
+	}
+	return os.WriteFile(*outPath, output, 0o644)
+}
+
+// runCeremony verifies the setup ceremony transcript of the server's keys and lists its contributions
+func runCeremony(args []string) error {
+	flags := flag.NewFlagSet("ceremony", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8080", "base URL of the server")
+	keyID := flags.String("key-id", "", "key version whose ceremony to verify; the current one when empty")
+	flags.Parse(args)
+
+	verified, verifyErr := client.New(*serverURL).VerifyCeremony(context.Background(), *keyID)
+	if verifyErr != nil {
+		return verifyErr
+	}
+	fmt.Printf("Key version %s of circuit %s comes from %d verified contributions:\n", verified.KeyID, verified.CircuitVersion, len(verified.Contributions))
+	for _, contribution := range verified.Contributions {
+		fmt.Printf("  phase %d  %s  %s  %s\n", contribution.Phase, contribution.Hash, contribution.ContributedAt.Format(time.RFC3339), contribution.Participant)
+		if contribution.Attestation != "" {
+			fmt.Printf("    %s\n", contribution.Attestation)
+		}
+	}
+	return nil
+}
+
+// readProofDocument decodes a proof document written by "ofa prove" from a file or, for "-", stdin
+func readProofDocument(path string) (client.ProofSubmission, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, openErr := os.Open(path)
+		if openErr != nil {
+			return client.ProofSubmission{}, openErr
+		}
+		defer file.Close()
+		in = file
+	}
+	var submission client.ProofSubmission
+	if decodeErr := json.NewDecoder(in).Decode(&submission); decodeErr != nil {
+		return client.ProofSubmission{}, fmt.Errorf("decoding proof document: %w", decodeErr)
+	}
+	return submission, nil
+}
+
+// kdfOptions are the flags controlling Argon2id stretching of password secrets
+type kdfOptions struct {
+	password    bool
+	saltFlag    string
+	memory      uint
+	time        uint
+	parallelism uint
+	salt        []byte
+	adopted     *secret.KDFParams // adopted holds the parameters of the registration, whatever algorithm they name
+}
+
+// addKDFFlags registers the -password, -salt and -argon2-* flags on a command
+func addKDFFlags(flags *flag.FlagSet) *kdfOptions {
+	defaults := secret.DefaultArgon2idParams()
+	opts := &kdfOptions{}
+	flags.BoolVar(&opts.password, "password", false, "treat the secret as a password and stretch it with Argon2id")
+	flags.StringVar(&opts.saltFlag, "salt", "", "base64 Argon2id salt; register generates one when empty")
+	flags.UintVar(&opts.memory, "argon2-memory", uint(defaults.Memory), "Argon2id memory cost in KiB")
+	flags.UintVar(&opts.time, "argon2-time", uint(defaults.Time), "Argon2id passes over memory")
+	flags.UintVar(&opts.parallelism, "argon2-parallelism", uint(defaults.Parallelism), "Argon2id lanes")
+	return opts
+}
+
+// params returns the parameters adopt took from the registration, or else the Argon2id ones
+// selected by the flags
+func (o *kdfOptions) params() secret.KDFParams {
+	if o.adopted != nil {
+		return *o.adopted
+	}
+	return secret.KDFParams{
+		Algorithm:   secret.KDFArgon2id,
+		Memory:      uint32(o.memory),
+		Time:        uint32(o.time),
+		Parallelism: uint8(o.parallelism),
+	}
+}
+
+// adopt takes the salt and KDF parameters from a user's registration, in place of the flags
+func (o *kdfOptions) adopt(params client.UserParams) error {
+	if params.KDF == nil || len(params.Salt) == 0 {
+		return fmt.Errorf("%s was not registered with -password", params.UserName)
+	}
+	o.salt = params.Salt
+	o.adopted = params.KDF
+	return nil
+}
+
+// load reads the secret and, with -password, derives the field element from it.
+// generateSalt lets register pick a fresh salt when none was given.
+func (o *kdfOptions) load(flagValue string, generateSalt bool) (*secret.Buffer, error) {
+	if !o.password {
+		return parseSecret(flagValue)
+	}
+	switch {
+	case o.salt != nil:
+		// adopt already took the salt from the registration
+	case o.saltFlag != "":
+		salt, decodeErr := base64.StdEncoding.DecodeString(o.saltFlag)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("decoding -salt: %w", decodeErr)
+		}
+		o.salt = salt
+	case generateSalt:
+		o.salt = make([]byte, secret.MinSaltLength)
+		if _, randErr := rand.Read(o.salt); randErr != nil {
+			return nil, randErr
+		}
+		fmt.Fprintf(os.Stderr, "argon2id salt: %s\n", base64.StdEncoding.EncodeToString(o.salt))
+	default:
+		return nil, fmt.Errorf("-password needs the -salt used at registration")
+	}
+
+	password, readErr := readSecretInput(flagValue)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return secret.Derive(password, o.salt, o.params())
+}
+
+// parseSecret reads an integer secret with readSecretInput
+func parseSecret(flagValue string) (*secret.Buffer, error) {
+	digits, readErr := readSecretInput(flagValue)
+	if readErr != nil {
+		return nil, readErr
+	}
+	defer secret.WipeBytes(digits)
+
+	userSecret, parseErr := secret.Parse(digits)
+	if parseErr != nil {
+		return nil, fmt.Errorf("invalid secret: provide an integer with -secret, $OFA_SECRET or on stdin")
+	}
+	return userSecret, nil
+}
+
+// readSecretInput returns the secret bytes from the flag value, then $OFA_SECRET, then the first
+// line of stdin. The caller owns the returned slice and must wipe it.
+func readSecretInput(flagValue string) ([]byte, error) {
+	var input []byte
+	switch {
+	case flagValue != "":
+		input = []byte(flagValue)
+	case os.Getenv("OFA_SECRET") != "":
+		input = []byte(os.Getenv("OFA_SECRET"))
+	default:
+		line, readErr := bufio.NewReader(os.Stdin).ReadSlice('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("reading secret from stdin: %w", readErr)
+		}
+		// Copy the trimmed line out of the reader's buffer, then wipe the buffer
+		input = append([]byte(nil), bytes.TrimSpace(line)...)
+		secret.WipeBytes(line)
+	}
+	return input, nil
+}
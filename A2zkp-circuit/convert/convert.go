@@ -0,0 +1,468 @@
+// Package convert translates the Groth16 artifacts of the authentication circuit between the
+// encodings other tools use: gnark's binary encoding, the JSON snarkjs writes (proof.json,
+// public.json and verification_key.json), and raw compressed points.
+//
+// The raw encoding concatenates compressed BN254 points, 32 bytes per G1 point and 64 per G2
+// point, and 32-byte big-endian scalars: a proof is A|B|C, public signals are one scalar each,
+// and a verifying key is α|β|γ|δ followed by the points of the public inputs, IC[0] first.
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fp"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/witness"
+)
+
+// Encodings
+const (
+	Gnark   = "gnark"   // Gnark is gnark's binary encoding, as the server reads and writes it
+	SnarkJS = "snarkjs" // SnarkJS is snarkjs JSON
+	Raw     = "raw"     // Raw is concatenated compressed points and big-endian scalars
+)
+
+// Kinds of artifact
+const (
+	KindProof         = "proof"
+	KindPublicSignals = "public"
+	KindVerifyingKey  = "vk"
+)
+
+// ErrCommitments is returned for proofs and keys using gnark's Pedersen commitment extension,
+// which snarkjs and plain Groth16 verifiers don't know
+var ErrCommitments = errors.New("gnark commitment extension can't be converted")
+
+// Convert re-encodes one artifact of a kind from one encoding to another
+func Convert(kind, from, to string, input []byte) ([]byte, error) {
+	encodings := []string{Gnark, SnarkJS, Raw}
+	if !slices.Contains(encodings, from) || !slices.Contains(encodings, to) {
+		return nil, fmt.Errorf("encodings must be %s, %s or %s", Gnark, SnarkJS, Raw)
+	}
+	switch kind {
+	case KindProof:
+		proof, decodeErr := decodeProof(from, input)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return encodeProof(to, proof)
+	case KindPublicSignals:
+		signals, decodeErr := decodePublicSignals(from, input)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return encodePublicSignals(to, signals)
+	case KindVerifyingKey:
+		key, decodeErr := decodeVerifyingKey(from, input)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return encodeVerifyingKey(to, key)
+	default:
+		return nil, fmt.Errorf("kind %q must be %s, %s or %s", kind, KindProof, KindPublicSignals, KindVerifyingKey)
+	}
+}
+
+// decodeProof reads a proof in any encoding
+func decodeProof(encoding string, input []byte) (*groth16bn254.Proof, error) {
+	switch encoding {
+	case Gnark:
+		proof, readErr := verifier.ReadProof(input)
+		if readErr != nil {
+			return nil, readErr
+		}
+		return proof.(*groth16bn254.Proof), nil
+	case SnarkJS:
+		var proof verifier.SnarkJSProof
+		if decodeErr := json.Unmarshal(input, &proof); decodeErr != nil {
+			return nil, fmt.Errorf("decoding snarkjs proof: %w", decodeErr)
+		}
+		return ProofFromSnarkJS(proof)
+	default:
+		return ProofFromRaw(input)
+	}
+}
+
+// encodeProof writes a proof in any encoding
+func encodeProof(encoding string, proof *groth16bn254.Proof) ([]byte, error) {
+	switch encoding {
+	case Gnark:
+		var encoded bytes.Buffer
+		_, writeErr := proof.WriteTo(&encoded)
+		return encoded.Bytes(), writeErr
+	case SnarkJS:
+		converted, convertErr := ProofToSnarkJS(proof)
+		if convertErr != nil {
+			return nil, convertErr
+		}
+		return json.MarshalIndent(converted, "", "  ")
+	default:
+		return ProofToRaw(proof)
+	}
+}
+
+// ProofToSnarkJS writes a gnark proof as snarkjs's proof.json
+func ProofToSnarkJS(proof groth16.Proof) (verifier.SnarkJSProof, error) {
+	p, ok := proof.(*groth16bn254.Proof)
+	switch {
+	case !ok:
+		return verifier.SnarkJSProof{}, fmt.Errorf("proof is over %s, want BN254", proof.CurveID())
+	case len(p.Commitments) > 0:
+		return verifier.SnarkJSProof{}, ErrCommitments
+	}
+	return verifier.SnarkJSProof{PiA: snarkJSG1(p.Ar), PiB: snarkJSG2(p.Bs), PiC: snarkJSG1(p.Krs), Protocol: "groth16", Curve: "bn128"}, nil
+}
+
+// ProofFromSnarkJS reads snarkjs's proof.json into a gnark proof
+func ProofFromSnarkJS(proof verifier.SnarkJSProof) (*groth16bn254.Proof, error) {
+	var p groth16bn254.Proof
+	pointErr := errors.Join(parseG1("pi_a", proof.PiA, &p.Ar), parseG2("pi_b", proof.PiB, &p.Bs), parseG1("pi_c", proof.PiC, &p.Krs))
+	if pointErr != nil {
+		return nil, fmt.Errorf("decoding snarkjs proof: %w", pointErr)
+	}
+	return &p, nil
+}
+
+// ProofToRaw writes a proof as its compressed points A|B|C, 128 bytes
+func ProofToRaw(proof groth16.Proof) ([]byte, error) {
+	p, ok := proof.(*groth16bn254.Proof)
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("proof is over %s, want BN254", proof.CurveID())
+	case len(p.Commitments) > 0:
+		return nil, ErrCommitments
+	}
+	a, b, c := p.Ar.Bytes(), p.Bs.Bytes(), p.Krs.Bytes()
+	return slices.Concat(a[:], b[:], c[:]), nil
+}
+
+// ProofFromRaw reads a proof from its compressed points A|B|C
+func ProofFromRaw(raw []byte) (*groth16bn254.Proof, error) {
+	if len(raw) != 2*bn254.SizeOfG1AffineCompressed+bn254.SizeOfG2AffineCompressed {
+		return nil, fmt.Errorf("raw proof has %d bytes, want %d", len(raw), 2*bn254.SizeOfG1AffineCompressed+bn254.SizeOfG2AffineCompressed)
+	}
+	var p groth16bn254.Proof
+	g2End := bn254.SizeOfG1AffineCompressed + bn254.SizeOfG2AffineCompressed
+	_, aErr := p.Ar.SetBytes(raw[:bn254.SizeOfG1AffineCompressed])
+	_, bErr := p.Bs.SetBytes(raw[bn254.SizeOfG1AffineCompressed:g2End])
+	_, cErr := p.Krs.SetBytes(raw[g2End:])
+	if pointErr := errors.Join(aErr, bErr, cErr); pointErr != nil {
+		return nil, fmt.Errorf("decoding raw proof: %w", pointErr)
+	}
+	return &p, nil
+}
+
+// decodePublicSignals reads public signals in any encoding
+func decodePublicSignals(encoding string, input []byte) ([]fr.Element, error) {
+	switch encoding {
+	case Gnark:
+		return PublicSignalsFromGnark(input)
+	case SnarkJS:
+		var signals []string
+		if decodeErr := json.Unmarshal(input, &signals); decodeErr != nil {
+			return nil, fmt.Errorf("decoding snarkjs public signals: %w", decodeErr)
+		}
+		return PublicSignalsFromSnarkJS(signals)
+	default:
+		return PublicSignalsFromRaw(input)
+	}
+}
+
+// encodePublicSignals writes public signals in any encoding
+func encodePublicSignals(encoding string, signals []fr.Element) ([]byte, error) {
+	switch encoding {
+	case Gnark:
+		return PublicSignalsToGnark(signals)
+	case SnarkJS:
+		return json.MarshalIndent(PublicSignalsToSnarkJS(signals), "", "  ")
+	default:
+		return PublicSignalsToRaw(signals), nil
+	}
+}
+
+// PublicSignalsFromGnark reads a public witness in gnark binary encoding, as built by
+// circuit.NewPublicWitness
+func PublicSignalsFromGnark(encoded []byte) ([]fr.Element, error) {
+	publicWitness, newErr := witness.New(circuit.Curve.ScalarField())
+	if newErr != nil {
+		return nil, newErr
+	}
+	if unmarshalErr := publicWitness.UnmarshalBinary(encoded); unmarshalErr != nil {
+		return nil, fmt.Errorf("decoding public witness: %w", unmarshalErr)
+	}
+	values, ok := publicWitness.Vector().(fr.Vector)
+	if !ok {
+		return nil, errors.New("decoding public witness: not over the BN254 scalar field")
+	}
+	return slices.Clone(values), nil
+}
+
+// PublicSignalsToGnark writes public signals as a public witness in gnark binary encoding
+func PublicSignalsToGnark(signals []fr.Element) ([]byte, error) {
+	publicWitness, newErr := witness.New(circuit.Curve.ScalarField())
+	if newErr != nil {
+		return nil, newErr
+	}
+	values := make(chan any, len(signals))
+	for _, signal := range signals {
+		values <- signal
+	}
+	close(values)
+	if fillErr := publicWitness.Fill(len(signals), 0, values); fillErr != nil {
+		return nil, fillErr
+	}
+	return publicWitness.MarshalBinary()
+}
+
+// PublicSignalsFromSnarkJS reads snarkjs's public.json: decimal scalars, for this circuit the
+// commitment then the nonce
+func PublicSignalsFromSnarkJS(signals []string) ([]fr.Element, error) {
+	elements := make([]fr.Element, len(signals))
+	for i, signal := range signals {
+		value, ok := new(big.Int).SetString(signal, 10)
+		if !ok || value.Sign() < 0 || value.Cmp(fr.Modulus()) >= 0 {
+			return nil, fmt.Errorf("public signal %d: %q is not a scalar field element", i, signal)
+		}
+		elements[i].SetBigInt(value)
+	}
+	return elements, nil
+}
+
+// PublicSignalsToSnarkJS writes public signals as snarkjs's public.json
+func PublicSignalsToSnarkJS(signals []fr.Element) []string {
+	encoded := make([]string, len(signals))
+	for i := range signals {
+		encoded[i] = signals[i].String()
+	}
+	return encoded
+}
+
+// PublicSignalsFromRaw reads 32-byte big-endian scalars
+func PublicSignalsFromRaw(raw []byte) ([]fr.Element, error) {
+	if len(raw)%fr.Bytes != 0 {
+		return nil, fmt.Errorf("raw public signals have %d bytes, not a multiple of %d", len(raw), fr.Bytes)
+	}
+	elements := make([]fr.Element, len(raw)/fr.Bytes)
+	for i := range elements {
+		if setErr := elements[i].SetBytesCanonical(raw[i*fr.Bytes : (i+1)*fr.Bytes]); setErr != nil {
+			return nil, fmt.Errorf("public signal %d: %w", i, setErr)
+		}
+	}
+	return elements, nil
+}
+
+// PublicSignalsToRaw writes public signals as 32-byte big-endian scalars
+func PublicSignalsToRaw(signals []fr.Element) []byte {
+	raw := make([]byte, 0, len(signals)*fr.Bytes)
+	for i := range signals {
+		encoded := signals[i].Bytes()
+		raw = append(raw, encoded[:]...)
+	}
+	return raw
+}
+
+// decodeVerifyingKey reads a verifying key in any encoding
+func decodeVerifyingKey(encoding string, input []byte) (*groth16bn254.VerifyingKey, error) {
+	switch encoding {
+	case Gnark:
+		var key groth16bn254.VerifyingKey
+		if _, readErr := key.ReadFrom(bytes.NewReader(input)); readErr != nil {
+			return nil, fmt.Errorf("decoding verifying key: %w", readErr)
+		}
+		return &key, nil
+	case SnarkJS:
+		var key verifier.SnarkJSVerifyingKey
+		if decodeErr := json.Unmarshal(input, &key); decodeErr != nil {
+			return nil, fmt.Errorf("decoding snarkjs verifying key: %w", decodeErr)
+		}
+		return VerifyingKeyFromSnarkJS(key)
+	default:
+		return VerifyingKeyFromRaw(input)
+	}
+}
+
+// encodeVerifyingKey writes a verifying key in any encoding
+func encodeVerifyingKey(encoding string, key *groth16bn254.VerifyingKey) ([]byte, error) {
+	switch encoding {
+	case Gnark:
+		var encoded bytes.Buffer
+		_, writeErr := key.WriteTo(&encoded)
+		return encoded.Bytes(), writeErr
+	case SnarkJS:
+		converted, convertErr := VerifyingKeyToSnarkJS(key)
+		if convertErr != nil {
+			return nil, convertErr
+		}
+		return json.MarshalIndent(converted, "", "  ")
+	default:
+		return VerifyingKeyToRaw(key)
+	}
+}
+
+// plainKey checks a verifying key is a BN254 one without the commitment extension
+func plainKey(verifyingKey groth16.VerifyingKey) (*groth16bn254.VerifyingKey, error) {
+	key, ok := verifyingKey.(*groth16bn254.VerifyingKey)
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("verifying key is over %s, want BN254", verifyingKey.CurveID())
+	case len(key.CommitmentKeys) > 0:
+		return nil, ErrCommitments
+	case len(key.G1.K) == 0:
+		return nil, errors.New("verifying key has no public input points")
+	}
+	return key, nil
+}
+
+// VerifyingKeyToSnarkJS writes a gnark verifying key as snarkjs's verification_key.json
+func VerifyingKeyToSnarkJS(verifyingKey groth16.VerifyingKey) (verifier.SnarkJSVerifyingKey, error) {
+	key, keyErr := plainKey(verifyingKey)
+	if keyErr != nil {
+		return verifier.SnarkJSVerifyingKey{}, keyErr
+	}
+	converted := verifier.SnarkJSVerifyingKey{
+		Protocol: "groth16",
+		Curve:    "bn128",
+		NPublic:  len(key.G1.K) - 1,
+		Alpha1:   snarkJSG1(key.G1.Alpha),
+		Beta2:    snarkJSG2(key.G2.Beta),
+		Gamma2:   snarkJSG2(key.G2.Gamma),
+		Delta2:   snarkJSG2(key.G2.Delta),
+	}
+	for _, point := range key.G1.K {
+		converted.IC = append(converted.IC, snarkJSG1(point))
+	}
+	return converted, nil
+}
+
+// VerifyingKeyFromSnarkJS reads snarkjs's verification_key.json into a gnark verifying key. snarkjs
+// keys lack [β]₁ and [δ]₁, which gnark keeps but doesn't verify with; they are left at infinity.
+func VerifyingKeyFromSnarkJS(key verifier.SnarkJSVerifyingKey) (*groth16bn254.VerifyingKey, error) {
+	if key.Protocol != "groth16" || (key.Curve != "bn128" && key.Curve != "bn254") {
+		return nil, fmt.Errorf("snarkjs verifying key is a %s one over %s, want groth16 over bn128", key.Protocol, key.Curve)
+	}
+	if len(key.IC) != key.NPublic+1 {
+		return nil, fmt.Errorf("snarkjs verifying key has %d IC points for %d public signals", len(key.IC), key.NPublic)
+	}
+	var converted groth16bn254.VerifyingKey
+	converted.G1.K = make([]bn254.G1Affine, len(key.IC))
+	pointErrs := []error{
+		parseG1("vk_alpha_1", key.Alpha1, &converted.G1.Alpha),
+		parseG2("vk_beta_2", key.Beta2, &converted.G2.Beta),
+		parseG2("vk_gamma_2", key.Gamma2, &converted.G2.Gamma),
+		parseG2("vk_delta_2", key.Delta2, &converted.G2.Delta),
+	}
+	for i, point := range key.IC {
+		pointErrs = append(pointErrs, parseG1(fmt.Sprintf("IC[%d]", i), point, &converted.G1.K[i]))
+	}
+	if pointErr := errors.Join(pointErrs...); pointErr != nil {
+		return nil, fmt.Errorf("decoding snarkjs verifying key: %w", pointErr)
+	}
+	return &converted, converted.Precompute()
+}
+
+// VerifyingKeyToRaw writes a verifying key as the compressed points α|β|γ|δ|IC[0]|IC[1]|…
+func VerifyingKeyToRaw(verifyingKey groth16.VerifyingKey) ([]byte, error) {
+	key, keyErr := plainKey(verifyingKey)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	alpha, beta, gamma, delta := key.G1.Alpha.Bytes(), key.G2.Beta.Bytes(), key.G2.Gamma.Bytes(), key.G2.Delta.Bytes()
+	raw := slices.Concat(alpha[:], beta[:], gamma[:], delta[:])
+	for _, point := range key.G1.K {
+		encoded := point.Bytes()
+		raw = append(raw, encoded[:]...)
+	}
+	return raw, nil
+}
+
+// VerifyingKeyFromRaw reads a verifying key from its compressed points; [β]₁ and [δ]₁ are left at infinity
+func VerifyingKeyFromRaw(raw []byte) (*groth16bn254.VerifyingKey, error) {
+	header := bn254.SizeOfG1AffineCompressed + 3*bn254.SizeOfG2AffineCompressed
+	if len(raw) < header+bn254.SizeOfG1AffineCompressed || (len(raw)-header)%bn254.SizeOfG1AffineCompressed != 0 {
+		return nil, fmt.Errorf("raw verifying key has %d bytes, want %d plus %d per public input point", len(raw), header, bn254.SizeOfG1AffineCompressed)
+	}
+	var key groth16bn254.VerifyingKey
+	offset := 0
+	next := func(point interface{ SetBytes([]byte) (int, error) }, size int) error {
+		_, setErr := point.SetBytes(raw[offset : offset+size])
+		offset += size
+		return setErr
+	}
+	pointErrs := []error{
+		next(&key.G1.Alpha, bn254.SizeOfG1AffineCompressed),
+		next(&key.G2.Beta, bn254.SizeOfG2AffineCompressed),
+		next(&key.G2.Gamma, bn254.SizeOfG2AffineCompressed),
+		next(&key.G2.Delta, bn254.SizeOfG2AffineCompressed),
+	}
+	key.G1.K = make([]bn254.G1Affine, (len(raw)-header)/bn254.SizeOfG1AffineCompressed)
+	for i := range key.G1.K {
+		pointErrs = append(pointErrs, next(&key.G1.K[i], bn254.SizeOfG1AffineCompressed))
+	}
+	if pointErr := errors.Join(pointErrs...); pointErr != nil {
+		return nil, fmt.Errorf("decoding raw verifying key: %w", pointErr)
+	}
+	return &key, key.Precompute()
+}
+
+// snarkJSG1 writes a G1 point as snarkjs does
+func snarkJSG1(p bn254.G1Affine) []string {
+	return []string{p.X.String(), p.Y.String(), "1"}
+}
+
+// snarkJSG2 writes a G2 point as snarkjs does
+func snarkJSG2(p bn254.G2Affine) [][]string {
+	return [][]string{{p.X.A0.String(), p.X.A1.String()}, {p.Y.A0.String(), p.Y.A1.String()}, {"1", "0"}}
+}
+
+// parseFp parses a decimal coordinate, which must be reduced modulo the base field
+func parseFp(name, text string, out *fp.Element) error {
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok || value.Sign() < 0 || value.Cmp(fp.Modulus()) >= 0 {
+		return fmt.Errorf("%s: %q is not a base field element", name, text)
+	}
+	out.SetBigInt(value)
+	return nil
+}
+
+// parseG1 parses a snarkjs G1 point [x, y, "1"] and checks it lies on the curve
+func parseG1(name string, coordinates []string, out *bn254.G1Affine) error {
+	if len(coordinates) != 3 || coordinates[2] != "1" {
+		return fmt.Errorf("%s: want [x, y, \"1\"]", name)
+	}
+	if coordinateErr := errors.Join(parseFp(name, coordinates[0], &out.X), parseFp(name, coordinates[1], &out.Y)); coordinateErr != nil {
+		return coordinateErr
+	}
+	if !out.IsOnCurve() {
+		return fmt.Errorf("%s: not a point on the curve", name)
+	}
+	return nil
+}
+
+// parseG2 parses a snarkjs G2 point [[x0, x1], [y0, y1], ["1", "0"]] and checks it lies in the subgroup
+func parseG2(name string, coordinates [][]string, out *bn254.G2Affine) error {
+	if len(coordinates) != 3 || len(coordinates[0]) != 2 || len(coordinates[1]) != 2 ||
+		len(coordinates[2]) != 2 || coordinates[2][0] != "1" || coordinates[2][1] != "0" {
+		return fmt.Errorf("%s: want [[x0, x1], [y0, y1], [\"1\", \"0\"]]", name)
+	}
+	coordinateErr := errors.Join(
+		parseFp(name, coordinates[0][0], &out.X.A0), parseFp(name, coordinates[0][1], &out.X.A1),
+		parseFp(name, coordinates[1][0], &out.Y.A0), parseFp(name, coordinates[1][1], &out.Y.A1))
+	if coordinateErr != nil {
+		return coordinateErr
+	}
+	if !out.IsOnCurve() || !out.IsInSubGroup() {
+		return fmt.Errorf("%s: not a point of the G2 subgroup", name)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// fixture is a gnark verifying key, proof and public witness for secret 12345 bound to nonce 77,
+// each in gnark binary encoding
+type fixture struct {
+	verifyingKey, proof, publicWitness []byte
+}
+
+// commitment12345 is the commitment to secret 12345
+const commitment12345 = "152399025"
+
+// newFixture runs a throwaway setup and proves once
+func newFixture(t *testing.T) fixture {
+	t.Helper()
+	ccs, compileErr := circuit.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := prover.New(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), big.NewInt(77))
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	publicWitness, witnessErr := circuit.NewPublicWitness(commitment12345, big.NewInt(77))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	var encodedKey, encodedProof bytes.Buffer
+	if _, writeErr := verifyingKey.WriteTo(&encodedKey); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, writeErr := proof.WriteTo(&encodedProof); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	encodedWitness, marshalErr := publicWitness.MarshalBinary()
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	return fixture{verifyingKey: encodedKey.Bytes(), proof: encodedProof.Bytes(), publicWitness: encodedWitness}
+}
+
+// convert runs Convert and fails the test on error
+func convert(t *testing.T, kind, from, to string, input []byte) []byte {
+	t.Helper()
+	output, convertErr := Convert(kind, from, to, input)
+	if convertErr != nil {
+		t.Fatalf("Convert(%s, %s → %s) = %v", kind, from, to, convertErr)
+	}
+	return output
+}
+
+func TestRoundTrips(t *testing.T) {
+	f := newFixture(t)
+	for _, kind := range []struct {
+		name  string
+		gnark []byte
+	}{
+		{KindProof, f.proof},
+		{KindPublicSignals, f.publicWitness},
+	} {
+		for _, via := range []string{SnarkJS, Raw} {
+			there := convert(t, kind.name, Gnark, via, kind.gnark)
+			back := convert(t, kind.name, via, Gnark, there)
+			if !bytes.Equal(back, kind.gnark) {
+				t.Errorf("%s through %s changed its gnark encoding", kind.name, via)
+			}
+			other := Raw
+			if via == Raw {
+				other = SnarkJS
+			}
+			if across := convert(t, kind.name, other, via, convert(t, kind.name, Gnark, other, kind.gnark)); !bytes.Equal(across, there) {
+				t.Errorf("%s through %s then %s differs from converting directly", kind.name, other, via)
+			}
+		}
+	}
+
+	// snarkjs and raw verifying keys lack [β]₁ and [δ]₁, so only they round-trip byte for byte
+	snarkJSKey := convert(t, KindVerifyingKey, Gnark, SnarkJS, f.verifyingKey)
+	rawKey := convert(t, KindVerifyingKey, SnarkJS, Raw, snarkJSKey)
+	if back := convert(t, KindVerifyingKey, Raw, SnarkJS, rawKey); !bytes.Equal(back, snarkJSKey) {
+		t.Error("verifying key through raw changed its snarkjs encoding")
+	}
+	if direct := convert(t, KindVerifyingKey, Gnark, Raw, f.verifyingKey); !bytes.Equal(direct, rawKey) {
+		t.Error("verifying key through snarkjs differs from converting directly to raw")
+	}
+	regenerated := convert(t, KindVerifyingKey, Raw, Gnark, rawKey)
+	if back := convert(t, KindVerifyingKey, Gnark, SnarkJS, regenerated); !bytes.Equal(back, snarkJSKey) {
+		t.Error("verifying key rebuilt from raw changed its snarkjs encoding")
+	}
+
+	// a key and proof that went through every encoding still verify, by gnark and as snarkjs
+	v, loadErr := verifier.LoadVerifyingKey(bytes.NewReader(regenerated))
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	proof := convert(t, KindProof, Raw, Gnark, convert(t, KindProof, SnarkJS, Raw, convert(t, KindProof, Gnark, SnarkJS, f.proof)))
+	inputs := verifier.PublicInputs{Commitment: commitment12345, Nonce: big.NewInt(77)}
+	if verifyErr := v.VerifyProof(context.Background(), proof, inputs); verifyErr != nil {
+		t.Errorf("converted proof under the rebuilt key: %v", verifyErr)
+	}
+	snarkJSVerifier, snarkJSErr := verifier.LoadSnarkJSVerifyingKey(bytes.NewReader(snarkJSKey))
+	if snarkJSErr != nil {
+		t.Fatal(snarkJSErr)
+	}
+	var snarkJSProof verifier.SnarkJSProof
+	if decodeErr := json.Unmarshal(convert(t, KindProof, Gnark, SnarkJS, f.proof), &snarkJSProof); decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if verifyErr := snarkJSVerifier.VerifyProof(context.Background(), snarkJSProof, inputs); verifyErr != nil {
+		t.Errorf("converted proof under the snarkjs verifier: %v", verifyErr)
+	}
+}
+
+func TestPublicSignals(t *testing.T) {
+	f := newFixture(t)
+	var signals []string
+	if decodeErr := json.Unmarshal(convert(t, KindPublicSignals, Gnark, SnarkJS, f.publicWitness), &signals); decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if want := []string{commitment12345, "77"}; !reflect.DeepEqual(signals, want) {
+		t.Errorf("snarkjs public signals = %v, want %v", signals, want)
+	}
+	raw := convert(t, KindPublicSignals, Gnark, Raw, f.publicWitness)
+	if len(raw) != 64 || raw[63] != 77 || new(big.Int).SetBytes(raw[:32]).String() != commitment12345 {
+		t.Errorf("raw public signals = %x", raw)
+	}
+}
+
+func TestConvertRejects(t *testing.T) {
+	f := newFixture(t)
+	for _, tt := range []struct {
+		name, kind, from, to string
+		input                []byte
+	}{
+		{"unknown kind", "witness", Gnark, Raw, f.proof},
+		{"unknown encoding", KindProof, Gnark, "hex", f.proof},
+		{"truncated raw proof", KindProof, Raw, Gnark, make([]byte, 127)},
+		{"raw proof off the curve", KindProof, Raw, Gnark, bytes.Repeat([]byte{0x5a}, 128)},
+		{"snarkjs proof with a bad point", KindProof, SnarkJS, Gnark, []byte(`{"pi_a":["1","3","1"],"pi_b":[["0","0"],["0","0"],["1","0"]],"pi_c":["1","2","1"]}`)},
+		{"unreduced snarkjs signal", KindPublicSignals, SnarkJS, Raw, []byte(`["21888242871839275222246405745257275088548364400416034343698204186575808495617"]`)},
+		{"ragged raw signals", KindPublicSignals, Raw, SnarkJS, make([]byte, 33)},
+		{"snarkjs key with missing IC", KindVerifyingKey, SnarkJS, Gnark, []byte(`{"protocol":"groth16","curve":"bn128","nPublic":2,"IC":[]}`)},
+		{"truncated gnark key", KindVerifyingKey, Gnark, Raw, f.verifyingKey[:40]},
+	} {
+		if _, convertErr := Convert(tt.kind, tt.from, tt.to, tt.input); convertErr == nil {
+			t.Errorf("%s: Convert succeeded", tt.name)
+		}
+	}
+}
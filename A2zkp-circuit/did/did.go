@@ -0,0 +1,258 @@
+// Package did parses the decentralized identifiers users may register under, resolves their DID
+// documents and checks the bindings through which a key of the document vouches for a commitment.
+//
+// Two methods are supported: did:key, whose document is derived from the identifier itself, and
+// did:web, whose document is fetched over HTTPS from the domain it names. Only Ed25519 keys can
+// sign bindings, the key type of did:key identifiers and of most wallets.
+package did
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"A2zkp-circuit/verifier"
+)
+
+// ErrInvalid is returned for a string that is not a well-formed DID of a supported method
+var ErrInvalid = errors.New("invalid DID")
+
+// ErrBinding is returned for a binding whose key isn't in the DID document or whose signature
+// doesn't match
+var ErrBinding = errors.New("invalid DID binding")
+
+// Supported methods
+const (
+	MethodKey = "key"
+	MethodWeb = "web"
+)
+
+// MaxLength bounds the DIDs accepted as user names
+const MaxLength = 256
+
+// ed25519Multicodec is the multicodec prefix of an Ed25519 public key, varint encoded
+var ed25519Multicodec = []byte{0xed, 0x01}
+
+// DID is a parsed decentralized identifier, did:<method>:<id>
+type DID struct {
+	Method string // Method is MethodKey or MethodWeb
+	ID     string // ID is the method-specific identifier, e.g. "example.com:users:alice" for did:web
+}
+
+// IsDID reports whether a user name is meant as a DID
+func IsDID(name string) bool {
+	return strings.HasPrefix(name, "did:")
+}
+
+// Parse checks the syntax of a did:key or did:web identifier
+func Parse(text string) (DID, error) {
+	if len(text) > MaxLength {
+		return DID{}, fmt.Errorf("%w: longer than %d bytes", ErrInvalid, MaxLength)
+	}
+	method, id, found := strings.Cut(strings.TrimPrefix(text, "did:"), ":")
+	if !IsDID(text) || !found || id == "" {
+		return DID{}, fmt.Errorf("%w: %q is not of the form did:<method>:<id>", ErrInvalid, text)
+	}
+	parsed := DID{Method: method, ID: id}
+	switch method {
+	case MethodKey:
+		if _, keyErr := parsed.publicKey(); keyErr != nil {
+			return DID{}, keyErr
+		}
+	case MethodWeb:
+		if _, urlErr := parsed.documentURL(); urlErr != nil {
+			return DID{}, urlErr
+		}
+	default:
+		return DID{}, fmt.Errorf("%w: method %q is not supported (want key or web)", ErrInvalid, method)
+	}
+	return parsed, nil
+}
+
+// String returns the DID as it was parsed
+func (d DID) String() string {
+	return "did:" + d.Method + ":" + d.ID
+}
+
+// KeyDID is the did:key identifier of an Ed25519 public key
+func KeyDID(publicKey ed25519.PublicKey) string {
+	return "did:key:" + multibaseKey(publicKey)
+}
+
+// publicKey decodes the Ed25519 key of a did:key identifier
+func (d DID) publicKey() (ed25519.PublicKey, error) {
+	key, decodeErr := decodeMultibaseKey(d.ID)
+	if decodeErr != nil {
+		return nil, fmt.Errorf("%w: did:key %v", ErrInvalid, decodeErr)
+	}
+	return key, nil
+}
+
+// Document is the part of a DID document bindings are checked against
+type Document struct {
+	Context            any                  `json:"@context,omitempty"`
+	ID                 string               `json:"id"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []json.RawMessage    `json:"authentication,omitempty"` // Authentication holds method IDs or embedded methods
+}
+
+// VerificationMethod is a public key of a DID document
+type VerificationMethod struct {
+	ID         string `json:"id"`   // ID is a DID URL, or a fragment relative to the document's ID
+	Type       string `json:"type"` // Type is e.g. "Ed25519VerificationKey2020", "Multikey" or "JsonWebKey2020"
+	Controller string `json:"controller"`
+	// PublicKeyMultibase holds the key of Ed25519VerificationKey2020 and Multikey methods
+	PublicKeyMultibase string `json:"publicKeyMultibase,omitempty"`
+	// PublicKeyBase58 holds the raw key of Ed25519VerificationKey2018 methods
+	PublicKeyBase58 string          `json:"publicKeyBase58,omitempty"`
+	PublicKeyJWK    json.RawMessage `json:"publicKeyJwk,omitempty"` // PublicKeyJWK holds the key of JsonWebKey2020 methods
+}
+
+// keyDocument derives the document of a did:key identifier: its single key, for authentication
+func keyDocument(d DID) (Document, error) {
+	if _, keyErr := d.publicKey(); keyErr != nil {
+		return Document{}, keyErr
+	}
+	methodID := d.String() + "#" + d.ID
+	reference, _ := json.Marshal(methodID)
+	return Document{
+		Context: []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/suites/ed25519-2020/v1"},
+		ID:      d.String(),
+		VerificationMethod: []VerificationMethod{{
+			ID: methodID, Type: "Ed25519VerificationKey2020", Controller: d.String(), PublicKeyMultibase: d.ID,
+		}},
+		Authentication: []json.RawMessage{reference},
+	}, nil
+}
+
+// PublicKey returns the Ed25519 key of the verification method named by the DID URL methodID
+func (doc Document) PublicKey(methodID string) (ed25519.PublicKey, error) {
+	for _, method := range doc.VerificationMethod {
+		if method.ID != methodID && doc.ID+method.ID != methodID {
+			continue
+		}
+		switch method.Type {
+		case "Ed25519VerificationKey2020", "Multikey":
+			return decodeMultibaseKey(method.PublicKeyMultibase)
+		case "Ed25519VerificationKey2018":
+			raw, decodeErr := decodeBase58(method.PublicKeyBase58)
+			if decodeErr != nil || len(raw) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%w: %s has a malformed publicKeyBase58", ErrBinding, methodID)
+			}
+			return ed25519.PublicKey(raw), nil
+		case "JsonWebKey2020":
+			key, parseErr := verifier.ParseJSONWebKey(method.PublicKeyJWK)
+			if parseErr != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrBinding, methodID, parseErr)
+			}
+			if edKey, isEd25519 := key.(ed25519.PublicKey); isEd25519 {
+				return edKey, nil
+			}
+			return nil, fmt.Errorf("%w: %s is a %T, not an Ed25519 key", ErrBinding, methodID, key)
+		default:
+			return nil, fmt.Errorf("%w: %s has unsupported type %q", ErrBinding, methodID, method.Type)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not a verification method of %s", ErrBinding, methodID, doc.ID)
+}
+
+// Binding is the signature by which a key of a DID document vouches for the commitment registered
+// under the DID
+type Binding struct {
+	// VerificationMethod is the DID URL of the signing key, e.g. "did:key:z6Mk...#z6Mk..."
+	VerificationMethod string `json:"verification_method"`
+	Signature          []byte `json:"signature"` // Signature is the Ed25519 signature of BindingMessage
+}
+
+// BindingMessage is what a key signs to bind commitment to the DID it belongs to
+func BindingMessage(did, commitment string) []byte {
+	return []byte("ofa-did-binding:v1\n" + did + "\n" + commitment)
+}
+
+// SignBinding binds commitment to did with the key of methodID, as a wallet holding it would
+func SignBinding(privateKey ed25519.PrivateKey, methodID, did, commitment string) Binding {
+	return Binding{VerificationMethod: methodID, Signature: ed25519.Sign(privateKey, BindingMessage(did, commitment))}
+}
+
+// Verify checks that the binding's key belongs to doc and signed commitment for it
+func (b Binding) Verify(doc Document, commitment string) error {
+	if !strings.HasPrefix(b.VerificationMethod, doc.ID+"#") {
+		return fmt.Errorf("%w: %s is not a key of %s", ErrBinding, b.VerificationMethod, doc.ID)
+	}
+	publicKey, keyErr := doc.PublicKey(b.VerificationMethod)
+	if keyErr != nil {
+		return keyErr
+	}
+	if !ed25519.Verify(publicKey, BindingMessage(doc.ID, commitment), b.Signature) {
+		return fmt.Errorf("%w: the signature doesn't match", ErrBinding)
+	}
+	return nil
+}
+
+// multibaseKey encodes an Ed25519 key as a base58btc multibase multicodec value, "z6Mk..."
+func multibaseKey(publicKey ed25519.PublicKey) string {
+	return "z" + encodeBase58(append(append([]byte{}, ed25519Multicodec...), publicKey...))
+}
+
+// decodeMultibaseKey reverses multibaseKey
+func decodeMultibaseKey(value string) (ed25519.PublicKey, error) {
+	encoded, isBase58 := strings.CutPrefix(value, "z")
+	if !isBase58 {
+		return nil, errors.New("key is not base58btc multibase")
+	}
+	raw, decodeErr := decodeBase58(encoded)
+	switch {
+	case decodeErr != nil:
+		return nil, decodeErr
+	case len(raw) != len(ed25519Multicodec)+ed25519.PublicKeySize || string(raw[:2]) != string(ed25519Multicodec):
+		return nil, errors.New("key is not an Ed25519 multicodec key")
+	}
+	return ed25519.PublicKey(raw[2:]), nil
+}
+
+// base58Alphabet is the Bitcoin alphabet of base58btc
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// encodeBase58 encodes data in base58btc, each leading zero byte as a "1"
+func encodeBase58(data []byte) string {
+	value := new(big.Int).SetBytes(data)
+	radix, digit := big.NewInt(58), new(big.Int)
+	var encoded []byte
+	for value.Sign() > 0 {
+		value.DivMod(value, radix, digit)
+		encoded = append(encoded, base58Alphabet[digit.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, '1')
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+// decodeBase58 reverses encodeBase58
+func decodeBase58(text string) ([]byte, error) {
+	if text == "" {
+		return nil, errors.New("empty base58 value")
+	}
+	value, radix := new(big.Int), big.NewInt(58)
+	zeros := 0
+	for i, c := range []byte(text) {
+		digit := strings.IndexByte(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		if digit == 0 && i == zeros {
+			zeros++
+		}
+		value.Mul(value, radix).Add(value, big.NewInt(int64(digit)))
+	}
+	return append(make([]byte, zeros), value.Bytes()...), nil
+}
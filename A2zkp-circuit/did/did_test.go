@@ -0,0 +1,122 @@
+package did
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBase58(t *testing.T) {
+	for _, data := range [][]byte{{0}, {0, 0, 1}, {0xff}, []byte("hello world"), bytes.Repeat([]byte{0x5a}, 34)} {
+		decoded, decodeErr := decodeBase58(encodeBase58(data))
+		if decodeErr != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("base58 round trip of %x = %x, %v", data, decoded, decodeErr)
+		}
+	}
+	if encoded := encodeBase58([]byte("hello world")); encoded != "StV1DL6CwTryKyV" {
+		t.Errorf("base58 of hello world = %s", encoded)
+	}
+	if _, decodeErr := decodeBase58("0OIl"); decodeErr == nil {
+		t.Error("decoded characters outside the base58 alphabet")
+	}
+}
+
+func TestParse(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	keyDID := KeyDID(publicKey)
+	if !strings.HasPrefix(keyDID, "did:key:z6Mk") {
+		t.Errorf("KeyDID = %s, want a did:key:z6Mk... identifier", keyDID)
+	}
+	for _, valid := range []string{keyDID, "did:web:example.com", "did:web:example.com%3A8443:users:alice"} {
+		if parsed, parseErr := Parse(valid); parseErr != nil || parsed.String() != valid {
+			t.Errorf("Parse(%q) = %v, %v", valid, parsed, parseErr)
+		}
+	}
+	for _, invalid := range []string{"alice", "did:key", "did:ion:EiA", "did:key:z6Mkabc", "did:key:zz", "did:web:", "did:web:example.com::x", "did:web:example.com:..", "did:web:a%2Fb"} {
+		if _, parseErr := Parse(invalid); !errors.Is(parseErr, ErrInvalid) {
+			t.Errorf("Parse(%q) = %v, want ErrInvalid", invalid, parseErr)
+		}
+	}
+
+	for id, want := range map[string]string{
+		"did:web:example.com":                    "https://example.com/.well-known/did.json",
+		"did:web:example.com%3A8443:users:alice": "https://example.com:8443/users/alice/did.json",
+	} {
+		parsed, _ := Parse(id)
+		if documentURL, urlErr := parsed.documentURL(); urlErr != nil || documentURL.String() != want {
+			t.Errorf("document URL of %s = %v, %v, want %s", id, documentURL, urlErr, want)
+		}
+	}
+}
+
+func TestKeyBinding(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	parsed, _ := Parse(KeyDID(publicKey))
+	var resolver Resolver
+	doc, resolveErr := resolver.Resolve(context.Background(), parsed)
+	if resolveErr != nil || doc.ID != parsed.String() || len(doc.VerificationMethod) != 1 {
+		t.Fatalf("did:key document = %+v, %v", doc, resolveErr)
+	}
+	methodID := doc.VerificationMethod[0].ID
+
+	if verifyErr := SignBinding(privateKey, methodID, doc.ID, "12345").Verify(doc, "12345"); verifyErr != nil {
+		t.Errorf("binding = %v", verifyErr)
+	}
+	for name, binding := range map[string]Binding{
+		"another commitment": SignBinding(privateKey, methodID, doc.ID, "54321"),
+		"another key":        SignBinding(otherKey, methodID, doc.ID, "12345"),
+		"an unknown method":  SignBinding(privateKey, doc.ID+"#other", doc.ID, "12345"),
+		"another DID":        SignBinding(privateKey, "did:web:example.com#key-1", doc.ID, "12345"),
+	} {
+		if verifyErr := binding.Verify(doc, "12345"); !errors.Is(verifyErr, ErrBinding) {
+			t.Errorf("binding with %s = %v, want ErrBinding", name, verifyErr)
+		}
+	}
+}
+
+func TestResolveWeb(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	var id string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/alice/did.json" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(Document{ID: id, VerificationMethod: []VerificationMethod{
+			{ID: "#key-1", Type: "Multikey", Controller: id, PublicKeyMultibase: multibaseKey(publicKey)},
+		}})
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	id = "did:web:" + strings.ReplaceAll(host, ":", "%3A") + ":users:alice"
+	resolver := Resolver{Client: server.Client()}
+
+	parsed, parseErr := Parse(id)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	doc, resolveErr := resolver.Resolve(context.Background(), parsed)
+	if resolveErr != nil {
+		t.Fatal(resolveErr)
+	}
+	if verifyErr := SignBinding(privateKey, id+"#key-1", id, "777").Verify(doc, "777"); verifyErr != nil {
+		t.Errorf("binding to a relative did:web method = %v", verifyErr)
+	}
+
+	missing, _ := Parse("did:web:" + strings.ReplaceAll(host, ":", "%3A") + ":users:bob")
+	if _, resolveErr := resolver.Resolve(context.Background(), missing); !errors.Is(resolveErr, ErrUnresolvable) {
+		t.Errorf("resolving a missing document = %v, want ErrUnresolvable", resolveErr)
+	}
+	restricted := Resolver{Client: server.Client(), WebDomains: []string{"example.com"}}
+	if _, resolveErr := restricted.Resolve(context.Background(), parsed); !errors.Is(resolveErr, ErrUnresolvable) {
+		t.Errorf("resolving outside web_domains = %v, want ErrUnresolvable", resolveErr)
+	}
+}
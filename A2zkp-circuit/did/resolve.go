@@ -0,0 +1,94 @@
+package did
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrUnresolvable is returned when a DID's document can't be fetched or doesn't describe the DID
+var ErrUnresolvable = errors.New("DID document can't be resolved")
+
+// maxDocumentBytes bounds the did:web documents read
+const maxDocumentBytes = 64 << 10
+
+// Resolver resolves DID documents. The zero value resolves any did:web domain over HTTPS with a
+// 10 second timeout.
+type Resolver struct {
+	Client *http.Client // Client fetches did:web documents; nil uses one with a 10 second timeout
+	// WebDomains, when not empty, lists the only hosts did:web documents are fetched from, so user
+	// names can't make the server request arbitrary URLs
+	WebDomains []string
+}
+
+// Resolve returns the DID document of d
+func (r *Resolver) Resolve(ctx context.Context, d DID) (Document, error) {
+	if d.Method == MethodKey {
+		return keyDocument(d)
+	}
+	documentURL, urlErr := d.documentURL()
+	if urlErr != nil {
+		return Document{}, urlErr
+	}
+	if len(r.WebDomains) > 0 && !slices.Contains(r.WebDomains, documentURL.Hostname()) {
+		return Document{}, fmt.Errorf("%w: did:web domain %s is not allowed", ErrUnresolvable, documentURL.Hostname())
+	}
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, documentURL.String(), nil)
+	if reqErr != nil {
+		return Document{}, reqErr
+	}
+	req.Header.Set("Accept", "application/did+json, application/json")
+	resp, getErr := client.Do(req)
+	if getErr != nil {
+		return Document{}, fmt.Errorf("%w: %v", ErrUnresolvable, getErr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Document{}, fmt.Errorf("%w: %s answered %s", ErrUnresolvable, documentURL, resp.Status)
+	}
+	var doc Document
+	if decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentBytes)).Decode(&doc); decodeErr != nil {
+		return Document{}, fmt.Errorf("%w: decoding %s: %v", ErrUnresolvable, documentURL, decodeErr)
+	}
+	if doc.ID != d.String() {
+		return Document{}, fmt.Errorf("%w: %s describes %q", ErrUnresolvable, documentURL, doc.ID)
+	}
+	return doc, nil
+}
+
+// documentURL is where a did:web document is published: /.well-known/did.json on the domain, or
+// did.json under the path its further segments name
+func (d DID) documentURL() (*url.URL, error) {
+	segments := strings.Split(d.ID, ":")
+	host, unescapeErr := url.PathUnescape(segments[0])
+	if unescapeErr != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return nil, fmt.Errorf("%w: did:web domain %q is malformed", ErrInvalid, segments[0])
+	}
+	var path string
+	for _, segment := range segments[1:] {
+		unescaped, segmentErr := url.PathUnescape(segment)
+		if segmentErr != nil || unescaped == "" || unescaped == "." || unescaped == ".." || strings.ContainsAny(unescaped, "/?#") {
+			return nil, fmt.Errorf("%w: did:web path segment %q is malformed", ErrInvalid, segment)
+		}
+		path += "/" + unescaped
+	}
+	if path == "" {
+		path = "/.well-known"
+	}
+	parsed, parseErr := url.Parse("https://" + host + path + "/did.json")
+	if parseErr != nil || parsed.Host != host {
+		return nil, fmt.Errorf("%w: did:web domain %q is malformed", ErrInvalid, host)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,294 @@
+// Package ethereum checks proofs against the Solidity verifier that keygen exports
+// (gnark's verifier contract) over JSON-RPC, either read-only with eth_call or as a
+// signed transaction whose receipt records the result on chain.
+package ethereum
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"golang.org/x/crypto/sha3"
+)
+
+// verifySignature is the verifier's entry point for a circuit with two public inputs and no commitments
+const verifySignature = "verifyProof(uint256[8],uint256[2])"
+
+// revertReasons names the custom errors the exported verifier reverts with
+var revertReasons = map[string]string{
+	hex.EncodeToString(selector("ProofInvalid()")):          "ProofInvalid",
+	hex.EncodeToString(selector("PublicInputNotInField()")): "PublicInputNotInField",
+}
+
+// ErrReverted is returned when the verifier contract rejected the proof
+var ErrReverted = errors.New("verifier reverted")
+
+// RPCError is a JSON-RPC error returned by the node
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// reverted reports whether the node refused the call because the contract reverted
+func (e *RPCError) reverted() bool {
+	return e.Code == 3 || strings.Contains(e.Message, "execution reverted")
+}
+
+// reason names the custom error in the revert data, when it is one the verifier defines
+func (e *RPCError) reason() string {
+	data, _ := e.Data.(string)
+	data = strings.TrimPrefix(data, "0x")
+	if len(data) >= 8 {
+		if name, known := revertReasons[data[:8]]; known {
+			return name
+		}
+	}
+	return e.Message
+}
+
+// Client talks to one verifier contract through one JSON-RPC endpoint
+type Client struct {
+	rpcURL     string
+	verifier   Address
+	httpClient *http.Client
+
+	sendMu sync.Mutex // sendMu serializes account nonce lookups so concurrent submissions don't collide
+}
+
+// New creates a client for the verifier deployed at verifierAddress, e.g. "0x5FbD…0aa3"
+func New(rpcURL, verifierAddress string) (*Client, error) {
+	verifier, parseErr := ParseAddress(verifierAddress)
+	if parseErr != nil {
+		return nil, fmt.Errorf("verifier address: %w", parseErr)
+	}
+	return &Client{rpcURL: rpcURL, verifier: verifier, httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Verifier returns the address of the verifier contract
+func (c *Client) Verifier() Address {
+	return c.verifier
+}
+
+// EncodeVerifyCall ABI-encodes a verifyProof call for a BN254 proof and its public inputs in circuit order
+func EncodeVerifyCall(proof groth16.Proof, publicInputs []*big.Int) ([]byte, error) {
+	bn254Proof, isBN254 := proof.(*groth16bn254.Proof)
+	if !isBN254 {
+		return nil, fmt.Errorf("the solidity verifier only accepts BN254 proofs, got %T", proof)
+	}
+	if len(bn254Proof.Commitments) > 0 {
+		return nil, errors.New("proofs with commitments need a verifier with a different signature")
+	}
+	if len(publicInputs) != 2 {
+		return nil, fmt.Errorf("verifyProof takes 2 public inputs, got %d", len(publicInputs))
+	}
+
+	// uint256[8] and uint256[2] are static, so the arguments are just 10 consecutive words
+	calldata := selector(verifySignature)
+	calldata = append(calldata, bn254Proof.MarshalSolidity()...)
+	for _, input := range publicInputs {
+		if input.Sign() < 0 || input.BitLen() > 256 {
+			return nil, fmt.Errorf("public input %s does not fit in uint256", input)
+		}
+		calldata = append(calldata, input.FillBytes(make([]byte, 32))...)
+	}
+	return calldata, nil
+}
+
+// CallResult is the outcome of a read-only verification
+type CallResult struct {
+	Verified bool   `json:"verified"`
+	Reason   string `json:"reason,omitempty"` // Reason names the revert when the proof was rejected
+}
+
+// Call runs verifyProof with eth_call against the latest block. A revert is a rejected proof,
+// not an error; errors are reserved for transport and node failures.
+func (c *Client) Call(ctx context.Context, calldata []byte) (CallResult, error) {
+	call := map[string]string{"to": c.verifier.String(), "data": "0x" + hex.EncodeToString(calldata)}
+	var result string
+	callErr := c.rpc(ctx, "eth_call", []any{call, "latest"}, &result)
+	var rpcErr *RPCError
+	if errors.As(callErr, &rpcErr) && rpcErr.reverted() {
+		return CallResult{Verified: false, Reason: rpcErr.reason()}, nil
+	}
+	if callErr != nil {
+		return CallResult{}, callErr
+	}
+	return CallResult{Verified: true}, nil
+}
+
+// Submit sends verifyProof as a transaction signed by key and returns its hash. Gas is estimated
+// first, so a proof the contract would reject fails with ErrReverted without spending anything;
+// gasLimit overrides the estimate when non-zero.
+func (c *Client) Submit(ctx context.Context, key *PrivateKey, calldata []byte, gasLimit uint64) (string, error) {
+	from := key.Address().String()
+	call := map[string]string{"from": from, "to": c.verifier.String(), "data": "0x" + hex.EncodeToString(calldata)}
+
+	var estimate, gasPrice, chainID string
+	estimateErr := c.rpc(ctx, "eth_estimateGas", []any{call}, &estimate)
+	var rpcErr *RPCError
+	if errors.As(estimateErr, &rpcErr) && rpcErr.reverted() {
+		return "", fmt.Errorf("%w: %s", ErrReverted, rpcErr.reason())
+	}
+	if estimateErr != nil {
+		return "", estimateErr
+	}
+	if gasLimit == 0 {
+		estimated, parseErr := parseQuantity(estimate)
+		if parseErr != nil {
+			return "", parseErr
+		}
+		// Leave headroom for state changes between estimation and inclusion
+		gasLimit = estimated.Uint64() + estimated.Uint64()/5
+	}
+	if priceErr := c.rpc(ctx, "eth_gasPrice", []any{}, &gasPrice); priceErr != nil {
+		return "", priceErr
+	}
+	if chainErr := c.rpc(ctx, "eth_chainId", []any{}, &chainID); chainErr != nil {
+		return "", chainErr
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	var accountNonce string
+	if nonceErr := c.rpc(ctx, "eth_getTransactionCount", []any{from, "pending"}, &accountNonce); nonceErr != nil {
+		return "", nonceErr
+	}
+
+	tx := LegacyTx{To: c.verifier, Gas: gasLimit, Value: new(big.Int), Data: calldata}
+	var parseErr error
+	if tx.Nonce, parseErr = parseUint64(accountNonce); parseErr != nil {
+		return "", parseErr
+	}
+	if tx.GasPrice, parseErr = parseQuantity(gasPrice); parseErr != nil {
+		return "", parseErr
+	}
+	if tx.ChainID, parseErr = parseQuantity(chainID); parseErr != nil {
+		return "", parseErr
+	}
+	raw, signErr := tx.Sign(key)
+	if signErr != nil {
+		return "", signErr
+	}
+	var txHash string
+	if sendErr := c.rpc(ctx, "eth_sendRawTransaction", []any{"0x" + hex.EncodeToString(raw)}, &txHash); sendErr != nil {
+		return "", sendErr
+	}
+	return txHash, nil
+}
+
+// Receipt is the on-chain result of a submitted verification
+type Receipt struct {
+	TxHash      string `json:"tx_hash"`
+	Status      string `json:"status"` // Status is "pending", "success" (the proof verified) or "reverted"
+	BlockNumber uint64 `json:"block_number,omitempty"`
+	GasUsed     uint64 `json:"gas_used,omitempty"`
+}
+
+// Receipt looks up a transaction sent by Submit
+func (c *Client) Receipt(ctx context.Context, txHash string) (Receipt, error) {
+	var raw *struct {
+		Status      string `json:"status"`
+		BlockNumber string `json:"blockNumber"`
+		GasUsed     string `json:"gasUsed"`
+	}
+	if receiptErr := c.rpc(ctx, "eth_getTransactionReceipt", []any{txHash}, &raw); receiptErr != nil {
+		return Receipt{}, receiptErr
+	}
+	receipt := Receipt{TxHash: txHash, Status: "pending"}
+	if raw == nil {
+		return receipt, nil
+	}
+	receipt.Status = "reverted"
+	if raw.Status == "0x1" {
+		receipt.Status = "success"
+	}
+	receipt.BlockNumber, _ = parseUint64(raw.BlockNumber)
+	receipt.GasUsed, _ = parseUint64(raw.GasUsed)
+	return receipt, nil
+}
+
+// rpc performs one JSON-RPC 2.0 call and decodes its result into out
+func (c *Client) rpc(ctx context.Context, method string, params []any, out any) error {
+	body, marshalErr := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if marshalErr != nil {
+		return marshalErr
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, c.rpcURL, bytes.NewReader(body))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, doErr := c.httpClient.Do(req)
+	if doErr != nil {
+		return fmt.Errorf("%s: %w", method, doErr)
+	}
+	defer resp.Body.Close()
+	respBody, readErr := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if readErr != nil {
+		return readErr
+	}
+
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}
+	if decodeErr := json.Unmarshal(respBody, &envelope); decodeErr != nil {
+		return fmt.Errorf("%s: node returned %s: %w", method, resp.Status, decodeErr)
+	}
+	if envelope.Error != nil {
+		return envelope.Error
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+// selector is the 4-byte function or error selector of a Solidity signature
+func selector(signature string) []byte {
+	return keccak256([]byte(signature))[:4]
+}
+
+// keccak256 is Ethereum's pre-standard Keccak-256
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, chunk := range data {
+		h.Write(chunk)
+	}
+	return h.Sum(nil)
+}
+
+// parseQuantity decodes a JSON-RPC hex quantity such as "0x1a"
+func parseQuantity(text string) (*big.Int, error) {
+	digits, hasPrefix := strings.CutPrefix(text, "0x")
+	value, ok := new(big.Int).SetString(digits, 16)
+	if !hasPrefix || !ok {
+		return nil, fmt.Errorf("malformed quantity %q", text)
+	}
+	return value, nil
+}
+
+// parseUint64 decodes a hex quantity that must fit in 64 bits
+func parseUint64(text string) (uint64, error) {
+	value, parseErr := parseQuantity(text)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	if !value.IsUint64() {
+		return 0, fmt.Errorf("quantity %q overflows uint64", text)
+	}
+	return value.Uint64(), nil
+}
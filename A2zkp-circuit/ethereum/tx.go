@@ -0,0 +1,188 @@
+package ethereum
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/secp256k1"
+	"github.com/consensys/gnark-crypto/ecc/secp256k1/ecdsa"
+	"github.com/consensys/gnark-crypto/ecc/secp256k1/fr"
+)
+
+// Address is a 20-byte Ethereum account or contract address
+type Address [20]byte
+
+// ParseAddress decodes a 0x-prefixed hex address; mixed-case input must carry a valid EIP-55 checksum
+func ParseAddress(text string) (Address, error) {
+	var address Address
+	digits, hasPrefix := strings.CutPrefix(text, "0x")
+	raw, decodeErr := hex.DecodeString(digits)
+	if !hasPrefix || decodeErr != nil || len(raw) != len(address) {
+		return address, fmt.Errorf("%q is not a 0x-prefixed 20-byte hex address", text)
+	}
+	copy(address[:], raw)
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && address.String() != text {
+		return address, fmt.Errorf("%q has an invalid EIP-55 checksum", text)
+	}
+	return address, nil
+}
+
+// String returns the EIP-55 mixed-case checksum encoding
+func (a Address) String() string {
+	lower := hex.EncodeToString(a[:])
+	hash := keccak256([]byte(lower))
+	encoded := []byte(lower)
+	for i, c := range encoded {
+		// A hex letter is upper-cased when the matching nibble of the hash is 8 or more
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0x0f
+		}
+		if c >= 'a' && nibble >= 8 {
+			encoded[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(encoded)
+}
+
+// PrivateKey is a secp256k1 account key that signs transactions
+type PrivateKey struct {
+	key     ecdsa.PrivateKey
+	address Address
+}
+
+// ParsePrivateKey decodes a hex-encoded 32-byte secp256k1 private key, with or without 0x
+func ParsePrivateKey(text string) (*PrivateKey, error) {
+	raw, decodeErr := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(text), "0x"))
+	defer secret.WipeBytes(raw)
+	if decodeErr != nil || len(raw) != fr.Bytes {
+		return nil, errors.New("private key must be 32 hex-encoded bytes")
+	}
+	scalar := new(big.Int).SetBytes(raw)
+	defer scalar.SetInt64(0)
+	if scalar.Sign() == 0 || scalar.Cmp(fr.Modulus()) >= 0 {
+		return nil, errors.New("private key is outside the secp256k1 scalar range")
+	}
+
+	// gnark's key encoding is the uncompressed public point followed by the scalar
+	var public secp256k1.G1Affine
+	public.ScalarMultiplicationBase(scalar)
+	encoded := public.RawBytes()
+	buf := append(encoded[:], raw...)
+	defer secret.WipeBytes(buf)
+	key := &PrivateKey{}
+	if _, setErr := key.key.SetBytes(buf); setErr != nil {
+		return nil, fmt.Errorf("loading private key: %w", setErr)
+	}
+
+	x, y := public.X.Bytes(), public.Y.Bytes()
+	copy(key.address[:], keccak256(x[:], y[:])[12:])
+	return key, nil
+}
+
+// Address returns the account address controlled by the key
+func (k *PrivateKey) Address() Address {
+	return k.address
+}
+
+// halfOrder is n/2; Ethereum only accepts signatures with s at most this value (EIP-2)
+var halfOrder = new(big.Int).Rsh(fr.Modulus(), 1)
+
+// signHash signs a 32-byte digest, returning r, s and the recovery parity of the canonical low-s form
+func (k *PrivateKey) signHash(digest []byte) (r, s *big.Int, parity uint, err error) {
+	v, r, s, signErr := k.key.SignForRecover(digest, nil)
+	if signErr != nil {
+		return nil, nil, 0, signErr
+	}
+	if v > 1 {
+		return nil, nil, 0, errors.New("signature point overflowed the scalar field; retry")
+	}
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(fr.Modulus(), s)
+		v ^= 1
+	}
+	return r, s, v, nil
+}
+
+// LegacyTx is a pre-EIP-1559 transaction protected against replay on other chains by EIP-155
+type LegacyTx struct {
+	ChainID  *big.Int
+	Nonce    uint64
+	GasPrice *big.Int
+	Gas      uint64
+	To       Address
+	Value    *big.Int
+	Data     []byte
+}
+
+// SigningHash is the digest an EIP-155 signature covers
+func (tx LegacyTx) SigningHash() []byte {
+	return keccak256(rlpList(tx.fields(tx.ChainID, new(big.Int), new(big.Int))...))
+}
+
+// Sign returns the RLP-encoded signed transaction, ready for eth_sendRawTransaction
+func (tx LegacyTx) Sign(key *PrivateKey) ([]byte, error) {
+	r, s, parity, signErr := key.signHash(tx.SigningHash())
+	if signErr != nil {
+		return nil, signErr
+	}
+	v := new(big.Int).Mul(tx.ChainID, big.NewInt(2))
+	v.Add(v, big.NewInt(35+int64(parity)))
+	return rlpList(tx.fields(v, r, s)...), nil
+}
+
+// fields encodes the transaction fields followed by the three signature (or EIP-155 placeholder) values
+func (tx LegacyTx) fields(v, r, s *big.Int) [][]byte {
+	return [][]byte{
+		rlpUint(tx.Nonce),
+		rlpBig(tx.GasPrice),
+		rlpUint(tx.Gas),
+		rlpBytes(tx.To[:]),
+		rlpBig(tx.Value),
+		rlpBytes(tx.Data),
+		rlpBig(v),
+		rlpBig(r),
+		rlpBig(s),
+	}
+}
+
+// rlpBytes encodes a byte string
+func rlpBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return []byte{b[0]}
+	}
+	return append(rlpLength(len(b), 0x80), b...)
+}
+
+// rlpList encodes a list of already encoded items
+func rlpList(items ...[]byte) []byte {
+	var payload []byte
+	for _, item := range items {
+		payload = append(payload, item...)
+	}
+	return append(rlpLength(len(payload), 0xc0), payload...)
+}
+
+// rlpLength encodes the header of a string (offset 0x80) or list (offset 0xc0) of n bytes
+func rlpLength(n int, offset byte) []byte {
+	if n < 56 {
+		return []byte{offset + byte(n)}
+	}
+	length := new(big.Int).SetInt64(int64(n)).Bytes()
+	return append([]byte{offset + 55 + byte(len(length))}, length...)
+}
+
+// rlpUint encodes an integer as its minimal big-endian byte string
+func rlpUint(v uint64) []byte {
+	return rlpBytes(new(big.Int).SetUint64(v).Bytes())
+}
+
+// rlpBig encodes a non-negative big integer as its minimal big-endian byte string
+func rlpBig(v *big.Int) []byte {
+	return rlpBytes(v.Bytes())
+}
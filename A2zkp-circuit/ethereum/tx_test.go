@@ -0,0 +1,219 @@
+package ethereum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/secp256k1/ecdsa"
+)
+
+// eip155Example is the transaction of the example in EIP-155, signed by eip155Key
+var eip155Example = LegacyTx{
+	ChainID:  big.NewInt(1),
+	Nonce:    9,
+	GasPrice: big.NewInt(20_000_000_000),
+	Gas:      21000,
+	To:       mustAddress("0x3535353535353535353535353535353535353535"),
+	Value:    new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil),
+}
+
+const eip155Key = "0x4646464646464646464646464646464646464646464646464646464646464646"
+
+// mustAddress parses an address of the tests
+func mustAddress(text string) Address {
+	address, parseErr := ParseAddress(text)
+	if parseErr != nil {
+		panic(parseErr)
+	}
+	return address
+}
+
+// decodeHex decodes a 0x-prefixed hex vector
+func decodeHex(t *testing.T, text string) []byte {
+	t.Helper()
+	raw, decodeErr := hex.DecodeString(strings.TrimPrefix(text, "0x"))
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	return raw
+}
+
+// rlpItems splits an RLP list of byte strings into their contents
+func rlpItems(t *testing.T, list []byte) [][]byte {
+	t.Helper()
+	header := func(b []byte, offset byte) (start, length int) {
+		if b[0] < offset+56 {
+			return 1, int(b[0] - offset)
+		}
+		size := int(b[0] - offset - 55)
+		return 1 + size, int(new(big.Int).SetBytes(b[1 : 1+size]).Int64())
+	}
+	start, length := header(list, 0xc0)
+	if list[0] < 0xc0 || start+length != len(list) {
+		t.Fatalf("%x is not one RLP list", list)
+	}
+	var items [][]byte
+	for payload := list[start:]; len(payload) > 0; {
+		if payload[0] < 0x80 {
+			items, payload = append(items, payload[:1]), payload[1:]
+			continue
+		}
+		itemStart, itemLength := header(payload, 0x80)
+		items, payload = append(items, payload[itemStart:itemStart+itemLength]), payload[itemStart+itemLength:]
+	}
+	return items
+}
+
+// signer recovers the address that signed digest
+func signer(t *testing.T, digest []byte, parity uint, r, s *big.Int) Address {
+	t.Helper()
+	var public ecdsa.PublicKey
+	if recoverErr := public.RecoverFrom(digest, parity, r, s); recoverErr != nil {
+		t.Fatal(recoverErr)
+	}
+	x, y := public.A.X.Bytes(), public.A.Y.Bytes()
+	var address Address
+	copy(address[:], keccak256(x[:], y[:])[12:])
+	return address
+}
+
+func TestRLP(t *testing.T) {
+	// The examples of the RLP specification
+	long := []byte("Lorem ipsum dolor sit amet, consectetur adipisicing elit")
+	for _, c := range []struct {
+		name    string
+		encoded []byte
+		want    string
+	}{
+		{"dog", rlpBytes([]byte("dog")), "83646f67"},
+		{"cat and dog", rlpList(rlpBytes([]byte("cat")), rlpBytes([]byte("dog"))), "c88363617483646f67"},
+		{"empty string", rlpBytes(nil), "80"},
+		{"empty list", rlpList(), "c0"},
+		{"zero", rlpUint(0), "80"},
+		{"byte below 0x80", rlpBytes([]byte{0x0f}), "0f"},
+		{"byte from 0x80", rlpBytes([]byte{0x80}), "8180"},
+		{"1024", rlpUint(1024), "820400"},
+		{"56 bytes", rlpBytes(long), "b838" + hex.EncodeToString(long)},
+		{"big integer", rlpBig(new(big.Int).Lsh(big.NewInt(1), 64)), "89010000000000000000"},
+	} {
+		if got := hex.EncodeToString(c.encoded); got != c.want {
+			t.Errorf("%s encodes as %s, want %s", c.name, got, c.want)
+		}
+	}
+	if header := rlpLength(1024, 0xc0); !bytes.Equal(header, []byte{0xf9, 0x04, 0x00}) {
+		t.Errorf("header of a 1024-byte list = %x, want f90400", header)
+	}
+}
+
+func TestEIP155Example(t *testing.T) {
+	tx := eip155Example
+	unsigned := rlpList(tx.fields(tx.ChainID, new(big.Int), new(big.Int))...)
+	if want := decodeHex(t, "0xec098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a764000080018080"); !bytes.Equal(unsigned, want) {
+		t.Errorf("signing data = %x, want %x", unsigned, want)
+	}
+	digest := tx.SigningHash()
+	if want := decodeHex(t, "0xdaf5a779ae972f972197303d7b574746c7ef83eadac0f2791ad23db92e4c8e53"); !bytes.Equal(digest, want) {
+		t.Errorf("SigningHash = %x, want %x", digest, want)
+	}
+
+	// The example's signature encodes as its raw transaction, and was made by its key
+	r, _ := new(big.Int).SetString("18515461264373351373200002665853028612451056578545711640558177340181847433846", 10)
+	s, _ := new(big.Int).SetString("46948507304638947509940763649030358759909902576025900602547168820602576006531", 10)
+	raw := rlpList(tx.fields(big.NewInt(37), r, s)...)
+	if want := decodeHex(t, "0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"); !bytes.Equal(raw, want) {
+		t.Errorf("signed transaction = %x, want %x", raw, want)
+	}
+	key, keyErr := ParsePrivateKey(eip155Key)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	if want := mustAddress("0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"); key.Address() != want {
+		t.Errorf("address of the key = %s, want %s", key.Address(), want)
+	}
+	if recovered := signer(t, digest, 0, r, s); recovered != key.Address() {
+		t.Errorf("the example signature recovers to %s, want %s", recovered, key.Address())
+	}
+}
+
+func TestSignRecovers(t *testing.T) {
+	key, keyErr := ParsePrivateKey(eip155Key)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	tx := eip155Example
+	tx.ChainID, tx.Data = big.NewInt(31337), bytes.Repeat([]byte{0xab}, 100)
+	digest := tx.SigningHash()
+	unsigned := tx.fields(tx.ChainID, new(big.Int), new(big.Int))
+
+	// Signatures are random, so enough of them use both recovery parities
+	parities := make(map[uint]bool)
+	for range 32 {
+		raw, signErr := tx.Sign(key)
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		items := rlpItems(t, raw)
+		if len(items) != 9 {
+			t.Fatalf("signed transaction has %d fields, want 9", len(items))
+		}
+		for i, field := range unsigned[:6] {
+			if want := rlpItems(t, rlpList(field))[0]; !bytes.Equal(items[i], want) {
+				t.Errorf("field %d = %x, want %x", i, items[i], want)
+			}
+		}
+		v, r, s := new(big.Int).SetBytes(items[6]), new(big.Int).SetBytes(items[7]), new(big.Int).SetBytes(items[8])
+		parity := new(big.Int).Sub(v, big.NewInt(31337*2+35))
+		if !parity.IsUint64() || parity.Uint64() > 1 {
+			t.Fatalf("v = %s, want chain ID * 2 + 35 or 36", v)
+		}
+		if s.Cmp(halfOrder) > 0 {
+			t.Errorf("s = %s is above n/2", s)
+		}
+		parities[uint(parity.Uint64())] = true
+		if recovered := signer(t, digest, uint(parity.Uint64()), r, s); recovered != key.Address() {
+			t.Fatalf("signature with v %s recovers to %s, want %s", v, recovered, key.Address())
+		}
+	}
+	if len(parities) != 2 {
+		t.Errorf("32 signatures used parities %v only", parities)
+	}
+}
+
+func TestAddressChecksum(t *testing.T) {
+	// The examples of EIP-55
+	for _, checksummed := range []string{
+		"0x52908400098527886E0F7030069857D2E4169EE7",
+		"0x8617E340B3D01FA5F11F306F4090FD50E238070D",
+		"0xde709f2102306220921060314715629080e2fb77",
+		"0x27b1fdb04752bbc536007a920d24acb045561c26",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	} {
+		address, parseErr := ParseAddress(checksummed)
+		if parseErr != nil {
+			t.Errorf("ParseAddress(%s): %v", checksummed, parseErr)
+			continue
+		}
+		if address.String() != checksummed {
+			t.Errorf("String of %s = %s", checksummed, address)
+		}
+		if lower, _ := ParseAddress(strings.ToLower(checksummed)); lower != address {
+			t.Errorf("lower-case %s parses as %s", checksummed, lower)
+		}
+	}
+
+	// Mixed case must carry the checksum; a single letter in the wrong case breaks it
+	if _, parseErr := ParseAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD"); parseErr == nil {
+		t.Error("ParseAddress accepted a wrong checksum")
+	}
+	for _, malformed := range []string{"5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea", "0xzzaeb6053f3e94c9b9a09f33669435e7ef1beaed"} {
+		if _, parseErr := ParseAddress(malformed); parseErr == nil {
+			t.Errorf("ParseAddress(%q) succeeded", malformed)
+		}
+	}
+}
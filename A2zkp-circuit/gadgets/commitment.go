@@ -0,0 +1,55 @@
+// Package gadgets holds the constraint building blocks the authentication circuits are assembled
+// from, so other projects can compose their own circuits out of the same pieces. Each gadget adds
+// its constraints to a frontend.API; those that hash have a native counterpart that computes the
+// same value outside the circuit, for building witnesses.
+package gadgets
+
+import (
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark/frontend"
+	stdmimc "github.com/consensys/gnark/std/hash/mimc"
+)
+
+// SquareCommitment constrains commitment to be secret², the commitment of the v1 circuit
+func SquareCommitment(api frontend.API, commitment, secret frontend.Variable) {
+	api.AssertIsEqual(commitment, api.Mul(secret, secret))
+}
+
+// MiMCCommitment constrains commitment to be the MiMC hash of secret followed by bindings, such
+// as the device identifier of the device-bound circuit
+func MiMCCommitment(api frontend.API, commitment, secret frontend.Variable, bindings ...frontend.Variable) error {
+	sum, hashErr := MiMC(api, append([]frontend.Variable{secret}, bindings...)...)
+	if hashErr != nil {
+		return hashErr
+	}
+	api.AssertIsEqual(commitment, sum)
+	return nil
+}
+
+// MiMC hashes field elements with the MiMC gadget over BN254, matching NativeMiMC
+func MiMC(api frontend.API, inputs ...frontend.Variable) (frontend.Variable, error) {
+	hasher, hashErr := stdmimc.NewMiMC(api)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	hasher.Write(inputs...)
+	return hasher.Sum(), nil
+}
+
+// NativeMiMC hashes field elements outside a circuit, matching MiMC. The encodings written to the
+// hasher are wiped, since the inputs are often secrets.
+func NativeMiMC(elements ...*fr.Element) fr.Element {
+	hasher := mimc.NewMiMC()
+	for _, element := range elements {
+		encoded := element.Bytes()
+		hasher.Write(encoded[:])
+		secret.WipeBytes(encoded[:])
+	}
+	var sum fr.Element
+	sum.SetBytes(hasher.Sum(nil))
+	hasher.Reset()
+	return sum
+}
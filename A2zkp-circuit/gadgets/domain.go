@@ -0,0 +1,30 @@
+package gadgets
+
+import (
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/frontend"
+)
+
+// DomainTag maps a purpose, such as an application ID, to the field element that separates its
+// commitments from those of other protocols hashing the same secret: the SHA-256 of the purpose
+// reduced into the scalar field
+func DomainTag(purpose string) fr.Element {
+	digest := sha256.Sum256([]byte(purpose))
+	var tag fr.Element
+	tag.SetBigInt(new(big.Int).SetBytes(digest[:]))
+	return tag
+}
+
+// DomainCommitment constrains commitment to be the MiMC hash of a domain tag followed by the secret,
+// so a commitment registered under one tag is no commitment under another or under MiMCCommitment
+func DomainCommitment(api frontend.API, commitment, tag, secret frontend.Variable) error {
+	sum, hashErr := MiMC(api, tag, secret)
+	if hashErr != nil {
+		return hashErr
+	}
+	api.AssertIsEqual(commitment, sum)
+	return nil
+}
@@ -0,0 +1,164 @@
+package gadgets
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// compile compiles a test circuit over BN254
+func compile(t *testing.T, circuit frontend.Circuit) constraint.ConstraintSystem {
+	t.Helper()
+	ccs, compileErr := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	return ccs
+}
+
+// solves reports whether an assignment satisfies a compiled circuit
+func solves(t *testing.T, ccs constraint.ConstraintSystem, assignment frontend.Circuit) bool {
+	t.Helper()
+	fullWitness, witnessErr := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	return ccs.IsSolved(fullWitness) == nil
+}
+
+type squareCircuit struct {
+	Secret     frontend.Variable
+	Commitment frontend.Variable `gnark:",public"`
+}
+
+func (c *squareCircuit) Define(api frontend.API) error {
+	SquareCommitment(api, c.Commitment, c.Secret)
+	return nil
+}
+
+type mimcCircuit struct {
+	Secret     frontend.Variable
+	Binding    frontend.Variable `gnark:",public"`
+	Commitment frontend.Variable `gnark:",public"`
+}
+
+func (c *mimcCircuit) Define(api frontend.API) error {
+	return MiMCCommitment(api, c.Commitment, c.Secret, c.Binding)
+}
+
+func TestCommitmentGadgets(t *testing.T) {
+	square := compile(t, &squareCircuit{})
+	if !solves(t, square, &squareCircuit{Secret: 7, Commitment: 49}) {
+		t.Error("7² = 49 rejected")
+	}
+	if solves(t, square, &squareCircuit{Secret: 7, Commitment: 50}) {
+		t.Error("7² = 50 accepted")
+	}
+
+	// The in-circuit hash matches the native one, and binds the extra input
+	var secret, binding fr.Element
+	secret.SetUint64(12345)
+	binding.SetUint64(99)
+	commitment := NativeMiMC(&secret, &binding)
+	hashed := compile(t, &mimcCircuit{})
+	if !solves(t, hashed, &mimcCircuit{Secret: 12345, Binding: 99, Commitment: &commitment}) {
+		t.Error("native MiMC commitment rejected in circuit")
+	}
+	if solves(t, hashed, &mimcCircuit{Secret: 12345, Binding: 98, Commitment: &commitment}) {
+		t.Error("MiMC commitment accepted with another binding")
+	}
+}
+
+type rangeCircuit struct {
+	Value  frontend.Variable
+	Min    frontend.Variable    `gnark:",public"`
+	Max    frontend.Variable    `gnark:",public"`
+	Denied [2]frontend.Variable `gnark:",public"`
+}
+
+func (c *rangeCircuit) Define(api frontend.API) error {
+	AssertInRange(api, c.Value, c.Min, c.Max)
+	AssertNoneOf(api, c.Value, c.Denied[:]...)
+	return nil
+}
+
+func TestRangeGadgets(t *testing.T) {
+	ccs := compile(t, &rangeCircuit{})
+	for value, want := range map[int]bool{0: false, 1: true, 500: true, 777: false, 999999: true, 1000000: false} {
+		assignment := &rangeCircuit{Value: value, Min: 1, Max: 999999, Denied: [2]frontend.Variable{777, 1234}}
+		if got := solves(t, ccs, assignment); got != want {
+			t.Errorf("value %d in 1..999999 but not 777 or 1234: solved = %v, want %v", value, got, want)
+		}
+	}
+}
+
+type nonceCircuit struct {
+	Secret     frontend.Variable
+	Commitment frontend.Variable `gnark:",public"`
+	Nonce      frontend.Variable `gnark:",public"`
+}
+
+func (c *nonceCircuit) Define(api frontend.API) error {
+	SquareCommitment(api, c.Commitment, c.Secret)
+	BindNonce(api, c.Nonce, c.Secret)
+	return nil
+}
+
+func TestBindNonce(t *testing.T) {
+	ccs := compile(t, &nonceCircuit{})
+	if public := ccs.GetNbPublicVariables(); public != 3 {
+		t.Errorf("public variables = %d, want 3 (the constant one, commitment and nonce)", public)
+	}
+	if !solves(t, ccs, &nonceCircuit{Secret: 7, Commitment: 49, Nonce: 123456789}) {
+		t.Error("bound nonce rejected")
+	}
+}
+
+// merkleDepth is the height of the test tree
+const merkleDepth = 2
+
+type merkleCircuit struct {
+	Leaf     frontend.Variable
+	Siblings [merkleDepth]frontend.Variable
+	PathBits [merkleDepth]frontend.Variable
+	Root     frontend.Variable `gnark:",public"`
+}
+
+func (c *merkleCircuit) Define(api frontend.API) error {
+	return AssertMerkleMember(api, c.Root, c.Leaf, c.Siblings[:], c.PathBits[:])
+}
+
+func TestMerkleGadget(t *testing.T) {
+	var leaves [4]fr.Element
+	for i := range leaves {
+		leaves[i].SetUint64(uint64(10 + i))
+	}
+	left, right := NativeMiMC(&leaves[0], &leaves[1]), NativeMiMC(&leaves[2], &leaves[3])
+	root := NativeMiMC(&left, &right)
+
+	// Leaf 2 is a left child whose parent is a right child
+	siblings := []fr.Element{leaves[3], left}
+	if native := NativeMerkleRoot(&leaves[2], siblings, 2); !native.Equal(&root) {
+		t.Fatal("NativeMerkleRoot disagrees with the tree")
+	}
+	ccs := compile(t, &merkleCircuit{})
+	assignment := func(leaf frontend.Variable, bits [merkleDepth]frontend.Variable) *merkleCircuit {
+		return &merkleCircuit{Leaf: leaf, Siblings: [merkleDepth]frontend.Variable{&siblings[0], &siblings[1]}, PathBits: bits, Root: &root}
+	}
+	if !solves(t, ccs, assignment(&leaves[2], [merkleDepth]frontend.Variable{0, 1})) {
+		t.Error("member rejected")
+	}
+	if solves(t, ccs, assignment(99, [merkleDepth]frontend.Variable{0, 1})) {
+		t.Error("non-member accepted")
+	}
+	if solves(t, ccs, assignment(&leaves[2], [merkleDepth]frontend.Variable{1, 1})) {
+		t.Error("member accepted at the wrong position")
+	}
+	if solves(t, ccs, assignment(&leaves[2], [merkleDepth]frontend.Variable{2, 1})) {
+		t.Error("non-boolean path bit accepted")
+	}
+}
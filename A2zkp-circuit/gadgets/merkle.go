@@ -0,0 +1,55 @@
+package gadgets
+
+import (
+	"errors"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/frontend"
+	stdmimc "github.com/consensys/gnark/std/hash/mimc"
+)
+
+// MerkleRoot computes the root of a binary MiMC Merkle tree from a leaf and its path. siblings are
+// the nodes next to the path, bottom first, and pathBits the leaf index in binary, lowest bit
+// first, 1 meaning the path node is a right child. Each bit is constrained to be boolean.
+func MerkleRoot(api frontend.API, leaf frontend.Variable, siblings, pathBits []frontend.Variable) (frontend.Variable, error) {
+	if len(siblings) != len(pathBits) {
+		return nil, errors.New("merkle path: need one path bit per sibling")
+	}
+	hasher, hashErr := stdmimc.NewMiMC(api)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	node := leaf
+	for level := range siblings {
+		api.AssertIsBoolean(pathBits[level])
+		left := api.Select(pathBits[level], siblings[level], node)
+		right := api.Select(pathBits[level], node, siblings[level])
+		hasher.Reset()
+		hasher.Write(left, right)
+		node = hasher.Sum()
+	}
+	return node, nil
+}
+
+// AssertMerkleMember constrains leaf to be in the tree with the given root, as located by its path
+func AssertMerkleMember(api frontend.API, root, leaf frontend.Variable, siblings, pathBits []frontend.Variable) error {
+	computed, rootErr := MerkleRoot(api, leaf, siblings, pathBits)
+	if rootErr != nil {
+		return rootErr
+	}
+	api.AssertIsEqual(root, computed)
+	return nil
+}
+
+// NativeMerkleRoot computes outside a circuit the root MerkleRoot would, for the leaf at index
+func NativeMerkleRoot(leaf *fr.Element, siblings []fr.Element, index uint64) fr.Element {
+	node := *leaf
+	for level := range siblings {
+		if (index>>level)&1 == 1 {
+			node = NativeMiMC(&siblings[level], &node)
+		} else {
+			node = NativeMiMC(&node, &siblings[level])
+		}
+	}
+	return node
+}
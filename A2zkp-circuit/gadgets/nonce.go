@@ -0,0 +1,10 @@
+package gadgets
+
+import "github.com/consensys/gnark/frontend"
+
+// BindNonce ties a public nonce into the constraint system alongside the secret, so a proof only
+// verifies for the challenge it was made for. The constraint holds for any nonce; what binds the
+// proof is that the nonce is a public input the verifier supplies.
+func BindNonce(api frontend.API, nonce, secret frontend.Variable) {
+	api.AssertIsEqual(api.Mul(nonce, secret), api.Mul(secret, nonce))
+}
@@ -0,0 +1,20 @@
+package gadgets
+
+import "github.com/consensys/gnark/frontend"
+
+// AssertInRange constrains min <= value <= max, each compared as a non-negative integer below the
+// field modulus
+func AssertInRange(api frontend.API, value, min, max frontend.Variable) {
+	api.AssertIsLessOrEqual(min, value)
+	api.AssertIsLessOrEqual(value, max)
+}
+
+// AssertNoneOf constrains value to differ from every denied value. The product of the differences
+// must be invertible, which takes one constraint per value and keeps which one matched hidden.
+func AssertNoneOf(api frontend.API, value frontend.Variable, denied ...frontend.Variable) {
+	product := frontend.Variable(1)
+	for _, d := range denied {
+		product = api.Mul(product, api.Sub(value, d))
+	}
+	api.Inverse(product)
+}
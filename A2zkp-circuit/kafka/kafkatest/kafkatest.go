@@ -0,0 +1,313 @@
+// Package kafkatest runs a single-broker Kafka cluster in memory for tests of Kafka producers.
+// It answers the requests a github.com/segmentio/kafka-go writer sends, ApiVersions, Metadata,
+// Produce and SASL PLAIN, decoding and encoding them with that library's protocol package. Topics
+// are created by CreateTopic or when a Metadata request names them.
+package kafkatest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/protocol/saslauthenticate"
+	"github.com/segmentio/kafka-go/protocol/saslhandshake"
+)
+
+// Error codes the broker answers with
+const (
+	errorCorruptMessage       = 2
+	errorUnsupportedMechanism = 33
+	errorSASLAuthentication   = 58
+)
+
+// supported are the versions of the requests the broker answers, advertised through ApiVersions
+var supported = []apiversions.ApiKeyResponse{
+	{ApiKey: int16(protocol.Produce), MinVersion: 3, MaxVersion: 7},
+	{ApiKey: int16(protocol.Metadata), MinVersion: 1, MaxVersion: 8},
+	{ApiKey: int16(protocol.SaslHandshake), MinVersion: 1, MaxVersion: 1},
+	{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+	{ApiKey: int16(protocol.SaslAuthenticate), MinVersion: 0, MaxVersion: 1},
+}
+
+// Header is a record header
+type Header = protocol.Header
+
+// Message is a record the broker stored
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Time      time.Time
+}
+
+// Header returns the value of a message's header, or nil when it has none by that name
+func (m Message) Header(key string) []byte {
+	for _, header := range m.Headers {
+		if header.Key == key {
+			return header.Value
+		}
+	}
+	return nil
+}
+
+// Server is a broker, node 0, leading every partition of every topic
+type Server struct {
+	listener   net.Listener
+	partitions int32
+
+	mu       sync.Mutex
+	username string
+	password string
+	topics   []string
+	messages []Message
+	offsets  map[string]int64 // offsets holds the next offset of each "topic/partition"
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a broker on a loopback port whose topics have the given number of partitions
+func NewServer(partitions int) (*Server, error) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	s := &Server{
+		listener:   listener,
+		partitions: int32(max(partitions, 1)),
+		offsets:    make(map[string]int64),
+		conns:      make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr is the host:port the broker listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// RequireSASL makes connections authenticate with SASL PLAIN as username before anything else
+func (s *Server) RequireSASL(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+// CreateTopic creates a topic, if it doesn't exist yet
+func (s *Server) CreateTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.topics, topic) {
+		s.topics = append(s.topics, topic)
+	}
+}
+
+// Messages returns the messages stored in topic, in the order they were produced
+func (s *Server) Messages(topic string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []Message
+	for _, message := range s.messages {
+		if message.Topic == topic {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Close stops the broker and closes its connections
+func (s *Server) Close() error {
+	closeErr := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return closeErr
+}
+
+// accept serves connections until the listener closes
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, acceptErr := s.listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests of one connection, closing it on anything unexpected
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	s.mu.Lock()
+	authenticated := s.username == ""
+	s.mu.Unlock()
+	reader := bufio.NewReader(conn)
+	for {
+		version, correlation, _, request, readErr := protocol.ReadRequest(reader)
+		if readErr != nil {
+			return
+		}
+		var response protocol.Message
+		keepOpen := true
+		switch request := request.(type) {
+		case *apiversions.Request:
+			response = &apiversions.Response{ApiKeys: supported}
+		case *saslhandshake.Request:
+			response = s.handshake(request)
+		case *saslauthenticate.Request:
+			response, authenticated = s.authenticate(request)
+			keepOpen = authenticated
+		case *metadata.Request:
+			if !authenticated {
+				return
+			}
+			response = s.metadata(request)
+		case *produce.Request:
+			if !authenticated {
+				return
+			}
+			response = s.produce(request)
+		default:
+			return
+		}
+		if protocol.WriteResponse(conn, version, correlation, response) != nil || !keepOpen {
+			return
+		}
+	}
+}
+
+// handshake answers a SaslHandshake request, accepting PLAIN only
+func (s *Server) handshake(request *saslhandshake.Request) *saslhandshake.Response {
+	response := &saslhandshake.Response{Mechanisms: []string{"PLAIN"}}
+	if request.Mechanism != "PLAIN" {
+		response.ErrorCode = errorUnsupportedMechanism
+	}
+	return response
+}
+
+// authenticate answers a SaslAuthenticate request carrying PLAIN credentials, reporting whether they are right
+func (s *Server) authenticate(request *saslauthenticate.Request) (*saslauthenticate.Response, bool) {
+	s.mu.Lock()
+	want := "\x00" + s.username + "\x00" + s.password
+	s.mu.Unlock()
+	if string(request.AuthBytes) != want {
+		return &saslauthenticate.Response{
+			ErrorCode:    errorSASLAuthentication,
+			ErrorMessage: "Authentication failed: Invalid username or password",
+			AuthBytes:    []byte{},
+		}, false
+	}
+	return &saslauthenticate.Response{AuthBytes: []byte{}}, true
+}
+
+// metadata answers a Metadata request with this broker and the partitions of the topics asked for,
+// or of every topic when it names none
+func (s *Server) metadata(request *metadata.Request) *metadata.Response {
+	for _, topic := range request.TopicNames {
+		s.CreateTopic(topic)
+	}
+	s.mu.Lock()
+	topics := request.TopicNames
+	if topics == nil {
+		topics = slices.Clone(s.topics)
+	}
+	s.mu.Unlock()
+	host, portText, _ := net.SplitHostPort(s.Addr())
+	port, _ := strconv.Atoi(portText)
+	response := &metadata.Response{
+		Brokers:      []metadata.ResponseBroker{{NodeID: 0, Host: host, Port: int32(port)}},
+		ControllerID: 0,
+	}
+	for _, topic := range topics {
+		partitions := make([]metadata.ResponsePartition, s.partitions)
+		for i := range partitions {
+			partitions[i] = metadata.ResponsePartition{PartitionIndex: int32(i), ReplicaNodes: []int32{0}, IsrNodes: []int32{0}}
+		}
+		response.Topics = append(response.Topics, metadata.ResponseTopic{Name: topic, Partitions: partitions})
+	}
+	return response
+}
+
+// produce stores the records of a Produce request
+func (s *Server) produce(request *produce.Request) *produce.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := &produce.Response{}
+	for _, topic := range request.Topics {
+		answer := produce.ResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			key := topic.Topic + "/" + strconv.Itoa(int(partition.Partition))
+			base := s.offsets[key]
+			var code int16
+			messages, recordsErr := readRecords(partition.RecordSet.Records)
+			if recordsErr != nil {
+				code = errorCorruptMessage
+			}
+			for _, message := range messages {
+				message.Topic, message.Partition, message.Offset = topic.Topic, partition.Partition, s.offsets[key]
+				s.messages = append(s.messages, message)
+				s.offsets[key]++
+			}
+			answer.Partitions = append(answer.Partitions, produce.ResponsePartition{
+				Partition:     partition.Partition,
+				ErrorCode:     code,
+				BaseOffset:    base,
+				LogAppendTime: -1,
+			})
+		}
+		response.Topics = append(response.Topics, answer)
+	}
+	return response
+}
+
+// readRecords reads the records of a produced record set, all or none
+func readRecords(records protocol.RecordReader) ([]Message, error) {
+	var messages []Message
+	for records != nil {
+		record, readErr := records.ReadRecord()
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		key, keyErr := protocol.ReadAll(record.Key)
+		value, valueErr := protocol.ReadAll(record.Value)
+		if keyErr != nil || valueErr != nil {
+			return nil, errors.Join(keyErr, valueErr)
+		}
+		headers := make([]Header, len(record.Headers))
+		for i, header := range record.Headers {
+			headers[i] = Header{Key: header.Key, Value: append([]byte(nil), header.Value...)}
+		}
+		messages = append(messages, Message{Key: key, Value: value, Headers: headers, Time: record.Time})
+	}
+	return messages, nil
+}
@@ -0,0 +1,406 @@
+// Package ldaptest runs an in-memory directory server for tests of LDAP clients. It speaks the
+// subset of LDAPv3 the LDAP store sends through github.com/go-ldap/ldap/v3: simple binds, searches
+// and modifications, without TLS. Messages are decoded and encoded with github.com/go-asn1-ber/asn1-ber.
+package ldaptest
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Result codes the server answers with
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultNoSuchAttribute    = 16
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultInsufficientAccess = 50
+)
+
+// Server is a directory holding entries in memory. Only the bind DN given to NewServer may
+// search and modify them; anonymous connections may only bind.
+type Server struct {
+	listener net.Listener
+	bindDN   string
+	password string
+
+	mu      sync.Mutex
+	entries map[string]map[string][]string // entries maps lowercased DNs to attributes by name
+	dns     map[string]string              // dns maps lowercased DNs to their spelling
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a server on a loopback port accepting binds as bindDN with password
+func NewServer(bindDN, password string) (*Server, error) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	s := &Server{
+		listener: listener,
+		bindDN:   bindDN,
+		password: password,
+		entries:  make(map[string]map[string][]string),
+		dns:      make(map[string]string),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// URL is the ldap:// URL the server listens on
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// AddEntry adds or replaces an entry
+func (s *Server) AddEntry(dn string, attributes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		copied[name] = slices.Clone(values)
+	}
+	s.entries[strings.ToLower(dn)] = copied
+	s.dns[strings.ToLower(dn)] = dn
+}
+
+// Entry returns a copy of an entry's attributes, or nil when there is no such entry
+func (s *Server) Entry(dn string) map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attributes, exists := s.entries[strings.ToLower(dn)]
+	if !exists {
+		return nil
+	}
+	copied := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		copied[name] = slices.Clone(values)
+	}
+	return copied
+}
+
+// DropConnections closes every open client connection, as a directory restarting would
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// accept serves connections until the listener closes
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, acceptErr := s.listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve answers one connection's requests in order until it unbinds or fails
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	bound := false
+	for {
+		message, readErr := ber.ReadPacket(reader)
+		if readErr != nil {
+			return
+		}
+		id, op := child(message, 0), child(message, 1)
+		if id == nil || op == nil || op.ClassType != ber.ClassApplication {
+			return
+		}
+		var responses []*ber.Packet
+		switch op.Tag {
+		case 0:
+			code := s.bind(op)
+			bound = code == resultSuccess && text(child(op, 1)) != ""
+			responses = append(responses, result(1, code, ""))
+		case 2:
+			return
+		case 3:
+			responses = s.search(op, bound)
+		case 6:
+			responses = append(responses, s.modify(op, bound))
+		case 23:
+			responses = append(responses, result(24, resultProtocolError, "extended operations are not supported"))
+		default:
+			return
+		}
+		for _, response := range responses {
+			envelope := ber.NewSequence("")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, number(id), ""))
+			envelope.AppendChild(response)
+			if _, writeErr := conn.Write(envelope.Bytes()); writeErr != nil {
+				return
+			}
+		}
+	}
+}
+
+// child returns the i-th child of a packet, or nil when it has fewer
+func child(packet *ber.Packet, i int) *ber.Packet {
+	if packet == nil || i >= len(packet.Children) {
+		return nil
+	}
+	return packet.Children[i]
+}
+
+// text returns the content of a primitive packet as a string
+func text(packet *ber.Packet) string {
+	if packet == nil || packet.Data == nil {
+		return ""
+	}
+	return packet.Data.String()
+}
+
+// number returns the content of an INTEGER or ENUMERATED packet; malformed ones read as -1
+func number(packet *ber.Packet) int64 {
+	if packet == nil || packet.Data == nil {
+		return -1
+	}
+	value, parseErr := ber.ParseInt64(packet.Data.Bytes())
+	if parseErr != nil {
+		return -1
+	}
+	return value
+}
+
+// octetString builds an OCTET STRING
+func octetString(value string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "")
+}
+
+// constructed builds a constructed packet of a class and tag holding children
+func constructed(class ber.Class, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(class, ber.TypeConstructed, tag, nil, "")
+	for _, c := range children {
+		packet.AppendChild(c)
+	}
+	return packet
+}
+
+// result builds a response of the given application tag holding an LDAPResult
+func result(tag ber.Tag, code int64, message string) *ber.Packet {
+	return constructed(ber.ClassApplication, tag,
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""),
+		octetString(""), octetString(message))
+}
+
+// bind checks a simple bind; an empty DN and password bind anonymously
+func (s *Server) bind(op *ber.Packet) int64 {
+	dn, password := child(op, 1), child(op, 2)
+	switch {
+	case dn == nil || password == nil || password.ClassType != ber.ClassContext || password.Tag != 0:
+		return resultProtocolError
+	case text(dn) == "" && text(password) == "":
+		return resultSuccess
+	case strings.EqualFold(text(dn), s.bindDN) && text(password) == s.password:
+		return resultSuccess
+	default:
+		return resultInvalidCredentials
+	}
+}
+
+// search answers a search with its entries and the final result
+func (s *Server) search(op *ber.Packet, bound bool) []*ber.Packet {
+	if !bound {
+		return []*ber.Packet{result(5, resultInsufficientAccess, "bind first")}
+	}
+	base, scopeField, filter, attributeList := child(op, 0), child(op, 1), child(op, 6), child(op, 7)
+	if base == nil || scopeField == nil || filter == nil || attributeList == nil {
+		return []*ber.Packet{result(5, resultProtocolError, "short search request")}
+	}
+	scope := number(scopeField)
+	baseDN := strings.ToLower(text(base))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[baseDN]; !exists && scope == 0 {
+		return []*ber.Packet{result(5, resultNoSuchObject, "")}
+	}
+	var wanted []string
+	for _, attr := range attributeList.Children {
+		wanted = append(wanted, text(attr))
+	}
+	var responses []*ber.Packet
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		attributes := s.entries[key]
+		if !inScope(key, baseDN, scope) || !matches(filter, attributes) {
+			continue
+		}
+		var encoded []*ber.Packet
+		for name, values := range attributes {
+			if len(wanted) > 0 && !slices.ContainsFunc(wanted, func(w string) bool { return strings.EqualFold(w, name) }) {
+				continue
+			}
+			encodedValues := make([]*ber.Packet, len(values))
+			for i, value := range values {
+				encodedValues[i] = octetString(value)
+			}
+			set := constructed(ber.ClassUniversal, ber.TagSet, encodedValues...)
+			encoded = append(encoded, constructed(ber.ClassUniversal, ber.TagSequence, octetString(name), set))
+		}
+		entry := constructed(ber.ClassApplication, 4, octetString(s.dns[key]), constructed(ber.ClassUniversal, ber.TagSequence, encoded...))
+		responses = append(responses, entry)
+	}
+	return append(responses, result(5, resultSuccess, ""))
+}
+
+// inScope reports whether the entry dn falls under base for a scope
+func inScope(dn, base string, scope int64) bool {
+	switch {
+	case dn == base:
+		return scope != 1
+	case base == "":
+		return scope == 2 || !strings.Contains(dn, ",")
+	case !strings.HasSuffix(dn, ","+base):
+		return false
+	case scope == 1:
+		return !strings.Contains(strings.TrimSuffix(dn, ","+base), ",")
+	default:
+		return scope == 2
+	}
+}
+
+// matches evaluates a filter against an entry; values compare case-insensitively
+func matches(filter *ber.Packet, attributes map[string][]string) bool {
+	if filter.ClassType != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case 0:
+		for _, child := range filter.Children {
+			if !matches(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		return slices.ContainsFunc(filter.Children, func(child *ber.Packet) bool { return matches(child, attributes) })
+	case 2:
+		return len(filter.Children) == 1 && !matches(filter.Children[0], attributes)
+	case 3:
+		attr, value := child(filter, 0), child(filter, 1)
+		if attr == nil || value == nil {
+			return false
+		}
+		return slices.ContainsFunc(values(attributes, text(attr)), func(v string) bool { return strings.EqualFold(v, text(value)) })
+	case 7:
+		return len(values(attributes, text(filter))) > 0
+	default:
+		return false
+	}
+}
+
+// values returns the values of an attribute, matching its name case-insensitively
+func values(attributes map[string][]string, name string) []string {
+	for attr, values := range attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// modify applies a modify request's changes to an entry, all of them or none
+func (s *Server) modify(op *ber.Packet, bound bool) *ber.Packet {
+	if !bound {
+		return result(7, resultInsufficientAccess, "bind first")
+	}
+	dn, changes := child(op, 0), child(op, 1)
+	if dn == nil || changes == nil {
+		return result(7, resultProtocolError, "short modify request")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.entries[strings.ToLower(text(dn))]
+	if !exists {
+		return result(7, resultNoSuchObject, "")
+	}
+	updated := make(map[string][]string, len(current))
+	for name, values := range current {
+		updated[name] = slices.Clone(values)
+	}
+	for _, change := range changes.Children {
+		operation, modification := child(change, 0), child(change, 1)
+		if operation == nil || child(modification, 0) == nil || child(modification, 1) == nil {
+			return result(7, resultProtocolError, "short change")
+		}
+		opCode := number(operation)
+		name := text(child(modification, 0))
+		var newValues []string
+		for _, value := range child(modification, 1).Children {
+			newValues = append(newValues, text(value))
+		}
+		for existing := range updated {
+			if strings.EqualFold(existing, name) && existing != name {
+				updated[name] = updated[existing]
+				delete(updated, existing)
+			}
+		}
+		switch opCode {
+		case 0:
+			updated[name] = append(updated[name], newValues...)
+		case 1:
+			if len(updated[name]) == 0 {
+				return result(7, resultNoSuchAttribute, name)
+			}
+			if len(newValues) == 0 {
+				delete(updated, name)
+				break
+			}
+			for _, value := range newValues {
+				if !slices.Contains(updated[name], value) {
+					return result(7, resultNoSuchAttribute, name)
+				}
+			}
+			updated[name] = slices.DeleteFunc(updated[name], func(v string) bool { return slices.Contains(newValues, v) })
+		case 2:
+			updated[name] = newValues
+		default:
+			return result(7, resultProtocolError, "unknown modification")
+		}
+		if len(updated[name]) == 0 {
+			delete(updated, name)
+		}
+	}
+	s.entries[strings.ToLower(text(dn))] = updated
+	return result(7, resultSuccess, "")
+}
@@ -0,0 +1,88 @@
+// Package mobile is the on-device prover API for iOS and Android apps.
+//
+// It only uses types gomobile can bind (strings, byte slices, errors and
+// pointers to exported structs), so it can be built with
+//
+//	gomobile bind -target=android -o ofa.aar ./mobile
+//	gomobile bind -target=ios -o Ofa.xcframework ./mobile
+//
+// Nonces are decimal strings to avoid precision loss in host languages. Secrets are
+// passed as the ASCII bytes of the decimal value so no immutable string copy is ever
+// created; the slice is zeroed before each call returns, so hosts should not reuse it.
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/logger"
+)
+
+func init() {
+	// The host app owns stdout/logcat; keep gnark quiet
+	logger.Disable()
+}
+
+// GenerateCommitment returns the commitment to register for a secret
+func GenerateCommitment(secretDigits []byte) (string, error) {
+	userSecret, parseErr := parseSecret(secretDigits)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	defer userSecret.Zero()
+	return prover.Commitment(userSecret)
+}
+
+// Prover generates proofs with a proving key downloaded from the server
+type Prover struct {
+	prover *prover.Prover
+}
+
+// NewProver decodes the proving key served at /v1/keys/proving and compiles the circuit.
+// This is slow; apps should create one Prover and keep it.
+func NewProver(provingKey []byte) (*Prover, error) {
+	key, readErr := prover.ReadProvingKey(bytes.NewReader(provingKey))
+	if readErr != nil {
+		return nil, readErr
+	}
+	loaded, newErr := prover.New(context.Background(), key)
+	if newErr != nil {
+		return nil, newErr
+	}
+	return &Prover{prover: loaded}, nil
+}
+
+// Prove returns the gnark-encoded proof of knowledge of secret bound to the challenge nonce.
+// Base64-encode the result into the "proof" field of a /v1/verify request, or pass it to EncodeVerifyRequest.
+func (p *Prover) Prove(secretDigits []byte, nonce string) ([]byte, error) {
+	userSecret, parseErr := parseSecret(secretDigits)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	defer userSecret.Zero()
+	nonceValue, nonceOK := new(big.Int).SetString(nonce, 10)
+	if !nonceOK {
+		return nil, fmt.Errorf("invalid nonce value")
+	}
+
+	proof, proveErr := p.prover.Prove(context.Background(), userSecret, nonceValue)
+	if proveErr != nil {
+		return nil, proveErr
+	}
+	return prover.EncodeProof(proof)
+}
+
+// parseSecret converts the decimal secret bytes used across the binding boundary and wipes them
+func parseSecret(secretDigits []byte) (*secret.Buffer, error) {
+	defer secret.WipeBytes(secretDigits)
+	userSecret, parseErr := secret.Parse(secretDigits)
+	if parseErr != nil {
+		return nil, fmt.Errorf("invalid secret value")
+	}
+	return userSecret, nil
+}
@@ -0,0 +1,88 @@
+package mobile
+
+import (
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/verifier"
+	"A2zkp-circuit/wire"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufContentType is the Content-Type and Accept value for the protobuf request bodies below
+const ProtobufContentType = wire.ContentType
+
+// EncodeRegisterRequest returns the protobuf body of a POST /v1/users registering a raw-secret commitment
+func EncodeRegisterRequest(userName, commitment string) ([]byte, error) {
+	value, parseErr := parseDecimal("commitment", commitment)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return proto.Marshal(&wire.RegisterRequest{
+		UserName: userName,
+		Commitment: &wire.Commitment{
+			Curve:          wire.Curve_CURVE_BN254,
+			CircuitVersion: circuit.Version,
+			Encoding:       wire.Encoding_ENCODING_BIG_ENDIAN,
+			Value:          wire.FieldElement(value),
+		},
+	})
+}
+
+// EncodeChallengeRequest returns the protobuf body of a POST /v1/challenges
+func EncodeChallengeRequest(userName string) ([]byte, error) {
+	return proto.Marshal(&wire.ChallengeRequest{UserName: userName})
+}
+
+// Challenge is a decoded /v1/challenges response
+type Challenge struct {
+	Nonce           string // Nonce is the decimal nonce to pass to Prove
+	ExpiresAtUnixMS int64
+	KeyID           string
+}
+
+// DecodeChallengeResponse decodes the protobuf body of a /v1/challenges response
+func DecodeChallengeResponse(data []byte) (*Challenge, error) {
+	var message wire.ChallengeResponse
+	if decodeErr := proto.Unmarshal(data, &message); decodeErr != nil {
+		return nil, decodeErr
+	}
+	nonce, nonceErr := wire.ParseFieldElement(message.Nonce)
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+	return &Challenge{Nonce: nonce.String(), ExpiresAtUnixMS: message.ExpiresAtUnixMs, KeyID: message.KeyId}, nil
+}
+
+// EncodeVerifyRequest returns the protobuf body of a POST /v1/verify carrying a proof from Prove,
+// with the envelope format version and backend the server checks
+func EncodeVerifyRequest(userName, nonce string, proof []byte, keyID string) ([]byte, error) {
+	value, parseErr := parseDecimal("nonce", nonce)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return proto.Marshal(&wire.VerifyRequest{
+		UserName: userName,
+		Nonce:    wire.FieldElement(value),
+		Proof: &wire.Proof{
+			Curve:          wire.Curve_CURVE_BN254,
+			CircuitVersion: circuit.Version,
+			Encoding:       wire.Encoding_ENCODING_GNARK_BINARY,
+			Data:           proof,
+			FormatVersion:  verifier.ProofEnvelopeVersion,
+			Backend:        verifier.BackendGroth16,
+		},
+		KeyId: keyID,
+	})
+}
+
+// parseDecimal parses a decimal field element passed across the binding boundary
+func parseDecimal(name, text string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok || value.Sign() < 0 || value.Cmp(circuit.Curve.ScalarField()) >= 0 {
+		return nil, fmt.Errorf("invalid %s value", name)
+	}
+	return value, nil
+}
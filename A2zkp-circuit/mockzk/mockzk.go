@@ -0,0 +1,140 @@
+// Package mockzk fakes Groth16 for local development, where the setup and proofs of the larger
+// circuits take seconds.
+//
+// Setup returns keys in gnark's encoding that are recognisably fake: their [α]₁ is a fixed
+// marker point no real setup produces. Prove checks that the witness satisfies the circuit and
+// returns a proof that only hashes the public inputs with a per-setup tag, and Verify recomputes
+// the hash. The prover and verifier packages switch to these fakes whenever they are handed a
+// mock key, so APIs and wire formats stay the same. The tag is part of the verifying key, so
+// anyone can forge a mock proof: mock keys prove nothing and must never reach production.
+package mockzk
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	curve "github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/fft"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+)
+
+// ErrMockProof is returned when a mock proof doesn't match its public inputs or key
+var ErrMockProof = errors.New("mock proof does not match the public inputs")
+
+// marker is the [α]₁ of every mock key
+var marker = hashToG1([]byte("A2zkp-circuit mock Groth16 key"))
+
+// hashToG1 maps data to a multiple of the G1 generator. Anyone can compute the multiple, which
+// is fine for fakes.
+func hashToG1(data ...[]byte) curve.G1Affine {
+	digest := sha256.New()
+	for _, part := range data {
+		digest.Write(part)
+	}
+	var scalar fr.Element
+	scalar.SetBytes(digest.Sum(nil))
+	return scalarG1(&scalar)
+}
+
+// scalarG1 multiplies the G1 generator by a scalar
+func scalarG1(scalar *fr.Element) curve.G1Affine {
+	var point curve.G1Affine
+	point.ScalarMultiplicationBase(scalar.BigInt(new(big.Int)))
+	return point
+}
+
+// Setup returns mock keys for a constraint system, in the blink of an eye. Each setup draws a
+// fresh tag, so key versions still differ.
+func Setup(ccs constraint.ConstraintSystem) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	var tag fr.Element
+	if _, randErr := tag.SetRandom(); randErr != nil {
+		return nil, nil, randErr
+	}
+	_, _, g1, g2 := curve.Generators()
+	tagPoint := scalarG1(&tag)
+
+	provingKey := &groth16bn254.ProvingKey{Domain: *fft.NewDomain(uint64(ccs.GetNbConstraints()))}
+	provingKey.G1.Alpha, provingKey.G1.Beta, provingKey.G1.Delta = marker, tagPoint, g1
+	provingKey.G2.Beta, provingKey.G2.Delta = g2, g2
+
+	verifyingKey := &groth16bn254.VerifyingKey{}
+	verifyingKey.G1.Alpha, verifyingKey.G1.Beta, verifyingKey.G1.Delta = marker, tagPoint, g1
+	verifyingKey.G1.K = make([]curve.G1Affine, ccs.GetNbPublicVariables())
+	for i := range verifyingKey.G1.K {
+		verifyingKey.G1.K[i] = g1
+	}
+	verifyingKey.G2.Beta, verifyingKey.G2.Delta, verifyingKey.G2.Gamma = g2, g2, g2
+	return provingKey, verifyingKey, nil
+}
+
+// IsProvingKey reports whether a proving key came from Setup
+func IsProvingKey(provingKey groth16.ProvingKey) bool {
+	key, isBN254 := provingKey.(*groth16bn254.ProvingKey)
+	return isBN254 && key.G1.Alpha.Equal(&marker)
+}
+
+// IsVerifyingKey reports whether a verifying key came from Setup
+func IsVerifyingKey(verifyingKey groth16.VerifyingKey) bool {
+	key, isBN254 := verifyingKey.(*groth16bn254.VerifyingKey)
+	return isBN254 && key.G1.Alpha.Equal(&marker)
+}
+
+// bind is the Ar of the mock proof of a public witness under a setup's tag
+func bind(tag *curve.G1Affine, publicWitness witness.Witness) (curve.G1Affine, error) {
+	elements, isFr := publicWitness.Vector().(fr.Vector)
+	if !isFr {
+		return curve.G1Affine{}, fmt.Errorf("public witness is not over the BN254 scalar field")
+	}
+	tagBytes := tag.Bytes()
+	parts := [][]byte{tagBytes[:]}
+	for i := range elements {
+		elementBytes := elements[i].Bytes()
+		parts = append(parts, elementBytes[:])
+	}
+	return hashToG1(parts...), nil
+}
+
+// Prove checks that a full witness satisfies the constraint system and returns its mock proof
+func Prove(ccs constraint.ConstraintSystem, provingKey groth16.ProvingKey, fullWitness witness.Witness) (groth16.Proof, error) {
+	if !IsProvingKey(provingKey) {
+		return nil, errors.New("not a mock proving key")
+	}
+	if solveErr := ccs.IsSolved(fullWitness); solveErr != nil {
+		return nil, fmt.Errorf("witness does not satisfy the circuit: %w", solveErr)
+	}
+	publicWitness, publicErr := fullWitness.Public()
+	if publicErr != nil {
+		return nil, publicErr
+	}
+	ar, bindErr := bind(&provingKey.(*groth16bn254.ProvingKey).G1.Beta, publicWitness)
+	if bindErr != nil {
+		return nil, bindErr
+	}
+	_, _, g1, g2 := curve.Generators()
+	return &groth16bn254.Proof{Ar: ar, Bs: g2, Krs: g1}, nil
+}
+
+// Verify checks a mock proof against its public witness
+func Verify(proof groth16.Proof, verifyingKey groth16.VerifyingKey, publicWitness witness.Witness) error {
+	if !IsVerifyingKey(verifyingKey) {
+		return errors.New("not a mock verifying key")
+	}
+	mockProof, isBN254 := proof.(*groth16bn254.Proof)
+	if !isBN254 {
+		return ErrMockProof
+	}
+	want, bindErr := bind(&verifyingKey.(*groth16bn254.VerifyingKey).G1.Beta, publicWitness)
+	if bindErr != nil {
+		return bindErr
+	}
+	if !mockProof.Ar.Equal(&want) {
+		return ErrMockProof
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package mockzk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+)
+
+// roundTrip encodes a gnark object and decodes it into dst, as a client downloading it would
+func roundTrip(t *testing.T, src io.WriterTo, dst io.ReaderFrom) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if _, writeErr := src.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, readErr := dst.ReadFrom(&encoded); readErr != nil {
+		t.Fatal(readErr)
+	}
+}
+
+func TestMockProof(t *testing.T) {
+	ccs, compileErr := circuit.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+
+	// Mock keys survive gnark's encoding and stay recognisable; real ones aren't mistaken for them
+	decodedPK, decodedVK := groth16.NewProvingKey(circuit.Curve), groth16.NewVerifyingKey(circuit.Curve)
+	roundTrip(t, provingKey, decodedPK)
+	roundTrip(t, verifyingKey, decodedVK)
+	if !IsProvingKey(decodedPK) || !IsVerifyingKey(decodedVK) {
+		t.Fatal("decoded mock keys are not recognised as mock keys")
+	}
+	realPK, realVK, realErr := groth16.Setup(ccs)
+	if realErr != nil {
+		t.Fatal(realErr)
+	}
+	if IsProvingKey(realPK) || IsVerifyingKey(realVK) {
+		t.Error("a real setup was recognised as a mock one")
+	}
+
+	nonce := big.NewInt(424242)
+	fullWitness, witnessErr := circuit.NewWitness(secret.FromInt64(12345), nonce)
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	proof, proveErr := Prove(ccs, decodedPK, fullWitness)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	decodedProof := groth16.NewProof(circuit.Curve)
+	roundTrip(t, proof, decodedProof)
+
+	commitment, _ := circuit.GenerateCryptoCommitment(secret.FromInt64(12345))
+	publicWitness, _ := circuit.NewPublicWitness(commitment, nonce)
+	if verifyErr := Verify(decodedProof, decodedVK, publicWitness); verifyErr != nil {
+		t.Errorf("mock proof rejected: %v", verifyErr)
+	}
+	otherNonce, _ := circuit.NewPublicWitness(commitment, big.NewInt(424243))
+	if verifyErr := Verify(decodedProof, decodedVK, otherNonce); !errors.Is(verifyErr, ErrMockProof) {
+		t.Errorf("mock proof against another nonce = %v, want ErrMockProof", verifyErr)
+	}
+	_, otherVK, _ := Setup(ccs)
+	if verifyErr := Verify(decodedProof, otherVK, publicWitness); !errors.Is(verifyErr, ErrMockProof) {
+		t.Errorf("mock proof against another mock setup = %v, want ErrMockProof", verifyErr)
+	}
+	if verifyErr := Verify(decodedProof, realVK, publicWitness); verifyErr == nil {
+		t.Error("mock verification accepted a real verifying key")
+	}
+
+	// Like a real prover, the mock one refuses a witness that doesn't satisfy the circuit
+	assignment := &circuit.Circuit{UserSecret: 12345, CryptoCommitment: 7, Nonce: nonce}
+	unsatisfied, witnessErr := frontend.NewWitness(assignment, circuit.Curve.ScalarField())
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if _, proveErr := Prove(ccs, provingKey, unsatisfied); proveErr == nil {
+		t.Error("mock prover proved an unsatisfied witness")
+	}
+}
@@ -0,0 +1,115 @@
+// Package ntp is a minimal SNTP client (RFC 4330): one request to a server, answered with the
+// offset of the local clock from the server's and the round trip it took.
+package ntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultPort is the port of servers whose address names none
+const DefaultPort = "123"
+
+// defaultTimeout bounds the query when the context has no earlier deadline
+const defaultTimeout = 5 * time.Second
+
+// packetSize is the size of an SNTP packet without extension fields or authenticator
+const packetSize = 48
+
+// Modes of the first byte of a packet
+const (
+	modeClient = 3
+	modeServer = 4
+)
+
+// version is the NTP version requests are sent with
+const version = 4
+
+// ntpEpochOffset is the number of seconds between the NTP epoch, 1900, and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// ErrKissOfDeath is returned for a server answering with stratum 0, telling the client to go away
+var ErrKissOfDeath = errors.New("ntp: kiss-of-death reply")
+
+// Response is what a query learned about the local clock
+type Response struct {
+	Offset  time.Duration // Offset is how far the local clock is behind the server's; negative when ahead
+	RTT     time.Duration // RTT is the round trip, less the time the server took to answer
+	Stratum uint8         // Stratum is the server's distance from a reference clock, 1 for a primary server
+	Time    time.Time     // Time is the server's clock when it answered
+}
+
+// Query asks the server at addr, "host" or "host:port", for the time
+func Query(ctx context.Context, addr string) (Response, error) {
+	if _, _, splitErr := net.SplitHostPort(addr); splitErr != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline || time.Until(deadline) > defaultTimeout {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	var dialer net.Dialer
+	conn, dialErr := dialer.DialContext(ctx, "udp", addr)
+	if dialErr != nil {
+		return Response{}, fmt.Errorf("ntp: %w", dialErr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	request := make([]byte, packetSize)
+	request[0] = version<<3 | modeClient
+	sent := time.Now()
+	transmit := toNTP(sent)
+	binary.BigEndian.PutUint64(request[40:], transmit)
+	if _, writeErr := conn.Write(request); writeErr != nil {
+		return Response{}, fmt.Errorf("ntp: %w", writeErr)
+	}
+	reply := make([]byte, packetSize)
+	n, readErr := conn.Read(reply)
+	received := time.Now()
+	if readErr != nil {
+		return Response{}, fmt.Errorf("ntp: %w", readErr)
+	}
+	return parseReply(reply[:n], transmit, sent, received)
+}
+
+// parseReply checks a server's reply to the request sent at sent with the given transmit timestamp
+// and works out the clock offset, received being when the reply came in
+func parseReply(reply []byte, transmit uint64, sent, received time.Time) (Response, error) {
+	switch {
+	case len(reply) < packetSize:
+		return Response{}, fmt.Errorf("ntp: reply of %d bytes is too short", len(reply))
+	case reply[0]&0x07 != modeServer:
+		return Response{}, fmt.Errorf("ntp: reply has mode %d, not %d", reply[0]&0x07, modeServer)
+	case reply[0]>>6 == 3:
+		return Response{}, errors.New("ntp: server clock is not synchronized")
+	case reply[1] == 0:
+		return Response{}, fmt.Errorf("%w: %q", ErrKissOfDeath, reply[12:16])
+	case binary.BigEndian.Uint64(reply[24:]) != transmit:
+		return Response{}, errors.New("ntp: reply does not answer the request")
+	}
+	serverReceived := fromNTP(binary.BigEndian.Uint64(reply[32:]))
+	serverSent := fromNTP(binary.BigEndian.Uint64(reply[40:]))
+	// Monotonic readings keep the local side of the round trip exact even if the clock steps
+	rtt := received.Sub(sent) - serverSent.Sub(serverReceived)
+	offset := (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2
+	return Response{Offset: offset, RTT: max(rtt, 0), Stratum: reply[1], Time: serverSent}, nil
+}
+
+// toNTP encodes t as a 64-bit NTP timestamp: seconds since 1900 and a binary fraction
+func toNTP(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// fromNTP decodes a 64-bit NTP timestamp
+func fromNTP(timestamp uint64) time.Time {
+	seconds := int64(timestamp>>32) - ntpEpochOffset
+	nanos := int64((timestamp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanos)
+}
@@ -0,0 +1,98 @@
+package ntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve answers every request on a local UDP socket with answer's reply, if any, until the test ends
+func serve(t *testing.T, answer func(request []byte) []byte) string {
+	conn, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, readErr := conn.ReadFrom(buf)
+			if readErr != nil {
+				return
+			}
+			if reply := answer(buf[:n]); reply != nil {
+				conn.WriteTo(reply, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// skewedServer answers as a stratum 2 server whose clock runs skew ahead of the local one
+func skewedServer(skew time.Duration) func([]byte) []byte {
+	return func(request []byte) []byte {
+		reply := make([]byte, packetSize)
+		reply[0] = version<<3 | modeServer
+		reply[1] = 2
+		copy(reply[24:32], request[40:48])
+		now := toNTP(time.Now().Add(skew))
+		binary.BigEndian.PutUint64(reply[32:], now)
+		binary.BigEndian.PutUint64(reply[40:], now)
+		return reply
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	for _, skew := range []time.Duration{0, 90 * time.Second, -3 * time.Minute} {
+		response, queryErr := Query(ctx, serve(t, skewedServer(skew)))
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		if drift := response.Offset - skew; drift < -50*time.Millisecond || drift > 50*time.Millisecond {
+			t.Errorf("offset from a server %s ahead = %s", skew, response.Offset)
+		}
+		if response.Stratum != 2 || response.RTT < 0 {
+			t.Errorf("response = %+v", response)
+		}
+	}
+
+	kissOfDeath := serve(t, func(request []byte) []byte {
+		reply := skewedServer(0)(request)
+		reply[1] = 0
+		copy(reply[12:16], "RATE")
+		return reply
+	})
+	if _, queryErr := Query(ctx, kissOfDeath); !errors.Is(queryErr, ErrKissOfDeath) {
+		t.Errorf("query answered with a kiss of death = %v, want ErrKissOfDeath", queryErr)
+	}
+	spoofed := serve(t, func(request []byte) []byte {
+		reply := skewedServer(0)(request)
+		reply[24]++
+		return reply
+	})
+	if _, queryErr := Query(ctx, spoofed); queryErr == nil {
+		t.Error("a reply to another request was accepted")
+	}
+	short := serve(t, func([]byte) []byte { return []byte{0x24} })
+	if _, queryErr := Query(ctx, short); queryErr == nil {
+		t.Error("a truncated reply was accepted")
+	}
+
+	silent := serve(t, func([]byte) []byte { return nil })
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, queryErr := Query(timeout, silent); queryErr == nil {
+		t.Error("a query nobody answered succeeded")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	now := time.Unix(1760000000, 123456789)
+	if back := fromNTP(toNTP(now)); back.Sub(now).Abs() > time.Nanosecond {
+		t.Errorf("round trip of %s = %s", now, back)
+	}
+}
@@ -0,0 +1,80 @@
+package prover
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"A2zkp-circuit/mockzk"
+
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+)
+
+// Values accepted by NewBackend
+const (
+	AccelerationCPU = "cpu"
+	AccelerationGPU = "gpu"
+)
+
+// Backend runs server-side Groth16 proving, routing MSM and FFT work to the Icicle GPU
+// backend when requested, compiled in (-tags icicle) and working. The first GPU failure
+// switches the backend to CPU for the rest of the process lifetime.
+type Backend struct {
+	gpu atomic.Bool
+}
+
+// NewBackend validates the acceleration setting and reports what will actually be used
+func NewBackend(acceleration string) (*Backend, error) {
+	b := &Backend{}
+	switch acceleration {
+	case "", AccelerationCPU:
+	case AccelerationGPU:
+		if !icicleCompiled {
+			log.Println("GPU proving requested but this binary was built without -tags icicle; using CPU")
+			break
+		}
+		b.gpu.Store(true)
+		log.Println("GPU proving enabled through Icicle")
+	default:
+		return nil, fmt.Errorf("prover_acceleration must be %q or %q, got %q", AccelerationCPU, AccelerationGPU, acceleration)
+	}
+	return b, nil
+}
+
+// Name reports the backend currently used for proving
+func (b *Backend) Name() string {
+	if b.gpu.Load() {
+		return AccelerationGPU
+	}
+	return AccelerationCPU
+}
+
+// Prove generates a proof, retrying on CPU if the GPU backend fails (for instance when no device is present).
+// A proof already running can't be interrupted, so the context is only checked before each attempt.
+// The caller built the witness, so only StageProving and StageDone reach a ProgressFunc of ctx.
+func (b *Backend) Prove(ctx context.Context, ccs constraint.ConstraintSystem, provingKey groth16.ProvingKey, fullWitness witness.Witness) (groth16.Proof, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if mockzk.IsProvingKey(provingKey) {
+		return trackProof(ctx, ccs, false, func() (groth16.Proof, error) { return mockzk.Prove(ccs, provingKey, fullWitness) })
+	}
+	if b.gpu.Load() {
+		proof, gpuErr := trackProof(ctx, ccs, true, func() (groth16.Proof, error) {
+			return groth16.Prove(ccs, provingKey, fullWitness, backend.WithIcicleAcceleration())
+		})
+		if gpuErr == nil {
+			return proof, nil
+		}
+		log.Println("GPU proving failed, falling back to CPU:", gpuErr)
+		b.gpu.Store(false)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return trackProof(ctx, ccs, true, func() (groth16.Proof, error) { return groth16.Prove(ccs, provingKey, fullWitness) })
+}
@@ -0,0 +1,6 @@
+//go:build !icicle
+
+package prover
+
+// icicleCompiled is true when gnark's Icicle GPU backend is linked in
+const icicleCompiled = false
@@ -0,0 +1,58 @@
+package prover
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// DeviceProver proves with the device-bound circuit, circuit.DeviceCircuit. Its proving key comes
+// from a setup of that circuit, not of circuit.Circuit.
+type DeviceProver struct {
+	ccs        constraint.ConstraintSystem
+	provingKey groth16.ProvingKey
+}
+
+// NewDevice compiles the device-bound circuit and pairs it with a proving key
+func NewDevice(ctx context.Context, provingKey groth16.ProvingKey) (*DeviceProver, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	ccs, compileErr := circuit.CompileDevice()
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling device circuit: %w", compileErr)
+	}
+	return &DeviceProver{ccs: ccs, provingKey: provingKey}, nil
+}
+
+// DeviceCommitment computes the commitment to register for a secret on one device
+func DeviceCommitment(userSecret *secret.Buffer, deviceID string) (string, error) {
+	return circuit.GenerateDeviceCommitment(userSecret, deviceID)
+}
+
+// Prove builds the witness for a secret, device and challenge nonce and generates a Groth16 proof
+// that only verifies against that device's identifier. Cancellation and wiping work as in Prover.Prove.
+func (p *DeviceProver) Prove(ctx context.Context, userSecret *secret.Buffer, deviceID string, nonce *big.Int) (groth16.Proof, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	fullWitness, witnessErr := circuit.NewDeviceWitness(userSecret, deviceID, nonce)
+	if witnessErr != nil {
+		return nil, fmt.Errorf("building witness: %w", witnessErr)
+	}
+	defer circuit.WipeWitness(fullWitness)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	proof, proveErr := prove(ctx, p.ccs, p.provingKey, fullWitness)
+	if proveErr != nil {
+		return nil, fmt.Errorf("proving: %w", proveErr)
+	}
+	return proof, nil
+}
@@ -0,0 +1,59 @@
+package prover
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// GroupProver proves group membership with circuit.GroupCircuit. Its proving key comes from a
+// setup of that circuit, served by the server at /v1/keys/group/proving.
+type GroupProver struct {
+	ccs        constraint.ConstraintSystem
+	provingKey groth16.ProvingKey
+}
+
+// NewGroup compiles the group membership circuit and pairs it with a proving key
+func NewGroup(ctx context.Context, provingKey groth16.ProvingKey) (*GroupProver, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	ccs, compileErr := circuit.CompileGroup()
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling group circuit: %w", compileErr)
+	}
+	return &GroupProver{ccs: ccs, provingKey: provingKey}, nil
+}
+
+// Nullifier computes the nullifier a member's proofs for a group carry in one epoch
+func Nullifier(userSecret *secret.Buffer, group string, epoch uint64) (string, error) {
+	return circuit.GroupNullifier(userSecret, group, epoch)
+}
+
+// Prove generates a Groth16 proof that the commitment of a secret is one of the members of tree,
+// bound to a group, epoch and challenge nonce, without revealing which member. Cancellation and
+// wiping work as in Prover.Prove.
+func (p *GroupProver) Prove(ctx context.Context, userSecret *secret.Buffer, tree *circuit.GroupTree, group string, epoch uint64, nonce *big.Int) (groth16.Proof, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	fullWitness, witnessErr := circuit.NewGroupWitness(userSecret, tree, group, epoch, nonce)
+	if witnessErr != nil {
+		return nil, fmt.Errorf("building witness: %w", witnessErr)
+	}
+	defer circuit.WipeWitness(fullWitness)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	proof, proveErr := prove(ctx, p.ccs, p.provingKey, fullWitness)
+	if proveErr != nil {
+		return nil, fmt.Errorf("proving: %w", proveErr)
+	}
+	return proof, nil
+}
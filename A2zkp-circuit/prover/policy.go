@@ -0,0 +1,53 @@
+package prover
+
+import (
+	"context"
+	"fmt"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// PolicyProver proves a secret meets a secret policy with circuit.PolicyCircuit. Its proving key
+// comes from a setup of that circuit, served by the server at /v1/keys/policy/proving.
+type PolicyProver struct {
+	ccs        constraint.ConstraintSystem
+	provingKey groth16.ProvingKey
+}
+
+// NewPolicy compiles the policy circuit and pairs it with a proving key
+func NewPolicy(ctx context.Context, provingKey groth16.ProvingKey) (*PolicyProver, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	ccs, compileErr := circuit.CompilePolicy()
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling policy circuit: %w", compileErr)
+	}
+	return &PolicyProver{ccs: ccs, provingKey: provingKey}, nil
+}
+
+// Prove generates the Groth16 proof, sent along with the commitment of a secret when registering
+// it, that the secret meets policy. A secret the policy forbids fails with circuit.ErrWeakSecret
+// before any proving. Cancellation and wiping work as in Prover.Prove.
+func (p *PolicyProver) Prove(ctx context.Context, userSecret *secret.Buffer, policy circuit.SecretPolicy) (groth16.Proof, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	fullWitness, witnessErr := circuit.NewPolicyWitness(userSecret, policy)
+	if witnessErr != nil {
+		return nil, fmt.Errorf("building witness: %w", witnessErr)
+	}
+	defer circuit.WipeWitness(fullWitness)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	proof, proveErr := prove(ctx, p.ccs, p.provingKey, fullWitness)
+	if proveErr != nil {
+		return nil, fmt.Errorf("proving: %w", proveErr)
+	}
+	return proof, nil
+}
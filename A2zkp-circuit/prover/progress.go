@@ -0,0 +1,114 @@
+package prover
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// Stages a proof generation reports its progress in, in order
+const (
+	StageWitness = "witness" // StageWitness is reported once the witness is built, before proving starts
+	StageProving = "proving" // StageProving is reported as the multi-scalar multiplications go, with an estimated Percent
+	StageDone    = "done"    // StageDone is reported with Percent 100 once the proof exists
+)
+
+// Progress is one step of a proof generation, for a progress bar.
+//
+// gnark reports nothing from inside groth16.Prove, so Percent is an estimate from elapsed time: the
+// proving time per constraint measured by the last proof this process generated, or before any a
+// conservative guess. It never passes 99 until the proof is done, whichever way the estimate is off.
+type Progress struct {
+	Stage   string  // Stage is StageWitness, StageProving or StageDone
+	Percent float64 // Percent is how far proving is, from 0 to 100, in whole percents
+}
+
+// ProgressFunc receives the progress of a proof generation. It is called from the proving goroutine
+// and from a ticker of its own, never concurrently, and should return quickly.
+type ProgressFunc func(Progress)
+
+// progressKey is the context key of the ProgressFunc WithProgress installs
+type progressKey struct{}
+
+// WithProgress returns a context under which Prove calls, including Backend.Prove and those of the
+// device, group and policy provers, report their progress to report
+func WithProgress(ctx context.Context, report ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// progressFrom returns the ProgressFunc ctx carries, or one doing nothing
+func progressFrom(ctx context.Context) ProgressFunc {
+	if report, _ := ctx.Value(progressKey{}).(ProgressFunc); report != nil {
+		return report
+	}
+	return func(Progress) {}
+}
+
+// progressInterval is how often the estimated percent is reported while proving
+const progressInterval = 200 * time.Millisecond
+
+// defaultConstraintCost is the proving time per constraint assumed before any proof was measured,
+// that of a low-end phone, so the first estimate errs towards a bar that jumps to done
+const defaultConstraintCost = 50 * time.Microsecond
+
+// constraintCost is the proving time per constraint, in nanoseconds, the last timed proof took
+var constraintCost atomic.Int64
+
+// trackProof runs a proof of ccs, reporting StageProving with estimated percents to ctx's
+// ProgressFunc until it is done and StageDone after it succeeds. Only timed proofs, real Groth16
+// ones rather than mock ones, update the estimate.
+func trackProof(ctx context.Context, ccs constraint.ConstraintSystem, timed bool, run func() (groth16.Proof, error)) (groth16.Proof, error) {
+	report := progressFrom(ctx)
+	constraints := max(ccs.GetNbConstraints(), 1)
+	expected := time.Duration(constraints) * defaultConstraintCost
+	if measured := constraintCost.Load(); measured > 0 {
+		expected = time.Duration(int64(constraints) * measured)
+	}
+
+	var (
+		reporting sync.Mutex // reporting keeps the ticker from reporting alongside or after the proof
+		finished  bool
+	)
+	started := time.Now()
+	report(Progress{Stage: StageProving})
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	stop := make(chan struct{})
+	go func() {
+		last := 0.0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			percent := min(99, math.Floor(100*float64(time.Since(started))/float64(expected)))
+			reporting.Lock()
+			if !finished && percent > last {
+				last = percent
+				report(Progress{Stage: StageProving, Percent: percent})
+			}
+			reporting.Unlock()
+		}
+	}()
+
+	proof, proveErr := run()
+	took := time.Since(started)
+	close(stop)
+	reporting.Lock()
+	finished = true
+	reporting.Unlock()
+	if proveErr != nil {
+		return nil, proveErr
+	}
+	if timed {
+		constraintCost.Store(max(int64(took)/int64(constraints), 1))
+	}
+	report(Progress{Stage: StageDone, Percent: 100})
+	return proof, nil
+}
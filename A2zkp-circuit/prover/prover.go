@@ -0,0 +1,130 @@
+// Package prover generates commitments and proofs on the user's device.
+//
+// Nothing in this package talks to the network: callers supply the proving key
+// (typically downloaded once from the server's /v1/keys/proving endpoint) and the
+// challenge nonce, and only the resulting commitment or proof is sent anywhere.
+// Backend proves on the server instead, for clients that can't, optionally on a GPU.
+package prover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/mockzk"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+)
+
+// Prover holds a compiled circuit and the proving key matching it
+type Prover struct {
+	ccs         constraint.ConstraintSystem
+	provingKey  groth16.ProvingKey
+	composition circuit.Composition
+}
+
+// New compiles the circuit and pairs it with a proving key
+func New(ctx context.Context, provingKey groth16.ProvingKey) (*Prover, error) {
+	return NewComposed(ctx, provingKey, circuit.DefaultComposition)
+}
+
+// NewComposed compiles the circuit a composition assembles, as served by a server configured
+// with one, and pairs it with a proving key
+func NewComposed(ctx context.Context, provingKey groth16.ProvingKey, composition circuit.Composition) (*Prover, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	ccs, compileErr := composition.Compile()
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling circuit %s: %w", composition.Version(), compileErr)
+	}
+	return &Prover{ccs: ccs, provingKey: provingKey, composition: composition}, nil
+}
+
+// prove generates a Groth16 proof, or a mock one for a mock proving key, reporting its progress
+// to ctx's ProgressFunc from the built witness on
+func prove(ctx context.Context, ccs constraint.ConstraintSystem, provingKey groth16.ProvingKey, fullWitness witness.Witness) (groth16.Proof, error) {
+	progressFrom(ctx)(Progress{Stage: StageWitness})
+	if mockzk.IsProvingKey(provingKey) {
+		return trackProof(ctx, ccs, false, func() (groth16.Proof, error) { return mockzk.Prove(ccs, provingKey, fullWitness) })
+	}
+	return trackProof(ctx, ccs, true, func() (groth16.Proof, error) { return groth16.Prove(ccs, provingKey, fullWitness) })
+}
+
+// ReadProvingKey decodes a proving key in gnark binary encoding
+func ReadProvingKey(r io.Reader) (groth16.ProvingKey, error) {
+	provingKey := groth16.NewProvingKey(circuit.Curve)
+	if _, readErr := provingKey.ReadFrom(r); readErr != nil {
+		return nil, fmt.Errorf("decoding proving key: %w", readErr)
+	}
+	return provingKey, nil
+}
+
+// proofBuffers holds the buffers EncodeProof serializes into, so a busy prover doesn't regrow one
+// per proof
+var proofBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// EncodeProof serializes a proof in gnark binary encoding, as /v1/verify takes it, with
+// compressed points: the smallest encoding, for mobile links
+func EncodeProof(proof groth16.Proof) ([]byte, error) {
+	return encodeProof(proof.WriteTo)
+}
+
+// EncodeUncompressedProof serializes a proof with uncompressed points, twice EncodeProof's size
+// but decoded without recovering each point's second coordinate; submit it with the
+// "uncompressed" proof_encoding
+func EncodeUncompressedProof(proof groth16.Proof) ([]byte, error) {
+	return encodeProof(proof.WriteRawTo)
+}
+
+// encodeProof serializes a proof with one of its write methods into a pooled buffer
+func encodeProof(write func(io.Writer) (int64, error)) ([]byte, error) {
+	buffer := proofBuffers.Get().(*bytes.Buffer)
+	defer proofBuffers.Put(buffer)
+	buffer.Reset()
+	if _, writeErr := write(buffer); writeErr != nil {
+		return nil, fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	return bytes.Clone(buffer.Bytes()), nil
+}
+
+// Commitment computes the commitment to register for a secret
+func Commitment(userSecret *secret.Buffer) (string, error) {
+	return circuit.GenerateCryptoCommitment(userSecret)
+}
+
+// Commitment computes the commitment under the prover's composition that its proofs verify against,
+// which a server blinding stored commitments needs sent along with them
+func (p *Prover) Commitment(userSecret *secret.Buffer) (string, error) {
+	return p.composition.GenerateCommitment(userSecret)
+}
+
+// Prove builds the witness for a secret and challenge nonce and generates a Groth16 proof.
+// The context is checked before each phase; a proof already being computed runs to completion.
+// Progress is reported to the ProgressFunc of a context from WithProgress.
+// The witness is wiped before returning, but userSecret itself is left for the caller to zero.
+func (p *Prover) Prove(ctx context.Context, userSecret *secret.Buffer, nonce *big.Int) (groth16.Proof, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	fullWitness, witnessErr := p.composition.NewWitness(userSecret, nonce)
+	if witnessErr != nil {
+		return nil, fmt.Errorf("building witness: %w", witnessErr)
+	}
+	defer circuit.WipeWitness(fullWitness)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	proof, proveErr := prove(ctx, p.ccs, p.provingKey, fullWitness)
+	if proveErr != nil {
+		return nil, fmt.Errorf("proving: %w", proveErr)
+	}
+	return proof, nil
+}
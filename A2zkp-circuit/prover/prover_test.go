@@ -0,0 +1,284 @@
+package prover
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/entropy"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// setup compiles the circuit and runs a throwaway Groth16 setup
+func setup(t *testing.T) (*Prover, groth16.VerifyingKey) {
+	t.Helper()
+	ccs, compileErr := circuit.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := New(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	return p, verifyingKey
+}
+
+func TestProveVerifies(t *testing.T) {
+	p, verifyingKey := setup(t)
+	nonce := big.NewInt(424242)
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), nonce)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	publicWitness, witnessErr := circuit.NewPublicWitness("152399025", nonce)
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if verifyErr := groth16.Verify(proof, verifyingKey, publicWitness); verifyErr != nil {
+		t.Errorf("proof does not verify: %v", verifyErr)
+	}
+}
+
+func TestSeededSetupAndProof(t *testing.T) {
+	// run sets up and proves under a fresh seed, returning the encoded verifying key and proof
+	run := func() ([]byte, []byte) {
+		defer entropy.UseSeed("golden")()
+		p, verifyingKey := setup(t)
+		proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), big.NewInt(424242))
+		if proveErr != nil {
+			t.Fatal(proveErr)
+		}
+		var encoded bytes.Buffer
+		proof.WriteTo(&encoded)
+		return encodeKey(verifyingKey), encoded.Bytes()
+	}
+	firstKey, firstProof := run()
+	secondKey, secondProof := run()
+	if !bytes.Equal(firstKey, secondKey) {
+		t.Error("the same seed gave different verifying keys")
+	}
+	if !bytes.Equal(firstProof, secondProof) {
+		t.Error("the same seed gave different proofs")
+	}
+	if _, unseeded := setup(t); bytes.Equal(firstKey, encodeKey(unseeded)) {
+		t.Error("an unseeded setup reproduced the seeded keys")
+	}
+}
+
+// encodeKey serializes a verifying key for comparison
+func encodeKey(verifyingKey groth16.VerifyingKey) []byte {
+	var encoded bytes.Buffer
+	verifyingKey.WriteTo(&encoded)
+	return encoded.Bytes()
+}
+
+func TestProveHonoursCancellation(t *testing.T) {
+	p, _ := setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, proveErr := p.Prove(ctx, secret.FromInt64(1), big.NewInt(1)); !errors.Is(proveErr, context.Canceled) {
+		t.Errorf("Prove on a cancelled context = %v, want context.Canceled", proveErr)
+	}
+	if _, newErr := New(ctx, nil); !errors.Is(newErr, context.Canceled) {
+		t.Errorf("New on a cancelled context = %v, want context.Canceled", newErr)
+	}
+}
+
+func TestProveReportsProgress(t *testing.T) {
+	p, _ := setup(t)
+	var reported []Progress
+	ctx := WithProgress(context.Background(), func(progress Progress) { reported = append(reported, progress) })
+	if _, proveErr := p.Prove(ctx, secret.FromInt64(12345), big.NewInt(7)); proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	if len(reported) < 3 || reported[0].Stage != StageWitness || reported[1].Stage != StageProving {
+		t.Fatalf("progress %+v, want witness then proving", reported)
+	}
+	if last := reported[len(reported)-1]; last != (Progress{Stage: StageDone, Percent: 100}) {
+		t.Errorf("last progress %+v, want done at 100%%", last)
+	}
+	for i := 2; i < len(reported)-1; i++ {
+		if reported[i].Stage != StageProving || reported[i].Percent <= reported[i-1].Percent || reported[i].Percent > 99 {
+			t.Errorf("progress %d of %+v doesn't move proving forward below 100%%", i, reported)
+		}
+	}
+	if constraintCost.Load() <= 0 {
+		t.Error("a timed proof didn't update the proving estimate")
+	}
+}
+
+func TestReadProvingKeyRoundTrip(t *testing.T) {
+	p, _ := setup(t)
+	var encoded bytes.Buffer
+	if _, writeErr := p.provingKey.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, readErr := ReadProvingKey(bytes.NewReader(encoded.Bytes())); readErr != nil {
+		t.Errorf("reading an encoded key: %v", readErr)
+	}
+	if _, readErr := ReadProvingKey(bytes.NewReader([]byte("garbage"))); readErr == nil {
+		t.Error("garbage accepted as a proving key")
+	}
+}
+
+func TestCommitment(t *testing.T) {
+	commitment, commitErr := Commitment(secret.FromInt64(3))
+	if commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	if commitment != "9" {
+		t.Errorf("commitment = %s, want 9", commitment)
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	for _, acceleration := range []string{"", AccelerationCPU, AccelerationGPU} {
+		backend, backendErr := NewBackend(acceleration)
+		if backendErr != nil {
+			t.Errorf("NewBackend(%q): %v", acceleration, backendErr)
+			continue
+		}
+		if acceleration != AccelerationGPU && backend.Name() != AccelerationCPU {
+			t.Errorf("NewBackend(%q).Name() = %s, want cpu", acceleration, backend.Name())
+		}
+	}
+	if _, backendErr := NewBackend("tpu"); backendErr == nil {
+		t.Error("unknown acceleration accepted")
+	}
+}
+
+func TestBackendProve(t *testing.T) {
+	p, verifyingKey := setup(t)
+	backend, _ := NewBackend(AccelerationCPU)
+	fullWitness, witnessErr := circuit.NewWitness(secret.FromInt64(5), big.NewInt(8))
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	proof, proveErr := backend.Prove(context.Background(), p.ccs, p.provingKey, fullWitness)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	publicWitness, _ := fullWitness.Public()
+	if verifyErr := groth16.Verify(proof, verifyingKey, publicWitness); verifyErr != nil {
+		t.Errorf("backend proof does not verify: %v", verifyErr)
+	}
+}
+
+func TestDeviceProveVerifies(t *testing.T) {
+	ccs, compileErr := circuit.CompileDevice()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := NewDevice(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	nonce := big.NewInt(424242)
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), "phone-1", nonce)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	commitment, commitErr := DeviceCommitment(secret.FromInt64(12345), "phone-1")
+	if commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	publicWitness, witnessErr := circuit.NewDevicePublicWitness(commitment, "phone-1", nonce)
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if verifyErr := groth16.Verify(proof, verifyingKey, publicWitness); verifyErr != nil {
+		t.Errorf("device proof does not verify: %v", verifyErr)
+	}
+	if _, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), "", nonce); proveErr == nil {
+		t.Error("proved without a device ID")
+	}
+}
+
+func TestComposedProveVerifies(t *testing.T) {
+	composition := circuit.Composition{Commitment: circuit.CommitmentMiMC, BindNonce: true, Range: "1000..999999"}
+	ccs, compileErr := composition.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := NewComposed(context.Background(), provingKey, composition)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	nonce := big.NewInt(424242)
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), nonce)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	commitment, _ := composition.GenerateCommitment(secret.FromInt64(12345))
+	publicWitness, witnessErr := circuit.NewPublicWitness(commitment, nonce)
+	if witnessErr != nil {
+		t.Fatal(witnessErr)
+	}
+	if verifyErr := groth16.Verify(proof, verifyingKey, publicWitness); verifyErr != nil {
+		t.Errorf("composed proof does not verify: %v", verifyErr)
+	}
+	if _, rangeErr := p.Prove(context.Background(), secret.FromInt64(7), nonce); !errors.Is(rangeErr, circuit.ErrSecretOutOfRange) {
+		t.Errorf("proving an out-of-range secret = %v, want ErrSecretOutOfRange", rangeErr)
+	}
+}
+
+func TestEncodeProof(t *testing.T) {
+	p, verifyingKey := setup(t)
+	nonce := big.NewInt(7)
+	proof, _ := p.Prove(context.Background(), secret.FromInt64(12345), nonce)
+	first, encodeErr := EncodeProof(proof)
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	// The pooled buffer is reused, so earlier results must not change under later encodings
+	second, _ := EncodeProof(proof)
+	var want bytes.Buffer
+	proof.WriteTo(&want)
+	if !bytes.Equal(first, want.Bytes()) || !bytes.Equal(second, want.Bytes()) {
+		t.Error("EncodeProof differs from proof.WriteTo")
+	}
+	decoded := groth16.NewProof(circuit.Curve)
+	decoded.ReadFrom(bytes.NewReader(first))
+	publicWitness, _ := circuit.NewPublicWitness("152399025", nonce)
+	if verifyErr := groth16.Verify(decoded, verifyingKey, publicWitness); verifyErr != nil {
+		t.Errorf("encoded proof doesn't verify: %v", verifyErr)
+	}
+}
+
+// BenchmarkEncodeProof compares encoding proofs through the buffer pool with a fresh buffer each time
+func BenchmarkEncodeProof(b *testing.B) {
+	ccs, _ := circuit.Compile()
+	provingKey, _, _ := groth16.Setup(ccs)
+	p, _ := New(context.Background(), provingKey)
+	proof, _ := p.Prove(context.Background(), secret.FromInt64(12345), big.NewInt(7))
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			EncodeProof(proof)
+		}
+	})
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			var encoded bytes.Buffer
+			proof.WriteTo(&encoded)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Names of the key-derivation functions in stored parameters
+const (
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+	KDFPBKDF2   = "pbkdf2-sha256" // KDFPBKDF2 is PBKDF2 with HMAC-SHA256
+)
+
+// Bounds on Argon2id parameters accepted at registration, so a stored record can't make
+// every later login derive with absurd cost or with settings too weak to be worth it
+const (
+	MinArgon2Memory = 8 << 10 // 8 MiB, in KiB
+	MaxArgon2Memory = 4 << 20 // 4 GiB, in KiB
+	MaxArgon2Time   = 64      // passes over memory
+	MinSaltLength   = 16      // bytes
+	argon2KeyLength = 32      // bytes, reduced into the scalar field afterwards
+)
+
+// Bounds on scrypt and PBKDF2 parameters, for the same reason
+const (
+	MinScryptCost       = 1 << 14 // N, as in RFC 7914's interactive example
+	MaxScryptCost       = 1 << 20 // N
+	MaxScryptBlockSize  = 16      // r; with MaxScryptCost, 2 GiB of memory
+	MaxScryptLanes      = 16      // p
+	MinPBKDF2Iterations = 100_000
+	MaxPBKDF2Iterations = 10_000_000
+	MaxKDFNameLength    = 64
+)
+
+// KDFParams describes how a low-entropy secret such as a PIN or password is stretched before
+// it enters the circuit. They are public and stored next to the commitment; the salt is kept
+// beside them in the user record. Only the costs of Algorithm are set. Parameters taken from a
+// registry name the parameter set and its version, so a prover can tell which one it derives with.
+type KDFParams struct {
+	Algorithm   string `json:"algorithm"`             // Algorithm is KDFArgon2id, KDFScrypt or KDFPBKDF2
+	Name        string `json:"name,omitempty"`        // Name is the registered parameter set the parameters are, if any
+	Version     uint32 `json:"version,omitempty"`     // Version is the version of the named set, from 1
+	Memory      uint32 `json:"memory_kib,omitempty"`  // Memory is the Argon2 memory cost in KiB
+	Time        uint32 `json:"time,omitempty"`        // Time is the number of Argon2 passes over memory
+	Parallelism uint8  `json:"parallelism,omitempty"` // Parallelism is the number of Argon2 lanes, or scrypt's p
+	Cost        uint32 `json:"cost,omitempty"`        // Cost is scrypt's N, a power of two
+	BlockSize   uint32 `json:"block_size,omitempty"`  // BlockSize is scrypt's r
+	Iterations  uint32 `json:"iterations,omitempty"`  // Iterations is the PBKDF2 iteration count
+}
+
+// DefaultArgon2idParams returns the RFC 9106 second recommended option (64 MiB, 3 passes, 4 lanes)
+func DefaultArgon2idParams() KDFParams {
+	return KDFParams{Algorithm: KDFArgon2id, Memory: 64 << 10, Time: 3, Parallelism: 4}
+}
+
+// DefaultKDFRegistry returns a parameter set for each supported algorithm, Argon2id first: the
+// RFC 9106 option of DefaultArgon2idParams, scrypt with N=2^15, r=8, p=1 and PBKDF2-HMAC-SHA256
+// with 600,000 iterations, as OWASP recommends
+func DefaultKDFRegistry() []KDFParams {
+	argon2id := DefaultArgon2idParams()
+	argon2id.Name, argon2id.Version = KDFArgon2id, 1
+	return []KDFParams{
+		argon2id,
+		{Algorithm: KDFScrypt, Name: KDFScrypt, Version: 1, Cost: 1 << 15, BlockSize: 8, Parallelism: 1},
+		{Algorithm: KDFPBKDF2, Name: KDFPBKDF2, Version: 1, Iterations: 600_000},
+	}
+}
+
+// Validate checks that the parameters name a supported KDF with costs inside the accepted bounds
+func (p KDFParams) Validate() error {
+	switch {
+	case len(p.Name) > MaxKDFNameLength:
+		return fmt.Errorf("kdf name must be at most %d characters", MaxKDFNameLength)
+	case p.Name != "" && p.Version == 0:
+		return fmt.Errorf("kdf parameter set %q needs a version", p.Name)
+	case p.Name == "" && p.Version != 0:
+		return errors.New("kdf version needs the name of its parameter set")
+	}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		return p.validateArgon2id()
+	case KDFScrypt:
+		return p.validateScrypt()
+	case KDFPBKDF2:
+		return p.validatePBKDF2()
+	}
+	return fmt.Errorf("unsupported kdf algorithm %q", p.Algorithm)
+}
+
+// validateArgon2id checks the costs of Argon2id parameters
+func (p KDFParams) validateArgon2id() error {
+	if p.Memory < MinArgon2Memory || p.Memory > MaxArgon2Memory {
+		return fmt.Errorf("argon2id memory must be between %d and %d KiB", MinArgon2Memory, MaxArgon2Memory)
+	}
+	if p.Time == 0 || p.Time > MaxArgon2Time {
+		return fmt.Errorf("argon2id time must be between 1 and %d", MaxArgon2Time)
+	}
+	if p.Parallelism == 0 {
+		return errors.New("argon2id parallelism must be at least 1")
+	}
+	if p.Cost != 0 || p.BlockSize != 0 || p.Iterations != 0 {
+		return errors.New("argon2id takes no cost, block_size or iterations")
+	}
+	return nil
+}
+
+// validateScrypt checks the costs of scrypt parameters
+func (p KDFParams) validateScrypt() error {
+	if p.Cost < MinScryptCost || p.Cost > MaxScryptCost || p.Cost&(p.Cost-1) != 0 {
+		return fmt.Errorf("scrypt cost must be a power of two between %d and %d", MinScryptCost, MaxScryptCost)
+	}
+	if p.BlockSize == 0 || p.BlockSize > MaxScryptBlockSize {
+		return fmt.Errorf("scrypt block_size must be between 1 and %d", MaxScryptBlockSize)
+	}
+	if p.Parallelism == 0 || p.Parallelism > MaxScryptLanes {
+		return fmt.Errorf("scrypt parallelism must be between 1 and %d", MaxScryptLanes)
+	}
+	if p.Memory != 0 || p.Time != 0 || p.Iterations != 0 {
+		return errors.New("scrypt takes no memory_kib, time or iterations")
+	}
+	return nil
+}
+
+// validatePBKDF2 checks the iteration count of PBKDF2 parameters
+func (p KDFParams) validatePBKDF2() error {
+	if p.Iterations < MinPBKDF2Iterations || p.Iterations > MaxPBKDF2Iterations {
+		return fmt.Errorf("%s iterations must be between %d and %d", KDFPBKDF2, MinPBKDF2Iterations, MaxPBKDF2Iterations)
+	}
+	if p.Memory != 0 || p.Time != 0 || p.Parallelism != 0 || p.Cost != 0 || p.BlockSize != 0 {
+		return fmt.Errorf("%s takes only iterations", KDFPBKDF2)
+	}
+	return nil
+}
+
+// SameCosts reports whether two parameter sets derive the same keys, whatever they are named
+func (p KDFParams) SameCosts(other KDFParams) bool {
+	p.Name, p.Version, other.Name, other.Version = "", 0, "", 0
+	return p == other
+}
+
+// Derive stretches password with the parameters and salt and reduces the output into a field
+// element secret. The password slice is wiped before returning.
+func Derive(password, salt []byte, params KDFParams) (*Buffer, error) {
+	defer WipeBytes(password)
+	if validateErr := params.Validate(); validateErr != nil {
+		return nil, validateErr
+	}
+	if len(salt) < MinSaltLength {
+		return nil, fmt.Errorf("kdf salt must be at least %d bytes", MinSaltLength)
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password is empty")
+	}
+	var key []byte
+	switch params.Algorithm {
+	case KDFScrypt:
+		var keyErr error
+		if key, keyErr = scrypt.Key(password, salt, int(params.Cost), int(params.BlockSize), int(params.Parallelism), argon2KeyLength); keyErr != nil {
+			return nil, keyErr
+		}
+	case KDFPBKDF2:
+		key = pbkdf2.Key(password, salt, int(params.Iterations), argon2KeyLength, sha256.New)
+	default:
+		key = argon2.IDKey(password, salt, params.Time, params.Memory, params.Parallelism, argon2KeyLength)
+	}
+	return FromFieldBytes(key), nil
+}
@@ -0,0 +1,205 @@
+// Package secret holds user secrets in wipeable memory.
+//
+// Go strings are immutable and get copied freely, so a secret that ever becomes a
+// string can't be reliably erased. A Buffer keeps the secret in a byte slice that
+// callers zero as soon as the witness has been built, and Parse reads decimal digits
+// straight from bytes so no string copy is created along the way.
+//
+// Integer secrets lie in [MinInt, MaxInt]. Negative secrets are refused because -s has the same
+// square commitment as s, and zero because its commitment is zero; commitments are computed in
+// the scalar field, so no secret in the domain overflows.
+package secret
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+)
+
+// The domain of integer secrets
+const (
+	MinInt = 1
+	MaxInt = math.MaxInt64
+)
+
+// ErrInvalid is returned when the input is not a decimal integer
+var ErrInvalid = errors.New("secret must be a decimal integer")
+
+// ErrOutOfRange is returned for an integer secret outside [MinInt, MaxInt]
+var ErrOutOfRange = fmt.Errorf("secret must be an integer between %d and %d", MinInt, int64(MaxInt))
+
+// ErrZeroed is returned for a secret that is empty or has already been zeroed
+var ErrZeroed = errors.New("secret is empty or already zeroed")
+
+// Buffer holds a secret either as an integer, in 8 big-endian two's-complement bytes, or
+// as a field element already reduced into the circuit's scalar field, in 32 big-endian bytes
+type Buffer struct {
+	data  []byte
+	field bool
+}
+
+// FromFieldBytes reduces arbitrary bytes, such as a KDF output, into a field element secret.
+// The input is wiped once it has been absorbed.
+func FromFieldBytes(raw []byte) *Buffer {
+	defer WipeBytes(raw)
+	var element fr.Element
+	element.SetBytes(raw)
+	encoded := element.Bytes()
+	element.SetZero()
+
+	b := &Buffer{data: make([]byte, fr.Bytes), field: true}
+	copy(b.data, encoded[:])
+	WipeBytes(encoded[:])
+	return b
+}
+
+// FromInt64 copies an integer secret into a new buffer. A value outside [MinInt, MaxInt] is kept
+// but fails Check, so it never makes it into a commitment or witness.
+func FromInt64(value int64) *Buffer {
+	b := &Buffer{data: make([]byte, 8)}
+	binary.BigEndian.PutUint64(b.data, uint64(value))
+	return b
+}
+
+// Parse reads an optionally signed decimal integer from ASCII digits. Input that isn't a decimal
+// integer yields ErrInvalid, and an integer outside [MinInt, MaxInt], however long, ErrOutOfRange.
+// The input slice is not modified; callers should zero it themselves once parsed.
+func Parse(digits []byte) (*Buffer, error) {
+	negative := false
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return nil, ErrInvalid
+	}
+
+	// Accumulation stops past MaxInt, so overlong input can't wrap around into the domain
+	var magnitude uint64
+	overflow := false
+	for _, digit := range digits {
+		if digit < '0' || digit > '9' {
+			return nil, ErrInvalid
+		}
+		overflow = overflow || magnitude > (MaxInt-uint64(digit-'0'))/10
+		if !overflow {
+			magnitude = magnitude*10 + uint64(digit-'0')
+		}
+	}
+	if overflow || magnitude < MinInt || negative {
+		magnitude = 0
+		return nil, ErrOutOfRange
+	}
+
+	b := &Buffer{data: make([]byte, 8)}
+	binary.BigEndian.PutUint64(b.data, magnitude)
+	magnitude = 0
+	return b, nil
+}
+
+// UnmarshalJSON accepts the secret as a JSON string or number without materializing a Go string
+func (b *Buffer) UnmarshalJSON(data []byte) error {
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		data = data[1 : len(data)-1]
+	}
+	parsed, parseErr := Parse(data)
+	if parseErr != nil {
+		return parseErr
+	}
+	b.data, b.field = parsed.data, false
+	return nil
+}
+
+// MarshalJSON writes the secret as a JSON string built directly into a byte slice
+func (b *Buffer) MarshalJSON() ([]byte, error) {
+	if !b.Valid() {
+		return nil, errors.New("secret has been zeroed")
+	}
+	if b.field {
+		return nil, errors.New("derived field element secrets are never serialized")
+	}
+	encoded := make([]byte, 0, 22)
+	encoded = append(encoded, '"')
+	encoded = strconv.AppendInt(encoded, b.Int64(), 10)
+	return append(encoded, '"'), nil
+}
+
+// Int64 returns an integer secret for arithmetic on the caller's stack
+func (b *Buffer) Int64() int64 {
+	if b == nil || b.field || len(b.data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b.data))
+}
+
+// IsFieldElement reports whether the secret was derived into the scalar field rather than parsed as an integer
+func (b *Buffer) IsFieldElement() bool {
+	return b != nil && b.field
+}
+
+// Element writes a field element secret into dst; callers zero dst after use
+func (b *Buffer) Element(dst *fr.Element) {
+	if !b.IsFieldElement() || len(b.data) != fr.Bytes {
+		dst.SetZero()
+		return
+	}
+	dst.SetBytes(b.data)
+}
+
+// Check returns ErrZeroed for an empty or zeroed buffer and ErrOutOfRange for an integer secret
+// outside [MinInt, MaxInt]; field element secrets are always in range
+func (b *Buffer) Check() error {
+	switch {
+	case !b.Valid():
+		return ErrZeroed
+	case !b.field && b.Int64() < MinInt:
+		return ErrOutOfRange
+	}
+	return nil
+}
+
+// Valid reports whether the buffer holds a secret that has not been zeroed
+func (b *Buffer) Valid() bool {
+	if b == nil {
+		return false
+	}
+	if b.field {
+		return len(b.data) == fr.Bytes
+	}
+	return len(b.data) == 8
+}
+
+// Zero overwrites the secret; the buffer is unusable afterwards
+func (b *Buffer) Zero() {
+	if b == nil {
+		return
+	}
+	for i := range b.data {
+		b.data[i] = 0
+	}
+	b.data = nil
+}
+
+// WipeBytes zeroes a byte slice that held secret material, such as the digits passed to Parse
+func WipeBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// WipeInt zeroes the words backing a big.Int that held secret material
+func WipeInt(value *big.Int) {
+	if value == nil {
+		return
+	}
+	words := value.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	value.SetInt64(0)
+}
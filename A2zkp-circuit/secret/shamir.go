@@ -0,0 +1,154 @@
+package secret
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+)
+
+// MaxShares bounds how many shares a secret is split into
+const MaxShares = 255
+
+// ErrShare is returned for a malformed share or an unusable set of them
+var ErrShare = errors.New("invalid secret share")
+
+// Share is one of the points a secret is split into by Split: a random polynomial of the scalar
+// field with the secret as constant term, evaluated at Index. Value is a field element secret the
+// circuit can prove knowledge of like any other.
+type Share struct {
+	Index int     // Index is the evaluation point, from 1 to MaxShares
+	Value *Buffer // Value is the polynomial at Index
+}
+
+// Split divides a secret into n shares, any threshold of which recover it with Combine while fewer
+// reveal nothing about it
+func Split(s *Buffer, n, threshold int) ([]Share, error) {
+	if checkErr := s.Check(); checkErr != nil {
+		return nil, checkErr
+	}
+	switch {
+	case threshold < 1 || threshold > n || n > MaxShares:
+		return nil, fmt.Errorf("%w: need 1 <= threshold <= shares <= %d, got %d of %d", ErrShare, MaxShares, threshold, n)
+	}
+	coefficients := make([]fr.Element, threshold)
+	defer func() {
+		for i := range coefficients {
+			coefficients[i].SetZero()
+		}
+	}()
+	if s.IsFieldElement() {
+		s.Element(&coefficients[0])
+	} else {
+		coefficients[0].SetInt64(s.Int64())
+	}
+	for i := 1; i < threshold; i++ {
+		if _, randErr := coefficients[i].SetRandom(); randErr != nil {
+			return nil, randErr
+		}
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		// Horner's rule for the polynomial at x = i+1
+		var x, y fr.Element
+		x.SetInt64(int64(i + 1))
+		for j := threshold - 1; j >= 0; j-- {
+			y.Mul(&y, &x).Add(&y, &coefficients[j])
+		}
+		shares[i] = Share{Index: i + 1, Value: fromElement(&y)}
+		y.SetZero()
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from threshold or more distinct shares of a Split by Lagrange
+// interpolation at zero. Shares of another secret, or too few, yield a wrong secret rather than an error.
+func Combine(shares []Share) (*Buffer, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%w: no shares", ErrShare)
+	}
+	seen := make(map[int]bool, len(shares))
+	for _, share := range shares {
+		if share.Index < 1 || share.Index > MaxShares || seen[share.Index] || !share.Value.IsFieldElement() {
+			return nil, fmt.Errorf("%w: share %d is missing, repeated or out of range", ErrShare, share.Index)
+		}
+		seen[share.Index] = true
+	}
+
+	var result fr.Element
+	for i, share := range shares {
+		// The Lagrange basis polynomial of share i at zero is Π x_j / (x_j - x_i) over j != i
+		var numerator, denominator, xi fr.Element
+		numerator.SetOne()
+		denominator.SetOne()
+		xi.SetInt64(int64(share.Index))
+		for j, other := range shares {
+			if j == i {
+				continue
+			}
+			var xj, difference fr.Element
+			xj.SetInt64(int64(other.Index))
+			numerator.Mul(&numerator, &xj)
+			difference.Sub(&xj, &xi)
+			denominator.Mul(&denominator, &difference)
+		}
+		var value, term fr.Element
+		share.Value.Element(&value)
+		term.Div(&numerator, &denominator).Mul(&term, &value)
+		result.Add(&result, &term)
+		value.SetZero()
+		term.SetZero()
+	}
+	defer result.SetZero()
+	return fromElement(&result), nil
+}
+
+// fromElement copies a field element into a new field element secret
+func fromElement(element *fr.Element) *Buffer {
+	encoded := element.Bytes()
+	b := &Buffer{data: make([]byte, fr.Bytes), field: true}
+	copy(b.data, encoded[:])
+	WipeBytes(encoded[:])
+	return b
+}
+
+// Encode writes a share as its index, a dash and its value in hex, e.g. "3-1f0c…", so it can be
+// printed or stored as a recovery code. Callers wipe the result once it has been handed over.
+func (s Share) Encode() []byte {
+	encoded := strconv.AppendInt(nil, int64(s.Index), 10)
+	encoded = append(encoded, '-')
+	return hex.AppendEncode(encoded, s.Value.data)
+}
+
+// ParseShare reads a share written by Encode. The input is not modified.
+func ParseShare(text []byte) (Share, error) {
+	dash := -1
+	for i, c := range text {
+		if c == '-' {
+			dash = i
+			break
+		}
+	}
+	if dash < 1 || len(text)-dash-1 != 2*fr.Bytes {
+		return Share{}, fmt.Errorf("%w: want <index>-<%d hex digits>", ErrShare, 2*fr.Bytes)
+	}
+	index, indexErr := strconv.Atoi(string(text[:dash]))
+	if indexErr != nil || index < 1 || index > MaxShares {
+		return Share{}, fmt.Errorf("%w: index must be 1 to %d", ErrShare, MaxShares)
+	}
+	value := &Buffer{data: make([]byte, fr.Bytes), field: true}
+	if _, decodeErr := hex.Decode(value.data, text[dash+1:]); decodeErr != nil {
+		value.Zero()
+		return Share{}, fmt.Errorf("%w: %v", ErrShare, decodeErr)
+	}
+	var element fr.Element
+	defer element.SetZero()
+	if element.SetBytesCanonical(value.data) != nil {
+		value.Zero()
+		return Share{}, fmt.Errorf("%w: value is not a scalar field element", ErrShare)
+	}
+	return Share{Index: index, Value: value}, nil
+}
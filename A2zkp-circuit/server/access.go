@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// accessRule is an AccessRule with its CIDRs parsed
+type accessRule struct {
+	routes string
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+}
+
+// accessList is access_control parsed, swapped whole by Reload
+type accessList struct {
+	rules []accessRule
+}
+
+// parseAccessControl checks and parses the access_control rules
+func parseAccessControl(rules []AccessRule) (*accessList, error) {
+	list := &accessList{}
+	for i, rule := range rules {
+		field := fmt.Sprintf("access_control[%d]", i)
+		switch {
+		case !validRouteGroup(rule.Routes):
+			return nil, fmt.Errorf("%s: routes %q is not api, admin, metrics or a path prefix", field, rule.Routes)
+		case len(rule.Allow) == 0 && len(rule.Deny) == 0:
+			return nil, fmt.Errorf("%s: needs allow or deny", field)
+		}
+		allow, allowErr := parsePrefixes(field+".allow", rule.Allow)
+		if allowErr != nil {
+			return nil, allowErr
+		}
+		deny, denyErr := parsePrefixes(field+".deny", rule.Deny)
+		if denyErr != nil {
+			return nil, denyErr
+		}
+		list.rules = append(list.rules, accessRule{routes: rule.Routes, allow: allow, deny: deny})
+	}
+	return list, nil
+}
+
+// validRouteGroup reports whether routes names a group of routes: api, admin, metrics or a path prefix
+func validRouteGroup(routes string) bool {
+	return routes == serveAPI || routes == serveAdmin || routes == serveMetrics || strings.HasPrefix(routes, "/")
+}
+
+// covers reports whether the rule applies to a route pattern
+func (rule accessRule) covers(pattern string) bool {
+	path := pattern
+	if _, afterMethod, hasMethod := strings.Cut(pattern, " "); hasMethod {
+		path = afterMethod
+	}
+	metrics := path == "/metrics" || strings.HasPrefix(path, "/debug/")
+	switch rule.routes {
+	case serveAdmin:
+		return strings.HasPrefix(path, "/admin/")
+	case serveMetrics:
+		return metrics
+	case serveAPI:
+		return !metrics && path != "/healthz" && path != "/readyz" && !strings.HasPrefix(path, "/admin/")
+	default:
+		return strings.HasPrefix(path, rule.routes)
+	}
+}
+
+// permits reports whether a client may call a route: every rule covering it must let the address
+// through. An address that isn't an IP, a Unix socket peer without X-Forwarded-For, passes deny
+// lists and fails allow lists.
+func (l *accessList) permits(pattern, clientAddr string) bool {
+	addr, parseErr := netip.ParseAddr(clientAddr)
+	for _, rule := range l.rules {
+		if !rule.covers(pattern) {
+			continue
+		}
+		if parseErr == nil && containsAddr(rule.deny, addr) {
+			return false
+		}
+		if len(rule.allow) > 0 && (parseErr != nil || !containsAddr(rule.allow, addr)) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAddr reports whether addr is in one of prefixes
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// guard stores the client address and country in the request context and turns the request away unless
+// access_control lets that address call the route
+func (s *Server) guard(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientAddr := s.clientAddr(r)
+		if !s.access.Load().permits(pattern, clientAddr) {
+			writeProblem(w, http.StatusForbidden, codeForbidden, "Requests from this address are not allowed here")
+			return
+		}
+		ctx := context.WithValue(r.Context(), clientAddrKey{}, clientAddr)
+		next(w, r.WithContext(context.WithValue(ctx, clientCountryKey{}, s.clientCountry(r))))
+	}
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/store"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Anomaly is a brute-force pattern found in the failed logins of the sliding window
+type Anomaly struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"` // Kind is "brute_force", "password_spray" or "credential_stuffing"
+	// UserName is the user a brute_force targets
+	UserName string `json:"user_name,omitempty"`
+	// ClientAddrs are the addresses the failures came from: the sprayer, or those guessing one user's secret
+	ClientAddrs   []string  `json:"client_addrs,omitempty"`
+	Failures      int       `json:"failures"`                 // Failures counts the failed logins behind the finding
+	Attempts      int       `json:"attempts,omitempty"`       // Attempts counts every login of the window, for credential_stuffing
+	DistinctUsers int       `json:"distinct_users,omitempty"` // DistinctUsers counts the users a password_spray failed for
+	WindowStart   time.Time `json:"window_start"`
+	DetectedAt    time.Time `json:"detected_at"`
+}
+
+// AnomalyList is the response of GET /admin/anomalies, newest first
+type AnomalyList struct {
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// anomalyDetectedEvent is the webhook event type announcing an Anomaly
+const anomalyDetectedEvent = "anomaly.detected"
+
+// maxTrackedFailures bounds the failures remembered per user or address; counts saturate there
+const maxTrackedFailures = 1000
+
+// attemptBuckets is how many slices of the window the login counts of credential_stuffing are kept in
+const attemptBuckets = 60
+
+// failure is one failed login
+type failure struct {
+	at       time.Time
+	userName string
+	addr     string
+}
+
+// attemptBucket counts the logins of one slice of the window
+type attemptBucket struct {
+	start    time.Time
+	attempts int
+	failures int
+}
+
+// anomalyDetector counts login outcomes per user, per client address and overall over a sliding
+// window and reports each pattern once per window, when it crosses its threshold. In stateless mode
+// the counts, reports and recent list live in Redis, so the logins of every replica add up.
+type anomalyDetector struct {
+	cfg    AnomalyConfig
+	notify func(context.Context, Anomaly) // notify is called with every new anomaly and the context of the login that completed it, outside the lock
+	now    func() time.Time
+	shared *sharedState // shared is nil outside stateless mode
+
+	mu        sync.Mutex
+	users     map[string][]failure // users holds each user's failures within the window, oldest first
+	addrs     map[string][]failure // addrs holds each client address's failures within the window
+	buckets   []attemptBucket      // buckets count every login per slice of the window, oldest first
+	flagged   map[string]time.Time // flagged is when each kind and subject was last reported
+	recent    []Anomaly            // recent holds the latest anomalies, newest last
+	lastSweep time.Time
+}
+
+// newAnomalyDetector creates a detector for cfg; it returns nil when detection is disabled
+func newAnomalyDetector(cfg AnomalyConfig, notify func(context.Context, Anomaly), shared *sharedState) *anomalyDetector {
+	if cfg.Window.Duration <= 0 {
+		return nil
+	}
+	return &anomalyDetector{
+		cfg:     cfg,
+		notify:  notify,
+		now:     time.Now,
+		shared:  shared,
+		users:   make(map[string][]failure),
+		addrs:   make(map[string][]failure),
+		flagged: make(map[string]time.Time),
+	}
+}
+
+// record counts one login outcome and reports the anomalies it completes; a nil receiver ignores it
+func (d *anomalyDetector) record(ctx context.Context, addr, userName string, failed bool) {
+	if d == nil {
+		return
+	}
+	var found []Anomaly
+	if d.shared != nil {
+		var recordErr error
+		if found, recordErr = d.recordShared(ctx, addr, userName, failed); recordErr != nil {
+			logf(ctx, "Anomaly detection failed to count a login: %v", recordErr)
+		}
+	} else {
+		found = d.recordLocal(addr, userName, failed)
+	}
+	for _, anomaly := range found {
+		d.notify(ctx, anomaly)
+	}
+}
+
+// recordLocal counts a login in memory and returns the anomalies it completes
+func (d *anomalyDetector) recordLocal(addr, userName string, failed bool) []Anomaly {
+	now := d.now()
+	since := now.Add(-d.cfg.Window.Duration)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.countAttempt(now, failed)
+	var userFailures, addrFailures []failure
+	if failed {
+		attempt := failure{at: now, userName: userName, addr: addr}
+		userFailures = appendFailure(d.users[userName], attempt, since)
+		addrFailures = appendFailure(d.addrs[addr], attempt, since)
+		d.users[userName], d.addrs[addr] = userFailures, addrFailures
+	}
+	attempts, failures, windowStart := d.windowTotals(since)
+	var found []Anomaly
+	for _, anomaly := range d.patterns(userName, addr, userFailures, addrFailures, attempts, failures, windowStart) {
+		found = d.flag(found, now, anomaly)
+	}
+	if now.Sub(d.lastSweep) > d.cfg.Window.Duration {
+		d.sweep(now, since)
+	}
+	return found
+}
+
+// patterns lists the anomalies the counts of the window show, whether reported already or not:
+// the failures of userName and of addr, and the logins and failures of every user
+func (d *anomalyDetector) patterns(userName, addr string, userFailures, addrFailures []failure, attempts, failures int, windowStart time.Time) []Anomaly {
+	var found []Anomaly
+	if d.cfg.UserFailures > 0 && len(userFailures) >= d.cfg.UserFailures {
+		found = append(found, Anomaly{
+			Kind:        "brute_force",
+			UserName:    userName,
+			ClientAddrs: distinct(userFailures, func(f failure) string { return f.addr }),
+			Failures:    len(userFailures),
+			WindowStart: userFailures[0].at,
+		})
+	}
+	if users := distinct(addrFailures, func(f failure) string { return f.userName }); d.cfg.SprayUsers > 0 && len(users) >= d.cfg.SprayUsers {
+		found = append(found, Anomaly{
+			Kind:          "password_spray",
+			ClientAddrs:   []string{addr},
+			Failures:      len(addrFailures),
+			DistinctUsers: len(users),
+			WindowStart:   addrFailures[0].at,
+		})
+	}
+	if d.cfg.StuffingMinAttempts > 0 && attempts >= d.cfg.StuffingMinAttempts && float64(failures) >= d.cfg.StuffingFailureRatio*float64(attempts) {
+		found = append(found, Anomaly{Kind: "credential_stuffing", Failures: failures, Attempts: attempts, WindowStart: windowStart})
+	}
+	return found
+}
+
+// appendFailure drops the failures older than since and adds attempt, keeping at most maxTrackedFailures
+func appendFailure(failures []failure, attempt failure, since time.Time) []failure {
+	kept := slices.DeleteFunc(failures, func(f failure) bool { return f.at.Before(since) })
+	if len(kept) == maxTrackedFailures {
+		kept = slices.Delete(kept, 0, 1)
+	}
+	return append(kept, attempt)
+}
+
+// distinct lists the different values field takes over failures, sorted
+func distinct(failures []failure, field func(failure) string) []string {
+	values := make([]string, 0, len(failures))
+	for _, f := range failures {
+		values = append(values, field(f))
+	}
+	slices.Sort(values)
+	return slices.Compact(values)
+}
+
+// countAttempt adds a login to the bucket of the current slice of the window
+func (d *anomalyDetector) countAttempt(now time.Time, failed bool) {
+	width := d.cfg.Window.Duration / attemptBuckets
+	if last := len(d.buckets) - 1; last < 0 || now.Sub(d.buckets[last].start) >= width {
+		d.buckets = append(d.buckets, attemptBucket{start: now})
+	}
+	bucket := &d.buckets[len(d.buckets)-1]
+	bucket.attempts++
+	if failed {
+		bucket.failures++
+	}
+}
+
+// windowTotals drops the buckets older than since and sums the rest
+func (d *anomalyDetector) windowTotals(since time.Time) (attempts, failures int, windowStart time.Time) {
+	d.buckets = slices.DeleteFunc(d.buckets, func(b attemptBucket) bool { return b.start.Before(since) })
+	for _, bucket := range d.buckets {
+		attempts += bucket.attempts
+		failures += bucket.failures
+	}
+	if len(d.buckets) > 0 {
+		windowStart = d.buckets[0].start
+	}
+	return attempts, failures, windowStart
+}
+
+// flag adds anomaly to found and to the recent list unless its kind and subject were already
+// reported within the window
+func (d *anomalyDetector) flag(found []Anomaly, now time.Time, anomaly Anomaly) []Anomaly {
+	key := anomaly.Kind + "\x00" + anomaly.subject()
+	if last, reported := d.flagged[key]; reported && now.Sub(last) < d.cfg.Window.Duration {
+		return found
+	}
+	anomalyID, idErr := randomToken()
+	if idErr != nil {
+		return found
+	}
+	d.flagged[key] = now
+	anomaly.ID, anomaly.DetectedAt = anomalyID, now
+	d.recent = append(d.recent, anomaly)
+	if retained := max(d.cfg.Retained, 1); len(d.recent) > retained {
+		d.recent = slices.Delete(d.recent, 0, len(d.recent)-retained)
+	}
+	return append(found, anomaly)
+}
+
+// subject is what an anomaly is about: the sprayer's address, the user a brute_force targets, or
+// nothing for credential_stuffing
+func (a Anomaly) subject() string {
+	if a.Kind == "password_spray" {
+		return a.ClientAddrs[0]
+	}
+	return a.UserName
+}
+
+// sweep forgets users, addresses and reports with nothing left in the window
+func (d *anomalyDetector) sweep(now, since time.Time) {
+	for _, tracked := range []map[string][]failure{d.users, d.addrs} {
+		for key, failures := range tracked {
+			if failures[len(failures)-1].at.Before(since) {
+				delete(tracked, key)
+			}
+		}
+	}
+	for key, at := range d.flagged {
+		if at.Before(since) {
+			delete(d.flagged, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// list returns the retained anomalies, newest first
+func (d *anomalyDetector) list(ctx context.Context) ([]Anomaly, error) {
+	if d.shared != nil {
+		return d.listShared(ctx)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	anomalies := slices.Clone(d.recent)
+	slices.Reverse(anomalies)
+	return anomalies, nil
+}
+
+// recordShared counts a login in Redis and returns the anomalies it completes. Failures are kept
+// per user and per address as sorted sets scored by their time, as "<nonce> <address or user>",
+// and the logins of each slice of the window as fields of one hash.
+func (d *anomalyDetector) recordShared(ctx context.Context, addr, userName string, failed bool) ([]Anomaly, error) {
+	now := d.now()
+	window := d.cfg.Window.Duration
+	since := now.Add(-window)
+	sinceMillis := strconv.FormatInt(since.UnixMilli(), 10)
+	nonce, nonceErr := randomToken()
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+	failureKeys := [][2]string{{d.shared.key("anomaly-user", userName), addr}, {d.shared.key("anomaly-addr", addr), userName}}
+	bucketsKey := d.shared.key("anomaly-buckets")
+	bucket := strconv.FormatInt(now.Truncate(window/attemptBuckets).UnixMilli(), 10)
+	var failureRanges []*redis.ZSliceCmd
+	var buckets *redis.MapStringStringCmd
+	_, countErr := d.shared.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if failed {
+			for _, failureKey := range failureKeys {
+				pipe.ZAdd(ctx, failureKey[0], redis.Z{Score: float64(now.UnixMilli()), Member: nonce + " " + failureKey[1]})
+				pipe.ZRemRangeByScore(ctx, failureKey[0], "-inf", "("+sinceMillis)
+				pipe.ZRemRangeByRank(ctx, failureKey[0], 0, -maxTrackedFailures-1)
+				pipe.PExpire(ctx, failureKey[0], window)
+				failureRanges = append(failureRanges, pipe.ZRangeWithScores(ctx, failureKey[0], 0, -1))
+			}
+			pipe.HIncrBy(ctx, bucketsKey, bucket+":failures", 1)
+		}
+		pipe.HIncrBy(ctx, bucketsKey, bucket+":attempts", 1)
+		pipe.PExpire(ctx, bucketsKey, window)
+		buckets = pipe.HGetAll(ctx, bucketsKey)
+		return nil
+	})
+	if countErr != nil {
+		return nil, countErr
+	}
+
+	var userFailures, addrFailures []failure
+	if failed {
+		userFailures = sharedFailures(failureRanges[0].Val(), func(other string, at time.Time) failure { return failure{at: at, userName: userName, addr: other} })
+		addrFailures = sharedFailures(failureRanges[1].Val(), func(other string, at time.Time) failure { return failure{at: at, userName: other, addr: addr} })
+	}
+	attempts, failures, windowStart, stale := bucketTotals(buckets.Val(), since)
+	if len(stale) > 0 {
+		d.shared.client.HDel(ctx, bucketsKey, stale...)
+	}
+
+	var found []Anomaly
+	for _, anomaly := range d.patterns(userName, addr, userFailures, addrFailures, attempts, failures, windowStart) {
+		// SET NX elects the one replica reporting a kind and subject in each window
+		reported, flagErr := d.shared.client.SetNX(ctx, d.shared.key("anomaly-flag", anomaly.Kind, anomaly.subject()), "1", window).Result()
+		if flagErr != nil {
+			return found, flagErr
+		}
+		if !reported {
+			continue
+		}
+		anomalyID, idErr := randomToken()
+		if idErr != nil {
+			return found, idErr
+		}
+		anomaly.ID, anomaly.DetectedAt = anomalyID, now
+		encoded, _ := json.Marshal(anomaly)
+		recentKey := d.shared.key("anomalies")
+		if _, pushErr := d.shared.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LPush(ctx, recentKey, encoded)
+			pipe.LTrim(ctx, recentKey, 0, int64(max(d.cfg.Retained, 1)-1))
+			return nil
+		}); pushErr != nil {
+			return found, pushErr
+		}
+		found = append(found, anomaly)
+	}
+	return found, nil
+}
+
+// sharedFailures turns the members of a set of failures, with their scores, into failures, oldest first
+func sharedFailures(members []redis.Z, build func(other string, at time.Time) failure) []failure {
+	failures := make([]failure, 0, len(members))
+	for _, member := range members {
+		value, _ := member.Member.(string)
+		_, other, _ := strings.Cut(value, " ")
+		failures = append(failures, build(other, time.UnixMilli(int64(member.Score))))
+	}
+	return failures
+}
+
+// bucketTotals sums the fields of the shared buckets hash, "<start ms>:attempts" or
+// "<start ms>:failures", still in the window and lists the others
+func bucketTotals(fields map[string]string, since time.Time) (attempts, failures int, windowStart time.Time, stale []string) {
+	for field, value := range fields {
+		startField, kind, _ := strings.Cut(field, ":")
+		startMillis, _ := strconv.ParseInt(startField, 10, 64)
+		start := time.UnixMilli(startMillis)
+		if start.Before(since) {
+			stale = append(stale, field)
+			continue
+		}
+		count, _ := strconv.Atoi(value)
+		if kind == "failures" {
+			failures += count
+		} else {
+			attempts += count
+		}
+		if windowStart.IsZero() || start.Before(windowStart) {
+			windowStart = start
+		}
+	}
+	return attempts, failures, windowStart, stale
+}
+
+// listShared returns the anomalies every replica reported, newest first
+func (d *anomalyDetector) listShared(ctx context.Context) ([]Anomaly, error) {
+	encoded, rangeErr := d.shared.client.LRange(ctx, d.shared.key("anomalies"), 0, -1).Result()
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	anomalies := make([]Anomaly, 0, len(encoded))
+	for _, value := range encoded {
+		var anomaly Anomaly
+		if decodeErr := json.Unmarshal([]byte(value), &anomaly); decodeErr != nil {
+			return nil, decodeErr
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+	return anomalies, nil
+}
+
+// recordLogin feeds the outcome of a login to the anomaly detector and the statistics. Only verdicts
+// on a proof count; unknown key versions, expired challenges and a busy pool say nothing about guessing.
+func (s *Server) recordLogin(ctx context.Context, userName, tenant string, proofLatency time.Duration, authErr error) {
+	if authErr == nil || errors.Is(authErr, ErrInvalidProof) {
+		addr, _ := ctx.Value(clientAddrKey{}).(string)
+		s.anomalies.record(ctx, addr, userName, authErr != nil)
+		s.events.add(store.Event{Kind: store.EventVerification, Tenant: tenant, Success: authErr == nil, Latency: proofLatency, At: time.Now()})
+		s.bus.emit(ctx, busVerificationCompleted, tenant, userName, VerificationCompleted{
+			UserName:      userName,
+			Success:       authErr == nil,
+			LatencyMillis: float64(proofLatency) / float64(time.Millisecond),
+		})
+	}
+}
+
+// announceAnomaly logs a detected anomaly and posts it to the webhooks
+func (s *Server) announceAnomaly(ctx context.Context, anomaly Anomaly) {
+	logf(ctx, "Anomaly %s detected: user %q, addresses %v, %d failures", anomaly.Kind, anomaly.UserName, anomaly.ClientAddrs, anomaly.Failures)
+	s.webhooks.publish(ctx, anomalyDetectedEvent, anomaly)
+	s.notifyLockout(ctx, anomaly)
+	s.events.add(store.Event{Kind: store.EventAnomaly, At: anomaly.DetectedAt})
+}
+
+// anomaliesHandler lists the anomalies detected recently, newest first
+func (s *Server) anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.anomalies == nil {
+		writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "Anomaly detection is disabled")
+		return
+	}
+	anomalies, listErr := s.anomalies.list(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing anomalies: %v", listErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, AnomalyList{Anomalies: anomalies})
+}
+
+// clientAddrKey is the context key of the client address guard found
+type clientAddrKey struct{}
+
+// clientAddr is the address a request came from: the peer's, or when the peer is a trusted proxy
+// the last X-Forwarded-For hop that isn't one. Peers on Unix sockets, which only local processes
+// can reach, count as trusted proxies.
+func (s *Server) clientAddr(r *http.Request) string {
+	host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		host = r.RemoteAddr
+	}
+	peer, parseErr := netip.ParseAddr(host)
+	if parseErr == nil && !s.trustedProxy(peer) {
+		return peer.Unmap().String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, hopErr := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if hopErr != nil {
+			break
+		}
+		peer, parseErr = hop, nil
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	if parseErr != nil {
+		return "unix"
+	}
+	return peer.Unmap().String()
+}
+
+// trustedProxy reports whether addr is in trusted_proxies
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	return containsAddr(s.trustedProxies, addr)
+}
+
+// parsePrefixes parses CIDRs such as "10.0.0.0/8"; a bare address stands for itself alone
+func parsePrefixes(field string, cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, addrErr := netip.ParseAddr(cidr); addrErr == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, prefixErr := netip.ParsePrefix(cidr)
+		if prefixErr != nil {
+			return nil, fmt.Errorf("%s: %w", field, prefixErr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,320 @@
+package server
+
+//go:generate go run ../cmd/ofa-server keygen -out artifacts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/entropy"
+	"A2zkp-circuit/mockzk"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// Artifact file names written by the keygen command and read back by loadCircuitArtifacts
+const (
+	artifactVersionFile      = "circuit_version.txt"
+	artifactConstraintFile   = "circuit.r1cs"
+	artifactProvingKeyFile   = "proving.key"
+	artifactVerifyingKeyFile = "verifying.key"
+	// artifactSealedKeyFile replaces proving.key when keygen runs with -seal
+	artifactSealedKeyFile = "proving.key.sealed"
+	// artifactVerifierContractFile is the Solidity verifier for on-chain checks; the server never reads it
+	artifactVerifierContractFile = "verifier.sol"
+)
+
+// embeddedArtifacts is set by binaries built with -tags embedkeys; it is nil otherwise
+var embeddedArtifacts fs.FS
+
+// runKeygenCommand implements the "keygen" subcommand: compile the circuit, run the setup and write the artifacts
+func runKeygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	outDir := flags.String("out", "artifacts", "directory to write the compiled circuit and keys to")
+	configPath := flags.String("config", "", "configuration file selecting the circuit and the key_provider used by -seal")
+	seal := flags.Bool("seal", false, "write the proving key sealed by the configured key_provider instead of in plaintext")
+	curveName := flags.String("curve", circuit.Curve.String(), "curve to set the circuit up over; serve others from a subdirectory of artifacts_dir named after it")
+	tenant := flags.String("tenant", "", "set up the circuit tenant_circuits pins this tenant to instead; serve it from a subdirectory of artifacts_dir named after its version")
+	ceremonyDir := flags.String("ceremony", "", "take the keys from the setup ceremony of \"ofa-server ceremony\" in this directory instead of a single-party setup, and publish its transcript")
+	flags.Parse(args)
+
+	curve, curveErr := circuit.ParseCurve(*curveName)
+	if curveErr != nil {
+		return curveErr
+	}
+
+	ctx := context.Background()
+	cfg, configErr := LoadConfig(*configPath)
+	if configErr != nil {
+		return configErr
+	}
+	if *tenant != "" {
+		composition, pinned := cfg.pinnedComposition(*tenant)
+		switch {
+		case !pinned:
+			return fmt.Errorf("tenant_circuits doesn't pin tenant %q", *tenant)
+		case curve != circuit.Curve:
+			return fmt.Errorf("the circuits of tenant_circuits are only set up over %s", circuit.Curve)
+		}
+		cfg.Circuit = composition
+	}
+	if cfg.DeterministicSeed != "" {
+		log.Println("Deterministic mode: the setup derives from deterministic_seed; never use these keys in production")
+		defer entropy.UseSeed(cfg.DeterministicSeed)()
+	}
+	var provider KeyProvider
+	if *seal {
+		var providerErr error
+		if provider, providerErr = newKeyProvider(cfg); providerErr != nil {
+			return providerErr
+		}
+		if provider == nil {
+			return fmt.Errorf("-seal needs a key_provider in the configuration")
+		}
+	}
+
+	// Artifacts always hold real keys, whatever mock_prover says
+	var keys *circuitKeys
+	var setupErr error
+	switch {
+	case *ceremonyDir != "" && curve != circuit.Curve:
+		return fmt.Errorf("setup ceremonies only run over %s", circuit.Curve)
+	case *ceremonyDir != "":
+		keys, setupErr = ceremonyKeys(ctx, *ceremonyDir, cfg.Circuit)
+	default:
+		keys, setupErr = compileAndSetup(ctx, cfg.Circuit, curve, false)
+	}
+	if setupErr != nil {
+		return setupErr
+	}
+	if mkdirErr := os.MkdirAll(*outDir, 0o755); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	writes := map[string]io.WriterTo{
+		artifactConstraintFile:   keys.ccs,
+		artifactVerifyingKeyFile: keys.verifyingKey,
+	}
+	if provider == nil {
+		writes[artifactProvingKeyFile] = keys.provingKey
+	}
+	for name, artifact := range writes {
+		if writeErr := writeArtifact(filepath.Join(*outDir, name), artifact); writeErr != nil {
+			return writeErr
+		}
+	}
+	if provider != nil {
+		// The plaintext proving key only ever exists in this buffer
+		var plaintext bytes.Buffer
+		if _, writeErr := keys.provingKey.WriteTo(&plaintext); writeErr != nil {
+			return writeErr
+		}
+		sealed, sealErr := sealWithProvider(ctx, provider, artifactProvingKeyFile, plaintext.Bytes())
+		secret.WipeBytes(plaintext.Bytes())
+		if sealErr != nil {
+			return sealErr
+		}
+		if writeErr := os.WriteFile(filepath.Join(*outDir, artifactSealedKeyFile), sealed, 0o600); writeErr != nil {
+			return writeErr
+		}
+	}
+	if keys.transcript != nil {
+		if saveErr := keys.transcript.save(*outDir); saveErr != nil {
+			return saveErr
+		}
+	}
+	// gnark only exports Solidity verifiers for BN254, the curve with EVM precompiles
+	if curve == circuit.Curve {
+		var contract bytes.Buffer
+		if exportErr := keys.verifyingKey.ExportSolidity(&contract); exportErr != nil {
+			return fmt.Errorf("exporting solidity verifier: %w", exportErr)
+		}
+		if writeErr := os.WriteFile(filepath.Join(*outDir, artifactVerifierContractFile), contract.Bytes(), 0o644); writeErr != nil {
+			return writeErr
+		}
+	}
+	versionPath := filepath.Join(*outDir, artifactVersionFile)
+	if writeErr := os.WriteFile(versionPath, []byte(cfg.Circuit.Version()+"\n"), 0o644); writeErr != nil {
+		return writeErr
+	}
+	log.Printf("Wrote circuit %s artifacts over %s to %s", cfg.Circuit.Version(), curve, *outDir)
+	return nil
+}
+
+// writeArtifact serializes one gnark object to a file
+func writeArtifact(path string, artifact io.WriterTo) error {
+	file, createErr := os.Create(path)
+	if createErr != nil {
+		return createErr
+	}
+	if _, writeErr := artifact.WriteTo(file); writeErr != nil {
+		file.Close()
+		return fmt.Errorf("writing %s: %w", path, writeErr)
+	}
+	return file.Close()
+}
+
+// loadCircuitArtifacts reads precomputed artifacts over curve, refusing ones built for a circuit
+// version other than want. A sealed proving key is unsealed in memory through provider.
+func loadCircuitArtifacts(ctx context.Context, fsys fs.FS, provider KeyProvider, want string, curve ecc.ID) (*circuitKeys, error) {
+	if versionErr := checkArtifactVersion(fsys, want); versionErr != nil {
+		return nil, versionErr
+	}
+	loaded := startupProgressFrom(ctx).begin(phaseLoadingKeys, want, curve)
+	ccs := groth16.NewCS(curve)
+	if readErr := readArtifact(fsys, artifactConstraintFile, ccs); readErr != nil {
+		return nil, readErr
+	}
+	keys, loadErr := loadArtifactKeys(ctx, fsys, provider, ccs, curve)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	loaded(ccs.GetNbConstraints())
+	return keys, nil
+}
+
+// checkArtifactVersion refuses artifacts built for a circuit version other than want
+func checkArtifactVersion(fsys fs.FS, want string) error {
+	version, versionErr := fs.ReadFile(fsys, artifactVersionFile)
+	if versionErr != nil {
+		return fmt.Errorf("reading artifact version: %w", versionErr)
+	}
+	if got := strings.TrimSpace(string(version)); got != want {
+		return fmt.Errorf("artifacts are for circuit %s but the configured circuit is %s; rerun keygen with its configuration", got, want)
+	}
+	return nil
+}
+
+// loadArtifactKeys reads the proving and verifying keys over curve of precomputed artifacts for an
+// already loaded constraint system
+func loadArtifactKeys(ctx context.Context, fsys fs.FS, provider KeyProvider, ccs constraint.ConstraintSystem, curve ecc.ID) (*circuitKeys, error) {
+	keys := &circuitKeys{
+		ccs:          ccs,
+		provingKey:   groth16.NewProvingKey(curve),
+		verifyingKey: groth16.NewVerifyingKey(curve),
+	}
+	if loadErr := loadProvingKey(ctx, fsys, provider, keys.provingKey); loadErr != nil {
+		return nil, loadErr
+	}
+	if loadErr := loadVerifyingKey(fsys, keys.verifyingKey); loadErr != nil {
+		return nil, loadErr
+	}
+	var transcriptErr error
+	if keys.transcript, transcriptErr = loadSetupTranscript(fsys, keys.verifyingKey); transcriptErr != nil {
+		return nil, transcriptErr
+	}
+	return keys, nil
+}
+
+// loadProvingKey reads proving.key, or unseals proving.key.sealed through provider when present
+func loadProvingKey(ctx context.Context, fsys fs.FS, provider KeyProvider, provingKey groth16.ProvingKey) error {
+	sealed, sealedErr := fs.ReadFile(fsys, artifactSealedKeyFile)
+	switch {
+	case errors.Is(sealedErr, fs.ErrNotExist):
+		return readArtifact(fsys, artifactProvingKeyFile, provingKey)
+	case sealedErr != nil:
+		return sealedErr
+	}
+	plaintext, openErr := openWithProvider(ctx, provider, artifactProvingKeyFile, sealed)
+	if openErr != nil {
+		return openErr
+	}
+	_, readErr := provingKey.ReadFrom(bytes.NewReader(plaintext))
+	secret.WipeBytes(plaintext)
+	if readErr != nil {
+		return fmt.Errorf("reading sealed %s: %w", artifactProvingKeyFile, readErr)
+	}
+	return nil
+}
+
+// loadVerifyingKey reads verifying.key, refusing a mock one
+func loadVerifyingKey(fsys fs.FS, verifyingKey groth16.VerifyingKey) error {
+	if readErr := readArtifact(fsys, artifactVerifyingKeyFile, verifyingKey); readErr != nil {
+		return readErr
+	}
+	// A mock verifying key accepts proofs anyone can forge
+	if mockzk.IsVerifyingKey(verifyingKey) {
+		return fmt.Errorf("%s is a mock key, which proves nothing", artifactVerifyingKeyFile)
+	}
+	return nil
+}
+
+// readArtifact deserializes one gnark object from a file
+func readArtifact(fsys fs.FS, name string, artifact io.ReaderFrom) error {
+	file, openErr := fsys.Open(name)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	if _, readErr := artifact.ReadFrom(file); readErr != nil {
+		return fmt.Errorf("reading %s: %w", name, readErr)
+	}
+	return nil
+}
+
+// artifactFetchTimeout bounds the download of one artifact from artifacts_url; proving keys run to
+// hundreds of megabytes
+const artifactFetchTimeout = 5 * time.Minute
+
+// urlArtifacts is an fs.FS of artifacts under a URL prefix: opening a name downloads <base>/<name>,
+// and a 404 reads as a missing file
+type urlArtifacts struct {
+	base    string
+	headers map[string]string
+	client  *http.Client
+}
+
+// newURLArtifacts opens the artifacts under cfg.ArtifactsURL, or the subdirectory dir of it
+func newURLArtifacts(cfg Config, dir string) *urlArtifacts {
+	base := strings.TrimSuffix(cfg.ArtifactsURL, "/")
+	if dir != "" {
+		base += "/" + dir
+	}
+	return &urlArtifacts{base: base, headers: cfg.ArtifactsHeaders, client: &http.Client{Timeout: artifactFetchTimeout}}
+}
+
+// Open downloads the artifact name in full
+func (a *urlArtifacts) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	req, reqErr := http.NewRequest(http.MethodGet, a.base+"/"+name, nil)
+	if reqErr != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: reqErr}
+	}
+	for header, value := range a.headers {
+		req.Header.Set(header, value)
+	}
+	resp, getErr := a.client.Do(req)
+	if getErr != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: getErr}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case resp.StatusCode != http.StatusOK:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)}
+	}
+	data, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: readErr}
+	}
+	return fstest.MapFS{name: &fstest.MapFile{Data: data}}.Open(name)
+}
@@ -0,0 +1,21 @@
+//go:build embedkeys
+
+package server
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Run "go generate" before building with -tags embedkeys so the directory exists
+//
+//go:embed artifacts
+var embeddedArtifactsDir embed.FS
+
+func init() {
+	sub, subErr := fs.Sub(embeddedArtifactsDir, "artifacts")
+	if subErr != nil {
+		panic(subErr)
+	}
+	embeddedArtifacts = sub
+}
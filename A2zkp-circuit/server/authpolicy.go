@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// ErrAuthPolicyDenied is returned for a login an authentication policy refuses; the error names the rule
+var ErrAuthPolicyDenied = errors.New("the authentication policy refuses the login")
+
+// maxPolicyCountries bounds each country list of a policy
+const maxPolicyCountries = 250
+
+// AuthPolicyRequest sets the login rules of a tenant or a user
+type AuthPolicyRequest struct {
+	store.LoginRules
+}
+
+// validate checks the rules, with circuits listing the circuit versions a policy may require
+func (req AuthPolicyRequest) validate(circuits map[string]CircuitMetadata) error {
+	var v validate.Validator
+	if window := req.AllowedHours; window != nil {
+		from, fromErr := time.Parse(store.HourLayout, window.From)
+		to, toErr := time.Parse(store.HourLayout, window.To)
+		if fromErr != nil {
+			v.Fail("allowed_hours.from", "must be a time of day such as 09:00")
+		}
+		if toErr != nil {
+			v.Fail("allowed_hours.to", "must be a time of day such as 17:00")
+		}
+		if fromErr == nil && toErr == nil && from.Equal(to) {
+			v.Fail("allowed_hours.to", "must differ from allowed_hours.from; omit allowed_hours to accept logins at any time")
+		}
+		if _, zoneErr := time.LoadLocation(window.TimeZone); zoneErr != nil {
+			v.Fail("allowed_hours.time_zone", "must be an IANA time zone such as Europe/Berlin")
+		}
+		for i, day := range window.Weekdays {
+			if !slices.Contains(store.Weekdays, day) {
+				v.Fail(fmt.Sprintf("allowed_hours.weekdays[%d]", i), "must be one of %s", strings.Join(store.Weekdays, ", "))
+			}
+		}
+	}
+	if req.MaxSessions < 0 {
+		v.Fail("max_sessions", "must not be negative")
+	}
+	if _, known := circuits[req.CircuitVersion]; req.CircuitVersion != "" && !known {
+		v.Fail("circuit_version", "must be a circuit version of this server")
+	}
+	for field, countries := range map[string][]string{"allowed_countries": req.AllowedCountries, "blocked_countries": req.BlockedCountries} {
+		v.MaxLength(field, len(countries), maxPolicyCountries)
+		for i, country := range countries {
+			if !isCountryCode(country) {
+				v.Fail(fmt.Sprintf("%s[%d]", field, i), "must be an ISO 3166-1 alpha-2 code such as DE")
+			}
+		}
+	}
+	return v.Err()
+}
+
+// isCountryCode reports whether code has the form of an ISO 3166-1 alpha-2 code: two capital letters
+func isCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+// AuthPolicyList lists authentication policies, each tenant's own before those of its users
+type AuthPolicyList struct {
+	Policies []store.AuthPolicy `json:"policies"`
+}
+
+// clientCountryKey is the context key of the client country guard found
+type clientCountryKey struct{}
+
+// clientCountry is the ISO 3166-1 code of the country a request came from, as the trusted proxy
+// in front of the server reports it in country_header; empty when it is unknown, or the peer isn't
+// a trusted proxy whose header can be believed
+func (s *Server) clientCountry(r *http.Request) string {
+	if s.cfg.CountryHeader == "" {
+		return ""
+	}
+	host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		host = r.RemoteAddr
+	}
+	if peer, parseErr := netip.ParseAddr(host); parseErr == nil && !s.trustedProxy(peer) {
+		return ""
+	}
+	if country := strings.ToUpper(strings.TrimSpace(r.Header.Get(s.cfg.CountryHeader))); isCountryCode(country) {
+		return country
+	}
+	return ""
+}
+
+// checkAuthPolicy holds a login that proved knowledge of the secret to the policies of the user's
+// tenant and of the user, with user.CryptoCommitment the commitment the proof matched under version
+func (s *Server) checkAuthPolicy(ctx context.Context, req ProofRequest, user store.User, version *keyVersion) error {
+	now := time.Now()
+	for _, userName := range []string{"", user.UserName} {
+		policy, getErr := s.store.GetAuthPolicy(ctx, user.Tenant, userName)
+		if errors.Is(getErr, store.ErrAuthPolicyNotFound) {
+			continue
+		}
+		if getErr != nil {
+			return &requestError{status: http.StatusInternalServerError, code: codeInternal, message: fmt.Sprintf("Error loading the authentication policy: %v", getErr)}
+		}
+		rules := policy.LoginRules
+		if req.stepUpSession != "" {
+			// A step-up elevates a session the user holds already rather than adding one
+			rules.MaxSessions = 0
+		}
+		denial, evaluateErr := s.evaluateLoginRules(ctx, rules, user, version, now)
+		if evaluateErr != nil {
+			return &requestError{status: http.StatusInternalServerError, code: codeInternal, message: fmt.Sprintf("Error evaluating the authentication policy: %v", evaluateErr)}
+		}
+		if denial != "" {
+			scope := "the tenant's"
+			if userName != "" {
+				scope = "the user's"
+			}
+			return fmt.Errorf("%w: %s policy %s", ErrAuthPolicyDenied, scope, denial)
+		}
+	}
+	return nil
+}
+
+// evaluateLoginRules returns why rules refuse a login at now, or "" when they accept it
+func (s *Server) evaluateLoginRules(ctx context.Context, rules store.LoginRules, user store.User, version *keyVersion, now time.Time) (string, error) {
+	if window := rules.AllowedHours; window != nil && !window.Contains(now) {
+		return fmt.Sprintf("only accepts logins from %s to %s %s", window.From, window.To, windowZone(*window)), nil
+	}
+	if rules.CircuitVersion != "" && version.CircuitVersion != rules.CircuitVersion {
+		return fmt.Sprintf("requires proofs for circuit %s, not %s", rules.CircuitVersion, version.CircuitVersion), nil
+	}
+	if rules.RequireDevice && !s.deviceBound(user) {
+		return "requires a proof from a registered device or with a WebAuthn assertion", nil
+	}
+	if len(rules.AllowedCountries) > 0 || len(rules.BlockedCountries) > 0 {
+		country, _ := ctx.Value(clientCountryKey{}).(string)
+		switch {
+		case slices.Contains(rules.BlockedCountries, country):
+			return fmt.Sprintf("refuses logins from %s", country), nil
+		case len(rules.AllowedCountries) > 0 && country == "":
+			return "only accepts logins from known countries, and the client's is unknown", nil
+		case len(rules.AllowedCountries) > 0 && !slices.Contains(rules.AllowedCountries, country):
+			return fmt.Sprintf("refuses logins from %s", country), nil
+		}
+	}
+	if rules.MaxSessions > 0 {
+		live, countErr := s.store.CountSessions(ctx, user.UserName, now)
+		if countErr != nil {
+			return "", countErr
+		}
+		if live >= rules.MaxSessions {
+			return fmt.Sprintf("allows %d sessions at once, and the user holds %d; log out of one first", rules.MaxSessions, live), nil
+		}
+	}
+	return "", nil
+}
+
+// deviceBound reports whether a login is bound to a device: its proof matched the commitment of an
+// active device, or the user is bound to a WebAuthn credential, whose assertion came with it
+func (s *Server) deviceBound(user store.User) bool {
+	return user.WebAuthn != nil || slices.ContainsFunc(user.Devices, func(device store.Device) bool {
+		return device.RevokedAt == nil && s.blinder.matches(device.CryptoCommitment, user.CryptoCommitment)
+	})
+}
+
+// windowZone is the name of the time zone of a window
+func windowZone(w store.HourWindow) string {
+	if w.TimeZone == "" {
+		return "UTC"
+	}
+	return w.TimeZone
+}
+
+// policyScope resolves the tenant and user name of an authentication policy route: the user name
+// is empty for /admin/tenants/{tenant}/auth-policy, whose tenant is "-" for the default one. A
+// tenant-admin manages the policies of its own tenant and its users only.
+func (s *Server) policyScope(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	p := requestPrincipal(r)
+	if r.PathValue("id") == "" {
+		tenant := r.PathValue("tenant")
+		if tenant == defaultGroup {
+			tenant = ""
+		}
+		if !p.managesTenant(tenant) {
+			writeProblem(w, http.StatusForbidden, codePermissionDenied, fmt.Sprintf("A %s of tenant %q may not manage the policy of tenant %q", RoleTenantAdmin, p.tenant, tenant))
+			return "", "", false
+		}
+		return tenant, "", true
+	}
+	user, getErr := s.getUser(r.Context(), r.PathValue("id"))
+	if errors.Is(getErr, store.ErrUserNotFound) || (getErr == nil && !p.managesTenant(user.Tenant)) {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return "", "", false
+	}
+	if getErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading user: %v", getErr))
+		return "", "", false
+	}
+	return user.Tenant, user.UserName, true
+}
+
+// listAuthPoliciesHandler lists the authentication policies, of one tenant when tenant is set; a
+// tenant-admin only sees those of its own tenant
+func (s *Server) listAuthPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		query.Set("tenant", p.tenant)
+	}
+	policies, listErr := s.store.ListAuthPolicies(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing authentication policies: %v", listErr))
+		return
+	}
+	response := AuthPolicyList{Policies: []store.AuthPolicy{}}
+	for _, policy := range policies {
+		if query.Has("tenant") && policy.Tenant != query.Get("tenant") {
+			continue
+		}
+		response.Policies = append(response.Policies, policy)
+	}
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// getAuthPolicyHandler answers with the authentication policy of a tenant or user
+func (s *Server) getAuthPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userName, ok := s.policyScope(w, r)
+	if !ok {
+		return
+	}
+	policy, getErr := s.store.GetAuthPolicy(r.Context(), tenant, userName)
+	switch {
+	case errors.Is(getErr, store.ErrAuthPolicyNotFound):
+		writeProblem(w, http.StatusNotFound, codeAuthPolicyNotFound, "No authentication policy is set")
+		return
+	case getErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error loading the authentication policy: %v", getErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, policy)
+}
+
+// putAuthPolicyHandler sets the authentication policy of a tenant or user, replacing any set before
+func (s *Server) putAuthPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userName, ok := s.policyScope(w, r)
+	if !ok {
+		return
+	}
+	var req AuthPolicyRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(s.circuits); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	policy := store.AuthPolicy{Tenant: tenant, UserName: userName, LoginRules: req.LoginRules, UpdatedAt: time.Now().UTC()}
+	if putErr := s.store.PutAuthPolicy(r.Context(), policy); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing the authentication policy: %v", putErr))
+		return
+	}
+	if userName == "" {
+		logf(r.Context(), "Set the authentication policy of tenant %q", tenant)
+	} else {
+		logf(r.Context(), "Set the authentication policy of user %q", userName)
+	}
+	writeResponse(w, r, http.StatusOK, policy)
+}
+
+// deleteAuthPolicyHandler removes the authentication policy of a tenant or user
+func (s *Server) deleteAuthPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, userName, ok := s.policyScope(w, r)
+	if !ok {
+		return
+	}
+	deleteErr := s.store.DeleteAuthPolicy(r.Context(), tenant, userName)
+	switch {
+	case errors.Is(deleteErr, store.ErrAuthPolicyNotFound):
+		writeProblem(w, http.StatusNotFound, codeAuthPolicyNotFound, "No authentication policy is set")
+		return
+	case deleteErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error deleting the authentication policy: %v", deleteErr))
+		return
+	}
+	logf(r.Context(), "Removed the authentication policy of tenant %q, user %q", tenant, userName)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/store"
+)
+
+// snapshotFormatVersion is the version of the backup document layout written by exportSnapshot
+const snapshotFormatVersion = 1
+
+// Snapshot is a portable, versioned export of every registration held by a store
+type Snapshot struct {
+	FormatVersion int               `json:"format_version"` // FormatVersion is the layout version of this document
+	CreatedAt     time.Time         `json:"created_at"`     // CreatedAt is when the snapshot was taken
+	Circuits      []CircuitMetadata `json:"circuits"`       // Circuits describes every circuit version referenced by Users
+	Users         []store.User      `json:"users"`          // Users holds the exported registrations
+}
+
+// RestoreReport summarizes the outcome (or, for a dry run, the expected outcome) of a restore
+type RestoreReport struct {
+	DryRun   bool     `json:"dry_run"`  // DryRun is true when nothing was written
+	Total    int      `json:"total"`    // Total is the number of users in the snapshot
+	Created  int      `json:"created"`  // Created counts users absent from the store before the restore
+	Replaced int      `json:"replaced"` // Replaced counts users whose existing registration is overwritten
+	Problems []string `json:"problems"` // Problems lists validation failures; a restore with problems writes nothing
+}
+
+// exportSnapshot collects all registrations from the store into a snapshot, describing the circuit
+// versions they reference from circuits
+func exportSnapshot(ctx context.Context, userStore store.Store, circuits map[string]CircuitMetadata) (Snapshot, error) {
+	users, listErr := userStore.ListUsers(ctx)
+	if listErr != nil {
+		return Snapshot{}, fmt.Errorf("listing users: %w", listErr)
+	}
+
+	// Record the metadata of every circuit version the registrations depend on
+	referenced := make(map[string]bool)
+	described := []CircuitMetadata{}
+	for _, user := range users {
+		if referenced[user.CircuitVersion] {
+			continue
+		}
+		referenced[user.CircuitVersion] = true
+		if metadata, known := circuits[user.CircuitVersion]; known {
+			described = append(described, metadata)
+		}
+	}
+
+	if users == nil {
+		users = []store.User{}
+	}
+	return Snapshot{
+		FormatVersion: snapshotFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Circuits:      described,
+		Users:         users,
+	}, nil
+}
+
+// validateSnapshot checks a snapshot for structural problems before anything is written, including
+// registrations bound to a circuit version missing from circuits
+func validateSnapshot(snapshot Snapshot, circuits map[string]CircuitMetadata) []string {
+	problems := []string{}
+	if snapshot.FormatVersion != snapshotFormatVersion {
+		problems = append(problems, fmt.Sprintf("unsupported format_version %d (want %d)", snapshot.FormatVersion, snapshotFormatVersion))
+		return problems
+	}
+
+	seen := make(map[string]bool)
+	for i, user := range snapshot.Users {
+		switch {
+		case user.UserName == "":
+			problems = append(problems, fmt.Sprintf("users[%d]: missing user_name", i))
+		case seen[user.UserName]:
+			problems = append(problems, fmt.Sprintf("users[%d]: duplicate user_name %q", i, user.UserName))
+		}
+		seen[user.UserName] = true
+
+		if user.Pending() {
+			// Imported users have a legacy password hash in place of a commitment and circuit
+			if hashErr := checkLegacyHash(user.Legacy.Hash); hashErr != nil {
+				problems = append(problems, fmt.Sprintf("users[%d].legacy: hash %v", i, hashErr))
+			}
+		} else if user.CryptoCommitment == "" {
+			problems = append(problems, fmt.Sprintf("users[%d]: missing crypto_commitment", i))
+		}
+		if metadata, known := circuits[user.CircuitVersion]; !known && !user.Pending() {
+			problems = append(problems, fmt.Sprintf("users[%d]: unknown circuit_version %q", i, user.CircuitVersion))
+		} else if _, curveErr := circuit.ParseCurve(user.Curve); user.Curve != "" && user.Curve != metadata.Curve && curveErr != nil {
+			// Registrations may be on a curve besides their circuit's when the server lists it in curves
+			problems = append(problems, fmt.Sprintf("users[%d]: curve %q is not supported", i, user.Curve))
+		}
+		if user.KDF != nil {
+			if kdfErr := user.KDF.Validate(); kdfErr != nil {
+				problems = append(problems, fmt.Sprintf("users[%d]: kdf: %v", i, kdfErr))
+			}
+		}
+		labels := make(map[string]bool)
+		for j, device := range user.Devices {
+			switch {
+			case device.Label == "" || labels[device.Label]:
+				problems = append(problems, fmt.Sprintf("users[%d].devices[%d]: missing or duplicate label", i, j))
+			case device.CryptoCommitment == "":
+				problems = append(problems, fmt.Sprintf("users[%d].devices[%d]: missing crypto_commitment", i, j))
+			}
+			labels[device.Label] = true
+		}
+		if recovery := user.Recovery; recovery != nil && (recovery.Threshold < 1 || recovery.Threshold > len(recovery.Shares)) {
+			problems = append(problems, fmt.Sprintf("users[%d].recovery: threshold %d of %d shares", i, recovery.Threshold, len(recovery.Shares)))
+		}
+	}
+	return problems
+}
+
+// restoreSnapshot validates a snapshot and, unless dryRun is set, writes its users into the store
+func restoreSnapshot(ctx context.Context, userStore store.Store, snapshot Snapshot, dryRun bool, circuits map[string]CircuitMetadata) (RestoreReport, error) {
+	report := RestoreReport{DryRun: dryRun, Total: len(snapshot.Users), Problems: validateSnapshot(snapshot, circuits)}
+	if len(report.Problems) > 0 {
+		return report, nil
+	}
+
+	// Classify each user so the report describes the effect of the restore
+	for _, user := range snapshot.Users {
+		_, getErr := userStore.GetUser(ctx, user.UserName)
+		switch {
+		case getErr == nil:
+			report.Replaced++
+		case errors.Is(getErr, store.ErrUserNotFound):
+			report.Created++
+		default:
+			return report, fmt.Errorf("looking up %q: %w", user.UserName, getErr)
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	for _, user := range snapshot.Users {
+		if putErr := userStore.PutUser(ctx, user); putErr != nil {
+			return report, fmt.Errorf("restoring %q: %w", user.UserName, putErr)
+		}
+	}
+	return report, nil
+}
+
+// backupHandler streams a snapshot of the store as JSON
+func (s *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, exportErr := exportSnapshot(r.Context(), s.store, s.circuits)
+	if exportErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error exporting snapshot: %v", exportErr))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"ofa-snapshot.json\"")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// restoreHandler loads a snapshot from the request body; ?dry_run=true only validates it
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	var snapshot Snapshot
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxSnapshotBytes, &snapshot); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, restoreErr := restoreSnapshot(r.Context(), s.store, snapshot, dryRun, s.circuits)
+	if restoreErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error restoring snapshot: %v", restoreErr))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(report.Problems) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// runBackupCommand implements the "backup" subcommand, writing a snapshot of the configured store
+func runBackupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the JSON configuration file")
+	databasePath := flags.String("db", "", "SQLite database to export (overrides the config)")
+	outPath := flags.String("out", "-", "file to write the snapshot to, - for stdout")
+	flags.Parse(args)
+
+	userStore, cfg, openErr := openConfiguredStore(*configPath, *databasePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer userStore.Close()
+
+	snapshot, exportErr := exportSnapshot(context.Background(), userStore, knownCircuits(cfg))
+	if exportErr != nil {
+		return exportErr
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "-" {
+		file, createErr := os.Create(*outPath)
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// runRestoreCommand implements the "restore" subcommand, loading a snapshot into the configured store
+func runRestoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the JSON configuration file")
+	databasePath := flags.String("db", "", "SQLite database to restore into (overrides the config)")
+	inPath := flags.String("in", "-", "snapshot file to read, - for stdin")
+	dryRun := flags.Bool("dry-run", false, "validate the snapshot without writing anything")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *inPath != "-" {
+		file, openErr := os.Open(*inPath)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		in = file
+	}
+	var snapshot Snapshot
+	if decodeErr := json.NewDecoder(in).Decode(&snapshot); decodeErr != nil {
+		return fmt.Errorf("decoding snapshot: %w", decodeErr)
+	}
+
+	userStore, cfg, openErr := openConfiguredStore(*configPath, *databasePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer userStore.Close()
+
+	report, restoreErr := restoreSnapshot(context.Background(), userStore, snapshot, *dryRun, knownCircuits(cfg))
+	if restoreErr != nil {
+		return restoreErr
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("snapshot has %d problem(s); nothing was restored", len(report.Problems))
+	}
+	return nil
+}
+
+// openConfiguredStore opens the store named by the config file, optionally overriding its database
+// path, and returns the configuration with it
+func openConfiguredStore(configPath, databasePath string) (store.Store, Config, error) {
+	cfg, configErr := LoadConfig(configPath)
+	if configErr != nil {
+		return nil, cfg, configErr
+	}
+	if databasePath != "" {
+		cfg.DatabasePath, cfg.LDAP, cfg.Stateless.Enabled = databasePath, store.LDAPConfig{}, false
+	}
+	shared, sharedErr := newSharedState(cfg)
+	if sharedErr != nil {
+		return nil, cfg, sharedErr
+	}
+	provider, providerErr := newKeyProvider(cfg)
+	if providerErr != nil {
+		return nil, cfg, providerErr
+	}
+	blinder, blinderErr := newCommitmentBlinder(context.Background(), cfg, provider, shared)
+	if blinderErr != nil {
+		return nil, cfg, blinderErr
+	}
+	userStore, openErr := openStore(context.Background(), cfg, shared, blinder)
+	return userStore, cfg, openErr
+}
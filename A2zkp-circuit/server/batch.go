@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"A2zkp-circuit/store"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BatchRegisterRequest is the body of POST /v1/users:batch
+type BatchRegisterRequest struct {
+	Users []RegisterRequest `json:"users"` // Users are the registrations, at most max_batch_size of them
+}
+
+// BatchRegisterResponse reports the outcome of every registration of a batch, in request order
+type BatchRegisterResponse struct {
+	Created   int                   `json:"created"`    // Created counts the registrations stored
+	Failed    int                   `json:"failed"`     // Failed counts the registrations that were not
+	ChunkSize int                   `json:"chunk_size"` // ChunkSize is how many consecutive registrations were stored all or none
+	Results   []BatchRegisterResult `json:"results"`
+}
+
+// BatchRegisterResult is the outcome of one registration of a batch
+type BatchRegisterResult struct {
+	Index    int      `json:"index"` // Index is the registration's position in the request
+	UserName string   `json:"user_name"`
+	Status   string   `json:"status"`            // Status is "created" or "failed"
+	Problem  *Problem `json:"problem,omitempty"` // Problem explains a failure as POST /v1/users would
+}
+
+// batchRegisterHandler registers many users in one request. The registrations are split into
+// chunks of batch_chunk_size stored in one transaction each, so a failing registration, whether
+// invalid or already taken, keeps the rest of its chunk out of the store too. The route takes the
+// admin token because the per-registration results tell which names are taken.
+func (s *Server) batchRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchRegisterRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBatchBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if len(req.Users) == 0 {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "Missing users")
+		return
+	}
+	if len(req.Users) > s.cfg.MaxBatchSize {
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("A batch holds at most %d users", s.cfg.MaxBatchSize))
+		return
+	}
+
+	chunkSize := max(s.cfg.BatchChunkSize, 1)
+	response := BatchRegisterResponse{ChunkSize: chunkSize, Results: make([]BatchRegisterResult, len(req.Users))}
+	for start := 0; start < len(req.Users); start += chunkSize {
+		chunk := req.Users[start:min(start+chunkSize, len(req.Users))]
+		results := response.Results[start : start+len(chunk)]
+		for i, registration := range chunk {
+			results[i] = BatchRegisterResult{Index: start + i, UserName: registration.UserName, Status: "created"}
+		}
+		if failed, failure := s.registerChunk(r, chunk); failure != nil {
+			for i := range results {
+				results[i].Status = "failed"
+				if i == failed {
+					results[i].Problem = failure
+				} else {
+					aborted := newProblem(http.StatusConflict, codeBatchAborted, fmt.Sprintf("Registration %d of this chunk failed", start+failed))
+					results[i].Problem = &aborted
+				}
+			}
+			response.Failed += len(chunk)
+			continue
+		}
+		response.Created += len(chunk)
+	}
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// registerChunk validates and stores a chunk of registrations atomically. When any of them fails
+// it returns its position in the chunk and the problem POST /v1/users would have answered with.
+// The policy proofs, whose witnesses are the costly part, are checked batch_concurrency at a time.
+func (s *Server) registerChunk(r *http.Request, chunk []RegisterRequest) (int, *Problem) {
+	registrations := slices.Clone(chunk)
+	var holders map[string][]store.User
+	if s.checksDuplicates() {
+		var holdersErr error
+		if holders, holdersErr = s.commitmentHolders(r.Context()); holdersErr != nil {
+			problem := newProblem(http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error checking the commitments: %v", holdersErr))
+			return 0, &problem
+		}
+	}
+	for i := range registrations {
+		registration := &registrations[i]
+		if validateErr := registration.validate(); validateErr != nil {
+			problem := requestProblem(validateErr)
+			return i, &problem
+		}
+		if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+			// A tenant-admin registers into its own tenant only
+			if registration.Tenant == "" {
+				registration.Tenant = p.tenant
+			}
+			if !p.managesTenant(registration.Tenant) {
+				problem := newProblem(http.StatusForbidden, codePermissionDenied, fmt.Sprintf("A %s of tenant %q may not register users of tenant %q", RoleTenantAdmin, p.tenant, registration.Tenant))
+				return i, &problem
+			}
+		}
+		if curveErr := s.checkCurve(registration.Curve, registration.Tenant); curveErr != nil {
+			problem := requestProblem(curveErr)
+			return i, &problem
+		}
+		if kdfErr := s.checkKDF(registration); kdfErr != nil {
+			problem := requestProblem(kdfErr)
+			return i, &problem
+		}
+		if duplicateErr := s.duplicateProblem(holders, *registration); duplicateErr != nil {
+			problem := requestProblem(duplicateErr)
+			return i, &problem
+		}
+		if holders != nil {
+			// Registrations of the same chunk may not share a commitment either
+			blinded := s.blinder.blind(registration.CryptoCommitment)
+			holders[blinded] = append(holders[blinded], store.User{UserName: registration.UserName})
+		}
+		if registration.Recovery != nil {
+			// The batch response has nowhere to return shares
+			problem := requestProblem(badRequest("recovery is not available in batch registrations"))
+			return i, &problem
+		}
+		if didErr := s.checkDID(r.Context(), registration); didErr != nil {
+			problem := requestProblem(didErr)
+			return i, &problem
+		}
+	}
+	if failed, failure := s.checkBatchPolicy(r.Context(), registrations); failure != nil {
+		return failed, failure
+	}
+	users := make([]store.User, len(registrations))
+	for i, registration := range registrations {
+		users[i] = s.newUser(registration)
+	}
+
+	createErr := s.store.CreateUsers(r.Context(), users)
+	if createErr == nil {
+		for _, user := range users {
+			s.recordRegistration(r.Context(), user)
+		}
+		return 0, nil
+	}
+	failed := 0
+	var batchErr *store.BatchError
+	if errors.As(createErr, &batchErr) {
+		failed = batchErr.Index
+	}
+	problem := newProblem(http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing users: %v", createErr))
+	switch {
+	case errors.Is(createErr, store.ErrUserExists):
+		problem = newProblem(http.StatusConflict, codeUserExists, "User already exists")
+	case errors.Is(createErr, store.ErrNoDirectoryEntry):
+		problem = newProblem(http.StatusNotFound, codeUserNotFound, "The directory has no entry for the user")
+	}
+	return failed, &problem
+}
+
+// checkBatchPolicy checks the policy proofs of registrations on up to batch_concurrency goroutines.
+// No further proof is started once one fails; of those that failed, the first in the chunk is
+// reported.
+func (s *Server) checkBatchPolicy(ctx context.Context, registrations []RegisterRequest) (int, *Problem) {
+	if s.policy == nil {
+		return 0, nil
+	}
+	concurrency := s.cfg.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = max(cap(s.pool.workers)/2, 1)
+	}
+	failures := make([]error, len(registrations))
+	var failed atomic.Bool
+	var group errgroup.Group
+	group.SetLimit(concurrency)
+	for i, registration := range registrations {
+		if failed.Load() {
+			break
+		}
+		group.Go(func() error {
+			if failed.Load() {
+				return nil
+			}
+			if policyErr := s.checkSecretPolicy(ctx, registration.CryptoCommitment, registration.PolicyProof); policyErr != nil {
+				failures[i] = policyErr
+				failed.Store(true)
+			}
+			return nil
+		})
+	}
+	group.Wait()
+	for i, policyErr := range failures {
+		if policyErr != nil {
+			problem := policyProblem(policyErr)
+			return i, &problem
+		}
+	}
+	return 0, nil
+}
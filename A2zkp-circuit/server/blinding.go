@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"A2zkp-circuit/store"
+)
+
+// commitmentPepperFile names the pepper of commitment_blinding in sealed files
+const commitmentPepperFile = "commitment-pepper"
+
+// commitmentPepperSize is the length of a generated pepper, that of an HMAC-SHA256 key
+const commitmentPepperSize = 32
+
+// commitmentBlinder compares the commitments clients send with the keyed hashes of a blinded store.
+// A nil blinder, without commitment_blinding, compares them as they are.
+type commitmentBlinder struct {
+	pepper []byte
+}
+
+// newCommitmentBlinder loads the pepper of commitment_blinding: derived from stateless.secret in
+// stateless mode, so replicas agree, and otherwise read from pepper_file, sealed through provider
+// when one is configured, or generated into it on first start. It returns nil when blinding is off.
+func newCommitmentBlinder(ctx context.Context, cfg Config, provider KeyProvider, shared *sharedState) (*commitmentBlinder, error) {
+	switch {
+	case !cfg.CommitmentBlinding.Enabled:
+		return nil, nil
+	case cfg.Transcripts.Enabled:
+		return nil, errors.New("commitment_blinding: transcripts keep the commitment each proof verified against and can't be enabled too")
+	case cfg.Groups.Enabled:
+		return nil, errors.New("commitment_blinding: group trees are built from the stored commitments and can't be enabled too")
+	case shared != nil:
+		return &commitmentBlinder{pepper: shared.derive("commitment pepper")}, nil
+	case cfg.CommitmentBlinding.PepperFile == "":
+		return nil, errors.New("commitment_blinding: pepper_file is required outside stateless mode")
+	}
+
+	path := cfg.CommitmentBlinding.PepperFile
+	data, readErr := os.ReadFile(path)
+	switch {
+	case errors.Is(readErr, os.ErrNotExist) && cfg.ReadOnly:
+		return nil, fmt.Errorf("commitment_blinding: %s doesn't exist; a read_only replica needs the primary's pepper", path)
+	case errors.Is(readErr, os.ErrNotExist):
+		return generatePepper(ctx, path, provider)
+	case readErr != nil:
+		return nil, fmt.Errorf("commitment_blinding: %w", readErr)
+	case provider != nil:
+		var openErr error
+		if data, openErr = openWithProvider(ctx, provider, commitmentPepperFile, data); openErr != nil {
+			return nil, fmt.Errorf("commitment_blinding: %w", openErr)
+		}
+	}
+	if len(data) != commitmentPepperSize {
+		return nil, fmt.Errorf("commitment_blinding: %s holds %d bytes, want a %d-byte pepper", path, len(data), commitmentPepperSize)
+	}
+	return &commitmentBlinder{pepper: data}, nil
+}
+
+// generatePepper draws a pepper and writes it to path, sealed through provider when one is configured
+func generatePepper(ctx context.Context, path string, provider KeyProvider) (*commitmentBlinder, error) {
+	pepper := make([]byte, commitmentPepperSize)
+	if _, randErr := rand.Read(pepper); randErr != nil {
+		return nil, randErr
+	}
+	data := pepper
+	if provider != nil {
+		var sealErr error
+		if data, sealErr = sealWithProvider(ctx, provider, commitmentPepperFile, pepper); sealErr != nil {
+			return nil, fmt.Errorf("commitment_blinding: %w", sealErr)
+		}
+	} else {
+		log.Printf("commitment_blinding: no key_provider is configured, so the pepper in %s is stored in the clear", path)
+	}
+	if writeErr := os.WriteFile(path, data, 0o600); writeErr != nil {
+		return nil, fmt.Errorf("commitment_blinding: %w", writeErr)
+	}
+	log.Printf("Generated the commitment_blinding pepper in %s; blinded registrations can't log in without it", path)
+	return &commitmentBlinder{pepper: pepper}, nil
+}
+
+// blind returns the form the store keeps of a commitment
+func (b *commitmentBlinder) blind(commitment string) string {
+	if b == nil {
+		return commitment
+	}
+	return store.BlindCommitment(b.pepper, commitment)
+}
+
+// matches reports whether a stored commitment, blinded or not, is that of commitment
+func (b *commitmentBlinder) matches(stored, commitment string) bool {
+	return stored == commitment || store.IsBlinded(stored) && b.blind(commitment) == stored
+}
+
+// resolve returns the commitments a proof is checked against for those stored: the claimed one in
+// place of the blinded one it matches, and unblinded ones as they are. Blinded ones the claim
+// doesn't match are dropped; when nothing is left the decoy stands in, so the proof still takes a
+// pairing check, and fails it.
+func (b *commitmentBlinder) resolve(stored []string, claimed string) []string {
+	resolved := make([]string, 0, len(stored))
+	for _, commitment := range stored {
+		switch {
+		case !store.IsBlinded(commitment):
+			resolved = append(resolved, commitment)
+		case claimed != "" && b.matches(commitment, claimed):
+			resolved = append(resolved, claimed)
+		}
+	}
+	if len(resolved) == 0 && len(stored) > 0 {
+		return []string{decoyCommitment}
+	}
+	return resolved
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/verifier"
+)
+
+// ndjsonContentType is the media type of newline-delimited JSON bodies
+const ndjsonContentType = "application/x-ndjson"
+
+// BulkVerifyItem is one line of a POST /admin/verify:bulk body: a proof checked again without a challenge
+type BulkVerifyItem struct {
+	ID string `json:"id,omitempty"` // ID is the caller's reference for the proof, echoed in its result
+	ProofRequest
+}
+
+// BulkVerifyResult is one line of the POST /admin/verify:bulk response, written as soon as its proof is checked
+type BulkVerifyResult struct {
+	Index    int      `json:"index"`        // Index is the item's position in the body; -1 when the body itself broke off
+	ID       string   `json:"id,omitempty"` // ID echoes the item's id
+	UserName string   `json:"user_name,omitempty"`
+	Valid    bool     `json:"valid"`             // Valid reports whether the proof verified for the user's stored commitment
+	KeyID    string   `json:"key_id,omitempty"`  // KeyID is the key version a valid proof verified under
+	Problem  *Problem `json:"problem,omitempty"` // Problem explains why the proof isn't valid
+}
+
+// bulkItems reads the items of an NDJSON body, or of every part of a multipart body whose parts
+// hold NDJSON, one line at a time
+type bulkItems struct {
+	parts *multipart.Reader // parts is nil for a plain NDJSON body
+	lines *bufio.Scanner
+	limit int
+}
+
+// newBulkItems opens the body of a bulk request, whose lines may be up to limit bytes long
+func newBulkItems(r *http.Request, limit int64) (*bulkItems, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	items := &bulkItems{limit: int(limit)}
+	switch {
+	case mediaType == ndjsonContentType || mediaType == "application/jsonl":
+		items.lines = items.scanner(r.Body)
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		items.parts = multipart.NewReader(r.Body, params["boundary"])
+	default:
+		return nil, &requestError{
+			status:  http.StatusUnsupportedMediaType,
+			code:    codeUnsupportedMedia,
+			message: "Send proofs as " + ndjsonContentType + " or as multipart parts holding it",
+		}
+	}
+	return items, nil
+}
+
+// scanner splits body into lines of at most limit bytes
+func (b *bulkItems) scanner(body io.Reader) *bufio.Scanner {
+	lines := bufio.NewScanner(body)
+	lines.Buffer(make([]byte, 0, 4096), b.limit)
+	return lines
+}
+
+// next returns the next non-blank line, or io.EOF after the last one
+func (b *bulkItems) next() ([]byte, error) {
+	for {
+		if b.lines != nil {
+			for b.lines.Scan() {
+				if line := bytes.TrimSpace(b.lines.Bytes()); len(line) > 0 {
+					return bytes.Clone(line), nil
+				}
+			}
+			if errors.Is(b.lines.Err(), bufio.ErrTooLong) {
+				return nil, badRequest("A line exceeds %d bytes", b.limit)
+			}
+			if scanErr := b.lines.Err(); scanErr != nil {
+				return nil, scanErr
+			}
+		}
+		if b.parts == nil {
+			return nil, io.EOF
+		}
+		part, partErr := b.parts.NextPart()
+		if partErr != nil {
+			return nil, partErr
+		}
+		b.lines = b.scanner(part)
+	}
+}
+
+// bulkVerifyHandler re-verifies a stream of earlier proofs, e.g. for a nightly re-validation job.
+// Proofs are checked against the users' stored commitments without consuming challenges, up to
+// bulk_verify_concurrency at a time, and each result is streamed back as NDJSON once it is known,
+// so results arrive out of order while the rest of the body is still being read.
+func (s *Server) bulkVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	items, itemsErr := newBulkItems(r, s.cfg.MaxBodyBytes)
+	if itemsErr != nil {
+		writeRequestError(w, itemsErr)
+		return
+	}
+	controller := http.NewResponseController(w)
+	// Results go out while the body is still arriving, possibly for longer than the server timeouts
+	controller.EnableFullDuplex()
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	concurrency := s.cfg.BulkVerifyConcurrency
+	if concurrency <= 0 {
+		concurrency = max(cap(s.pool.workers)/2, 1)
+	}
+	ctx := r.Context()
+	results := make(chan BulkVerifyResult)
+	go func() {
+		slots := make(chan struct{}, concurrency)
+		var running sync.WaitGroup
+		defer func() {
+			running.Wait()
+			close(results)
+		}()
+		for index := 0; ; index++ {
+			line, nextErr := items.next()
+			if errors.Is(nextErr, io.EOF) {
+				return
+			}
+			if nextErr != nil {
+				problem := requestProblem(nextErr)
+				results <- BulkVerifyResult{Index: -1, Problem: &problem}
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			running.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					running.Done()
+				}()
+				results <- s.verifyBulkItem(ctx, index, line)
+			}()
+		}
+	}()
+
+	encoder := json.NewEncoder(w)
+	for result := range results {
+		encoder.Encode(result)
+		controller.Flush()
+	}
+}
+
+// verifyBulkItem decodes and checks one line of a bulk verification body
+func (s *Server) verifyBulkItem(ctx context.Context, index int, line []byte) BulkVerifyResult {
+	var item BulkVerifyItem
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if decodeErr := decoder.Decode(&item); decodeErr != nil {
+		problem := newProblem(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid JSON: %v", decodeErr))
+		return BulkVerifyResult{Index: index, Problem: &problem}
+	}
+	result := BulkVerifyResult{Index: index, ID: item.ID, UserName: item.UserName}
+	nonce, validateErr := item.validate()
+	if validateErr != nil {
+		problem := requestProblem(validateErr)
+		result.Problem = &problem
+		return result
+	}
+
+	version, verifyErr := s.revalidate(ctx, item.ProofRequest, nonce)
+	if verifyErr != nil {
+		problem := authProblem(item.ProofRequest, verifyErr)
+		var storeErr *bulkStoreError
+		switch {
+		case errors.Is(verifyErr, store.ErrUserNotFound):
+			problem = newProblem(http.StatusNotFound, codeUserNotFound, "Unknown user")
+		case errors.As(verifyErr, &storeErr):
+			problem = newProblem(http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading user: %v", storeErr.err))
+		}
+		result.Problem = &problem
+		return result
+	}
+	result.Valid, result.KeyID = true, version.ID
+	return result
+}
+
+// bulkStoreError is a store failure met by revalidate, told apart from the verdict on the proof
+type bulkStoreError struct {
+	err error
+}
+
+func (e *bulkStoreError) Error() string {
+	return e.err.Error()
+}
+
+// revalidate checks a proof against the user's stored commitment on the worker pool. Unlike
+// authenticate it consumes no challenge, and it waits out a full queue rather than failing, so
+// bulk jobs yield to logins instead of competing with them.
+func (s *Server) revalidate(ctx context.Context, req ProofRequest, nonce *big.Int) (*keyVersion, error) {
+	user, getErr := s.getUser(ctx, req.UserName)
+	if errors.Is(getErr, store.ErrUserNotFound) {
+		return nil, getErr
+	}
+	if getErr != nil {
+		return nil, &bulkStoreError{err: getErr}
+	}
+	var version *keyVersion
+	var keyErr error
+	if pinned := s.userCircuit(user, req); pinned != nil {
+		version, keyErr = pinned.keyVersion(ctx, req)
+	} else {
+		version, keyErr = s.keyring.lookup(req.KeyID)
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	if user.Pending() {
+		return nil, errors.Join(ErrInvalidProof, errMigrationPending)
+	}
+	commitments, ok := s.proofCommitments(user, req)
+	if !ok {
+		return nil, fmt.Errorf("%w: %w %q", ErrInvalidProof, errDeviceRevoked, req.Device)
+	}
+
+	var verifyErr error
+	for {
+		poolErr := s.pool.Do(ctx, func() {
+			for _, commitment := range commitments {
+				inputs := verifier.PublicInputs{Commitment: commitment, Nonce: nonce}
+				verifyErr = s.verdicts.Verify(version.ID, proofBytes(req), inputs, func() error {
+					started := time.Now()
+					checkErr := verifier.New(version.keys.verifyingKey).VerifyProof(ctx, req.Proof, inputs)
+					s.observeProof(proofVerify, version, req.curve(), time.Since(started), len(req.Proof))
+					return checkErr
+				})
+				if !errors.Is(verifyErr, verifier.ErrRejected) {
+					break
+				}
+			}
+		})
+		if !errors.Is(poolErr, ErrPoolBusy) {
+			if poolErr != nil {
+				return nil, poolErr
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.cfg.PoolRetryAfter.Duration):
+		}
+	}
+	switch {
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		return nil, verifyErr
+	case verifyErr != nil:
+		return nil, invalidProof(verifyErr)
+	case user.Expired(time.Now()):
+		return nil, ErrCommitmentExpired
+	}
+	return version, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"A2zkp-circuit/wire"
+)
+
+// immutableCacheControl lets clients and shared caches keep a response that can never change, such
+// as the bytes of a key version named by its ID, for a year, as RFC 9111 suggests
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// keyETag is the strong ETag of a key of a key version. Key IDs digest the verifying key, and the
+// encodings are deterministic, so the bytes served under a key ID never change.
+func keyETag(keyID, kind string) string {
+	return `"` + keyID + "." + kind + `"`
+}
+
+// cacheControl is the Cache-Control of the metadata responses, which change with key rotations and
+// configuration only
+func (s *Server) cacheControl(immutable bool) string {
+	maxAge := int(s.cfg.MetadataMaxAge.Seconds())
+	switch {
+	case immutable:
+		return immutableCacheControl
+	case maxAge <= 0:
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+// notModified sets the validators of a cacheable response, and answers 304 Not Modified when the
+// request's If-None-Match names etag, reporting true so the handler writes nothing more
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, etag string, immutable bool) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", s.cacheControl(immutable))
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header names etag, comparing weakly as RFC 9110
+// requires of If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCachedResponse is writeResponse for metadata: the encoded body is validated by a strong
+// ETag of its SHA-256, which differs between the JSON and protobuf representations, the latter a
+// google.protobuf.Value for bodies without a message of their own
+func (s *Server) writeCachedResponse(w http.ResponseWriter, r *http.Request, body any) {
+	contentType, encoded := "application/json", new(bytes.Buffer)
+	message, isProtobuf := protobufBody(r, body)
+	switch {
+	case isProtobuf:
+		contentType = wire.ContentType
+		encoded.Write(message)
+	default:
+		json.NewEncoder(encoded).Encode(body)
+		// Transcoded here rather than by negotiate, so the ETag is of the bytes served
+		if wantsProtobuf(r) {
+			if value, transcodeErr := wire.ValueFromJSON(encoded.Bytes()); transcodeErr == nil {
+				contentType = wire.ValueContentType
+				encoded.Reset()
+				encoded.Write(value)
+			}
+		}
+	}
+	digest := sha256.Sum256(encoded.Bytes())
+	w.Header().Add("Vary", "Accept")
+	if s.notModified(w, r, `"`+base64.RawURLEncoding.EncodeToString(digest[:])+`"`, false) {
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded.Bytes())
+}
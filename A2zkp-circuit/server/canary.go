@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/store"
+)
+
+// canaryBuckets is how finely canary_circuit.percent splits user names, in hundredths of a percent
+const canaryBuckets = 10000
+
+// canaryRollout is who new registrations are routed to the canary circuit for, swapped by Reload
+type canaryRollout struct {
+	percent float64
+	users   map[string]bool
+}
+
+// newCanaryRollout checks the rollout of canary_circuit; it returns nil without a canary circuit
+func newCanaryRollout(cfg CanaryCircuitConfig) (*canaryRollout, error) {
+	if cfg.Circuit == nil {
+		return nil, nil
+	}
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return nil, fmt.Errorf("canary_circuit: percent %g must be between 0 and 100", cfg.Percent)
+	}
+	rollout := &canaryRollout{percent: cfg.Percent, users: make(map[string]bool, len(cfg.Users))}
+	for _, userName := range cfg.Users {
+		rollout.users[userName] = true
+	}
+	return rollout, nil
+}
+
+// canaryBucket places a user name among canaryBuckets by its hash. The bucket never changes, so
+// raising the percent only adds users to the canary and lowering it only removes some.
+func canaryBucket(userName string) uint64 {
+	sum := sha256.Sum256([]byte("ofa canary\x00" + userName))
+	return binary.BigEndian.Uint64(sum[:8]) % canaryBuckets
+}
+
+// routesToCanary reports whether a new registration of userName in tenant over curve is bound to the
+// canary circuit. Pinned tenants keep their circuit, and registrations over additional curves the
+// configured one, as the canary is only set up over circuit.Curve.
+func (s *Server) routesToCanary(tenant, userName, curve string) bool {
+	rollout := s.canaryRollout.Load()
+	switch {
+	case s.canary == nil || rollout == nil, s.pinnedCircuit(tenant) != nil:
+		return false
+	case curve != "" && curve != circuit.Curve.String():
+		return false
+	}
+	return rollout.users[userName] || float64(canaryBucket(userName)) < rollout.percent*canaryBuckets/100
+}
+
+// boundToCanary reports whether a user's registration is bound to the canary circuit
+func (s *Server) boundToCanary(user store.User) bool {
+	return s.canary != nil && user.CircuitVersion == s.canary.composition.Version()
+}
+
+// requestedCircuit is the circuit besides the configured one a request for a circuit or its keys
+// names: with ?tenant= the one tenant_circuits pins the tenant to, with ?key_id= the canary's once
+// it is set up, and with ?user_name= the canary when new registrations of the user route there.
+// It is nil for the configured circuit.
+func (s *Server) requestedCircuit(query url.Values) *tenantCircuit {
+	tenant := query.Get("tenant")
+	if pinned := s.pinnedCircuit(tenant); pinned != nil {
+		return pinned
+	}
+	if s.canary == nil {
+		return nil
+	}
+	if keyID := query.Get("key_id"); keyID != "" && keyID == s.canary.keys.id() {
+		return s.canary
+	}
+	if userName := query.Get("user_name"); userName != "" && s.routesToCanary(tenant, userName, query.Get("curve")) {
+		return s.canary
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"A2zkp-circuit/ceremony"
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// setupTranscript is the published record of the setup ceremony a key version came from
+type setupTranscript struct {
+	manifest   ceremony.Manifest
+	transcript []byte
+}
+
+// CeremonyResponse is the manifest of the setup ceremony of a key version
+type CeremonyResponse struct {
+	ceremony.Manifest
+	KeyID string `json:"key_id"` // KeyID is the key version the ceremony produced
+}
+
+// loadSetupTranscript reads the ceremony files keygen -ceremony writes next to the keys, refusing
+// ones for other keys; it returns nil for keys of a single-party setup, which have none
+func loadSetupTranscript(fsys fs.FS, verifyingKey groth16.VerifyingKey) (*setupTranscript, error) {
+	encoded, readErr := fs.ReadFile(fsys, ceremony.ManifestFile)
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	setup := &setupTranscript{}
+	if decodeErr := json.Unmarshal(encoded, &setup.manifest); decodeErr != nil {
+		return nil, fmt.Errorf("parsing %s: %w", ceremony.ManifestFile, decodeErr)
+	}
+	var transcriptErr error
+	if setup.transcript, transcriptErr = fs.ReadFile(fsys, ceremony.TranscriptFile); transcriptErr != nil {
+		return nil, transcriptErr
+	}
+	// Replaying the transcript is left to those checking it; serving one for other keys is caught here
+	hash, hashErr := verifier.KeyHash(verifyingKey)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	if setup.manifest.VerifyingKeyHash != hash {
+		return nil, fmt.Errorf("%s is for the verifying key %s, not %s", ceremony.ManifestFile, setup.manifest.VerifyingKeyHash, hash)
+	}
+	return setup, nil
+}
+
+// save writes the ceremony files into dir, next to the keys they produced
+func (t *setupTranscript) save(dir string) error {
+	encoded, encodeErr := json.MarshalIndent(t.manifest, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if writeErr := os.WriteFile(filepath.Join(dir, ceremony.TranscriptFile), t.transcript, 0o644); writeErr != nil {
+		return writeErr
+	}
+	return os.WriteFile(filepath.Join(dir, ceremony.ManifestFile), append(encoded, '\n'), 0o644)
+}
+
+// requestedTranscript resolves the key version of a ceremony request, answering 404 for keys
+// that no ceremony produced
+func (s *Server) requestedTranscript(w http.ResponseWriter, r *http.Request) (*keyVersion, bool) {
+	version, ok := s.requestedCurveKeyVersion(w, r)
+	if !ok {
+		return nil, false
+	}
+	if version.keys.transcript == nil {
+		writeProblem(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Key version %s comes from a single-party setup, with no ceremony transcript", version.ID))
+		return nil, false
+	}
+	return version, true
+}
+
+// ceremonyHandler publishes the contributions to the setup ceremony of a key version, with the
+// participants' attestations
+func (s *Server) ceremonyHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := s.requestedTranscript(w, r)
+	if !ok {
+		return
+	}
+	s.writeCachedResponse(w, r, CeremonyResponse{Manifest: version.keys.transcript.manifest, KeyID: version.ID})
+}
+
+// ceremonyTranscriptHandler serves the transcript of the setup ceremony of a key version, for
+// ceremony.Verify to replay against the keys
+func (s *Server) ceremonyTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := s.requestedTranscript(w, r)
+	if !ok || s.notModified(w, r, keyETag(version.ID, "transcript"), r.URL.Query().Has("key_id")) {
+		return
+	}
+	writeKeyBytes(w, "application/octet-stream", version.keys.transcript.transcript)
+}
+
+// runCeremonyCommand implements the "ceremony" subcommand: add one participant's contribution to
+// the setup ceremony in a directory, starting it when the directory holds none
+func runCeremonyCommand(args []string) error {
+	flags := flag.NewFlagSet("ceremony", flag.ExitOnError)
+	dir := flags.String("dir", "ceremony", "directory holding the ceremony; pass it from participant to participant")
+	configPath := flags.String("config", "", "configuration file selecting the circuit")
+	tenant := flags.String("tenant", "", "set up the circuit tenant_circuits pins this tenant to instead")
+	phase := flags.Int("phase", 1, "phase to contribute to: 1 (powers of tau) or 2 (circuit-specific), which closes phase 1")
+	participant := flags.String("participant", "", "name the contribution is published under")
+	attestation := flags.String("attestation", "", "statement published with the contribution, such as how the randomness was made and destroyed")
+	flags.Parse(args)
+
+	cfg, configErr := LoadConfig(*configPath)
+	if configErr != nil {
+		return configErr
+	}
+	if *tenant != "" {
+		composition, pinned := cfg.pinnedComposition(*tenant)
+		if !pinned {
+			return fmt.Errorf("tenant_circuits doesn't pin tenant %q", *tenant)
+		}
+		cfg.Circuit = composition
+	}
+	ccs, compileErr := cfg.Circuit.CompileOn(circuit.Curve)
+	if compileErr != nil {
+		return fmt.Errorf("compiling circuit: %w", compileErr)
+	}
+	setup, openErr := ceremony.Open(*dir, ccs)
+	if errors.Is(openErr, fs.ErrNotExist) {
+		log.Printf("Starting the setup ceremony of circuit %s in %s", cfg.Circuit.Version(), *dir)
+		setup, openErr = ceremony.New(ccs, cfg.Circuit.Version())
+	}
+	if openErr != nil {
+		return openErr
+	}
+	if setup.Manifest.CircuitVersion != cfg.Circuit.Version() {
+		return fmt.Errorf("the ceremony in %s sets up circuit %s but the configured circuit is %s", *dir, setup.Manifest.CircuitVersion, cfg.Circuit.Version())
+	}
+	contribution, contributeErr := setup.Contribute(*phase, *participant, *attestation)
+	if contributeErr != nil {
+		return contributeErr
+	}
+	if saveErr := setup.Save(*dir); saveErr != nil {
+		return saveErr
+	}
+	log.Printf("Contribution %d to phase %d recorded in %s, hash %s", len(setup.Manifest.Contributions), contribution.Phase, *dir, contribution.Hash)
+	return nil
+}
+
+// ceremonyKeys extracts the keys of the ceremony in dir, for keygen -ceremony
+func ceremonyKeys(ctx context.Context, dir string, composition circuit.Composition) (*circuitKeys, error) {
+	ccs, compileErr := composition.CompileOn(circuit.Curve)
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling circuit: %w", compileErr)
+	}
+	setup, openErr := ceremony.Open(dir, ccs)
+	if openErr != nil {
+		return nil, fmt.Errorf("opening the ceremony in %s: %w", dir, openErr)
+	}
+	if setup.Manifest.CircuitVersion != composition.Version() {
+		return nil, fmt.Errorf("the ceremony in %s sets up circuit %s but the configured circuit is %s", dir, setup.Manifest.CircuitVersion, composition.Version())
+	}
+	provingKey, verifyingKey, keysErr := setup.Keys()
+	if keysErr != nil {
+		return nil, keysErr
+	}
+	logf(ctx, "Extracted the keys of circuit %s from %d ceremony contributions", composition.Version(), len(setup.Manifest.Contributions))
+	return &circuitKeys{
+		ccs:          ccs,
+		provingKey:   provingKey,
+		verifyingKey: verifyingKey,
+		transcript:   &setupTranscript{manifest: setup.Manifest, transcript: setup.Transcript()},
+	}, nil
+}
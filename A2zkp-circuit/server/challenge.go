@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"A2zkp-circuit/circuit"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrChallengeNotFound is returned when a nonce was never issued, was already used, or has expired
+var ErrChallengeNotFound = errors.New("challenge not found or expired")
+
+// challenge is an outstanding nonce issued to a user
+type challenge struct {
+	userName  string
+	expiresAt time.Time
+}
+
+// challengeStore keeps issued nonces until they are consumed or expire; in stateless mode they
+// live in Redis, so a nonce issued by one replica can be consumed by another
+type challengeStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	random     io.Reader // random is where nonces are drawn from, crypto/rand outside deterministic mode
+	challenges map[string]challenge
+	shared     *sharedState // shared is nil outside stateless mode
+	pool       *noncePool   // pool is nil when nonces are drawn as they are issued
+}
+
+// noncePool holds nonces drawn ahead of time by a background goroutine, which replenishes it as
+// they are taken, so a login storm doesn't queue on the random source
+type noncePool struct {
+	nonces chan *big.Int
+	misses atomic.Uint64 // misses counts the nonces issued while the pool was empty
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newChallengeStore creates a store whose nonces, drawn from random, stay valid for ttl. With a
+// poolSize, up to that many nonces are drawn ahead of time.
+func newChallengeStore(ttl time.Duration, random io.Reader, shared *sharedState, poolSize int) *challengeStore {
+	s := &challengeStore{ttl: ttl, random: random, challenges: make(map[string]challenge), shared: shared}
+	if poolSize > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.pool = &noncePool{nonces: make(chan *big.Int, poolSize), cancel: cancel, done: make(chan struct{})}
+		go s.replenish(ctx)
+	}
+	return s
+}
+
+// replenish keeps the nonce pool full until ctx is done
+func (s *challengeStore) replenish(ctx context.Context) {
+	defer close(s.pool.done)
+	for {
+		nonce, randErr := s.draw()
+		if randErr != nil {
+			log.Printf("Drawing nonces ahead of time failed: %v", randErr)
+			return
+		}
+		select {
+		case s.pool.nonces <- nonce:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// draw draws a random nonce in the circuit's scalar field
+func (s *challengeStore) draw() (*big.Int, error) {
+	return rand.Int(s.random, circuit.Curve.ScalarField())
+}
+
+// next takes a nonce from the pool, drawing one when it is empty or there is none
+func (s *challengeStore) next() (*big.Int, error) {
+	if s.pool == nil {
+		return s.draw()
+	}
+	select {
+	case nonce := <-s.pool.nonces:
+		return nonce, nil
+	default:
+		s.pool.misses.Add(1)
+		return s.draw()
+	}
+}
+
+// poolDepth reports how many nonces are drawn ahead and how many were issued while there were none
+func (s *challengeStore) poolDepth() (depth int, misses uint64) {
+	if s.pool == nil {
+		return 0, 0
+	}
+	return len(s.pool.nonces), s.pool.misses.Load()
+}
+
+// close stops replenishing the nonce pool
+func (s *challengeStore) close() {
+	if s.pool == nil {
+		return
+	}
+	s.pool.cancel()
+	<-s.pool.done
+}
+
+// issue creates a fresh random nonce in the circuit's scalar field for the given user
+func (s *challengeStore) issue(ctx context.Context, userName string) (*big.Int, time.Time, error) {
+	nonce, randErr := s.next()
+	if randErr != nil {
+		return nil, time.Time{}, randErr
+	}
+	if s.shared != nil {
+		return s.issueShared(ctx, userName, nonce)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt := time.Now().Add(s.ttl)
+	s.pruneLocked()
+	s.challenges[nonce.String()] = challenge{userName: userName, expiresAt: expiresAt}
+	return nonce, expiresAt, nil
+}
+
+// issueShared records nonce in Redis. The nonce's key expires by itself; the user's set, kept for
+// forgetUser, lives as long as its newest nonce.
+func (s *challengeStore) issueShared(ctx context.Context, userName string, nonce *big.Int) (*big.Int, time.Time, error) {
+	s.mu.Lock()
+	ttl := s.ttl
+	s.mu.Unlock()
+	userKey := s.shared.key("challenges", userName)
+	expiresAt := time.Now().Add(ttl)
+	_, issueErr := s.shared.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.shared.key("challenge", nonce.String()), userName, ttl)
+		pipe.SAdd(ctx, userKey, nonce.String())
+		pipe.PExpire(ctx, userKey, ttl)
+		return nil
+	})
+	if issueErr != nil {
+		return nil, time.Time{}, issueErr
+	}
+	return nonce, expiresAt, nil
+}
+
+// setTTL changes how long nonces issued from now on stay valid
+func (s *challengeStore) setTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// consume removes a nonce, succeeding only if it was issued to userName and has not expired
+func (s *challengeStore) consume(ctx context.Context, userName string, nonce *big.Int) error {
+	if s.shared != nil {
+		key := s.shared.key("challenge", nonce.String())
+		return s.shared.watch(ctx, func(tx *redis.Tx) error {
+			issuedTo, getErr := tx.Get(ctx, key).Result()
+			switch {
+			case errors.Is(getErr, redis.Nil):
+				return ErrChallengeNotFound
+			case getErr != nil:
+				return getErr
+			case issuedTo != userName:
+				return ErrChallengeNotFound
+			}
+			_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				pipe.SRem(ctx, s.shared.key("challenges", userName), nonce.String())
+				return nil
+			})
+			return execErr
+		}, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nonce.String()
+	issued, exists := s.challenges[key]
+	if !exists || issued.userName != userName || time.Now().After(issued.expiresAt) {
+		return ErrChallengeNotFound
+	}
+	delete(s.challenges, key)
+	return nil
+}
+
+// peek succeeds, as consume would, if a nonce was issued to userName and has not expired, but leaves it outstanding
+func (s *challengeStore) peek(ctx context.Context, userName string, nonce *big.Int) error {
+	if s.shared != nil {
+		issuedTo, getErr := s.shared.client.Get(ctx, s.shared.key("challenge", nonce.String())).Result()
+		switch {
+		case errors.Is(getErr, redis.Nil):
+			return ErrChallengeNotFound
+		case getErr != nil:
+			return getErr
+		case issuedTo != userName:
+			return ErrChallengeNotFound
+		}
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	issued, exists := s.challenges[nonce.String()]
+	if !exists || issued.userName != userName || time.Now().After(issued.expiresAt) {
+		return ErrChallengeNotFound
+	}
+	return nil
+}
+
+// forgetUser drops every nonce outstanding for userName and returns them
+func (s *challengeStore) forgetUser(ctx context.Context, userName string) ([]string, error) {
+	if s.shared != nil {
+		userKey := s.shared.key("challenges", userName)
+		var nonces []string
+		forgetErr := s.shared.watch(ctx, func(tx *redis.Tx) error {
+			members, membersErr := tx.SMembers(ctx, userKey).Result()
+			if membersErr != nil {
+				return membersErr
+			}
+			nonces = members
+			_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, userKey)
+				for _, nonce := range members {
+					pipe.Del(ctx, s.shared.key("challenge", nonce))
+				}
+				return nil
+			})
+			return execErr
+		}, userKey)
+		return nonces, forgetErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var nonces []string
+	for key, issued := range s.challenges {
+		if issued.userName == userName {
+			nonces = append(nonces, key)
+			delete(s.challenges, key)
+		}
+	}
+	return nonces, nil
+}
+
+// pruneLocked drops expired nonces; the caller must hold s.mu
+func (s *challengeStore) pruneLocked() {
+	now := time.Now()
+	for key, issued := range s.challenges {
+		if now.After(issued.expiresAt) {
+			delete(s.challenges, key)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/ntp"
+)
+
+// TimeResponse is the body of GET /v1/time: the server's clock, for clients to align theirs with
+// before building a witness over a timestamp such as a group epoch
+type TimeResponse struct {
+	Time       time.Time `json:"time"`
+	UnixMillis int64     `json:"unix_millis"`
+	// ClockSkewSeconds is clock.skew: how far off a client's clock may be and its proofs still verify
+	ClockSkewSeconds float64 `json:"clock_skew_seconds"`
+	// ClockOffsetSeconds is how far the server's clock was behind clock.ntp_server's at startup;
+	// absent when it wasn't checked
+	ClockOffsetSeconds *float64 `json:"clock_offset_seconds,omitempty"`
+	// Epoch, EpochEndsAt and EpochSeconds describe the current group epoch, when groups are enabled
+	Epoch        uint64     `json:"epoch,omitempty"`
+	EpochEndsAt  *time.Time `json:"epoch_ends_at,omitempty"`
+	EpochSeconds int64      `json:"epoch_seconds,omitempty"`
+}
+
+// validate checks the skew
+func (c ClockConfig) validate() error {
+	if c.Skew.Duration < 0 {
+		return fmt.Errorf("clock.skew must not be negative")
+	}
+	return nil
+}
+
+// checkClock asks clock.ntp_server for the time and returns how far the local clock is behind it.
+// A clock off by more than clock.skew fails startup, since proofs of honest clients would fail
+// against it; an unreachable server is only logged, with checked false.
+func checkClock(ctx context.Context, cfg ClockConfig) (offset time.Duration, checked bool, err error) {
+	if cfg.NTPServer == "" {
+		return 0, false, nil
+	}
+	response, queryErr := ntp.Query(ctx, cfg.NTPServer)
+	if queryErr != nil {
+		log.Printf("Skipping the clock check: %v", queryErr)
+		return 0, false, nil
+	}
+	if response.Offset.Abs() > cfg.Skew.Duration {
+		return 0, false, fmt.Errorf("clock is %s off %s, more than clock.skew %s", response.Offset, cfg.NTPServer, cfg.Skew.Duration)
+	}
+	log.Printf("Clock is %s off %s (stratum %d, round trip %s)", response.Offset, cfg.NTPServer, response.Stratum, response.RTT)
+	return response.Offset, true, nil
+}
+
+// timeHandler reports the server's time, the skew it tolerates and the current group epoch
+func (s *Server) timeHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	response := TimeResponse{
+		Time:               now,
+		UnixMillis:         now.UnixMilli(),
+		ClockSkewSeconds:   s.cfg.Clock.Skew.Seconds(),
+		ClockOffsetSeconds: s.clockOffset,
+	}
+	if s.groups != nil {
+		epoch := s.groups.epochAt(now)
+		end := s.groups.epochEnd(epoch)
+		response.Epoch, response.EpochEndsAt = epoch, &end
+		response.EpochSeconds = int64(s.groups.epoch / time.Second)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, http.StatusOK, response)
+}
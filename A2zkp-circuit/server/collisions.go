@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"A2zkp-circuit/store"
+)
+
+// Values of duplicate_commitments
+const (
+	duplicatesAllow  = "allow"  // duplicatesAllow stores a commitment whoever else holds it
+	duplicatesReject = "reject" // duplicatesReject refuses it, for the registrant to pick another secret
+	duplicatesResalt = "resalt" // duplicatesResalt refuses it, for the registrant to stretch the same secret under a fresh salt
+)
+
+// CommitmentCollision is a commitment held by more than one user: they registered the same
+// secret, with the same salt if any
+type CommitmentCollision struct {
+	// Fingerprint tells collisions apart without disclosing the commitment: the first 8 bytes of its
+	// SHA-256, in hex
+	Fingerprint string   `json:"fingerprint"`
+	Users       []string `json:"users"`    // Users lists the users holding the commitment, by name
+	Unsalted    bool     `json:"unsalted"` // Unsalted is set when none of them stretched the secret under a salt
+}
+
+// CommitmentCollisions is the report of GET /admin/commitments/collisions
+type CommitmentCollisions struct {
+	Collisions []CommitmentCollision `json:"collisions"`
+	Users      int                   `json:"users"` // Users adds up the users of the collisions
+}
+
+// validateDuplicates checks a duplicate_commitments setting
+func validateDuplicates(mode string) error {
+	switch mode {
+	case "", duplicatesAllow, duplicatesReject, duplicatesResalt:
+		return nil
+	}
+	return fmt.Errorf("duplicate_commitments %q is not %s, %s or %s", mode, duplicatesAllow, duplicatesReject, duplicatesResalt)
+}
+
+// checksDuplicates reports whether duplicate_commitments refuses commitments other users hold
+func (s *Server) checksDuplicates() bool {
+	return s.cfg.DuplicateCommitments != duplicatesAllow && s.cfg.DuplicateCommitments != ""
+}
+
+// commitmentHolders maps each active commitment of the registrations that aren't soft-deleted to
+// the users holding it, in name order. Under commitment_blinding the keys are blinded, those of
+// registrations stored before it included.
+func (s *Server) commitmentHolders(ctx context.Context) (map[string][]store.User, error) {
+	users, listErr := s.store.ListUsers(ctx)
+	if listErr != nil {
+		return nil, fmt.Errorf("listing users: %w", listErr)
+	}
+	holders := make(map[string][]store.User)
+	for _, user := range users {
+		if user.Deleted() {
+			continue
+		}
+		for _, stored := range user.ActiveCommitments() {
+			commitment := s.blinder.blind(stored)
+			if held := holders[commitment]; len(held) == 0 || held[len(held)-1].UserName != user.UserName {
+				holders[commitment] = append(held, user)
+			}
+		}
+	}
+	return holders, nil
+}
+
+// duplicateProblem is the error refusing a registration whose commitment another user holds, or
+// nil when duplicate_commitments allows it or no one else does
+func (s *Server) duplicateProblem(holders map[string][]store.User, req RegisterRequest) error {
+	if !s.checksDuplicates() {
+		return nil
+	}
+	for _, holder := range holders[s.blinder.blind(req.CryptoCommitment)] {
+		if holder.UserName == req.UserName {
+			continue
+		}
+		if s.cfg.DuplicateCommitments == duplicatesResalt {
+			return &requestError{status: http.StatusConflict, code: codeResaltRequired, message: "Stretch the secret with a KDF of GET /v1/circuit under a fresh random salt and register again"}
+		}
+		return &requestError{status: http.StatusConflict, code: codeCommitmentReused, message: "Another user registered the same commitment; register with another secret"}
+	}
+	return nil
+}
+
+// checkDuplicate refuses a registration whose commitment another user already holds, as
+// duplicate_commitments asks. The registrant's own registration never counts, so a taken name or a
+// replaced commitment is answered as before.
+func (s *Server) checkDuplicate(ctx context.Context, req RegisterRequest) error {
+	if !s.checksDuplicates() {
+		return nil
+	}
+	holders, holdersErr := s.commitmentHolders(ctx)
+	if holdersErr != nil {
+		return &requestError{status: http.StatusInternalServerError, code: codeInternal, message: fmt.Sprintf("Error checking the commitment: %v", holdersErr)}
+	}
+	return s.duplicateProblem(holders, req)
+}
+
+// commitmentFingerprint identifies a commitment in reports without disclosing it
+func commitmentFingerprint(commitment string) string {
+	digest := sha256.Sum256([]byte(commitment))
+	return hex.EncodeToString(digest[:8])
+}
+
+// collisionsHandler reports the commitments more than one user holds in the stored data, most
+// users first. A tenant-admin only sees collisions among the users of its own tenant.
+func (s *Server) collisionsHandler(w http.ResponseWriter, r *http.Request) {
+	holders, holdersErr := s.commitmentHolders(r.Context())
+	if holdersErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing users: %v", holdersErr))
+		return
+	}
+	p := requestPrincipal(r)
+	report := CommitmentCollisions{Collisions: []CommitmentCollision{}}
+	for commitment, held := range holders {
+		collision := CommitmentCollision{Fingerprint: commitmentFingerprint(commitment), Unsalted: true}
+		for _, user := range held {
+			if p.role == RoleTenantAdmin && user.Tenant != p.tenant {
+				continue
+			}
+			collision.Users = append(collision.Users, user.UserName)
+			collision.Unsalted = collision.Unsalted && len(user.Salt) == 0
+		}
+		if len(collision.Users) > 1 {
+			report.Collisions = append(report.Collisions, collision)
+			report.Users += len(collision.Users)
+		}
+	}
+	slices.SortFunc(report.Collisions, func(a, b CommitmentCollision) int {
+		if len(a.Users) != len(b.Users) {
+			return len(b.Users) - len(a.Users)
+		}
+		return slices.Compare(a.Users, b.Users)
+	})
+	writeResponse(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/test/unsafekzg"
+)
+
+// Proof systems a backend comparison measures
+const (
+	backendGroth16 = "groth16"
+	backendPLONK   = "plonk"
+)
+
+// BackendComparison is the report of POST /admin/backends/compare: what each proof system costs
+// for the configured circuit on this machine
+type BackendComparison struct {
+	CircuitVersion string          `json:"circuit_version"`
+	Curve          string          `json:"curve"`
+	Backends       []BackendReport `json:"backends"` // Backends lists groth16 then plonk
+	// Note warns that the figures come from throwaway keys; PLONK's come from an unsafe test SRS
+	Note string `json:"note"`
+}
+
+// BackendReport measures one proof system over a single setup, proof and verification
+type BackendReport struct {
+	Backend           string  `json:"backend"`     // Backend is "groth16" or "plonk"
+	Constraints       int     `json:"constraints"` // Constraints counts R1CS constraints for groth16 and PLONK gates for plonk
+	CompileSeconds    float64 `json:"compile_seconds"`
+	SetupSeconds      float64 `json:"setup_seconds"`
+	ProveSeconds      float64 `json:"prove_seconds"`
+	VerifySeconds     float64 `json:"verify_seconds"`
+	ProofBytes        int64   `json:"proof_bytes"` // ProofBytes and the key sizes are those of gnark's binary encoding
+	ProvingKeyBytes   int64   `json:"proving_key_bytes"`
+	VerifyingKeyBytes int64   `json:"verifying_key_bytes"`
+}
+
+// comparisonNote is the note of every BackendComparison
+const comparisonNote = "Keys are generated for this comparison and discarded. PLONK's setup uses an unsafe test SRS, " +
+	"so setup_seconds leaves out a real ceremony; its verifying key could not be deployed."
+
+// compareBackendsHandler compiles, sets up, proves and verifies the configured circuit once with
+// each proof system and reports the timings and sizes. It runs on the worker pool, one comparison
+// at a time.
+func (s *Server) compareBackendsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.comparisonMu.TryLock() {
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	}
+	defer s.comparisonMu.Unlock()
+
+	var comparison BackendComparison
+	var compareErr error
+	poolErr := s.pool.Do(r.Context(), func() {
+		comparison, compareErr = compareBackends(r.Context(), s.cfg.Circuit)
+	})
+	switch {
+	case errors.Is(poolErr, ErrPoolBusy):
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	case poolErr != nil:
+		writeProblem(w, http.StatusServiceUnavailable, codeTimeout, fmt.Sprintf("Comparison abandoned: %v", poolErr))
+		return
+	case compareErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error comparing backends: %v", compareErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, comparison)
+}
+
+// compareBackends measures Groth16 then PLONK for a composition over Curve. Setups can't be
+// interrupted, so ctx is only checked between the two.
+func compareBackends(ctx context.Context, composition circuit.Composition) (BackendComparison, error) {
+	userSecret, secretErr := comparisonSecret(composition)
+	if secretErr != nil {
+		return BackendComparison{}, secretErr
+	}
+	fullWitness, witnessErr := composition.NewWitness(userSecret, big.NewInt(1))
+	userSecret.Zero()
+	if witnessErr != nil {
+		return BackendComparison{}, witnessErr
+	}
+	defer circuit.WipeWitness(fullWitness)
+	publicWitness, publicErr := fullWitness.Public()
+	if publicErr != nil {
+		return BackendComparison{}, publicErr
+	}
+
+	groth16Report, groth16Err := measureGroth16(composition, fullWitness, publicWitness)
+	if groth16Err != nil {
+		return BackendComparison{}, fmt.Errorf("%s: %w", backendGroth16, groth16Err)
+	}
+	if ctx.Err() != nil {
+		return BackendComparison{}, ctx.Err()
+	}
+	plonkReport, plonkErr := measurePLONK(composition, fullWitness, publicWitness)
+	if plonkErr != nil {
+		return BackendComparison{}, fmt.Errorf("%s: %w", backendPLONK, plonkErr)
+	}
+	return BackendComparison{
+		CircuitVersion: composition.Version(),
+		Curve:          circuit.Curve.String(),
+		Backends:       []BackendReport{groth16Report, plonkReport},
+		Note:           comparisonNote,
+	}, nil
+}
+
+// comparisonSecret is the secret the comparison proves knowledge of: the lower end of the
+// composition's range, or 1 without one
+func comparisonSecret(composition circuit.Composition) (*secret.Buffer, error) {
+	value := "1"
+	if minText, _, hasRange := strings.Cut(composition.Range, ".."); hasRange {
+		value = strings.TrimSpace(minText)
+	}
+	return secret.Parse([]byte(value))
+}
+
+// measureGroth16 runs the Groth16 steps a deployment goes through once each
+func measureGroth16(composition circuit.Composition, fullWitness, publicWitness witness.Witness) (BackendReport, error) {
+	report := BackendReport{Backend: backendGroth16}
+	var ccs constraint.ConstraintSystem
+	var provingKey groth16.ProvingKey
+	var verifyingKey groth16.VerifyingKey
+	var proof groth16.Proof
+	steps := []timedStep{
+		{&report.CompileSeconds, func() (compileErr error) { ccs, compileErr = composition.Compile(); return }},
+		{&report.SetupSeconds, func() (setupErr error) { provingKey, verifyingKey, setupErr = groth16.Setup(ccs); return }},
+		{&report.ProveSeconds, func() (proveErr error) { proof, proveErr = groth16.Prove(ccs, provingKey, fullWitness); return }},
+		{&report.VerifySeconds, func() error { return groth16.Verify(proof, verifyingKey, publicWitness) }},
+	}
+	if stepErr := timeSteps(steps); stepErr != nil {
+		return BackendReport{}, stepErr
+	}
+	report.Constraints = ccs.GetNbConstraints()
+	report.ProofBytes, report.ProvingKeyBytes, report.VerifyingKeyBytes = encodedSize(proof), encodedSize(provingKey), encodedSize(verifyingKey)
+	return report, nil
+}
+
+// measurePLONK runs the PLONK steps once each. The SRS is generated on the spot, within setup.
+func measurePLONK(composition circuit.Composition, fullWitness, publicWitness witness.Witness) (BackendReport, error) {
+	report := BackendReport{Backend: backendPLONK}
+	var ccs constraint.ConstraintSystem
+	var provingKey plonk.ProvingKey
+	var verifyingKey plonk.VerifyingKey
+	var proof plonk.Proof
+	setup := func() error {
+		canonical, lagrange, srsErr := unsafekzg.NewSRS(ccs)
+		if srsErr != nil {
+			return srsErr
+		}
+		var setupErr error
+		provingKey, verifyingKey, setupErr = plonk.Setup(ccs, canonical, lagrange)
+		return setupErr
+	}
+	steps := []timedStep{
+		{&report.CompileSeconds, func() (compileErr error) { ccs, compileErr = composition.CompileSparse(); return }},
+		{&report.SetupSeconds, setup},
+		{&report.ProveSeconds, func() (proveErr error) { proof, proveErr = plonk.Prove(ccs, provingKey, fullWitness); return }},
+		{&report.VerifySeconds, func() error { return plonk.Verify(proof, verifyingKey, publicWitness) }},
+	}
+	if stepErr := timeSteps(steps); stepErr != nil {
+		return BackendReport{}, stepErr
+	}
+	report.Constraints = ccs.GetNbConstraints()
+	report.ProofBytes, report.ProvingKeyBytes, report.VerifyingKeyBytes = encodedSize(proof), encodedSize(provingKey), encodedSize(verifyingKey)
+	return report, nil
+}
+
+// timedStep is a step of a comparison and where its duration is recorded
+type timedStep struct {
+	seconds *float64
+	run     func() error
+}
+
+// timeSteps runs each step in turn, recording how long it took, and stops at the first failure
+func timeSteps(steps []timedStep) error {
+	for _, step := range steps {
+		started := time.Now()
+		if runErr := step.run(); runErr != nil {
+			return runErr
+		}
+		*step.seconds = time.Since(started).Seconds()
+	}
+	return nil
+}
+
+// encodedSize is the length of an object's gnark binary encoding
+func encodedSize(object io.WriterTo) int64 {
+	size, _ := object.WriteTo(io.Discard)
+	return size
+}
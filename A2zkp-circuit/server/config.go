@@ -0,0 +1,819 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+)
+
+// Config holds the runtime settings of the commitment server
+type Config struct {
+	Addr         string   `json:"addr"`          // Addr is the TCP address the HTTP server listens on; empty serves on unix_socket only
+	DatabasePath string   `json:"database_path"` // DatabasePath is the SQLite file backing the store; empty keeps users in memory
+	AdminToken   string   `json:"admin_token"`   // AdminToken is the bearer token required on /admin routes; empty disables them
+	ChallengeTTL Duration `json:"challenge_ttl"` // ChallengeTTL is how long an issued login nonce stays valid, e.g. "2m"
+	WasmDir      string   `json:"wasm_dir"`      // WasmDir holds prover.wasm and wasm_exec.js for /v1/wasm; empty disables it
+	// ReplayCacheTTL is how long a byte-identical copy of an accepted login proof is refused; 0 disables the cache
+	ReplayCacheTTL Duration `json:"replay_cache_ttl"`
+	// VerdictCacheTTL is how long the verdict on a proof is reused for an identical submission; 0 disables the cache
+	VerdictCacheTTL Duration `json:"verdict_cache_ttl"`
+	// InteractiveDeadline is how long GET /v1/login/ws waits for the proof after sending its challenge
+	InteractiveDeadline Duration `json:"interactive_deadline"`
+	SessionTTL          Duration `json:"session_ttl"` // SessionTTL is the lifetime of session tokens issued by /v1/login/ws
+	// StepUpTTL is the lifetime of step-up tokens, which never outlive the session they elevate
+	StepUpTTL Duration `json:"step_up_ttl"`
+	// RevealUserExistence answers unknown users with 404 user_not_found and taken names with 409 user_exists;
+	// by default both get the answers a wrong proof and a fresh registration get, so user names can't be probed
+	RevealUserExistence bool `json:"reveal_user_existence"`
+	// DuplicateCommitments is what happens to a registration whose commitment another user holds,
+	// as two users with the same secret and no salt have: "allow", the default, stores it, "reject"
+	// refuses it with 409 commitment_reused and "resalt" with 409 resalt_required. Refusing tells the
+	// registrant someone else has the secret, but not who. Each check scans the registrations.
+	DuplicateCommitments string `json:"duplicate_commitments"`
+	// FailureLatency is the least time a failed login or a registration takes while user existence is hidden
+	FailureLatency Duration `json:"failure_latency"`
+
+	// UnixSocket also serves plain HTTP on a Unix domain socket at this path, e.g. for a reverse proxy on the same host
+	UnixSocket     string `json:"unix_socket"`
+	UnixSocketMode string `json:"unix_socket_mode"` // UnixSocketMode is the socket's octal file mode, e.g. "0660"
+	// InternalAddr serves /admin, /metrics, pprof, /healthz and /readyz on a separate address, e.g. "10.0.0.5:9090",
+	// and takes /admin off addr and unix_socket; bind it to an interface the public can't reach
+	InternalAddr string `json:"internal_addr"`
+	// Listeners are further addresses to serve on, each with its own TLS settings and choice of routes
+	Listeners []ListenerConfig `json:"listeners"`
+
+	ReadTimeout    Duration `json:"read_timeout"`    // ReadTimeout bounds reading a whole request, body included
+	WriteTimeout   Duration `json:"write_timeout"`   // WriteTimeout bounds writing a response; keep it above every handler timeout
+	HandlerTimeout Duration `json:"handler_timeout"` // HandlerTimeout cancels a handler's context and answers 503 once exceeded; 0 disables
+	// ReadHeaderTimeout bounds reading a request's headers, so slow clients can't hold connections open
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`        // IdleTimeout closes a kept-alive connection once no request arrives for this long
+	MaxHeaderBytes    int      `json:"max_header_bytes"`    // MaxHeaderBytes caps the request line and headers of a request
+	DisableKeepAlives bool     `json:"disable_keep_alives"` // DisableKeepAlives closes every connection after one request
+	// TCPKeepAlive is the period of keep-alive probes on accepted TCP connections; 0 keeps Go's 15s and a negative value disables them
+	TCPKeepAlive Duration `json:"tcp_keep_alive"`
+	DisableHTTP2 bool     `json:"disable_http2"` // DisableHTTP2 serves HTTP/1.1 only on TLS listeners, which otherwise negotiate HTTP/2
+	// EndpointTimeouts overrides HandlerTimeout per route pattern, e.g. {"POST /v1/verify": "5s"}
+	EndpointTimeouts map[string]Duration `json:"endpoint_timeouts"`
+
+	MaxBodyBytes     int64 `json:"max_body_bytes"`     // MaxBodyBytes caps the body of every JSON POST request
+	MaxSnapshotBytes int64 `json:"max_snapshot_bytes"` // MaxSnapshotBytes caps the snapshot uploaded to /admin/restore
+	MaxBatchBytes    int64 `json:"max_batch_bytes"`    // MaxBatchBytes caps the body of POST /v1/users:batch
+	MaxBatchSize     int   `json:"max_batch_size"`     // MaxBatchSize caps the registrations of one POST /v1/users:batch
+	// BatchChunkSize is how many consecutive registrations of a batch are stored together, all or none
+	BatchChunkSize int `json:"batch_chunk_size"`
+
+	PoolWorkers    int      `json:"pool_workers"`     // PoolWorkers caps concurrent proving/verification jobs; 0 means GOMAXPROCS
+	PoolQueueSize  int      `json:"pool_queue_size"`  // PoolQueueSize is how many jobs may wait for a worker before requests get 503
+	PoolRetryAfter Duration `json:"pool_retry_after"` // PoolRetryAfter is the Retry-After hint sent with those 503 responses
+	// PoolAdmissionQueueSize is how many login verifications may wait for room in a full queue
+	// instead of getting 503, each for at most pool_admission_wait
+	PoolAdmissionQueueSize int      `json:"pool_admission_queue_size"`
+	PoolAdmissionWait      Duration `json:"pool_admission_wait"`
+	// ChallengePoolSize is how many nonces are drawn ahead of time and replenished in the
+	// background, so bursts of challenges don't wait on the random source; ignored under
+	// deterministic_seed, whose nonces are drawn in the order they are issued
+	ChallengePoolSize int `json:"challenge_pool_size"`
+	// SelfTest runs the self-test of POST /admin/self-test at startup, once the keys are ready: a
+	// throwaway proof is made and verified, a registration stored and read back and signatures
+	// checked. While the latest self-test failed, GET /readyz answers 503, so the deploy takes no traffic.
+	SelfTest bool `json:"self_test"`
+	// BulkVerifyConcurrency caps the proofs POST /admin/verify:bulk checks at once; 0 means half of pool_workers
+	BulkVerifyConcurrency int `json:"bulk_verify_concurrency"`
+	// BatchConcurrency caps the policy proofs of a POST /v1/users:batch chunk checked at once; 0 means half of pool_workers
+	BatchConcurrency int `json:"batch_concurrency"`
+
+	// EnableProvingAPI turns on POST /v1/prove, which receives the secret; only enable it on trusted hosts
+	EnableProvingAPI bool     `json:"enable_proving_api"`
+	JobRetention     Duration `json:"job_retention"` // JobRetention is how long finished proving jobs stay retrievable
+	// ProvingMemoryBudget caps, in bytes, the memory the proving jobs admitted and not yet finished are
+	// estimated to take from their constraint counts; a job over it gets a retryable 503. 0 leaves it uncapped.
+	ProvingMemoryBudget int64 `json:"proving_memory_budget"`
+	// ProverAcceleration is "cpu" (default) or "gpu"; gpu needs a binary built with -tags icicle and falls back to CPU
+	ProverAcceleration string `json:"prover_acceleration"`
+
+	// DebugAddr enables pprof and /debug/memstats on a separate listener, e.g. "127.0.0.1:6060"; it must be loopback
+	DebugAddr string `json:"debug_addr"`
+
+	// MasterKeyID names the master key that wraps newly written data keys; empty disables encryption at rest
+	MasterKeyID string `json:"master_key_id"`
+	// MasterKeys maps master key IDs to base64-encoded 32-byte keys; retired keys stay listed until no record uses them
+	MasterKeys map[string]string `json:"master_keys"`
+
+	// ArtifactsDir loads the keygen output from disk at startup instead of running a fresh setup
+	ArtifactsDir string `json:"artifacts_dir"`
+	// ArtifactsURL loads the keygen output over HTTP(S) from a URL prefix instead, e.g. an object
+	// storage bucket every replica reads: <url>/verifying.key, and <url>/<curve>/ for curves
+	ArtifactsURL string `json:"artifacts_url"`
+	// ArtifactsHeaders are sent with every artifacts_url request, e.g. an Authorization header
+	ArtifactsHeaders map[string]string `json:"artifacts_headers"`
+	// SnarkJSVerifyingKey is the verification_key.json of an equivalent circom circuit; once set,
+	// proof requests may carry a snarkjs_proof instead of a proof
+	SnarkJSVerifyingKey string `json:"snarkjs_verifying_key"`
+	// KeyDir persists key versions added through /admin/keys so they survive restarts; empty keeps them in memory
+	KeyDir string `json:"key_dir"`
+	// KeyGracePeriod is how long a replaced key version keeps verifying proofs, e.g. "24h"
+	KeyGracePeriod Duration `json:"key_grace_period"`
+	// MetadataMaxAge is how long clients and caches may reuse the circuit descriptions and current keys
+	// before revalidating them by ETag, e.g. "5m"; keys requested by key_id are cached for good
+	MetadataMaxAge Duration `json:"metadata_max_age"`
+	// KeyProvider is "aws-kms", "pkcs11" or "vault-transit" to unseal a sealed proving key and sign tokens; empty disables it
+	KeyProvider string       `json:"key_provider"`
+	AWSKMS      AWSKMSConfig `json:"aws_kms"` // AWSKMS configures the aws-kms provider
+	PKCS11      PKCS11Config `json:"pkcs11"`  // PKCS11 configures the pkcs11 provider
+	// SigningKey references the token signing key inside the provider: a KMS key ID, an HSM key label or a transit key name
+	SigningKey string `json:"signing_key"`
+	// PreviousSigningKeys references keys in the provider that signing_key replaced before the last
+	// restart; tokens they signed keep verifying, and they stay in the JWKS until removed from here
+	PreviousSigningKeys []string `json:"previous_signing_keys"`
+
+	// Vault connects to HashiCorp Vault; values of the form "vault:<mount>/<path>#<field>" in
+	// admin_token, database_path, master_keys, pkcs11.pin, tls_cert, tls_key, listeners[].tls_cert,
+	// listeners[].tls_key, ethereum.sender_key, stateless.secret and stateless.redis.password are
+	// then read from KV v2
+	Vault VaultConfig  `json:"vault"`
+	vault *vaultClient // vault is the authenticated client once references are resolved
+
+	// TLSCertFile and TLSKeyFile serve HTTPS from PEM files on disk
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// TLSCert and TLSKey serve HTTPS from inline PEM, typically vault: references so nothing touches the disk
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// LDAP keeps registrations as attributes of the users' existing entries in a directory instead
+	// of in database_path; it is used when ldap.url is set
+	LDAP store.LDAPConfig `json:"ldap"`
+
+	// OIDC makes the server an OpenID Connect provider and OAuth2 token issuer signing with signing_key
+	OIDC OIDCConfig `json:"oidc"`
+
+	// Credentials issues W3C Verifiable Credentials, signed with signing_key, after a successful proof
+	Credentials CredentialsConfig `json:"credentials"`
+
+	// SAML issues signed SAML 2.0 responses to legacy service providers after a successful proof
+	SAML SAMLConfig `json:"saml"`
+
+	// VerdictSigning signs the verdict of every proof POST /v1/verify accepts, so services it is
+	// relayed to through intermediaries can check it themselves
+	VerdictSigning VerdictSigningConfig `json:"verdict_signing"`
+
+	// DIDs lets users register under did:key and did:web identifiers, optionally with the commitment
+	// signed by a key of the DID document, so an external wallet is the source of identity
+	DIDs DIDConfig `json:"dids"`
+
+	// TOTP adds an optional one-time password check after the proof, per tenant, for tenants that
+	// want a second factor besides the secret
+	TOTP TOTPConfig `json:"totp"`
+
+	// WebAuthn lets users bind their registration to a hardware key, whose assertion must then come
+	// with every proof
+	WebAuthn WebAuthnConfig `json:"webauthn"`
+
+	// SigningKeys manages the keys signed verdicts and webhook deliveries carry, published with the
+	// keys they replaced at /v1/signing-keys
+	SigningKeys SigningKeysConfig `json:"signing_keys"`
+
+	// Ethereum checks proofs against the Solidity verifier exported by keygen and deployed on an EVM chain
+	Ethereum EthereumConfig `json:"ethereum"`
+
+	// TrustedProxies lists the CIDRs of reverse proxies whose X-Forwarded-For names the client, e.g. ["10.0.0.0/8"]
+	TrustedProxies []string `json:"trusted_proxies"`
+	// CountryHeader names the header trusted proxies set to the client's ISO 3166-1 country code, e.g. "CF-IPCountry", for authentication policies' country rules
+	CountryHeader string `json:"country_header"`
+	// AccessControl limits the client addresses allowed on groups of routes; reloadable
+	AccessControl []AccessRule `json:"access_control"`
+	// CSRF makes browsers calling state-changing routes prove they read a CSRF cookie, e.g. for pages posting proofs made by the wasm prover
+	CSRF CSRFConfig `json:"csrf"`
+	// RateLimit caps how often one client address may call groups of routes
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Stateless keeps the state replicas must share in Redis, so any replica behind a load balancer
+	// can serve any request of a login
+	Stateless StatelessConfig `json:"stateless"`
+	// ReadOnly runs a read replica: keys are loaded, never set up or rotated, the store is opened
+	// read-only, and only verification, key and metadata routes are served, so the verify path can
+	// scale apart from the primary that registers users
+	ReadOnly bool `json:"read_only"`
+	// Anomalies flags brute-force patterns in failed logins, listed on /admin/anomalies and sent to webhooks
+	Anomalies AnomalyConfig `json:"anomalies"`
+	// StatsRetention is how long the authentication events behind /v1/stats are kept; 0 keeps them forever
+	StatsRetention Duration `json:"stats_retention"`
+	// ExpirySweepInterval is how often registrations past their expires_at are marked expired and
+	// reported, and soft-deleted users past deletion_retention purged; 0 disables the sweeper, though
+	// expired registrations and deleted users are still refused
+	ExpirySweepInterval Duration `json:"expiry_sweep_interval"`
+	// DeletionRetention is how long DELETE /v1/users/{id} keeps a soft-deleted registration, which
+	// no longer verifies, so it can be restored; 0 erases registrations at once
+	DeletionRetention Duration `json:"deletion_retention"`
+	// Groups lets members of a tenant log in anonymously, proving only that they belong to it
+	Groups GroupConfig `json:"groups"`
+	// Clock is how far clients' clocks may be off the server's for proofs over timestamps, such as
+	// group epochs, with an optional check of the server's own clock at startup
+	Clock ClockConfig `json:"clock"`
+	// Transcripts keeps the proof of every accepted login with what it verified against, for
+	// auditors to download and verify again from /admin/transcripts
+	Transcripts TranscriptConfig `json:"transcripts"`
+	// CommitmentBlinding stores a keyed hash of each user and device commitment instead of the
+	// commitment, so a leaked database can't be brute-forced for weak secrets without the pepper too
+	CommitmentBlinding CommitmentBlindingConfig `json:"commitment_blinding"`
+	// KDFs is the registry of named, versioned parameter sets a PIN or password is stretched with
+	// before it enters the circuit, served by GET /v1/circuit
+	KDFs KDFConfig `json:"kdfs"`
+	// Circuit assembles the authentication circuit from named gadgets; changing it changes the circuit
+	// version, so existing registrations, artifacts and key_dir versions no longer match
+	Circuit circuit.Composition `json:"circuit"`
+	// Curves lists the curves besides bn254 proofs of the circuit are verified on, e.g. ["bls12_381"],
+	// so registrations made on them keep working; their keys come from artifacts_dir/<curve> when
+	// present and are set up on first use otherwise
+	Curves []string `json:"curves"`
+	// TenantCircuits pins tenants to a circuit of their own, by tenant name, "-" naming the default
+	// one, so each adopts a new circuit version when it is ready. New registrations of a pinned tenant
+	// are bound to its circuit, and proofs verify against the circuit their registration is bound to.
+	// Keys come from artifacts_dir/<circuit version>, as written by keygen -tenant, when present and
+	// are set up on first use otherwise.
+	TenantCircuits map[string]circuit.Composition `json:"tenant_circuits"`
+	// CanaryCircuit rolls a new circuit version out to a share of the users of tenants on the
+	// configured circuit: their new registrations are bound to it, and their proofs verify against
+	// it from then on
+	CanaryCircuit CanaryCircuitConfig `json:"canary_circuit"`
+	// DeterministicSeed replaces the process's randomness with a stream derived from it, so setups,
+	// nonces and proofs are reproducible for golden-file tests; never set it in production
+	DeterministicSeed string `json:"deterministic_seed"`
+	// MockProver swaps Groth16 for fast fakes that prove nothing, for local development only: the
+	// server refuses it alongside TLS, key providers, stored keys or non-loopback listeners
+	MockProver bool `json:"mock_prover"`
+	// SecretPolicy makes new commitments come with a proof that their secret is strong enough
+	SecretPolicy SecretPolicyConfig `json:"secret_policy"`
+	// Webhooks receive server events as JSON POSTs, e.g. for a SOC to act on detected anomalies
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// EventBus streams registration, verification and revocation events to Kafka or NATS as
+	// versioned JSON messages, for analytics pipelines
+	EventBus EventBusConfig `json:"event_bus"`
+	// Notifications alert users by email or HTTP push to new devices, lockouts and commitment
+	// rotations on their accounts
+	Notifications NotificationsConfig `json:"notifications"`
+	// AccessLog writes a JSON line per request, without query strings, headers or bodies, which may
+	// carry secrets, tokens or proofs
+	AccessLog AccessLogConfig `json:"access_log"`
+}
+
+// AccessRule restricts the client addresses that may call a group of routes, e.g. only internal
+// CIDRs on admin or no known-bad ranges on /v1/verify; every rule covering a route applies
+type AccessRule struct {
+	// Routes is "api" (everything but /admin, metrics, /healthz and /readyz), "admin", "metrics" (/metrics and /debug)
+	// or a path prefix such as "/v1/verify"
+	Routes string   `json:"routes"`
+	Allow  []string `json:"allow"` // Allow lists the CIDRs let through; when set, every other address is turned away
+	Deny   []string `json:"deny"`  // Deny lists the CIDRs turned away, even when allow lists them
+}
+
+// CSRFConfig configures double-submit-cookie CSRF protection. Browser requests to the covered
+// state-changing routes must echo the token of the CSRF cookie in X-CSRF-Token, or a csrf_token form
+// field; requests with an Authorization header, and those from clients that aren't browsers, pass.
+type CSRFConfig struct {
+	// Routes lists the groups of routes protected, each "api", "admin" or a path prefix as in access_control,
+	// e.g. ["/v1/users", "/v1/verify", "/oauth/authorize"]; empty disables CSRF protection
+	Routes []string `json:"routes"`
+	// Secret signs the tokens, so a cookie planted by a sibling domain is refused; replicas must share it.
+	// Empty generates one that changes on restart.
+	Secret string `json:"secret"`
+}
+
+// RateLimitConfig configures per-client-address rate limits over sliding windows. The memory backend
+// counts on each instance alone, which a load balancer spreading requests over replicas multiplies;
+// redis shares the counts between them.
+type RateLimitConfig struct {
+	// Backend is "memory" or "redis"; it defaults to memory, or in stateless mode to the stateless Redis
+	Backend string      `json:"backend"`
+	Redis   RedisConfig `json:"redis"`
+	// Rules are the limits; a request counts against every rule covering its route
+	Rules []RateLimitRule `json:"rules"`
+}
+
+// RateLimitRule allows one client address requests calls to a group of routes per window
+type RateLimitRule struct {
+	// Routes is "api", "admin", "metrics" or a path prefix as in access_control, e.g. "/v1/verify"
+	Routes   string   `json:"routes"`
+	Requests int      `json:"requests"`
+	Window   Duration `json:"window"` // Window is the span requests are counted over, e.g. "1m"
+}
+
+// StatelessConfig configures stateless mode. Nonces, the replay cache, OIDC codes, anomaly counts,
+// sessions and the user store live in Redis, and keys come from artifacts every replica loads, so
+// replicas behind a load balancer behave the same without sticky sessions. Features whose state
+// can't be shared that way, groups, secret_policy, enable_proving_api and adding key versions through
+// /admin/keys, are refused.
+type StatelessConfig struct {
+	Enabled bool        `json:"enabled"`
+	Redis   RedisConfig `json:"redis"`
+	// Secret must be the same on every replica: the decoy salts of unknown users, the CSRF tokens
+	// and, without a signing_key, the token signing key are derived from it
+	Secret string `json:"secret"`
+}
+
+// RedisConfig locates a Redis server: the one the redis rate limit backend keeps its counts in, or
+// the one of stateless mode
+type RedisConfig struct {
+	Addr     string `json:"addr"`     // Addr is the server's host:port, e.g. "redis:6379"
+	Username string `json:"username"` // Username is the ACL user; empty authenticates with password alone
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	TLS      bool   `json:"tls"`
+	// KeyPrefix starts every key written, so deployments can share a server
+	KeyPrefix string `json:"key_prefix"`
+	// Timeout bounds each call. When Redis fails or is too slow rate limits let requests through, and
+	// log it; in stateless mode the requests needing it fail.
+	Timeout Duration `json:"timeout"`
+	// PoolSize is how many connections are kept open
+	PoolSize int `json:"pool_size"`
+}
+
+// AnomalyConfig configures the detection of brute-force patterns over a sliding window of login attempts
+type AnomalyConfig struct {
+	Window Duration `json:"window"` // Window is how far back attempts are counted, e.g. "10m"; 0 disables detection
+	// UserFailures flags brute_force once one user's proofs fail this often within the window
+	UserFailures int `json:"user_failures"`
+	// SprayUsers flags password_spray once one client address fails logins for this many different users
+	SprayUsers int `json:"spray_users"`
+	// StuffingFailureRatio flags credential_stuffing once this share of all logins in the window fail,
+	// counted after at least stuffing_min_attempts attempts
+	StuffingFailureRatio float64 `json:"stuffing_failure_ratio"`
+	StuffingMinAttempts  int     `json:"stuffing_min_attempts"`
+	Retained             int     `json:"retained"` // Retained is how many detected anomalies /admin/anomalies keeps
+}
+
+// WebhookConfig is one endpoint server events are posted to
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Secret signs every body with HMAC-SHA256, sent as "X-OFA-Signature: sha256=<hex>"; empty sends them unsigned
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // Events limits the event types delivered, e.g. ["anomaly.detected"]; empty delivers all
+}
+
+// EventBusConfig configures the message bus authentication events are published to
+type EventBusConfig struct {
+	Driver string `json:"driver"` // Driver is "kafka" or "nats"; empty publishes nothing
+	// Brokers are the host:port of the Kafka brokers to fetch the cluster metadata from, or of the NATS servers
+	Brokers []string `json:"brokers"`
+	// Topic is the Kafka topic every event is produced to, keyed by user name so each user's events
+	// stay in order; on NATS each event goes to the subject "<topic>.<type>", e.g. "ofa.events.session.revoked"
+	Topic    string `json:"topic"`
+	Username string `json:"username"` // Username authenticates with SASL PLAIN on Kafka, or as the NATS user
+	Password string `json:"password"`
+	Token    string `json:"token"` // Token authenticates to NATS instead of a user
+	TLS      bool   `json:"tls"`
+	// Events limits the event types published, e.g. ["verification.completed"]; empty publishes all
+	Events []string `json:"events"`
+	// BufferSize is how many events may wait to be published; further ones are dropped and counted
+	BufferSize int      `json:"buffer_size"`
+	Timeout    Duration `json:"timeout"` // Timeout bounds each attempt at publishing a batch
+}
+
+// NotificationsConfig configures the channels users hear of security events on their accounts over
+type NotificationsConfig struct {
+	// Channels notify the users of every tenant without channels of its own
+	Channels []NotificationChannel `json:"channels"`
+	// Tenants gives tenants channels of their own, by tenant name, "-" naming the default one; an
+	// empty list notifies a tenant's users of nothing
+	Tenants map[string][]NotificationChannel `json:"tenants"`
+}
+
+// NotificationChannel is one way of notifying users: email through an SMTP server, or JSON POSTs
+// to an HTTP endpoint such as a push gateway
+type NotificationChannel struct {
+	Type string `json:"type"` // Type is "email" or "http"
+	// Events limits the notices sent, e.g. ["account.locked"]; empty sends "device.added",
+	// "account.locked" and "commitment.rotated"
+	Events []string `json:"events"`
+	// To is a Go text/template over the notice rendering the recipient: the address for email, e.g.
+	// "{{.UserName}}@example.com", or "{{.UserName}}" where user names are addresses; http channels
+	// post it as "to", the user name when empty
+	To string `json:"to"`
+	// Templates overrides the subject and body of notices, by notice type, as Go text/templates over
+	// the notice; what they leave out keeps the built-in wording
+	Templates map[string]NotificationTemplate `json:"templates"`
+
+	SMTPAddr     string `json:"smtp_addr"`     // SMTPAddr is the mail server's host:port
+	SMTPUsername string `json:"smtp_username"` // SMTPUsername, when set, authenticates with PLAIN and SMTPPassword
+	SMTPPassword string `json:"smtp_password"`
+	// SMTPTLS speaks TLS from the start, as on port 465; otherwise STARTTLS is used when offered
+	SMTPTLS bool   `json:"smtp_tls"`
+	From    string `json:"from"` // From is the sender of the mails, e.g. "Security <security@example.com>"
+
+	URL string `json:"url"` // URL receives the notices of http channels
+	// Secret signs every http body with HMAC-SHA256, sent as "X-OFA-Signature: sha256=<hex>" as webhooks are
+	Secret string `json:"secret"`
+}
+
+// NotificationTemplate is the wording of one notice type
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// CanaryCircuitConfig configures a canary circuit and who new registrations are bound to it for.
+// Percent and Users change on Reload; the circuit only on restart.
+type CanaryCircuitConfig struct {
+	// Circuit is the canary's composition; nil runs no canary. Keys come from artifacts_dir/<circuit
+	// version>, as written by keygen -tenant, when present and are set up on first use otherwise.
+	Circuit *circuit.Composition `json:"circuit"`
+	// Percent is the share of user names, from 0 to 100, whose new registrations are bound to the
+	// canary. Each name's share is fixed by its hash, so raising Percent only adds users; 0 stops
+	// binding new ones while those bound keep verifying.
+	Percent float64 `json:"percent"`
+	// Users are bound to the canary on registering whatever Percent says, e.g. the team's own accounts
+	Users []string `json:"users"`
+}
+
+// ListenerConfig is one address the server listens on. Exactly one of Addr, UnixSocket and Systemd is set.
+type ListenerConfig struct {
+	// Serve is "all" (default), "api" (everything outside /admin), "admin" (only /admin), "metrics"
+	// (pprof, /debug/memstats and /metrics, which must not be reachable beyond this host) or "internal"
+	// (admin and metrics together, for a private network); every listener answers /healthz and /readyz
+	Serve          string `json:"serve"`
+	Addr           string `json:"addr"`             // Addr is a TCP address, e.g. ":9443"
+	UnixSocket     string `json:"unix_socket"`      // UnixSocket is the path of a Unix domain socket to create
+	UnixSocketMode string `json:"unix_socket_mode"` // UnixSocketMode is the socket's octal file mode; "0660" when empty
+	// Systemd takes over the sockets systemd passed in under this FileDescriptorName (socket activation)
+	Systemd string `json:"systemd"`
+
+	// TLSCertFile and TLSKeyFile, or inline TLSCert and TLSKey, serve HTTPS on this listener; neither serves plain HTTP
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+}
+
+// EthereumConfig configures the on-chain verifier endpoints
+type EthereumConfig struct {
+	// RPCURL is the node's JSON-RPC endpoint, e.g. "http://127.0.0.1:8545"; empty disables /v1/onchain
+	RPCURL          string `json:"rpc_url"`
+	VerifierAddress string `json:"verifier_address"` // VerifierAddress is where verifier.sol is deployed
+	// SenderKey is the hex secp256k1 key paying for submitted transactions; empty allows read-only calls only
+	SenderKey string `json:"sender_key"`
+	GasLimit  uint64 `json:"gas_limit"` // GasLimit replaces the estimated gas of submissions when non-zero
+}
+
+// GroupConfig configures anonymous group authentication on /v1/groups
+type GroupConfig struct {
+	Enabled bool `json:"enabled"` // Enabled turns on /v1/groups; the group circuit's setup runs on first use
+	// Epoch is how long a member's nullifier stays the same, e.g. "24h"; members log in once per epoch
+	Epoch    Duration `json:"epoch"`
+	TokenTTL Duration `json:"token_ttl"` // TokenTTL is the lifetime of group tokens, cut short at the end of the epoch
+}
+
+// CommitmentBlindingConfig configures the blinding of stored commitments. Clients must then send the
+// commitment their proof is for as crypto_commitment, which is checked against the stored hash.
+type CommitmentBlindingConfig struct {
+	Enabled bool `json:"enabled"`
+	// PepperFile keeps the 32-byte HMAC key, sealed through key_provider when one is configured and
+	// generated on first start; losing it locks out every blinded registration. It is unused in
+	// stateless mode, where the pepper is derived from stateless.secret.
+	PepperFile string `json:"pepper_file"`
+}
+
+// AccessLogConfig configures the access log. Each line records the method, path, status, latency,
+// request ID and client address of a request; nothing else of it is logged.
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"` // Path is the file lines are appended to; standard output when empty
+}
+
+// ClockConfig configures the clock skew tolerated between clients and the server
+type ClockConfig struct {
+	// Skew is how far a client's clock may be off the server's, e.g. "30s": group proofs are accepted
+	// for any epoch current within skew of the server's time
+	Skew Duration `json:"skew"`
+	// NTPServer, "host" or "host:port", is asked for the time at startup, and the server refuses to
+	// start when its clock is off by more than skew; an unreachable server is logged. Empty skips the check.
+	NTPServer string `json:"ntp_server"`
+}
+
+// TranscriptConfig configures proof transcripts. A login fails when its transcript can't be
+// recorded, so none goes unaudited.
+type TranscriptConfig struct {
+	Enabled bool `json:"enabled"`
+	// Retention is how long transcripts are kept, pruned as new ones are recorded; 0 keeps them forever
+	Retention Duration `json:"retention"`
+	// AuditInterval is how often a random sample of the transcripts is verified again under the
+	// keys the server holds, each that no longer verifies sent to webhooks as transcript.invalid;
+	// 0 disables the audits
+	AuditInterval Duration `json:"audit_interval"`
+	AuditSample   int      `json:"audit_sample"` // AuditSample is how many transcripts an audit verifies; 0 verifies them all
+}
+
+// KDFConfig is the registry of KDF parameter sets. A registration naming a set stores its
+// parameters, a later version of the set leaving it on the one it named; its provers derive with
+// what the registration stored.
+type KDFConfig struct {
+	// Registry lists the parameter sets, each with a name and a version unique together; the first
+	// is the one clients register with when they have no preference
+	Registry []secret.KDFParams `json:"registry"`
+	// RequireRegistered refuses registrations whose KDF parameters are not a set of the registry
+	RequireRegistered bool `json:"require_registered"`
+}
+
+// SecretPolicyConfig is the policy the secrets of new commitments must be proven to satisfy; it is
+// off while both fields are empty
+type SecretPolicyConfig struct {
+	MinBits  int     `json:"min_bits"` // MinBits is the smallest bit length a secret may have, at most 253
+	Denylist []int64 `json:"denylist"` // Denylist holds up to 16 secrets that may never be registered, e.g. 1234
+}
+
+// CredentialsConfig configures Verifiable Credential issuance
+type CredentialsConfig struct {
+	// IssuerDID identifies the issuer, e.g. "did:web:auth.example.com"; empty disables issuance
+	IssuerDID string   `json:"issuer_did"`
+	Types     []string `json:"types"` // Types are the credential types added after "VerifiableCredential"
+	// SchemaID and SchemaType fill credentialSchema when set, e.g. a JSON Schema URL and "JsonSchema"
+	SchemaID   string   `json:"schema_id"`
+	SchemaType string   `json:"schema_type"`
+	TTL        Duration `json:"ttl"` // TTL is how long an issued credential stays valid
+}
+
+// SAMLConfig configures the SAML 2.0 identity provider. Responses are posted by the browser to the
+// service provider's assertion consumer service, the assertion signed with key_file.
+type SAMLConfig struct {
+	// EntityID is the IdP's issuer, e.g. "https://auth.example.com/saml"; empty disables SAML
+	EntityID string `json:"entity_id"`
+	// CertFile and KeyFile are the PEM certificate service providers pin and its RSA or ECDSA key
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// SSOURL is the sign-in page service providers send AuthnRequests to, published in the metadata; optional
+	SSOURL           string                `json:"sso_url"`
+	AssertionTTL     Duration              `json:"assertion_ttl"` // AssertionTTL is how long a service provider accepts an assertion
+	ServiceProviders []SAMLServiceProvider `json:"service_providers"`
+}
+
+// SAMLServiceProvider is a relying party assertions can be issued to
+type SAMLServiceProvider struct {
+	EntityID string `json:"entity_id"` // EntityID is the audience of the assertions
+	ACSURL   string `json:"acs_url"`   // ACSURL is the assertion consumer service responses are posted to
+	// NameIDFormat is the format of the subject's NameID, the user name; unspecified by default
+	NameIDFormat string `json:"name_id_format"`
+	// Attributes maps attribute names to the user fields they carry: user_name, tenant,
+	// crypto_commitment, circuit_version, curve, did_key or key_id
+	Attributes map[string]string `json:"attributes"`
+}
+
+// VerdictSigningConfig configures signed verification verdicts. Each one is an EdDSA JWS naming the
+// user, the key version and the challenge nonce, signed with the current of signing_keys.
+type VerdictSigningConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// DIDConfig configures DID user names. Documents are resolved when a registration binds its
+// commitment to one of their keys.
+type DIDConfig struct {
+	// Enabled treats user names starting with "did:" as DIDs, which must then be did:key or did:web
+	Enabled bool `json:"enabled"`
+	// RequireBinding refuses DID registrations and recoveries whose commitment no key of the DID
+	// document signed
+	RequireBinding bool `json:"require_binding"`
+	// WebDomains lists the only domains did:web documents are fetched from; empty allows any, which
+	// lets anyone registering make the server fetch https://<domain>/.well-known/did.json
+	WebDomains     []string `json:"web_domains"`
+	ResolveTimeout Duration `json:"resolve_timeout"` // ResolveTimeout bounds fetching a did:web document
+}
+
+// TOTPConfig configures the TOTP (RFC 6238) codes users may enroll. Codes are checked on every
+// path that authenticates a proof: verification, sessions, OIDC and OAuth2, credentials and SAML.
+type TOTPConfig struct {
+	// Policy applies to the tenants Tenants doesn't list: "off", the default, "enrolled", which asks
+	// the users who confirmed an enrolment for a code, or "required", which also refuses the others
+	Policy  string            `json:"policy"`
+	Tenants map[string]string `json:"tenants"` // Tenants overrides Policy per tenant, "-" naming the default one
+	Issuer  string            `json:"issuer"`  // Issuer labels the account in authenticator apps
+	Skew    int               `json:"skew"`    // Skew is how many 30-second steps a code may be off by, either way
+}
+
+// WebAuthnConfig configures binding registrations to WebAuthn/FIDO2 credentials
+type WebAuthnConfig struct {
+	// RPID is the relying party ID credentials are scoped to, e.g. "example.com"; empty disables binding
+	RPID string `json:"rp_id"`
+	// Origins lists the origins assertions are accepted from, e.g. "https://login.example.com"
+	Origins []string `json:"origins"`
+	// RequireUserVerification refuses assertions made without the authenticator's PIN or biometric check
+	RequireUserVerification bool `json:"require_user_verification"`
+}
+
+// SigningKeysConfig configures the Ed25519 keys verdicts and webhook deliveries are signed with
+type SigningKeysConfig struct {
+	// Dir keeps the keys across restarts, sealed through key_provider when one is configured; empty
+	// keeps them in memory. Stateless replicas ignore it and derive their keys from stateless.secret.
+	Dir string `json:"dir"`
+	// RotateEvery is how long a key signs before a new one replaces it, e.g. "720h"; 0 never rotates
+	RotateEvery Duration `json:"rotate_every"`
+	// Overlap is how long a replaced key stays published, so what it signed just before a rotation
+	// keeps verifying; keep it shorter than rotate_every
+	Overlap Duration `json:"overlap"`
+}
+
+// OIDCConfig configures the OpenID Connect provider endpoints
+type OIDCConfig struct {
+	// Issuer is the provider's public base URL, e.g. "https://auth.example.com"; empty disables OIDC
+	Issuer   string       `json:"issuer"`
+	Clients  []OIDCClient `json:"clients"`   // Clients lists the relying parties allowed to authenticate users
+	TokenTTL Duration     `json:"token_ttl"` // TokenTTL is the lifetime of issued ID and access tokens
+	// RefreshTokenTTL is how long a refresh token can be redeemed; each redemption rotates it
+	RefreshTokenTTL Duration `json:"refresh_token_ttl"`
+	// RefreshFamilyTTL is how long a chain of rotated refresh tokens lasts from the sign-in that
+	// started it, after which the user must sign in again; 0 lets it last while it keeps being redeemed
+	RefreshFamilyTTL Duration `json:"refresh_family_ttl"`
+	CodeTTL          Duration `json:"code_ttl"`    // CodeTTL is how long an authorization code can be redeemed
+	LoginTitle       string   `json:"login_title"` // LoginTitle is shown on the sign-in page
+}
+
+// OIDCClient is a registered relying party or API client
+type OIDCClient struct {
+	ClientID string `json:"client_id"`
+	// ClientSecret authenticates a confidential client at the token endpoint; public clients leave it empty and must use PKCE
+	ClientSecret string   `json:"client_secret"`
+	RedirectURIs []string `json:"redirect_uris"` // RedirectURIs are the exact callback URLs the client may use
+	// Scopes lists the API scopes the client may request; the zk-proof grant defaults to all of them
+	Scopes []string `json:"scopes"`
+}
+
+// defaultConfig returns the settings used when no configuration file is given
+func defaultConfig() Config {
+	return Config{
+		Addr:         ":8080",
+		DatabasePath: "users.db",
+		ChallengeTTL: Duration{2 * time.Minute},
+
+		ReplayCacheTTL:  Duration{10 * time.Minute},
+		VerdictCacheTTL: Duration{time.Minute},
+
+		InteractiveDeadline: Duration{30 * time.Second},
+		SessionTTL:          Duration{time.Hour},
+		StepUpTTL:           Duration{5 * time.Minute},
+		FailureLatency:      Duration{250 * time.Millisecond},
+
+		UnixSocketMode: "0660",
+
+		ReadTimeout:    Duration{15 * time.Second},
+		WriteTimeout:   Duration{60 * time.Second},
+		HandlerTimeout: Duration{30 * time.Second},
+
+		ReadHeaderTimeout: Duration{5 * time.Second},
+		IdleTimeout:       Duration{2 * time.Minute},
+		MaxHeaderBytes:    32 << 10,
+
+		MaxBodyBytes:     64 << 10,
+		MaxSnapshotBytes: 256 << 20,
+		MaxBatchBytes:    4 << 20,
+		MaxBatchSize:     1000,
+		BatchChunkSize:   100,
+
+		PoolQueueSize:  64,
+		PoolRetryAfter: Duration{time.Second},
+		JobRetention:   Duration{10 * time.Minute},
+
+		PoolAdmissionQueueSize: 256,
+		PoolAdmissionWait:      Duration{2 * time.Second},
+		ChallengePoolSize:      1024,
+		SelfTest:               true,
+
+		KeyGracePeriod: Duration{24 * time.Hour},
+		MetadataMaxAge: Duration{5 * time.Minute},
+		SigningKeys:    SigningKeysConfig{Overlap: Duration{24 * time.Hour}},
+		DIDs:           DIDConfig{ResolveTimeout: Duration{10 * time.Second}},
+		Circuit:        circuit.DefaultComposition,
+
+		StatsRetention:      Duration{30 * 24 * time.Hour},
+		ExpirySweepInterval: Duration{time.Hour},
+		Groups:              GroupConfig{Epoch: Duration{time.Hour}, TokenTTL: Duration{time.Hour}},
+		Clock:               ClockConfig{Skew: Duration{30 * time.Second}},
+		Transcripts:         TranscriptConfig{AuditInterval: Duration{time.Hour}, AuditSample: 100},
+		KDFs:                KDFConfig{Registry: secret.DefaultKDFRegistry()},
+
+		DuplicateCommitments: duplicatesAllow,
+		EventBus:             EventBusConfig{Topic: "ofa.events", BufferSize: 1024, Timeout: Duration{10 * time.Second}},
+		RateLimit: RateLimitConfig{
+			Redis: RedisConfig{KeyPrefix: "ofa:ratelimit:", Timeout: Duration{time.Second}, PoolSize: 8},
+		},
+		Stateless: StatelessConfig{
+			Redis: RedisConfig{KeyPrefix: "ofa:", Timeout: Duration{time.Second}, PoolSize: 16},
+		},
+		Anomalies: AnomalyConfig{
+			Window:               Duration{10 * time.Minute},
+			UserFailures:         10,
+			SprayUsers:           5,
+			StuffingFailureRatio: 0.8,
+			StuffingMinAttempts:  50,
+			Retained:             100,
+		},
+
+		OIDC: OIDCConfig{
+			TokenTTL:         Duration{time.Hour},
+			RefreshTokenTTL:  Duration{30 * 24 * time.Hour},
+			RefreshFamilyTTL: Duration{90 * 24 * time.Hour},
+			CodeTTL:          Duration{time.Minute},
+			LoginTitle:       "Sign in",
+		},
+
+		SAML: SAMLConfig{AssertionTTL: Duration{5 * time.Minute}},
+		TOTP: TOTPConfig{Issuer: "OFA", Skew: 1},
+
+		Credentials: CredentialsConfig{
+			Types:      []string{"CommitmentKnowledgeCredential"},
+			SchemaType: "JsonSchema",
+			TTL:        Duration{24 * time.Hour},
+		},
+	}
+}
+
+// Duration is a time.Duration that reads and writes itself as a Go duration string in JSON
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses values such as "30s" or "5m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if unmarshalErr := json.Unmarshal(data, &text); unmarshalErr != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", unmarshalErr)
+	}
+	parsed, parseErr := time.ParseDuration(text)
+	if parseErr != nil {
+		return parseErr
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON writes the duration in time.Duration.String form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// DefaultConfig returns the settings LoadConfig starts from, without its environment overrides
+func DefaultConfig() Config {
+	return defaultConfig()
+}
+
+// LoadConfig reads a JSON configuration file on top of the defaults, applies environment overrides
+// and resolves vault: references
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return cfg, fmt.Errorf("reading config: %w", readErr)
+		}
+		if parseErr := json.Unmarshal(data, &cfg); parseErr != nil {
+			return cfg, fmt.Errorf("parsing config: %w", parseErr)
+		}
+	}
+
+	// Secrets are preferably supplied through the environment rather than the config file
+	if token := os.Getenv("OFA_ADMIN_TOKEN"); token != "" {
+		cfg.AdminToken = token
+	}
+	if pin := os.Getenv("OFA_PKCS11_PIN"); pin != "" {
+		cfg.PKCS11.PIN = pin
+	}
+	if keyID := os.Getenv("OFA_MASTER_KEY_ID"); keyID != "" {
+		cfg.MasterKeyID = keyID
+	}
+	// OFA_MASTER_KEYS holds comma-separated "id:base64key" pairs
+	if keys := os.Getenv("OFA_MASTER_KEYS"); keys != "" {
+		cfg.MasterKeys = make(map[string]string)
+		for _, pair := range strings.Split(keys, ",") {
+			id, key, found := strings.Cut(strings.TrimSpace(pair), ":")
+			if !found {
+				return cfg, fmt.Errorf("OFA_MASTER_KEYS entry %q is not id:key", pair)
+			}
+			cfg.MasterKeys[id] = key
+		}
+	}
+	if senderKey := os.Getenv("OFA_ETH_SENDER_KEY"); senderKey != "" {
+		cfg.Ethereum.SenderKey = senderKey
+	}
+	if statelessSecret := os.Getenv("OFA_STATELESS_SECRET"); statelessSecret != "" {
+		cfg.Stateless.Secret = statelessSecret
+	}
+	if seed := os.Getenv("OFA_DETERMINISTIC_SEED"); seed != "" {
+		cfg.DeterministicSeed = seed
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		cfg.Vault.Token = token
+	}
+	if secretID := os.Getenv("VAULT_SECRET_ID"); secretID != "" {
+		cfg.Vault.SecretID = secretID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if vaultErr := resolveVaultReferences(ctx, &cfg); vaultErr != nil {
+		return cfg, fmt.Errorf("resolving vault references: %w", vaultErr)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/validate"
+)
+
+// credentialsContext is the base JSON-LD context of every issued credential
+const credentialsContext = "https://www.w3.org/2018/credentials/v1"
+
+// maxDIDLength bounds the holder DID accepted on credential requests
+const maxDIDLength = 512
+
+// validate checks the issuer DID and that credentials get at least one specific type
+func (c CredentialsConfig) validate() error {
+	if c.IssuerDID == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.IssuerDID, "did:") {
+		return fmt.Errorf("credentials issuer_did %q is not a DID", c.IssuerDID)
+	}
+	if c.SchemaID != "" && c.SchemaType == "" {
+		return fmt.Errorf("credentials schema_id needs a schema_type")
+	}
+	return nil
+}
+
+// verificationMethod is the DID URL of the signing key, sent as the credential "kid"
+func (s *Server) verificationMethod() string {
+	return s.cfg.Credentials.IssuerDID + "#" + s.tokens.signer().keyID
+}
+
+// CredentialRequest is a proof submission asking for a credential instead of a verdict
+type CredentialRequest struct {
+	ProofRequest
+	Holder string `json:"holder,omitempty"` // Holder is the DID the credential is issued to; omitted for bearer credentials
+}
+
+// validate checks the proof fields and the holder DID and returns the parsed nonce
+func (req *CredentialRequest) validate() (*big.Int, error) {
+	var v validate.Validator
+	nonce := req.ProofRequest.validateInto(&v)
+	if req.Holder != "" && (!strings.HasPrefix(req.Holder, "did:") || !v.MaxLength("holder", len(req.Holder), maxDIDLength)) {
+		v.Fail("holder", "must be a DID")
+	}
+	return nonce, v.Err()
+}
+
+// CredentialResponse carries an issued credential
+type CredentialResponse struct {
+	Format     string    `json:"format"`     // Format is always "jwt_vc": a VC Data Model JWT signed by the issuer
+	Credential string    `json:"credential"` // Credential is the compact JWS
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// CommitmentSubject is what a credential attests: its subject knows the secret behind CryptoCommitment
+type CommitmentSubject struct {
+	ID               string `json:"id,omitempty"`
+	UserName         string `json:"userName"`
+	CryptoCommitment string `json:"cryptoCommitment"`
+	CircuitVersion   string `json:"circuitVersion"`
+	KeyID            string `json:"keyId"` // KeyID is the key version the proof was verified under
+}
+
+// CredentialSchema points verifiers at the schema the subject conforms to
+type CredentialSchema struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// VerifiableCredential is the "vc" claim of a JWT-VC
+type VerifiableCredential struct {
+	Context           []string          `json:"@context"`
+	Type              []string          `json:"type"`
+	CredentialSubject CommitmentSubject `json:"credentialSubject"`
+	CredentialSchema  *CredentialSchema `json:"credentialSchema,omitempty"`
+}
+
+// CredentialClaims are the JWT claims of an issued credential; iss, sub, nbf, exp and jti stand in
+// for the issuer, credentialSubject.id, issuanceDate, expirationDate and id properties
+type CredentialClaims struct {
+	Issuer     string               `json:"iss"`
+	Subject    string               `json:"sub,omitempty"`
+	NotBefore  int64                `json:"nbf"`
+	IssuedAt   int64                `json:"iat"`
+	ExpiresAt  int64                `json:"exp"`
+	JWTID      string               `json:"jti"`
+	Credential VerifiableCredential `json:"vc"`
+}
+
+// issueCredentialHandler verifies a proof and answers with a Verifiable Credential attesting it
+func (s *Server) issueCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Credentials.IssuerDID == "" {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "Credential issuance is disabled")
+		return
+	}
+	var req CredentialRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+
+	user, version, authErr := s.authenticate(r.Context(), req.ProofRequest, nonce)
+	if authErr != nil {
+		s.writeAuthError(w, req.ProofRequest, authErr)
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.cfg.Credentials.TTL.Duration)
+	credentialID, idErr := randomToken()
+	if idErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error issuing credential")
+		return
+	}
+	credential := VerifiableCredential{
+		Context: []string{credentialsContext},
+		Type:    append([]string{"VerifiableCredential"}, s.cfg.Credentials.Types...),
+		CredentialSubject: CommitmentSubject{
+			ID:               req.Holder,
+			UserName:         user.UserName,
+			CryptoCommitment: user.CryptoCommitment,
+			CircuitVersion:   user.CircuitVersion,
+			KeyID:            version.ID,
+		},
+	}
+	if s.cfg.Credentials.SchemaID != "" {
+		credential.CredentialSchema = &CredentialSchema{ID: s.cfg.Credentials.SchemaID, Type: s.cfg.Credentials.SchemaType}
+	}
+	signed, signErr := s.tokens.signWithKeyID("JWT", s.verificationMethod(), CredentialClaims{
+		Issuer:     s.cfg.Credentials.IssuerDID,
+		Subject:    req.Holder,
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  expiresAt.Unix(),
+		JWTID:      "urn:ofa:credential:" + credentialID,
+		Credential: credential,
+	})
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error issuing credential")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CredentialResponse{Format: "jwt_vc", Credential: signed, ExpiresAt: expiresAt.UTC()})
+}
+
+// didDocumentHandler serves /.well-known/did.json for a did:web issuer hosted at the domain root,
+// so verifiers can resolve the key that signed a credential
+func (s *Server) didDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	did := s.cfg.Credentials.IssuerDID
+	domain, isWeb := strings.CutPrefix(did, "did:web:")
+	if !isWeb || strings.Contains(domain, ":") {
+		writeProblem(w, http.StatusNotFound, codeNotFound, "No did:web issuer is hosted here")
+		return
+	}
+	method := s.verificationMethod()
+	w.Header().Set("Content-Type", "application/did+json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"@context": []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/suites/jws-2020/v1"},
+		"id":       did,
+		"verificationMethod": []map[string]any{{
+			"id":           method,
+			"type":         "JsonWebKey2020",
+			"controller":   did,
+			"publicKeyJwk": s.tokens.signer().jwk,
+		}},
+		"assertionMethod": []string{method},
+	})
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// CSRF tokens travel in a cookie and come back in a header, or a form field for HTML forms
+const (
+	csrfCookieName = "ofa_csrf"
+	csrfHeader     = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// CSRFResponse is the body of GET /v1/csrf
+type CSRFResponse struct {
+	Token string `json:"csrf_token"` // Token is to be sent back in X-CSRF-Token or a csrf_token form field
+}
+
+// csrfGuard checks double-submit CSRF tokens on the routes of csrf.routes
+type csrfGuard struct {
+	rules  []accessRule // rules hold the protected route groups; their CIDRs are unused
+	secret []byte
+}
+
+// newCSRFGuard checks the csrf settings; it returns nil when no routes are protected
+func newCSRFGuard(cfg CSRFConfig) (*csrfGuard, error) {
+	if len(cfg.Routes) == 0 {
+		return nil, nil
+	}
+	guard := &csrfGuard{secret: []byte(cfg.Secret)}
+	for i, routes := range cfg.Routes {
+		if !validRouteGroup(routes) {
+			return nil, fmt.Errorf("csrf.routes[%d]: %q is not api, admin, metrics or a path prefix", i, routes)
+		}
+		guard.rules = append(guard.rules, accessRule{routes: routes})
+	}
+	if cfg.Secret == "" {
+		log.Println("No csrf.secret configured: CSRF tokens are signed with a generated key that changes on restart")
+		guard.secret = make([]byte, 32)
+		if _, randErr := rand.Read(guard.secret); randErr != nil {
+			return nil, randErr
+		}
+	}
+	return guard, nil
+}
+
+// covers reports whether a route pattern is checked: only state-changing methods are
+func (g *csrfGuard) covers(pattern string) bool {
+	if g == nil {
+		return false
+	}
+	method, _, hasMethod := strings.Cut(pattern, " ")
+	if !hasMethod || method == http.MethodGet || method == http.MethodHead {
+		return false
+	}
+	for _, rule := range g.rules {
+		if rule.covers(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns a token for a random value: the value and its HMAC, base64url-encoded and joined by a dot
+func (g *csrfGuard) sign(value []byte) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(value)
+	return base64.RawURLEncoding.EncodeToString(value) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// valid reports whether a token was signed by this guard
+func (g *csrfGuard) valid(token string) bool {
+	encodedValue, _, found := strings.Cut(token, ".")
+	value, decodeErr := base64.RawURLEncoding.DecodeString(encodedValue)
+	return found && decodeErr == nil && subtle.ConstantTimeCompare([]byte(g.sign(value)), []byte(token)) == 1
+}
+
+// issue returns the token of the request's CSRF cookie, setting a fresh cookie when it has no valid
+// one; secure marks the cookie Secure, for requests served over HTTPS
+func (g *csrfGuard) issue(w http.ResponseWriter, r *http.Request, secure bool) string {
+	if cookie, cookieErr := r.Cookie(csrfCookieName); cookieErr == nil && g.valid(cookie.Value) {
+		return cookie.Value
+	}
+	value := make([]byte, 32)
+	rand.Read(value)
+	token := g.sign(value)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// servedOverHTTPS reports whether a request reached the server over TLS, or through a proxy in
+// trusted_proxies whose X-Forwarded-Proto says the client used HTTPS. Anyone else could set that
+// header, so it is ignored from other peers.
+func (s *Server) servedOverHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		host = r.RemoteAddr
+	}
+	peer, parseErr := netip.ParseAddr(host)
+	if parseErr != nil || !s.trustedProxy(peer) {
+		return false
+	}
+	// The proxy facing the client sets the first entry; proxies behind it may append their own
+	scheme, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(scheme), "https")
+}
+
+// fromBrowser reports whether a request looks sent by a browser, the only clients that can be
+// tricked into a cross-site request: they add Origin to POSTs and Sec-Fetch-Site to every request
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Cookie") != ""
+}
+
+// requireCSRF turns away browser requests to a covered route whose CSRF token doesn't match their
+// CSRF cookie. Requests with an Authorization header pass: browsers never add one on their own.
+func (s *Server) requireCSRF(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if !s.csrf.covers(pattern) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || !fromBrowser(r) {
+			next(w, r)
+			return
+		}
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) == "application/x-www-form-urlencoded" {
+				r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+				if parseErr := r.ParseForm(); parseErr == nil {
+					token = r.PostForm.Get(csrfFormField)
+				}
+			}
+		}
+		cookie, cookieErr := r.Cookie(csrfCookieName)
+		if cookieErr != nil || !s.csrf.valid(cookie.Value) || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			writeProblem(w, http.StatusForbidden, codeCSRFFailed, "Missing or mismatched CSRF token; get one from GET /v1/csrf")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// csrfTokenHandler sets the CSRF cookie and returns its token for pages to send back
+func (s *Server) csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if s.csrf == nil {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "CSRF protection is disabled")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, http.StatusOK, CSRFResponse{Token: s.csrf.issue(w, r, s.servedOverHTTPS(r))})
+}
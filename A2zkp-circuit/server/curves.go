@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/constraint"
+)
+
+// newCurveKeys prepares the keys of the configured circuit on each of cfg.Curves, by curve name.
+// Keys written by keygen -curve to artifacts_dir/<curve>, or found under artifacts_url/<curve>, are
+// loaded now; curves without them are set
+// up on first use and lose their keys on restart, like the group and policy circuits. Either way a
+// curve has a single key version, which the key ring does not rotate. They always hold real keys:
+// the mock prover only fakes BN254 proofs.
+func newCurveKeys(ctx context.Context, cfg Config, provider KeyProvider) (map[string]*lazyKeys, error) {
+	curves := make(map[string]*lazyKeys, len(cfg.Curves))
+	for _, name := range cfg.Curves {
+		curve, parseErr := circuit.ParseCurve(name)
+		switch {
+		case parseErr != nil:
+			return nil, fmt.Errorf("curves: %w", parseErr)
+		case curve == circuit.Curve:
+			return nil, fmt.Errorf("curves: %s is the circuit's own curve", curve)
+		case curves[curve.String()] != nil:
+			return nil, fmt.Errorf("curves: %s is listed twice", curve)
+		}
+		if curveErr := cfg.Circuit.CheckCurve(curve); curveErr != nil {
+			return nil, fmt.Errorf("curves: %w", curveErr)
+		}
+		keys := &lazyKeys{
+			version: fmt.Sprintf("%s over %s", cfg.Circuit.Version(), curve),
+			compile: func() (constraint.ConstraintSystem, error) { return cfg.Circuit.CompileOn(curve) },
+		}
+		var artifacts fs.FS
+		location := filepath.Join(cfg.ArtifactsDir, curve.String())
+		switch {
+		case cfg.ArtifactsDir != "":
+			if _, statErr := os.Stat(location); statErr == nil {
+				artifacts = os.DirFS(location)
+			}
+		case cfg.ArtifactsURL != "":
+			artifacts, location = newURLArtifacts(cfg, curve.String()), "artifacts_url/"+curve.String()
+		}
+		if artifacts != nil {
+			loaded, loadErr := loadCircuitArtifacts(ctx, artifacts, provider, cfg.Circuit.Version(), curve)
+			switch {
+			case cfg.ArtifactsDir == "" && errors.Is(loadErr, fs.ErrNotExist):
+				// The URL has nothing for the curve
+			case loadErr != nil:
+				return nil, fmt.Errorf("loading artifacts from %s: %w", location, loadErr)
+			default:
+				keyID, idErr := verifier.KeyID(loaded.verifyingKey)
+				if idErr != nil {
+					return nil, idErr
+				}
+				keys.keys, keys.keyID = loaded, keyID
+				log.Printf("Circuit %s loaded from %s: key version %s", keys.version, location, keyID)
+			}
+		}
+		if keys.keys == nil && cfg.Stateless.Enabled {
+			return nil, fmt.Errorf("curves: %s has no artifacts; stateless replicas can't each set up keys of their own", curve)
+		}
+		curves[curve.String()] = keys
+	}
+	return curves, nil
+}
+
+// curveNames lists the curves the server verifies proofs on, the circuit's own first
+func (s *Server) curveNames() []string {
+	return append([]string{circuit.Curve.String()}, slices.Sorted(maps.Keys(s.curves))...)
+}
+
+// checkCurve refuses registrations of a tenant on a curve the server does not verify its proofs
+// on. Under a secret policy only the circuit's own curve is accepted, as policy proofs are made over
+// it, and so it is for tenants tenant_circuits pins, whose circuits are only set up over it.
+func (s *Server) checkCurve(name, tenant string) error {
+	switch {
+	case name == "" || name == circuit.Curve.String():
+		return nil
+	case s.curves[name] == nil:
+		return badRequest("curve: this server verifies proofs over %s", strings.Join(s.curveNames(), ", "))
+	case s.policy != nil:
+		return badRequest("curve: with a secret policy registrations use %s, the curve of policy proofs", circuit.Curve)
+	case s.pinnedCircuit(tenant) != nil:
+		return badRequest("curve: registrations of tenant %q use %s, the curve of its circuit", tenant, circuit.Curve)
+	}
+	return nil
+}
+
+// userCurve is the curve a user registered on. Registrations stored before the curve was recorded
+// are on the curve of their circuit.
+func (s *Server) userCurve(user store.User) string {
+	if user.Curve != "" {
+		return user.Curve
+	}
+	return s.circuits[user.CircuitVersion].Curve
+}
+
+// curveKeyVersion resolves the key of a proof made over one of the additional curves, setting it up
+// if needed. key_id may name it; snarkjs proofs only exist on the circuit's own curve.
+func (s *Server) curveKeyVersion(ctx context.Context, req ProofRequest) (*keyVersion, error) {
+	keys := s.curves[req.Curve]
+	switch {
+	case keys == nil:
+		return nil, badRequest("curve: this server verifies proofs over %s", strings.Join(s.curveNames(), ", "))
+	case req.SnarkJSProof != nil:
+		return nil, badRequest("snarkjs_proof: snarkjs proofs are verified over %s only", circuit.Curve)
+	}
+	curveKeys, keyID, keysErr := keys.get(ctx)
+	switch {
+	case keysErr != nil:
+		return nil, keysErr
+	case req.KeyID != "" && req.KeyID != keyID:
+		return nil, ErrKeyNotFound
+	}
+	return &keyVersion{ID: keyID, CircuitVersion: s.circuitVersion, keys: curveKeys}, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+)
+
+// mountDebug adds pprof, memory statistics and /metrics to a metrics or internal listener's mux
+func (s *Server) mountDebug(mux *http.ServeMux) {
+	for pattern, handler := range map[string]http.HandlerFunc{
+		"/debug/pprof/":        pprof.Index,
+		"/debug/pprof/cmdline": pprof.Cmdline,
+		"/debug/pprof/profile": pprof.Profile,
+		"/debug/pprof/symbol":  pprof.Symbol,
+		"/debug/pprof/trace":   pprof.Trace,
+		"/debug/memstats":      memStatsHandler(s.keyring.current().keys),
+		"GET /metrics":         s.metricsHandler,
+	} {
+		mux.HandleFunc(pattern, s.guard(pattern, handler))
+	}
+}
+
+// requireLocal refuses a TCP listener that doesn't bind a loopback address, saying why it must;
+// Unix sockets are always local
+func requireLocal(addr net.Addr, reason string) error {
+	if tcpAddr, isTCP := addr.(*net.TCPAddr); isTCP && !tcpAddr.IP.IsLoopback() {
+		return fmt.Errorf("listener %s must bind a loopback address: %s", addr, reason)
+	}
+	return nil
+}
+
+// ArtifactSizes reports the serialized size of each cached circuit artifact
+type ArtifactSizes struct {
+	Constraints           int   `json:"constraints"`
+	ConstraintSystemBytes int64 `json:"constraint_system_bytes"`
+	ProvingKeyBytes       int64 `json:"proving_key_bytes"`
+	VerifyingKeyBytes     int64 `json:"verifying_key_bytes"`
+}
+
+// MemStatsResponse is the body served by /debug/memstats
+type MemStatsResponse struct {
+	Artifacts    ArtifactSizes `json:"artifacts"`
+	HeapAlloc    uint64        `json:"heap_alloc_bytes"`
+	HeapInuse    uint64        `json:"heap_inuse_bytes"`
+	HeapObjects  uint64        `json:"heap_objects"`
+	Sys          uint64        `json:"sys_bytes"`
+	NumGC        uint32        `json:"num_gc"`
+	PauseTotalNs uint64        `json:"gc_pause_total_ns"`
+	Goroutines   int           `json:"goroutines"`
+}
+
+// memStatsHandler reports runtime memory statistics next to the sizes of the cached circuit and keys
+func memStatsHandler(keys *circuitKeys) http.HandlerFunc {
+	// Artifact sizes don't change, so they are measured on first use only
+	var sizesOnce sync.Once
+	var sizes ArtifactSizes
+	return func(w http.ResponseWriter, r *http.Request) {
+		sizesOnce.Do(func() {
+			sizes = ArtifactSizes{
+				Constraints:           keys.ccs.GetNbConstraints(),
+				ConstraintSystemBytes: serializedSize(keys.ccs),
+				ProvingKeyBytes:       serializedSize(keys.provingKey),
+				VerifyingKeyBytes:     serializedSize(keys.verifyingKey),
+			}
+		})
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MemStatsResponse{
+			Artifacts:    sizes,
+			HeapAlloc:    stats.HeapAlloc,
+			HeapInuse:    stats.HeapInuse,
+			HeapObjects:  stats.HeapObjects,
+			Sys:          stats.Sys,
+			NumGC:        stats.NumGC,
+			PauseTotalNs: stats.PauseTotalNs,
+			Goroutines:   runtime.NumGoroutine(),
+		})
+	}
+}
+
+// serializedSize measures an object's gnark binary encoding without keeping it
+func serializedSize(artifact io.WriterTo) int64 {
+	size, _ := artifact.WriteTo(io.Discard)
+	return size
+}
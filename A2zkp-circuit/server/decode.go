@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/wire"
+)
+
+// requestError is a client error found while reading or validating a request
+type requestError struct {
+	status  int
+	code    string // code is the problem code reported to the client
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// errInvalidSecret rejects a user_secret outside the integer secret domain
+var errInvalidSecret = &requestError{
+	status:  http.StatusBadRequest,
+	code:    codeInvalidSecret,
+	message: fmt.Sprintf("user_secret must be a decimal integer between %d and %d", secret.MinInt, int64(secret.MaxInt)),
+}
+
+// badRequest creates a 400 requestError with a formatted message
+func badRequest(format string, args ...any) *requestError {
+	return &requestError{status: http.StatusBadRequest, code: codeInvalidRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// decodeJSON strictly decodes a request body of at most limit bytes into dst. Unknown fields,
+// trailing data and oversized bodies are rejected, so malformed input never reaches the verifier.
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, dst any) error {
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case isValueMessage(contentType):
+		if transcodeErr := valueBodyAsJSON(w, r, limit); transcodeErr != nil {
+			return transcodeErr
+		}
+	case isProtobuf(contentType):
+		return &requestError{
+			status:  http.StatusUnsupportedMediaType,
+			code:    codeUnsupportedMedia,
+			message: "This endpoint takes JSON, or its JSON document as " + wire.ValueContentType,
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	decodeErr := decoder.Decode(dst)
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case decodeErr == nil:
+	case errors.As(decodeErr, &maxBytesErr):
+		return &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    codeBodyTooLarge,
+			message: fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit),
+		}
+	case errors.Is(decodeErr, io.EOF):
+		return badRequest("Request body is empty")
+	case errors.As(decodeErr, &syntaxErr):
+		return badRequest("Invalid JSON at offset %d", syntaxErr.Offset)
+	case errors.As(decodeErr, &typeErr):
+		return badRequest("Field %q must be of type %s", typeErr.Field, typeErr.Type)
+	case errors.Is(decodeErr, secret.ErrInvalid), errors.Is(decodeErr, secret.ErrOutOfRange):
+		return errInvalidSecret
+	case strings.HasPrefix(decodeErr.Error(), "json: unknown field "):
+		return badRequest("Unknown field %s", strings.TrimPrefix(decodeErr.Error(), "json: unknown field "))
+	default:
+		return badRequest("Invalid JSON data")
+	}
+
+	// A body must hold exactly one JSON value
+	if _, trailingErr := decoder.Token(); !errors.Is(trailingErr, io.EOF) {
+		return badRequest("Request body must contain a single JSON object")
+	}
+	return nil
+}
+
+// writeRequestError reports a decoding or validation failure to the client
+func writeRequestError(w http.ResponseWriter, err error) {
+	sendProblem(w, requestProblem(err))
+}
+
+// requestProblem is the problem reported for a decoding or validation failure; invalid fields
+// found by a validate.Validator are listed one by one
+func requestProblem(err error) Problem {
+	var reqErr *requestError
+	var fieldErrs validate.Errors
+	switch {
+	case errors.As(err, &reqErr):
+		return newProblem(reqErr.status, reqErr.code, reqErr.message)
+	case errors.As(err, &fieldErrs):
+		problem := newProblem(http.StatusBadRequest, codeInvalidRequest, "Invalid fields: "+fieldErrs.Error())
+		problem.InvalidParams = fieldErrs
+		return problem
+	}
+	return newProblem(http.StatusBadRequest, codeInvalidRequest, err.Error())
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// DeletionReceipt confirms that a user's data was erased. It names what was removed without
+// keeping any of it: the removed records are only counted and committed to by a hash.
+type DeletionReceipt struct {
+	UserName  string         `json:"user_name"`
+	DeletedAt time.Time      `json:"deleted_at"`
+	Records   map[string]int `json:"records"` // Records counts the removed records by kind
+	// RecordsHash is "sha256:" and the hex SHA-256 of the sorted IDs of the removed records, one per line
+	RecordsHash string `json:"records_hash"`
+	// PurgeAfter is when a soft-deleted registration, kept until then, is erased unless it is
+	// restored first; nil when the registration was erased at once
+	PurgeAfter *time.Time `json:"purge_after,omitempty"`
+}
+
+// deleteUserHandler deletes a user and answers with the deletion receipt. With a deletion_retention
+// the user is soft-deleted, as softDeleteUser does, unless ?purge=true asks for the registration to
+// be erased at once, as eraseUser does; only the latter works on a user soft-deleted already.
+func (s *Server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	if !s.authorizedFor(r, userName) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Deleting a user needs the admin token or a session token of that user")
+		return
+	}
+	receipt, deleteErr := s.deleteUser(r.Context(), userName, r.URL.Query().Get("purge") == "true")
+	if errors.Is(deleteErr, store.ErrUserNotFound) {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return
+	}
+	if deleteErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error deleting user: %v", deleteErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, receipt)
+}
+
+// deleteUser soft-deletes a user when a deletion_retention is configured and purge isn't set, and
+// erases the user otherwise
+func (s *Server) deleteUser(ctx context.Context, userName string, purge bool) (DeletionReceipt, error) {
+	if purge || s.cfg.DeletionRetention.Duration <= 0 {
+		return s.eraseUser(ctx, userName)
+	}
+	return s.softDeleteUser(ctx, userName)
+}
+
+// eraseUser removes a user's registration with its commitment, salt and KDF parameters,
+// authentication policy, proof transcripts, outstanding challenge nonces, refresh tokens and unredeemed
+// authorization codes, and revokes the user's sessions. The user's active commitments are added to the revocation log. It fails with
+// store.ErrUserNotFound when there is no such user.
+func (s *Server) eraseUser(ctx context.Context, userName string) (DeletionReceipt, error) {
+	// The commitments are read first so they can be published as revoked once the user is gone
+	user, _ := s.store.GetUser(ctx, userName)
+	if deleteErr := s.store.DeleteUser(ctx, userName); deleteErr != nil {
+		return DeletionReceipt{}, deleteErr
+	}
+	if user.UserName != "" {
+		s.recordRevocations(ctx, store.RevokedDeletion, user.ActiveCommitments())
+	}
+	removed := map[string][]string{"user": {userName}}
+	policyErr := s.store.DeleteAuthPolicy(ctx, user.Tenant, userName)
+	switch {
+	case policyErr == nil:
+		removed["auth_policy"] = []string{userName}
+	case !errors.Is(policyErr, store.ErrAuthPolicyNotFound):
+		logf(ctx, "Error deleting the authentication policy of %q: %v", userName, policyErr)
+	}
+	transcriptOwners := []string{userName}
+	if user.Deleted() {
+		transcriptOwners = append(transcriptOwners, transcriptPseudonym(userName, *user.DeletedAt))
+	}
+	for _, owner := range transcriptOwners {
+		transcripts, transcriptErr := s.store.DeleteUserTranscripts(ctx, owner)
+		if transcriptErr != nil {
+			logf(ctx, "Error deleting the proof transcripts of %q: %v", userName, transcriptErr)
+		}
+		removed["transcript"] = append(removed["transcript"], transcripts...)
+	}
+	receipt := s.forgetUser(ctx, userName, removed)
+	logf(ctx, "Deleted user %q: %d records, %s", userName, receipt.count(), receipt.RecordsHash)
+	return receipt, nil
+}
+
+// softDeleteUser marks a user deleted, so that their proofs fail as an unknown user's would, and
+// removes their challenge nonces, refresh tokens and authorization codes and revokes their sessions
+// as eraseUser does. Their proof transcripts are kept under transcriptPseudonym in place of their
+// name. The
+// registration itself is kept for deletion_retention, until the sweeper purges it, so that
+// POST /admin/users/{id}/restore can bring it back; its commitments are published as revoked
+// with the purge. It fails with store.ErrUserNotFound when there is no such user, or the user
+// was soft-deleted already.
+func (s *Server) softDeleteUser(ctx context.Context, userName string) (DeletionReceipt, error) {
+	s.devicesMu.Lock()
+	user, getErr := s.getUser(ctx, userName)
+	if getErr != nil {
+		s.devicesMu.Unlock()
+		return DeletionReceipt{}, getErr
+	}
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	putErr := s.store.PutUser(ctx, user)
+	s.devicesMu.Unlock()
+	if putErr != nil {
+		return DeletionReceipt{}, putErr
+	}
+
+	pseudonymized, renameErr := s.renameTranscripts(ctx, userName, transcriptPseudonym(userName, now))
+	if renameErr != nil {
+		logf(ctx, "Error pseudonymizing the proof transcripts of %q: %v", userName, renameErr)
+	}
+	receipt := s.forgetUser(ctx, userName, map[string][]string{"pseudonymized_transcript": pseudonymized})
+	purgeAfter := now.Add(s.cfg.DeletionRetention.Duration)
+	receipt.DeletedAt, receipt.PurgeAfter = now, &purgeAfter
+	logf(ctx, "Soft-deleted user %q until %s: %d records, %s", userName, purgeAfter.Format(time.RFC3339), receipt.count(), receipt.RecordsHash)
+	return receipt, nil
+}
+
+// forgetUser removes the challenges, refresh tokens and authorization codes of a user whose
+// registration is gone or soft-deleted, revokes every session token issued to them so far, and
+// returns the receipt for the records removed and those removed already. A failure is logged and
+// the receipt lists what was removed.
+func (s *Server) forgetUser(ctx context.Context, userName string, removed map[string][]string) DeletionReceipt {
+	// Without the revocation a session token would act for the user, or for whoever registers the
+	// name next, until it expires
+	now := time.Now().UTC()
+	if revokeErr := s.revokeSessions(ctx, store.SessionRevocation{
+		UserName:  userName,
+		RevokedAt: now,
+		ExpiresAt: now.Add(s.cfg.SessionTTL.Duration),
+	}, sessionAllRevoked); revokeErr != nil {
+		logf(ctx, "Error revoking the sessions of %q: %v", userName, revokeErr)
+	}
+	challenges, challengeErr := s.challenges.forgetUser(ctx, userName)
+	if challengeErr != nil {
+		logf(ctx, "Error deleting challenges of %q: %v", userName, challengeErr)
+	}
+	refreshTokens, refreshErr := s.refresh.forgetUser(ctx, userName)
+	if refreshErr != nil {
+		logf(ctx, "Error deleting refresh tokens of %q: %v", userName, refreshErr)
+	}
+	codes, codeErr := s.codes.forgetUser(ctx, userName)
+	if codeErr != nil {
+		logf(ctx, "Error deleting authorization codes of %q: %v", userName, codeErr)
+	}
+	removed["challenge"], removed["refresh_token"], removed["authorization_code"] = challenges, refreshTokens, codes
+
+	receipt := DeletionReceipt{UserName: userName, DeletedAt: time.Now().UTC(), Records: make(map[string]int)}
+	var ids []string
+	for kind, records := range removed {
+		receipt.Records[kind] = len(records)
+		for _, record := range records {
+			ids = append(ids, kind+"/"+record)
+		}
+	}
+	slices.Sort(ids)
+	digest := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	receipt.RecordsHash = "sha256:" + hex.EncodeToString(digest[:])
+	return receipt
+}
+
+// transcriptPseudonym is the user name the proof transcripts of a user soft-deleted at deletedAt are
+// kept under, so that auditors reading them don't see the name. Restoring or purging the user
+// derives it again from the registration, which keeps the deletion time.
+func transcriptPseudonym(userName string, deletedAt time.Time) string {
+	digest := sha256.Sum256([]byte(userName + "\n" + strconv.FormatInt(deletedAt.Unix(), 10)))
+	return "deleted-" + hex.EncodeToString(digest[:16])
+}
+
+// count is the number of records the receipt lists as removed
+func (r DeletionReceipt) count() int {
+	total := 0
+	for _, records := range r.Records {
+		total += records
+	}
+	return total
+}
+
+// getUser reads a user for the API, which treats a soft-deleted user as store.ErrUserNotFound
+func (s *Server) getUser(ctx context.Context, userName string) (store.User, error) {
+	user, getErr := s.store.GetUser(ctx, userName)
+	if getErr == nil && user.Deleted() {
+		return store.User{}, store.ErrUserNotFound
+	}
+	return user, getErr
+}
+
+// restoreUserHandler brings back a soft-deleted user before the sweeper purges them. Their
+// commitments verify again and their proof transcripts carry their name again; the challenges,
+// refresh tokens and codes removed with the deletion stay gone. A tenant-admin restores users of its own tenant only.
+func (s *Server) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.store.GetUser(r.Context(), userName)
+	if p := requestPrincipal(r); errors.Is(getErr, store.ErrUserNotFound) || (getErr == nil && !p.managesTenant(user.Tenant)) {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return
+	}
+	if getErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading user: %v", getErr))
+		return
+	}
+	if !user.Deleted() {
+		writeProblem(w, http.StatusConflict, codeUserNotDeleted, "The user is not deleted")
+		return
+	}
+	deletedAt := *user.DeletedAt
+	user.DeletedAt = nil
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing user: %v", putErr))
+		return
+	}
+	if _, renameErr := s.renameTranscripts(r.Context(), transcriptPseudonym(userName, deletedAt), userName); renameErr != nil {
+		logf(r.Context(), "Error restoring the proof transcripts of %q: %v", userName, renameErr)
+	}
+	logf(r.Context(), "Restored soft-deleted user %q", userName)
+	writeResponse(w, r, http.StatusOK, StatusResponse{Status: "User restored", KeyID: user.KeyID})
+}
+
+// purgeDeleted erases the soft-deleted users whose deletion_retention has passed, as eraseUser
+// does, returning their names
+func (s *Server) purgeDeleted(ctx context.Context) ([]string, error) {
+	if s.cfg.DeletionRetention.Duration <= 0 {
+		return nil, nil
+	}
+	users, listErr := s.store.ListUsers(ctx)
+	if listErr != nil {
+		return nil, fmt.Errorf("listing users: %w", listErr)
+	}
+	cutoff := time.Now().Add(-s.cfg.DeletionRetention.Duration)
+	var purged []string
+	for _, user := range users {
+		if !user.Deleted() || user.DeletedAt.After(cutoff) {
+			continue
+		}
+		erased, purgeErr := s.purgeUser(ctx, user.UserName, cutoff)
+		if purgeErr != nil {
+			return purged, purgeErr
+		}
+		if erased {
+			purged = append(purged, user.UserName)
+		}
+	}
+	return purged, nil
+}
+
+// purgeUser erases a user still soft-deleted no later than cutoff when reread under the edit
+// lock, so one restored meanwhile is kept, and reports whether it did
+func (s *Server) purgeUser(ctx context.Context, userName string, cutoff time.Time) (bool, error) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.store.GetUser(ctx, userName)
+	if getErr != nil || !user.Deleted() || user.DeletedAt.After(cutoff) {
+		return false, nil
+	}
+	if _, eraseErr := s.eraseUser(ctx, userName); eraseErr != nil {
+		return false, fmt.Errorf("purging %q: %w", userName, eraseErr)
+	}
+	return true, nil
+}
+
+// authorizedFor accepts the admin token, an API key whose role manages the users of userName's
+// tenant, or a session token from the interactive login issued to userName and not revoked
+func (s *Server) authorizedFor(r *http.Request, userName string) bool {
+	if p, known, _ := s.adminPrincipal(r); known && p.can(permManageUsers) {
+		if p.role != RoleTenantAdmin {
+			return true
+		}
+		user, getErr := s.store.GetUser(r.Context(), userName)
+		return getErr == nil && p.managesTenant(user.Tenant)
+	}
+	claims, valid := s.sessionClaims(r)
+	return valid && claims.Subject == userName
+}
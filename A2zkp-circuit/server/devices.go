@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// maxDeviceLabelLength bounds device labels
+const maxDeviceLabelLength = 64
+
+// maxDevicesPerUser bounds the devices of a user, revoked ones included, since a login without a
+// device label is checked against every active commitment in turn
+const maxDevicesPerUser = 16
+
+// AddDeviceRequest registers a commitment for another of a user's devices
+type AddDeviceRequest struct {
+	Label            string `json:"label"`                  // Label names the device, unique among the user's devices
+	CryptoCommitment string `json:"crypto_commitment"`      // The commitment generated from the device's secret
+	PolicyProof      []byte `json:"policy_proof,omitempty"` // PolicyProof is required when a secret policy is configured, as for registrations
+}
+
+// DeviceResponse describes one of a user's devices; the commitment itself is not returned
+type DeviceResponse struct {
+	Label     string     `json:"label"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Active    bool       `json:"active"` // Active reports whether proofs may match the device's commitment
+}
+
+// DeviceList lists a user's devices in the order they were added
+type DeviceList struct {
+	UserName string           `json:"user_name"`
+	Devices  []DeviceResponse `json:"devices"`
+}
+
+// validate checks the label and that the commitment is an element of the scalar field of curve
+func (req AddDeviceRequest) validate(curve ecc.ID) error {
+	var v validate.Validator
+	v.Text("label", req.Label, maxDeviceLabelLength)
+	v.FieldElementOn(curve, "crypto_commitment", req.CryptoCommitment)
+	v.MaxLength("policy_proof", len(req.PolicyProof), maxProofLength)
+	return v.Err()
+}
+
+// newDeviceResponse describes a stored device
+func newDeviceResponse(device store.Device) DeviceResponse {
+	return DeviceResponse{Label: device.Label, CreatedAt: device.CreatedAt, RevokedAt: device.RevokedAt, Active: device.RevokedAt == nil}
+}
+
+// authorizeDevices checks the caller may manage the devices of the user in the path, writing the
+// problem when not
+func (s *Server) authorizeDevices(w http.ResponseWriter, r *http.Request) bool {
+	if !s.authorizedFor(r, r.PathValue("id")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Managing devices needs the admin token or a session token of that user")
+		return false
+	}
+	return true
+}
+
+// deviceUser loads the user in the path, writing the problem and returning false when it can't
+func (s *Server) deviceUser(w http.ResponseWriter, r *http.Request) (store.User, bool) {
+	user, getErr := s.getUser(r.Context(), r.PathValue("id"))
+	if errors.Is(getErr, store.ErrUserNotFound) {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return store.User{}, false
+	}
+	if getErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error loading user: %v", getErr))
+		return store.User{}, false
+	}
+	return user, true
+}
+
+// listDevicesHandler lists a user's devices, active and revoked
+func (s *Server) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeDevices(w, r) {
+		return
+	}
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	list := DeviceList{UserName: user.UserName, Devices: []DeviceResponse{}}
+	for _, device := range user.Devices {
+		list.Devices = append(list.Devices, newDeviceResponse(device))
+	}
+	writeResponse(w, r, http.StatusOK, list)
+}
+
+// addDeviceHandler registers the commitment of another device, after which proofs for the user
+// verify against it as well as against the commitment they registered with
+func (s *Server) addDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeDevices(w, r) {
+		return
+	}
+	var req AddDeviceRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	// Every device of a user proves over the curve the user registered on
+	owner, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	curve, curveErr := circuit.ParseCurve(s.userCurve(owner))
+	if curveErr != nil {
+		curve = circuit.Curve
+	}
+	if validateErr := req.validate(curve); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	if policyErr := s.checkSecretPolicy(r.Context(), req.CryptoCommitment, req.PolicyProof); policyErr != nil {
+		s.writePolicyError(w, policyErr)
+		return
+	}
+
+	// Edits read, change and write back the whole registration, so they take turns
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if slices.ContainsFunc(user.Devices, func(d store.Device) bool { return d.Label == req.Label }) {
+		writeProblem(w, http.StatusConflict, codeDeviceExists, fmt.Sprintf("Device %q already exists", req.Label))
+		return
+	}
+	if len(user.Devices) >= maxDevicesPerUser {
+		writeRequestError(w, badRequest("Users may have at most %d devices", maxDevicesPerUser))
+		return
+	}
+	device := store.Device{Label: req.Label, CryptoCommitment: req.CryptoCommitment, CreatedAt: time.Now().UTC()}
+	user.Devices = append(slices.Clone(user.Devices), device)
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing device: %v", putErr))
+		return
+	}
+	s.notices.send(r.Context(), SecurityNotice{Type: noticeDeviceAdded, UserName: user.UserName, Tenant: user.Tenant, Device: device.Label})
+	writeResponse(w, r, http.StatusCreated, newDeviceResponse(device))
+}
+
+// revokeDeviceHandler revokes a device so proofs no longer match its commitment. The device stays
+// listed, and its label taken, as a record of the revocation; revoking it again changes nothing.
+func (s *Server) revokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeDevices(w, r) {
+		return
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	label := r.PathValue("label")
+	i := slices.IndexFunc(user.Devices, func(d store.Device) bool { return d.Label == label })
+	if i < 0 {
+		writeProblem(w, http.StatusNotFound, codeDeviceNotFound, fmt.Sprintf("No device %q", label))
+		return
+	}
+	if user.Devices[i].RevokedAt == nil {
+		revokedAt := time.Now().UTC()
+		user.Devices = slices.Clone(user.Devices)
+		user.Devices[i].RevokedAt = &revokedAt
+		if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error revoking device: %v", putErr))
+			return
+		}
+		s.recordRevocations(r.Context(), store.RevokedDevice, []string{user.Devices[i].CryptoCommitment})
+	}
+	writeResponse(w, r, http.StatusOK, newDeviceResponse(user.Devices[i]))
+}
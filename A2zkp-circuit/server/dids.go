@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+
+	"A2zkp-circuit/did"
+	"A2zkp-circuit/validate"
+)
+
+// newDIDResolver resolves the DID documents of DID user names; it returns nil unless dids.enabled
+func newDIDResolver(cfg DIDConfig) *did.Resolver {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &did.Resolver{Client: &http.Client{Timeout: cfg.ResolveTimeout.Duration}, WebDomains: cfg.WebDomains}
+}
+
+// validateDIDBinding records the invalid fields of a DID binding in v
+func validateDIDBinding(v *validate.Validator, binding *did.Binding) {
+	if binding == nil {
+		return
+	}
+	if v.Required("did_binding.verification_method", binding.VerificationMethod) {
+		v.MaxLength("did_binding.verification_method", len(binding.VerificationMethod), maxDIDLength)
+	}
+	if len(binding.Signature) != ed25519.SignatureSize {
+		v.Fail("did_binding.signature", "must be a %d-byte Ed25519 signature", ed25519.SignatureSize)
+	}
+}
+
+// checkDID checks a registration under a DID user name: the DID must be a did:key or did:web one
+// and, when the registration carries a binding or dids.require_binding is set, a key of its
+// document must have signed the commitment. The binding's key is recorded in req for newUser.
+// Without dids.enabled user names starting with "did:" are plain names and bindings are refused.
+func (s *Server) checkDID(ctx context.Context, req *RegisterRequest) error {
+	if s.dids == nil || !did.IsDID(req.UserName) {
+		if req.DIDBinding != nil {
+			return badRequest("did_binding: user_name is not a DID, or DID user names are disabled")
+		}
+		return nil
+	}
+	parsed, parseErr := did.Parse(req.UserName)
+	if parseErr != nil {
+		return badRequest("user_name: %v", parseErr)
+	}
+	if req.DIDBinding == nil {
+		if s.cfg.DIDs.RequireBinding {
+			return &requestError{status: http.StatusUnprocessableEntity, code: codeDIDBindingInvalid, message: "Missing did_binding, required for DID user names"}
+		}
+		return nil
+	}
+	doc, resolveErr := s.dids.Resolve(ctx, parsed)
+	if resolveErr != nil {
+		return &requestError{status: http.StatusUnprocessableEntity, code: codeDIDUnresolvable, message: resolveErr.Error()}
+	}
+	if bindErr := req.DIDBinding.Verify(doc, req.CryptoCommitment); bindErr != nil {
+		return &requestError{status: http.StatusUnprocessableEntity, code: codeDIDBindingInvalid, message: bindErr.Error()}
+	}
+	req.didKey = req.DIDBinding.VerificationMethod
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+)
+
+// DryRunResponse is what /v1/verify would make of a proof, found without any of its side effects
+type DryRunResponse struct {
+	Valid bool   `json:"valid"`  // Valid is whether /v1/verify would accept the proof, second factors and auth policies aside
+	KeyID string `json:"key_id"` // KeyID is the key version the proof was checked under
+	// ProofVerified is whether the pairing check passed against one of the user's active commitments,
+	// whatever else failed
+	ProofVerified bool `json:"proof_verified"`
+	// Code is the problem code /v1/verify would answer an invalid proof with, e.g. "challenge_expired",
+	// and Reason its failure reason, user existence included
+	Code          string  `json:"code,omitempty"`
+	Reason        string  `json:"reason,omitempty"`
+	LatencyMillis float64 `json:"latency_ms"` // LatencyMillis is how long the pairing check took
+}
+
+// dryRunVerifyHandler runs a proof through decoding, key lookup, the challenge check and the pairing
+// check as /v1/verify does, but consumes no nonce, records nothing towards lockouts, stats, replays
+// or verdicts, and issues no token, so clients can test their integration against production keys.
+// It needs a principal, since it answers as often as asked and tells unknown users apart.
+func (s *Server) dryRunVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var req ProofRequest
+	if decodeErr := decodeBody(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	resp, dryRunErr := s.dryRun(r.Context(), req, nonce)
+	if dryRunErr != nil {
+		s.writeAuthError(w, req, dryRunErr)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, resp)
+}
+
+// dryRun runs checkProof without its side effects, reporting the first failure authenticate would
+// have returned in the response. Only failures that keep the checks from running at all, such as an
+// unknown key version or a busy pool, are returned.
+func (s *Server) dryRun(ctx context.Context, req ProofRequest, nonce *big.Int) (DryRunResponse, error) {
+	outcome, checkErr := s.checkProof(ctx, req, nonce, true)
+	resp := DryRunResponse{ProofVerified: outcome.verified, LatencyMillis: float64(outcome.latency.Microseconds()) / 1000}
+	if outcome.version != nil {
+		resp.KeyID = outcome.version.ID
+	}
+	switch {
+	case checkErr == nil:
+		resp.Valid = true
+		return resp, nil
+	case errors.Is(checkErr, ErrInvalidProof), errors.Is(checkErr, ErrChallengeNotFound), errors.Is(checkErr, ErrCommitmentExpired), errors.Is(checkErr, ErrProofReplayed):
+		return dryRunFailure(req, resp, checkErr), nil
+	default:
+		return DryRunResponse{}, checkErr
+	}
+}
+
+// dryRunFailure fills the problem code and failure reason of authErr into resp
+func dryRunFailure(req ProofRequest, resp DryRunResponse, authErr error) DryRunResponse {
+	_, resp.Code, _ = authFailure(req, authErr)
+	resp.Reason = failureReason(authErr)
+	return resp
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Drivers of event_bus.driver
+const (
+	busKafka = "kafka"
+	busNATS  = "nats"
+)
+
+// Event types published to the event bus
+const (
+	busRegistrationCreated   = "registration.created"
+	busVerificationCompleted = "verification.completed"
+	busCommitmentRevoked     = "commitment.revoked"
+	busSessionRevoked        = sessionRevokedEvent
+)
+
+// busEventTypes lists the event types event_bus.events may name
+var busEventTypes = []string{busRegistrationCreated, busVerificationCompleted, busCommitmentRevoked, busSessionRevoked}
+
+// busSchemaVersion is the version of the event schemas. Adding fields keeps it; renaming, removing
+// or retyping one bumps it, so consumers can tell the shapes apart.
+const busSchemaVersion = 1
+
+// busBatchSize bounds how many queued events are published at once
+const busBatchSize = 100
+
+// busAttempts is how often a batch is tried before its events are given up
+const busAttempts = 3
+
+// busDrainTimeout bounds how long Close waits for the queued events to be published
+const busDrainTimeout = 10 * time.Second
+
+// BusEvent is the envelope of every message on the event bus, JSON encoded. Schema names the
+// shape of Data, "ofa.<type>/v<schema version>", and is also sent as the "ofa-schema" header of
+// Kafka records.
+type BusEvent struct {
+	Schema        string    `json:"schema"`         // Schema is e.g. "ofa.registration.created/v1"
+	SchemaVersion int       `json:"schema_version"` // SchemaVersion is the version Schema ends in
+	ID            string    `json:"id"`             // ID is unique per event, so consumers can drop redelivered ones
+	Type          string    `json:"type"`           // Type is the event type, e.g. "verification.completed"
+	Time          time.Time `json:"time"`           // Time is when the event happened
+	Tenant        string    `json:"tenant,omitempty"`
+	// RequestID is the X-Request-ID of the request that caused the event; empty for background work
+	RequestID string `json:"request_id,omitempty"`
+	Data      any    `json:"data"` // Data is a RegistrationCreated, VerificationCompleted, CommitmentRevoked or SessionRevocation
+}
+
+// RegistrationCreated is the data of registration.created events, for every user stored by a
+// registration, a batch import or a migration
+type RegistrationCreated struct {
+	UserName       string    `json:"user_name"`
+	CircuitVersion string    `json:"circuit_version,omitempty"`
+	Curve          string    `json:"curve,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// VerificationCompleted is the data of verification.completed events, for every login whose proof
+// was checked, whether it verified or not
+type VerificationCompleted struct {
+	UserName      string  `json:"user_name"`
+	Success       bool    `json:"success"`
+	LatencyMillis float64 `json:"latency_ms"` // LatencyMillis is how long checking the proof took
+}
+
+// CommitmentRevoked is the data of commitment.revoked events, one per commitment entered in the revocation log
+type CommitmentRevoked struct {
+	CryptoCommitment string `json:"crypto_commitment"`
+	// Reason is the revocation log's: "user_deleted", "device_revoked", "commitment_expired" or "commitment_replaced"
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// busSchema names the schema of an event type's data at the current schema version
+func busSchema(eventType string) string {
+	return fmt.Sprintf("ofa.%s/v%d", eventType, busSchemaVersion)
+}
+
+// busMessage is an encoded event waiting to be published
+type busMessage struct {
+	eventType string
+	key       string // key keeps the events of one user, or one commitment, in order on Kafka
+	body      []byte
+}
+
+// busPublisher is a driver of the event bus, publishing batches of messages to Kafka or NATS
+type busPublisher interface {
+	publish(ctx context.Context, messages []busMessage) error
+	close() error
+}
+
+// eventBus publishes events to the configured message bus in the background. Events queue up to
+// event_bus.buffer_size and are published in batches; those that can't be queued or published
+// are counted as dropped or failed, so the request path never waits on the bus.
+type eventBus struct {
+	publisher busPublisher
+	events    []string // events limits the event types published; empty publishes all
+	timeout   time.Duration
+	retry     time.Duration // retry is the pause before the second attempt, doubled before each further one
+	queue     chan busMessage
+	ctx       context.Context // ctx is cancelled when Close gives up draining the queue
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	closeMu sync.RWMutex // closeMu keeps emit from sending on queue once close has closed it
+	closed  bool
+
+	published atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// newEventBus checks the event_bus settings and starts publishing; it returns nil when no driver is configured
+func newEventBus(cfg EventBusConfig) (*eventBus, error) {
+	if cfg.Driver == "" {
+		return nil, nil
+	}
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("event_bus.brokers must list at least one host:port")
+	}
+	for _, broker := range cfg.Brokers {
+		if _, _, splitErr := net.SplitHostPort(broker); splitErr != nil {
+			return nil, fmt.Errorf("event_bus.brokers: %q: %w", broker, splitErr)
+		}
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("event_bus.topic must be set")
+	}
+	for _, eventType := range cfg.Events {
+		if !slices.Contains(busEventTypes, eventType) {
+			return nil, fmt.Errorf("event_bus.events: unknown event type %q, want one of %v", eventType, busEventTypes)
+		}
+	}
+	if cfg.BufferSize <= 0 || cfg.Timeout.Duration <= 0 {
+		return nil, errors.New("event_bus.buffer_size and event_bus.timeout must be positive")
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLS {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	var publisher busPublisher
+	switch cfg.Driver {
+	case busKafka:
+		transport := &kafka.Transport{ClientID: "ofa", TLS: tlsConfig, DialTimeout: cfg.Timeout.Duration}
+		if cfg.Username != "" {
+			transport.SASL = plain.Mechanism{Username: cfg.Username, Password: cfg.Password}
+		}
+		publisher = &kafkaPublisher{writer: &kafka.Writer{
+			Addr:  kafka.TCP(cfg.Brokers...),
+			Topic: cfg.Topic,
+			// Murmur2Balancer partitions keys as the Java client's default partitioner does, so
+			// consumers and other producers agree on where a user's events go
+			Balancer:     kafka.Murmur2Balancer{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    busBatchSize,
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: cfg.Timeout.Duration,
+			Transport:    transport,
+		}}
+	case busNATS:
+		urls := make([]string, len(cfg.Brokers))
+		for i, broker := range cfg.Brokers {
+			urls[i] = "nats://" + broker
+		}
+		opts := []nats.Option{nats.Name("ofa"), nats.Timeout(cfg.Timeout.Duration)}
+		switch {
+		case cfg.Token != "":
+			opts = append(opts, nats.Token(cfg.Token))
+		case cfg.Username != "":
+			opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+		}
+		if tlsConfig != nil {
+			opts = append(opts, nats.Secure(tlsConfig))
+		}
+		publisher = &natsPublisher{url: strings.Join(urls, ","), opts: opts, subject: cfg.Topic}
+	default:
+		return nil, fmt.Errorf("event_bus.driver must be %q or %q, not %q", busKafka, busNATS, cfg.Driver)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &eventBus{
+		publisher: publisher,
+		events:    cfg.Events,
+		timeout:   cfg.Timeout.Duration,
+		retry:     time.Second,
+		queue:     make(chan busMessage, cfg.BufferSize),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// emit queues an event of the given type with the ID of the request ctx belongs to; an event the
+// configuration filters out, or that finds the queue full, is dropped, as it is by a nil receiver
+func (b *eventBus) emit(ctx context.Context, eventType, tenant, key string, data any) {
+	if b == nil || (len(b.events) > 0 && !slices.Contains(b.events, eventType)) {
+		return
+	}
+	eventID, idErr := randomToken()
+	if idErr != nil {
+		logf(ctx, "Dropping %s bus event: %v", eventType, idErr)
+		b.dropped.Add(1)
+		return
+	}
+	body, encodeErr := json.Marshal(BusEvent{
+		Schema:        busSchema(eventType),
+		SchemaVersion: busSchemaVersion,
+		ID:            eventID,
+		Type:          eventType,
+		Time:          time.Now().UTC(),
+		Tenant:        tenant,
+		RequestID:     requestID(ctx),
+		Data:          data,
+	})
+	if encodeErr != nil {
+		logf(ctx, "Dropping %s bus event: %v", eventType, encodeErr)
+		b.dropped.Add(1)
+		return
+	}
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- busMessage{eventType: eventType, key: key, body: body}:
+	default:
+		b.dropped.Add(1)
+		logf(ctx, "Dropping %s bus event: the event bus queue is full", eventType)
+	}
+}
+
+// run publishes the queued events in batches until the queue is closed and drained
+func (b *eventBus) run() {
+	defer close(b.done)
+	defer b.publisher.close()
+	for first := range b.queue {
+		batch := []busMessage{first}
+		for drained := false; !drained && len(batch) < busBatchSize; {
+			select {
+			case message, open := <-b.queue:
+				if !open {
+					drained = true
+					break
+				}
+				batch = append(batch, message)
+			default:
+				drained = true
+			}
+		}
+		b.publishBatch(batch)
+	}
+}
+
+// publishBatch publishes one batch, retrying with a growing pause, and counts the outcome
+func (b *eventBus) publishBatch(batch []busMessage) {
+	pause := b.retry
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(b.ctx, b.timeout)
+		publishErr := b.publisher.publish(ctx, batch)
+		cancel()
+		if publishErr == nil {
+			b.published.Add(uint64(len(batch)))
+			return
+		}
+		if attempt == busAttempts || b.ctx.Err() != nil {
+			b.failed.Add(uint64(len(batch)))
+			log.Printf("Giving up publishing %d events to the event bus: %v", len(batch), publishErr)
+			return
+		}
+		select {
+		case <-time.After(pause):
+		case <-b.ctx.Done():
+		}
+		pause *= 2
+	}
+}
+
+// close stops taking events and waits up to busDrainTimeout for the queued ones to be published
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+	b.closeMu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.closeMu.Unlock()
+	select {
+	case <-b.done:
+	case <-time.After(busDrainTimeout):
+		log.Printf("Giving up on %d events still queued for the event bus", len(b.queue))
+		b.cancel()
+		<-b.done
+	}
+	b.cancel()
+}
+
+// kafkaPublisher publishes every event to one Kafka topic, keyed so one user's events stay in order
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, messages []busMessage) error {
+	records := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		records[i] = kafka.Message{
+			Value: message.body,
+			Headers: []kafka.Header{
+				{Key: "content-type", Value: []byte("application/json")},
+				{Key: "ofa-event-type", Value: []byte(message.eventType)},
+				{Key: "ofa-schema", Value: []byte(busSchema(message.eventType))},
+			},
+		}
+		if message.key != "" {
+			records[i].Key = []byte(message.key)
+		}
+	}
+	return p.writer.WriteMessages(ctx, records...)
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.writer.Close()
+}
+
+// natsPublisher publishes each event to the subject "<event_bus.topic>.<type>", connecting on
+// first use and again once the client gave up reconnecting
+type natsPublisher struct {
+	url     string // url lists the servers of event_bus.brokers, comma-separated
+	opts    []nats.Option
+	subject string
+	conn    *nats.Conn
+}
+
+func (p *natsPublisher) publish(ctx context.Context, messages []busMessage) error {
+	if p.conn == nil || p.conn.IsClosed() {
+		conn, connectErr := nats.Connect(p.url, p.opts...)
+		if connectErr != nil {
+			return connectErr
+		}
+		p.conn = conn
+	}
+	for _, message := range messages {
+		if publishErr := p.conn.Publish(p.subject+"."+message.eventType, message.body); publishErr != nil {
+			return publishErr
+		}
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) close() error {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	return nil
+}
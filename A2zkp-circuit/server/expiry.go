@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// registrationExpiredEvent is the webhook event type announcing an ExpiredRegistration
+const registrationExpiredEvent = "registration.expired"
+
+// ExpiredRegistration describes a registration past its expiry
+type ExpiredRegistration struct {
+	UserName  string     `json:"user_name"`
+	Tenant    string     `json:"tenant,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	ExpiredAt *time.Time `json:"expired_at,omitempty"` // ExpiredAt is when the sweeper marked it; nil until the next sweep
+}
+
+// ExpiredList lists the registrations past their expiry, by user name
+type ExpiredList struct {
+	Registrations []ExpiredRegistration `json:"registrations"`
+}
+
+// newExpiredRegistration describes a stored registration past its expiry
+func newExpiredRegistration(user store.User) ExpiredRegistration {
+	return ExpiredRegistration{UserName: user.UserName, Tenant: user.Tenant, ExpiresAt: *user.ExpiresAt, ExpiredAt: user.ExpiredAt}
+}
+
+// periodicTask runs a task every interval in the background until closed, such as the expiry sweep
+type periodicTask struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startPeriodicTask starts calling task every interval, logging its failures as those of name;
+// it returns nil when interval is 0. The task's context ends when the task is closed.
+func startPeriodicTask(name string, interval time.Duration, task func(context.Context) error) *periodicTask {
+	if interval <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &periodicTask{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if taskErr := task(ctx); taskErr != nil && ctx.Err() == nil {
+					log.Printf("%s failed: %v", name, taskErr)
+				}
+			}
+		}
+	}()
+	return p
+}
+
+// close stops the task, waiting for a run in progress to see its context end; a nil receiver does nothing
+func (p *periodicTask) close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+// sweep marks the expired registrations and purges the soft-deleted users past deletion_retention
+func (s *Server) sweep(ctx context.Context) ([]store.User, error) {
+	marked, sweepErr := s.sweepExpired(ctx)
+	if sweepErr != nil {
+		return marked, sweepErr
+	}
+	_, purgeErr := s.purgeDeleted(ctx)
+	return marked, purgeErr
+}
+
+// sweepExpired marks the registrations that passed their expiry since the last sweep, publishes
+// their commitments as revoked and reports each in the log and to the webhooks. It returns the
+// registrations it marked.
+func (s *Server) sweepExpired(ctx context.Context) ([]store.User, error) {
+	users, listErr := s.store.ListUsers(ctx)
+	if listErr != nil {
+		return nil, fmt.Errorf("listing users: %w", listErr)
+	}
+	now := time.Now().UTC()
+	var marked []store.User
+	for _, listed := range users {
+		if !listed.Expired(now) || listed.ExpiredAt != nil || listed.Deleted() {
+			continue
+		}
+		user, markErr := s.markExpired(ctx, listed.UserName, now)
+		if markErr != nil {
+			return marked, markErr
+		}
+		if user.ExpiredAt == nil {
+			continue // changed since it was listed
+		}
+		s.recordRevocations(ctx, store.RevokedExpiry, user.ActiveCommitments())
+		logf(ctx, "Registration of %q expired at %s", user.UserName, user.ExpiresAt.Format(time.RFC3339))
+		s.webhooks.publish(ctx, registrationExpiredEvent, newExpiredRegistration(user))
+		marked = append(marked, user)
+	}
+	return marked, nil
+}
+
+// markExpired sets ExpiredAt on a registration still expired and unmarked when reread under the
+// edit lock, returning it; a returned user without ExpiredAt was not marked
+func (s *Server) markExpired(ctx context.Context, userName string, now time.Time) (store.User, error) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.store.GetUser(ctx, userName)
+	if getErr != nil || !user.Expired(now) || user.ExpiredAt != nil || user.Deleted() {
+		return store.User{}, nil
+	}
+	user.ExpiredAt = &now
+	if putErr := s.store.PutUser(ctx, user); putErr != nil {
+		return store.User{}, fmt.Errorf("marking %q expired: %w", userName, putErr)
+	}
+	return user, nil
+}
+
+// expiredHandler lists the registrations past their expiry, marked by the sweeper or not yet
+func (s *Server) expiredHandler(w http.ResponseWriter, r *http.Request) {
+	users, listErr := s.store.ListUsers(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing users: %v", listErr))
+		return
+	}
+	now := time.Now()
+	list := ExpiredList{Registrations: []ExpiredRegistration{}}
+	for _, user := range users {
+		if user.Expired(now) && !user.Deleted() {
+			list.Registrations = append(list.Registrations, newExpiredRegistration(user))
+		}
+	}
+	writeResponse(w, r, http.StatusOK, list)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+)
+
+// groupTokenType is the "typ" header of group tokens, keeping them apart from session tokens
+const groupTokenType = "group+jwt"
+
+// defaultGroup names the group of the users registered without a tenant
+const defaultGroup = "-"
+
+// ErrNullifierUsed is returned for a group login whose nullifier already logged in this epoch
+var ErrNullifierUsed = errors.New("nullifier already used this epoch")
+
+// ErrGroupChanged is returned for a group proof made against another root than the current one, or an epoch not accepted
+var ErrGroupChanged = errors.New("group members or epoch changed")
+
+// GroupResponse describes a group as members need it to prove membership
+type GroupResponse struct {
+	Group       string    `json:"group"`
+	Epoch       uint64    `json:"epoch"`         // Epoch is the current epoch, the one proofs must be made for
+	EpochEndsAt time.Time `json:"epoch_ends_at"` // EpochEndsAt is when the next epoch, and a fresh nullifier, begins
+	MembersRoot string    `json:"members_root"`  // MembersRoot is the root of the circuit.GroupTree of Members
+	Members     []string  `json:"members"`       // Members are the group's active commitments, in tree order
+	KeyID       string    `json:"key_id"`        // KeyID names the group circuit's key, served at /v1/keys/group/proving
+}
+
+// GroupLoginRequest is the body of POST /v1/groups/{group}/login. It names no user.
+type GroupLoginRequest struct {
+	Nonce       string `json:"nonce"`        // The challenge nonce from POST /v1/groups/{group}/challenges
+	Epoch       uint64 `json:"epoch"`        // The epoch the proof and nullifier are for
+	MembersRoot string `json:"members_root"` // The root the proof was made against
+	Nullifier   string `json:"nullifier"`
+	Proof       []byte `json:"proof"` // Proof is the base64-encoded Groth16 proof of circuit.GroupCircuit
+}
+
+// GroupSession is the response of a successful group login
+type GroupSession struct {
+	GroupToken string `json:"group_token"` // GroupToken is a JWT of type group+jwt whose subject is the nullifier
+	ExpiresIn  int64  `json:"expires_in"`  // ExpiresIn is the token lifetime in seconds, ending no later than clock.skew past the epoch
+}
+
+// GroupClaims are the claims of a group token. The subject is the member's nullifier for the
+// epoch: stable while it lasts and unlinkable to the user or to other epochs.
+type GroupClaims struct {
+	registeredClaims
+	Group string `json:"group"`
+	Epoch uint64 `json:"epoch"`
+	JWTID string `json:"jti"`
+}
+
+// validate checks the nonce, nullifier and proof and returns the parsed nonce
+func (req GroupLoginRequest) validate() (*big.Int, error) {
+	var v validate.Validator
+	nonce := v.FieldElement("nonce", req.Nonce)
+	v.FieldElement("nullifier", req.Nullifier)
+	v.FieldElement("members_root", req.MembersRoot)
+	if len(req.Proof) == 0 {
+		v.Fail("proof", "is required")
+	}
+	v.MaxLength("proof", len(req.Proof), maxProofLength)
+	return nonce, v.Err()
+}
+
+// groupAuth holds the group circuit's keys, set up on first use, and the nullifiers spent this epoch
+type groupAuth struct {
+	epoch    time.Duration
+	tokenTTL time.Duration
+	skew     time.Duration // skew is clock.skew, widening the epochs proofs are accepted for
+	keys     *lazyKeys
+
+	spentMu sync.Mutex
+	spent   map[string]uint64 // spent maps nullifiers to the epoch they logged in
+}
+
+// newGroupAuth checks the group settings, with skew the clock skew tolerated and mock making the group
+// circuit's setup a mock one; it returns nil when group authentication is disabled
+func newGroupAuth(cfg GroupConfig, skew time.Duration, mock bool) (*groupAuth, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Epoch.Duration < time.Second {
+		return nil, fmt.Errorf("groups.epoch must be at least 1s")
+	}
+	return &groupAuth{
+		epoch:    cfg.Epoch.Duration,
+		tokenTTL: cfg.TokenTTL.Duration,
+		skew:     skew,
+		keys:     &lazyKeys{version: circuit.GroupVersion, compile: circuit.CompileGroup, mock: mock},
+		spent:    make(map[string]uint64),
+	}, nil
+}
+
+// epochAt numbers the epoch containing t, counted from the Unix epoch
+func (g *groupAuth) epochAt(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(g.epoch/time.Second))
+}
+
+// epochEnd is when an epoch is over
+func (g *groupAuth) epochEnd(epoch uint64) time.Time {
+	return time.Unix(int64(epoch+1)*int64(g.epoch/time.Second), 0).UTC()
+}
+
+// acceptedEpochs are the first and last epochs proofs are accepted for at t: those current at some
+// time within skew of it, so a client whose clock is slightly off still proves for an accepted one
+func (g *groupAuth) acceptedEpochs(t time.Time) (first, last uint64) {
+	return g.epochAt(t.Add(-g.skew)), g.epochAt(t.Add(g.skew))
+}
+
+// spend records a nullifier as having logged in during epoch, failing if it already has; entries
+// of epochs no longer accepted are dropped on the way, so replays stay caught while theirs is
+func (g *groupAuth) spend(nullifier string, epoch uint64) error {
+	g.spentMu.Lock()
+	defer g.spentMu.Unlock()
+	first, _ := g.acceptedEpochs(time.Now())
+	for key, spentIn := range g.spent {
+		if spentIn < first {
+			delete(g.spent, key)
+		}
+	}
+	if _, spent := g.spent[nullifier]; spent {
+		return ErrNullifierUsed
+	}
+	g.spent[nullifier] = epoch
+	return nil
+}
+
+// spentIn reports whether a nullifier already logged in during epoch
+func (g *groupAuth) spentIn(nullifier string, epoch uint64) bool {
+	g.spentMu.Lock()
+	defer g.spentMu.Unlock()
+	spentIn, spent := g.spent[nullifier]
+	return spent && spentIn == epoch
+}
+
+// requireGroups answers 404 feature_disabled unless group authentication is enabled
+func (s *Server) requireGroups(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.groups == nil {
+			writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "Group authentication is disabled")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// groupChallengeKey is what group challenges are issued to in the challenge store. The prefix keeps
+// them apart from ordinary user names; anyone may request one, so a collision would gain nothing.
+func groupChallengeKey(group string) string {
+	return "\x00group:" + group
+}
+
+// groupTree builds the member tree of a group: the active commitments of the tenant's
+// registrations that haven't expired or been deleted
+func (s *Server) groupTree(ctx context.Context, group string) (*circuit.GroupTree, error) {
+	tenant := group
+	if group == defaultGroup {
+		tenant = ""
+	}
+	users, listErr := s.store.ListUsers(ctx)
+	if listErr != nil {
+		return nil, fmt.Errorf("listing users: %w", listErr)
+	}
+	now := time.Now()
+	var members []string
+	for _, user := range users {
+		if user.Tenant == tenant && !user.Expired(now) && !user.Deleted() {
+			members = append(members, user.ActiveCommitments()...)
+		}
+	}
+	return circuit.NewGroupTree(members)
+}
+
+// groupHandler describes a group for its members to prove membership. Groups are tenants, with
+// "-" for the default tenant.
+func (s *Server) groupHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	tree, treeErr := s.groupTree(r.Context(), group)
+	if treeErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error building group: %v", treeErr))
+		return
+	}
+	members := tree.Members()
+	if len(members) == 0 {
+		writeProblem(w, http.StatusNotFound, codeNotFound, "The group has no members")
+		return
+	}
+	_, keyID, keysErr := s.groups.keys.get(r.Context())
+	if keysErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up group circuit: %v", keysErr))
+		return
+	}
+	epoch := s.groups.epochAt(time.Now())
+	writeResponse(w, r, http.StatusOK, GroupResponse{
+		Group:       group,
+		Epoch:       epoch,
+		EpochEndsAt: s.groups.epochEnd(epoch),
+		MembersRoot: tree.Root(),
+		Members:     members,
+		KeyID:       keyID,
+	})
+}
+
+// groupChallengeHandler issues a single-use nonce for a group login
+func (s *Server) groupChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	_, keyID, keysErr := s.groups.keys.get(r.Context())
+	if keysErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up group circuit: %v", keysErr))
+		return
+	}
+	nonce, expiresAt, issueErr := s.challenges.issue(r.Context(), groupChallengeKey(r.PathValue("group")))
+	if issueErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error issuing challenge: %v", issueErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, ChallengeResponse{Nonce: nonce.String(), ExpiresAt: expiresAt, KeyID: keyID})
+}
+
+// groupLoginHandler checks a proof that the caller is one of a group's members and answers with a
+// group token. Nothing identifying the member is learned, logged or recorded; the nullifier only
+// stops a member logging in twice in one epoch.
+func (s *Server) groupLoginHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	var req GroupLoginRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+
+	authErr := s.authenticateGroup(r.Context(), group, req, nonce)
+	switch {
+	case errors.Is(authErr, ErrGroupChanged):
+		writeProblem(w, http.StatusConflict, codeGroupChanged, "The group's members or epoch changed since the proof was made; prove again")
+		return
+	case errors.Is(authErr, ErrNullifierUsed):
+		writeProblem(w, http.StatusConflict, codeNullifierUsed, "This member already logged in to the group during the epoch")
+		return
+	case authErr != nil:
+		s.writeAuthError(w, ProofRequest{}, authErr)
+		return
+	}
+
+	token, expiresAt, tokenErr := s.issueGroupToken(group, req.Nullifier, req.Epoch)
+	if tokenErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error signing group token")
+		return
+	}
+	writeResponse(w, r, http.StatusOK, GroupSession{GroupToken: token, ExpiresIn: int64(time.Until(expiresAt) / time.Second)})
+}
+
+// authenticateGroup checks a group login proof against the group's current root and an accepted
+// epoch, then spends its nullifier. The nonce is consumed whether or not the proof verifies.
+func (s *Server) authenticateGroup(ctx context.Context, group string, req GroupLoginRequest, nonce *big.Int) error {
+	keys, _, keysErr := s.groups.keys.get(ctx)
+	if keysErr != nil {
+		return keysErr
+	}
+	tree, treeErr := s.groupTree(ctx, group)
+	if treeErr != nil {
+		return treeErr
+	}
+	first, last := s.groups.acceptedEpochs(time.Now())
+	if req.Epoch < first || req.Epoch > last || req.MembersRoot != tree.Root() {
+		return ErrGroupChanged
+	}
+	if s.groups.spentIn(req.Nullifier, req.Epoch) {
+		return ErrNullifierUsed
+	}
+
+	var consumeErr, verifyErr error
+	poolErr := s.pool.Do(ctx, func() {
+		if consumeErr = s.challenges.consume(ctx, groupChallengeKey(group), nonce); consumeErr != nil {
+			return
+		}
+		inputs := verifier.GroupInputs{MembersRoot: req.MembersRoot, Group: group, Epoch: req.Epoch, Nonce: nonce, Nullifier: req.Nullifier}
+		verifyErr = verifier.New(keys.verifyingKey).VerifyGroupProof(ctx, req.Proof, inputs)
+	})
+	switch {
+	case poolErr != nil:
+		return poolErr
+	case consumeErr != nil:
+		return consumeErr
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		return verifyErr
+	case verifyErr != nil:
+		return invalidProof(verifyErr)
+	}
+	return s.groups.spend(req.Nullifier, req.Epoch)
+}
+
+// issueGroupToken signs a group token for a nullifier, expiring after groups.token_ttl or clock.skew
+// past the end of the epoch, whichever comes first
+func (s *Server) issueGroupToken(group, nullifier string, epoch uint64) (string, time.Time, error) {
+	tokenID, idErr := randomToken()
+	if idErr != nil {
+		return "", time.Time{}, idErr
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.groups.tokenTTL)
+	if end := s.groups.epochEnd(epoch).Add(s.groups.skew); end.Before(expiresAt) {
+		expiresAt = end
+	}
+	issuer := s.cfg.OIDC.issuer()
+	token, signErr := s.tokens.sign(groupTokenType, GroupClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    issuer,
+			Subject:   nullifier,
+			Audience:  issuer,
+			ExpiresAt: expiresAt.Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		Group: group,
+		Epoch: epoch,
+		JWTID: tokenID,
+	})
+	return token, expiresAt, signErr
+}
+
+// groupProvingKeyHandler serves the group circuit's proving key so members can prove locally
+func (s *Server) groupProvingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLazyKey(w, r, s.groups.keys, true)
+}
+
+// groupVerifyingKeyHandler serves the group circuit's verifying key
+func (s *Server) groupVerifyingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLazyKey(w, r, s.groups.keys, false)
+}
@@ -0,0 +1,48 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/client"
+	"A2zkp-circuit/server"
+	"A2zkp-circuit/testkit"
+)
+
+func TestReplayCache(t *testing.T) {
+	// Without bind_nonce a proof verifies against any challenge, so only the replay cache stops a copy
+	ctx := context.Background()
+	for _, ttl := range []time.Duration{time.Minute, 0} {
+		kit, startErr := testkit.Start(ctx, testkit.WithUsers(testkit.User{Name: "alice", Secret: 12345}), testkit.WithConfig(func(cfg *server.Config) {
+			cfg.Circuit = circuit.Composition{Commitment: circuit.CommitmentSquare}
+			cfg.ReplayCacheTTL = server.Duration{Duration: ttl}
+		}))
+		if startErr != nil {
+			t.Fatal(startErr)
+		}
+		t.Cleanup(func() { kit.Close() })
+		submission, proofErr := kit.Proof(ctx, "alice")
+		if proofErr != nil {
+			t.Fatal(proofErr)
+		}
+		if _, verifyErr := kit.Client.Verify(ctx, submission); verifyErr != nil {
+			t.Fatalf("first submission: %v", verifyErr)
+		}
+
+		// The same bytes against a fresh challenge
+		fresh, _ := kit.Client.RequestChallenge(ctx, "alice")
+		submission.Nonce = fresh.Nonce
+		_, replayErr := kit.Client.Verify(ctx, submission)
+		var apiErr *client.APIError
+		switch {
+		case ttl > 0 && (!errors.As(replayErr, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "proof_replayed"):
+			t.Errorf("replayed proof = %v, want 401 proof_replayed", replayErr)
+		case ttl == 0 && replayErr != nil:
+			t.Errorf("replayed proof with the cache disabled = %v; the non-nonce circuit should accept it", replayErr)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// InteractiveChallenge is the first message of GET /v1/login/ws. Its expires_at is the deadline
+// for the proof, which may come before the nonce itself would expire.
+type InteractiveChallenge struct {
+	Type string `json:"type"` // Type is "challenge"
+	ChallengeResponse
+}
+
+// InteractiveProof is the client's answer to an InteractiveChallenge
+type InteractiveProof struct {
+	Type  string `json:"type"`             // Type is "proof"
+	Proof []byte `json:"proof"`            // Proof is the base64-encoded Groth16 proof bound to the challenge nonce
+	KeyID string `json:"key_id,omitempty"` // KeyID is the key version the proof was generated with; the challenge's when omitted
+	// ProofEncoding is Proof's point encoding, "compressed" when omitted or "uncompressed"
+	ProofEncoding string `json:"proof_encoding,omitempty"`
+	// TOTPCode is the user's one-time code, when their tenant's TOTP policy asks for one
+	TOTPCode string `json:"totp_code,omitempty"`
+	// WebAuthn is the assertion of the user's hardware key, when the registration is bound to one
+	WebAuthn *WebAuthnAssertion `json:"webauthn,omitempty"`
+	// CryptoCommitment is the commitment the proof was generated against, which a server with
+	// commitment_blinding needs
+	CryptoCommitment string `json:"crypto_commitment,omitempty"`
+}
+
+// InteractiveVerdict is the server's last message on GET /v1/login/ws
+type InteractiveVerdict struct {
+	Type         string   `json:"type"`                    // Type is "verdict"
+	Status       string   `json:"status"`                  // Status is "accepted" or "rejected"
+	KeyID        string   `json:"key_id,omitempty"`        // KeyID is the key version an accepted proof verified under
+	SessionToken string   `json:"session_token,omitempty"` // SessionToken is a signed JWT naming the user, issued on acceptance
+	ExpiresIn    int64    `json:"expires_in,omitempty"`    // ExpiresIn is the session token's lifetime in seconds
+	Problem      *Problem `json:"problem,omitempty"`       // Problem explains a rejection as the HTTP routes would
+}
+
+// SessionClaims are the claims of a session token issued by the interactive login
+type SessionClaims struct {
+	registeredClaims
+	KeyID string `json:"key_id"` // KeyID is the key version the login proof verified under
+	JWTID string `json:"jti"`
+}
+
+// sessionTokenType is the "typ" header of session tokens, keeping them apart from OAuth tokens
+const sessionTokenType = "session+jwt"
+
+// upgrader completes WebSocket handshakes, answering a request that isn't one with a problem. The
+// default origin check stands: browsers on other origins are refused with 403.
+var upgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, _ *http.Request, status int, reason error) {
+		if status == http.StatusForbidden {
+			writeProblem(w, status, codeInvalidRequest, fmt.Sprintf("Refused the WebSocket handshake: %v", reason))
+			return
+		}
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeProblem(w, http.StatusUpgradeRequired, codeInvalidRequest, fmt.Sprintf("Expected a WebSocket handshake: %v", reason))
+	},
+}
+
+// interactiveLoginHandler upgrades to a WebSocket and runs a whole login over it: the server sends
+// a challenge, the client answers with its proof before the deadline and the server pushes the
+// verdict, with a session token when the proof verifies
+func (s *Server) interactiveLoginHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.URL.Query().Get("user_name")
+	if validateErr := (ChallengeRequest{UserName: userName}).validate(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	if _, getErr := s.getUser(r.Context(), userName); getErr != nil && s.cfg.RevealUserExistence {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return
+	}
+	conn, upgradeErr := upgrader.Upgrade(w, r, nil)
+	if upgradeErr != nil {
+		return // upgrader.Error has answered
+	}
+	defer conn.Close()
+	conn.SetReadLimit(s.cfg.MaxBodyBytes)
+
+	verdict, clientGone := s.interactiveLogin(r.Context(), conn, userName)
+	if clientGone {
+		s.closeWebSocket(conn, websocket.CloseGoingAway)
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout.Duration))
+	conn.WriteJSON(verdict)
+	s.closeWebSocket(conn, websocket.CloseNormalClosure)
+}
+
+// closeWebSocket sends a close frame with code, leaving the connection to be closed by the caller
+func (s *Server) closeWebSocket(conn *websocket.Conn, code int) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(s.cfg.WriteTimeout.Duration))
+}
+
+// interactiveLogin sends the challenge and checks the proof that comes back, reporting instead
+// whether the client hung up or broke the protocol before sending one
+func (s *Server) interactiveLogin(ctx context.Context, conn *websocket.Conn, userName string) (InteractiveVerdict, bool) {
+	nonce, expiresAt, issueErr := s.challenges.issue(ctx, userName)
+	if issueErr != nil {
+		return rejectedVerdict(http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error issuing challenge: %v", issueErr)), false
+	}
+	deadline := time.Now().Add(s.cfg.InteractiveDeadline.Duration)
+	if expiresAt.Before(deadline) {
+		deadline = expiresAt
+	}
+	challenge := InteractiveChallenge{
+		Type:              "challenge",
+		ChallengeResponse: ChallengeResponse{Nonce: nonce.String(), ExpiresAt: deadline, KeyID: s.keyring.current().ID},
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout.Duration))
+	if writeErr := conn.WriteJSON(challenge); writeErr != nil {
+		return InteractiveVerdict{}, true
+	}
+
+	conn.SetReadDeadline(deadline)
+	messageType, message, readErr := conn.ReadMessage()
+	// A timeout is the one read error that leaves the connection fit to carry the verdict; after
+	// a close, a protocol violation or an oversized message the client is gone
+	var netErr net.Error
+	switch {
+	case errors.As(readErr, &netErr) && netErr.Timeout():
+		return rejectedVerdict(http.StatusUnauthorized, codeChallengeExpired, "No proof arrived before the deadline"), false
+	case readErr != nil:
+		return InteractiveVerdict{}, true
+	case messageType != websocket.TextMessage:
+		return rejectedVerdict(http.StatusBadRequest, codeInvalidRequest, "Expected a proof message, got a binary message"), false
+	}
+	var answer InteractiveProof
+	switch decodeErr := json.Unmarshal(message, &answer); {
+	case decodeErr != nil:
+		return rejectedVerdict(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Expected a proof message: %v", decodeErr)), false
+	case answer.Type != "proof":
+		return rejectedVerdict(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Expected a proof message, got %q", answer.Type)), false
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	req := ProofRequest{UserName: userName, Nonce: nonce.String(), Proof: answer.Proof, KeyID: answer.KeyID, ProofEncoding: answer.ProofEncoding, TOTPCode: answer.TOTPCode, WebAuthn: answer.WebAuthn, CryptoCommitment: answer.CryptoCommitment}
+	if req.KeyID == "" {
+		req.KeyID = challenge.KeyID
+	}
+	if _, validateErr := req.validate(); validateErr != nil {
+		return rejectedVerdict(http.StatusBadRequest, codeInvalidRequest, validateErr.Error()), false
+	}
+	_, version, authErr := s.authenticate(ctx, req, nonce)
+	if authErr != nil {
+		problem := authProblem(req, authErr)
+		return InteractiveVerdict{Type: "verdict", Status: "rejected", Problem: &problem}, false
+	}
+
+	token, tokenErr := s.issueSessionToken(ctx, userName, version.ID)
+	if tokenErr != nil {
+		return rejectedVerdict(http.StatusInternalServerError, codeInternal, "Error signing session token"), false
+	}
+	return InteractiveVerdict{
+		Type:         "verdict",
+		Status:       "accepted",
+		KeyID:        version.ID,
+		SessionToken: token,
+		ExpiresIn:    int64(s.cfg.SessionTTL.Duration / time.Second),
+	}, false
+}
+
+// rejectedVerdict is the verdict for a failed login, carrying the problem the HTTP routes would answer with
+func rejectedVerdict(status int, code, detail string) InteractiveVerdict {
+	problem := newProblem(status, code, detail)
+	return InteractiveVerdict{Type: "verdict", Status: "rejected", Problem: &problem}
+}
+
+// issueSessionToken signs a session token for a user who just proved knowledge of their secret,
+// recording it for the max_sessions rule of authentication policies
+func (s *Server) issueSessionToken(ctx context.Context, userName, keyID string) (string, error) {
+	tokenID, idErr := randomToken()
+	if idErr != nil {
+		return "", idErr
+	}
+	now := time.Now()
+	issuer := s.cfg.OIDC.issuer()
+	token, signErr := s.tokens.sign(sessionTokenType, SessionClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    issuer,
+			Subject:   userName,
+			Audience:  issuer,
+			ExpiresAt: now.Add(s.cfg.SessionTTL.Duration).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		KeyID: keyID,
+		JWTID: tokenID,
+	})
+	if signErr != nil {
+		return "", signErr
+	}
+	// Expired sessions are pruned as new ones are recorded, so the records stay bounded
+	if _, pruneErr := s.store.PruneSessions(ctx, now); pruneErr != nil {
+		return "", pruneErr
+	}
+	session := store.Session{TokenID: tokenID, UserName: userName, IssuedAt: now, ExpiresAt: now.Add(s.cfg.SessionTTL.Duration)}
+	if recordErr := s.store.RecordSession(ctx, session); recordErr != nil {
+		return "", recordErr
+	}
+	return token, nil
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// IntrospectionResponse is the RFC 7662 answer of the introspection endpoint. A token that is
+// unknown, expired, rotated or revoked, or whose user is gone, is answered with active false alone.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	JWTID     string `json:"jti,omitempty"` // JWTID is set for access, step-up and session tokens
+	// AssuranceLevel is set for step-up tokens. SessionID is the session they elevate, the one an
+	// access token belongs to, or a session token's own jti
+	AssuranceLevel string `json:"acr,omitempty"`
+	SessionID      string `json:"sid,omitempty"`
+}
+
+// introspectHandler implements RFC 7662 token introspection, so resource servers can check a token
+// centrally instead of verifying it themselves. Only confidential clients may introspect. Access
+// tokens must verify and belong to a user who is still registered; step-up tokens must verify,
+// belong to a user who is still registered and elevate a session that wasn't revoked; session
+// tokens must verify, not be revoked and belong to a user who is still registered; refresh tokens
+// must be active in the store and are only reported to the client they were issued to.
+func (s *Server) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	if parseErr := r.ParseForm(); parseErr != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+	client, clientErr := s.authenticateClient(r)
+	if clientErr == nil && client.ClientSecret == "" {
+		clientErr = errors.New("introspection needs the credentials of a confidential client")
+	}
+	if clientErr != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", clientErr.Error())
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	// Access, step-up and session tokens are JWTs, told apart by their type, and refresh tokens never
+	// contain a dot, so token_type_hint isn't needed
+	var response IntrospectionResponse
+	var introspectErr error
+	if strings.Count(token, ".") == 2 {
+		response, introspectErr = s.introspectAccessToken(r.Context(), token)
+		if introspectErr == nil && !response.Active {
+			response, introspectErr = s.introspectStepUpToken(r.Context(), token)
+		}
+		if introspectErr == nil && !response.Active {
+			response, introspectErr = s.introspectSessionToken(r.Context(), token)
+		}
+	} else {
+		response, introspectErr = s.introspectRefreshToken(r.Context(), token, client.ClientID)
+	}
+	if introspectErr != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error introspecting token")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// introspectAccessToken describes an access token issued by the token endpoint, which is inactive
+// once its session is revoked
+func (s *Server) introspectAccessToken(ctx context.Context, token string) (IntrospectionResponse, error) {
+	var claims AccessTokenClaims
+	if s.tokens.verify(token, "at+jwt", s.cfg.OIDC.issuer(), &claims) != nil {
+		return IntrospectionResponse{}, nil
+	}
+	// Access tokens are stateless, but a central check can still notice the user was deleted or expired
+	if active, userErr := s.userActive(ctx, claims.Subject); userErr != nil || !active {
+		return IntrospectionResponse{}, userErr
+	}
+	revoked, checkErr := s.store.SessionRevoked(ctx, claims.Subject, claims.SessionID, time.Unix(claims.IssuedAt, 0))
+	if checkErr != nil || revoked {
+		return IntrospectionResponse{}, checkErr
+	}
+	return IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		JWTID:     claims.JWTID,
+		SessionID: claims.SessionID,
+	}, nil
+}
+
+// introspectStepUpToken describes a step-up token, which is inactive once the session it elevates
+// is revoked or its user is gone
+func (s *Server) introspectStepUpToken(ctx context.Context, token string) (IntrospectionResponse, error) {
+	var claims StepUpClaims
+	if s.tokens.verify(token, stepUpTokenType, s.cfg.OIDC.issuer(), &claims) != nil {
+		return IntrospectionResponse{}, nil
+	}
+	if active, userErr := s.userActive(ctx, claims.Subject); userErr != nil || !active {
+		return IntrospectionResponse{}, userErr
+	}
+	revoked, checkErr := s.store.SessionRevoked(ctx, claims.Subject, claims.SessionID, time.Unix(claims.IssuedAt, 0))
+	if checkErr != nil || revoked {
+		return IntrospectionResponse{}, checkErr
+	}
+	return IntrospectionResponse{
+		Active:         true,
+		Subject:        claims.Subject,
+		Audience:       claims.Audience,
+		Issuer:         claims.Issuer,
+		ExpiresAt:      claims.ExpiresAt,
+		IssuedAt:       claims.IssuedAt,
+		JWTID:          claims.JWTID,
+		AssuranceLevel: claims.AssuranceLevel,
+		SessionID:      claims.SessionID,
+	}, nil
+}
+
+// introspectSessionToken describes a session token from the interactive login, which is inactive once
+// it is revoked or its user is gone. Its sid is its own jti, the one step-up tokens name.
+func (s *Server) introspectSessionToken(ctx context.Context, token string) (IntrospectionResponse, error) {
+	var claims SessionClaims
+	if s.tokens.verify(token, sessionTokenType, s.cfg.OIDC.issuer(), &claims) != nil {
+		return IntrospectionResponse{}, nil
+	}
+	if active, userErr := s.userActive(ctx, claims.Subject); userErr != nil || !active {
+		return IntrospectionResponse{}, userErr
+	}
+	revoked, checkErr := s.store.SessionRevoked(ctx, claims.Subject, claims.JWTID, time.Unix(claims.IssuedAt, 0))
+	if checkErr != nil || revoked {
+		return IntrospectionResponse{}, checkErr
+	}
+	return IntrospectionResponse{
+		Active:    true,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		JWTID:     claims.JWTID,
+		SessionID: claims.JWTID,
+	}, nil
+}
+
+// userActive reports whether userName is still registered and not expired
+func (s *Server) userActive(ctx context.Context, userName string) (bool, error) {
+	user, getErr := s.getUser(ctx, userName)
+	switch {
+	case errors.Is(getErr, store.ErrUserNotFound):
+		return false, nil
+	case getErr != nil:
+		return false, getErr
+	}
+	return !user.Expired(time.Now()), nil
+}
+
+// introspectRefreshToken describes a refresh token issued to clientID. Unlike redeeming it,
+// introspecting a rotated token does not revoke its family.
+func (s *Server) introspectRefreshToken(ctx context.Context, token, clientID string) (IntrospectionResponse, error) {
+	stored, getErr := s.store.GetRefreshToken(ctx, refreshTokenHash(token))
+	switch {
+	case errors.Is(getErr, store.ErrRefreshTokenNotFound):
+		return IntrospectionResponse{}, nil
+	case getErr != nil:
+		return IntrospectionResponse{}, getErr
+	case stored.RotatedAt != nil || stored.ClientID != clientID || !time.Now().Before(stored.ExpiresAt):
+		return IntrospectionResponse{}, nil
+	}
+	return IntrospectionResponse{
+		Active:    true,
+		Scope:     stored.Scope,
+		ClientID:  stored.ClientID,
+		Subject:   stored.UserName,
+		Issuer:    s.cfg.OIDC.issuer(),
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.IssuedAt.Unix(),
+	}, nil
+}
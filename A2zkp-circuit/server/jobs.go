@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+)
+
+// Job states reported by GET /v1/jobs/{id}
+const (
+	jobQueued    = "queued"
+	jobProving   = "proving"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// ProveRequest is the body of POST /v1/prove.
+//
+// Server-side proving means the server sees the secret, so the endpoint is disabled unless
+// enable_proving_api is set. It is meant for deployments where this server runs on hardware
+// the user already trusts with the secret, such as a sidecar next to a thin client.
+type ProveRequest struct {
+	UserSecret secret.Buffer `json:"user_secret"` // The decimal secret to prove knowledge of, decoded without a string copy
+	Nonce      string        `json:"nonce"`       // The challenge nonce to bind the proof to
+	// ProofEncoding is the point encoding of the finished proof: "compressed", the default, or "uncompressed"
+	ProofEncoding string `json:"proof_encoding,omitempty"`
+}
+
+// JobStatus is the representation of a proving job returned to clients
+type JobStatus struct {
+	ID               string     `json:"id"`
+	Status           string     `json:"status"`
+	CreatedAt        time.Time  `json:"created_at"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+	CryptoCommitment string     `json:"crypto_commitment,omitempty"` // The public commitment the proof is for
+	Nonce            string     `json:"nonce,omitempty"`
+	Proof            []byte     `json:"proof,omitempty"`          // The base64-encoded proof once the job is done
+	ProofEncoding    string     `json:"proof_encoding,omitempty"` // The point encoding of Proof, to submit it with
+	KeyID            string     `json:"key_id,omitempty"`         // The key version the proof was generated with
+	// Stage is how far a proving job got, prover.StageWitness, StageProving or StageDone, and Percent
+	// its estimated share of the proving work done so far
+	Stage   string  `json:"stage,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// provingJob is the server-side state of one asynchronous proof generation
+type provingJob struct {
+	status  JobStatus
+	cancel  context.CancelFunc
+	changed chan struct{} // changed is closed and replaced whenever status changes
+}
+
+// jobStore tracks asynchronous proving jobs and forgets finished ones after the retention period
+type jobStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	jobs      map[string]*provingJob
+}
+
+// newJobStore creates a job store keeping finished results for retention
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{retention: retention, jobs: make(map[string]*provingJob)}
+}
+
+// add registers a new queued job and returns its ID
+func (s *jobStore) add(nonce string, cancel context.CancelFunc) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, randErr := rand.Read(idBytes); randErr != nil {
+		return "", randErr
+	}
+	id := hex.EncodeToString(idBytes)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.jobs[id] = &provingJob{
+		status:  JobStatus{ID: id, Status: jobQueued, CreatedAt: time.Now().UTC(), Nonce: nonce},
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	return id, nil
+}
+
+// get returns a copy of a job's status
+func (s *jobStore) get(id string) (JobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	job, exists := s.jobs[id]
+	if !exists {
+		return JobStatus{}, false
+	}
+	return job.status, true
+}
+
+// watch returns a copy of a job's status and a channel closed at its next change
+func (s *jobStore) watch(id string) (JobStatus, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	job, exists := s.jobs[id]
+	if !exists {
+		return JobStatus{}, nil, false
+	}
+	return job.status, job.changed, true
+}
+
+// update applies a change to a job unless it already reached a final state
+func (s *jobStore) update(id string, change func(*JobStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, exists := s.jobs[id]
+	if !exists || isFinalJobStatus(job.status.Status) {
+		return
+	}
+	change(&job.status)
+	close(job.changed)
+	job.changed = make(chan struct{})
+	if isFinalJobStatus(job.status.Status) {
+		finishedAt := time.Now().UTC()
+		job.status.FinishedAt = &finishedAt
+		job.cancel()
+	}
+}
+
+// cancelJob marks an unfinished job cancelled, returning false if it doesn't exist
+func (s *jobStore) cancelJob(id string) (JobStatus, bool) {
+	s.update(id, func(status *JobStatus) { status.Status = jobCancelled })
+	return s.get(id)
+}
+
+// pruneLocked forgets jobs that finished more than the retention period ago; the caller must hold s.mu
+func (s *jobStore) pruneLocked() {
+	cutoff := time.Now().Add(-s.retention)
+	for id, job := range s.jobs {
+		if job.status.FinishedAt != nil && job.status.FinishedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// isFinalJobStatus reports whether a job can no longer change
+func isFinalJobStatus(status string) bool {
+	return status == jobDone || status == jobFailed || status == jobCancelled
+}
+
+// proveHandler queues a proving job and returns its ID immediately
+func (s *Server) proveHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableProvingAPI {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "Server-side proving is disabled")
+		return
+	}
+	var req ProveRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	userSecret := &req.UserSecret
+	if userSecret.Check() != nil {
+		writeRequestError(w, errInvalidSecret)
+		return
+	}
+	var v validate.Validator
+	nonce := v.FieldElement("nonce", req.Nonce)
+	if req.ProofEncoding == "" {
+		req.ProofEncoding = verifier.ProofCompressed
+	}
+	if req.ProofEncoding != verifier.ProofCompressed && req.ProofEncoding != verifier.ProofUncompressed {
+		v.Fail("proof_encoding", "must be %s or %s", verifier.ProofCompressed, verifier.ProofUncompressed)
+	}
+	if nonceErr := v.Err(); nonceErr != nil {
+		userSecret.Zero()
+		writeRequestError(w, nonceErr)
+		return
+	}
+
+	// The estimated memory of the proof stays reserved from admission until the job is over
+	needed := estimateProofMemory(s.keyring.current().keys.ccs)
+	release, ahead, reserved := s.provingMemory.reserve(needed)
+	if !reserved {
+		userSecret.Zero()
+		writeMemoryBusy(w, s.cfg.PoolRetryAfter.Duration, needed, ahead)
+		return
+	}
+
+	// The job outlives the request, so it gets its own cancellable context
+	jobCtx, cancel := context.WithCancel(context.Background())
+	id, addErr := s.jobs.add(nonce.String(), cancel)
+	if addErr != nil {
+		release()
+		cancel()
+		userSecret.Zero()
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error creating job")
+		return
+	}
+
+	queueErr := s.pool.Go(jobCtx, func() { s.runProvingJob(jobCtx, id, userSecret, nonce, req.ProofEncoding) }, func(runErr error) {
+		release()
+		if runErr != nil {
+			userSecret.Zero()
+			s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobCancelled, runErr.Error() })
+		}
+	})
+	if errors.Is(queueErr, ErrPoolBusy) {
+		release()
+		userSecret.Zero()
+		s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobFailed, queueErr.Error() })
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	}
+
+	status, _ := s.jobs.get(id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/jobs/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// runProvingJob generates the proof for a queued job on a pool worker, in the point encoding the
+// job asked for. The secret is zeroed as soon as the witness exists, and the witness once the proof does.
+func (s *Server) runProvingJob(ctx context.Context, id string, userSecret *secret.Buffer, nonce *big.Int, encoding string) {
+	if ctx.Err() != nil {
+		userSecret.Zero()
+		return
+	}
+	s.jobs.update(id, func(status *JobStatus) { status.Status = jobProving })
+
+	fullWitness, witnessErr := s.cfg.Circuit.NewWitness(userSecret, nonce)
+	cryptoCommitment, commitErr := s.cfg.Circuit.GenerateCommitment(userSecret)
+	userSecret.Zero()
+	if witnessErr != nil {
+		s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobFailed, witnessErr.Error() })
+		return
+	}
+	defer circuit.WipeWitness(fullWitness)
+	if commitErr != nil {
+		s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobFailed, commitErr.Error() })
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	s.jobs.update(id, func(status *JobStatus) { status.Stage = prover.StageWitness })
+
+	// Groth16 proving can't be interrupted; a job cancelled meanwhile simply discards its result
+	version := s.keyring.current()
+	proveStarted := time.Now()
+	progressCtx := prover.WithProgress(ctx, func(progress prover.Progress) {
+		s.jobs.update(id, func(status *JobStatus) { status.Stage, status.Percent = progress.Stage, progress.Percent })
+	})
+	proof, proveErr := s.prover.Prove(progressCtx, version.keys.ccs, version.keys.provingKey, fullWitness)
+	if proveErr != nil {
+		s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobFailed, proveErr.Error() })
+		return
+	}
+	took := time.Since(proveStarted)
+	encode := prover.EncodeProof
+	if encoding == verifier.ProofUncompressed {
+		encode = prover.EncodeUncompressedProof
+	}
+	encoded, encodeErr := encode(proof)
+	if encodeErr != nil {
+		s.jobs.update(id, func(status *JobStatus) { status.Status, status.Error = jobFailed, encodeErr.Error() })
+		return
+	}
+	s.observeProof(proofProve, version, circuit.Curve.String(), took, len(encoded))
+	s.jobs.update(id, func(status *JobStatus) {
+		status.Status = jobDone
+		status.CryptoCommitment = cryptoCommitment
+		status.Proof = encoded
+		status.ProofEncoding = encoding
+		status.KeyID = version.ID
+	})
+}
+
+// jobStatusHandler reports the state of a proving job, including the proof once done
+func (s *Server) jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, exists := s.jobs.get(r.PathValue("id"))
+	if !exists {
+		writeProblem(w, http.StatusNotFound, codeJobNotFound, "Unknown job")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// cancelJobHandler cancels a queued or running proving job
+func (s *Server) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	status, exists := s.jobs.cancelJob(r.PathValue("id"))
+	if !exists {
+		writeProblem(w, http.StatusNotFound, codeJobNotFound, "Unknown job")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// jobEventsKeepAlive is how often an idle event stream sends a comment so proxies keep it open
+const jobEventsKeepAlive = 15 * time.Second
+
+// jobEventsHandler streams a proving job's state transitions as Server-Sent Events, one event
+// named after each state with the JobStatus as data, and ends the stream after the final state.
+// A proving job sends a proving event again each time its stage or percent moves on.
+func (s *Server) jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	status, changed, exists := s.jobs.watch(r.PathValue("id"))
+	if !exists {
+		writeProblem(w, http.StatusNotFound, codeJobNotFound, "Unknown job")
+		return
+	}
+	// The stream lasts as long as the job, well past the server's write timeout
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(jobEventsKeepAlive)
+	defer keepAlive.Stop()
+	var lastSent JobStatus
+	for {
+		if status.Status != lastSent.Status || status.Stage != lastSent.Stage || status.Percent != lastSent.Percent {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", status.Status, data)
+			lastSent = status
+		}
+		if controller.Flush() != nil || isFinalJobStatus(status.Status) {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			continue
+		case <-r.Context().Done():
+			return
+		}
+		if status, changed, exists = s.jobs.watch(status.ID); !exists {
+			return
+		}
+	}
+}
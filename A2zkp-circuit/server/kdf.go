@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+
+	"A2zkp-circuit/secret"
+)
+
+// validate checks every parameter set of the registry and that no name and version repeat
+func (c KDFConfig) validate() error {
+	seen := make(map[string]bool, len(c.Registry))
+	for i, params := range c.Registry {
+		if params.Name == "" {
+			return fmt.Errorf("kdfs registry[%d] needs a name and a version", i)
+		}
+		if validateErr := params.Validate(); validateErr != nil {
+			return fmt.Errorf("kdfs registry[%d]: %w", i, validateErr)
+		}
+		key := fmt.Sprintf("%s/%d", params.Name, params.Version)
+		if seen[key] {
+			return fmt.Errorf("kdfs registry[%d] repeats version %d of %q", i, params.Version, params.Name)
+		}
+		seen[key] = true
+	}
+	if c.RequireRegistered && len(c.Registry) == 0 {
+		return fmt.Errorf("kdfs require_registered needs a registry")
+	}
+	return nil
+}
+
+// kdfRegistry returns the registered parameter sets, never nil so GET /v1/circuit lists none as []
+func (s *Server) kdfRegistry() []secret.KDFParams {
+	if s.cfg.KDFs.Registry == nil {
+		return []secret.KDFParams{}
+	}
+	return s.cfg.KDFs.Registry
+}
+
+// registeredKDF returns the parameter set of the registry with a name and version
+func (s *Server) registeredKDF(name string, version uint32) (secret.KDFParams, bool) {
+	for _, params := range s.cfg.KDFs.Registry {
+		if params.Name == name && params.Version == version {
+			return params, true
+		}
+	}
+	return secret.KDFParams{}, false
+}
+
+// checkKDF resolves the KDF parameters of a registration against the registry. A registration
+// may name a set alone, whose parameters are recorded in req for newUser, or with its parameters,
+// which have to be the set's. With kdfs.require_registered unnamed parameters are refused; raw
+// secrets, without KDF parameters, always pass.
+func (s *Server) checkKDF(req *RegisterRequest) error {
+	if req.KDF == nil {
+		return nil
+	}
+	if req.KDF.Name == "" {
+		if s.cfg.KDFs.RequireRegistered {
+			return badRequest("kdf: registrations use a parameter set of the registry GET /v1/circuit lists")
+		}
+		return nil
+	}
+	if req.KDF.Version == 0 {
+		return badRequest("kdf: parameter set %q needs a version", req.KDF.Name)
+	}
+	registered, found := s.registeredKDF(req.KDF.Name, req.KDF.Version)
+	if !found {
+		return badRequest("kdf: version %d of %q is not a registered parameter set", req.KDF.Version, req.KDF.Name)
+	}
+	if req.KDF.Algorithm != "" && !req.KDF.SameCosts(registered) {
+		return badRequest("kdf: the parameters are not those of version %d of %q", req.KDF.Version, req.KDF.Name)
+	}
+	req.KDF = &registered
+	return nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/convert"
+	"A2zkp-circuit/verifier"
+)
+
+// VerifyingKeyDocument is the response of GET /v1/keys/{circuitVersion}: a verifying key in both
+// encodings, with the signed manifest embedded verifiers check it against before pinning it
+type VerifyingKeyDocument struct {
+	verifier.KeyManifest
+	Gnark []byte `json:"gnark"` // Gnark is the key in gnark binary encoding, base64
+	// SnarkJS is the key as snarkjs's verification_key.json; omitted for keys snarkjs can't verify with
+	SnarkJS *verifier.SnarkJSVerifyingKey `json:"snarkjs,omitempty"`
+	// Signature is a compact JWS of type verifier.KeyManifestType whose payload is the manifest, signed
+	// with a key published at /v1/signing-keys; verifier.VerifyKeyManifest checks it
+	Signature string `json:"signature"`
+}
+
+// circuitKeyVersion finds the key version ?key_id= names among those of a circuit version, by
+// default its current one
+func (s *Server) circuitKeyVersion(r *http.Request, circuitVersion string) (*keyVersion, error) {
+	keyID := r.URL.Query().Get("key_id")
+	if pinned := s.tenantCircuits[circuitVersion]; pinned != nil {
+		return pinned.keyVersion(r.Context(), ProofRequest{KeyID: keyID})
+	}
+	if circuitVersion != s.circuitVersion {
+		return nil, fmt.Errorf("%w: no circuit has version %q", ErrKeyNotFound, circuitVersion)
+	}
+	return s.keyring.lookup(keyID)
+}
+
+// keyDocumentHandler distributes the verifying key of a circuit version with its SHA-256 digests
+// and a signed manifest. ?format=gnark and ?format=snarkjs serve the key alone in that encoding,
+// the bytes the manifest's digests are of.
+func (s *Server) keyDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "gnark" && format != "snarkjs" {
+		writeRequestError(w, badRequest("format must be gnark or snarkjs"))
+		return
+	}
+	version, keyErr := s.circuitKeyVersion(r, r.PathValue("circuitVersion"))
+	switch {
+	case errors.Is(keyErr, ErrKeyNotFound) || errors.Is(keyErr, ErrKeyExpired):
+		writeProblem(w, http.StatusNotFound, keyProblemCode(keyErr), fmt.Sprintf("Key version: %v", keyErr))
+		return
+	case keyErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up keys: %v", keyErr))
+		return
+	}
+	w.Header().Set(keyVersionHeader, version.ID)
+
+	document := VerifyingKeyDocument{KeyManifest: verifier.KeyManifest{CircuitVersion: version.CircuitVersion, KeyID: version.ID, Curve: circuit.Curve.String()}}
+	var snarkJS []byte
+	if converted, convertErr := convert.VerifyingKeyToSnarkJS(version.keys.verifyingKey); convertErr == nil {
+		snarkJS, _ = json.Marshal(converted)
+		document.SnarkJS = &converted
+		document.SnarkJSDigest = sha256Hash(snarkJS)
+	}
+	var binary bytes.Buffer
+	if _, writeErr := version.keys.verifyingKey.WriteTo(&binary); writeErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error encoding verifying key: %v", writeErr))
+		return
+	}
+	document.Gnark, document.Digest = binary.Bytes(), sha256Hash(binary.Bytes())
+
+	named := r.URL.Query().Has("key_id")
+	switch {
+	case format == "gnark":
+		if s.notModified(w, r, keyETag(version.ID, "verifying"), named) {
+			return
+		}
+		writeKeyBytes(w, "application/octet-stream", document.Gnark)
+		return
+	case format == "snarkjs" && snarkJS == nil:
+		writeProblem(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Key version %s has no snarkjs encoding", version.ID))
+		return
+	case format == "snarkjs":
+		if s.notModified(w, r, keyETag(version.ID, "snarkjs"), named) {
+			return
+		}
+		writeKeyBytes(w, "application/json", snarkJS)
+		return
+	}
+
+	signature, signErr := s.signingKeys.sign(r.Context(), verifier.KeyManifestType, document.KeyManifest)
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error signing key manifest: %v", signErr))
+		return
+	}
+	document.Signature = signature
+	s.writeCachedResponse(w, r, document)
+}
+
+// sha256Hash is data's SHA-256 as verifier.KeyHash writes it, "sha256:" followed by hex
+func sha256Hash(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// writeKeyBytes serves one encoding of a key, with its RFC 9530 Repr-Digest header
+func writeKeyBytes(w http.ResponseWriter, contentType string, key []byte) {
+	digest := sha256.Sum256(key)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+	w.Write(key)
+}
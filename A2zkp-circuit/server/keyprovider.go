@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+)
+
+// KeyProvider keeps key-encryption and signing keys inside a KMS or HSM. Secrets such as the
+// proving key are stored sealed under a data key that only the provider can unwrap, and token
+// signing happens through a crypto.Signer whose private key never leaves the device.
+type KeyProvider interface {
+	// Name identifies the provider in sealed files, e.g. "aws-kms"
+	Name() string
+	// WrapKey encrypts a data key under the provider's key-encryption key
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key produced by WrapKey
+	UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error)
+	// Signer returns a signer for the asymmetric key identified by keyRef (a KMS key ID or an HSM label)
+	Signer(ctx context.Context, keyRef string) (crypto.Signer, error)
+}
+
+// PKCS11Config selects the token and objects used by the pkcs11 key provider
+type PKCS11Config struct {
+	ModulePath   string `json:"module_path"`    // ModulePath is the vendor PKCS#11 library, e.g. /usr/lib/softhsm/libsofthsm2.so
+	TokenLabel   string `json:"token_label"`    // TokenLabel selects the token to log into
+	PIN          string `json:"pin"`            // PIN is the user PIN; prefer $OFA_PKCS11_PIN
+	WrapKeyLabel string `json:"wrap_key_label"` // WrapKeyLabel is the CKA_LABEL of the AES key that wraps data keys
+}
+
+// newKeyProvider opens the provider selected by cfg.KeyProvider; it returns nil when none is configured
+func newKeyProvider(cfg Config) (KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case "":
+		return nil, nil
+	case "aws-kms":
+		provider, providerErr := newAWSKMSProvider(cfg.AWSKMS)
+		if providerErr != nil {
+			return nil, providerErr
+		}
+		return provider, nil
+	case "pkcs11":
+		return newPKCS11Provider(cfg.PKCS11)
+	case "vault-transit":
+		provider, providerErr := newVaultTransitProvider(cfg.vault)
+		if providerErr != nil {
+			return nil, providerErr
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("unknown key_provider %q (want aws-kms, pkcs11 or vault-transit)", cfg.KeyProvider)
+	}
+}
+
+// sealedArtifact is the on-disk form of a file encrypted through a KeyProvider
+type sealedArtifact struct {
+	Provider   string `json:"provider"`    // Provider is the Name of the KeyProvider that wrapped the data key
+	WrappedKey []byte `json:"wrapped_key"` // WrappedKey is the AES-256 data key encrypted by the provider
+	Ciphertext []byte `json:"ciphertext"`  // Ciphertext is the artifact sealed with the data key, nonce first
+}
+
+// sealWithProvider encrypts plaintext under a fresh data key wrapped by provider. The name is
+// bound as associated data so sealed files can't be swapped for one another.
+func sealWithProvider(ctx context.Context, provider KeyProvider, name string, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, randErr := rand.Read(dataKey); randErr != nil {
+		return nil, randErr
+	}
+	defer secret.WipeBytes(dataKey)
+
+	ciphertext, sealErr := store.SealAESGCM(dataKey, plaintext, []byte(name))
+	if sealErr != nil {
+		return nil, sealErr
+	}
+	wrappedKey, wrapErr := provider.WrapKey(ctx, dataKey)
+	if wrapErr != nil {
+		return nil, fmt.Errorf("wrapping data key with %s: %w", provider.Name(), wrapErr)
+	}
+	return json.Marshal(sealedArtifact{Provider: provider.Name(), WrappedKey: wrappedKey, Ciphertext: ciphertext})
+}
+
+// openWithProvider reverses sealWithProvider; the plaintext only ever exists in memory
+func openWithProvider(ctx context.Context, provider KeyProvider, name string, sealed []byte) ([]byte, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("%s is sealed but no key_provider is configured", name)
+	}
+	var artifact sealedArtifact
+	if decodeErr := json.Unmarshal(sealed, &artifact); decodeErr != nil {
+		return nil, fmt.Errorf("decoding sealed %s: %w", name, decodeErr)
+	}
+	if artifact.Provider != provider.Name() {
+		return nil, fmt.Errorf("%s was sealed with %s but the configured key_provider is %s", name, artifact.Provider, provider.Name())
+	}
+	dataKey, unwrapErr := provider.UnwrapKey(ctx, artifact.WrappedKey)
+	if unwrapErr != nil {
+		return nil, fmt.Errorf("unwrapping data key for %s: %w", name, unwrapErr)
+	}
+	defer secret.WipeBytes(dataKey)
+	plaintext, openErr := store.OpenAESGCM(dataKey, artifact.Ciphertext, []byte(name))
+	if openErr != nil {
+		return nil, errors.New("sealed " + name + " failed authentication")
+	}
+	return plaintext, nil
+}
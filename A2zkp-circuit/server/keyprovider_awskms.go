@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSKMSConfig selects the AWS KMS keys used by the aws-kms key provider.
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and, optionally, AWS_SESSION_TOKEN.
+type AWSKMSConfig struct {
+	Region   string `json:"region"`   // Region is the AWS region, e.g. "eu-west-1"; defaults to $AWS_REGION
+	KeyID    string `json:"key_id"`   // KeyID is the symmetric key (ID, ARN or alias) that wraps data keys
+	Endpoint string `json:"endpoint"` // Endpoint overrides https://kms.<region>.amazonaws.com, e.g. for a VPC endpoint
+}
+
+// awsKMSProvider implements KeyProvider with the AWS KMS JSON API, signed with SigV4
+type awsKMSProvider struct {
+	cfg          AWSKMSConfig
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	httpClient   *http.Client
+}
+
+// newAWSKMSProvider checks the configuration and picks up credentials from the environment
+func newAWSKMSProvider(cfg AWSKMSConfig) (*awsKMSProvider, error) {
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_REGION")
+	}
+	if cfg.Region == "" || cfg.KeyID == "" {
+		return nil, errors.New("aws_kms needs region and key_id")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://kms." + cfg.Region + ".amazonaws.com"
+	}
+	provider := &awsKMSProvider{
+		cfg:          cfg,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if provider.accessKey == "" || provider.secretKey == "" {
+		return nil, errors.New("aws-kms key provider needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return provider, nil
+}
+
+func (p *awsKMSProvider) Name() string {
+	return "aws-kms"
+}
+
+func (p *awsKMSProvider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+	callErr := p.call(ctx, "Encrypt", map[string]any{"KeyId": p.cfg.KeyID, "Plaintext": dataKey}, &resp)
+	return resp.CiphertextBlob, callErr
+}
+
+func (p *awsKMSProvider) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+	callErr := p.call(ctx, "Decrypt", map[string]any{"KeyId": p.cfg.KeyID, "CiphertextBlob": wrappedKey}, &resp)
+	return resp.Plaintext, callErr
+}
+
+func (p *awsKMSProvider) Signer(ctx context.Context, keyRef string) (crypto.Signer, error) {
+	var resp struct {
+		PublicKey []byte
+	}
+	if callErr := p.call(ctx, "GetPublicKey", map[string]any{"KeyId": keyRef}, &resp); callErr != nil {
+		return nil, callErr
+	}
+	publicKey, parseErr := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if parseErr != nil {
+		return nil, fmt.Errorf("parsing KMS public key: %w", parseErr)
+	}
+	return &awsKMSSigner{provider: p, keyID: keyRef, publicKey: publicKey}, nil
+}
+
+// call invokes one KMS action; []byte fields are base64-encoded by encoding/json as KMS expects
+func (p *awsKMSProvider) call(ctx context.Context, action string, request, response any) error {
+	body, encodeErr := json.Marshal(request)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.Endpoint+"/", bytes.NewReader(body))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	p.sign(req, body, time.Now().UTC())
+	forwardRequestID(req)
+
+	resp, doErr := p.httpClient.Do(req)
+	if doErr != nil {
+		return fmt.Errorf("kms %s: %w", action, doErr)
+	}
+	defer resp.Body.Close()
+	respBody, readErr := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if readErr != nil {
+		return readErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &kmsErr)
+		return fmt.Errorf("kms %s failed with %s: %s %s", action, resp.Status, kmsErr.Type, kmsErr.Message)
+	}
+	return json.Unmarshal(respBody, response)
+}
+
+// sign adds AWS Signature Version 4 headers for the kms service
+func (p *awsKMSProvider) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+
+	// Every header set above is signed, in lowercase sorted order
+	headerNames := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if p.sessionToken != "" {
+		headerNames = append(headerNames, "x-amz-security-token")
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + p.cfg.Region + "/kms/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+p.secretKey), date)
+	signingKey = hmacSHA256(signingKey, p.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "kms")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		p.accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 computes one step of the SigV4 key derivation
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsKMSSigner is a crypto.Signer whose private key stays in KMS
+type awsKMSSigner struct {
+	provider  *awsKMSProvider
+	keyID     string
+	publicKey crypto.PublicKey
+}
+
+func (s *awsKMSSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks KMS to sign a precomputed digest; the result is ASN.1 DER for ECDSA and PKCS#1/PSS for RSA
+func (s *awsKMSSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, algorithmErr := kmsSigningAlgorithm(s.publicKey, opts)
+	if algorithmErr != nil {
+		return nil, algorithmErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var resp struct {
+		Signature []byte
+	}
+	callErr := s.provider.call(ctx, "Sign", map[string]any{
+		"KeyId":            s.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": algorithm,
+	}, &resp)
+	return resp.Signature, callErr
+}
+
+// kmsSigningAlgorithm maps a key type and hash to the KMS SigningAlgorithm name
+func kmsSigningAlgorithm(publicKey crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	bits := map[crypto.Hash]string{crypto.SHA256: "SHA_256", crypto.SHA384: "SHA_384", crypto.SHA512: "SHA_512"}[opts.HashFunc()]
+	if bits == "" {
+		return "", fmt.Errorf("unsupported hash %v for KMS signing", opts.HashFunc())
+	}
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA_" + bits, nil
+	case *rsa.PublicKey:
+		if _, pss := opts.(*rsa.PSSOptions); pss {
+			return "RSASSA_PSS_" + bits, nil
+		}
+		return "RSASSA_PKCS1_V1_5_" + bits, nil
+	default:
+		return "", fmt.Errorf("unsupported KMS key type %T", publicKey)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !pkcs11
+
+package server
+
+import "errors"
+
+// newPKCS11Provider is unavailable unless the binary is built with -tags pkcs11, which links the cgo PKCS#11 bindings
+func newPKCS11Provider(cfg PKCS11Config) (KeyProvider, error) {
+	return nil, errors.New("key_provider pkcs11 requires a binary built with -tags pkcs11")
+}
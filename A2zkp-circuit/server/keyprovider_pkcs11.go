@@ -0,0 +1,218 @@
+//go:build pkcs11
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Provider implements KeyProvider with keys held in a PKCS#11 token. Data keys are
+// wrapped with an AES key using CKM_AES_GCM and tokens are signed with an EC key using CKM_ECDSA.
+type pkcs11Provider struct {
+	mu      sync.Mutex // mu serializes use of the single session
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	wrapKey pkcs11.ObjectHandle
+}
+
+// newPKCS11Provider loads the module, logs into the token and looks up the wrapping key
+func newPKCS11Provider(cfg PKCS11Config) (KeyProvider, error) {
+	if cfg.ModulePath == "" || cfg.TokenLabel == "" || cfg.WrapKeyLabel == "" {
+		return nil, errors.New("pkcs11 needs module_path, token_label and wrap_key_label")
+	}
+	module := pkcs11.New(cfg.ModulePath)
+	if module == nil {
+		return nil, fmt.Errorf("loading PKCS#11 module %s", cfg.ModulePath)
+	}
+	if initErr := module.Initialize(); initErr != nil {
+		return nil, fmt.Errorf("initializing PKCS#11 module: %w", initErr)
+	}
+
+	slot, slotErr := findPKCS11Slot(module, cfg.TokenLabel)
+	if slotErr != nil {
+		module.Finalize()
+		return nil, slotErr
+	}
+	session, sessionErr := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if sessionErr != nil {
+		module.Finalize()
+		return nil, fmt.Errorf("opening PKCS#11 session: %w", sessionErr)
+	}
+	if loginErr := module.Login(session, pkcs11.CKU_USER, cfg.PIN); loginErr != nil {
+		module.CloseSession(session)
+		module.Finalize()
+		return nil, fmt.Errorf("logging into token %q: %w", cfg.TokenLabel, loginErr)
+	}
+
+	provider := &pkcs11Provider{ctx: module, session: session}
+	wrapKey, findErr := provider.findObject(pkcs11.CKO_SECRET_KEY, cfg.WrapKeyLabel)
+	if findErr != nil {
+		module.Logout(session)
+		module.CloseSession(session)
+		module.Finalize()
+		return nil, findErr
+	}
+	provider.wrapKey = wrapKey
+	return provider, nil
+}
+
+// findPKCS11Slot returns the slot holding the token with the given label
+func findPKCS11Slot(module *pkcs11.Ctx, label string) (uint, error) {
+	slots, listErr := module.GetSlotList(true)
+	if listErr != nil {
+		return 0, fmt.Errorf("listing PKCS#11 slots: %w", listErr)
+	}
+	for _, slot := range slots {
+		info, infoErr := module.GetTokenInfo(slot)
+		if infoErr == nil && info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no PKCS#11 token labelled %q", label)
+}
+
+func (p *pkcs11Provider) Name() string {
+	return "pkcs11"
+}
+
+// WrapKey encrypts a data key with AES-GCM inside the token, returning nonce || ciphertext
+func (p *pkcs11Provider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	iv := make([]byte, 12)
+	if _, randErr := rand.Read(iv); randErr != nil {
+		return nil, randErr
+	}
+	params := pkcs11.NewGCMParams(iv, nil, 128)
+	defer params.Free()
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if initErr := p.ctx.EncryptInit(p.session, mechanism, p.wrapKey); initErr != nil {
+		return nil, fmt.Errorf("pkcs11 encrypt init: %w", initErr)
+	}
+	ciphertext, encryptErr := p.ctx.Encrypt(p.session, dataKey)
+	if encryptErr != nil {
+		return nil, fmt.Errorf("pkcs11 encrypt: %w", encryptErr)
+	}
+	// Some tokens choose their own IV; read back whichever was used
+	return append(append([]byte(nil), params.IV()...), ciphertext...), nil
+}
+
+// UnwrapKey decrypts a data key produced by WrapKey
+func (p *pkcs11Provider) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < 12 {
+		return nil, errors.New("wrapped key too short")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	params := pkcs11.NewGCMParams(wrappedKey[:12], nil, 128)
+	defer params.Free()
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if initErr := p.ctx.DecryptInit(p.session, mechanism, p.wrapKey); initErr != nil {
+		return nil, fmt.Errorf("pkcs11 decrypt init: %w", initErr)
+	}
+	dataKey, decryptErr := p.ctx.Decrypt(p.session, wrappedKey[12:])
+	if decryptErr != nil {
+		return nil, fmt.Errorf("pkcs11 decrypt: %w", decryptErr)
+	}
+	return dataKey, nil
+}
+
+// Signer returns a P-256 signer for the key pair whose private and public objects carry keyRef as label
+func (p *pkcs11Provider) Signer(ctx context.Context, keyRef string) (crypto.Signer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	privateKey, privateErr := p.findObject(pkcs11.CKO_PRIVATE_KEY, keyRef)
+	if privateErr != nil {
+		return nil, privateErr
+	}
+	publicKey, publicErr := p.findObject(pkcs11.CKO_PUBLIC_KEY, keyRef)
+	if publicErr != nil {
+		return nil, publicErr
+	}
+	attributes, attrErr := p.ctx.GetAttributeValue(p.session, publicKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if attrErr != nil {
+		return nil, fmt.Errorf("reading public key %q: %w", keyRef, attrErr)
+	}
+
+	// CKA_EC_POINT is a DER OCTET STRING wrapping the uncompressed point
+	var point []byte
+	if _, derErr := asn1.Unmarshal(attributes[0].Value, &point); derErr != nil {
+		return nil, fmt.Errorf("decoding EC point of %q: %w", keyRef, derErr)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, fmt.Errorf("key %q is not a P-256 key", keyRef)
+	}
+	return &pkcs11Signer{provider: p, privateKey: privateKey, publicKey: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+}
+
+// findObject looks up exactly one object of a class by label
+func (p *pkcs11Provider) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if initErr := p.ctx.FindObjectsInit(p.session, template); initErr != nil {
+		return 0, initErr
+	}
+	defer p.ctx.FindObjectsFinal(p.session)
+	objects, _, findErr := p.ctx.FindObjects(p.session, 2)
+	if findErr != nil {
+		return 0, findErr
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("expected one PKCS#11 object labelled %q, found %d", label, len(objects))
+	}
+	return objects[0], nil
+}
+
+// pkcs11Signer is a crypto.Signer whose private key never leaves the token
+type pkcs11Signer struct {
+	provider   *pkcs11Provider
+	privateKey pkcs11.ObjectHandle
+	publicKey  *ecdsa.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a digest with CKM_ECDSA and converts the raw r || s output to ASN.1 DER
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	if initErr := s.provider.ctx.SignInit(s.provider.session, mechanism, s.privateKey); initErr != nil {
+		return nil, fmt.Errorf("pkcs11 sign init: %w", initErr)
+	}
+	raw, signErr := s.provider.ctx.Sign(s.provider.session, digest)
+	if signErr != nil {
+		return nil, fmt.Errorf("pkcs11 sign: %w", signErr)
+	}
+	if len(raw)%2 != 0 {
+		return nil, errors.New("pkcs11 returned a malformed ECDSA signature")
+	}
+	half := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(raw[:half]),
+		S: new(big.Int).SetBytes(raw[half:]),
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vaultTransitProvider implements KeyProvider with Vault's transit secrets engine
+type vaultTransitProvider struct {
+	vault *vaultClient
+	mount string
+	key   string
+}
+
+// newVaultTransitProvider uses the client created from the vault configuration
+func newVaultTransitProvider(vault *vaultClient) (*vaultTransitProvider, error) {
+	if vault == nil {
+		return nil, errors.New("key_provider vault-transit needs the vault section configured")
+	}
+	if vault.cfg.TransitKey == "" {
+		return nil, errors.New("key_provider vault-transit needs vault.transit_key")
+	}
+	return &vaultTransitProvider{vault: vault, mount: vault.cfg.TransitMount, key: vault.cfg.TransitKey}, nil
+}
+
+func (p *vaultTransitProvider) Name() string {
+	return "vault-transit"
+}
+
+func (p *vaultTransitProvider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	if encryptErr := p.vault.do(ctx, http.MethodPost, p.mount+"/encrypt/"+p.key, body, &resp); encryptErr != nil {
+		return nil, encryptErr
+	}
+	// The "vault:vN:" ciphertext is stored as-is so transit key rotation keeps old files readable
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (p *vaultTransitProvider) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"ciphertext": string(wrappedKey)}
+	if decryptErr := p.vault.do(ctx, http.MethodPost, p.mount+"/decrypt/"+p.key, body, &resp); decryptErr != nil {
+		return nil, decryptErr
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// Signer returns a signer for the transit key named keyRef, using its latest version's public key
+func (p *vaultTransitProvider) Signer(ctx context.Context, keyRef string) (crypto.Signer, error) {
+	var resp struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if readErr := p.vault.do(ctx, http.MethodGet, p.mount+"/keys/"+keyRef, nil, &resp); readErr != nil {
+		return nil, readErr
+	}
+	latest, exists := resp.Data.Keys[strconv.Itoa(resp.Data.LatestVersion)]
+	if !exists {
+		return nil, fmt.Errorf("transit key %q has no public key; it must be an asymmetric key", keyRef)
+	}
+	block, _ := pem.Decode([]byte(latest.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("transit key %q returned no PEM public key", keyRef)
+	}
+	publicKey, parseErr := x509.ParsePKIXPublicKey(block.Bytes)
+	if parseErr != nil {
+		return nil, fmt.Errorf("parsing transit public key: %w", parseErr)
+	}
+	return &vaultTransitSigner{provider: p, keyName: keyRef, publicKey: publicKey}, nil
+}
+
+// vaultTransitSigner is a crypto.Signer backed by transit/sign
+type vaultTransitSigner struct {
+	provider  *vaultTransitProvider
+	keyName   string
+	publicKey crypto.PublicKey
+}
+
+func (s *vaultTransitSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign has Vault sign a prehashed digest, returning an ASN.1 DER signature
+func (s *vaultTransitSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashName := map[crypto.Hash]string{crypto.SHA256: "sha2-256", crypto.SHA384: "sha2-384", crypto.SHA512: "sha2-512"}[opts.HashFunc()]
+	if hashName == "" {
+		return nil, fmt.Errorf("unsupported hash %v for transit signing", opts.HashFunc())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	body := map[string]any{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"marshaling_algorithm": "asn1",
+	}
+	// RSA keys default to PSS in transit; plain crypto.Hash options ask for PKCS#1 v1.5 as crypto/rsa does
+	if _, isRSA := s.publicKey.(*rsa.PublicKey); isRSA {
+		body["signature_algorithm"] = "pkcs1v15"
+		if _, isPSS := opts.(*rsa.PSSOptions); isPSS {
+			body["signature_algorithm"] = "pss"
+		}
+	}
+	if signErr := s.provider.vault.do(ctx, http.MethodPost, s.provider.mount+"/sign/"+s.keyName+"/"+hashName, body, &resp); signErr != nil {
+		return nil, signErr
+	}
+	// Signatures come back as "vault:v<version>:<base64>"
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed transit signature")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// ErrKeyNotFound is returned for a key ID that was never issued or has been retired
+var ErrKeyNotFound = errors.New("unknown key version")
+
+// ErrKeyExpired is returned for a key version whose grace period is over
+var ErrKeyExpired = errors.New("key version has expired")
+
+// ErrCurrentKey is returned when retiring the version new proofs are made against
+var ErrCurrentKey = errors.New("the current key version can't be retired; add a new version first")
+
+// keyringStateFile records the versions kept in Config.KeyDir and their lifetimes
+const keyringStateFile = "keyring.json"
+
+// keyVersion is one Groth16 setup for the circuit, identified by a hash of its verifying key
+type keyVersion struct {
+	ID        string     `json:"id"`                   // ID is derived from the verifying key, so it is stable across restarts
+	CreatedAt time.Time  `json:"created_at"`           // CreatedAt is when the version was generated
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // ExpiresAt is set once a newer version replaces this one
+	Current   bool       `json:"current"`              // Current marks the version new proofs are made against
+	// CircuitVersion is the circuit the keys were set up for; key rings saved before it existed hold v1 keys
+	CircuitVersion string `json:"circuit_version,omitempty"`
+
+	keys *circuitKeys
+}
+
+// keyRing holds every key version that proofs may still target. The newest is current: clients
+// are told to prove against it, while older versions keep verifying until their grace period ends.
+type keyRing struct {
+	mu       sync.RWMutex
+	versions []*keyVersion // versions is ordered oldest first; the last one is current
+	grace    time.Duration
+	dir      string      // dir persists versions added at runtime; empty keeps them in memory only
+	provider KeyProvider // provider seals proving keys written to dir, when configured
+	circuit  string      // circuit is the configured circuit version every key version must be set up for
+	mock     bool        // mock makes add run mock setups, as for Config.MockProver
+}
+
+// newKeyRing starts a key ring from the circuit keys loaded at startup, restoring versions saved in dir
+func newKeyRing(ctx context.Context, initial *circuitKeys, cfg Config, provider KeyProvider) (*keyRing, error) {
+	ring := &keyRing{grace: cfg.KeyGracePeriod.Duration, dir: cfg.KeyDir, provider: provider, circuit: cfg.Circuit.Version(), mock: cfg.MockProver}
+	if ring.dir != "" {
+		loaded, loadErr := ring.load(ctx, initial)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		if loaded {
+			return ring, nil
+		}
+		if cfg.ReadOnly {
+			return nil, fmt.Errorf("read_only: %s holds no key versions to load", ring.dir)
+		}
+	}
+
+	id, idErr := verifier.KeyID(initial.verifyingKey)
+	if idErr != nil {
+		return nil, idErr
+	}
+	ring.versions = []*keyVersion{{ID: id, CreatedAt: time.Now().UTC(), CircuitVersion: ring.circuit, keys: initial}}
+	if ring.dir != "" {
+		if saveErr := ring.saveVersion(ctx, ring.versions[0]); saveErr != nil {
+			return nil, saveErr
+		}
+		if saveErr := ring.saveState(); saveErr != nil {
+			return nil, saveErr
+		}
+	}
+	return ring, nil
+}
+
+// current returns the version new proofs should target
+func (r *keyRing) current() *keyVersion {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.versions[len(r.versions)-1]
+}
+
+// lookup returns the version with the given ID, or the current one for an empty ID
+func (r *keyRing) lookup(id string) (*keyVersion, error) {
+	if id == "" {
+		return r.current(), nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, version := range r.versions {
+		if version.ID != id {
+			continue
+		}
+		if version.ExpiresAt != nil && time.Now().After(*version.ExpiresAt) {
+			return nil, ErrKeyExpired
+		}
+		return version, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// list returns a snapshot of every version with its current flag set
+func (r *keyRing) list() []keyVersion {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions := make([]keyVersion, len(r.versions))
+	for i, version := range r.versions {
+		versions[i] = *version
+		versions[i].Current = i == len(r.versions)-1
+	}
+	return versions
+}
+
+// add runs a fresh setup and makes it current; the previous versions expire after the grace period
+func (r *keyRing) add(ctx context.Context) (*keyVersion, error) {
+	ccs := r.current().keys.ccs
+	provingKey, verifyingKey, setupErr := runSetup(ccs, r.mock)
+	if setupErr != nil {
+		return nil, fmt.Errorf("groth16 setup: %w", setupErr)
+	}
+	return r.install(ctx, &circuitKeys{ccs: ccs, provingKey: provingKey, verifyingKey: verifyingKey})
+}
+
+// install makes keys the current version, replacing any older copy of the same version;
+// the previous versions expire after the grace period
+func (r *keyRing) install(ctx context.Context, keys *circuitKeys) (*keyVersion, error) {
+	id, idErr := verifier.KeyID(keys.verifyingKey)
+	if idErr != nil {
+		return nil, idErr
+	}
+	version := &keyVersion{ID: id, CreatedAt: time.Now().UTC(), CircuitVersion: r.circuit, keys: keys}
+	if r.dir != "" {
+		if saveErr := r.saveVersion(ctx, version); saveErr != nil {
+			return nil, saveErr
+		}
+	}
+
+	r.mu.Lock()
+	expiresAt := version.CreatedAt.Add(r.grace)
+	kept := r.versions[:0]
+	for _, previous := range r.versions {
+		if previous.ID == id {
+			continue
+		}
+		if previous.ExpiresAt == nil || previous.ExpiresAt.After(expiresAt) {
+			previous.ExpiresAt = &expiresAt
+		}
+		kept = append(kept, previous)
+	}
+	r.versions = append(kept, version)
+	r.pruneLocked()
+	r.mu.Unlock()
+	return version, r.saveState()
+}
+
+// setGrace changes how long versions replaced from now on keep verifying
+func (r *keyRing) setGrace(grace time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grace = grace
+}
+
+// reload picks up key versions changed outside this process: the versions recorded in dir when it
+// is set, otherwise the setup in artifacts, which becomes current if it isn't already. Keys already
+// held in memory are reused and the compiled circuit is shared, so nothing is recompiled.
+func (r *keyRing) reload(ctx context.Context, artifacts fs.FS) error {
+	ccs := r.current().keys.ccs
+	if r.dir != "" {
+		known := make(map[string]*circuitKeys)
+		r.mu.RLock()
+		for _, version := range r.versions {
+			known[version.ID] = version.keys
+		}
+		r.mu.RUnlock()
+		versions, readErr := r.readVersions(ctx, ccs, known)
+		if readErr != nil || versions == nil {
+			return readErr
+		}
+		r.mu.Lock()
+		r.versions = versions
+		r.mu.Unlock()
+		return nil
+	}
+
+	if artifacts == nil {
+		return nil
+	}
+	if versionErr := checkArtifactVersion(artifacts, r.circuit); versionErr != nil {
+		return versionErr
+	}
+	keys, loadErr := loadArtifactKeys(ctx, artifacts, r.provider, ccs, circuit.Curve)
+	if loadErr != nil {
+		return fmt.Errorf("loading artifacts: %w", loadErr)
+	}
+	id, idErr := verifier.KeyID(keys.verifyingKey)
+	if idErr != nil || id == r.current().ID {
+		return idErr
+	}
+	_, installErr := r.install(ctx, keys)
+	return installErr
+}
+
+// retire removes a version immediately; the current version can only be replaced via add
+func (r *keyRing) retire(id string) error {
+	r.mu.Lock()
+	index := -1
+	for i, version := range r.versions {
+		if version.ID == id {
+			index = i
+		}
+	}
+	switch {
+	case index < 0:
+		r.mu.Unlock()
+		return ErrKeyNotFound
+	case index == len(r.versions)-1:
+		r.mu.Unlock()
+		return ErrCurrentKey
+	}
+	r.versions = append(r.versions[:index], r.versions[index+1:]...)
+	r.mu.Unlock()
+
+	if r.dir != "" {
+		if removeErr := os.RemoveAll(filepath.Join(r.dir, id)); removeErr != nil {
+			return removeErr
+		}
+	}
+	return r.saveState()
+}
+
+// pruneLocked drops versions whose grace period has ended
+func (r *keyRing) pruneLocked() {
+	now := time.Now()
+	kept := r.versions[:0]
+	for _, version := range r.versions {
+		if version.ExpiresAt == nil || now.Before(*version.ExpiresAt) {
+			kept = append(kept, version)
+		}
+	}
+	r.versions = kept
+}
+
+// saveVersion writes a version's keys under dir/<id>, sealing the proving key when a provider is configured
+func (r *keyRing) saveVersion(ctx context.Context, version *keyVersion) error {
+	versionDir := filepath.Join(r.dir, version.ID)
+	if mkdirErr := os.MkdirAll(versionDir, 0o700); mkdirErr != nil {
+		return mkdirErr
+	}
+	if writeErr := writeArtifact(filepath.Join(versionDir, artifactVerifyingKeyFile), version.keys.verifyingKey); writeErr != nil {
+		return writeErr
+	}
+	if version.keys.transcript != nil {
+		if saveErr := version.keys.transcript.save(versionDir); saveErr != nil {
+			return saveErr
+		}
+	}
+	if r.provider == nil {
+		return writeArtifact(filepath.Join(versionDir, artifactProvingKeyFile), version.keys.provingKey)
+	}
+	var plaintext bytes.Buffer
+	if _, writeErr := version.keys.provingKey.WriteTo(&plaintext); writeErr != nil {
+		return writeErr
+	}
+	sealed, sealErr := sealWithProvider(ctx, r.provider, artifactProvingKeyFile, plaintext.Bytes())
+	secret.WipeBytes(plaintext.Bytes())
+	if sealErr != nil {
+		return sealErr
+	}
+	return os.WriteFile(filepath.Join(versionDir, artifactSealedKeyFile), sealed, 0o600)
+}
+
+// saveState records the version list and lifetimes in dir/keyring.json
+func (r *keyRing) saveState() error {
+	if r.dir == "" {
+		return nil
+	}
+	encoded, encodeErr := json.MarshalIndent(r.list(), "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return os.WriteFile(filepath.Join(r.dir, keyringStateFile), encoded, 0o600)
+}
+
+// load restores the versions recorded in dir; it reports false when dir holds no key ring yet
+func (r *keyRing) load(ctx context.Context, initial *circuitKeys) (bool, error) {
+	versions, readErr := r.readVersions(ctx, initial.ccs, nil)
+	if readErr != nil || versions == nil {
+		return false, readErr
+	}
+	r.versions = versions
+	return true, nil
+}
+
+// readVersions reads the unexpired versions recorded in dir, taking keys from known instead of disk
+// when a version is already loaded; it returns nil when dir holds no key ring yet. Versions set up
+// for another circuit are refused, since their keys can't prove or verify the configured one.
+func (r *keyRing) readVersions(ctx context.Context, ccs constraint.ConstraintSystem, known map[string]*circuitKeys) ([]*keyVersion, error) {
+	state, readErr := os.ReadFile(filepath.Join(r.dir, keyringStateFile))
+	if errors.Is(readErr, os.ErrNotExist) {
+		return nil, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	var saved []keyVersion
+	if decodeErr := json.Unmarshal(state, &saved); decodeErr != nil {
+		return nil, fmt.Errorf("parsing %s: %w", keyringStateFile, decodeErr)
+	}
+
+	var versions []*keyVersion
+	for i := range saved {
+		version := saved[i]
+		if version.ExpiresAt != nil && time.Now().After(*version.ExpiresAt) {
+			continue
+		}
+		if version.CircuitVersion == "" {
+			version.CircuitVersion = circuit.Version
+		}
+		if version.CircuitVersion != r.circuit {
+			return nil, fmt.Errorf("key version %s in %s is for circuit %s but the configured circuit is %s", version.ID, r.dir, version.CircuitVersion, r.circuit)
+		}
+		keys, loaded := known[version.ID]
+		if !loaded {
+			// Versions share the compiled circuit; only the keys are stored per version
+			files := os.DirFS(filepath.Join(r.dir, version.ID))
+			keys = &circuitKeys{
+				ccs:          ccs,
+				provingKey:   groth16.NewProvingKey(circuit.Curve),
+				verifyingKey: groth16.NewVerifyingKey(circuit.Curve),
+			}
+			if loadErr := loadProvingKey(ctx, files, r.provider, keys.provingKey); loadErr != nil {
+				return nil, fmt.Errorf("loading key version %s: %w", version.ID, loadErr)
+			}
+			if loadErr := loadVerifyingKey(files, keys.verifyingKey); loadErr != nil {
+				return nil, fmt.Errorf("loading key version %s: %w", version.ID, loadErr)
+			}
+			var transcriptErr error
+			if keys.transcript, transcriptErr = loadSetupTranscript(files, keys.verifyingKey); transcriptErr != nil {
+				return nil, fmt.Errorf("loading key version %s: %w", version.ID, transcriptErr)
+			}
+		}
+		version.keys, version.Current = keys, false
+		versions = append(versions, &version)
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("every key version in " + r.dir + " has expired")
+	}
+	return versions, nil
+}
+
+// KeyVersionResponse describes a key version on the admin API
+type KeyVersionResponse struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Current   bool       `json:"current"`
+}
+
+// listKeysHandler lists the key versions proofs may target
+func (s *Server) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	versions := s.keyring.list()
+	response := make([]KeyVersionResponse, len(versions))
+	for i, version := range versions {
+		response[i] = KeyVersionResponse{ID: version.ID, CreatedAt: version.CreatedAt, ExpiresAt: version.ExpiresAt, Current: version.Current}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// addKeyHandler generates a new key version and makes it current
+func (s *Server) addKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shared != nil {
+		writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "Key versions can't be added in stateless mode; publish new artifacts instead")
+		return
+	}
+	version, addErr := s.keyring.add(r.Context())
+	if addErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error adding key version: %v", addErr))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(KeyVersionResponse{ID: version.ID, CreatedAt: version.CreatedAt, Current: true})
+}
+
+// retireKeyHandler removes a key version before its grace period ends
+func (s *Server) retireKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shared != nil {
+		writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "Key versions can't be retired in stateless mode, where each replica keeps its own")
+		return
+	}
+	retireErr := s.keyring.retire(r.PathValue("id"))
+	switch {
+	case errors.Is(retireErr, ErrKeyNotFound):
+		writeProblem(w, http.StatusNotFound, codeKeyNotFound, "Unknown key version")
+	case errors.Is(retireErr, ErrCurrentKey):
+		writeProblem(w, http.StatusConflict, codeKeyCurrent, retireErr.Error())
+	case retireErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error retiring key version: %v", retireErr))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
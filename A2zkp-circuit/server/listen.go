@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// What a listener serves
+const (
+	serveAll      = "all"
+	serveAPI      = "api"
+	serveAdmin    = "admin"
+	serveMetrics  = "metrics"
+	serveInternal = "internal"
+)
+
+// systemdFirstFD is the first file descriptor of sockets passed by systemd socket activation
+const systemdFirstFD = 3
+
+// listenerConfigs lists everything the server listens on: the top-level addr and unix_socket serving the
+// whole API (or all but /admin once internal_addr takes it), internal_addr, debug_addr serving metrics,
+// then the listeners section
+func (cfg Config) listenerConfigs() []ListenerConfig {
+	public := serveAll
+	if cfg.InternalAddr != "" {
+		public = serveAPI
+	}
+	var listeners []ListenerConfig
+	if cfg.Addr != "" {
+		listeners = append(listeners, ListenerConfig{
+			Serve: public, Addr: cfg.Addr,
+			TLSCertFile: cfg.TLSCertFile, TLSKeyFile: cfg.TLSKeyFile, TLSCert: cfg.TLSCert, TLSKey: cfg.TLSKey,
+		})
+	}
+	// The socket is only reachable on this host and guarded by its file mode, so the top-level TLS settings stay on TCP
+	if cfg.UnixSocket != "" {
+		listeners = append(listeners, ListenerConfig{Serve: public, UnixSocket: cfg.UnixSocket, UnixSocketMode: cfg.UnixSocketMode})
+	}
+	if cfg.InternalAddr != "" {
+		listeners = append(listeners, ListenerConfig{Serve: serveInternal, Addr: cfg.InternalAddr})
+	}
+	if cfg.DebugAddr != "" {
+		listeners = append(listeners, ListenerConfig{Serve: serveMetrics, Addr: cfg.DebugAddr})
+	}
+	return append(listeners, cfg.Listeners...)
+}
+
+// validate checks the listener names exactly one address and a known set of routes
+func (l ListenerConfig) validate() error {
+	set := 0
+	for _, address := range []string{l.Addr, l.UnixSocket, l.Systemd} {
+		if address != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("a listener needs exactly one of addr, unix_socket and systemd")
+	}
+	switch l.Serve {
+	case "", serveAll, serveAPI, serveAdmin, serveMetrics, serveInternal:
+		return nil
+	default:
+		return fmt.Errorf("listener serve %q is not all, api, admin, metrics or internal", l.Serve)
+	}
+}
+
+// String describes the listener's address for logs and errors
+func (l ListenerConfig) String() string {
+	switch {
+	case l.UnixSocket != "":
+		return "unix socket " + l.UnixSocket
+	case l.Systemd != "":
+		return "systemd socket " + l.Systemd
+	default:
+		return l.Addr
+	}
+}
+
+// loadCertificate reads the certificate from inline PEM (possibly resolved from Vault) or from files;
+// it returns nil when TLS is not configured
+func (l ListenerConfig) loadCertificate() (*tls.Certificate, error) {
+	var certificate tls.Certificate
+	var loadErr error
+	switch {
+	case l.TLSCert != "" || l.TLSKey != "":
+		certificate, loadErr = tls.X509KeyPair([]byte(l.TLSCert), []byte(l.TLSKey))
+	case l.TLSCertFile != "" || l.TLSKeyFile != "":
+		certificate, loadErr = tls.LoadX509KeyPair(l.TLSCertFile, l.TLSKeyFile)
+	default:
+		return nil, nil
+	}
+	if loadErr != nil {
+		return nil, fmt.Errorf("loading TLS certificate for %s: %w", l, loadErr)
+	}
+	return &certificate, nil
+}
+
+// certificateHolder hands a listener's TLS certificate to each handshake, so Reload can replace it
+type certificateHolder struct {
+	current atomic.Pointer[tls.Certificate]
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (h *certificateHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.current.Load(), nil
+}
+
+// listen opens the listener's sockets, taking systemd sockets out of inherited. TCP sockets it opens
+// probe idle connections every keepAlive, as net.ListenConfig does.
+func (l ListenerConfig) listen(inherited map[string][]net.Listener, keepAlive time.Duration) ([]net.Listener, error) {
+	switch {
+	case l.Systemd != "":
+		sockets, found := inherited[l.Systemd]
+		if !found {
+			return nil, fmt.Errorf("systemd passed no socket named %q", l.Systemd)
+		}
+		delete(inherited, l.Systemd)
+		return sockets, nil
+	case l.UnixSocket != "":
+		mode := l.UnixSocketMode
+		if mode == "" {
+			mode = "0660"
+		}
+		listener, listenErr := listenUnix(l.UnixSocket, mode)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+		return []net.Listener{listener}, nil
+	default:
+		listenConfig := net.ListenConfig{KeepAlive: keepAlive}
+		listener, listenErr := listenConfig.Listen(context.Background(), "tcp", l.Addr)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+		return []net.Listener{listener}, nil
+	}
+}
+
+// listenUnix listens on a Unix domain socket at path and sets its file mode, an octal string such as "0660".
+// A socket file left behind by a previous run is replaced; any other file at path, or a socket another
+// process is still serving, is an error.
+func listenUnix(path, mode string) (net.Listener, error) {
+	permissions, parseErr := strconv.ParseUint(mode, 8, 32)
+	if parseErr != nil || permissions > 0o777 {
+		return nil, fmt.Errorf("unix_socket_mode %q is not an octal permission such as \"0660\"", mode)
+	}
+
+	info, statErr := os.Lstat(path)
+	switch {
+	case errors.Is(statErr, fs.ErrNotExist):
+	case statErr != nil:
+		return nil, statErr
+	case info.Mode().Type() != fs.ModeSocket:
+		return nil, fmt.Errorf("unix_socket %s exists and is not a socket", path)
+	default:
+		if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix_socket %s is in use by another process", path)
+		}
+		if removeErr := os.Remove(path); removeErr != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", removeErr)
+		}
+	}
+
+	listener, listenErr := net.Listen("unix", path)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	// The listener unlinks the socket file again when it is closed
+	if chmodErr := os.Chmod(path, fs.FileMode(permissions)); chmodErr != nil {
+		listener.Close()
+		return nil, chmodErr
+	}
+	return listener, nil
+}
+
+// systemdListeners takes over the sockets passed by systemd socket activation, grouped by their
+// FileDescriptorName ("unknown" unless the socket unit sets one). The LISTEN_* variables are cleared
+// so child processes don't mistake the sockets for their own.
+func systemdListeners() (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener)
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+	count, countErr := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if countErr != nil || count < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS %q is not a socket count", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, variable := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(variable)
+	}
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		listener, listenerErr := net.FileListener(file)
+		file.Close()
+		if listenerErr != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("systemd socket %d (%s): %w", systemdFirstFD+i, name, listenerErr)
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	return listeners, nil
+}
+
+// closeListeners closes every listener in a name-keyed group
+func closeListeners(groups map[string][]net.Listener) {
+	for _, group := range groups {
+		for _, listener := range group {
+			listener.Close()
+		}
+	}
+}
+
+// handlerFor returns what a listener serves; see ListenerConfig.Serve
+func (s *Server) handlerFor(serve string) http.Handler {
+	if serve == "" || serve == serveAll {
+		return s.Handler()
+	}
+	mux := http.NewServeMux()
+	for _, rt := range s.routeTable() {
+		if servedBy(rt.pattern, serve) {
+			s.handle(mux, rt.pattern, rt.handler)
+		}
+	}
+	if serve == serveMetrics || serve == serveInternal {
+		s.mountDebug(mux)
+	}
+	return s.logAccess(mux)
+}
+
+// servedBy reports whether a route pattern belongs on a listener: /healthz and /readyz go everywhere,
+// /admin to admin and internal listeners and everything else to api listeners
+func servedBy(pattern, serve string) bool {
+	path := pattern
+	if _, afterMethod, hasMethod := strings.Cut(pattern, " "); hasMethod {
+		path = afterMethod
+	}
+	switch {
+	case path == "/healthz" || path == "/readyz":
+		return true
+	case serve == serveAPI:
+		return !strings.HasPrefix(path, "/admin/")
+	case serve == serveAdmin || serve == serveInternal:
+		return strings.HasPrefix(path, "/admin/")
+	default:
+		return false
+	}
+}
+
+// serve runs an HTTP server on every configured listener until one fails or ctx is cancelled,
+// then shuts them all down gracefully
+func (s *Server) serve(ctx context.Context, configs []ListenerConfig) error {
+	return serveListeners(ctx, s.cfg, configs, s.startup, func() (*Server, error) { return s, nil })
+}
+
+// serveListeners opens every configured listener and answers on them with startingHandler while
+// start builds the server, then serves its routes as serve does. Probes can so tell a server busy
+// compiling its circuit from one that is down.
+func serveListeners(ctx context.Context, cfg Config, configs []ListenerConfig, progress *startupProgress, start func() (*Server, error)) error {
+	if len(configs) == 0 {
+		return errors.New("nothing to listen on: set addr, unix_socket or listeners")
+	}
+	for _, l := range configs {
+		if validateErr := l.validate(); validateErr != nil {
+			return validateErr
+		}
+	}
+	inherited, systemdErr := systemdListeners()
+	if systemdErr != nil {
+		return systemdErr
+	}
+	defer closeListeners(inherited)
+
+	var httpServers []*http.Server
+	closeAll := func() {
+		for _, httpServer := range httpServers {
+			httpServer.Close()
+		}
+	}
+	starting := startingHandler(progress)
+	handlers := make([]*switchHandler, len(configs))
+	certificates := make(map[string]*certificateHolder)
+	serveErr := make(chan error, len(configs)+len(inherited))
+	for i, l := range configs {
+		certificate, certificateErr := l.loadCertificate()
+		if certificateErr != nil {
+			closeAll()
+			return certificateErr
+		}
+		var tlsConfig *tls.Config
+		if certificate != nil {
+			holder := &certificateHolder{}
+			holder.current.Store(certificate)
+			certificates[l.String()] = holder
+			tlsConfig = &tls.Config{GetCertificate: holder.getCertificate, MinVersion: tls.VersionTLS12}
+		}
+		listeners, listenErr := l.listen(inherited, cfg.TCPKeepAlive.Duration)
+		if listenErr != nil {
+			closeAll()
+			return fmt.Errorf("listening on %s: %w", l, listenErr)
+		}
+
+		handlers[i] = newSwitchHandler(starting)
+		httpServer := configureHTTPServer(cfg, l, tlsConfig, handlers[i])
+		httpServers = append(httpServers, httpServer)
+		for _, listener := range listeners {
+			var localErr error
+			switch {
+			case cfg.MockProver:
+				localErr = requireLocal(listener.Addr(), "mock_prover is on")
+			case l.Serve == serveMetrics:
+				localErr = requireLocal(listener.Addr(), "it serves metrics and pprof")
+			}
+			if localErr != nil {
+				listener.Close()
+				closeAll()
+				return localErr
+			}
+			go func() {
+				if tlsConfig != nil {
+					log.Printf("Server is starting with TLS on %s (%s)", listener.Addr(), l.serving())
+					serveErr <- httpServer.ServeTLS(listener, "", "")
+					return
+				}
+				log.Printf("Server is starting on %s (%s)", listener.Addr(), l.serving())
+				serveErr <- httpServer.Serve(listener)
+			}()
+		}
+	}
+	if len(inherited) > 0 {
+		closeAll()
+		return fmt.Errorf("systemd passed sockets no listener uses: %s", strings.Join(slices.Sorted(maps.Keys(inherited)), ", "))
+	}
+
+	srv, startErr := start()
+	if startErr != nil {
+		closeAll()
+		return startErr
+	}
+	srv.certsMu.Lock()
+	maps.Copy(srv.certificates, certificates)
+	srv.certsMu.Unlock()
+	for i, l := range configs {
+		handlers[i].store(srv.handlerFor(l.Serve))
+	}
+
+	select {
+	case listenErr := <-serveErr:
+		closeAll()
+		return listenErr
+	case <-ctx.Done():
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var shutdownErr error
+		for _, httpServer := range httpServers {
+			shutdownErr = errors.Join(shutdownErr, httpServer.Shutdown(shutdownCtx))
+		}
+		return shutdownErr
+	}
+}
+
+// serving names what the listener serves for logs
+func (l ListenerConfig) serving() string {
+	if l.Serve == "" {
+		return serveAll
+	}
+	return l.Serve
+}
+
+// newHTTPServer configures the HTTP server of a listener serving its routes
+func (s *Server) newHTTPServer(l ListenerConfig, tlsConfig *tls.Config) *http.Server {
+	return configureHTTPServer(s.cfg, l, tlsConfig, s.handlerFor(l.Serve))
+}
+
+// configureHTTPServer configures the HTTP server of a listener from the timeouts, header limit,
+// keep-alive and HTTP/2 settings of cfg
+func configureHTTPServer(cfg Config, l ListenerConfig, tlsConfig *tls.Config, handler http.Handler) *http.Server {
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
+	if l.Serve == serveMetrics {
+		// CPU profiles and traces stream for as long as the caller asks
+		httpServer.WriteTimeout = 0
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto keeps net/http from offering h2 over ALPN
+		httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	httpServer.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+	return httpServer
+}
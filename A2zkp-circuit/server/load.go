@@ -0,0 +1,458 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// loadProgressInterval is how many records a load handles between two progress events
+const loadProgressInterval = 1000
+
+// maxLoadLineLength bounds a line of an NDJSON file the load command reads
+const maxLoadLineLength = 64 << 10
+
+// loadColumns are the columns a CSV load may have
+var loadColumns = []string{"user_name", "crypto_commitment", "circuit_version", "salt", "tenant"}
+
+// CommitmentRecord is one record of a load: a commitment generated elsewhere, stored as a registration
+type CommitmentRecord struct {
+	UserName         string `json:"user_name"`
+	CryptoCommitment string `json:"crypto_commitment"`
+	// CircuitVersion is the circuit the commitment was generated for, the current one when empty
+	CircuitVersion string `json:"circuit_version,omitempty"`
+	Salt           []byte `json:"salt,omitempty"` // Salt is base64 in CSV too
+	Tenant         string `json:"tenant,omitempty"`
+}
+
+// LoadEvent is one line of the report of a load: a record that wasn't stored, a progress update
+// or the summary that ends the report
+type LoadEvent struct {
+	Event string `json:"event"` // Event is "failed", "progress" or "summary"
+	// Row is the failed record's number, from 1 and not counting a CSV header; it is omitted when
+	// the body itself broke off
+	Row      int      `json:"row,omitempty"`
+	UserName string   `json:"user_name,omitempty"`
+	Problem  *Problem `json:"problem,omitempty"`
+	*LoadCounts
+}
+
+// LoadCounts tally the records a load has handled so far
+type LoadCounts struct {
+	DryRun    bool `json:"dry_run"`   // DryRun is true when nothing is written
+	Processed int  `json:"processed"` // Processed counts the records read
+	// Loaded counts the records stored or, for a dry run, valid and not registered yet
+	Loaded int `json:"loaded"`
+	Failed int `json:"failed"` // Failed counts the records reported as failed
+}
+
+// loadRow is a record read from a load, or the reason it couldn't be decoded
+type loadRow struct {
+	record CommitmentRecord
+	err    error
+}
+
+// commitmentRecords reads the records of a load one at a time, from CSV with a header row naming
+// the user_name, crypto_commitment and optional circuit_version, salt and tenant columns, or from
+// NDJSON lines of CommitmentRecord objects
+type commitmentRecords struct {
+	lines   func() ([]byte, error) // lines yields the NDJSON lines; nil for CSV
+	csv     *csv.Reader
+	columns map[string]int
+}
+
+// newCSVRecords reads the header row of a CSV load
+func newCSVRecords(in io.Reader) (*commitmentRecords, error) {
+	reader := csv.NewReader(in)
+	reader.ReuseRecord = true
+	header, headerErr := reader.Read()
+	if errors.Is(headerErr, io.EOF) {
+		return nil, badRequest("Missing the header row")
+	}
+	if headerErr != nil {
+		return nil, badRequest("Invalid CSV: %v", headerErr)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(loadColumns, name) {
+			return nil, badRequest("Unknown column %q (want %s)", name, strings.Join(loadColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"user_name", "crypto_commitment"} {
+		if _, ok := columns[name]; !ok {
+			return nil, badRequest("The header row must name the user_name and crypto_commitment columns")
+		}
+	}
+	return &commitmentRecords{csv: reader, columns: columns}, nil
+}
+
+// next returns the next record, or io.EOF after the last one. An error that ends the load is
+// returned as such; a record that can't be decoded comes back with the reason in its row.
+func (c *commitmentRecords) next() (loadRow, error) {
+	if c.lines != nil {
+		line, lineErr := c.lines()
+		if lineErr != nil {
+			return loadRow{}, lineErr
+		}
+		var row loadRow
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if decodeErr := decoder.Decode(&row.record); decodeErr != nil {
+			row.err = badRequest("Invalid JSON: %v", decodeErr)
+		}
+		return row, nil
+	}
+
+	fields, readErr := c.csv.Read()
+	if errors.Is(readErr, io.EOF) {
+		return loadRow{}, io.EOF
+	}
+	if errors.Is(readErr, csv.ErrFieldCount) {
+		return loadRow{err: badRequest("The record has %d fields, the header row names %d", len(fields), len(c.columns))}, nil
+	}
+	if readErr != nil {
+		return loadRow{}, badRequest("Invalid CSV: %v", readErr)
+	}
+	column := func(name string) string {
+		if i, ok := c.columns[name]; ok {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	row := loadRow{record: CommitmentRecord{
+		UserName:         column("user_name"),
+		CryptoCommitment: column("crypto_commitment"),
+		CircuitVersion:   column("circuit_version"),
+		Tenant:           column("tenant"),
+	}}
+	if salt := column("salt"); salt != "" {
+		var v validate.Validator
+		row.record.Salt = v.Base64("salt", salt, maxSaltLength)
+		row.err = v.Err()
+	}
+	return row, nil
+}
+
+// commitmentLoader validates the records of a load and stores each as a registration
+type commitmentLoader struct {
+	store    store.Store
+	circuits map[string]CircuitMetadata
+	current  string            // current is the circuit version of records that name none
+	pinned   map[string]string // pinned maps the tenants tenant_circuits pins to the version of their circuit, which replaces current
+	keyID    string            // keyID is recorded as the key version of the users stored on current
+	dryRun   bool
+	// admit, when set, checks that the caller may load a record, setting defaults the caller implies
+	admit func(record *CommitmentRecord) error
+	// loaded, when set, is called with every user stored
+	loaded func(user store.User)
+}
+
+// validate checks a record and returns the user it stores
+func (l *commitmentLoader) validate(record CommitmentRecord, now time.Time) (store.User, error) {
+	version, keyID := record.CircuitVersion, l.keyID
+	if pinned, ok := l.pinned[record.Tenant]; ok && version == "" {
+		version, keyID = pinned, ""
+	}
+	if version == "" {
+		version = l.current
+	}
+	metadata, known := l.circuits[version]
+	registration := RegisterRequest{
+		UserName:         record.UserName,
+		CryptoCommitment: record.CryptoCommitment,
+		Salt:             record.Salt,
+		Tenant:           record.Tenant,
+		Curve:            metadata.Curve,
+	}
+	var v validate.Validator
+	if !known {
+		v.Fail("circuit_version", "is not a circuit this server knows")
+		registration.Curve = ""
+	}
+	registration.validateInto(&v)
+	if validateErr := v.Err(); validateErr != nil {
+		return store.User{}, validateErr
+	}
+	return store.User{
+		UserName:         record.UserName,
+		Tenant:           record.Tenant,
+		CryptoCommitment: record.CryptoCommitment,
+		Salt:             record.Salt,
+		CircuitVersion:   version,
+		Curve:            metadata.Curve,
+		KeyID:            keyID,
+		CreatedAt:        now,
+	}, nil
+}
+
+// run reads the records and stores those that are valid and not registered yet, calling emit
+// for every failed record and every loadProgressInterval records. A dry run only checks the
+// store for the names taken. run stops at the first store failure, or when emit fails, returning
+// the counts so far.
+func (l *commitmentLoader) run(ctx context.Context, records *commitmentRecords, emit func(LoadEvent) error) (LoadCounts, error) {
+	counts := LoadCounts{DryRun: l.dryRun}
+	// A dry run writes nothing, so it remembers the names it has seen to find a repeated one
+	var seen map[string]bool
+	if l.dryRun {
+		seen = make(map[string]bool)
+	}
+	for {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return counts, ctxErr
+		}
+		row, nextErr := records.next()
+		if errors.Is(nextErr, io.EOF) {
+			return counts, nil
+		}
+		if nextErr != nil {
+			return counts, nextErr
+		}
+		counts.Processed++
+
+		recordErr := l.load(ctx, row, seen)
+		var storeErr *loadStoreError
+		if errors.As(recordErr, &storeErr) {
+			return counts, storeErr.err
+		}
+		if recordErr != nil {
+			counts.Failed++
+			problem := requestProblem(recordErr)
+			if emitErr := emit(LoadEvent{Event: "failed", Row: counts.Processed, UserName: row.record.UserName, Problem: &problem}); emitErr != nil {
+				return counts, emitErr
+			}
+		} else {
+			counts.Loaded++
+		}
+		if counts.Processed%loadProgressInterval == 0 {
+			progress := counts
+			if emitErr := emit(LoadEvent{Event: "progress", LoadCounts: &progress}); emitErr != nil {
+				return counts, emitErr
+			}
+		}
+	}
+}
+
+// loadStoreError is a store failure met by a load, which ends it, told apart from a failed record
+type loadStoreError struct {
+	err error
+}
+
+func (e *loadStoreError) Error() string {
+	return e.err.Error()
+}
+
+// load validates and stores one record, returning why it failed
+func (l *commitmentLoader) load(ctx context.Context, row loadRow, seen map[string]bool) error {
+	if row.err != nil {
+		return row.err
+	}
+	record := row.record
+	if l.admit != nil {
+		if admitErr := l.admit(&record); admitErr != nil {
+			return admitErr
+		}
+	}
+	user, validateErr := l.validate(record, time.Now().UTC())
+	if validateErr != nil {
+		return validateErr
+	}
+
+	var createErr error
+	if l.dryRun {
+		if seen[user.UserName] {
+			createErr = store.ErrUserExists
+		} else if _, createErr = l.store.GetUser(ctx, user.UserName); createErr == nil {
+			createErr = store.ErrUserExists
+		} else if errors.Is(createErr, store.ErrUserNotFound) {
+			createErr = nil
+		}
+		seen[user.UserName] = true
+	} else {
+		createErr = l.store.CreateUser(ctx, user)
+	}
+	switch {
+	case createErr == nil:
+		if l.loaded != nil && !l.dryRun {
+			l.loaded(user)
+		}
+		return nil
+	case errors.Is(createErr, store.ErrUserExists):
+		return &requestError{status: http.StatusConflict, code: codeUserExists, message: "User already exists"}
+	case errors.Is(createErr, store.ErrNoDirectoryEntry):
+		return &requestError{status: http.StatusNotFound, code: codeUserNotFound, message: "The directory has no entry for the user"}
+	}
+	return &loadStoreError{err: fmt.Errorf("storing %q: %w", user.UserName, createErr)}
+}
+
+// loadHandler streams a file of commitments generated elsewhere into the store, as CSV (text/csv)
+// or NDJSON, and streams back the report: a line for every record that wasn't stored, a progress
+// line every loadProgressInterval records and a summary. ?dry_run=true only reports what the load
+// would do. Records are stored one at a time, so a failed record keeps no other out of the store;
+// a store failure ends the load early. Like a restore it needs no secret policy proofs. A
+// tenant-admin loads into its own tenant only.
+func (s *Server) loadHandler(w http.ResponseWriter, r *http.Request) {
+	var records *commitmentRecords
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		var csvErr error
+		if records, csvErr = newCSVRecords(r.Body); csvErr != nil {
+			writeRequestError(w, csvErr)
+			return
+		}
+	} else {
+		items, itemsErr := newBulkItems(r, s.cfg.MaxBodyBytes)
+		if itemsErr != nil {
+			var reqErr *requestError
+			if errors.As(itemsErr, &reqErr) && reqErr.code == codeUnsupportedMedia {
+				reqErr.message = "Send records as text/csv, as " + ndjsonContentType + " or as multipart parts holding it"
+			}
+			writeRequestError(w, itemsErr)
+			return
+		}
+		records = &commitmentRecords{lines: items.next}
+	}
+
+	loader := &commitmentLoader{
+		store:    s.store,
+		circuits: s.circuits,
+		current:  s.circuitVersion,
+		pinned:   s.cfg.tenantCircuitVersions(),
+		keyID:    s.keyring.current().ID,
+		dryRun:   r.URL.Query().Get("dry_run") == "true",
+		loaded:   func(user store.User) { s.recordRegistration(r.Context(), user) },
+	}
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		loader.admit = func(record *CommitmentRecord) error {
+			if record.Tenant == "" {
+				record.Tenant = p.tenant
+			}
+			if !p.managesTenant(record.Tenant) {
+				return &requestError{
+					status:  http.StatusForbidden,
+					code:    codePermissionDenied,
+					message: fmt.Sprintf("A %s of tenant %q may not load users of tenant %q", RoleTenantAdmin, p.tenant, record.Tenant),
+				}
+			}
+			return nil
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	// The report goes out while the body is still arriving, possibly for longer than the server timeouts
+	controller.EnableFullDuplex()
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	encoder := json.NewEncoder(w)
+	emit := func(event LoadEvent) error {
+		if encodeErr := encoder.Encode(event); encodeErr != nil {
+			return encodeErr
+		}
+		return controller.Flush()
+	}
+	counts, loadErr := loader.run(r.Context(), records, emit)
+	if loadErr != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		problem := requestProblem(loadErr)
+		emit(LoadEvent{Event: "failed", Problem: &problem})
+	}
+	logf(r.Context(), "Loaded %d of %d records (%d failed, dry run %t)", counts.Loaded, counts.Processed, counts.Failed, counts.DryRun)
+	emit(LoadEvent{Event: "summary", LoadCounts: &counts})
+}
+
+// runLoadCommand implements the "load" subcommand, streaming a file of commitments into the
+// configured store. The report of failed records and the summary are written as NDJSON to -report,
+// progress to stderr; the command fails when any record did.
+func runLoadCommand(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the JSON configuration file")
+	databasePath := flags.String("db", "", "SQLite database to load into (overrides the config)")
+	inPath := flags.String("in", "-", "file of commitments to read, - for stdin")
+	format := flags.String("format", "csv", "format of the file: csv or jsonl")
+	reportPath := flags.String("report", "-", "file to write the report of failed records to, - for stdout")
+	dryRun := flags.Bool("dry-run", false, "validate the file without writing anything")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *inPath != "-" {
+		file, openErr := os.Open(*inPath)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		in = file
+	}
+	var records *commitmentRecords
+	switch *format {
+	case "csv":
+		var csvErr error
+		if records, csvErr = newCSVRecords(in); csvErr != nil {
+			return csvErr
+		}
+	case "jsonl":
+		items := &bulkItems{limit: maxLoadLineLength}
+		items.lines = items.scanner(in)
+		records = &commitmentRecords{lines: items.next}
+	default:
+		return fmt.Errorf("unknown format %q (want csv or jsonl)", *format)
+	}
+
+	userStore, cfg, openErr := openConfiguredStore(*configPath, *databasePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer userStore.Close()
+
+	var report io.Writer = os.Stdout
+	if *reportPath != "-" {
+		file, createErr := os.Create(*reportPath)
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		report = file
+	}
+	encoder := json.NewEncoder(report)
+	emit := func(event LoadEvent) error {
+		if event.Event == "progress" {
+			fmt.Fprintf(os.Stderr, "%d records: %d loaded, %d failed\n", event.Processed, event.Loaded, event.Failed)
+			return nil
+		}
+		return encoder.Encode(event)
+	}
+
+	// Offline there is no keyring to name the current key version, so loaded users record none
+	loader := &commitmentLoader{store: userStore, circuits: knownCircuits(cfg), current: cfg.Circuit.Version(), pinned: cfg.tenantCircuitVersions(), dryRun: *dryRun}
+	counts, loadErr := loader.run(context.Background(), records, emit)
+	if loadErr != nil {
+		return fmt.Errorf("after %d records: %w", counts.Processed, loadErr)
+	}
+	if encodeErr := emit(LoadEvent{Event: "summary", LoadCounts: &counts}); encodeErr != nil {
+		return encodeErr
+	}
+	if counts.Failed > 0 {
+		return fmt.Errorf("%d of %d records failed", counts.Failed, counts.Processed)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/consensys/gnark/constraint"
+)
+
+// Terms of estimateProofMemory, sized after what gnark's Groth16 prover allocates
+const (
+	proofMemoryBase      = 20 << 20 // proofMemoryBase covers the MSM buckets and what else doesn't grow with the circuit
+	proofMemoryPerDomain = 8 * 32   // proofMemoryPerDomain is the FFT vectors, eight field elements per evaluation point
+	proofMemoryPerWire   = 6 * 32   // proofMemoryPerWire is the solution and the MSM scalars, six field elements per wire
+)
+
+// estimateProofMemory estimates the peak memory one Groth16 proof of ccs takes besides the proving
+// key, which all proofs share. It is an upper estimate meant for admission, not an accounting: the
+// FFT domain is the constraint count rounded up to a power of two.
+func estimateProofMemory(ccs constraint.ConstraintSystem) int64 {
+	domain := uint64(1) << bits.Len64(uint64(max(ccs.GetNbConstraints(), 1))-1)
+	wires := int64(ccs.GetNbInternalVariables() + ccs.GetNbPublicVariables() + ccs.GetNbSecretVariables())
+	return proofMemoryBase + int64(domain)*proofMemoryPerDomain + wires*proofMemoryPerWire
+}
+
+// memoryBudget caps the estimated memory of the proving jobs admitted and not yet finished, so a
+// burst of large proofs is turned away instead of running a small container out of memory
+type memoryBudget struct {
+	limit int64
+
+	mu       sync.Mutex
+	reserved int64 // reserved is the estimated memory of the admitted jobs
+	holders  int   // holders is how many admitted jobs hold a reservation
+}
+
+// newMemoryBudget checks proving_memory_budget against one proof of ccs; it returns nil when the
+// budget is unset, admitting every job
+func newMemoryBudget(limit int64, ccs constraint.ConstraintSystem) (*memoryBudget, error) {
+	switch {
+	case limit == 0:
+		return nil, nil
+	case limit < 0:
+		return nil, fmt.Errorf("proving_memory_budget: %d must not be negative", limit)
+	case estimateProofMemory(ccs) > limit:
+		return nil, fmt.Errorf("proving_memory_budget: %d bytes is less than the %d bytes one proof is estimated to take", limit, estimateProofMemory(ccs))
+	}
+	return &memoryBudget{limit: limit}, nil
+}
+
+// reserve sets aside bytes for a job and returns the function giving them back. When they don't fit
+// it returns false and how many admitted jobs are ahead of a retry. A nil budget admits everything.
+func (b *memoryBudget) reserve(bytes int64) (func(), int, bool) {
+	if b == nil {
+		return func() {}, 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reserved+bytes > b.limit {
+		return nil, b.holders, false
+	}
+	b.reserved += bytes
+	b.holders++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.reserved -= bytes
+			b.holders--
+		})
+	}, 0, true
+}
+
+// usage reports the reserved memory and how many jobs hold it
+func (b *memoryBudget) usage() (int64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reserved, b.holders
+}
+
+// writeMemoryBusy tells the client the proving memory budget is taken, with the proving jobs that
+// must finish first as queue_position
+func writeMemoryBusy(w http.ResponseWriter, retryAfter time.Duration, needed int64, ahead int) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	problem := newProblem(http.StatusServiceUnavailable, codeServerBusy,
+		fmt.Sprintf("The proof needs about %d MiB of a proving memory budget %d running or queued proving jobs hold, retry later", needed>>20, ahead))
+	problem.QueuePosition = ahead
+	sendProblem(w, problem)
+}
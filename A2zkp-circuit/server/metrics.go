@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/mockzk"
+)
+
+// requestKey identifies one series of the request counter
+type requestKey struct {
+	route string
+	code  int
+}
+
+// Operations the proof histograms break down
+const (
+	proofProve  = "prove"
+	proofVerify = "verify"
+)
+
+// proofKey identifies one series of the proof histograms
+type proofKey struct {
+	operation string // operation is proofProve or proofVerify
+	curve     string
+	backend   string // backend is the proof system: "groth16", "mock" or "snarkjs"
+	circuit   string // circuit is the circuit version
+}
+
+// Bucket upper bounds of the proof histograms; +Inf is implied
+var (
+	proofSecondsBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	proofBytesBuckets   = []float64{128, 256, 512, 1024, 2048, 4096, 8192}
+)
+
+// histogram counts observations per bucket, as a Prometheus histogram does
+type histogram struct {
+	buckets []uint64 // buckets counts the observations at most each bound, not cumulatively
+	count   uint64
+	sum     float64
+}
+
+// observe records value against bounds
+func (h *histogram) observe(bounds []float64, value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(bounds))
+	}
+	if i, _ := slices.BinarySearch(bounds, value); i < len(bounds) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// write prints the series of a histogram named name, labels being its other labels, if any
+func (h *histogram) write(w io.Writer, name, labels string, bounds []float64) {
+	bucketLabels, seriesLabels := labels+",", "{"+labels+"}"
+	if labels == "" {
+		bucketLabels, seriesLabels = "", ""
+	}
+	var cumulative uint64
+	for i, bound := range bounds {
+		if i < len(h.buckets) {
+			cumulative += h.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, bucketLabels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, seriesLabels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, seriesLabels, h.count)
+}
+
+// labels formats the key as Prometheus labels
+func (k proofKey) labels() string {
+	return fmt.Sprintf("operation=%s,curve=%s,backend=%s,circuit=%s", strconv.Quote(k.operation), strconv.Quote(k.curve), strconv.Quote(k.backend), strconv.Quote(k.circuit))
+}
+
+// requestMetrics counts served requests per route pattern and status code for /metrics, and
+// measures the proofs made and checked
+type requestMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]float64 // durations sums the seconds spent per route pattern
+
+	proofSeconds map[proofKey]*histogram // proofSeconds holds the latency of each proof made or checked
+	proofBytes   map[proofKey]*histogram // proofBytes holds the encoded size of those proofs
+
+	transcriptAudits map[string]uint64    // transcriptAudits counts the transcripts audits verified again, by outcome
+	verifications    map[[2]string]uint64 // verifications counts the logins whose proof was checked, by circuit version and result
+}
+
+// newRequestMetrics creates empty request counters
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		requests:     make(map[requestKey]uint64),
+		durations:    make(map[string]float64),
+		proofSeconds: make(map[proofKey]*histogram),
+		proofBytes:   make(map[proofKey]*histogram),
+
+		transcriptAudits: make(map[string]uint64),
+		verifications:    make(map[[2]string]uint64),
+	}
+}
+
+// observeTranscriptAudit counts a transcript an audit verified again, by its verdict or "skipped"
+// when its key version is gone; a nil receiver counts nothing
+func (m *requestMetrics) observeTranscriptAudit(outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transcriptAudits[outcome]++
+}
+
+// observeVerification counts a login whose proof was checked under a circuit version, so a canary's
+// success rate compares with the configured circuit's; a nil receiver counts nothing
+func (m *requestMetrics) observeVerification(circuitVersion string, success bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.verifications[[2]string{circuitVersion, result}]++
+}
+
+// observeProof records how long a proof took to make or check and its encoded size, when known;
+// a nil receiver records nothing
+func (m *requestMetrics) observeProof(key proofKey, took time.Duration, size int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.proofSeconds[key] == nil {
+		m.proofSeconds[key], m.proofBytes[key] = &histogram{}, &histogram{}
+	}
+	m.proofSeconds[key].observe(proofSecondsBuckets, took.Seconds())
+	if size > 0 {
+		m.proofBytes[key].observe(proofBytesBuckets, float64(size))
+	}
+}
+
+// observeProof records a proof made or checked under a key version over curve
+func (s *Server) observeProof(operation string, version *keyVersion, curve string, took time.Duration, size int) {
+	backend := "groth16"
+	switch {
+	case s.snarkJS != nil && version == s.snarkJS.version:
+		backend = "snarkjs"
+	case version.keys != nil && mockzk.IsVerifyingKey(version.keys.verifyingKey):
+		backend = "mock"
+	}
+	s.metrics.observeProof(proofKey{operation: operation, curve: curve, backend: backend, circuit: cmp.Or(version.CircuitVersion, s.circuitVersion)}, took, size)
+}
+
+// instrument wraps a route's handler to count its requests; a nil receiver leaves it unwrapped
+func (m *requestMetrics) instrument(pattern string, handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		m.mu.Lock()
+		m.requests[requestKey{route: pattern, code: recorder.status}]++
+		m.durations[pattern] += time.Since(started).Seconds()
+		m.mu.Unlock()
+	})
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records the first status code written
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands the connection over to a WebSocket upgrade, which asserts http.Hijacker rather than
+// going through http.ResponseController
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// metricsHandler serves the request counters, proof histograms, worker pool occupancy and Go runtime figures
+// in the Prometheus text exposition format
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if s.metrics != nil {
+		s.metrics.mu.Lock()
+		keys := make([]requestKey, 0, len(s.metrics.requests))
+		for key := range s.metrics.requests {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b requestKey) int {
+			if byRoute := strings.Compare(a.route, b.route); byRoute != 0 {
+				return byRoute
+			}
+			return a.code - b.code
+		})
+		fmt.Fprintln(w, "# HELP ofa_http_requests_total Requests served, by route pattern and status code.")
+		fmt.Fprintln(w, "# TYPE ofa_http_requests_total counter")
+		for _, key := range keys {
+			fmt.Fprintf(w, "ofa_http_requests_total{route=%s,code=\"%d\"} %d\n", strconv.Quote(key.route), key.code, s.metrics.requests[key])
+		}
+		fmt.Fprintln(w, "# HELP ofa_http_request_seconds_total Time spent serving requests, by route pattern.")
+		fmt.Fprintln(w, "# TYPE ofa_http_request_seconds_total counter")
+		routes := make([]string, 0, len(s.metrics.durations))
+		for route := range s.metrics.durations {
+			routes = append(routes, route)
+		}
+		slices.Sort(routes)
+		for _, route := range routes {
+			fmt.Fprintf(w, "ofa_http_request_seconds_total{route=%s} %g\n", strconv.Quote(route), s.metrics.durations[route])
+		}
+		proofs := make([]proofKey, 0, len(s.metrics.proofSeconds))
+		for key := range s.metrics.proofSeconds {
+			proofs = append(proofs, key)
+		}
+		slices.SortFunc(proofs, func(a, b proofKey) int {
+			return strings.Compare(a.operation+" "+a.curve+" "+a.backend+" "+a.circuit, b.operation+" "+b.curve+" "+b.backend+" "+b.circuit)
+		})
+		fmt.Fprintln(w, "# HELP ofa_proof_seconds Time to make or check a proof, by operation, curve, backend and circuit version.")
+		fmt.Fprintln(w, "# TYPE ofa_proof_seconds histogram")
+		for _, key := range proofs {
+			s.metrics.proofSeconds[key].write(w, "ofa_proof_seconds", key.labels(), proofSecondsBuckets)
+		}
+		fmt.Fprintln(w, "# HELP ofa_proof_bytes Encoded size of the proofs made or checked, by operation, curve, backend and circuit version.")
+		fmt.Fprintln(w, "# TYPE ofa_proof_bytes histogram")
+		for _, key := range proofs {
+			if s.metrics.proofBytes[key].count > 0 {
+				s.metrics.proofBytes[key].write(w, "ofa_proof_bytes", key.labels(), proofBytesBuckets)
+			}
+		}
+		fmt.Fprintln(w, "# HELP ofa_transcript_audits_total Proof transcripts verified again by the background audit, by outcome.")
+		fmt.Fprintln(w, "# TYPE ofa_transcript_audits_total counter")
+		outcomes := make([]string, 0, len(s.metrics.transcriptAudits))
+		for outcome := range s.metrics.transcriptAudits {
+			outcomes = append(outcomes, outcome)
+		}
+		slices.Sort(outcomes)
+		for _, outcome := range outcomes {
+			fmt.Fprintf(w, "ofa_transcript_audits_total{outcome=%s} %d\n", strconv.Quote(outcome), s.metrics.transcriptAudits[outcome])
+		}
+		fmt.Fprintln(w, "# HELP ofa_verifications_total Logins whose proof was checked, by circuit version and result, to compare a canary circuit with the configured one.")
+		fmt.Fprintln(w, "# TYPE ofa_verifications_total counter")
+		verifications := slices.SortedFunc(maps.Keys(s.metrics.verifications), func(a, b [2]string) int {
+			return strings.Compare(a[0]+" "+a[1], b[0]+" "+b[1])
+		})
+		for _, key := range verifications {
+			fmt.Fprintf(w, "ofa_verifications_total{circuit=%s,result=%s} %d\n", strconv.Quote(key[0]), strconv.Quote(key[1]), s.metrics.verifications[key])
+		}
+		s.metrics.mu.Unlock()
+	}
+
+	if s.pool != nil {
+		fmt.Fprintln(w, "# HELP ofa_pool_busy_workers Proving and verification jobs running.")
+		fmt.Fprintln(w, "# TYPE ofa_pool_busy_workers gauge")
+		fmt.Fprintf(w, "ofa_pool_busy_workers %d\n", len(s.pool.workers))
+		fmt.Fprintln(w, "# HELP ofa_pool_queued_jobs Jobs waiting for a worker.")
+		fmt.Fprintln(w, "# TYPE ofa_pool_queued_jobs gauge")
+		fmt.Fprintf(w, "ofa_pool_queued_jobs %d\n", s.pool.Queued())
+		fmt.Fprintln(w, "# HELP ofa_pool_admission_waiting Login verifications waiting in the admission queue for room in a full queue.")
+		fmt.Fprintln(w, "# TYPE ofa_pool_admission_waiting gauge")
+		fmt.Fprintf(w, "ofa_pool_admission_waiting %d\n", s.pool.Admitting())
+		fmt.Fprintln(w, "# HELP ofa_pool_queue_wait_seconds Time jobs waited for a worker, admission included.")
+		fmt.Fprintln(w, "# TYPE ofa_pool_queue_wait_seconds histogram")
+		s.pool.mu.Lock()
+		s.pool.waits.write(w, "ofa_pool_queue_wait_seconds", "", proofSecondsBuckets)
+		s.pool.mu.Unlock()
+	}
+	if s.provingMemory != nil {
+		reserved, holders := s.provingMemory.usage()
+		fmt.Fprintln(w, "# HELP ofa_proving_memory_budget_bytes The proving_memory_budget proving jobs are admitted under.")
+		fmt.Fprintln(w, "# TYPE ofa_proving_memory_budget_bytes gauge")
+		fmt.Fprintf(w, "ofa_proving_memory_budget_bytes %d\n", s.provingMemory.limit)
+		fmt.Fprintln(w, "# HELP ofa_proving_memory_reserved_bytes Estimated memory of the proving jobs admitted and not yet finished.")
+		fmt.Fprintln(w, "# TYPE ofa_proving_memory_reserved_bytes gauge")
+		fmt.Fprintf(w, "ofa_proving_memory_reserved_bytes %d\n", reserved)
+		fmt.Fprintln(w, "# HELP ofa_proving_memory_jobs Proving jobs holding part of the proving memory budget.")
+		fmt.Fprintln(w, "# TYPE ofa_proving_memory_jobs gauge")
+		fmt.Fprintf(w, "ofa_proving_memory_jobs %d\n", holders)
+	}
+
+	if s.challenges != nil {
+		depth, misses := s.challenges.poolDepth()
+		fmt.Fprintln(w, "# HELP ofa_challenge_pool_nonces Nonces drawn ahead of time, ready to be issued.")
+		fmt.Fprintln(w, "# TYPE ofa_challenge_pool_nonces gauge")
+		fmt.Fprintf(w, "ofa_challenge_pool_nonces %d\n", depth)
+		fmt.Fprintln(w, "# HELP ofa_challenge_pool_misses_total Nonces drawn as they were issued because none was ready.")
+		fmt.Fprintln(w, "# TYPE ofa_challenge_pool_misses_total counter")
+		fmt.Fprintf(w, "ofa_challenge_pool_misses_total %d\n", misses)
+	}
+
+	if s.verdicts != nil {
+		hits, misses := s.verdicts.Stats()
+		fmt.Fprintln(w, "# HELP ofa_verdict_cache_lookups_total Verdict cache lookups for proofs, by whether a verdict was cached.")
+		fmt.Fprintln(w, "# TYPE ofa_verdict_cache_lookups_total counter")
+		fmt.Fprintf(w, "ofa_verdict_cache_lookups_total{result=\"hit\"} %d\n", hits)
+		fmt.Fprintf(w, "ofa_verdict_cache_lookups_total{result=\"miss\"} %d\n", misses)
+	}
+
+	if s.bus != nil {
+		fmt.Fprintln(w, "# HELP ofa_event_bus_published_total Events published to the event bus.")
+		fmt.Fprintln(w, "# TYPE ofa_event_bus_published_total counter")
+		fmt.Fprintf(w, "ofa_event_bus_published_total %d\n", s.bus.published.Load())
+		fmt.Fprintln(w, "# HELP ofa_event_bus_failed_total Events given up after every attempt to publish them failed.")
+		fmt.Fprintln(w, "# TYPE ofa_event_bus_failed_total counter")
+		fmt.Fprintf(w, "ofa_event_bus_failed_total %d\n", s.bus.failed.Load())
+		fmt.Fprintln(w, "# HELP ofa_event_bus_dropped_total Events dropped without being queued, mostly because the event bus queue was full.")
+		fmt.Fprintln(w, "# TYPE ofa_event_bus_dropped_total counter")
+		fmt.Fprintf(w, "ofa_event_bus_dropped_total %d\n", s.bus.dropped.Load())
+		fmt.Fprintln(w, "# HELP ofa_event_bus_queued_events Events waiting to be published to the event bus.")
+		fmt.Fprintln(w, "# TYPE ofa_event_bus_queued_events gauge")
+		fmt.Fprintf(w, "ofa_event_bus_queued_events %d\n", len(s.bus.queue))
+	}
+
+	if s.startup != nil {
+		readiness := s.startup.readiness()
+		fmt.Fprintln(w, "# HELP ofa_startup_seconds Time from the start of startup until the server was ready.")
+		fmt.Fprintln(w, "# TYPE ofa_startup_seconds gauge")
+		fmt.Fprintf(w, "ofa_startup_seconds %g\n", readiness.StartupSeconds)
+		fmt.Fprintln(w, "# HELP ofa_startup_phase_seconds Time each startup phase took, by phase, circuit version and curve.")
+		fmt.Fprintln(w, "# TYPE ofa_startup_phase_seconds gauge")
+		for _, phase := range readiness.Phases {
+			fmt.Fprintf(w, "ofa_startup_phase_seconds{phase=%s,circuit=%s,curve=%s} %g\n", strconv.Quote(phase.Phase), strconv.Quote(phase.Circuit), strconv.Quote(phase.Curve), phase.Seconds)
+		}
+		fmt.Fprintln(w, "# HELP ofa_circuit_constraints Constraints of the circuits compiled or loaded at startup, by circuit version and curve.")
+		fmt.Fprintln(w, "# TYPE ofa_circuit_constraints gauge")
+		counted := make(map[[2]string]bool)
+		for _, phase := range readiness.Phases {
+			circuitKey := [2]string{phase.Circuit, phase.Curve}
+			if phase.Constraints == 0 || counted[circuitKey] {
+				continue
+			}
+			counted[circuitKey] = true
+			fmt.Fprintf(w, "ofa_circuit_constraints{circuit=%s,curve=%s} %d\n", strconv.Quote(phase.Circuit), strconv.Quote(phase.Curve), phase.Constraints)
+		}
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	fmt.Fprintln(w, "# HELP go_goroutines Goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP go_memstats_heap_inuse_bytes Heap bytes in use.")
+	fmt.Fprintln(w, "# TYPE go_memstats_heap_inuse_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_heap_inuse_bytes %d\n", stats.HeapInuse)
+	fmt.Fprintln(w, "# HELP go_gc_cycles_total Completed garbage collection cycles.")
+	fmt.Fprintln(w, "# TYPE go_gc_cycles_total counter")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", stats.NumGC)
+}
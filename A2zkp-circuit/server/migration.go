@@ -0,0 +1,530 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/did"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxLegacyHashLength bounds an imported password hash
+const maxLegacyHashLength = 512
+
+// maxPasswordLength bounds the password of a migration, which is only hashed as its legacy hash says
+const maxPasswordLength = 1024
+
+// decoyLegacyHash is the bcrypt hash the password of a user with nothing to migrate is checked
+// against, so the answer costs about as much as a wrong password
+const decoyLegacyHash = "$2a$10$toxR2on1yCqGauhDGIGpaO7t/whwGe0SnZneHQrBHMG5QHs7B5mIq"
+
+// ErrLegacyPasswordInvalid is returned when a migration's password doesn't match the user's
+// legacy hash, or, unless user existence may be revealed, when there is nothing to migrate
+var ErrLegacyPasswordInvalid = errors.New("wrong password, or no imported password to migrate from")
+
+// ErrMigrationNotPending is returned, with reveal_user_existence, when migrating a user who has a
+// commitment already
+var ErrMigrationNotPending = errors.New("the user has no imported password to migrate from")
+
+// errMigrationPending marks a proof for an imported user who hasn't migrated, joined to ErrInvalidProof
+var errMigrationPending = errors.New("user imported with a legacy password and not migrated yet")
+
+// LegacyUser is one user of a user table imported from another system
+type LegacyUser struct {
+	UserName string `json:"user_name"`
+	Tenant   string `json:"tenant,omitempty"`
+	// PasswordHash is a bcrypt hash ("$2a$", "$2b$" or "$2y$") or an Argon2id or Argon2i one in PHC
+	// string format, e.g. "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>" in unpadded base64
+	PasswordHash string `json:"password_hash"`
+}
+
+// ImportRequest is the body of POST /v1/users:import
+type ImportRequest struct {
+	Users []LegacyUser `json:"users"` // Users are the users to import, at most max_batch_size of them
+}
+
+// ImportReport summarizes the outcome (or, for a dry run, the expected outcome) of an import
+type ImportReport struct {
+	DryRun   bool `json:"dry_run"`  // DryRun is true when nothing was written
+	Total    int  `json:"total"`    // Total is the number of users in the import
+	Imported int  `json:"imported"` // Imported counts the users stored pending their migration
+	// Existing counts the users already registered, or imported before, who are left as they are
+	Existing int `json:"existing"`
+	// Unmatched counts the users the directory has no entry for, which an LDAP store can't hold
+	Unmatched int `json:"unmatched,omitempty"`
+}
+
+// MigrateRequest is the body of POST /v1/users/{id}/migration: the password of an imported user,
+// checked once against their legacy hash, and the registration that replaces it
+type MigrateRequest struct {
+	Password string `json:"password"`
+	// CryptoCommitment is the commitment generated from the user's new secret, usually the password
+	// stretched with kdf
+	CryptoCommitment string            `json:"crypto_commitment"`
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	Curve            string            `json:"curve,omitempty"`
+	PolicyProof      []byte            `json:"policy_proof,omitempty"` // PolicyProof is required when a secret policy is configured, as for registrations
+	// DIDBinding binds the commitment to a key of the user's DID document, as for registrations
+	DIDBinding *did.Binding `json:"did_binding,omitempty"`
+}
+
+// MigrateResponse is the answer to a completed migration, with a session token as a proof login would have
+type MigrateResponse struct {
+	StatusResponse
+	// SessionToken is omitted in tenants that require TOTP, whose users enroll before they log in
+	SessionToken string `json:"session_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"` // ExpiresIn is the session token's lifetime in seconds
+}
+
+// registration is the registration a migration request makes for a user
+func (req MigrateRequest) registration(userName string) RegisterRequest {
+	return RegisterRequest{
+		UserName:         userName,
+		CryptoCommitment: req.CryptoCommitment,
+		Salt:             req.Salt,
+		KDF:              req.KDF,
+		Curve:            req.Curve,
+		PolicyProof:      req.PolicyProof,
+		DIDBinding:       req.DIDBinding,
+	}
+}
+
+// validate checks the password is present and the registration is valid
+func (req MigrateRequest) validate(registration RegisterRequest) error {
+	var v validate.Validator
+	if v.Required("password", req.Password) {
+		v.MaxLength("password", len(req.Password), maxPasswordLength)
+	}
+	registration.validateInto(&v)
+	return v.Err()
+}
+
+// isBcrypt reports whether a legacy hash is a bcrypt one
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// argon2Hash is a parsed Argon2 hash in PHC string format
+type argon2Hash struct {
+	variant     string // variant is "argon2id" or "argon2i"
+	memory      uint32 // memory is in KiB
+	time        uint32
+	parallelism uint8
+	salt, key   []byte
+}
+
+// parseArgon2Hash parses "$argon2id$v=19$m=<KiB>,t=<passes>,p=<lanes>$<salt>$<hash>", or the same
+// for argon2i, bounding the costs to those secret.KDFParams accepts
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" || (fields[1] != "argon2id" && fields[1] != "argon2i") {
+		return argon2Hash{}, errors.New("is neither a bcrypt hash nor an argon2id or argon2i one in PHC string format")
+	}
+	parsed := argon2Hash{variant: fields[1]}
+	if fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return argon2Hash{}, fmt.Errorf("has Argon2 version %q, want v=%d", fields[2], argon2.Version)
+	}
+	var memory, passes, lanes uint64
+	for _, param := range strings.Split(fields[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		number, parseErr := strconv.ParseUint(value, 10, 32)
+		if parseErr != nil {
+			return argon2Hash{}, fmt.Errorf("has a malformed parameter %q", param)
+		}
+		switch name {
+		case "m":
+			memory = number
+		case "t":
+			passes = number
+		case "p":
+			lanes = number
+		default:
+			return argon2Hash{}, fmt.Errorf("has an unknown parameter %q", name)
+		}
+	}
+	switch {
+	case memory == 0 || memory > secret.MaxArgon2Memory:
+		return argon2Hash{}, fmt.Errorf("must have a memory cost between 1 and %d KiB", secret.MaxArgon2Memory)
+	case passes == 0 || passes > secret.MaxArgon2Time:
+		return argon2Hash{}, fmt.Errorf("must have a time cost between 1 and %d", secret.MaxArgon2Time)
+	case lanes == 0 || lanes > 255:
+		return argon2Hash{}, errors.New("must have a parallelism between 1 and 255")
+	}
+	parsed.memory, parsed.time, parsed.parallelism = uint32(memory), uint32(passes), uint8(lanes)
+
+	var saltErr, keyErr error
+	parsed.salt, saltErr = base64.RawStdEncoding.DecodeString(fields[4])
+	parsed.key, keyErr = base64.RawStdEncoding.DecodeString(fields[5])
+	if saltErr != nil || keyErr != nil || len(parsed.salt) < 8 || len(parsed.key) < 16 {
+		return argon2Hash{}, errors.New("must have a salt of at least 8 bytes and a hash of at least 16, in unpadded base64")
+	}
+	return parsed, nil
+}
+
+// checkLegacyHash checks an imported password hash is one matchLegacyPassword can check
+func checkLegacyHash(hash string) error {
+	if isBcrypt(hash) {
+		if _, costErr := bcrypt.Cost([]byte(hash)); costErr != nil {
+			return fmt.Errorf("is a malformed bcrypt hash: %v", costErr)
+		}
+		return nil
+	}
+	_, parseErr := parseArgon2Hash(hash)
+	return parseErr
+}
+
+// matchLegacyPassword reports whether a password is the one a legacy hash was made from
+func matchLegacyPassword(hash string, password []byte) bool {
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	}
+	parsed, parseErr := parseArgon2Hash(hash)
+	if parseErr != nil {
+		return false
+	}
+	keyLength := uint32(len(parsed.key))
+	var key []byte
+	if parsed.variant == "argon2id" {
+		key = argon2.IDKey(password, parsed.salt, parsed.time, parsed.memory, parsed.parallelism, keyLength)
+	} else {
+		key = argon2.Key(password, parsed.salt, parsed.time, parsed.memory, parsed.parallelism, keyLength)
+	}
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+// validateLegacyUsers checks every user of an import, so that nothing is written when one is invalid
+func validateLegacyUsers(users []LegacyUser) error {
+	var v validate.Validator
+	seen := make(map[string]bool, len(users))
+	for i, user := range users {
+		field := fmt.Sprintf("users[%d]", i)
+		v.UserID(field+".user_name", user.UserName)
+		if seen[user.UserName] {
+			v.Fail(field+".user_name", "duplicates an earlier user")
+		}
+		seen[user.UserName] = true
+		if user.Tenant != "" {
+			v.Text(field+".tenant", user.Tenant, maxTenantLength)
+		}
+		if v.Required(field+".password_hash", user.PasswordHash) && v.MaxLength(field+".password_hash", len(user.PasswordHash), maxLegacyHashLength) {
+			if hashErr := checkLegacyHash(user.PasswordHash); hashErr != nil {
+				v.Fail(field+".password_hash", "%v", hashErr)
+			}
+		}
+	}
+	return v.Err()
+}
+
+// importLegacyUsers validates an import and, unless dryRun is set, stores each user not already
+// registered as pending, with their legacy hash in place of a commitment
+func importLegacyUsers(ctx context.Context, userStore store.Store, users []LegacyUser, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Total: len(users)}
+	if validateErr := validateLegacyUsers(users); validateErr != nil {
+		return report, validateErr
+	}
+
+	now := time.Now().UTC()
+	for _, user := range users {
+		var storeErr error
+		if dryRun {
+			if _, storeErr = userStore.GetUser(ctx, user.UserName); storeErr == nil {
+				storeErr = store.ErrUserExists
+			} else if errors.Is(storeErr, store.ErrUserNotFound) {
+				storeErr = nil
+			}
+		} else {
+			storeErr = userStore.CreateUser(ctx, store.User{
+				UserName:  user.UserName,
+				Tenant:    user.Tenant,
+				CreatedAt: now,
+				Legacy:    &store.LegacyPassword{Hash: user.PasswordHash, ImportedAt: now},
+			})
+		}
+		switch {
+		case storeErr == nil:
+			report.Imported++
+		case errors.Is(storeErr, store.ErrUserExists):
+			report.Existing++
+		case errors.Is(storeErr, store.ErrNoDirectoryEntry):
+			report.Unmatched++
+		default:
+			return report, fmt.Errorf("importing %q: %w", user.UserName, storeErr)
+		}
+	}
+	return report, nil
+}
+
+// importHandler imports users with legacy password hashes; ?dry_run=true only counts what the
+// import would do. A tenant-admin imports into its own tenant only.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	var req ImportRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBatchBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if len(req.Users) == 0 {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "Missing users")
+		return
+	}
+	if len(req.Users) > s.cfg.MaxBatchSize {
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("An import holds at most %d users", s.cfg.MaxBatchSize))
+		return
+	}
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		for i := range req.Users {
+			if req.Users[i].Tenant == "" {
+				req.Users[i].Tenant = p.tenant
+			}
+			if !p.managesTenant(req.Users[i].Tenant) {
+				writeProblem(w, http.StatusForbidden, codePermissionDenied, fmt.Sprintf("A %s of tenant %q may not import users of tenant %q", RoleTenantAdmin, p.tenant, req.Users[i].Tenant))
+				return
+			}
+		}
+	}
+
+	report, importErr := importLegacyUsers(r.Context(), s.store, req.Users, r.URL.Query().Get("dry_run") == "true")
+	var fieldErrs validate.Errors
+	if errors.As(importErr, &fieldErrs) {
+		writeRequestError(w, importErr)
+		return
+	}
+	if importErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error importing users: %v", importErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, report)
+}
+
+// authenticateLegacy checks the password of a migration against the user's legacy hash and
+// returns the pending user. Unknown and migrated users fail as ErrLegacyPasswordInvalid after
+// the same kind of check, against a decoy hash, unless user existence may be revealed.
+func (s *Server) authenticateLegacy(ctx context.Context, userName, password string) (_ store.User, authErr error) {
+	var tenant string
+	defer func() {
+		// A wrong password counts as a failed login for anomaly detection and /v1/stats
+		loginErr := authErr
+		if errors.Is(authErr, ErrLegacyPasswordInvalid) {
+			loginErr = ErrInvalidProof
+		}
+		s.recordLogin(ctx, userName, tenant, 0, loginErr)
+	}()
+	if !s.cfg.RevealUserExistence {
+		started := time.Now()
+		defer func() {
+			if authErr != nil {
+				s.padLatency(ctx, started)
+			}
+		}()
+	}
+	user, getErr := s.getUser(ctx, userName)
+	switch {
+	case getErr != nil && !errors.Is(getErr, store.ErrUserNotFound):
+		return store.User{}, getErr
+	case getErr != nil && s.cfg.RevealUserExistence:
+		return store.User{}, errors.Join(ErrLegacyPasswordInvalid, errUnknownUser)
+	case getErr == nil && !user.Pending() && s.cfg.RevealUserExistence:
+		return store.User{}, ErrMigrationNotPending
+	}
+	hash := decoyLegacyHash
+	if user.Pending() {
+		tenant, hash = user.Tenant, user.Legacy.Hash
+	}
+	if !matchLegacyPassword(hash, []byte(password)) || !user.Pending() {
+		return store.User{}, ErrLegacyPasswordInvalid
+	}
+	return user, nil
+}
+
+// writeMigrationError answers a failed migration
+func writeMigrationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownUser):
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+	case errors.Is(err, ErrLegacyPasswordInvalid):
+		writeProblem(w, http.StatusUnauthorized, codeLegacyPasswordInvalid, "Wrong password, or no imported password to migrate from")
+	case errors.Is(err, ErrMigrationNotPending):
+		writeProblem(w, http.StatusConflict, codeMigrationNotPending, "The user has a commitment already; log in with a proof")
+	default:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error migrating user: %v", err))
+	}
+}
+
+// migrateHandler completes the migration of an imported user on their first login: the password
+// is checked against the legacy hash once, the commitment the client generated replaces it, and
+// the user is logged in. From then on the user logs in with proofs only.
+func (s *Server) migrateHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	var req MigrateRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	registration := req.registration(userName)
+	if validateErr := req.validate(registration); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	if curveErr := s.checkCurve(registration.Curve, registration.Tenant); curveErr != nil {
+		writeRequestError(w, curveErr)
+		return
+	}
+	if kdfErr := s.checkKDF(&registration); kdfErr != nil {
+		writeRequestError(w, kdfErr)
+		return
+	}
+	if duplicateErr := s.checkDuplicate(r.Context(), registration); duplicateErr != nil {
+		writeRequestError(w, duplicateErr)
+		return
+	}
+	if didErr := s.checkDID(r.Context(), &registration); didErr != nil {
+		writeRequestError(w, didErr)
+		return
+	}
+	if policyErr := s.checkSecretPolicy(r.Context(), registration.CryptoCommitment, registration.PolicyProof); policyErr != nil {
+		s.writePolicyError(w, policyErr)
+		return
+	}
+
+	proven, authErr := s.authenticateLegacy(r.Context(), userName, req.Password)
+	if authErr != nil {
+		writeMigrationError(w, authErr)
+		return
+	}
+
+	// The user is reread under the edit lock so two migrations with the same password can't both
+	// store their commitment: the second finds the legacy hash retired
+	s.devicesMu.Lock()
+	user, getErr := s.getUser(r.Context(), userName)
+	if getErr != nil || !user.Pending() || user.Legacy.Hash != proven.Legacy.Hash {
+		s.devicesMu.Unlock()
+		writeMigrationError(w, ErrLegacyPasswordInvalid)
+		return
+	}
+	migrated := s.newUser(registration)
+	migrated.Tenant, migrated.ExpiresAt = user.Tenant, user.ExpiresAt
+	putErr := s.store.PutUser(r.Context(), migrated)
+	s.devicesMu.Unlock()
+	if putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing user: %v", putErr))
+		return
+	}
+	s.recordRegistration(r.Context(), migrated)
+	logf(r.Context(), "Migrated imported user %q to a commitment", userName)
+
+	response := MigrateResponse{StatusResponse: StatusResponse{Status: "User migrated", KeyID: migrated.KeyID}}
+	// Without a proof to check, the session token is left for a proof login to issue when TOTP is
+	// required, or an authentication policy refuses the login
+	version, lookupErr := s.keyring.lookup(migrated.KeyID)
+	if s.cfg.TOTP.policy(migrated.Tenant) != totpRequired && lookupErr == nil && s.checkAuthPolicy(r.Context(), ProofRequest{UserName: userName}, migrated, version) == nil {
+		token, tokenErr := s.issueSessionToken(r.Context(), userName, migrated.KeyID)
+		if tokenErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, "Error signing session token")
+			return
+		}
+		response.SessionToken, response.ExpiresIn = token, int64(s.cfg.SessionTTL.Duration/time.Second)
+	}
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// readLegacyUsers reads the users of an import, as CSV with a header row naming the user_name,
+// password_hash and optional tenant columns, or as JSON Lines of LegacyUser objects
+func readLegacyUsers(in io.Reader, format string) ([]LegacyUser, error) {
+	var users []LegacyUser
+	switch format {
+	case "jsonl":
+		decoder := json.NewDecoder(in)
+		decoder.DisallowUnknownFields()
+		for line := 1; ; line++ {
+			var user LegacyUser
+			decodeErr := decoder.Decode(&user)
+			if errors.Is(decodeErr, io.EOF) {
+				return users, nil
+			}
+			if decodeErr != nil {
+				return nil, fmt.Errorf("decoding user %d: %w", line, decodeErr)
+			}
+			users = append(users, user)
+		}
+	case "csv":
+		records, readErr := csv.NewReader(in).ReadAll()
+		if readErr != nil {
+			return nil, readErr
+		}
+		if len(records) == 0 {
+			return nil, errors.New("missing the header row")
+		}
+		userName, hash, tenant := slices.Index(records[0], "user_name"), slices.Index(records[0], "password_hash"), slices.Index(records[0], "tenant")
+		if userName < 0 || hash < 0 {
+			return nil, errors.New("the header row must name the user_name and password_hash columns")
+		}
+		for _, record := range records[1:] {
+			user := LegacyUser{UserName: record[userName], PasswordHash: record[hash]}
+			if tenant >= 0 {
+				user.Tenant = record[tenant]
+			}
+			users = append(users, user)
+		}
+		return users, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (want csv or jsonl)", format)
+	}
+}
+
+// runImportCommand implements the "import" subcommand, importing a user table with legacy password
+// hashes into the configured store
+func runImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the JSON configuration file")
+	databasePath := flags.String("db", "", "SQLite database to import into (overrides the config)")
+	inPath := flags.String("in", "-", "user table to read, - for stdin")
+	format := flags.String("format", "csv", "format of the user table: csv or jsonl")
+	dryRun := flags.Bool("dry-run", false, "validate the user table without writing anything")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *inPath != "-" {
+		file, openErr := os.Open(*inPath)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		in = file
+	}
+	users, readErr := readLegacyUsers(in, *format)
+	if readErr != nil {
+		return fmt.Errorf("reading users: %w", readErr)
+	}
+
+	userStore, _, openErr := openConfiguredStore(*configPath, *databasePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer userStore.Close()
+
+	report, importErr := importLegacyUsers(context.Background(), userStore, users, *dryRun)
+	if importErr != nil {
+		return importErr
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
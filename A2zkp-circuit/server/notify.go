@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// The security notices users get about their own accounts
+const (
+	noticeDeviceAdded       = "device.added"       // a device was added to the account
+	noticeAccountLocked     = "account.locked"     // failed logins to the account were flagged as brute force
+	noticeCommitmentRotated = "commitment.rotated" // the account's commitment was replaced
+)
+
+// noticeTypes are the notices channels may subscribe to
+var noticeTypes = []string{noticeDeviceAdded, noticeAccountLocked, noticeCommitmentRotated}
+
+// notifyAttempts is how often a notice is tried on a channel before it is given up
+const notifyAttempts = 3
+
+// notifyTimeout bounds each attempt at delivering a notice
+const notifyTimeout = 10 * time.Second
+
+// SecurityNotice is an event on a user's account the user is told about. Templates render it, and
+// http channels post it as "notice".
+type SecurityNotice struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"` // Type is e.g. "device.added"
+	Time     time.Time `json:"time"`
+	UserName string    `json:"user_name"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Device   string    `json:"device,omitempty"` // Device is the label of the device added
+	// Failures counts the failed logins behind a lockout, and ClientAddrs are where they came from
+	Failures    int      `json:"failures,omitempty"`
+	ClientAddrs []string `json:"client_addrs,omitempty"`
+	Via         string   `json:"via,omitempty"` // Via is how a commitment was rotated: "recovery" or "scim"
+	RequestID   string   `json:"request_id,omitempty"`
+}
+
+// PushNotification is the JSON body http channels post
+type PushNotification struct {
+	To      string         `json:"to"` // To is the rendered recipient, the user name unless the channel sets one
+	Subject string         `json:"subject"`
+	Body    string         `json:"body"`
+	Notice  SecurityNotice `json:"notice"`
+}
+
+// defaultNoticeTemplates word the notices channels don't override
+var defaultNoticeTemplates = map[string]NotificationTemplate{
+	noticeDeviceAdded: {
+		Subject: "New device added to your account",
+		Body: "The device {{printf \"%q\" .Device}} was added to your account {{.UserName}} at {{.Time.Format \"2006-01-02 15:04 MST\"}}.\n\n" +
+			"If this wasn't you, revoke the device and contact your administrator.\n",
+	},
+	noticeAccountLocked: {
+		Subject: "Repeated failed logins to your account",
+		Body: "{{.Failures}} logins to your account {{.UserName}} failed, the last at {{.Time.Format \"2006-01-02 15:04 MST\"}}, " +
+			"so further attempts are being watched.\n\nIf these weren't you, someone may be guessing your secret.\n",
+	},
+	noticeCommitmentRotated: {
+		Subject: "Your account's credential was replaced",
+		Body: "The credential of your account {{.UserName}} was replaced through {{.Via}} at {{.Time.Format \"2006-01-02 15:04 MST\"}}; " +
+			"devices using the old one must log in again.\n\nIf this wasn't you, contact your administrator.\n",
+	},
+}
+
+// notifier delivers a rendered notice over one channel
+type notifier interface {
+	notify(ctx context.Context, message PushNotification) error
+	String() string
+}
+
+// noticeTemplates are the parsed subject and body of one notice type
+type noticeTemplates struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// noticeChannel is a notifier with the notices it is subscribed to and the templates it renders them with
+type noticeChannel struct {
+	notifier  notifier
+	events    []string
+	to        *template.Template // to renders the recipient; nil for http channels without one
+	templates map[string]noticeTemplates
+}
+
+// securityNotices alerts users to security events on their accounts over the channels of their tenant
+type securityNotices struct {
+	channels []noticeChannel            // channels serve tenants without channels of their own
+	tenants  map[string][]noticeChannel // tenants holds the channels of tenants that have their own, "" naming the default one
+	retry    time.Duration              // retry is the pause before the second attempt, doubled before each further one
+}
+
+// newSecurityNotices checks and parses the notification channels; it returns nil when there are none
+func newSecurityNotices(cfg NotificationsConfig) (*securityNotices, error) {
+	if len(cfg.Channels) == 0 && len(cfg.Tenants) == 0 {
+		return nil, nil
+	}
+	channels, channelsErr := newNoticeChannels(cfg.Channels)
+	if channelsErr != nil {
+		return nil, fmt.Errorf("notifications: %w", channelsErr)
+	}
+	n := &securityNotices{channels: channels, tenants: make(map[string][]noticeChannel, len(cfg.Tenants)), retry: time.Second}
+	for tenant, configs := range cfg.Tenants {
+		tenantChannels, tenantErr := newNoticeChannels(configs)
+		if tenantErr != nil {
+			return nil, fmt.Errorf("notifications of tenant %q: %w", tenant, tenantErr)
+		}
+		if tenant == "-" {
+			tenant = ""
+		}
+		n.tenants[tenant] = tenantChannels
+	}
+	return n, nil
+}
+
+// newNoticeChannels checks and parses a list of channels
+func newNoticeChannels(configs []NotificationChannel) ([]noticeChannel, error) {
+	channels := make([]noticeChannel, 0, len(configs))
+	for i, cfg := range configs {
+		channel, channelErr := newNoticeChannel(cfg)
+		if channelErr != nil {
+			return nil, fmt.Errorf("channel %d: %w", i, channelErr)
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// newNoticeChannel checks one channel's settings and parses its templates
+func newNoticeChannel(cfg NotificationChannel) (noticeChannel, error) {
+	for _, event := range cfg.Events {
+		if !slices.Contains(noticeTypes, event) {
+			return noticeChannel{}, fmt.Errorf("unknown event %q, want one of %s", event, strings.Join(noticeTypes, ", "))
+		}
+	}
+	channel := noticeChannel{events: cfg.Events, templates: make(map[string]noticeTemplates, len(noticeTypes))}
+	switch cfg.Type {
+	case "email":
+		if cfg.SMTPAddr == "" || cfg.To == "" {
+			return noticeChannel{}, errors.New("email channels need smtp_addr and to")
+		}
+		host, _, splitErr := net.SplitHostPort(cfg.SMTPAddr)
+		if splitErr != nil {
+			return noticeChannel{}, fmt.Errorf("smtp_addr: %w", splitErr)
+		}
+		from, fromErr := mail.ParseAddress(cfg.From)
+		if fromErr != nil {
+			return noticeChannel{}, fmt.Errorf("from %q: %w", cfg.From, fromErr)
+		}
+		channel.notifier = &emailNotifier{cfg: cfg, host: host, from: from}
+	case "http":
+		parsed, parseErr := url.Parse(cfg.URL)
+		if parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return noticeChannel{}, fmt.Errorf("url %q must be an absolute http or https URL", cfg.URL)
+		}
+		channel.notifier = &pushNotifier{cfg: cfg, client: &http.Client{Timeout: notifyTimeout}}
+	default:
+		return noticeChannel{}, fmt.Errorf("unknown type %q, want email or http", cfg.Type)
+	}
+	if cfg.To != "" {
+		to, toErr := template.New("to").Option("missingkey=error").Parse(cfg.To)
+		if toErr != nil {
+			return noticeChannel{}, fmt.Errorf("to: %w", toErr)
+		}
+		channel.to = to
+	}
+	for event, override := range cfg.Templates {
+		if !slices.Contains(noticeTypes, event) {
+			return noticeChannel{}, fmt.Errorf("template for unknown event %q", event)
+		}
+		if override.Subject == "" && override.Body == "" {
+			return noticeChannel{}, fmt.Errorf("template for %s sets neither subject nor body", event)
+		}
+	}
+	for _, event := range noticeTypes {
+		wording := defaultNoticeTemplates[event]
+		if override, overridden := cfg.Templates[event]; overridden {
+			wording.Subject = cmp.Or(override.Subject, wording.Subject)
+			wording.Body = cmp.Or(override.Body, wording.Body)
+		}
+		subject, subjectErr := template.New(event + " subject").Parse(wording.Subject)
+		if subjectErr != nil {
+			return noticeChannel{}, fmt.Errorf("subject of %s: %w", event, subjectErr)
+		}
+		body, bodyErr := template.New(event + " body").Parse(wording.Body)
+		if bodyErr != nil {
+			return noticeChannel{}, fmt.Errorf("body of %s: %w", event, bodyErr)
+		}
+		channel.templates[event] = noticeTemplates{subject: subject, body: body}
+	}
+	return channel, nil
+}
+
+// send alerts the user a notice is about over their tenant's channels without waiting for the
+// deliveries; a nil receiver drops it
+func (n *securityNotices) send(ctx context.Context, notice SecurityNotice) {
+	if n == nil {
+		return
+	}
+	channels, own := n.tenants[notice.Tenant]
+	if !own {
+		channels = n.channels
+	}
+	noticeID, idErr := randomToken()
+	if idErr != nil {
+		logf(ctx, "Dropping %s notice to %q: %v", notice.Type, notice.UserName, idErr)
+		return
+	}
+	notice.ID, notice.RequestID = noticeID, requestID(ctx)
+	if notice.Time.IsZero() {
+		notice.Time = time.Now().UTC()
+	}
+	for _, channel := range channels {
+		if len(channel.events) > 0 && !slices.Contains(channel.events, notice.Type) {
+			continue
+		}
+		message, renderErr := channel.render(notice)
+		if renderErr != nil {
+			logf(ctx, "Dropping %s notice to %q on %s: %v", notice.Type, notice.UserName, channel.notifier, renderErr)
+			continue
+		}
+		// The delivery outlives the request, so it only keeps the request's ID
+		go n.deliver(context.WithValue(context.Background(), requestIDKey{}, notice.RequestID), channel.notifier, message)
+	}
+}
+
+// render fills in a channel's templates for notice
+func (c noticeChannel) render(notice SecurityNotice) (PushNotification, error) {
+	message := PushNotification{To: notice.UserName, Notice: notice}
+	var rendered bytes.Buffer
+	if c.to != nil {
+		if toErr := c.to.Execute(&rendered, notice); toErr != nil {
+			return PushNotification{}, toErr
+		}
+		message.To = strings.TrimSpace(rendered.String())
+	}
+	templates := c.templates[notice.Type]
+	rendered.Reset()
+	if subjectErr := templates.subject.Execute(&rendered, notice); subjectErr != nil {
+		return PushNotification{}, subjectErr
+	}
+	// A subject is one header line
+	message.Subject = strings.Join(strings.Fields(rendered.String()), " ")
+	rendered.Reset()
+	if bodyErr := templates.body.Execute(&rendered, notice); bodyErr != nil {
+		return PushNotification{}, bodyErr
+	}
+	message.Body = rendered.String()
+	return message, nil
+}
+
+// deliver sends message over one channel, retrying failures with a growing pause
+func (n *securityNotices) deliver(ctx context.Context, channel notifier, message PushNotification) {
+	pause := n.retry
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		deliveryErr := channel.notify(attemptCtx, message)
+		cancel()
+		if deliveryErr == nil {
+			return
+		}
+		var permanent permanentNoticeError
+		if errors.As(deliveryErr, &permanent) || attempt == notifyAttempts {
+			logf(ctx, "Giving up notifying %q of %s on %s: %v", message.Notice.UserName, message.Notice.Type, channel, deliveryErr)
+			return
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// permanentNoticeError is a delivery failure retrying won't change, such as a rejected recipient
+type permanentNoticeError struct {
+	err error
+}
+
+func (e permanentNoticeError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentNoticeError) Unwrap() error {
+	return e.err
+}
+
+// emailNotifier mails notices through an SMTP server
+type emailNotifier struct {
+	cfg  NotificationChannel
+	host string
+	from *mail.Address
+}
+
+func (n *emailNotifier) String() string {
+	return "email via " + n.cfg.SMTPAddr
+}
+
+func (n *emailNotifier) notify(ctx context.Context, message PushNotification) error {
+	to, toErr := mail.ParseAddress(message.To)
+	if toErr != nil {
+		return permanentNoticeError{fmt.Errorf("recipient %q: %w", message.To, toErr)}
+	}
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	var conn net.Conn
+	var dialErr error
+	if n.cfg.SMTPTLS {
+		conn, dialErr = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: n.host}}).DialContext(ctx, "tcp", n.cfg.SMTPAddr)
+	} else {
+		conn, dialErr = dialer.DialContext(ctx, "tcp", n.cfg.SMTPAddr)
+	}
+	if dialErr != nil {
+		return dialErr
+	}
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	client, clientErr := smtp.NewClient(conn, n.host)
+	if clientErr != nil {
+		conn.Close()
+		return clientErr
+	}
+	defer client.Close()
+	if offered, _ := client.Extension("STARTTLS"); offered && !n.cfg.SMTPTLS {
+		if tlsErr := client.StartTLS(&tls.Config{ServerName: n.host}); tlsErr != nil {
+			return tlsErr
+		}
+	}
+	if n.cfg.SMTPUsername != "" {
+		// PlainAuth refuses to send the password unencrypted to anything but localhost
+		if authErr := client.Auth(smtp.PlainAuth("", n.cfg.SMTPUsername, n.cfg.SMTPPassword, n.host)); authErr != nil {
+			return permanentNoticeError{authErr}
+		}
+	}
+	if mailErr := client.Mail(n.from.Address); mailErr != nil {
+		return mailErr
+	}
+	if rcptErr := client.Rcpt(to.Address); rcptErr != nil {
+		return permanentNoticeError{rcptErr}
+	}
+	data, dataErr := client.Data()
+	if dataErr != nil {
+		return dataErr
+	}
+	if _, writeErr := data.Write(n.compose(to, message)); writeErr != nil {
+		return writeErr
+	}
+	if closeErr := data.Close(); closeErr != nil {
+		return closeErr
+	}
+	return client.Quit()
+}
+
+// compose writes message as a quoted-printable plain-text mail
+func (n *emailNotifier) compose(to *mail.Address, message PushNotification) []byte {
+	var mailBody bytes.Buffer
+	header := func(name, value string) {
+		mailBody.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", n.from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header("Date", message.Notice.Time.Format(time.RFC1123Z))
+	header("Message-ID", "<"+message.Notice.ID+"@"+n.host+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	header("X-OFA-Notice", message.Notice.Type)
+	mailBody.WriteString("\r\n")
+	encoder := quotedprintable.NewWriter(&mailBody)
+	encoder.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n")))
+	encoder.Close()
+	return mailBody.Bytes()
+}
+
+// pushNotifier posts notices as JSON to an HTTP endpoint, e.g. a gateway to mobile push services
+type pushNotifier struct {
+	cfg    NotificationChannel
+	client *http.Client
+}
+
+func (n *pushNotifier) String() string {
+	return "http to " + n.cfg.URL
+}
+
+func (n *pushNotifier) notify(ctx context.Context, message PushNotification) error {
+	body, encodeErr := json.Marshal(message)
+	if encodeErr != nil {
+		return permanentNoticeError{encodeErr}
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if reqErr != nil {
+		return permanentNoticeError{reqErr}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-OFA-Notice", message.Notice.Type)
+	forwardRequestID(req)
+	if n.cfg.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(n.cfg.Secret, body))
+	}
+	resp, postErr := n.client.Do(req)
+	if postErr != nil {
+		return postErr
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("push endpoint answered %s", resp.Status)
+	case resp.StatusCode >= 400:
+		return permanentNoticeError{fmt.Errorf("push endpoint answered %s", resp.Status)}
+	}
+	return nil
+}
+
+// notifyLockout tells the user a brute_force anomaly targets that their account is under attack;
+// anomalies against unknown user names tell nobody
+func (s *Server) notifyLockout(ctx context.Context, anomaly Anomaly) {
+	if s.notices == nil || anomaly.Kind != "brute_force" || anomaly.UserName == "" {
+		return
+	}
+	user, getErr := s.store.GetUser(ctx, anomaly.UserName)
+	if getErr != nil {
+		if !errors.Is(getErr, store.ErrUserNotFound) {
+			logf(ctx, "Error looking up %q to notify of a lockout: %v", anomaly.UserName, getErr)
+		}
+		return
+	}
+	s.notices.send(ctx, SecurityNotice{
+		Type: noticeAccountLocked, Time: anomaly.DetectedAt, UserName: user.UserName, Tenant: user.Tenant,
+		Failures: anomaly.Failures, ClientAddrs: anomaly.ClientAddrs,
+	})
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// proofGrantType is the extension grant whose credential is a proof of knowledge of the user's secret
+const proofGrantType = "urn:ofa:params:oauth:grant-type:zk-proof"
+
+// allowsScope reports whether every scope in a space-separated list may be granted to the client.
+// openid and offline_access are always allowed; anything else must be listed in the client's scopes.
+func (c *OIDCClient) allowsScope(scope string) bool {
+	for _, requested := range strings.Fields(scope) {
+		if requested != "openid" && requested != "offline_access" && !slices.Contains(c.Scopes, requested) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenGrant is who, for which client and with which scope a set of tokens is issued
+type tokenGrant struct {
+	userName string
+	clientID string
+	scope    string
+	family   string // family links a refresh token to every token rotated from it, and is the sid of the access tokens
+	// rotates is the hash of the refresh token the grant was redeemed with; the new refresh token replaces it
+	rotates         string
+	familyExpiresAt time.Time // familyExpiresAt is when the family ends; zero when it has no end
+}
+
+// writeTokens signs an access token for grant, adds a refresh token when asked and answers the token request
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, grant tokenGrant, idToken string, withRefresh bool) {
+	now := time.Now()
+	ttl := s.cfg.OIDC.TokenTTL.Duration
+	tokenID, idErr := randomToken()
+	if idErr == nil && grant.family == "" {
+		grant.family, idErr = randomToken()
+	}
+	if idErr != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing tokens")
+		return
+	}
+	accessToken, accessErr := s.tokens.sign("at+jwt", AccessTokenClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    s.cfg.OIDC.issuer(),
+			Subject:   grant.userName,
+			Audience:  grant.clientID,
+			ExpiresAt: now.Add(ttl).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		ClientID:  grant.clientID,
+		Scope:     grant.scope,
+		SessionID: grant.family,
+		JWTID:     tokenID,
+	})
+	if accessErr != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing tokens")
+		return
+	}
+	response := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ttl / time.Second),
+		IDToken:     idToken,
+		Scope:       grant.scope,
+	}
+	if withRefresh {
+		var refreshErr error
+		response.RefreshToken, refreshErr = s.refresh.issue(r.Context(), grant)
+		switch {
+		case errors.Is(refreshErr, ErrRefreshTokenReused) || errors.Is(refreshErr, ErrRefreshTokenNotFound):
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", refreshErr.Error())
+			return
+		case refreshErr != nil:
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error issuing refresh token")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// redeemProof implements the zk-proof grant: the client submits the user's proof, bound to a
+// challenge from /v1/challenges, in place of a password
+func (s *Server) redeemProof(w http.ResponseWriter, r *http.Request, client *OIDCClient) {
+	// Without a requested scope the client gets every scope it is registered for
+	scope := r.PostForm.Get("scope")
+	if scope == "" {
+		scope = strings.Join(client.Scopes, " ")
+	}
+	if !client.allowsScope(scope) || slices.Contains(strings.Fields(scope), "openid") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope is not allowed for this client")
+		return
+	}
+
+	var v validate.Validator
+	proof := v.Base64("proof", r.PostForm.Get("proof"), maxProofLength)
+	if proofErr := v.Err(); proofErr != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", proofErr.Error())
+		return
+	}
+	assertion, assertionErr := formAssertion(r.PostForm.Get("webauthn"))
+	if assertionErr != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", assertionErr.Error())
+		return
+	}
+	proofReq := ProofRequest{
+		UserName:         r.PostForm.Get("user_name"),
+		Nonce:            r.PostForm.Get("nonce"),
+		Proof:            proof,
+		KeyID:            r.PostForm.Get("key_id"),
+		TOTPCode:         r.PostForm.Get("totp_code"),
+		WebAuthn:         assertion,
+		CryptoCommitment: r.PostForm.Get("crypto_commitment"),
+	}
+	nonce, validateErr := proofReq.validate()
+	if validateErr != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", validateErr.Error())
+		return
+	}
+	user, _, authErr := s.authenticate(r.Context(), proofReq, nonce)
+	if authErr != nil {
+		status, _, message := authFailure(proofReq, authErr)
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", retryAfterSeconds(s.cfg.PoolRetryAfter.Duration))
+			writeOAuthError(w, status, "temporarily_unavailable", message)
+			return
+		}
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", message)
+		return
+	}
+
+	s.writeTokens(w, r, tokenGrant{userName: user.UserName, clientID: client.ClientID, scope: scope}, "", true)
+}
+
+// redeemRefreshToken implements the refresh_token grant. Refresh tokens are single use: each
+// redemption rotates the token into a new one, and presenting a rotated token revokes its whole
+// family. The token is only rotated once the request is known to be valid, so asking for a scope
+// that was not granted doesn't use it up.
+func (s *Server) redeemRefreshToken(w http.ResponseWriter, r *http.Request, client *OIDCClient) {
+	grant, redeemErr := s.refresh.redeem(r.Context(), r.PostForm.Get("refresh_token"), client.ClientID)
+	switch {
+	case errors.Is(redeemErr, ErrRefreshTokenReused) || errors.Is(redeemErr, ErrRefreshTokenNotFound):
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", redeemErr.Error())
+		return
+	case redeemErr != nil:
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error loading refresh token")
+		return
+	}
+	// A refresh may narrow the scope but never widen it
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		granted := strings.Fields(grant.scope)
+		for _, scope := range strings.Fields(requested) {
+			if !slices.Contains(granted, scope) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %q was not granted", scope))
+				return
+			}
+		}
+		grant.scope = requested
+	}
+	if _, stillRegistered := s.cfg.OIDC.client(grant.clientID); !stillRegistered {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Client is no longer registered")
+		return
+	}
+	s.writeTokens(w, r, grant, "", true)
+}
+
+// ErrRefreshTokenNotFound is returned for refresh tokens that were never issued, have expired or belong to another client
+var ErrRefreshTokenNotFound = errors.New("unknown or expired refresh token")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already redeemed is presented again
+var ErrRefreshTokenReused = errors.New("refresh token was already used; its family has been revoked")
+
+// refreshStore issues and redeems refresh tokens. They are persisted in the user store by hash,
+// so neither a memory dump nor a copy of the database reveals usable tokens, and survive restarts.
+type refreshStore struct {
+	store     store.Store
+	ttl       time.Duration // ttl is how long each token can be redeemed
+	familyTTL time.Duration // familyTTL is how long a family lasts from its first token; 0 for no limit
+}
+
+// newRefreshStore creates a store whose tokens stay valid for ttl, in families ending familyTTL
+// after they start
+func newRefreshStore(userStore store.Store, ttl, familyTTL time.Duration) *refreshStore {
+	return &refreshStore{store: userStore, ttl: ttl, familyTTL: familyTTL}
+}
+
+// issue creates a refresh token for grant. A grant redeemed from a refresh token rotates that token
+// into the new one, within its family; any other grant starts a new family, named grant.family when set.
+func (s *refreshStore) issue(ctx context.Context, grant tokenGrant) (string, error) {
+	token, randErr := randomToken()
+	if randErr != nil {
+		return "", randErr
+	}
+	now := time.Now()
+	issued := store.RefreshToken{
+		Hash:            refreshTokenHash(token),
+		Family:          grant.family,
+		UserName:        grant.userName,
+		ClientID:        grant.clientID,
+		Scope:           grant.scope,
+		IssuedAt:        now,
+		ExpiresAt:       now.Add(s.ttl),
+		FamilyExpiresAt: grant.familyExpiresAt,
+	}
+	if grant.rotates == "" {
+		if issued.Family == "" {
+			if issued.Family, randErr = randomToken(); randErr != nil {
+				return "", randErr
+			}
+		}
+		if s.familyTTL > 0 {
+			issued.FamilyExpiresAt = now.Add(s.familyTTL)
+		}
+	}
+	if !issued.FamilyExpiresAt.IsZero() && issued.FamilyExpiresAt.Before(issued.ExpiresAt) {
+		issued.ExpiresAt = issued.FamilyExpiresAt
+	}
+
+	// Expired tokens are dropped whenever one is issued
+	if _, pruneErr := s.store.PruneRefreshTokens(ctx, now); pruneErr != nil {
+		return "", pruneErr
+	}
+	if grant.rotates == "" {
+		if putErr := s.store.PutRefreshToken(ctx, issued); putErr != nil {
+			return "", putErr
+		}
+		return token, nil
+	}
+	rotateErr := s.store.RotateRefreshToken(ctx, grant.rotates, issued)
+	switch {
+	case errors.Is(rotateErr, store.ErrRefreshTokenRotated):
+		// Another request redeemed the same token in the meantime
+		return "", errors.Join(ErrRefreshTokenReused, s.store.RevokeRefreshFamily(ctx, grant.family))
+	case errors.Is(rotateErr, store.ErrRefreshTokenNotFound):
+		return "", ErrRefreshTokenNotFound
+	case rotateErr != nil:
+		return "", rotateErr
+	}
+	return token, nil
+}
+
+// redeem looks up a refresh token issued to clientID and returns its grant, which rotates the token
+// when tokens are issued for it. Presenting a token that was rotated already revokes its family.
+func (s *refreshStore) redeem(ctx context.Context, token, clientID string) (tokenGrant, error) {
+	hash := refreshTokenHash(token)
+	stored, getErr := s.store.GetRefreshToken(ctx, hash)
+	switch {
+	case errors.Is(getErr, store.ErrRefreshTokenNotFound):
+		return tokenGrant{}, ErrRefreshTokenNotFound
+	case getErr != nil:
+		return tokenGrant{}, getErr
+	case stored.RotatedAt != nil:
+		return tokenGrant{}, errors.Join(ErrRefreshTokenReused, s.store.RevokeRefreshFamily(ctx, stored.Family))
+	case stored.ClientID != clientID || !time.Now().Before(stored.ExpiresAt):
+		return tokenGrant{}, ErrRefreshTokenNotFound
+	}
+	return tokenGrant{
+		userName:        stored.UserName,
+		clientID:        stored.ClientID,
+		scope:           stored.Scope,
+		family:          stored.Family,
+		rotates:         hash,
+		familyExpiresAt: stored.FamilyExpiresAt,
+	}, nil
+}
+
+// forgetUser deletes every refresh token issued to userName, rotated ones included, and returns their hashes
+func (s *refreshStore) forgetUser(ctx context.Context, userName string) ([]string, error) {
+	return s.store.DeleteUserRefreshTokens(ctx, userName)
+}
+
+// refreshTokenHash is the key a refresh token is stored under
+func refreshTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
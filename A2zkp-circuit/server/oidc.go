@@ -0,0 +1,708 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/validate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// validate checks the issuer URL and every registered client
+func (c OIDCConfig) validate() error {
+	if c.Issuer == "" {
+		return nil
+	}
+	issuer, parseErr := url.Parse(c.Issuer)
+	if parseErr != nil || issuer.Host == "" || issuer.RawQuery != "" || issuer.Fragment != "" {
+		return fmt.Errorf("oidc issuer %q must be an absolute URL without query or fragment", c.Issuer)
+	}
+	loopback := issuer.Hostname() == "localhost" || issuer.Hostname() == "127.0.0.1" || issuer.Hostname() == "::1"
+	if issuer.Scheme != "https" && !(issuer.Scheme == "http" && loopback) {
+		return fmt.Errorf("oidc issuer %q must use https", c.Issuer)
+	}
+	seen := make(map[string]bool)
+	for _, client := range c.Clients {
+		if client.ClientID == "" || seen[client.ClientID] {
+			return fmt.Errorf("oidc client_id %q is empty or duplicated", client.ClientID)
+		}
+		seen[client.ClientID] = true
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("oidc client %q has no redirect_uris", client.ClientID)
+		}
+	}
+	return nil
+}
+
+// issuer returns the configured issuer without a trailing slash, so endpoint URLs can be appended to it
+func (c OIDCConfig) issuer() string {
+	return strings.TrimSuffix(c.Issuer, "/")
+}
+
+// client returns the registered client with the given ID
+func (c OIDCConfig) client(clientID string) (*OIDCClient, bool) {
+	for i := range c.Clients {
+		if c.Clients[i].ClientID == clientID {
+			return &c.Clients[i], true
+		}
+	}
+	return nil, false
+}
+
+// oauthError is an RFC 6749 error code with a human-readable description
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// writeOAuthError answers a token or userinfo request with a JSON error body
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthError{Code: code, Description: description})
+}
+
+// requireOIDC answers 404 on the provider endpoints unless an issuer is configured
+func (s *Server) requireOIDC(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.OIDC.Issuer == "" {
+			writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "OIDC provider is disabled")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ProviderMetadata is the OpenID Connect discovery document
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// discoveryHandler serves /.well-known/openid-configuration
+func (s *Server) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := s.cfg.OIDC.issuer()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProviderMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserinfoEndpoint:                  issuer + "/oauth/userinfo",
+		IntrospectionEndpoint:             issuer + "/v1/introspect",
+		JWKSURI:                           issuer + "/oauth/jwks",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{s.tokens.signer().alg},
+		ScopesSupported:                   s.cfg.OIDC.scopes(),
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", proofGrantType},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr"},
+	})
+}
+
+// scopes lists every scope a client can be granted, for the discovery document
+func (c OIDCConfig) scopes() []string {
+	scopes := []string{"openid", "offline_access"}
+	for _, client := range c.Clients {
+		for _, scope := range client.Scopes {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// JSONWebKeySet is the document served at the jwks_uri
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// authorizationRequest holds the OAuth parameters of an authorization request
+type authorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string // Nonce is the relying party's ID token nonce, unrelated to the proof challenge
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// parseAuthorizationRequest reads the authorization parameters from a query or form
+func parseAuthorizationRequest(values url.Values) authorizationRequest {
+	return authorizationRequest{
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		ResponseType:        values.Get("response_type"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		Nonce:               values.Get("nonce"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+// hiddenFields lists the parameters the sign-in form carries through to its POST
+func (req authorizationRequest) hiddenFields() map[string]string {
+	return map[string]string{
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"response_type":         req.ResponseType,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+	}
+}
+
+// maxOAuthParamLength bounds state, nonce and the other free-form authorization parameters
+const maxOAuthParamLength = 512
+
+// check validates an authorization request. A nil client means the redirect URI can't be trusted, so
+// the error must be shown to the user instead of being sent back to the relying party.
+func (c OIDCConfig) check(req authorizationRequest) (*OIDCClient, error) {
+	client, known := c.client(req.ClientID)
+	if !known {
+		return nil, &oauthError{Code: "invalid_client", Description: "Unknown client_id"}
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, &oauthError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+	for _, value := range []string{req.Scope, req.State, req.Nonce, req.CodeChallenge} {
+		if len(value) > maxOAuthParamLength {
+			return client, &oauthError{Code: "invalid_request", Description: fmt.Sprintf("Parameters are limited to %d bytes", maxOAuthParamLength)}
+		}
+	}
+	if req.ResponseType != "code" {
+		return client, &oauthError{Code: "unsupported_response_type", Description: "Only response_type=code is supported"}
+	}
+	if !slices.Contains(strings.Fields(req.Scope), "openid") {
+		return client, &oauthError{Code: "invalid_scope", Description: "scope must include openid"}
+	}
+	if !client.allowsScope(req.Scope) {
+		return client, &oauthError{Code: "invalid_scope", Description: "scope is not allowed for this client"}
+	}
+	if req.CodeChallenge == "" && client.ClientSecret == "" {
+		return client, &oauthError{Code: "invalid_request", Description: "Public clients must send a PKCE code_challenge"}
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		return client, &oauthError{Code: "invalid_request", Description: "code_challenge_method must be S256"}
+	}
+	return client, nil
+}
+
+// redirectWith sends the user agent back to the relying party with the given query parameters
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, parseErr := url.Parse(redirectURI)
+	if parseErr != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "Invalid redirect_uri")
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// rejectAuthorization reports a failed authorization request, redirecting when the client is trusted
+func rejectAuthorization(w http.ResponseWriter, r *http.Request, req authorizationRequest, client *OIDCClient, err error) {
+	var oauthErr *oauthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = &oauthError{Code: "server_error", Description: err.Error()}
+	}
+	if client == nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, oauthErr.Description)
+		return
+	}
+	params := url.Values{"error": {oauthErr.Code}, "error_description": {oauthErr.Description}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectWith(w, r, req.RedirectURI, params)
+}
+
+// loginPage is the data rendered into loginTemplate
+type loginPage struct {
+	Title    string
+	Fields   map[string]string
+	UserName string
+	Error    string
+	// CSRFToken is sent back by the form and the page's own requests when csrf covers them
+	CSRFToken string
+}
+
+// authorizeHandler validates an authorization request and renders the sign-in page, which proves in the browser
+func (s *Server) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req := parseAuthorizationRequest(r.URL.Query())
+	client, checkErr := s.cfg.OIDC.check(req)
+	if checkErr != nil {
+		rejectAuthorization(w, r, req, client, checkErr)
+		return
+	}
+	s.renderLogin(w, r, http.StatusOK, loginPage{Title: s.cfg.OIDC.LoginTitle, Fields: req.hiddenFields()})
+}
+
+// authorizeSubmitHandler verifies the proof posted by the sign-in page and redirects back with a code
+func (s *Server) authorizeSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	if parseErr := r.ParseForm(); parseErr != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "Malformed form body")
+		return
+	}
+	req := parseAuthorizationRequest(r.PostForm)
+	client, checkErr := s.cfg.OIDC.check(req)
+	if checkErr != nil {
+		rejectAuthorization(w, r, req, client, checkErr)
+		return
+	}
+
+	page := loginPage{Title: s.cfg.OIDC.LoginTitle, Fields: req.hiddenFields(), UserName: r.PostForm.Get("user_name")}
+	var v validate.Validator
+	proof := v.Base64("proof", r.PostForm.Get("proof"), maxProofLength)
+	if proofErr := v.Err(); proofErr != nil {
+		page.Error = proofErr.Error()
+		s.renderLogin(w, r, http.StatusBadRequest, page)
+		return
+	}
+	assertion, assertionErr := formAssertion(r.PostForm.Get("webauthn"))
+	if assertionErr != nil {
+		page.Error = assertionErr.Error()
+		s.renderLogin(w, r, http.StatusBadRequest, page)
+		return
+	}
+	proofReq := ProofRequest{
+		UserName:         page.UserName,
+		Nonce:            r.PostForm.Get("challenge_nonce"),
+		Proof:            proof,
+		KeyID:            r.PostForm.Get("key_id"),
+		TOTPCode:         r.PostForm.Get("totp_code"),
+		WebAuthn:         assertion,
+		CryptoCommitment: r.PostForm.Get("crypto_commitment"),
+	}
+	nonce, validateErr := proofReq.validate()
+	if validateErr != nil {
+		page.Error = validateErr.Error()
+		s.renderLogin(w, r, http.StatusBadRequest, page)
+		return
+	}
+	user, _, authErr := s.authenticate(r.Context(), proofReq, nonce)
+	if authErr != nil {
+		if errors.Is(authErr, ErrPoolBusy) {
+			writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+			return
+		}
+		status, _, message := authFailure(proofReq, authErr)
+		page.Error = message
+		s.renderLogin(w, r, status, page)
+		return
+	}
+
+	code, issueErr := s.codes.issue(r.Context(), authorizationGrant{
+		clientID:      client.ClientID,
+		redirectURI:   req.RedirectURI,
+		userName:      user.UserName,
+		scope:         req.Scope,
+		nonce:         req.Nonce,
+		codeChallenge: req.CodeChallenge,
+		authTime:      time.Now(),
+	})
+	if issueErr != nil {
+		rejectAuthorization(w, r, req, client, issueErr)
+		return
+	}
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectWith(w, r, req.RedirectURI, params)
+}
+
+// renderLogin writes the sign-in page, with a CSRF token under csrf protection; framing is denied
+// so the page can't be clickjacked
+func (s *Server) renderLogin(w http.ResponseWriter, r *http.Request, status int, page loginPage) {
+	if s.csrf != nil {
+		page.CSRFToken = s.csrf.issue(w, r, s.servedOverHTTPS(r))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	loginTemplate.Execute(w, page)
+}
+
+// loginTemplate loads the wasm prover from /v1/wasm, proves in the page and posts only the proof and
+// the commitment it was generated against; the secret field has no name, so it is never submitted
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form id="login" method="post" action="/oauth/authorize">
+{{range $name, $value := .Fields}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}{{if .CSRFToken}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{end}}<input type="hidden" name="challenge_nonce">
+<input type="hidden" name="key_id">
+<input type="hidden" name="proof">
+<input type="hidden" name="crypto_commitment">
+<label>User name <input name="user_name" value="{{.UserName}}" autocomplete="username" required></label>
+<label>Secret <input id="secret" type="password" inputmode="numeric" autocomplete="off" required></label>
+<label>One-time code, if you enrolled one <input name="totp_code" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]{6}"></label>
+<button type="submit">Sign in</button>
+</form>
+<script src="/v1/wasm/wasm_exec.js"></script>
+<script>
+const go = new Go();
+const ready = WebAssembly.instantiateStreaming(fetch("/v1/wasm/prover.wasm"), go.importObject).then(r => { go.run(r.instance); });
+const form = document.getElementById("login");
+form.addEventListener("submit", async (event) => {
+  event.preventDefault();
+  await ready;
+  const headers = {"Content-Type": "application/json"};
+  if (form.csrf_token) headers["X-CSRF-Token"] = form.csrf_token.value;
+  const challenge = await (await fetch("/v1/challenges", {method: "POST", headers: headers,
+    body: JSON.stringify({user_name: form.user_name.value})})).json();
+  const provingKey = await fetch("/v1/keys/proving?key_id=" + encodeURIComponent(challenge.key_id));
+  await ofa.loadProvingKey(new Uint8Array(await provingKey.arrayBuffer()));
+  const secret = document.getElementById("secret");
+  const digits = new TextEncoder().encode(secret.value);
+  const commitmentDigits = new TextEncoder().encode(secret.value);
+  secret.value = "";
+  form.crypto_commitment.value = ofa.generateCommitment(commitmentDigits);
+  const proof = await ofa.prove(digits, challenge.nonce);
+  form.challenge_nonce.value = challenge.nonce;
+  form.key_id.value = challenge.key_id;
+  form.proof.value = btoa(String.fromCharCode(...proof));
+  form.submit();
+});
+</script>
+</body>
+</html>
+`))
+
+// TokenResponse is the successful answer of the token endpoint
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token
+type IDTokenClaims struct {
+	registeredClaims
+	AuthTime int64    `json:"auth_time"`
+	Nonce    string   `json:"nonce,omitempty"`
+	AMR      []string `json:"amr"` // AMR is always ["zkp"]: the user proved knowledge of their secret
+}
+
+// AccessTokenClaims are the claims of an RFC 9068 JWT access token
+type AccessTokenClaims struct {
+	registeredClaims
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	SessionID string `json:"sid,omitempty"` // SessionID is the refresh token family, shared by every token of one sign-in
+	JWTID     string `json:"jti"`
+}
+
+// tokenHandler implements the token endpoint of the provider
+func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	if parseErr := r.ParseForm(); parseErr != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+	client, clientErr := s.authenticateClient(r)
+	if clientErr != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", clientErr.Error())
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "authorization_code":
+		s.redeemAuthorizationCode(w, r, client)
+	case "refresh_token":
+		s.redeemRefreshToken(w, r, client)
+	case proofGrantType:
+		s.redeemProof(w, r, client)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("grant_type %q is not supported", grantType))
+	}
+}
+
+// authenticateClient identifies the client from HTTP Basic credentials or the form. Confidential
+// clients must present their secret; public clients are identified by client_id alone.
+func (s *Server) authenticateClient(r *http.Request) (*OIDCClient, error) {
+	clientID, clientSecret, hasBasic := r.BasicAuth()
+	if hasBasic {
+		// RFC 6749 form-encodes both halves of the Basic credentials
+		var idErr, secretErr error
+		clientID, idErr = url.QueryUnescape(clientID)
+		clientSecret, secretErr = url.QueryUnescape(clientSecret)
+		if idErr != nil || secretErr != nil {
+			return nil, errors.New("malformed client credentials")
+		}
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, known := s.cfg.OIDC.client(clientID)
+	if !known {
+		return nil, errors.New("unknown client")
+	}
+	if client.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) != 1 {
+		return nil, errors.New("client authentication failed")
+	}
+	return client, nil
+}
+
+// redeemAuthorizationCode exchanges a code issued by authorizeSubmitHandler for tokens
+func (s *Server) redeemAuthorizationCode(w http.ResponseWriter, r *http.Request, client *OIDCClient) {
+	grant, consumeErr := s.codes.consume(r.Context(), r.PostForm.Get("code"))
+	if consumeErr != nil || grant.clientID != client.ClientID || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Unknown, expired or mismatched authorization code")
+		return
+	}
+	if grant.codeChallenge != "" {
+		verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		computed := base64.RawURLEncoding.EncodeToString(verifierHash[:])
+		if subtle.ConstantTimeCompare([]byte(computed), []byte(grant.codeChallenge)) != 1 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match code_challenge")
+			return
+		}
+	}
+
+	now := time.Now()
+	idToken, idErr := s.tokens.sign("JWT", IDTokenClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    s.cfg.OIDC.issuer(),
+			Subject:   grant.userName,
+			Audience:  client.ClientID,
+			ExpiresAt: now.Add(s.cfg.OIDC.TokenTTL.Duration).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		AuthTime: grant.authTime.Unix(),
+		Nonce:    grant.nonce,
+		AMR:      []string{"zkp"},
+	})
+	if idErr != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Error signing tokens")
+		return
+	}
+	// Refresh tokens are only handed to relying parties that asked for offline access
+	offline := slices.Contains(strings.Fields(grant.scope), "offline_access")
+	s.writeTokens(w, r, tokenGrant{userName: grant.userName, clientID: client.ClientID, scope: grant.scope}, idToken, offline)
+}
+
+// UserInfo holds the claims returned by the userinfo endpoint
+type UserInfo struct {
+	Subject string `json:"sub"`
+}
+
+// userinfoHandler returns the claims about the user an access token was issued for
+func (s *Server) userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	token, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var claims AccessTokenClaims
+	if !hasBearer || s.tokens.verify(token, "at+jwt", s.cfg.OIDC.issuer(), &claims) != nil ||
+		!slices.Contains(strings.Fields(claims.Scope), "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "Missing, invalid or expired access token")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(UserInfo{Subject: claims.Subject})
+}
+
+// ErrCodeNotFound is returned when an authorization code was never issued, was already redeemed, or has expired
+var ErrCodeNotFound = errors.New("authorization code not found or expired")
+
+// authorizationGrant is what an authorization code stands for until it is redeemed
+type authorizationGrant struct {
+	clientID      string
+	redirectURI   string
+	userName      string
+	scope         string
+	nonce         string
+	codeChallenge string
+	authTime      time.Time
+	expiresAt     time.Time
+}
+
+// grantRecord is how an authorizationGrant is kept in Redis in stateless mode
+type grantRecord struct {
+	ClientID      string    `json:"client_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	UserName      string    `json:"user_name"`
+	Scope         string    `json:"scope"`
+	Nonce         string    `json:"nonce,omitempty"`
+	CodeChallenge string    `json:"code_challenge,omitempty"`
+	AuthTime      time.Time `json:"auth_time"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// codeStore keeps issued authorization codes until they are redeemed or expire; in stateless mode
+// they live in Redis, so the token request may reach another replica than the authorization did
+type codeStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	codes  map[string]authorizationGrant
+	shared *sharedState // shared is nil outside stateless mode
+}
+
+// newCodeStore creates a store whose codes stay valid for ttl
+func newCodeStore(ttl time.Duration, shared *sharedState) *codeStore {
+	return &codeStore{ttl: ttl, codes: make(map[string]authorizationGrant), shared: shared}
+}
+
+// issue records a grant under a fresh random code
+func (s *codeStore) issue(ctx context.Context, grant authorizationGrant) (string, error) {
+	code, randErr := randomToken()
+	if randErr != nil {
+		return "", randErr
+	}
+	grant.expiresAt = time.Now().Add(s.ttl)
+	if s.shared != nil {
+		encoded, _ := json.Marshal(grantRecord{
+			ClientID: grant.clientID, RedirectURI: grant.redirectURI, UserName: grant.userName, Scope: grant.scope,
+			Nonce: grant.nonce, CodeChallenge: grant.codeChallenge, AuthTime: grant.authTime, ExpiresAt: grant.expiresAt,
+		})
+		userKey := s.shared.key("codes", grant.userName)
+		_, issueErr := s.shared.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.shared.key("code", code), encoded, s.ttl)
+			pipe.SAdd(ctx, userKey, code)
+			pipe.PExpire(ctx, userKey, s.ttl)
+			return nil
+		})
+		if issueErr != nil {
+			return "", issueErr
+		}
+		return code, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.codes[code] = grant
+	return code, nil
+}
+
+// consume removes a code and returns its grant; each code can be redeemed once
+func (s *codeStore) consume(ctx context.Context, code string) (authorizationGrant, error) {
+	if s.shared != nil {
+		// GETDEL hands the code to one replica only, however many redeem it at once
+		encoded, getErr := s.shared.client.GetDel(ctx, s.shared.key("code", code)).Result()
+		if getErr != nil && !errors.Is(getErr, redis.Nil) {
+			return authorizationGrant{}, getErr
+		}
+		var record grantRecord
+		if errors.Is(getErr, redis.Nil) || json.Unmarshal([]byte(encoded), &record) != nil || time.Now().After(record.ExpiresAt) {
+			return authorizationGrant{}, ErrCodeNotFound
+		}
+		s.shared.client.SRem(ctx, s.shared.key("codes", record.UserName), code)
+		return authorizationGrant{
+			clientID: record.ClientID, redirectURI: record.RedirectURI, userName: record.UserName, scope: record.Scope,
+			nonce: record.Nonce, codeChallenge: record.CodeChallenge, authTime: record.AuthTime, expiresAt: record.ExpiresAt,
+		}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant, exists := s.codes[code]
+	if !exists || time.Now().After(grant.expiresAt) {
+		return authorizationGrant{}, ErrCodeNotFound
+	}
+	delete(s.codes, code)
+	return grant, nil
+}
+
+// forgetUser drops every unredeemed code issued to userName and returns them
+func (s *codeStore) forgetUser(ctx context.Context, userName string) ([]string, error) {
+	if s.shared != nil {
+		userKey := s.shared.key("codes", userName)
+		var codes []string
+		forgetErr := s.shared.watch(ctx, func(tx *redis.Tx) error {
+			members, membersErr := tx.SMembers(ctx, userKey).Result()
+			if membersErr != nil {
+				return membersErr
+			}
+			codes = members
+			_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, userKey)
+				for _, code := range members {
+					pipe.Del(ctx, s.shared.key("code", code))
+				}
+				return nil
+			})
+			return execErr
+		}, userKey)
+		return codes, forgetErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var codes []string
+	for code, grant := range s.codes {
+		if grant.userName == userName {
+			codes = append(codes, code)
+			delete(s.codes, code)
+		}
+	}
+	return codes, nil
+}
+
+// pruneLocked drops expired codes; the caller must hold s.mu
+func (s *codeStore) pruneLocked() {
+	now := time.Now()
+	for code, grant := range s.codes {
+		if now.After(grant.expiresAt) {
+			delete(s.codes, code)
+		}
+	}
+}
+
+// randomToken returns 32 random bytes encoded as unpadded base64url
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, randErr := rand.Read(raw); randErr != nil {
+		return "", randErr
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
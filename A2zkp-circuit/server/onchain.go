@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"A2zkp-circuit/ethereum"
+	"A2zkp-circuit/verifier"
+)
+
+// txHashPattern matches a 0x-prefixed 32-byte transaction hash
+var txHashPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+
+// newChainClient connects to the configured verifier contract; it returns nil when none is configured
+func newChainClient(cfg EthereumConfig) (*ethereum.Client, *ethereum.PrivateKey, error) {
+	if cfg.RPCURL == "" {
+		return nil, nil, nil
+	}
+	client, clientErr := ethereum.New(cfg.RPCURL, cfg.VerifierAddress)
+	if clientErr != nil {
+		return nil, nil, fmt.Errorf("ethereum: %w", clientErr)
+	}
+	if cfg.SenderKey == "" {
+		return client, nil, nil
+	}
+	senderKey, keyErr := ethereum.ParsePrivateKey(cfg.SenderKey)
+	if keyErr != nil {
+		return nil, nil, fmt.Errorf("ethereum sender_key: %w", keyErr)
+	}
+	return client, senderKey, nil
+}
+
+// requireChain answers 404 unless an Ethereum RPC endpoint is configured
+func (s *Server) requireChain(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.chain == nil {
+			writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "On-chain verification is disabled")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// OnchainSubmission is returned once a verification transaction has been broadcast
+type OnchainSubmission struct {
+	TxHash string `json:"tx_hash"` // TxHash polls the result at /v1/onchain/transactions/{hash}
+	From   string `json:"from"`
+}
+
+// onchainCalldata decodes a proof submission and encodes it as a verifyProof call against the user's
+// stored commitment. The challenge is not consumed: the contract has no notion of nonce freshness.
+func (s *Server) onchainCalldata(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var req ProofRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return nil, false
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return nil, false
+	}
+	if req.SnarkJSProof != nil {
+		writeRequestError(w, badRequest("The on-chain verifier checks gnark proofs only, not snarkjs_proof"))
+		return nil, false
+	}
+	user, getErr := s.getUser(r.Context(), req.UserName)
+	if getErr != nil && s.cfg.RevealUserExistence {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return nil, false
+	}
+	// The contract checks one commitment: the named device's, or else the user's own
+	commitments, ok := s.proofCommitments(user, req)
+	if getErr != nil || !ok || user.Pending() || user.Expired(time.Now()) {
+		// The contract rejects the decoy like any wrong proof, so expired registrations fail too
+		commitments = []string{decoyCommitment}
+	}
+	commitment, _ := new(big.Int).SetString(commitments[0], 10)
+
+	proof, readErr := verifier.ReadProof(req.Proof)
+	if readErr != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Malformed proof: %v", readErr))
+		return nil, false
+	}
+	// Public inputs go in circuit declaration order: the commitment, then the nonce
+	calldata, encodeErr := ethereum.EncodeVerifyCall(proof, []*big.Int{commitment, nonce})
+	if encodeErr != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error encoding proof: %v", encodeErr))
+		return nil, false
+	}
+	return calldata, true
+}
+
+// onchainVerifyHandler checks a proof with a read-only eth_call to the verifier contract
+func (s *Server) onchainVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	calldata, ok := s.onchainCalldata(w, r)
+	if !ok {
+		return
+	}
+	result, callErr := s.chain.Call(r.Context(), calldata)
+	if callErr != nil {
+		writeProblem(w, http.StatusBadGateway, codeUpstreamFailed, fmt.Sprintf("Ethereum node: %v", callErr))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// onchainSubmitHandler records a proof verification on chain as a transaction paid by the sender key
+func (s *Server) onchainSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chainKey == nil {
+		writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "No ethereum sender_key is configured")
+		return
+	}
+	calldata, ok := s.onchainCalldata(w, r)
+	if !ok {
+		return
+	}
+	txHash, submitErr := s.chain.Submit(r.Context(), s.chainKey, calldata, s.cfg.Ethereum.GasLimit)
+	if errors.Is(submitErr, ethereum.ErrReverted) {
+		writeProblem(w, http.StatusUnprocessableEntity, codeProofInvalid, fmt.Sprintf("Proof rejected by the verifier contract: %v", submitErr))
+		return
+	}
+	if submitErr != nil {
+		writeProblem(w, http.StatusBadGateway, codeUpstreamFailed, fmt.Sprintf("Ethereum node: %v", submitErr))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/onchain/transactions/"+txHash)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(OnchainSubmission{TxHash: txHash, From: s.chainKey.Address().String()})
+}
+
+// onchainReceiptHandler reports whether a submitted verification was mined and whether it succeeded
+func (s *Server) onchainReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	txHash := r.PathValue("hash")
+	if !txHashPattern.MatchString(txHash) {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "Transaction hash must be 0x followed by 64 hex digits")
+		return
+	}
+	receipt, receiptErr := s.chain.Receipt(r.Context(), txHash)
+	if receiptErr != nil {
+		writeProblem(w, http.StatusBadGateway, codeUpstreamFailed, fmt.Sprintf("Ethereum node: %v", receiptErr))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// verifierContractHandler serves the Solidity verifier of a key version, ready to deploy
+func (s *Server) verifierContractHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := s.requestedKeyVersion(w, r)
+	if !ok {
+		return
+	}
+	var contract bytes.Buffer
+	if exportErr := version.keys.verifyingKey.ExportSolidity(&contract); exportErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error exporting verifier: %v", exportErr))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(contract.Bytes())
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"go/token"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/wire"
+)
+
+// apiVersion is the version of the HTTP API described by the OpenAPI document
+const apiVersion = "1"
+
+// route is one HTTP endpoint: the pattern it is served under, its handler and its documentation
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	doc     operation
+}
+
+// operation documents a route in the OpenAPI document
+type operation struct {
+	id      string // id is the operationId that code generators name the client method after
+	summary string
+	// security names the scheme guarding the route: "admin", "client", "confidential" (a client with
+	// its secret), "bearer", "session" or "user" (admin or the user's session token); empty for public routes
+	security string
+	request  any // request is a value of the JSON body type; nil when the route takes no JSON body
+	form     any // form is a value whose json tags name the form fields of a urlencoded body
+	query    []parameter
+	status   int // status is the success status code; 200 when zero
+	response any // response is a value of the JSON response type; nil for empty or non-JSON responses
+	// contentType describes a non-JSON success response, e.g. "application/octet-stream"
+	contentType string
+	oauthErrors bool // oauthErrors marks routes answering errors as RFC 6749 JSON rather than problem details
+	// scim marks the /scim/v2 routes, whose bodies are application/scim+json and whose errors are SCIM error messages
+	scim bool
+	// protobuf names the ofa.v1 request and response messages of routes that also speak application/x-protobuf
+	protobuf [2]string
+	// cached marks routes whose responses carry an ETag, answering 304 when If-None-Match names it
+	cached bool
+}
+
+// parameter documents a query parameter
+type parameter struct {
+	name        string
+	description string
+}
+
+// TokenRequest documents the form fields of the token endpoint; which ones apply depends on grant_type
+type TokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id,omitempty"`     // ClientID identifies the client when Basic authentication isn't used
+	ClientSecret string `json:"client_secret,omitempty"` // ClientSecret authenticates a confidential client without Basic authentication
+	Code         string `json:"code,omitempty"`
+	RedirectURI  string `json:"redirect_uri,omitempty"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	UserName     string `json:"user_name,omitempty"` // UserName, Nonce, KeyID and Proof carry a zk-proof grant
+	Nonce        string `json:"nonce,omitempty"`
+	KeyID        string `json:"key_id,omitempty"`
+	Proof        []byte `json:"proof,omitempty"`
+	// CryptoCommitment is the commitment the proof was generated against, for commitment_blinding
+	CryptoCommitment string `json:"crypto_commitment,omitempty"`
+}
+
+// IntrospectionRequest documents the form fields of the introspection endpoint
+type IntrospectionRequest struct {
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"token_type_hint,omitempty"` // TokenTypeHint is accepted and ignored; the token's format tells its type
+	ClientID      string `json:"client_id,omitempty"`       // ClientID and ClientSecret authenticate the client without Basic authentication
+	ClientSecret  string `json:"client_secret,omitempty"`
+}
+
+// AuthorizeSubmission documents the form the sign-in page posts back to the authorization endpoint
+type AuthorizeSubmission struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	ResponseType        string `json:"response_type"`
+	Scope               string `json:"scope"`
+	State               string `json:"state,omitempty"`
+	Nonce               string `json:"nonce,omitempty"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+	UserName            string `json:"user_name"`
+	ChallengeNonce      string `json:"challenge_nonce"`
+	KeyID               string `json:"key_id,omitempty"`
+	Proof               []byte `json:"proof"`
+	// CryptoCommitment is the commitment the proof was generated against, for commitment_blinding
+	CryptoCommitment string `json:"crypto_commitment,omitempty"`
+}
+
+// keyIDParameter selects the key version of a served key
+var keyIDParameter = parameter{name: "key_id", description: "Key version to serve; the current one when omitted"}
+
+// curveParameter selects the curve of a served key
+var curveParameter = parameter{name: "curve", description: "Curve of the key, one of those listed by GET /v1/circuit; the circuit's own when omitted"}
+
+// tenantParameter selects the circuit a tenant is pinned to
+var tenantParameter = parameter{name: "tenant", description: "Tenant whose circuit to use, for a tenant tenant_circuits pins; the configured circuit when omitted or not pinned"}
+
+// userNameParameter selects the canary circuit for users canary_circuit routes to it
+var userNameParameter = parameter{name: "user_name", description: "User about to register, for the canary circuit when canary_circuit routes their new registrations to it"}
+
+// schemaOverrides describes types whose JSON encoding differs from their Go structure
+var schemaOverrides = map[reflect.Type]map[string]any{
+	reflect.TypeOf(time.Time{}):     {"type": "string", "format": "date-time"},
+	reflect.TypeOf(Duration{}):      {"type": "string", "example": "30s"},
+	reflect.TypeOf(secret.Buffer{}): {"type": "string", "pattern": "^[0-9]+$"},
+}
+
+// schemaBuilder turns Go types into OpenAPI schemas, collecting exported structs as named components
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// schema returns the schema of a type, or a reference to its component
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	if override, overridden := schemaOverrides[t]; overridden {
+		return override
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json writes []byte as base64
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		// Anonymous and unexported structs are inlined
+		if !token.IsExported(t.Name()) {
+			return b.object(t)
+		}
+		if _, seen := b.components[t.Name()]; !seen {
+			b.components[t.Name()] = map[string]any{} // placeholder, so recursive types terminate
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object describes a struct by its JSON fields; fields without omitempty are required
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	b.addFields(t, properties, &required)
+	object := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+// addFields adds the JSON fields of a struct, flattening embedded structs the way encoding/json does
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// content describes a body of the given value's type under a media type
+func (b *schemaBuilder) content(mediaType string, value any) map[string]any {
+	return map[string]any{mediaType: map[string]any{"schema": b.schema(reflect.TypeOf(value))}}
+}
+
+// protobufContent describes a body holding an ofa.v1 message, which OpenAPI can't express structurally
+func protobufContent(message string) map[string]any {
+	return map[string]any{"schema": map[string]any{
+		"type": "string", "format": "binary", "description": "ofa.v1." + message + ", defined in wire/ofa.proto",
+	}}
+}
+
+// valueContent describes the JSON document of a body as a google.protobuf.Value, for clients
+// speaking only protobuf to endpoints without an ofa.v1 message
+var valueContent = map[string]any{"schema": map[string]any{
+	"type": "string", "format": "binary", "description": wire.ValueMessage + " holding the JSON document, field for field",
+}}
+
+// operation renders a route as an OpenAPI operation object
+func (b *schemaBuilder) operation(op operation, path string) map[string]any {
+	rendered := map[string]any{"operationId": op.id, "summary": op.summary}
+
+	parameters := []any{}
+	for _, segment := range strings.Split(path, "/") {
+		if name, isWildcard := strings.CutPrefix(segment, "{"); isWildcard {
+			parameters = append(parameters, map[string]any{
+				"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+	}
+	for _, query := range op.query {
+		rendered := map[string]any{"name": query.name, "in": "query", "schema": map[string]any{"type": "string"}}
+		if query.description != "" {
+			rendered["description"] = query.description
+		}
+		parameters = append(parameters, rendered)
+	}
+	if op.cached {
+		parameters = append(parameters, map[string]any{
+			"name": "If-None-Match", "in": "header", "schema": map[string]any{"type": "string"},
+			"description": "ETag of a copy the client holds, answered with 304 when it is current",
+		})
+	}
+	if len(parameters) > 0 {
+		rendered["parameters"] = parameters
+	}
+
+	mediaType := "application/json"
+	if op.scim {
+		mediaType = scimContentType
+	}
+	switch {
+	case op.request != nil:
+		content := b.content(mediaType, op.request)
+		if message := op.protobuf[0]; message != "" {
+			content[wire.ContentType] = protobufContent(message)
+		} else if !op.scim {
+			content[wire.ValueContentType] = valueContent
+		}
+		rendered["requestBody"] = map[string]any{"required": true, "content": content}
+	case op.form != nil:
+		rendered["requestBody"] = map[string]any{"required": true, "content": b.content("application/x-www-form-urlencoded", op.form)}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.response != nil:
+		success["content"] = b.content(mediaType, op.response)
+		if message := op.protobuf[1]; message != "" {
+			success["content"].(map[string]any)[wire.ContentType] = protobufContent(message)
+		} else if !op.scim {
+			success["content"].(map[string]any)[wire.ValueContentType] = valueContent
+		}
+	case op.contentType != "":
+		success["content"] = map[string]any{op.contentType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+	}
+	errorResponse := "#/components/responses/Error"
+	switch {
+	case op.oauthErrors:
+		errorResponse = "#/components/responses/OAuthError"
+	case op.scim:
+		errorResponse = "#/components/responses/SCIMError"
+	}
+	responses := map[string]any{
+		strconv.Itoa(status): success,
+		"default":            map[string]any{"$ref": errorResponse},
+	}
+	if op.cached {
+		etag := map[string]any{"ETag": map[string]any{"schema": map[string]any{"type": "string"}}}
+		success["headers"] = etag
+		responses[strconv.Itoa(http.StatusNotModified)] = map[string]any{"description": http.StatusText(http.StatusNotModified), "headers": etag}
+	}
+	rendered["responses"] = responses
+
+	switch op.security {
+	case "admin":
+		rendered["security"] = []any{map[string]any{"adminToken": []string{}}}
+	case "bearer":
+		rendered["security"] = []any{map[string]any{"accessToken": []string{}}}
+	case "session":
+		rendered["security"] = []any{map[string]any{"sessionToken": []string{}}}
+	case "user":
+		rendered["security"] = []any{map[string]any{"adminToken": []string{}}, map[string]any{"sessionToken": []string{}}}
+	case "client":
+		// Public clients identify themselves with client_id in the form instead
+		rendered["security"] = []any{map[string]any{"clientCredentials": []string{}}, map[string]any{}}
+	case "confidential":
+		rendered["security"] = []any{map[string]any{"clientCredentials": []string{}}}
+	}
+	return rendered
+}
+
+// openAPIDocument builds the OpenAPI 3 description of a route table
+func openAPIDocument(table []route) map[string]any {
+	builder := &schemaBuilder{components: map[string]any{}}
+	builder.components["OAuthError"] = builder.object(reflect.TypeOf(oauthError{}))
+	builder.components["SCIMError"] = builder.object(reflect.TypeOf(SCIMError{}))
+	problem := builder.object(reflect.TypeOf(Problem{}))
+	codes := slices.Sorted(maps.Keys(problemTitles))
+	problem["properties"].(map[string]any)["code"] = map[string]any{"type": "string", "enum": codes}
+	problem["properties"].(map[string]any)["reason"] = map[string]any{"type": "string", "enum": failureReasons}
+	builder.components["Problem"] = problem
+
+	paths := map[string]map[string]any{}
+	for _, rt := range table {
+		method, path, hasMethod := strings.Cut(rt.pattern, " ")
+		if !hasMethod {
+			// Method-less patterns are the legacy JSON endpoints, which are called with POST
+			method, path = http.MethodPost, rt.pattern
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = builder.operation(rt.doc, path)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "One-Factor Authentication API",
+			"version":     apiVersion,
+			"description": "Registers commitments to user secrets and verifies Groth16 proofs of knowledge of them.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": builder.components,
+			"responses": map[string]any{
+				"Error": map[string]any{
+					"description": "RFC 7807 problem details",
+					"content":     map[string]any{problemContentType: map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Problem"}}},
+				},
+				"OAuthError": map[string]any{
+					"description": "RFC 6749 error",
+					"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/OAuthError"}}},
+				},
+				"SCIMError": map[string]any{
+					"description": "RFC 7644 error message",
+					"content":     map[string]any{scimContentType: map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/SCIMError"}}},
+				},
+			},
+			"securitySchemes": map[string]any{
+				"adminToken":        map[string]any{"type": "http", "scheme": "bearer", "description": "The configured admin_token or an API key from /admin/api-keys"},
+				"accessToken":       map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"sessionToken":      map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "A session token from /v1/login/ws"},
+				"clientCredentials": map[string]any{"type": "http", "scheme": "basic", "description": "OAuth client_id and client_secret"},
+			},
+		},
+	}
+}
+
+// runOpenAPICommand implements the "openapi" subcommand, printing the document for client code generation
+func runOpenAPICommand(args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	flags.Parse(args)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(openAPIDocument((&Server{}).routeTable()))
+}
+
+// openAPIHandler serves the OpenAPI document describing every route
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument(s.routeTable()))
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// UserParams are the public parameters a client needs to rebuild a user's witness, e.g. after a
+// reinstall: how the secret was stretched and which circuit the commitment belongs to. The
+// commitment itself is not returned.
+type UserParams struct {
+	UserName string `json:"user_name"`
+	Salt     []byte `json:"salt,omitempty"` // Salt is the base64-encoded salt the secret was derived with
+	// KDF holds the parameters the secret was stretched with; omitted for raw integer secrets
+	KDF            *secret.KDFParams `json:"kdf,omitempty"`
+	CircuitVersion string            `json:"circuit_version"`
+	Curve          string            `json:"curve"`
+}
+
+// newUserParams returns the public parameters of a registration. Registrations stored before the
+// curve was recorded are reported on the curve of their circuit.
+func (s *Server) newUserParams(user store.User) UserParams {
+	return UserParams{UserName: user.UserName, Salt: user.Salt, KDF: user.KDF, CircuitVersion: user.CircuitVersion, Curve: s.userCurve(user)}
+}
+
+// decoyUserParams stands in for the parameters of a user who isn't registered. They look like a
+// password registration on the current circuit under the registry's first KDF parameter set, with
+// a salt derived from the name so repeated requests agree; decoyKey changes on restart, and with
+// it every decoy salt.
+func (s *Server) decoyUserParams(userName string) UserParams {
+	mac := hmac.New(sha256.New, s.decoyKey)
+	mac.Write([]byte(userName))
+	kdf := secret.DefaultArgon2idParams()
+	if len(s.cfg.KDFs.Registry) > 0 {
+		kdf = s.cfg.KDFs.Registry[0]
+	}
+	return UserParams{
+		UserName:       userName,
+		Salt:           mac.Sum(nil)[:secret.MinSaltLength],
+		KDF:            &kdf,
+		CircuitVersion: s.circuitVersion,
+		Curve:          s.circuits[s.circuitVersion].Curve,
+	}
+}
+
+// userParamsHandler returns the public parameters of a user's registration. Unless user existence
+// may be revealed, an unknown user gets decoy parameters instead of a 404.
+func (s *Server) userParamsHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	var v validate.Validator
+	v.UserID("id", userName)
+	if validateErr := v.Err(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	user, getErr := s.getUser(r.Context(), userName)
+	switch {
+	case errors.Is(getErr, store.ErrUserNotFound) && s.cfg.RevealUserExistence:
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+	case errors.Is(getErr, store.ErrUserNotFound):
+		writeResponse(w, r, http.StatusOK, s.decoyUserParams(userName))
+	case getErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error loading user")
+	default:
+		writeResponse(w, r, http.StatusOK, s.newUserParams(user))
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/verifier"
+)
+
+// PolicyResponse describes the secret policy new commitments must be proven to satisfy
+type PolicyResponse struct {
+	CircuitVersion string  `json:"circuit_version"`
+	MinBits        int     `json:"min_bits"`
+	MinSecret      string  `json:"min_secret"` // MinSecret is the smallest secret allowed, the circuit's min_secret input
+	Denylist       []int64 `json:"denylist"`
+	KeyID          string  `json:"key_id"` // KeyID identifies the policy circuit's keys, served on /v1/keys/policy
+}
+
+// secretPolicy is the policy commitments are checked against, with the policy circuit's keys set up on first use
+type secretPolicy struct {
+	policy circuit.SecretPolicy
+	keys   *lazyKeys
+}
+
+// newSecretPolicy checks the policy settings, with mock making the policy circuit's setup a mock one;
+// it returns nil when no policy is configured
+func newSecretPolicy(cfg SecretPolicyConfig, mock bool) (*secretPolicy, error) {
+	policy := circuit.SecretPolicy{MinBits: cfg.MinBits, Denylist: cfg.Denylist}
+	if policy.MinBits == 0 && len(policy.Denylist) == 0 {
+		return nil, nil
+	}
+	if policyErr := policy.Validate(); policyErr != nil {
+		return nil, fmt.Errorf("secret_policy: %w", policyErr)
+	}
+	return &secretPolicy{policy: policy, keys: &lazyKeys{version: circuit.PolicyVersion, compile: circuit.CompilePolicy, mock: mock}}, nil
+}
+
+// requirePolicy answers 404 on the policy routes when no secret policy is configured
+func (s *Server) requirePolicy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.policy == nil {
+			writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "No secret policy is configured")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkSecretPolicy verifies the policy proof accompanying a new commitment. Without a configured
+// policy any commitment passes; otherwise a missing or failing proof is a request error.
+func (s *Server) checkSecretPolicy(ctx context.Context, commitment string, proof []byte) error {
+	if s.policy == nil {
+		return nil
+	}
+	if len(proof) == 0 {
+		return &requestError{status: http.StatusUnprocessableEntity, code: codeWeakSecret, message: "Missing policy_proof, required by the secret policy"}
+	}
+	if len(proof) > maxProofLength {
+		return badRequest("policy_proof exceeds %d bytes", maxProofLength)
+	}
+	keys, _, keysErr := s.policy.keys.get(ctx)
+	if keysErr != nil {
+		return keysErr
+	}
+	var verifyErr error
+	poolErr := s.pool.Do(ctx, func() {
+		verifyErr = verifier.New(keys.verifyingKey).VerifyPolicyProof(ctx, proof, commitment, s.policy.policy)
+	})
+	switch {
+	case poolErr != nil:
+		return poolErr
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		return verifyErr
+	case errors.Is(verifyErr, verifier.ErrRejected):
+		return &requestError{status: http.StatusUnprocessableEntity, code: codeWeakSecret, message: "The policy proof does not verify for this commitment"}
+	case verifyErr != nil:
+		return badRequest("policy_proof: %v", verifyErr)
+	}
+	return nil
+}
+
+// writePolicyError answers a request whose commitment failed checkSecretPolicy
+func (s *Server) writePolicyError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	switch {
+	case errors.Is(err, ErrPoolBusy):
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+	case errors.As(err, &reqErr):
+		writeRequestError(w, err)
+	default:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error checking the secret policy: %v", err))
+	}
+}
+
+// policyProblem is the problem a batch registration reports for a commitment that failed checkSecretPolicy
+func policyProblem(err error) Problem {
+	var reqErr *requestError
+	switch {
+	case errors.Is(err, ErrPoolBusy):
+		return newProblem(http.StatusServiceUnavailable, codeServerBusy, "Server is busy, retry later")
+	case errors.As(err, &reqErr):
+		return requestProblem(err)
+	}
+	return newProblem(http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error checking the secret policy: %v", err))
+}
+
+// policyHandler publishes the secret policy so clients can check a secret and prove it before registering
+func (s *Server) policyHandler(w http.ResponseWriter, r *http.Request) {
+	_, keyID, keysErr := s.policy.keys.get(r.Context())
+	if keysErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up policy circuit: %v", keysErr))
+		return
+	}
+	policy := s.policy.policy
+	s.writeCachedResponse(w, r, PolicyResponse{
+		CircuitVersion: circuit.PolicyVersion,
+		MinBits:        policy.MinBits,
+		MinSecret:      policy.MinSecret().String(),
+		Denylist:       append([]int64{}, policy.Denylist...),
+		KeyID:          keyID,
+	})
+}
+
+// policyProvingKeyHandler serves the policy circuit's proving key so clients can prove locally
+func (s *Server) policyProvingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLazyKey(w, r, s.policy.keys, true)
+}
+
+// policyVerifyingKeyHandler serves the policy circuit's verifying key
+func (s *Server) policyVerifyingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLazyKey(w, r, s.policy.keys, false)
+}
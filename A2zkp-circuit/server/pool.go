@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrPoolBusy is returned when the worker pool's queue is full
+var ErrPoolBusy = errors.New("worker pool queue is full")
+
+// workerPool bounds how many CPU- and memory-heavy ZK jobs (proof generation, pairing checks) run at once.
+// Up to queueSize further callers wait for a free worker; anyone beyond that is turned away immediately,
+// except callers of Admit, of which up to admissionSize wait a while for a place in the queue.
+type workerPool struct {
+	workers       chan struct{}
+	slots         chan struct{} // slots holds a token for each job running or queued, at most workers + queueSize
+	admission     chan struct{} // admission holds a token for each caller of Admit waiting for a slot
+	admissionWait time.Duration // admissionWait is how long a caller of Admit waits before ErrPoolBusy
+
+	mu    sync.Mutex
+	waits histogram // waits holds how long jobs waited for a worker, in seconds
+}
+
+// newWorkerPool creates a pool running at most workers jobs with up to queueSize waiting, and up
+// to admissionSize callers of Admit waiting at most admissionWait for room in the queue
+func newWorkerPool(workers, queueSize, admissionSize int, admissionWait time.Duration) *workerPool {
+	return &workerPool{
+		workers:       make(chan struct{}, workers),
+		slots:         make(chan struct{}, workers+queueSize),
+		admission:     make(chan struct{}, admissionSize),
+		admissionWait: admissionWait,
+	}
+}
+
+// Do runs job on a worker, waiting in the queue if needed.
+// It returns ErrPoolBusy if the queue is full, or the context's error if it ends while waiting.
+func (p *workerPool) Do(ctx context.Context, job func()) error {
+	if !p.reserve() {
+		return ErrPoolBusy
+	}
+	return p.run(ctx, time.Now(), job)
+}
+
+// Admit is Do for bursts of verifications: when the queue is full it waits in the admission queue
+// for a place, returning ErrPoolBusy once the admission queue is full too or the wait runs out
+func (p *workerPool) Admit(ctx context.Context, job func()) error {
+	queued := time.Now()
+	if !p.reserve() {
+		if admitErr := p.admit(ctx); admitErr != nil {
+			return admitErr
+		}
+	}
+	return p.run(ctx, queued, job)
+}
+
+// Go queues job without waiting for it. ErrPoolBusy is reported synchronously; once queued,
+// done receives nil after job ran or the context's error if it ended before a worker was free.
+func (p *workerPool) Go(ctx context.Context, job func(), done func(error)) error {
+	if !p.reserve() {
+		return ErrPoolBusy
+	}
+	queued := time.Now()
+	go func() { done(p.run(ctx, queued, job)) }()
+	return nil
+}
+
+// reserve claims a place in the pool, failing when workers and queue are all taken
+func (p *workerPool) reserve() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// admit waits in the admission queue until a place in the pool frees up, for at most admissionWait
+func (p *workerPool) admit(ctx context.Context) error {
+	select {
+	case p.admission <- struct{}{}:
+	default:
+		return ErrPoolBusy
+	}
+	defer func() { <-p.admission }()
+
+	timer := time.NewTimer(p.admissionWait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrPoolBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run waits for a worker and runs job on it, releasing the reservation made by reserve or admit.
+// The wait since queued is recorded once a worker is free.
+func (p *workerPool) run(ctx context.Context, queued time.Time, job func()) error {
+	defer func() { <-p.slots }()
+
+	select {
+	case p.workers <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.workers }()
+	p.mu.Lock()
+	p.waits.observe(proofSecondsBuckets, time.Since(queued).Seconds())
+	p.mu.Unlock()
+
+	job()
+	return nil
+}
+
+// Queued reports how many jobs are waiting for a worker
+func (p *workerPool) Queued() int {
+	queued := len(p.slots) - len(p.workers)
+	if queued < 0 {
+		return 0
+	}
+	return queued
+}
+
+// Admitting reports how many callers of Admit are waiting for room in the queue
+func (p *workerPool) Admitting() int {
+	return len(p.admission)
+}
+
+// writeBusy tells the client to come back later
+func writeBusy(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	writeProblem(w, http.StatusServiceUnavailable, codeServerBusy, "Server is busy, retry later")
+}
+
+// retryAfterSeconds formats a Retry-After value, never less than one second
+func retryAfterSeconds(retryAfter time.Duration) string {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"A2zkp-circuit/validate"
+)
+
+// problemContentType is the media type of error responses
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix turns a problem code into the problem type URI
+const problemTypePrefix = "urn:ofa:problem:"
+
+// Problem codes are stable: clients branch on them, while titles and details may change
+const (
+	codeInvalidRequest        = "invalid_request"
+	codeBodyTooLarge          = "body_too_large"
+	codeUnsupportedMedia      = "unsupported_media_type"
+	codeInvalidSecret         = "invalid_secret"
+	codeInvalidCommitment     = "invalid_commitment"
+	codeWeakSecret            = "weak_secret"
+	codeDIDUnresolvable       = "did_unresolvable"
+	codeDIDBindingInvalid     = "did_binding_invalid"
+	codeUserExists            = "user_exists"
+	codeCommitmentReused      = "commitment_reused"
+	codeResaltRequired        = "resalt_required"
+	codeUserNotFound          = "user_not_found"
+	codeDeviceExists          = "device_exists"
+	codeDeviceNotFound        = "device_not_found"
+	codeProofInvalid          = "proof_invalid"
+	codeProofReplayed         = "proof_replayed"
+	codeTOTPRequired          = "totp_required"
+	codeTOTPInvalid           = "totp_invalid"
+	codeTOTPUnenrolled        = "totp_enrollment_required"
+	codeTOTPNotEnrolled       = "totp_not_enrolled"
+	codeTOTPEnrolled          = "totp_enrolled"
+	codeWebAuthnRequired      = "webauthn_required"
+	codeWebAuthnInvalid       = "webauthn_invalid"
+	codeWebAuthnBound         = "webauthn_bound"
+	codeWebAuthnNotBound      = "webauthn_not_bound"
+	codeLegacyPasswordInvalid = "legacy_password_invalid"
+	codeMigrationNotPending   = "migration_not_pending"
+	codeUserNotDeleted        = "user_not_deleted"
+	codeExpired               = "commitment_expired"
+	codeChallengeExpired      = "challenge_expired"
+	codeGroupChanged          = "group_changed"
+	codeNullifierUsed         = "nullifier_used"
+	codeKeyNotFound           = "key_not_found"
+	codeAPIKeyNotFound        = "api_key_not_found"
+	codeAuthPolicyNotFound    = "auth_policy_not_found"
+	codeAuthPolicyDenied      = "auth_policy_denied"
+	codeTranscriptNotFound    = "transcript_not_found"
+	codeKeyExpired            = "key_expired"
+	codeKeyCurrent            = "key_current"
+	codeJobNotFound           = "job_not_found"
+	codeNotFound              = "not_found"
+	codeFeatureDisabled       = "feature_disabled"
+	codeReadOnly              = "read_only"
+	codeUnauthorized          = "unauthorized"
+	codeForbidden             = "forbidden"
+	codePermissionDenied      = "permission_denied"
+	codeCSRFFailed            = "csrf_failed"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeServerBusy            = "server_busy"
+	codeStarting              = "starting"
+	codeTimeout               = "timeout"
+	codeUpstreamFailed        = "upstream_failed"
+	codeReloadFailed          = "reload_failed"
+	codeBatchAborted          = "batch_aborted"
+	codeInternal              = "internal_error"
+)
+
+// Failure reasons refine the proof_invalid or challenge_expired code of a failed verification.
+// They stay coarse: unknown_user, revoked, curve_mismatch and migration_pending are only told apart with
+// reveal_user_existence, as they tell who is registered; otherwise those proofs read
+// pairing_check_failed, like any wrong proof.
+const (
+	reasonUnknownUser        = "unknown_user"         // reasonUnknownUser is a proof for a user name nobody registered
+	reasonRevoked            = "revoked"              // reasonRevoked is a proof for a device that is unknown or revoked
+	reasonExpiredChallenge   = "expired_challenge"    // reasonExpiredChallenge is a nonce unknown, used before or expired
+	reasonProofMalformed     = "proof_malformed"      // reasonProofMalformed is a proof that doesn't decode
+	reasonPairingCheckFailed = "pairing_check_failed" // reasonPairingCheckFailed is a well-formed proof that doesn't verify
+	reasonCurveMismatch      = "curve_mismatch"       // reasonCurveMismatch is a proof over another curve than the registration's
+	reasonMigrationPending   = "migration_pending"    // reasonMigrationPending is a proof for an imported user who hasn't migrated
+)
+
+// failureReasons lists every failure reason, for the OpenAPI description
+var failureReasons = []string{reasonCurveMismatch, reasonExpiredChallenge, reasonMigrationPending, reasonPairingCheckFailed, reasonProofMalformed, reasonRevoked, reasonUnknownUser}
+
+// problemTitles is the short, human-readable summary of each code
+var problemTitles = map[string]string{
+	codeInvalidRequest:        "The request is malformed",
+	codeBodyTooLarge:          "The request body is too large",
+	codeUnsupportedMedia:      "The request body's content type is not accepted here",
+	codeInvalidSecret:         "The secret is not a positive decimal 64-bit integer",
+	codeInvalidCommitment:     "The commitment does not match",
+	codeWeakSecret:            "The secret does not meet the secret policy",
+	codeDIDUnresolvable:       "The DID document of the user name can't be resolved",
+	codeDIDBindingInvalid:     "The commitment is not bound to a key of the DID document",
+	codeUserExists:            "The user already exists",
+	codeCommitmentReused:      "Another user registered the same commitment",
+	codeResaltRequired:        "The secret must be stretched again under a fresh salt",
+	codeUserNotFound:          "The user is not registered",
+	codeProofInvalid:          "The proof is invalid",
+	codeProofReplayed:         "The proof was already accepted",
+	codeTOTPRequired:          "A one-time code is required besides the proof",
+	codeTOTPInvalid:           "The one-time code is wrong, expired or already used",
+	codeTOTPUnenrolled:        "The tenant requires a TOTP enrolment, which an admin must make",
+	codeTOTPNotEnrolled:       "The user has no TOTP enrolment",
+	codeTOTPEnrolled:          "The user already confirmed a TOTP enrolment",
+	codeWebAuthnRequired:      "An assertion of the user's bound hardware key is required besides the proof",
+	codeWebAuthnInvalid:       "The WebAuthn assertion is invalid",
+	codeWebAuthnBound:         "The user is already bound to a WebAuthn credential",
+	codeWebAuthnNotBound:      "The user is not bound to a WebAuthn credential",
+	codeLegacyPasswordInvalid: "The password does not match an imported password hash",
+	codeMigrationNotPending:   "The user has no imported password to migrate from",
+	codeUserNotDeleted:        "The user is not soft-deleted",
+	codeExpired:               "The registration has expired",
+	codeChallengeExpired:      "The challenge is unknown or expired",
+	codeGroupChanged:          "The group changed since the proof was made",
+	codeNullifierUsed:         "The nullifier was already used this epoch",
+	codeKeyNotFound:           "The key version does not exist",
+	codeAPIKeyNotFound:        "The API key does not exist",
+	codeAuthPolicyNotFound:    "The tenant or user has no authentication policy",
+	codeAuthPolicyDenied:      "An authentication policy refuses the login",
+	codeTranscriptNotFound:    "No proof transcript has the requested ID",
+	codeKeyExpired:            "The key version has expired",
+	codeKeyCurrent:            "The key version is current",
+	codeJobNotFound:           "The job does not exist",
+	codeNotFound:              "The resource does not exist",
+	codeFeatureDisabled:       "The feature is disabled on this server",
+	codeReadOnly:              "The server is a read-only replica; writes go to the primary",
+	codeUnauthorized:          "Authentication is required",
+	codeForbidden:             "The client address may not call this route",
+	codePermissionDenied:      "The role of the credential does not allow this operation",
+	codeCSRFFailed:            "The CSRF token is missing or does not match the CSRF cookie",
+	codeRateLimited:           "Too many requests from this client address",
+	codeQuotaExceeded:         "The API key used up its daily or monthly quota",
+	codeServerBusy:            "The server is busy",
+	codeStarting:              "The server is still starting",
+	codeTimeout:               "The request timed out",
+	codeUpstreamFailed:        "An upstream service failed",
+	codeReloadFailed:          "The configuration could not be fully reloaded",
+	codeBatchAborted:          "Another registration in the same chunk failed, so none of it was stored",
+	codeInternal:              "Internal server error",
+}
+
+// Problem is an RFC 7807 problem details body extended with a machine-readable code
+type Problem struct {
+	Type   string `json:"type"` // Type is problemTypePrefix followed by Code
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"` // Detail explains this occurrence; don't parse it
+	Code   string `json:"code"`
+	// Reason tells why a proof_invalid or challenge_expired verification failed, e.g. "pairing_check_failed"
+	Reason string `json:"reason,omitempty"`
+	// RequestID is the request's X-Request-ID, to quote when reporting the failure
+	RequestID string `json:"request_id,omitempty"`
+	// QueuePosition is, when POST /v1/prove is over the proving memory budget, how many proving jobs
+	// hold the budget and must finish before a retry fits
+	QueuePosition int `json:"queue_position,omitempty"`
+	// InvalidParams lists each invalid field of an invalid_request, as in RFC 7807's example
+	InvalidParams []validate.FieldError `json:"invalid_params,omitempty"`
+}
+
+// newProblem builds the problem body for a code
+func newProblem(status int, code, detail string) Problem {
+	return Problem{Type: problemTypePrefix + code, Title: problemTitles[code], Status: status, Detail: detail, Code: code}
+}
+
+// writeProblem answers a request with a problem details body
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	sendProblem(w, newProblem(status, code, detail))
+}
+
+// sendProblem answers a request with a problem already built, quoting the request ID set on the response
+func sendProblem(w http.ResponseWriter, problem Problem) {
+	problem.RequestID = w.Header().Get(requestIDHeader)
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// timeoutProblemWriter labels the body http.TimeoutHandler writes when a handler runs out of time
+type timeoutProblemWriter struct {
+	http.ResponseWriter
+}
+
+// WriteHeader sets the problem content type on a 503 that carries no content type of its own
+func (w timeoutProblemWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", problemContentType)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// timeoutProblemBody is the problem sent when a handler timeout fires
+func timeoutProblemBody() string {
+	body, _ := json.Marshal(newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out"))
+	return string(body)
+}
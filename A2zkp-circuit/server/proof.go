@@ -0,0 +1,927 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/mockzk"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+)
+
+// circuitKeys holds the compiled circuit and the Groth16 keys produced by its setup
+type circuitKeys struct {
+	ccs          constraint.ConstraintSystem
+	provingKey   groth16.ProvingKey
+	verifyingKey groth16.VerifyingKey
+	transcript   *setupTranscript // transcript is the ceremony the keys come from; nil for a single-party setup
+}
+
+// setupCircuitKeys loads the artifacts embedded at build time, stored in Vault, found in
+// cfg.ArtifactsDir or served under cfg.ArtifactsURL, or compiles the configured circuit and runs a
+// fresh setup
+func setupCircuitKeys(ctx context.Context, cfg Config, provider KeyProvider) (*circuitKeys, error) {
+	version := cfg.Circuit.Version()
+	if embeddedArtifacts != nil {
+		keys, loadErr := loadCircuitArtifacts(ctx, embeddedArtifacts, provider, version, circuit.Curve)
+		if loadErr != nil {
+			return nil, fmt.Errorf("loading embedded artifacts: %w", loadErr)
+		}
+		log.Printf("Circuit %s loaded from embedded artifacts: %d constraints", version, keys.ccs.GetNbConstraints())
+		return keys, nil
+	}
+	if cfg.Vault.ArtifactsPath != "" && cfg.vault != nil {
+		artifacts, readErr := readVaultArtifacts(ctx, cfg.vault, cfg.Vault.ArtifactsPath)
+		if readErr != nil {
+			return nil, readErr
+		}
+		keys, loadErr := loadCircuitArtifacts(ctx, artifacts, provider, version, circuit.Curve)
+		if loadErr != nil {
+			return nil, fmt.Errorf("loading artifacts from vault: %w", loadErr)
+		}
+		log.Printf("Circuit %s loaded from vault %s: %d constraints", version, cfg.Vault.ArtifactsPath, keys.ccs.GetNbConstraints())
+		return keys, nil
+	}
+	if cfg.ArtifactsDir != "" {
+		keys, loadErr := loadCircuitArtifacts(ctx, os.DirFS(cfg.ArtifactsDir), provider, version, circuit.Curve)
+		if loadErr != nil {
+			return nil, fmt.Errorf("loading artifacts from %s: %w", cfg.ArtifactsDir, loadErr)
+		}
+		log.Printf("Circuit %s loaded from %s: %d constraints", version, cfg.ArtifactsDir, keys.ccs.GetNbConstraints())
+		return keys, nil
+	}
+	if cfg.ArtifactsURL != "" {
+		keys, loadErr := loadCircuitArtifacts(ctx, newURLArtifacts(cfg, ""), provider, version, circuit.Curve)
+		if loadErr != nil {
+			return nil, fmt.Errorf("loading artifacts from artifacts_url: %w", loadErr)
+		}
+		log.Printf("Circuit %s loaded from artifacts_url: %d constraints", version, keys.ccs.GetNbConstraints())
+		return keys, nil
+	}
+	return compileAndSetup(ctx, cfg.Circuit, circuit.Curve, cfg.MockProver)
+}
+
+// runSetup runs a Groth16 setup for a compiled circuit, or a mock one when mock is set
+func runSetup(ccs constraint.ConstraintSystem, mock bool) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	if mock {
+		return mockzk.Setup(ccs)
+	}
+	return groth16.Setup(ccs)
+}
+
+// compileAndSetup compiles the composed circuit over curve and runs a Groth16 setup for it, a mock
+// one when mock is set
+func compileAndSetup(ctx context.Context, composition circuit.Composition, curve ecc.ID, mock bool) (*circuitKeys, error) {
+	start := time.Now()
+	progress := startupProgressFrom(ctx)
+	compiled := progress.begin(phaseCompiling, composition.Version(), curve)
+	ccs, compileErr := composition.CompileOn(curve)
+	if compileErr != nil {
+		return nil, fmt.Errorf("compiling circuit: %w", compileErr)
+	}
+	compiled(ccs.GetNbConstraints())
+	// Compilation and setup can't be interrupted, so cancellation is checked between them
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	setUp := progress.begin(phaseSettingUp, composition.Version(), curve)
+	provingKey, verifyingKey, setupErr := runSetup(ccs, mock)
+	if setupErr != nil {
+		return nil, fmt.Errorf("groth16 setup: %w", setupErr)
+	}
+	setUp(ccs.GetNbConstraints())
+	log.Printf("Circuit %s (%s) over %s ready: %d constraints, setup took %s", composition.Version(), composition, curve, ccs.GetNbConstraints(), time.Since(start))
+	return &circuitKeys{ccs: ccs, provingKey: provingKey, verifyingKey: verifyingKey}, nil
+}
+
+// lazyKeys holds the keys of an auxiliary circuit, such as the group or policy one, running its
+// setup on first use. They live in memory, so clients need a fresh proving key after a restart.
+type lazyKeys struct {
+	version string
+	compile func() (constraint.ConstraintSystem, error)
+	mock    bool // mock runs a mock setup, as for Config.MockProver
+
+	mu    sync.Mutex
+	keys  *circuitKeys // keys is nil until first use
+	keyID string
+}
+
+// get returns the circuit's keys and key ID, compiling the circuit and running its setup first if needed
+func (l *lazyKeys) get(ctx context.Context) (*circuitKeys, string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.keys != nil {
+		return l.keys, l.keyID, nil
+	}
+	start := time.Now()
+	ccs, compileErr := l.compile()
+	if compileErr != nil {
+		return nil, "", fmt.Errorf("compiling circuit %s: %w", l.version, compileErr)
+	}
+	if ctx.Err() != nil {
+		return nil, "", ctx.Err()
+	}
+	provingKey, verifyingKey, setupErr := runSetup(ccs, l.mock)
+	if setupErr != nil {
+		return nil, "", fmt.Errorf("groth16 setup: %w", setupErr)
+	}
+	keyID, idErr := verifier.KeyID(verifyingKey)
+	if idErr != nil {
+		return nil, "", idErr
+	}
+	log.Printf("Circuit %s ready: %d constraints, setup took %s", l.version, ccs.GetNbConstraints(), time.Since(start))
+	l.keys, l.keyID = &circuitKeys{ccs: ccs, provingKey: provingKey, verifyingKey: verifyingKey}, keyID
+	return l.keys, l.keyID, nil
+}
+
+// id returns the key ID once the keys are set up, and an empty one before
+func (l *lazyKeys) id() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.keyID
+}
+
+// writeLazyKey serves the proving or verifying key of an auxiliary circuit, setting it up if needed,
+// or 304 Not Modified when the client already has the key
+func (s *Server) writeLazyKey(w http.ResponseWriter, r *http.Request, l *lazyKeys, proving bool) {
+	keys, keyID, keysErr := l.get(r.Context())
+	if keysErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up circuit %s: %v", l.version, keysErr))
+		return
+	}
+	w.Header().Set(keyVersionHeader, keyID)
+	kind := "verifying"
+	if proving {
+		kind = "proving"
+	}
+	if s.notModified(w, r, keyETag(keyID, kind), false) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if proving {
+		keys.provingKey.WriteTo(w)
+		return
+	}
+	keys.verifyingKey.WriteTo(w)
+}
+
+// ChallengeRequest represents the structure of a JSON request for a login challenge
+type ChallengeRequest struct {
+	UserName string `json:"user_name"` // The user who is about to prove knowledge of their secret
+	// Tenant is the tenant the user belongs to, if any, so the response names the key of the circuit
+	// tenant_circuits pins it to; the server doesn't infer it, as that would tell registered users apart
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// ChallengeResponse carries the nonce a proof must be bound to
+type ChallengeResponse struct {
+	Nonce     string    `json:"nonce"`      // Nonce is a decimal field element to use as the circuit's nonce input
+	ExpiresAt time.Time `json:"expires_at"` // ExpiresAt is when the nonce stops being accepted
+	KeyID     string    `json:"key_id"`     // KeyID is the current key version the proof should be generated with
+}
+
+// ProofRequest represents the structure of a JSON request submitting a proof for verification
+type ProofRequest struct {
+	UserName string `json:"user_name"`        // The user the proof is claimed for
+	Nonce    string `json:"nonce"`            // The challenge nonce the proof was generated against
+	Proof    []byte `json:"proof,omitempty"`  // The base64-encoded Groth16 proof in gnark binary encoding
+	KeyID    string `json:"key_id,omitempty"` // The key version the proof was generated with; the current one when omitted
+	Device   string `json:"device,omitempty"` // The label of the device whose commitment the proof is for; every active one is tried when omitted
+	Curve    string `json:"curve,omitempty"`  // The curve the proof was made over, one of the configured curves; bn254 when omitted
+	// CryptoCommitment is the commitment the proof is for, which a server with commitment_blinding
+	// keeps only a keyed hash of and can't verify against otherwise
+	CryptoCommitment string `json:"crypto_commitment,omitempty"`
+	// ProofEncoding is how Proof's points are encoded: "compressed", the default and what
+	// prover.EncodeProof writes, or "uncompressed", what prover.EncodeUncompressedProof writes
+	ProofEncoding string `json:"proof_encoding,omitempty"`
+	// Envelope replaces Proof, Curve and ProofEncoding with a versioned proof envelope naming them,
+	// and the circuit version the proof is for
+	Envelope *verifier.ProofEnvelope `json:"proof_envelope,omitempty"`
+	// SnarkJSProof replaces Proof with the proof.json of an equivalent circom circuit when
+	// snarkjs_verifying_key is configured; its public signals must be the commitment, then the nonce
+	SnarkJSProof *verifier.SnarkJSProof `json:"snarkjs_proof,omitempty"`
+	// TOTPCode is the one-time code of the user's authenticator app, checked once the proof verifies
+	// when the tenant's TOTP policy asks for one
+	TOTPCode string `json:"totp_code,omitempty"`
+	// WebAuthn is the assertion of the hardware key the registration is bound to, if it is, made
+	// over the SHA-256 of Nonce
+	WebAuthn *WebAuthnAssertion `json:"webauthn,omitempty"`
+
+	circuitVersion string // circuitVersion is the version a protobuf proof or envelope declares; empty when it declares none
+	stepUpSession  string // stepUpSession is the ID of the session a step-up proof elevates; empty for logins
+}
+
+// maxProofLength bounds the encoded proof; a BN254 Groth16 proof is a few hundred bytes
+const maxProofLength = 4096
+
+// validate checks the request fields, after opening a proof envelope, and returns the parsed nonce
+func (req *ProofRequest) validate() (*big.Int, error) {
+	var v validate.Validator
+	nonce := req.validateInto(&v)
+	return nonce, v.Err()
+}
+
+// validateInto records the invalid fields of the request in v, after opening a proof envelope
+// into the fields it stands for, and returns the parsed nonce
+func (req *ProofRequest) validateInto(v *validate.Validator) *big.Int {
+	req.openEnvelopeInto(v)
+	v.UserID("user_name", req.UserName)
+	nonce := v.FieldElement("nonce", req.Nonce)
+	switch {
+	case req.Envelope != nil:
+		// An envelope left unopened has been reported
+	case len(req.Proof) == 0 && req.SnarkJSProof == nil:
+		v.Fail("proof", "is required")
+	case len(req.Proof) > 0 && req.SnarkJSProof != nil:
+		v.Fail("snarkjs_proof", "can't be sent with proof")
+	default:
+		v.MaxLength("proof", len(req.Proof), maxProofLength)
+	}
+	req.validateEncodingInto(v)
+	v.KeyID("key_id", req.KeyID)
+	if req.TOTPCode != "" && !validTOTPCode(req.TOTPCode) {
+		v.Fail("totp_code", "must be %d digits", totpDigits)
+	}
+	if req.WebAuthn != nil {
+		req.WebAuthn.validateInto(v, "webauthn.")
+	}
+	if req.Device != "" {
+		v.Text("device", req.Device, maxDeviceLabelLength)
+	}
+	curve := circuit.Curve
+	if req.Curve != "" {
+		var curveErr error
+		if curve, curveErr = circuit.ParseCurve(req.Curve); curveErr != nil {
+			v.Fail("curve", "is not a supported curve")
+		}
+	}
+	if req.CryptoCommitment != "" {
+		v.FieldElementOn(curve, "crypto_commitment", req.CryptoCommitment)
+	}
+	return nonce
+}
+
+// openEnvelopeInto moves the proof of a proof_envelope into Proof, Curve and ProofEncoding,
+// translated if it came from an older gnark release, recording in v an envelope the server can't
+// read or one sent with those fields. The envelope is dropped once open.
+func (req *ProofRequest) openEnvelopeInto(v *validate.Validator) {
+	envelope := req.Envelope
+	switch {
+	case envelope == nil:
+		return
+	case len(req.Proof) > 0 || req.SnarkJSProof != nil || req.Curve != "" || req.ProofEncoding != "":
+		v.Fail("proof_envelope", "can't be sent with proof, snarkjs_proof, curve or proof_encoding")
+		return
+	case len(envelope.Payload) > maxProofLength:
+		v.MaxLength("proof_envelope.payload", len(envelope.Payload), maxProofLength)
+		return
+	}
+	payload, openErr := envelope.Open()
+	if openErr != nil {
+		v.Fail("proof_envelope", "%v", openErr)
+		return
+	}
+	req.Proof, req.Curve, req.ProofEncoding, req.Envelope = payload, envelope.Curve, envelope.Encoding, nil
+	if envelope.CircuitVersion != "" {
+		req.circuitVersion = envelope.CircuitVersion
+	}
+}
+
+// validateEncodingInto records in v a proof_encoding that isn't one, or that the proof isn't in.
+// Proofs that don't decode are left for verification to reject, as they are without one.
+func (req ProofRequest) validateEncodingInto(v *validate.Validator) {
+	switch {
+	case req.ProofEncoding == "" && len(req.Proof) == 0:
+		return
+	case req.ProofEncoding != "" && req.ProofEncoding != verifier.ProofCompressed && req.ProofEncoding != verifier.ProofUncompressed:
+		v.Fail("proof_encoding", "must be %s or %s", verifier.ProofCompressed, verifier.ProofUncompressed)
+		return
+	case req.SnarkJSProof != nil:
+		v.Fail("proof_encoding", "applies to proof, not snarkjs_proof")
+		return
+	}
+	curve, curveErr := circuit.ParseCurve(req.curve())
+	if curveErr != nil || len(req.Proof) > maxProofLength {
+		return
+	}
+	encoding, encodingErr := verifier.ProofEncoding(curve, req.Proof)
+	switch {
+	case errors.Is(encodingErr, verifier.ErrProofEncoding):
+		v.Fail("proof", "mixes point encodings or has trailing bytes")
+	case encodingErr == nil && encoding != req.proofEncoding():
+		v.Fail("proof_encoding", "is %s but the proof is %s", req.proofEncoding(), encoding)
+	}
+}
+
+// challengeHolder is who the request's nonce was issued to: the user, or the session a step-up
+// challenge was issued for
+func (req ProofRequest) challengeHolder() string {
+	if req.stepUpSession != "" {
+		return stepUpChallengeKey(req.stepUpSession)
+	}
+	return req.UserName
+}
+
+// proofEncoding is the point encoding the request declares, compressed when it declares none
+func (req ProofRequest) proofEncoding() string {
+	if req.ProofEncoding == "" {
+		return verifier.ProofCompressed
+	}
+	return req.ProofEncoding
+}
+
+// validate checks the user name and tenant
+func (req ChallengeRequest) validate() error {
+	var v validate.Validator
+	v.UserID("user_name", req.UserName)
+	if req.Tenant != "" {
+		v.Text("tenant", req.Tenant, maxTenantLength)
+	}
+	return v.Err()
+}
+
+// challengeHandler issues a single-use nonce to a registered user
+func (s *Server) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	var req ChallengeRequest
+	if decodeErr := decodeBody(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	// Unknown users get a nonce too unless user existence may be revealed; their proofs fail as invalid
+	user, getErr := s.getUser(r.Context(), req.UserName)
+	if getErr != nil && s.cfg.RevealUserExistence {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "Unknown user")
+		return
+	}
+
+	keyID := s.keyring.current().ID
+	keyCircuit := s.pinnedCircuit(req.Tenant)
+	// Under a canary the key is that of the circuit the user is bound to, and for unknown users that
+	// of the circuit they would register under now; only users registered before their name was
+	// routed to the canary are told apart from unknown ones
+	if keyCircuit == nil && (getErr == nil && s.boundToCanary(user) || getErr != nil && s.routesToCanary(req.Tenant, req.UserName, "")) {
+		keyCircuit = s.canary
+	}
+	if keyCircuit != nil {
+		version, keyErr := keyCircuit.keyVersion(r.Context(), ProofRequest{})
+		if keyErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up circuit %s: %v", keyCircuit.composition.Version(), keyErr))
+			return
+		}
+		keyID = version.ID
+	}
+
+	nonce, expiresAt, issueErr := s.challenges.issue(r.Context(), req.UserName)
+	if issueErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error issuing challenge: %v", issueErr))
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, ChallengeResponse{Nonce: nonce.String(), ExpiresAt: expiresAt, KeyID: keyID})
+}
+
+// verifyProofHandler checks a proof of knowledge of the secret behind a user's stored commitment
+func (s *Server) verifyProofHandler(w http.ResponseWriter, r *http.Request) {
+	var req ProofRequest
+	if decodeErr := decodeBody(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+
+	_, version, authErr := s.authenticate(r.Context(), req, nonce)
+	if authErr != nil {
+		s.writeAuthError(w, req, authErr)
+		return
+	}
+	verdict, signErr := s.signVerdict(r.Context(), req.UserName, version.ID, nonce)
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error signing verdict: %v", signErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, VerificationResponse{StatusResponse: StatusResponse{Status: "Proof is valid", KeyID: version.ID}, Verdict: verdict})
+}
+
+// ErrInvalidProof is returned when a proof does not verify for the claimed user
+var ErrInvalidProof = errors.New("invalid proof")
+
+// ErrCommitmentExpired is returned for a valid proof of a registration past its expiry
+var ErrCommitmentExpired = errors.New("registration expired")
+
+// Why a proof was invalid, joined to ErrInvalidProof for failureReason
+var (
+	errUnknownUser    = errors.New("unknown user")
+	errDeviceRevoked  = errors.New("unknown or revoked device")
+	errCurveMismatch  = errors.New("proof over another curve than the registration's")
+	errProofMalformed = errors.New("malformed proof")
+)
+
+// invalidProof wraps a failed verification in ErrInvalidProof, marking any failure but the pairing
+// check as a malformed proof
+func invalidProof(verifyErr error) error {
+	if errors.Is(verifyErr, verifier.ErrRejected) {
+		return errors.Join(ErrInvalidProof, verifyErr)
+	}
+	return errors.Join(ErrInvalidProof, errProofMalformed, verifyErr)
+}
+
+// proofCommitments lists the commitments a proof for a user may match: the named device's alone when
+// the request names one, otherwise every active one, with blinded ones resolved against the request's
+// crypto_commitment. ok is false when the user has no active device of that label.
+func (s *Server) proofCommitments(user store.User, req ProofRequest) (_ []string, ok bool) {
+	if req.Device == "" {
+		return s.blinder.resolve(user.ActiveCommitments(), req.CryptoCommitment), true
+	}
+	for _, d := range user.Devices {
+		if d.Label == req.Device && d.RevokedAt == nil {
+			return s.blinder.resolve([]string{d.CryptoCommitment}, req.CryptoCommitment), true
+		}
+	}
+	return nil, false
+}
+
+// authenticate checks a validated proof submission end to end: the checks of checkProof, then
+// the second factors, the user's auth policy and the transcript. It returns the user, with
+// CryptoCommitment set to the commitment the proof matched, and the key version it verified under.
+func (s *Server) authenticate(ctx context.Context, req ProofRequest, nonce *big.Int) (_ store.User, _ *keyVersion, authErr error) {
+	var outcome proofOutcome
+	defer func() { s.recordLogin(ctx, req.UserName, outcome.user.Tenant, outcome.latency, authErr) }()
+	if !s.cfg.RevealUserExistence {
+		started := time.Now()
+		defer func() {
+			if authErr != nil && !errors.Is(authErr, ErrPoolBusy) {
+				s.padLatency(ctx, started)
+			}
+		}()
+	}
+	outcome, authErr = s.checkProof(ctx, req, nonce, false)
+	if authErr != nil {
+		return store.User{}, nil, authErr
+	}
+	user, version := outcome.user, outcome.version
+	// The second checks only run for someone holding the secret, so their failures reveal nothing
+	// either; a rejected assertion or code needs a fresh proof, as the nonce is consumed
+	if webauthnErr := s.checkWebAuthn(ctx, req, user.UserName, nonce); webauthnErr != nil {
+		return store.User{}, nil, webauthnErr
+	}
+	if totpErr := s.checkTOTP(ctx, req, user.UserName, user.Tenant); totpErr != nil {
+		return store.User{}, nil, totpErr
+	}
+	if policyErr := s.checkAuthPolicy(ctx, req, user, version); policyErr != nil {
+		return store.User{}, nil, policyErr
+	}
+	if transcriptErr := s.recordTranscript(ctx, req, user, version, nonce); transcriptErr != nil {
+		return store.User{}, nil, transcriptErr
+	}
+	return user, version, nil
+}
+
+// proofOutcome is what checkProof found out about a submission, failed or not
+type proofOutcome struct {
+	user     store.User // user is the decoy for an unknown user; on success CryptoCommitment is the one matched
+	version  *keyVersion
+	verified bool          // verified is whether the pairing check ran and passed
+	latency  time.Duration // latency is how long the pairing check took
+}
+
+// checkProof runs the checks authenticate and the dry run share: the key version, the user, the
+// challenge, the pairing check against each of the user's active commitments, expiry and the replay
+// cache. With dryRun set it has no side effects: the nonce is looked up rather than consumed, the
+// replay cache is only read, nothing is recorded towards verdicts or metrics, and unknown users and
+// mismatches are reported as under reveal_user_existence.
+func (s *Server) checkProof(ctx context.Context, req ProofRequest, nonce *big.Int, dryRun bool) (outcome proofOutcome, checkErr error) {
+	reveal := s.cfg.RevealUserExistence || dryRun
+	user, getErr := s.getUser(ctx, req.UserName)
+	unknown := getErr != nil
+	if unknown && reveal {
+		return outcome, errors.Join(ErrInvalidProof, errUnknownUser)
+	}
+	if unknown {
+		// An unknown user's proof is checked against a decoy so it costs the same pairing check as a wrong one
+		user = store.User{UserName: req.UserName, CryptoCommitment: decoyCommitment}
+	}
+	outcome.user = user
+	version, keyErr := s.proofKeyVersion(ctx, req, user)
+	if keyErr != nil {
+		return outcome, keyErr
+	}
+	outcome.version = version
+	if !dryRun {
+		defer func() {
+			if checkErr == nil || errors.Is(checkErr, ErrInvalidProof) {
+				s.metrics.observeVerification(cmp.Or(version.CircuitVersion, s.circuitVersion), checkErr == nil)
+			}
+		}()
+	}
+	commitments, ok := s.proofCommitments(user, req)
+	var mismatchErr error
+	switch {
+	case user.Pending():
+		// An imported user has no commitment until they migrate with their password
+		mismatchErr = errMigrationPending
+	case !ok:
+		mismatchErr = errDeviceRevoked
+	case s.userCurve(user) != req.curve():
+		mismatchErr = errCurveMismatch
+	}
+	if mismatchErr != nil {
+		// An unknown or revoked device, or a proof over another curve than the registration's, is
+		// rejected after the same pairing check as a wrong proof
+		unknown, commitments = true, []string{decoyCommitment}
+	}
+
+	// An identical retry of a submission already rejected is rejected again, as the first attempt
+	// was, rather than for its consumed nonce. Retries of accepted submissions still fail on the
+	// nonce, or the replay cache, so a proof logs in once.
+	cached, verifyErr := s.cachedRejection(version, req, commitments, nonce)
+
+	// The pairing check runs on the worker pool, waiting in its admission queue through a burst. The
+	// nonce is only consumed once a worker picks the job up, so a client turned away because the
+	// queue is full can retry with the same challenge.
+	var consumeErr, poolErr error
+	if !cached {
+		poolErr = s.pool.Admit(ctx, func() {
+			// The nonce is consumed before verifying so a failed attempt can't be retried against it.
+			// A dry run still makes the pairing check, to report it whatever else failed.
+			if dryRun {
+				consumeErr = s.challenges.peek(ctx, req.challengeHolder(), nonce)
+			} else if consumeErr = s.challenges.consume(ctx, req.challengeHolder(), nonce); consumeErr != nil {
+				return
+			}
+			verifyStarted := time.Now()
+			for _, commitment := range commitments {
+				inputs := verifier.PublicInputs{Commitment: commitment, Nonce: nonce}
+				if req.SnarkJSProof != nil {
+					verifyErr = s.snarkJS.verifier.VerifyProof(ctx, *req.SnarkJSProof, inputs)
+				} else {
+					verifyErr = verifier.New(version.keys.verifyingKey).VerifyProof(ctx, req.Proof, inputs)
+				}
+				if !dryRun {
+					s.verdicts.Store(version.ID, proofBytes(req), inputs, verifyErr)
+				}
+				if !errors.Is(verifyErr, verifier.ErrRejected) {
+					user.CryptoCommitment = commitment
+					break
+				}
+			}
+			outcome.verified, outcome.latency = verifyErr == nil, time.Since(verifyStarted)
+			if !dryRun {
+				s.observeProof(proofVerify, version, req.curve(), outcome.latency, len(proofBytes(req)))
+			}
+		})
+	}
+	switch {
+	case poolErr != nil:
+		return outcome, poolErr
+	case consumeErr != nil:
+		return outcome, consumeErr
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		return outcome, verifyErr
+	case mismatchErr != nil && reveal:
+		return outcome, errors.Join(ErrInvalidProof, mismatchErr)
+	case verifyErr != nil:
+		return outcome, invalidProof(verifyErr)
+	case unknown:
+		return outcome, ErrInvalidProof
+	case user.Expired(time.Now()):
+		// Only someone holding the secret gets this far, so telling them apart reveals nothing
+		return outcome, ErrCommitmentExpired
+	}
+	// Only proofs that verified are recorded, so a replay can't lock out the honest submission; a
+	// dry run only looks the proof up
+	if dryRun {
+		if replayed, seenErr := s.replays.seen(ctx, proofBytes(req)); seenErr != nil || replayed {
+			return outcome, cmp.Or(seenErr, ErrProofReplayed)
+		}
+	} else if replayErr := s.replays.accept(ctx, proofBytes(req)); replayErr != nil {
+		return outcome, replayErr
+	}
+	outcome.user = user
+	return outcome, nil
+}
+
+// cachedRejection reports whether the verdict cache holds a failure of a proof request against
+// every commitment it would be checked against, and returns the last one
+func (s *Server) cachedRejection(version *keyVersion, req ProofRequest, commitments []string, nonce *big.Int) (bool, error) {
+	var verdict error
+	for _, commitment := range commitments {
+		var found bool
+		verdict, found = s.verdicts.Lookup(version.ID, proofBytes(req), verifier.PublicInputs{Commitment: commitment, Nonce: nonce})
+		if !found || verdict == nil {
+			return false, nil
+		}
+		if !errors.Is(verdict, verifier.ErrRejected) {
+			break
+		}
+	}
+	return verdict != nil, verdict
+}
+
+// ErrSnarkJSDisabled is returned for a snarkjs proof when no snarkjs_verifying_key is configured
+var ErrSnarkJSDisabled = errors.New("snarkjs proofs are not accepted")
+
+// snarkJSKey is the verifying key of a circom circuit equivalent to circuit.Circuit
+type snarkJSKey struct {
+	version  *keyVersion // version names the key for responses and tokens; it holds no gnark keys
+	verifier *verifier.SnarkJSVerifier
+}
+
+// loadSnarkJSKey reads snarkjs_verifying_key; it returns nil when none is configured
+func loadSnarkJSKey(path string) (*snarkJSKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, fmt.Errorf("snarkjs_verifying_key: %w", openErr)
+	}
+	defer file.Close()
+	snarkVerifier, loadErr := verifier.LoadSnarkJSVerifyingKey(file)
+	if loadErr != nil {
+		return nil, fmt.Errorf("snarkjs_verifying_key: %w", loadErr)
+	}
+	log.Printf("Accepting snarkjs proofs against %s", snarkVerifier.KeyID())
+	return &snarkJSKey{version: &keyVersion{ID: snarkVerifier.KeyID()}, verifier: snarkVerifier}, nil
+}
+
+// proofKeyVersion resolves the key a proof request for a user targets: the key of the circuit
+// tenant_circuits pinned the user's tenant to when they registered, the key of its curve for a
+// proof over an additional curve, the snarkjs key for a snarkjs proof, which key_id may name, and
+// otherwise the key version named by key_id
+func (s *Server) proofKeyVersion(ctx context.Context, req ProofRequest, user store.User) (*keyVersion, error) {
+	if pinned := s.userCircuit(user, req); pinned != nil {
+		return pinned.keyVersion(ctx, req)
+	}
+	if req.circuitVersion != "" && req.circuitVersion != s.circuitVersion {
+		return nil, badRequest("proof: this server verifies circuit_version %q", s.circuitVersion)
+	}
+	if req.curve() != circuit.Curve.String() {
+		return s.curveKeyVersion(ctx, req)
+	}
+	if req.SnarkJSProof == nil {
+		return s.keyring.lookup(req.KeyID)
+	}
+	switch {
+	case s.snarkJS == nil:
+		return nil, ErrSnarkJSDisabled
+	case req.KeyID != "" && req.KeyID != s.snarkJS.version.ID:
+		return nil, ErrKeyNotFound
+	}
+	return s.snarkJS.version, nil
+}
+
+// curve is the curve the proof was made over
+func (req ProofRequest) curve() string {
+	if req.Curve == "" {
+		return circuit.Curve.String()
+	}
+	return req.Curve
+}
+
+// decoyCommitment stands in for the stored commitment of a user who isn't registered
+const decoyCommitment = "0"
+
+// padLatency sleeps until failure_latency has passed since started, so failures and registrations
+// take the same time whatever the store lookup found. It returns early when ctx is done.
+func (s *Server) padLatency(ctx context.Context, started time.Time) {
+	remaining := time.Until(started.Add(s.cfg.FailureLatency.Duration))
+	if remaining <= 0 {
+		return
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// authFailure maps an authenticate error to the status, problem code and message reported to the client
+func authFailure(req ProofRequest, err error) (int, string, string) {
+	var requestErr *requestError
+	switch {
+	case errors.As(err, &requestErr):
+		return requestErr.status, requestErr.code, requestErr.message
+	case errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyExpired):
+		return http.StatusUnauthorized, keyProblemCode(err), fmt.Sprintf("Key version %q: %v", req.KeyID, err)
+	case errors.Is(err, ErrPoolBusy):
+		return http.StatusServiceUnavailable, codeServerBusy, "Server is busy, retry later"
+	case errors.Is(err, ErrSnarkJSDisabled):
+		return http.StatusForbidden, codeFeatureDisabled, "snarkjs proofs are not accepted: no snarkjs_verifying_key is configured"
+	case errors.Is(err, ErrChallengeNotFound):
+		return http.StatusUnauthorized, codeChallengeExpired, "Unknown or expired challenge"
+	case errors.Is(err, ErrInvalidProof):
+		return http.StatusUnauthorized, codeProofInvalid, "Invalid proof"
+	case errors.Is(err, ErrCommitmentExpired):
+		return http.StatusUnauthorized, codeExpired, "The registration has expired"
+	case errors.Is(err, ErrProofReplayed):
+		return http.StatusUnauthorized, codeProofReplayed, "This proof was already accepted; prove again"
+	case errors.Is(err, ErrWebAuthnRequired):
+		return http.StatusUnauthorized, codeWebAuthnRequired, "The user is bound to a hardware key; prove again with a webauthn assertion"
+	case errors.Is(err, ErrWebAuthnInvalid):
+		return http.StatusUnauthorized, codeWebAuthnInvalid, err.Error()
+	case errors.Is(err, ErrTOTPRequired):
+		return http.StatusUnauthorized, codeTOTPRequired, "The user enrolled TOTP; prove again with totp_code"
+	case errors.Is(err, ErrTOTPInvalid):
+		return http.StatusUnauthorized, codeTOTPInvalid, "The one-time code is wrong, expired or already used; prove again with a current one"
+	case errors.Is(err, ErrTOTPEnrollmentRequired):
+		return http.StatusForbidden, codeTOTPUnenrolled, "The user's tenant requires TOTP and the user hasn't enrolled"
+	case errors.Is(err, ErrAuthPolicyDenied):
+		return http.StatusForbidden, codeAuthPolicyDenied, err.Error()
+	case errors.Is(err, store.ErrReadOnly):
+		return http.StatusForbidden, codeReadOnly, "The login must record the user's one-time code or hardware key counter, which a read-only replica can't; log in through the primary"
+	default:
+		return http.StatusServiceUnavailable, codeTimeout, "Request cancelled"
+	}
+}
+
+// authProblem is the problem reported for an authenticate error, with the failure reason of a
+// rejected proof or challenge
+func authProblem(req ProofRequest, err error) Problem {
+	status, code, message := authFailure(req, err)
+	problem := newProblem(status, code, message)
+	problem.Reason = failureReason(err)
+	return problem
+}
+
+// failureReason is the failure reason of a rejected proof or challenge, empty for other errors.
+// A proof that is merely invalid reads pairing_check_failed.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrChallengeNotFound):
+		return reasonExpiredChallenge
+	case !errors.Is(err, ErrInvalidProof):
+		return ""
+	case errors.Is(err, errUnknownUser):
+		return reasonUnknownUser
+	case errors.Is(err, errDeviceRevoked):
+		return reasonRevoked
+	case errors.Is(err, errCurveMismatch):
+		return reasonCurveMismatch
+	case errors.Is(err, errMigrationPending):
+		return reasonMigrationPending
+	case errors.Is(err, errProofMalformed):
+		return reasonProofMalformed
+	}
+	return reasonPairingCheckFailed
+}
+
+// keyProblemCode tells an expired key version apart from one that never existed
+func keyProblemCode(err error) string {
+	if errors.Is(err, ErrKeyExpired) {
+		return codeKeyExpired
+	}
+	return codeKeyNotFound
+}
+
+// writeAuthError reports an authenticate error, with a Retry-After hint when the pool is full
+func (s *Server) writeAuthError(w http.ResponseWriter, req ProofRequest, err error) {
+	if errors.Is(err, ErrPoolBusy) {
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	}
+	sendProblem(w, authProblem(req, err))
+}
+
+// keyVersionHeader names the key version of a served key
+const keyVersionHeader = "X-Key-ID"
+
+// requestedKeyVersion resolves the ?key_id= query parameter, defaulting to the current version
+func (s *Server) requestedKeyVersion(w http.ResponseWriter, r *http.Request) (*keyVersion, bool) {
+	version, keyErr := s.keyring.lookup(r.URL.Query().Get("key_id"))
+	if keyErr != nil {
+		writeProblem(w, http.StatusNotFound, keyProblemCode(keyErr), fmt.Sprintf("Key version: %v", keyErr))
+		return nil, false
+	}
+	w.Header().Set(keyVersionHeader, version.ID)
+	return version, true
+}
+
+// requestedCurveKeyVersion resolves the ?curve= query parameter along with ?key_id=, for the keys
+// that also exist on the additional curves, and ?tenant= or ?user_name=, for those of the circuit a
+// tenant is pinned to or of the canary, as requestedCircuit does
+func (s *Server) requestedCurveKeyVersion(w http.ResponseWriter, r *http.Request) (*keyVersion, bool) {
+	query := r.URL.Query()
+	request := ProofRequest{Curve: query.Get("curve"), KeyID: query.Get("key_id")}
+	var version *keyVersion
+	var keyErr error
+	switch pinned := s.requestedCircuit(query); {
+	case pinned != nil:
+		version, keyErr = pinned.keyVersion(r.Context(), request)
+	case request.curve() == circuit.Curve.String():
+		return s.requestedKeyVersion(w, r)
+	default:
+		version, keyErr = s.curveKeyVersion(r.Context(), request)
+	}
+	var requestErr *requestError
+	switch {
+	case errors.As(keyErr, &requestErr):
+		writeRequestError(w, keyErr)
+		return nil, false
+	case errors.Is(keyErr, ErrKeyNotFound):
+		writeProblem(w, http.StatusNotFound, keyProblemCode(keyErr), fmt.Sprintf("Key version: %v", keyErr))
+		return nil, false
+	case keyErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up keys over %s: %v", request.curve(), keyErr))
+		return nil, false
+	}
+	w.Header().Set(keyVersionHeader, version.ID)
+	return version, true
+}
+
+// CircuitResponse describes the configured authentication circuit, so clients can build matching
+// commitments and witnesses and check they prove the statement the server verifies
+type CircuitResponse struct {
+	Version     string              `json:"version"`     // Version is recorded on new registrations, e.g. "v1" or "c-1a2b3c4d5e6f7a8b"
+	Composition circuit.Composition `json:"composition"` // Composition names the gadgets the circuit is assembled from
+	Curve       string              `json:"curve"`
+	Curves      []string            `json:"curves"`    // Curves lists every curve proofs are verified over, Curve first
+	Backend     string              `json:"backend"`   // Backend is the proof system, "groth16" or, under mock_prover, "mock"
+	Statement   string              `json:"statement"` // Statement is a human-readable description of the constraints
+	Constraints int                 `json:"constraints"`
+	// PublicInputs lists the public inputs in the order of the public witness, with their encodings
+	PublicInputs []circuit.PublicInput `json:"public_inputs"`
+	KeyID        string                `json:"key_id"` // KeyID is the current key version
+	// VerifyingKeyHash is the whole SHA-256 of the current verifying key, e.g. "sha256:9f86…"
+	VerifyingKeyHash string `json:"verifying_key_hash"`
+	Mock             bool   `json:"mock,omitempty"` // Mock is set when mock_prover makes every proof a fake
+	// KDFs lists the registered parameter sets secrets may be stretched with, the one to register
+	// with by default first; provers of a registration use the parameters it stored
+	KDFs []secret.KDFParams `json:"kdfs"`
+}
+
+// circuitHandler describes the configured circuit, or the one a tenant is pinned to or the canary
+// when the query names them, as requestedCircuit does
+func (s *Server) circuitHandler(w http.ResponseWriter, r *http.Request) {
+	if pinned := s.requestedCircuit(r.URL.Query()); pinned != nil {
+		s.tenantCircuitHandler(w, r, pinned)
+		return
+	}
+	version := s.keyring.current()
+	keyHash, hashErr := verifier.KeyHash(version.keys.verifyingKey)
+	if hashErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error hashing verifying key: %v", hashErr))
+		return
+	}
+	backend := "groth16"
+	if s.cfg.MockProver {
+		backend = "mock"
+	}
+	s.writeCachedResponse(w, r, CircuitResponse{
+		Version:          s.circuitVersion,
+		Composition:      s.cfg.Circuit,
+		Curve:            s.circuits[s.circuitVersion].Curve,
+		Curves:           s.curveNames(),
+		Backend:          backend,
+		Statement:        s.circuits[s.circuitVersion].Statement,
+		Constraints:      version.keys.ccs.GetNbConstraints(),
+		PublicInputs:     s.cfg.Circuit.PublicInputs(),
+		KeyID:            version.ID,
+		VerifyingKeyHash: keyHash,
+		Mock:             s.cfg.MockProver,
+		KDFs:             s.kdfRegistry(),
+	})
+}
+
+// provingKeyHandler serves a Groth16 proving key so clients can prove locally
+func (s *Server) provingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := s.requestedCurveKeyVersion(w, r)
+	if !ok || s.notModified(w, r, keyETag(version.ID, "proving"), r.URL.Query().Has("key_id")) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	version.keys.provingKey.WriteTo(w)
+}
+
+// verifyingKeyHandler serves a Groth16 verifying key
+func (s *Server) verifyingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := s.requestedCurveKeyVersion(w, r)
+	if !ok || s.notModified(w, r, keyETag(version.ID, "verifying"), r.URL.Query().Has("key_id")) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	version.keys.verifyingKey.WriteTo(w)
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/verifier"
+	"A2zkp-circuit/wire"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"google.golang.org/protobuf/proto"
+)
+
+// isProtobuf reports whether a Content-Type or media range names the protobuf encoding
+func isProtobuf(mediaType string) bool {
+	parsed, _, _ := mime.ParseMediaType(mediaType)
+	// application/protobuf is the registered name; x-protobuf is what most clients still send
+	return parsed == wire.ContentType || parsed == "application/protobuf"
+}
+
+// isValueMessage reports whether a Content-Type names a google.protobuf.Value body, the protobuf
+// form of a JSON document that endpoints without a message of their own take
+func isValueMessage(contentType string) bool {
+	_, params, _ := mime.ParseMediaType(contentType)
+	return isProtobuf(contentType) && params["proto"] == wire.ValueMessage
+}
+
+// acceptance is how an Accept header weighs one media type: by the q of the most specific range
+// matching it, from 1 for */* to 3 for the type itself, 0 when none does
+type acceptance struct {
+	q           float64
+	specificity int
+	index       int // index is the position in the header of the range that set q
+}
+
+// accepted weighs the media type that matches recognizes in an Accept header; ranges that don't
+// parse, or whose q isn't a number from 0 to 1, are ignored
+func accepted(accept string, matches func(mediaType string) bool) acceptance {
+	var best acceptance
+	for index, mediaRange := range strings.Split(accept, ",") {
+		parsed, params, parseErr := mime.ParseMediaType(mediaRange)
+		if parseErr != nil {
+			continue
+		}
+		specificity := 0
+		switch {
+		case matches(parsed):
+			specificity = 3
+		case parsed == "application/*":
+			specificity = 2
+		case parsed == "*/*":
+			specificity = 1
+		}
+		if specificity <= best.specificity {
+			continue
+		}
+		q := 1.0
+		if text, hasQ := params["q"]; hasQ {
+			var qErr error
+			if q, qErr = strconv.ParseFloat(text, 64); qErr != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		best = acceptance{q: q, specificity: specificity, index: index}
+	}
+	return best
+}
+
+// wantsProtobuf reports whether the response should be protobuf: when Accept weighs it above JSON,
+// or lists the one it weighs equally first. When Accept names neither, or only through one wildcard,
+// the request's own Content-Type decides.
+func wantsProtobuf(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	protobufWeight := accepted(accept, isProtobuf)
+	jsonWeight := accepted(accept, func(mediaType string) bool { return mediaType == "application/json" })
+	switch {
+	case protobufWeight.q != jsonWeight.q:
+		return protobufWeight.q > jsonWeight.q
+	case protobufWeight.specificity == 0 && jsonWeight.specificity == 0, protobufWeight.q > 0 && protobufWeight.index == jsonWeight.index:
+		return isProtobuf(r.Header.Get("Content-Type"))
+	case protobufWeight.q == 0:
+		return false // both refused; problems and JSON are what's left
+	default:
+		return protobufWeight.index < jsonWeight.index
+	}
+}
+
+// protobufRequest is a request type that can also be decoded from its wire message
+type protobufRequest interface {
+	unmarshalProtobuf(data []byte) error
+}
+
+// protobufResponse is a response type that can also be encoded as its wire message
+type protobufResponse interface {
+	protobufMessage() proto.Message
+}
+
+// protobufBody encodes body as its wire message when the client asked for protobuf and body has one.
+// A message holding a string that isn't valid UTF-8 can't be encoded; that body goes out as JSON.
+func protobufBody(r *http.Request, body any) ([]byte, bool) {
+	response, hasProtobuf := body.(protobufResponse)
+	if !hasProtobuf || !wantsProtobuf(r) {
+		return nil, false
+	}
+	message, marshalErr := proto.Marshal(response.protobufMessage())
+	return message, marshalErr == nil
+}
+
+// decodeBody decodes a JSON or protobuf request body of at most limit bytes into dst,
+// choosing by Content-Type
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, dst protobufRequest) error {
+	contentType := r.Header.Get("Content-Type")
+	if !isProtobuf(contentType) || isValueMessage(contentType) {
+		return decodeJSON(w, r, limit, dst)
+	}
+	data, readErr := readProtobuf(w, r, limit)
+	if readErr != nil {
+		return readErr
+	}
+	return dst.unmarshalProtobuf(data)
+}
+
+// readProtobuf reads a protobuf request body of at most limit bytes
+func readProtobuf(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	data, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(readErr, &maxBytesErr):
+		return nil, &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    codeBodyTooLarge,
+			message: fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit),
+		}
+	case readErr != nil:
+		return nil, badRequest("Error reading request body: %v", readErr)
+	case len(data) == 0:
+		return nil, badRequest("Request body is empty")
+	}
+	return data, nil
+}
+
+// valueBodyAsJSON replaces a google.protobuf.Value request body with the JSON document it holds,
+// for decodeJSON to read like any other
+func valueBodyAsJSON(w http.ResponseWriter, r *http.Request, limit int64) error {
+	data, readErr := readProtobuf(w, r, limit)
+	if readErr != nil {
+		return readErr
+	}
+	document, transcodeErr := wire.JSONFromValue(data)
+	if transcodeErr != nil {
+		return badRequest("Invalid protobuf: %v", transcodeErr)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(document))
+	return nil
+}
+
+// negotiate serves the application/json responses of a handler as google.protobuf.Value to
+// clients that asked for protobuf, unless the handler wrote a message of its own. Problems,
+// streams and other media types pass through untouched.
+func negotiate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wantsProtobuf(r) {
+			handler(w, r)
+			return
+		}
+		values := &valueWriter{ResponseWriter: w}
+		handler(values, r)
+		values.finish()
+	}
+}
+
+// valueWriter holds back an application/json response for negotiate to write out as a Value
+type valueWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	document    *bytes.Buffer // document collects a JSON response; nil when passing one through
+}
+
+// WriteHeader starts holding back the response when it is JSON with a body
+func (w *valueWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType == "application/json" && status != http.StatusNoContent && status != http.StatusNotModified {
+		w.status, w.document = status, new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write collects a held-back response and passes any other through
+func (w *valueWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.document != nil {
+		return w.document.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *valueWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes a held-back response as a Value, or as the JSON it was if it doesn't transcode
+func (w *valueWriter) finish() {
+	if w.document == nil {
+		return
+	}
+	body := w.document.Bytes()
+	if message, transcodeErr := wire.ValueFromJSON(body); transcodeErr == nil {
+		w.Header().Set("Content-Type", wire.ValueContentType)
+		w.Header().Del("Content-Length")
+		body = message
+	}
+	w.Header().Add("Vary", "Accept")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// writeResponse writes a success body as JSON, or as protobuf when the client asked for it
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, body any) {
+	if message, isProtobuf := protobufBody(r, body); isProtobuf {
+		w.Header().Set("Content-Type", wire.ContentType)
+		w.WriteHeader(status)
+		w.Write(message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// wireCurves names the curves of the wire format as the JSON API does
+var wireCurves = map[wire.Curve]string{
+	wire.Curve_CURVE_UNSPECIFIED: "",
+	wire.Curve_CURVE_BN254:       ecc.BN254.String(),
+	wire.Curve_CURVE_BLS12_381:   ecc.BLS12_381.String(),
+}
+
+// checkWireFormat rejects values produced for an unknown curve or another encoding, and returns
+// the name of the curve. Unset fields take the protobuf default and are accepted, so minimal
+// clients can omit them. The declared circuit version and curve depend on the configuration, so
+// handlers check them against the server's.
+func checkWireFormat(name string, curve wire.Curve, encoding, want wire.Encoding) (string, error) {
+	curveName, known := wireCurves[curve]
+	if !known {
+		return "", badRequest("%s: unsupported curve %d", name, curve)
+	}
+	if encoding != wire.Encoding_ENCODING_UNSPECIFIED && encoding != want {
+		return "", badRequest("%s: unsupported encoding %d", name, encoding)
+	}
+	return curveName, nil
+}
+
+// decimalFieldElement converts a big-endian field element into the decimal form the JSON API uses
+func decimalFieldElement(name string, value []byte) (string, error) {
+	if len(value) == 0 {
+		return "", nil // left for validation to report as missing
+	}
+	parsed, parseErr := wire.ParseFieldElement(value)
+	if parseErr != nil {
+		return "", badRequest("%s: %v", name, parseErr)
+	}
+	return parsed.String(), nil
+}
+
+// unmarshalProtobuf decodes a wire.RegisterRequest
+func (req *RegisterRequest) unmarshalProtobuf(data []byte) error {
+	var message wire.RegisterRequest
+	if decodeErr := proto.Unmarshal(data, &message); decodeErr != nil {
+		return badRequest("Invalid protobuf: %v", decodeErr)
+	}
+	req.UserName, req.Salt, req.PolicyProof = message.UserName, message.Salt, message.PolicyProof
+	if message.Commitment != nil {
+		commitment := message.Commitment
+		var formatErr error
+		if req.Curve, formatErr = checkWireFormat("commitment", commitment.Curve, commitment.Encoding, wire.Encoding_ENCODING_BIG_ENDIAN); formatErr != nil {
+			return formatErr
+		}
+		req.circuitVersion = commitment.CircuitVersion
+		var convertErr error
+		if req.CryptoCommitment, convertErr = decimalFieldElement("commitment", commitment.Value); convertErr != nil {
+			return convertErr
+		}
+	}
+	if message.Kdf != nil {
+		if message.Kdf.Parallelism > math.MaxUint8 {
+			return badRequest("kdf: parallelism must be at most %d", math.MaxUint8)
+		}
+		req.KDF = &secret.KDFParams{
+			Algorithm:   message.Kdf.Algorithm,
+			Memory:      message.Kdf.MemoryKib,
+			Time:        message.Kdf.Time,
+			Parallelism: uint8(message.Kdf.Parallelism),
+			Name:        message.Kdf.Name,
+			Version:     message.Kdf.Version,
+			Cost:        message.Kdf.Cost,
+			BlockSize:   message.Kdf.BlockSize,
+			Iterations:  message.Kdf.Iterations,
+		}
+	}
+	return nil
+}
+
+// unmarshalProtobuf decodes a wire.ChallengeRequest
+func (req *ChallengeRequest) unmarshalProtobuf(data []byte) error {
+	var message wire.ChallengeRequest
+	if decodeErr := proto.Unmarshal(data, &message); decodeErr != nil {
+		return badRequest("Invalid protobuf: %v", decodeErr)
+	}
+	req.UserName = message.UserName
+	return nil
+}
+
+// unmarshalProtobuf decodes a wire.VerifyRequest
+func (req *ProofRequest) unmarshalProtobuf(data []byte) error {
+	var message wire.VerifyRequest
+	if decodeErr := proto.Unmarshal(data, &message); decodeErr != nil {
+		return badRequest("Invalid protobuf: %v", decodeErr)
+	}
+	req.UserName, req.KeyID = message.UserName, message.KeyId
+	var convertErr error
+	if req.Nonce, convertErr = decimalFieldElement("nonce", message.Nonce); convertErr != nil {
+		return convertErr
+	}
+	if req.CryptoCommitment, convertErr = decimalFieldElement("commitment", message.Commitment); convertErr != nil {
+		return convertErr
+	}
+	if message.Proof != nil {
+		proof := message.Proof
+		encoding, proofEncoding := wire.Encoding_ENCODING_GNARK_BINARY, ""
+		if proof.Encoding == wire.Encoding_ENCODING_GNARK_RAW {
+			encoding, proofEncoding = wire.Encoding_ENCODING_GNARK_RAW, verifier.ProofUncompressed
+		}
+		curve, formatErr := checkWireFormat("proof", proof.Curve, proof.Encoding, encoding)
+		if formatErr != nil {
+			return formatErr
+		}
+		if proof.FormatVersion == 0 {
+			req.Proof, req.Curve, req.ProofEncoding, req.circuitVersion = proof.Data, curve, proofEncoding, proof.CircuitVersion
+			return nil
+		}
+		// A versioned proof is opened like a JSON proof_envelope, over the curve it names or bn254
+		if curve == "" {
+			curve = ecc.BN254.String()
+		}
+		req.Envelope = &verifier.ProofEnvelope{
+			FormatVersion:  int(proof.FormatVersion),
+			Curve:          curve,
+			Backend:        proof.Backend,
+			CircuitVersion: proof.CircuitVersion,
+			Encoding:       proofEncoding,
+			Payload:        proof.Data,
+		}
+	}
+	return nil
+}
+
+// protobufMessage returns the response as a wire.StatusResponse
+func (resp StatusResponse) protobufMessage() proto.Message {
+	return &wire.StatusResponse{Status: resp.Status, KeyId: resp.KeyID}
+}
+
+// protobufMessage returns the response as a wire.StatusResponse carrying the verdict
+func (resp VerificationResponse) protobufMessage() proto.Message {
+	return &wire.StatusResponse{Status: resp.Status, KeyId: resp.KeyID, Verdict: resp.Verdict}
+}
+
+// protobufMessage returns the response as a wire.ChallengeResponse
+func (resp ChallengeResponse) protobufMessage() proto.Message {
+	nonce, _ := new(big.Int).SetString(resp.Nonce, 10)
+	return &wire.ChallengeResponse{
+		Nonce:           wire.FieldElement(nonce),
+		ExpiresAtUnixMs: resp.ExpiresAt.UnixMilli(),
+		KeyId:           resp.KeyID,
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Rate limit backends
+const (
+	rateLimitMemory = "memory"
+	rateLimitRedis  = "redis"
+)
+
+// RateLimiter counts requests per key over sliding windows, e.g. in memory or in a store shared by
+// every replica
+type RateLimiter interface {
+	// Allow counts a request under key unless limit requests were already counted within the last
+	// window, in which case it reports how long until the oldest of them leaves the window
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (allowed bool, retryAfter time.Duration, err error)
+	// Close releases the limiter's resources
+	Close() error
+}
+
+// rateLimits applies the rate_limit rules with the configured limiter
+type rateLimits struct {
+	limiter RateLimiter
+	rules   []rateLimitRule
+}
+
+// rateLimitRule is a RateLimitRule with its place in rate_limit.rules, which keys its counts
+type rateLimitRule struct {
+	accessRule // accessRule holds the routes the rule covers; its CIDRs are unused
+	key        string
+	requests   int
+	window     time.Duration
+}
+
+// newRateLimits checks the rate_limit settings and opens the backend; it returns nil when no rules are set.
+// In stateless mode the counts default to the shared Redis.
+func newRateLimits(cfg RateLimitConfig, shared *sharedState) (*rateLimits, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	limits := &rateLimits{}
+	for i, rule := range cfg.Rules {
+		field := fmt.Sprintf("rate_limit.rules[%d]", i)
+		switch {
+		case !validRouteGroup(rule.Routes):
+			return nil, fmt.Errorf("%s: routes %q is not api, admin, metrics or a path prefix", field, rule.Routes)
+		case rule.Requests < 1 || rule.Window.Duration <= 0:
+			return nil, fmt.Errorf("%s: requests and window must be positive", field)
+		}
+		limits.rules = append(limits.rules, rateLimitRule{
+			accessRule: accessRule{routes: rule.Routes},
+			key:        fmt.Sprintf("%d:%s", i, rule.Routes),
+			requests:   rule.Requests,
+			window:     rule.Window.Duration,
+		})
+	}
+	switch cfg.Backend {
+	case "":
+		if shared != nil {
+			limits.limiter = &redisLimiter{client: shared.client, prefix: shared.key("ratelimit", "")}
+			break
+		}
+		limits.limiter = newMemoryLimiter()
+	case rateLimitMemory:
+		limits.limiter = newMemoryLimiter()
+	case rateLimitRedis:
+		client, redisErr := newRedisClient(cfg.Redis)
+		if redisErr != nil {
+			return nil, fmt.Errorf("rate_limit.redis: %w", redisErr)
+		}
+		limits.limiter = &redisLimiter{client: client, prefix: cfg.Redis.KeyPrefix}
+	default:
+		return nil, fmt.Errorf("rate_limit.backend: %q is not memory or redis", cfg.Backend)
+	}
+	return limits, nil
+}
+
+// close closes the limiter; a nil receiver has nothing to close
+func (l *rateLimits) close() {
+	if l != nil {
+		l.limiter.Close()
+	}
+}
+
+// limitRate turns away requests from a client address past the limit of a rule covering the route,
+// with 429 and a Retry-After. A limiter that fails lets the request through: an outage of a shared
+// backend shouldn't take logins down with it.
+func (s *Server) limitRate(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if s.limits == nil {
+		return next
+	}
+	var rules []rateLimitRule
+	for _, rule := range s.limits.rules {
+		if rule.covers(pattern) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := r.Context().Value(clientAddrKey{}).(string)
+		for _, rule := range rules {
+			allowed, retryAfter, limitErr := s.limits.limiter.Allow(r.Context(), rule.key+":"+addr, rule.requests, rule.window)
+			switch {
+			case limitErr != nil:
+				logf(r.Context(), "Rate limit %s not applied: %v", rule.routes, limitErr)
+			case !allowed:
+				w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+				writeProblem(w, http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("At most %d requests per %s are allowed here", rule.requests, rule.window))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// memoryLimiter is the RateLimiter of a single instance: it remembers the times of the requests
+// within the window of each key
+type memoryLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	requests  map[string]*memoryWindow
+	lastSweep time.Time
+}
+
+// memoryWindow holds the requests counted under one key, oldest first
+type memoryWindow struct {
+	times  []time.Time
+	window time.Duration
+}
+
+// newMemoryLimiter creates an empty in-memory limiter
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{now: time.Now, requests: make(map[string]*memoryWindow)}
+}
+
+// Allow counts a request under key unless limit requests were already counted within the window
+func (m *memoryLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) > time.Minute {
+		m.sweep(now)
+	}
+	counted := m.requests[key]
+	if counted == nil {
+		counted = &memoryWindow{window: window}
+		m.requests[key] = counted
+	}
+	since := now.Add(-window)
+	counted.times = slices.DeleteFunc(counted.times, func(at time.Time) bool { return !at.After(since) })
+	if len(counted.times) >= limit {
+		return false, counted.times[len(counted.times)-limit].Sub(since), nil
+	}
+	counted.times = append(counted.times, now)
+	return true, 0, nil
+}
+
+// sweep forgets the keys with no request left in their window
+func (m *memoryLimiter) sweep(now time.Time) {
+	for key, counted := range m.requests {
+		if len(counted.times) == 0 || !counted.times[len(counted.times)-1].After(now.Add(-counted.window)) {
+			delete(m.requests, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+// Close does nothing: the counts live in memory
+func (m *memoryLimiter) Close() error {
+	return nil
+}
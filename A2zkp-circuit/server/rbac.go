@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// Roles an API key can be assigned. The admin_token is a super-admin.
+const (
+	RoleViewer      = "viewer"       // RoleViewer reads statistics, key versions, expired registrations and anomalies
+	RoleOperator    = "operator"     // RoleOperator is a viewer that also rotates keys, reloads, re-verifies and revokes sessions
+	RoleTenantAdmin = "tenant-admin" // RoleTenantAdmin manages the users of one tenant and reads that tenant's statistics
+	RoleAuditor     = "auditor"      // RoleAuditor downloads and re-verifies the proof transcripts of logins
+	RoleSuperAdmin  = "super-admin"  // RoleSuperAdmin may do everything, including backups and assigning roles
+)
+
+// permission is an admin operation a role may be granted
+type permission string
+
+// The permissions admin endpoints check
+const (
+	permView        permission = "view"         // permView reads server-wide admin data
+	permStats       permission = "stats"        // permStats reads the statistics, of one tenant for tenant-scoped principals
+	permOperate     permission = "operate"      // permOperate changes the running server: keys, reloads, sessions, on-chain submissions
+	permManageUsers permission = "manage_users" // permManageUsers registers and deletes users, of one tenant for tenant-scoped principals
+	permAudit       permission = "audit"        // permAudit reads and re-verifies proof transcripts
+	permSuperAdmin  permission = "super_admin"  // permSuperAdmin covers backups, restores and API key management
+)
+
+// rolePermissions lists what each role may do
+var rolePermissions = map[string][]permission{
+	RoleViewer:      {permView, permStats},
+	RoleOperator:    {permView, permStats, permOperate},
+	RoleTenantAdmin: {permStats, permManageUsers},
+	RoleAuditor:     {permAudit},
+	RoleSuperAdmin:  {permView, permStats, permOperate, permManageUsers, permAudit, permSuperAdmin},
+}
+
+// apiKeyPrefix starts every API key, which reads "ofa_<id>_<secret>"
+const apiKeyPrefix = "ofa_"
+
+// maxAPIKeyNameLength bounds the names of API keys
+const maxAPIKeyNameLength = 128
+
+// principal is who an admin request is made by: the admin_token or an API key
+type principal struct {
+	keyID  string // keyID is empty for the admin_token
+	role   string
+	tenant string // tenant is set for tenant-admin keys only
+	// dailyQuota and monthlyQuota are the API key's quotas, which meter holds it to
+	dailyQuota   int64
+	monthlyQuota int64
+}
+
+// can reports whether the principal's role grants a permission
+func (p principal) can(perm permission) bool {
+	return slices.Contains(rolePermissions[p.role], perm)
+}
+
+// managesTenant reports whether the principal may manage the users of a tenant
+func (p principal) managesTenant(tenant string) bool {
+	return p.can(permManageUsers) && (p.role != RoleTenantAdmin || p.tenant == tenant)
+}
+
+// principalKey is the context key under which requirePermission stores the principal
+type principalKey struct{}
+
+// requestPrincipal returns the principal requirePermission admitted a request for
+func requestPrincipal(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// adminPrincipal identifies the principal of a request's bearer token, reporting false when it is
+// neither the admin_token nor a known API key
+func (s *Server) adminPrincipal(r *http.Request) (principal, bool, error) {
+	token, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hasBearer {
+		return principal{}, false, nil
+	}
+	if adminToken := *s.adminToken.Load(); adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return principal{role: RoleSuperAdmin}, true, nil
+	}
+	id, keySecret, isKey := parseAPIKey(token)
+	if !isKey {
+		return principal{}, false, nil
+	}
+	key, getErr := s.store.GetAPIKey(r.Context(), id)
+	switch {
+	case errors.Is(getErr, store.ErrAPIKeyNotFound):
+		return principal{}, false, nil
+	case getErr != nil:
+		return principal{}, false, getErr
+	case subtle.ConstantTimeCompare([]byte(refreshTokenHash(keySecret)), []byte(key.Hash)) != 1:
+		return principal{}, false, nil
+	}
+	return principal{keyID: key.ID, role: key.Role, tenant: key.Tenant, dailyQuota: key.DailyQuota, monthlyQuota: key.MonthlyQuota}, true, nil
+}
+
+// requirePermission rejects requests whose bearer token is neither the admin_token nor an API key
+// with a role granting perm, and hands the principal on to next in the request context. Requests
+// made with an API key are metered, and refused once they exceed one of its quotas.
+func (s *Server) requirePermission(perm permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, known, principalErr := s.adminPrincipal(r)
+		if principalErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, "Error loading API key")
+			return
+		}
+		if !known {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, _, isKey := parseAPIKey(token); *s.adminToken.Load() == "" && !isKey {
+				writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "Admin API is disabled")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid admin token or API key")
+			return
+		}
+		if !p.can(perm) {
+			writeProblem(w, http.StatusForbidden, codePermissionDenied, fmt.Sprintf("Role %s lacks the %s permission", p.role, perm))
+			return
+		}
+		// A read replica can't count usage, so API key quotas are enforced by the primary alone
+		if p.keyID != "" && !s.cfg.ReadOnly {
+			if meterErr := s.usage.meter(r.Context(), p, time.Now()); meterErr != nil {
+				writeMeterError(w, meterErr)
+				return
+			}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// parseAPIKey splits an API key into its ID and secret
+func parseAPIKey(token string) (string, string, bool) {
+	rest, hasPrefix := strings.CutPrefix(token, apiKeyPrefix)
+	id, keySecret, hasSecret := strings.Cut(rest, "_")
+	return id, keySecret, hasPrefix && hasSecret && id != "" && keySecret != ""
+}
+
+// APIKeyRequest creates an API key or assigns one a role
+type APIKeyRequest struct {
+	Name   string `json:"name,omitempty"` // Name is required when creating a key and ignored when assigning roles
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"` // Tenant is required for the tenant-admin role and refused for the others
+	// DailyQuota and MonthlyQuota bound the requests of a key being created, 0 leaving them unbounded;
+	// they are ignored when assigning roles
+	DailyQuota   int64 `json:"daily_quota,omitempty"`
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+}
+
+// validate checks the request's role and tenant, and its name when creating a key
+func (req APIKeyRequest) validate(creating bool) error {
+	var v validate.Validator
+	if creating {
+		v.Text("name", req.Name, maxAPIKeyNameLength)
+	}
+	if _, known := rolePermissions[req.Role]; !known {
+		v.Fail("role", "must be one of %s, %s, %s, %s or %s", RoleViewer, RoleOperator, RoleTenantAdmin, RoleAuditor, RoleSuperAdmin)
+	}
+	switch {
+	case req.Role == RoleTenantAdmin:
+		v.Text("tenant", req.Tenant, maxTenantLength)
+	case req.Tenant != "":
+		v.Fail("tenant", "is only allowed for the %s role", RoleTenantAdmin)
+	}
+	if creating && req.DailyQuota < 0 {
+		v.Fail("daily_quota", "must not be negative")
+	}
+	if creating && req.MonthlyQuota < 0 {
+		v.Fail("monthly_quota", "must not be negative")
+	}
+	return v.Err()
+}
+
+// APIKeyResponse describes an API key; Key, the credential itself, is only returned when it is created
+type APIKeyResponse struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// DailyQuota and MonthlyQuota are omitted for a key without them
+	DailyQuota   int64     `json:"daily_quota,omitempty"`
+	MonthlyQuota int64     `json:"monthly_quota,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// newAPIKeyResponse describes a stored API key without its credential
+func newAPIKeyResponse(key store.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:           key.ID,
+		Name:         key.Name,
+		Role:         key.Role,
+		Tenant:       key.Tenant,
+		DailyQuota:   key.DailyQuota,
+		MonthlyQuota: key.MonthlyQuota,
+		CreatedAt:    key.CreatedAt,
+		UpdatedAt:    key.UpdatedAt,
+	}
+}
+
+// listAPIKeysHandler lists the API keys and their roles
+func (s *Server) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, listErr := s.store.ListAPIKeys(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing API keys: %v", listErr))
+		return
+	}
+	response := make([]APIKeyResponse, len(keys))
+	for i, key := range keys {
+		response[i] = newAPIKeyResponse(key)
+	}
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// createAPIKeyHandler creates an API key with a role. The key is in the response only; the store
+// keeps its hash.
+func (s *Server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(true); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	id, keySecret := make([]byte, 8), make([]byte, 32)
+	rand.Read(id)
+	rand.Read(keySecret)
+	now := time.Now().UTC()
+	key := store.APIKey{
+		ID:           hex.EncodeToString(id),
+		Name:         req.Name,
+		Role:         req.Role,
+		Tenant:       req.Tenant,
+		DailyQuota:   req.DailyQuota,
+		MonthlyQuota: req.MonthlyQuota,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(keySecret)
+	key.Hash = refreshTokenHash(encodedSecret)
+	if putErr := s.store.PutAPIKey(r.Context(), key); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing API key: %v", putErr))
+		return
+	}
+	logf(r.Context(), "Created API key %s (%q) with role %s", key.ID, key.Name, key.Role)
+	response := newAPIKeyResponse(key)
+	response.Key = apiKeyPrefix + key.ID + "_" + encodedSecret
+	writeResponse(w, r, http.StatusCreated, response)
+}
+
+// assignRoleHandler replaces the role, and tenant, of an API key. The change applies to the next
+// request made with the key.
+func (s *Server) assignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(false); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	key, getErr := s.store.GetAPIKey(r.Context(), r.PathValue("id"))
+	switch {
+	case errors.Is(getErr, store.ErrAPIKeyNotFound):
+		writeProblem(w, http.StatusNotFound, codeAPIKeyNotFound, "Unknown API key")
+		return
+	case getErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error loading API key: %v", getErr))
+		return
+	}
+	key.Role, key.Tenant, key.UpdatedAt = req.Role, req.Tenant, time.Now().UTC()
+	if putErr := s.store.PutAPIKey(r.Context(), key); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing API key: %v", putErr))
+		return
+	}
+	logf(r.Context(), "Assigned role %s to API key %s", key.Role, key.ID)
+	writeResponse(w, r, http.StatusOK, newAPIKeyResponse(key))
+}
+
+// deleteAPIKeyHandler deletes an API key, which stops working at once
+func (s *Server) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	deleteErr := s.store.DeleteAPIKey(r.Context(), id)
+	switch {
+	case errors.Is(deleteErr, store.ErrAPIKeyNotFound):
+		writeProblem(w, http.StatusNotFound, codeAPIKeyNotFound, "Unknown API key")
+	case deleteErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error deleting API key: %v", deleteErr))
+	default:
+		logf(r.Context(), "Deleted API key %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validateReadOnly checks the read_only settings against the rest of cfg. A replica verifies the
+// proofs the primary's clients make, so it must load the primary's keys and store rather than set
+// up or open fresh ones, and it refuses features that write on the verify path.
+func validateReadOnly(cfg Config) error {
+	switch {
+	case !cfg.ReadOnly:
+		return nil
+	case cfg.KeyDir == "" && embeddedArtifacts == nil && cfg.Vault.ArtifactsPath == "" && cfg.ArtifactsDir == "" && cfg.ArtifactsURL == "":
+		return errors.New("read_only needs the primary's keys: key_dir, embedded artifacts, vault.artifacts_path, artifacts_dir or artifacts_url")
+	case cfg.DatabasePath == "" && cfg.LDAP.URL == "" && !cfg.Stateless.Enabled:
+		return errors.New("read_only needs the primary's store: database_path, ldap.url or stateless mode")
+	case cfg.Transcripts.Enabled:
+		return errors.New("read_only can't be combined with transcripts.enabled: every verification would record one")
+	}
+	return nil
+}
+
+// replicaRoutes are the routes besides reads a read replica serves: challenges, verification, and
+// reloading the key versions the primary rotated
+var replicaRoutes = map[string]bool{
+	"POST /v1/challenges":     true,
+	"POST /v1/verify":         true,
+	"POST /v1/verify:dryRun":  true,
+	"POST /v1/introspect":     true,
+	"POST /admin/verify:bulk": true,
+	"POST /admin/reload":      true,
+	"POST /admin/self-test":   true,
+}
+
+// replicaWrites are the GET routes a read replica doesn't serve, since they write: the interactive
+// login records the session it issues, and the sign-in page posts to the authorization endpoint
+var replicaWrites = map[string]bool{
+	"GET /v1/login/ws":     true,
+	"GET /oauth/authorize": true,
+}
+
+// servedByReplica reports whether a read replica serves a route pattern: reads, other than those of
+// replicaWrites, and the routes of replicaRoutes
+func servedByReplica(pattern string) bool {
+	method, _, hasMethod := strings.Cut(pattern, " ")
+	switch {
+	case !hasMethod:
+		return true // only /verifyCommitment takes any method, and it compares without writing
+	case method == http.MethodGet:
+		return !replicaWrites[pattern]
+	default:
+		return replicaRoutes[pattern]
+	}
+}
+
+// replicaRouteTable answers the routes of table a read replica doesn't serve with read_only
+// problems. They stay in the table, and so in the OpenAPI document, since the API is the
+// primary's; only where the request must go differs.
+func replicaRouteTable(table []route) []route {
+	for i, rt := range table {
+		if !servedByReplica(rt.pattern) {
+			table[i].handler = readOnlyHandler
+		}
+	}
+	return table
+}
+
+// readOnlyHandler refuses a route a read replica doesn't serve, sending the client to the primary
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusForbidden, codeReadOnly, fmt.Sprintf("This server is a read-only replica; send %s %s to the primary", r.Method, r.URL.Path))
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/did"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+)
+
+// maxRecoveryShares bounds the shares issued at registration, since recovering checks one proof per share
+const maxRecoveryShares = 16
+
+// RecoveryOptions asks for a recovery secret split into Shares shares, any Threshold of which can
+// later replace the user's commitment
+type RecoveryOptions struct {
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+}
+
+// validateInto records in v unless 1 <= threshold <= shares <= maxRecoveryShares
+func (o RecoveryOptions) validateInto(v *validate.Validator) {
+	if o.Threshold < 1 || o.Threshold > o.Shares || o.Shares > maxRecoveryShares {
+		v.Fail("recovery", "needs 1 <= threshold <= shares <= %d", maxRecoveryShares)
+	}
+}
+
+// RegisterResponse is the body of a successful registration. RecoveryShares are only ever
+// returned here and by a recovery; the server keeps nothing from which they could be rebuilt.
+type RegisterResponse struct {
+	StatusResponse
+	RecoveryShares []string `json:"recovery_shares,omitempty"` // RecoveryShares are encoded as "<index>-<hex value>"
+}
+
+// ShareProof proves knowledge of one recovery share, as a proof of the v1 circuit with the share
+// value as secret
+type ShareProof struct {
+	Index int    `json:"index"` // Index is the share's index, the number before the dash in its encoding
+	Proof []byte `json:"proof"` // Proof is the base64-encoded Groth16 proof in gnark binary encoding
+}
+
+// RecoverRequest is the body of POST /v1/users/{id}/recovery: proofs over threshold shares, all
+// bound to one challenge nonce, and the registration that replaces the lost one
+type RecoverRequest struct {
+	Nonce            string            `json:"nonce"`            // The challenge nonce every proof was generated against
+	KeyID            string            `json:"key_id,omitempty"` // The key version the proofs were generated with; the current one when omitted
+	Proofs           []ShareProof      `json:"proofs"`
+	CryptoCommitment string            `json:"crypto_commitment"` // The commitment generated from the user's new secret
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	PolicyProof      []byte            `json:"policy_proof,omitempty"` // PolicyProof is required when a secret policy is configured, as for registrations
+	// DIDBinding binds the new commitment to a key of the user's DID document, as for registrations
+	DIDBinding *did.Binding `json:"did_binding,omitempty"`
+}
+
+// validate checks the proofs are for distinct shares and the new registration is valid, and
+// returns the parsed nonce
+func (req RecoverRequest) validate(userName string) (*big.Int, error) {
+	var v validate.Validator
+	nonce := v.FieldElement("nonce", req.Nonce)
+	v.KeyID("key_id", req.KeyID)
+	if len(req.Proofs) == 0 || len(req.Proofs) > maxRecoveryShares {
+		v.Fail("proofs", "must hold between 1 and %d share proofs", maxRecoveryShares)
+	}
+	seen := make(map[int]bool, len(req.Proofs))
+	for i, proof := range req.Proofs {
+		switch {
+		case proof.Index < 1 || proof.Index > maxRecoveryShares:
+			v.Fail(fmt.Sprintf("proofs[%d].index", i), "must be between 1 and %d", maxRecoveryShares)
+		case seen[proof.Index]:
+			v.Fail(fmt.Sprintf("proofs[%d].index", i), "proves share %d a second time", proof.Index)
+		case len(proof.Proof) == 0:
+			v.Fail(fmt.Sprintf("proofs[%d].proof", i), "is required")
+		default:
+			v.MaxLength(fmt.Sprintf("proofs[%d].proof", i), len(proof.Proof), maxProofLength)
+		}
+		seen[proof.Index] = true
+	}
+	registration := RegisterRequest{UserName: userName, CryptoCommitment: req.CryptoCommitment, Salt: req.Salt, KDF: req.KDF, PolicyProof: req.PolicyProof, DIDBinding: req.DIDBinding}
+	registration.validateInto(&v)
+	return nonce, v.Err()
+}
+
+// newRecovery generates a random recovery secret, splits it into shares and returns the record
+// storing their commitments along with the encoded shares to hand to the user
+func newRecovery(options RecoveryOptions) (*store.Recovery, []string, error) {
+	random := make([]byte, 32)
+	if _, randErr := rand.Read(random); randErr != nil {
+		return nil, nil, randErr
+	}
+	recoverySecret := secret.FromFieldBytes(random)
+	defer recoverySecret.Zero()
+	shares, splitErr := secret.Split(recoverySecret, options.Shares, options.Threshold)
+	if splitErr != nil {
+		return nil, nil, splitErr
+	}
+
+	recovery := &store.Recovery{Threshold: options.Threshold, CreatedAt: time.Now().UTC()}
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		commitment, commitmentErr := circuit.GenerateCryptoCommitment(share.Value)
+		if commitmentErr != nil {
+			return nil, nil, commitmentErr
+		}
+		recovery.Shares = append(recovery.Shares, store.RecoveryShare{Index: share.Index, CryptoCommitment: commitment})
+		text := share.Encode()
+		encoded[i] = string(text)
+		secret.WipeBytes(text)
+		share.Value.Zero()
+	}
+	return recovery, encoded, nil
+}
+
+// recoverHandler replaces a user's commitment once they prove knowledge of threshold of their
+// recovery shares. The proofs are bound to a nonce from POST /v1/challenges, consumed whether or
+// not they verify. Success issues a fresh set of shares, invalidating the old ones, and drops the
+// user's refresh tokens, authorization codes and outstanding nonces.
+func (s *Server) recoverHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	var req RecoverRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate(userName)
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	// The binding of the replaced commitment doesn't carry over to the new one
+	binding := RegisterRequest{UserName: userName, CryptoCommitment: req.CryptoCommitment, KDF: req.KDF, DIDBinding: req.DIDBinding}
+	if kdfErr := s.checkKDF(&binding); kdfErr != nil {
+		writeRequestError(w, kdfErr)
+		return
+	}
+	if duplicateErr := s.checkDuplicate(r.Context(), binding); duplicateErr != nil {
+		writeRequestError(w, duplicateErr)
+		return
+	}
+	if didErr := s.checkDID(r.Context(), &binding); didErr != nil {
+		writeRequestError(w, didErr)
+		return
+	}
+	if policyErr := s.checkSecretPolicy(r.Context(), req.CryptoCommitment, req.PolicyProof); policyErr != nil {
+		s.writePolicyError(w, policyErr)
+		return
+	}
+
+	proven, authErr := s.authenticateRecovery(r.Context(), userName, req, nonce)
+	if authErr != nil {
+		s.writeAuthError(w, ProofRequest{KeyID: req.KeyID}, authErr)
+		return
+	}
+
+	// The registration is reread under the edit lock so two recoveries with the same shares can't
+	// both replace the commitment: the second finds the shares it proved already superseded
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.getUser(r.Context(), userName)
+	if getErr != nil || user.Recovery == nil || !user.Recovery.CreatedAt.Equal(proven.Recovery.CreatedAt) {
+		writeProblem(w, http.StatusUnauthorized, codeProofInvalid, "Invalid proof")
+		return
+	}
+
+	recovery, shares, recoveryErr := newRecovery(RecoveryOptions{Shares: len(user.Recovery.Shares), Threshold: user.Recovery.Threshold})
+	if recoveryErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error generating recovery shares: %v", recoveryErr))
+		return
+	}
+	replaced := user.CryptoCommitment
+	user.CryptoCommitment, user.Salt, user.KDF = req.CryptoCommitment, req.Salt, binding.KDF
+	user.CircuitVersion, user.KeyID = s.registrationCircuit(user.Tenant, user.UserName, "")
+	user.Curve = s.circuits[user.CircuitVersion].Curve
+	user.Recovery, user.DIDKey = recovery, binding.didKey
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing user: %v", putErr))
+		return
+	}
+	s.recordRevocations(r.Context(), store.RevokedRecovery, []string{replaced})
+	s.notices.send(r.Context(), SecurityNotice{Type: noticeCommitmentRotated, UserName: user.UserName, Tenant: user.Tenant, Via: "recovery"})
+	if _, challengeErr := s.challenges.forgetUser(r.Context(), userName); challengeErr != nil {
+		logf(r.Context(), "Error deleting challenges of %q: %v", userName, challengeErr)
+	}
+	if _, refreshErr := s.refresh.forgetUser(r.Context(), userName); refreshErr != nil {
+		logf(r.Context(), "Error deleting refresh tokens of %q: %v", userName, refreshErr)
+	}
+	if _, codeErr := s.codes.forgetUser(r.Context(), userName); codeErr != nil {
+		logf(r.Context(), "Error deleting authorization codes of %q: %v", userName, codeErr)
+	}
+	writeResponse(w, r, http.StatusOK, RegisterResponse{StatusResponse: StatusResponse{Status: "Commitment replaced"}, RecoveryShares: shares})
+}
+
+// authenticateRecovery checks the share proofs of a recovery request and returns the user when at
+// least threshold of them verify. Unknown users and users without recovery shares fail as
+// ErrInvalidProof after the same checks, against decoy commitments, unless user existence may be revealed.
+func (s *Server) authenticateRecovery(ctx context.Context, userName string, req RecoverRequest, nonce *big.Int) (_ store.User, authErr error) {
+	var tenant string
+	var proofLatency time.Duration
+	defer func() { s.recordLogin(ctx, userName, tenant, proofLatency, authErr) }()
+	if !s.cfg.RevealUserExistence {
+		started := time.Now()
+		defer func() {
+			if authErr != nil && !errors.Is(authErr, ErrPoolBusy) {
+				s.padLatency(ctx, started)
+			}
+		}()
+	}
+	version, keyErr := s.keyring.lookup(req.KeyID)
+	if keyErr != nil {
+		return store.User{}, keyErr
+	}
+	user, getErr := s.getUser(ctx, userName)
+	unknown := getErr != nil || user.Recovery == nil
+	if unknown && s.cfg.RevealUserExistence {
+		return store.User{}, ErrInvalidProof
+	}
+	tenant = user.Tenant
+	commitments := map[int]string{}
+	if !unknown {
+		for _, share := range user.Recovery.Shares {
+			commitments[share.Index] = share.CryptoCommitment
+		}
+	}
+
+	var consumeErr, verifyErr error
+	valid := 0
+	poolErr := s.pool.Do(ctx, func() {
+		if consumeErr = s.challenges.consume(ctx, userName, nonce); consumeErr != nil {
+			return
+		}
+		verifyStarted := time.Now()
+		defer func() { proofLatency = time.Since(verifyStarted) }()
+		for _, proof := range req.Proofs {
+			commitment, exists := commitments[proof.Index]
+			if !exists {
+				commitment = decoyCommitment
+			}
+			inputs := verifier.PublicInputs{Commitment: commitment, Nonce: nonce}
+			shareStarted := time.Now()
+			shareErr := verifier.New(version.keys.verifyingKey).VerifyProof(ctx, proof.Proof, inputs)
+			s.observeProof(proofVerify, version, circuit.Curve.String(), time.Since(shareStarted), len(proof.Proof))
+			switch {
+			case shareErr == nil && exists:
+				valid++
+			case errors.Is(shareErr, context.Canceled) || errors.Is(shareErr, context.DeadlineExceeded):
+				verifyErr = shareErr
+				return
+			}
+		}
+	})
+	switch {
+	case poolErr != nil:
+		return store.User{}, poolErr
+	case consumeErr != nil:
+		return store.User{}, consumeErr
+	case verifyErr != nil:
+		return store.User{}, verifyErr
+	case unknown || valid < user.Recovery.Threshold:
+		return store.User{}, ErrInvalidProof
+	}
+	return user, nil
+}
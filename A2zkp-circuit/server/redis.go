@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slidingWindowScript keeps the requests of a key as a sorted set scored by their time in
+// milliseconds, read from the Redis clock so replicas with skewed clocks agree. It returns 0 when
+// the request is counted, or else the milliseconds until the oldest request counted leaves the window.
+const slidingWindowScript = `
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+local limit, window = tonumber(ARGV[1]), tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local counted = redis.call('ZCARD', KEYS[1])
+if counted >= limit then
+  local oldest = redis.call('ZRANGE', KEYS[1], counted - limit, counted - limit, 'WITHSCORES')
+  return math.max(tonumber(oldest[2]) + window - now, 1)
+end
+redis.call('ZADD', KEYS[1], now, now .. ':' .. ARGV[3])
+redis.call('PEXPIRE', KEYS[1], window)
+return 0
+`
+
+// slidingWindow is slidingWindowScript, run by its SHA-1 once Redis has it cached
+var slidingWindow = redis.NewScript(slidingWindowScript)
+
+// newRedisClient checks the redis settings; connections are opened on first use
+func newRedisClient(cfg RedisConfig) (*redis.Client, error) {
+	if _, _, splitErr := net.SplitHostPort(cfg.Addr); splitErr != nil {
+		return nil, fmt.Errorf("addr: %w", splitErr)
+	}
+	opts := &redis.Options{
+		Addr:         cfg.Addr,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		DialTimeout:  cfg.Timeout.Duration,
+		ReadTimeout:  cfg.Timeout.Duration,
+		WriteTimeout: cfg.Timeout.Duration,
+		PoolSize:     cfg.PoolSize,
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return redis.NewClient(opts), nil
+}
+
+// redisLimiter is the RateLimiter shared by replicas: the counts live in Redis, updated by a Lua
+// script so each request is checked and counted atomically
+type redisLimiter struct {
+	client *redis.Client
+	prefix string // prefix starts the keys of the counts
+}
+
+// Allow runs the sliding window script for key
+func (l *redisLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	member := make([]byte, 8)
+	rand.Read(member)
+	wait, evalErr := slidingWindow.Run(ctx, l.client, []string{l.prefix + key}, limit, window.Milliseconds(), hex.EncodeToString(member)).Int64()
+	if evalErr != nil {
+		return false, 0, evalErr
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+// Close closes the connections
+func (l *redisLimiter) Close() error {
+	return l.client.Close()
+}
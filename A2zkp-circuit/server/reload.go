@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+)
+
+// Reload applies the parts of cfg that can change while serving: the TLS certificate of every
+// listener, key versions (from key_dir, or a new setup in artifacts_dir, artifacts_url or Vault), signing_key,
+// admin_token, access_control, challenge_ttl, key_grace_period and the percent and users of
+// canary_circuit. Listeners, the store and everything else keep their startup settings until a
+// restart. Each part is applied independently; the errors of those that failed are joined.
+func (s *Server) Reload(ctx context.Context, cfg Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var reloadErr error
+	for _, l := range cfg.listenerConfigs() {
+		s.certsMu.Lock()
+		holder := s.certificates[l.String()]
+		s.certsMu.Unlock()
+		certificate, certificateErr := l.loadCertificate()
+		switch {
+		case certificateErr != nil:
+			reloadErr = errors.Join(reloadErr, certificateErr)
+		case holder == nil && certificate != nil:
+			log.Printf("TLS on %s takes effect after a restart", l)
+		case holder != nil && certificate == nil:
+			log.Printf("Turning TLS off on %s takes effect after a restart", l)
+		case holder != nil:
+			holder.current.Store(certificate)
+		}
+	}
+
+	if version := cfg.Circuit.Version(); version != s.circuitVersion {
+		log.Printf("Changing the circuit to %s takes effect after a restart", version)
+	}
+	if !maps.Equal(cfg.TenantCircuits, s.cfg.TenantCircuits) {
+		log.Printf("Changing tenant_circuits takes effect after a restart")
+	}
+	if canary, configured := cfg.CanaryCircuit.Circuit, s.cfg.CanaryCircuit.Circuit; (canary == nil) != (configured == nil) || canary != nil && *canary != *configured {
+		log.Printf("Changing canary_circuit.circuit takes effect after a restart")
+	}
+	if rollout, rolloutErr := newCanaryRollout(cfg.CanaryCircuit); rolloutErr != nil {
+		reloadErr = errors.Join(reloadErr, rolloutErr)
+	} else if s.canary != nil && rollout != nil {
+		s.canaryRollout.Store(rollout)
+	}
+	if cfg.MockProver != s.cfg.MockProver {
+		log.Printf("Changing mock_prover takes effect after a restart")
+	}
+	s.keyring.setGrace(cfg.KeyGracePeriod.Duration)
+	artifacts, artifactsErr := reloadableArtifacts(ctx, cfg)
+	if artifactsErr == nil {
+		artifactsErr = s.keyring.reload(ctx, artifacts)
+	}
+	if artifactsErr != nil {
+		reloadErr = errors.Join(reloadErr, fmt.Errorf("reloading keys: %w", artifactsErr))
+	}
+
+	if rotateErr := s.rotateTokenKey(ctx, cfg.SigningKey); rotateErr != nil {
+		reloadErr = errors.Join(reloadErr, fmt.Errorf("reloading signing_key: %w", rotateErr))
+	}
+
+	s.challenges.setTTL(cfg.ChallengeTTL.Duration)
+	s.replays.setTTL(cfg.ReplayCacheTTL.Duration)
+	s.verdicts.SetTTL(cfg.VerdictCacheTTL.Duration)
+	s.adminToken.Store(&cfg.AdminToken)
+	if access, accessErr := parseAccessControl(cfg.AccessControl); accessErr != nil {
+		reloadErr = errors.Join(reloadErr, fmt.Errorf("reloading access_control: %w", accessErr))
+	} else {
+		s.access.Store(access)
+	}
+	logf(ctx, "Configuration reloaded; current key version is %s", s.keyring.current().ID)
+	return reloadErr
+}
+
+// reload rereads the configuration through configSource, or reuses the startup configuration, and applies it
+func (s *Server) reload(ctx context.Context) error {
+	cfg := s.cfg
+	if s.configSource != nil {
+		var loadErr error
+		if cfg, loadErr = s.configSource(); loadErr != nil {
+			return loadErr
+		}
+	}
+	return s.Reload(ctx, cfg)
+}
+
+// reloadableArtifacts opens the artifacts a reload may find a new setup in: the Vault secret,
+// artifacts_dir or artifacts_url. Embedded artifacts can't change, so they yield nil like a server without artifacts.
+func reloadableArtifacts(ctx context.Context, cfg Config) (fs.FS, error) {
+	switch {
+	case embeddedArtifacts != nil:
+		return nil, nil
+	case cfg.Vault.ArtifactsPath != "" && cfg.vault != nil:
+		return readVaultArtifacts(ctx, cfg.vault, cfg.Vault.ArtifactsPath)
+	case cfg.ArtifactsDir != "":
+		return os.DirFS(cfg.ArtifactsDir), nil
+	case cfg.ArtifactsURL != "":
+		return newURLArtifacts(cfg, ""), nil
+	default:
+		return nil, nil
+	}
+}
+
+// reloadHandler rereads the configuration like SIGHUP does
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if reloadErr := s.reload(r.Context()); reloadErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeReloadFailed, reloadErr.Error())
+		return
+	}
+	writeResponse(w, r, http.StatusOK, StatusResponse{Status: "Configuration reloaded", KeyID: s.keyring.current().ID})
+}
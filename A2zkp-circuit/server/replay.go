@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/verifier"
+)
+
+// ErrProofReplayed is returned for a proof byte-identical to one accepted within replay_cache_ttl
+var ErrProofReplayed = errors.New("proof was already accepted")
+
+// replayCache remembers the SHA-256 of each accepted login proof for a while and refuses the same
+// bytes again. Consumed nonces already stop replays for circuits that bind the nonce; the cache
+// also covers compositions without bind_nonce, whose proofs verify against any challenge. It is
+// kept in memory, so a restart forgets it, or in stateless mode in Redis.
+type replayCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	accepted map[[sha256.Size]byte]time.Time // accepted maps proof hashes to when they stop being refused
+	shared   *sharedState                    // shared is nil outside stateless mode
+}
+
+// newReplayCache creates a cache that refuses a proof for ttl after it was accepted; 0 disables it
+func newReplayCache(ttl time.Duration, shared *sharedState) *replayCache {
+	return &replayCache{ttl: ttl, accepted: make(map[[sha256.Size]byte]time.Time), shared: shared}
+}
+
+// setTTL changes how long proofs accepted from now on are refused
+func (c *replayCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// accept records a proof as accepted, failing with ErrProofReplayed if the same proof was accepted
+// within the TTL; expired hashes are dropped on the way
+func (c *replayCache) accept(ctx context.Context, proof []byte) error {
+	digest := sha256.Sum256(proof)
+	c.mu.Lock()
+	if c.shared != nil {
+		ttl := c.ttl
+		c.mu.Unlock()
+		if ttl <= 0 {
+			return nil
+		}
+		// SET NX sets nothing when another replica recorded the proof first
+		recorded, setErr := c.shared.client.SetNX(ctx, c.shared.key("replay", hex.EncodeToString(digest[:])), "1", ttl).Result()
+		if setErr != nil {
+			return setErr
+		}
+		if !recorded {
+			return ErrProofReplayed
+		}
+		return nil
+	}
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, until := range c.accepted {
+		if !now.Before(until) {
+			delete(c.accepted, key)
+		}
+	}
+	if c.ttl <= 0 {
+		return nil
+	}
+	if _, replayed := c.accepted[digest]; replayed {
+		return ErrProofReplayed
+	}
+	c.accepted[digest] = now.Add(c.ttl)
+	return nil
+}
+
+// seen reports whether accept would refuse a proof as replayed, recording nothing
+func (c *replayCache) seen(ctx context.Context, proof []byte) (bool, error) {
+	digest := sha256.Sum256(proof)
+	c.mu.Lock()
+	if c.shared != nil {
+		ttl := c.ttl
+		c.mu.Unlock()
+		if ttl <= 0 {
+			return false, nil
+		}
+		count, existsErr := c.shared.client.Exists(ctx, c.shared.key("replay", hex.EncodeToString(digest[:]))).Result()
+		return count > 0, existsErr
+	}
+	defer c.mu.Unlock()
+	until, replayed := c.accepted[digest]
+	return c.ttl > 0 && replayed && time.Now().Before(until), nil
+}
+
+// proofBytes is what the replay cache hashes for a proof request: the gnark encoding with
+// compressed points, so re-encoding an accepted proof uncompressed doesn't replay it, or the JSON
+// of a snarkjs proof
+func proofBytes(req ProofRequest) []byte {
+	if req.SnarkJSProof != nil {
+		encoded, _ := json.Marshal(req.SnarkJSProof)
+		return encoded
+	}
+	if req.proofEncoding() == verifier.ProofUncompressed {
+		if curve, curveErr := circuit.ParseCurve(req.curve()); curveErr == nil {
+			if compressed, compressErr := verifier.CompressProof(curve, req.Proof); compressErr == nil {
+				return compressed
+			}
+		}
+	}
+	return req.Proof
+}
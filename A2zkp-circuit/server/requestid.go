@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// requestIDHeader carries the ID a request is traced by, in requests and responses alike
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the incoming request IDs adopted; longer ones are replaced
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key under which withRequestID stores the request ID
+type requestIDKey struct{}
+
+// withRequestID adopts a request's X-Request-ID, or generates one when it is missing or unfit for
+// logs, echoes it in the response and attaches it to the request context. A request already given
+// an ID keeps it.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r.Context())
+		if id == "" {
+			id = r.Header.Get(requestIDHeader)
+		}
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether an incoming ID is short printable ASCII, safe to log and forward
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// requestID returns the ID of the request ctx belongs to, empty outside requests
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// forwardRequestID passes the ID of the request an outbound call is made for on to the callee
+func forwardRequestID(req *http.Request) {
+	if id := requestID(req.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// logf logs a message, prefixed with the ID of the request ctx belongs to when there is one
+func logf(ctx context.Context, format string, args ...any) {
+	if id := requestID(ctx); id != "" {
+		log.Printf("request %s: "+format, append([]any{id}, args...)...)
+		return
+	}
+	log.Printf(format, args...)
+}
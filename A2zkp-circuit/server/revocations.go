@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/verifier"
+)
+
+// RevocationListResponse carries a signed revocation list
+type RevocationListResponse struct {
+	// List is a compact JWS of type verifier.RevocationType whose payload is a verifier.RevocationUpdate,
+	// signed with the key published at /v1/revocations/jwks
+	List string `json:"list"`
+}
+
+// recordRevocations appends commitments that must stop verifying to the revocation log and announces
+// each on the event bus. The change that revoked them has already been stored, so a failure is
+// logged rather than reported. With commitment_blinding the commitments are the stored keyed hashes,
+// the raw ones being unknown here; verifiers match them with verifier.RevocationList.WithPepper.
+func (s *Server) recordRevocations(ctx context.Context, reason string, commitments []string) {
+	if len(commitments) == 0 {
+		return
+	}
+	revokedAt := time.Now().UTC()
+	revocations := make([]store.Revocation, len(commitments))
+	for i, commitment := range commitments {
+		revocations[i] = store.Revocation{CryptoCommitment: commitment, Reason: reason, RevokedAt: revokedAt}
+	}
+	if _, appendErr := s.store.AppendRevocations(ctx, revocations); appendErr != nil {
+		logf(ctx, "Error recording %d revocations (%s): %v", len(commitments), reason, appendErr)
+		return
+	}
+	for _, revocation := range revocations {
+		s.bus.emit(ctx, busCommitmentRevoked, "", revocation.CryptoCommitment, CommitmentRevoked{
+			CryptoCommitment: revocation.CryptoCommitment,
+			Reason:           revocation.Reason,
+			RevokedAt:        revocation.RevokedAt,
+		})
+	}
+}
+
+// revocationsHandler serves the revocation log as a signed list. With ?after=N it holds only the
+// entries numbered after N, so offline verifiers fetch what they miss; the sequence number and
+// Merkle root always cover the whole log, letting them check the result without the server.
+func (s *Server) revocationsHandler(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if text := r.URL.Query().Get("after"); text != "" {
+		var parseErr error
+		if after, parseErr = strconv.ParseUint(text, 10, 64); parseErr != nil {
+			writeRequestError(w, badRequest("after must be a sequence number"))
+			return
+		}
+	}
+	revocations, listErr := s.store.ListRevocations(r.Context(), 0)
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing revocations: %v", listErr))
+		return
+	}
+	if after > uint64(len(revocations)) {
+		writeProblem(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("The revocation log has %d entries", len(revocations)))
+		return
+	}
+
+	update := verifier.RevocationUpdate{IssuedAt: time.Now().Unix(), After: after, Sequence: uint64(len(revocations)), Entries: []verifier.RevocationEntry{}}
+	leaves := make([][32]byte, len(revocations))
+	for i, revocation := range revocations {
+		entry := verifier.RevocationEntry{
+			Sequence:         revocation.Sequence,
+			CryptoCommitment: revocation.CryptoCommitment,
+			Reason:           revocation.Reason,
+			RevokedAt:        revocation.RevokedAt,
+		}
+		leaves[i] = verifier.RevocationLeaf(entry)
+		if revocation.Sequence > after {
+			update.Entries = append(update.Entries, entry)
+		}
+	}
+	root := verifier.RevocationRoot(leaves)
+	update.Root = hex.EncodeToString(root[:])
+
+	list, signErr := s.tokens.sign(verifier.RevocationType, update)
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error signing revocation list: %v", signErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, RevocationListResponse{List: list})
+}
+
+// revocationKeysHandler publishes the key revocation lists are signed with
+func (s *Server) revocationKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, JSONWebKeySet{Keys: []JSONWebKey{s.tokens.signer().jwk}})
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// Namespaces and identifiers of SAML 2.0 and XML Signature
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	xmlDSigNS       = "http://www.w3.org/2000/09/xmldsig#"
+	exclusiveC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	samlPOSTBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+// maxRelayStateLength is the longest RelayState SAML bindings carry
+const maxRelayStateLength = 80
+
+// samlAttributeSources are the user fields the attributes of a service provider can carry
+var samlAttributeSources = map[string]func(store.User, *keyVersion) string{
+	"user_name":         func(user store.User, _ *keyVersion) string { return user.UserName },
+	"tenant":            func(user store.User, _ *keyVersion) string { return user.Tenant },
+	"crypto_commitment": func(user store.User, _ *keyVersion) string { return user.CryptoCommitment },
+	"circuit_version":   func(user store.User, _ *keyVersion) string { return user.CircuitVersion },
+	"curve":             func(user store.User, _ *keyVersion) string { return user.Curve },
+	"did_key":           func(user store.User, _ *keyVersion) string { return user.DIDKey },
+	"key_id":            func(_ store.User, version *keyVersion) string { return version.ID },
+}
+
+// samlIssuer signs SAML responses for the configured service providers
+type samlIssuer struct {
+	cfg         SAMLConfig
+	signer      crypto.Signer
+	certificate []byte // certificate is the DER of cert_file's leaf, sent in every signature's KeyInfo
+	algorithm   string // algorithm is the XML Signature method URI of signer
+	providers   map[string]SAMLServiceProvider
+}
+
+// newSAMLIssuer loads the signing certificate and checks the service providers; it returns nil
+// when saml.entity_id is empty
+func newSAMLIssuer(cfg SAMLConfig) (*samlIssuer, error) {
+	if cfg.EntityID == "" {
+		return nil, nil
+	}
+	pair, loadErr := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if loadErr != nil {
+		return nil, fmt.Errorf("loading saml certificate: %w", loadErr)
+	}
+	issuer := &samlIssuer{cfg: cfg, certificate: pair.Certificate[0], providers: make(map[string]SAMLServiceProvider)}
+	switch key := pair.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		issuer.signer, issuer.algorithm = key, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	case *ecdsa.PrivateKey:
+		issuer.signer, issuer.algorithm = key, "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	default:
+		return nil, fmt.Errorf("saml key_file must hold an RSA or ECDSA key, not %T", pair.PrivateKey)
+	}
+	for _, provider := range cfg.ServiceProviders {
+		acs, parseErr := url.Parse(provider.ACSURL)
+		switch {
+		case provider.EntityID == "":
+			return nil, errors.New("saml service provider without entity_id")
+		case issuer.providers[provider.EntityID].EntityID != "":
+			return nil, fmt.Errorf("saml service provider %q is configured twice", provider.EntityID)
+		case parseErr != nil || acs.Host == "" || acs.Scheme != "https" && acs.Hostname() != "localhost":
+			return nil, fmt.Errorf("saml service provider %q: acs_url must be an https URL", provider.EntityID)
+		}
+		for name, source := range provider.Attributes {
+			if samlAttributeSources[source] == nil {
+				return nil, fmt.Errorf("saml service provider %q: attribute %q maps unknown field %q", provider.EntityID, name, source)
+			}
+		}
+		if provider.NameIDFormat == "" {
+			provider.NameIDFormat = samlUnspecified
+		}
+		issuer.providers[provider.EntityID] = provider
+	}
+	return issuer, nil
+}
+
+// SAMLRequest is a proof submission asking for a SAML response for a service provider
+type SAMLRequest struct {
+	ProofRequest
+	ServiceProvider string `json:"service_provider"` // ServiceProvider is the entity ID of one of saml.service_providers
+	// InResponseTo is the ID of the service provider's AuthnRequest; omitted for IdP-initiated sign-ins
+	InResponseTo string `json:"in_response_to,omitempty"`
+	RelayState   string `json:"relay_state,omitempty"` // RelayState is returned as is, for the service provider
+}
+
+// validate checks the proof fields and the SAML parameters and returns the parsed nonce
+func (req *SAMLRequest) validate() (*big.Int, error) {
+	var v validate.Validator
+	nonce := req.ProofRequest.validateInto(&v)
+	if v.Required("service_provider", req.ServiceProvider) {
+		v.Text("service_provider", req.ServiceProvider, maxDIDLength)
+	}
+	if req.InResponseTo != "" && !isXMLID(req.InResponseTo) {
+		v.Fail("in_response_to", "must be an XML ID")
+	}
+	v.MaxLength("relay_state", len(req.RelayState), maxRelayStateLength)
+	return nonce, v.Err()
+}
+
+// isXMLID reports whether id can be an XML ID attribute value: a letter or underscore followed by
+// letters, digits, '.', '-' and '_'
+func isXMLID(id string) bool {
+	if len(id) > 256 {
+		return false
+	}
+	for i, c := range id {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '.' || c == '-')) {
+			return false
+		}
+	}
+	return id != ""
+}
+
+// SAMLResponse carries a signed response for the browser to post to the service provider, as the
+// HTTP-POST binding does
+type SAMLResponse struct {
+	ACSURL       string    `json:"acs_url"`       // ACSURL is where the form with SAMLResponse and RelayState is posted
+	SAMLResponse string    `json:"saml_response"` // SAMLResponse is the base64 samlp:Response, its assertion signed
+	RelayState   string    `json:"relay_state,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"` // ExpiresAt is when the assertion stops being accepted
+}
+
+// issueSAMLHandler verifies a proof and answers with a SAML response asserting it to a service provider
+func (s *Server) issueSAMLHandler(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "SAML is disabled")
+		return
+	}
+	var req SAMLRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	provider, known := s.saml.providers[req.ServiceProvider]
+	if !known {
+		writeRequestError(w, badRequest("service_provider: %q is not a configured service provider", req.ServiceProvider))
+		return
+	}
+
+	user, version, authErr := s.authenticate(r.Context(), req.ProofRequest, nonce)
+	if authErr != nil {
+		s.writeAuthError(w, req.ProofRequest, authErr)
+		return
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(s.cfg.SAML.AssertionTTL.Duration)
+	response, signErr := s.saml.response(provider, user, version, req.InResponseTo, now, expiresAt)
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error signing SAML response: %v", signErr))
+		return
+	}
+	logf(r.Context(), "Issued a SAML assertion of %q to %s", user.UserName, provider.EntityID)
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, http.StatusCreated, SAMLResponse{
+		ACSURL:       provider.ACSURL,
+		SAMLResponse: base64.StdEncoding.EncodeToString(response),
+		RelayState:   req.RelayState,
+		ExpiresAt:    expiresAt,
+	})
+}
+
+// samlMetadataHandler serves the IdP metadata service providers are configured from
+func (s *Server) samlMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if s.saml == nil {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "SAML is disabled")
+		return
+	}
+	descriptor := xmlElement{name: "md:IDPSSODescriptor", attrs: map[string]string{
+		"WantAuthnRequestsSigned": "false", "protocolSupportEnumeration": samlProtocolNS,
+	}, children: []xmlElement{
+		{name: "md:KeyDescriptor", attrs: map[string]string{"use": "signing"}, children: []xmlElement{s.saml.keyInfo(true)}},
+		{name: "md:NameIDFormat", text: samlUnspecified},
+	}}
+	if s.cfg.SAML.SSOURL != "" {
+		descriptor.children = append(descriptor.children, xmlElement{name: "md:SingleSignOnService", attrs: map[string]string{
+			"Binding": samlPOSTBinding, "Location": s.cfg.SAML.SSOURL,
+		}})
+	}
+	metadata := xmlElement{
+		name:       "md:EntityDescriptor",
+		namespaces: [][2]string{{"md", samlMetadataNS}},
+		attrs:      map[string]string{"entityID": s.cfg.SAML.EntityID},
+		children:   []xmlElement{descriptor},
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(metadata.String()))
+}
+
+// response builds the samlp:Response asserting that user authenticated, its assertion signed
+// with an enveloped signature
+func (i *samlIssuer) response(provider SAMLServiceProvider, user store.User, version *keyVersion, inResponseTo string, now, expiresAt time.Time) ([]byte, error) {
+	var ids [3]string // the IDs of the response, the assertion and the session
+	for n := range ids {
+		raw := make([]byte, 20)
+		if _, randErr := rand.Read(raw); randErr != nil {
+			return nil, randErr
+		}
+		ids[n] = "_" + hex.EncodeToString(raw)
+	}
+	responseID, assertionID, sessionIndex := ids[0], ids[1], ids[2]
+	instant, notOnOrAfter := now.Format(time.RFC3339), expiresAt.Format(time.RFC3339)
+	issuer := xmlElement{name: "saml:Issuer", text: i.cfg.EntityID}
+
+	var attributes []xmlElement
+	for _, name := range slices.Sorted(maps.Keys(provider.Attributes)) {
+		if value := samlAttributeSources[provider.Attributes[name]](user, version); value != "" {
+			attributes = append(attributes, xmlElement{name: "saml:Attribute", attrs: map[string]string{
+				"Name": name, "NameFormat": "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			}, children: []xmlElement{{name: "saml:AttributeValue", text: value}}})
+		}
+	}
+	assertion := xmlElement{
+		name:       "saml:Assertion",
+		namespaces: [][2]string{{"saml", samlAssertionNS}},
+		attrs:      map[string]string{"ID": assertionID, "IssueInstant": instant, "Version": "2.0"},
+		children: []xmlElement{
+			issuer,
+			{name: "saml:Subject", children: []xmlElement{
+				{name: "saml:NameID", attrs: map[string]string{"Format": provider.NameIDFormat}, text: user.UserName},
+				{name: "saml:SubjectConfirmation", attrs: map[string]string{"Method": "urn:oasis:names:tc:SAML:2.0:cm:bearer"}, children: []xmlElement{
+					{name: "saml:SubjectConfirmationData", attrs: map[string]string{
+						"InResponseTo": inResponseTo, "NotOnOrAfter": notOnOrAfter, "Recipient": provider.ACSURL,
+					}},
+				}},
+			}},
+			{name: "saml:Conditions", attrs: map[string]string{"NotBefore": instant, "NotOnOrAfter": notOnOrAfter}, children: []xmlElement{
+				{name: "saml:AudienceRestriction", children: []xmlElement{{name: "saml:Audience", text: provider.EntityID}}},
+			}},
+			{name: "saml:AuthnStatement", attrs: map[string]string{"AuthnInstant": instant, "SessionIndex": sessionIndex}, children: []xmlElement{
+				{name: "saml:AuthnContext", children: []xmlElement{
+					{name: "saml:AuthnContextClassRef", text: "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"},
+				}},
+			}},
+		},
+	}
+	if len(attributes) > 0 {
+		assertion.children = append(assertion.children, xmlElement{name: "saml:AttributeStatement", children: attributes})
+	}
+	signature, signErr := i.sign(assertionID, assertion.String())
+	if signErr != nil {
+		return nil, signErr
+	}
+	// The enveloped signature goes right after the assertion's Issuer, as the schema wants it
+	assertion.children = slices.Insert(assertion.children, 1, signature)
+
+	issuer.namespaces = [][2]string{{"saml", samlAssertionNS}}
+	response := xmlElement{
+		name:       "samlp:Response",
+		namespaces: [][2]string{{"samlp", samlProtocolNS}},
+		attrs: map[string]string{
+			"Destination": provider.ACSURL, "ID": responseID, "InResponseTo": inResponseTo, "IssueInstant": instant, "Version": "2.0",
+		},
+		children: []xmlElement{
+			issuer,
+			{name: "samlp:Status", children: []xmlElement{
+				{name: "samlp:StatusCode", attrs: map[string]string{"Value": "urn:oasis:names:tc:SAML:2.0:status:Success"}},
+			}},
+			assertion,
+		},
+	}
+	return []byte(response.String()), nil
+}
+
+// sign makes the enveloped signature of the element with the given ID, whose exclusive canonical
+// form without the signature is canonical
+func (i *samlIssuer) sign(id, canonical string) (xmlElement, error) {
+	digest := sha256.Sum256([]byte(canonical))
+	signedInfo := xmlElement{name: "ds:SignedInfo", children: []xmlElement{
+		{name: "ds:CanonicalizationMethod", attrs: map[string]string{"Algorithm": exclusiveC14N}},
+		{name: "ds:SignatureMethod", attrs: map[string]string{"Algorithm": i.algorithm}},
+		{name: "ds:Reference", attrs: map[string]string{"URI": "#" + id}, children: []xmlElement{
+			{name: "ds:Transforms", children: []xmlElement{
+				{name: "ds:Transform", attrs: map[string]string{"Algorithm": "http://www.w3.org/2000/09/xmldsig#enveloped-signature"}},
+				{name: "ds:Transform", attrs: map[string]string{"Algorithm": exclusiveC14N}},
+			}},
+			{name: "ds:DigestMethod", attrs: map[string]string{"Algorithm": "http://www.w3.org/2001/04/xmlenc#sha256"}},
+			{name: "ds:DigestValue", text: base64.StdEncoding.EncodeToString(digest[:])},
+		}},
+	}}
+	// Canonicalized on its own, SignedInfo declares the ds namespace its Signature parent holds
+	standalone := signedInfo
+	standalone.namespaces = [][2]string{{"ds", xmlDSigNS}}
+	signedDigest := sha256.Sum256([]byte(standalone.String()))
+	signatureValue, signErr := i.signer.Sign(rand.Reader, signedDigest[:], crypto.SHA256)
+	if signErr != nil {
+		return xmlElement{}, signErr
+	}
+	if key, isECDSA := i.signer.Public().(*ecdsa.PublicKey); isECDSA {
+		// XML Signature wants r and s concatenated, not the ASN.1 encoding Sign returns
+		if signatureValue, signErr = concatenatedECDSA(signatureValue, (key.Curve.Params().BitSize+7)/8); signErr != nil {
+			return xmlElement{}, signErr
+		}
+	}
+	return xmlElement{
+		name:       "ds:Signature",
+		namespaces: [][2]string{{"ds", xmlDSigNS}},
+		children: []xmlElement{
+			signedInfo,
+			{name: "ds:SignatureValue", text: base64.StdEncoding.EncodeToString(signatureValue)},
+			i.keyInfo(false),
+		},
+	}, nil
+}
+
+// keyInfo is the ds:KeyInfo holding the signing certificate, declaring the ds namespace when
+// standalone
+func (i *samlIssuer) keyInfo(standalone bool) xmlElement {
+	keyInfo := xmlElement{name: "ds:KeyInfo", children: []xmlElement{
+		{name: "ds:X509Data", children: []xmlElement{
+			{name: "ds:X509Certificate", text: base64.StdEncoding.EncodeToString(i.certificate)},
+		}},
+	}}
+	if standalone {
+		keyInfo.namespaces = [][2]string{{"ds", xmlDSigNS}}
+	}
+	return keyInfo
+}
+
+// concatenatedECDSA converts an ASN.1 ECDSA signature to r || s, each size bytes
+func concatenatedECDSA(der []byte, size int) ([]byte, error) {
+	r, s, parseErr := parseECDSASignature(der)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+}
+
+// parseECDSASignature decodes the r and s of an ASN.1 ECDSA signature
+func parseECDSASignature(der []byte) (*big.Int, *big.Int, error) {
+	var signature struct{ R, S *big.Int }
+	if _, parseErr := asn1.Unmarshal(der, &signature); parseErr != nil {
+		return nil, nil, fmt.Errorf("decoding ECDSA signature: %w", parseErr)
+	}
+	return signature.R, signature.S, nil
+}
+
+// xmlElement is an element written in exclusive XML canonical form: namespace declarations
+// first, attributes sorted, explicit end tags and canonical escaping. A signature computed over
+// the written bytes is thus computed over the canonical form verifiers recompute.
+type xmlElement struct {
+	name       string
+	namespaces [][2]string       // namespaces are the prefixes declared on the element, in prefix order
+	attrs      map[string]string // attrs are unprefixed attributes; empty values are left out
+	children   []xmlElement
+	text       string // text is the content of elements without children
+}
+
+// String writes the element
+func (e xmlElement) String() string {
+	var b strings.Builder
+	e.write(&b)
+	return b.String()
+}
+
+// write appends the element to b
+func (e xmlElement) write(b *strings.Builder) {
+	b.WriteString("<" + e.name)
+	for _, namespace := range e.namespaces {
+		b.WriteString(" xmlns:" + namespace[0] + `="` + xmlAttrEscaper.Replace(namespace[1]) + `"`)
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.attrs)) {
+		if value := e.attrs[name]; value != "" {
+			b.WriteString(" " + name + `="` + xmlAttrEscaper.Replace(value) + `"`)
+		}
+	}
+	b.WriteString(">")
+	b.WriteString(xmlTextEscaper.Replace(e.text))
+	for _, child := range e.children {
+		child.write(b)
+	}
+	b.WriteString("</" + e.name + ">")
+}
+
+// The escaping of canonical XML text and attribute values
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
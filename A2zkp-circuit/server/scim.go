@@ -0,0 +1,534 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+)
+
+// URNs of the SCIM 2.0 schemas and messages (RFC 7643, RFC 7644) the /scim/v2 routes speak
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimOFASchema    = "urn:ietf:params:scim:schemas:extension:ofa:2.0:User"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// scimContentType is the media type of SCIM requests and responses
+const scimContentType = "application/scim+json"
+
+// maxSCIMResults bounds the users of one page of GET /scim/v2/Users
+const maxSCIMResults = 200
+
+// SCIMUser is a registration as a SCIM User resource. Its id is the user name; the IdP's other
+// attributes, such as name and emails, are accepted and ignored, since nothing but the commitment
+// and its parameters is stored.
+type SCIMUser struct {
+	Schemas  []string `json:"schemas"`
+	ID       string   `json:"id,omitempty"`
+	UserName string   `json:"userName"`
+	// Active is false once the registration was deactivated or expired; nil in requests leaves it as it is
+	Active *bool     `json:"active,omitempty"`
+	Meta   *SCIMMeta `json:"meta,omitempty"`
+	// OFA holds the commitment, required to create a user and replacing the stored one in a PUT
+	OFA *SCIMCommitment `json:"urn:ietf:params:scim:schemas:extension:ofa:2.0:User,omitempty"`
+}
+
+// SCIMCommitment is the extension schema carrying what POST /v1/users would register
+type SCIMCommitment struct {
+	CryptoCommitment string            `json:"cryptoCommitment"`
+	Salt             []byte            `json:"salt,omitempty"`
+	KDF              *secret.KDFParams `json:"kdf,omitempty"`
+	Curve            string            `json:"curve,omitempty"`
+	Tenant           string            `json:"tenant,omitempty"`      // Tenant can't change once the user is created
+	PolicyProof      []byte            `json:"policyProof,omitempty"` // PolicyProof is only read, as policy_proof is on registrations
+}
+
+// SCIMMeta describes a SCIM resource
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	Location     string    `json:"location"`
+}
+
+// SCIMListResponse is a page of the users matching a query
+type SCIMListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"` // StartIndex is the 1-based position of the first resource
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []SCIMUser `json:"Resources"`
+}
+
+// SCIMPatchRequest is the body of PATCH /scim/v2/Users/{id}
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation changes one attribute; only active is stored, so operations on other paths
+// are ignored
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`             // Op is "add", "replace" or "remove", in any case
+	Path  string          `json:"path,omitempty"` // Path is empty when Value is an object of attributes
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// SCIMError is the error message of the SCIM routes
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`             // Status is the HTTP status code, as a string
+	SCIMType string   `json:"scimType,omitempty"` // SCIMType is e.g. "uniqueness" or "invalidFilter"
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// SCIMServiceProviderConfig describes the SCIM features the server supports
+type SCIMServiceProviderConfig struct {
+	Schemas               []string                 `json:"schemas"`
+	Patch                 SCIMSupported            `json:"patch"`
+	Bulk                  SCIMSupported            `json:"bulk"`
+	Filter                SCIMFilterSupport        `json:"filter"`
+	ChangePassword        SCIMSupported            `json:"changePassword"`
+	Sort                  SCIMSupported            `json:"sort"`
+	ETag                  SCIMSupported            `json:"etag"`
+	AuthenticationSchemes []SCIMAuthenticationType `json:"authenticationSchemes"`
+}
+
+// SCIMSupported tells whether a SCIM feature is supported
+type SCIMSupported struct {
+	Supported bool `json:"supported"`
+}
+
+// SCIMFilterSupport describes the filters accepted: userName eq only
+type SCIMFilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// SCIMAuthenticationType describes how SCIM clients authenticate
+type SCIMAuthenticationType struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// writeSCIM writes a SCIM response body
+func writeSCIM(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeSCIMError writes a SCIM error message
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeSCIM(w, status, SCIMError{Schemas: []string{scimErrorSchema}, Status: strconv.Itoa(status), SCIMType: scimType, Detail: detail})
+}
+
+// writeSCIMProblem reports the problem POST /v1/users would answer with as a SCIM error
+func writeSCIMProblem(w http.ResponseWriter, problem Problem) {
+	var scimType string
+	switch {
+	case problem.Status == http.StatusConflict:
+		scimType = "uniqueness"
+	case problem.Status == http.StatusBadRequest || problem.Status == http.StatusUnprocessableEntity:
+		scimType = "invalidValue"
+	}
+	writeSCIMError(w, problem.Status, scimType, problem.Detail)
+}
+
+// decodeSCIM decodes a SCIM request body of at most limit bytes into dst. Unlike decodeJSON it
+// ignores unknown attributes, as IdPs send all those they hold.
+func decodeSCIM(w http.ResponseWriter, r *http.Request, limit int64, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	decodeErr := json.NewDecoder(r.Body).Decode(dst)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case decodeErr == nil:
+		return nil
+	case errors.As(decodeErr, &maxBytesErr):
+		return &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    codeBodyTooLarge,
+			message: fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit),
+		}
+	case errors.Is(decodeErr, io.EOF):
+		return badRequest("Request body is empty")
+	}
+	return badRequest("Invalid SCIM request: %v", decodeErr)
+}
+
+// newSCIMUser describes a stored registration as a SCIM User
+func newSCIMUser(user store.User) SCIMUser {
+	active := !user.Expired(time.Now())
+	return SCIMUser{
+		Schemas:  []string{scimUserSchema, scimOFASchema},
+		ID:       user.UserName,
+		UserName: user.UserName,
+		Active:   &active,
+		Meta:     &SCIMMeta{ResourceType: "User", Created: user.CreatedAt, Location: "/scim/v2/Users/" + url.PathEscape(user.UserName)},
+		OFA: &SCIMCommitment{
+			CryptoCommitment: user.CryptoCommitment,
+			Salt:             user.Salt,
+			KDF:              user.KDF,
+			Curve:            user.Curve,
+			Tenant:           user.Tenant,
+		},
+	}
+}
+
+// scimUser loads the user of a SCIM request, writing a 404 when there is none or it belongs to
+// another tenant than the principal's
+func (s *Server) scimUser(w http.ResponseWriter, r *http.Request, userName string) (store.User, bool) {
+	user, getErr := s.getUser(r.Context(), userName)
+	switch {
+	case errors.Is(getErr, store.ErrUserNotFound) || getErr == nil && !requestPrincipal(r).managesTenant(user.Tenant):
+		writeSCIMError(w, http.StatusNotFound, "", "Unknown user")
+		return store.User{}, false
+	case getErr != nil:
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error loading user: %v", getErr))
+		return store.User{}, false
+	}
+	return user, true
+}
+
+// createSCIMUserHandler registers a user provisioned by an IdP, with the checks of a batch
+// registration; the commitment comes in the extension schema
+func (s *Server) createSCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req SCIMUser
+	if decodeErr := decodeSCIM(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeSCIMProblem(w, requestProblem(decodeErr))
+		return
+	}
+	if req.OFA == nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "Missing the "+scimOFASchema+" extension carrying the cryptoCommitment")
+		return
+	}
+	registration := RegisterRequest{
+		UserName:         req.UserName,
+		CryptoCommitment: req.OFA.CryptoCommitment,
+		Salt:             req.OFA.Salt,
+		KDF:              req.OFA.KDF,
+		Curve:            req.OFA.Curve,
+		Tenant:           req.OFA.Tenant,
+		PolicyProof:      req.OFA.PolicyProof,
+	}
+	if _, problem := s.registerChunk(r, []RegisterRequest{registration}); problem != nil {
+		writeSCIMProblem(w, *problem)
+		return
+	}
+	user, getErr := s.getUser(r.Context(), req.UserName)
+	if getErr == nil && req.Active != nil && !*req.Active {
+		user, getErr = s.updateSCIMUser(r.Context(), req.UserName, req.Active, nil)
+	}
+	if getErr != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error loading the new user: %v", getErr))
+		return
+	}
+	logf(r.Context(), "Provisioned user %q through SCIM", user.UserName)
+	created := newSCIMUser(user)
+	w.Header().Set("Location", created.Meta.Location)
+	writeSCIM(w, http.StatusCreated, created)
+}
+
+// listSCIMUsersHandler pages through the users the principal manages, optionally filtered with
+// userName eq "<name>", the filter IdPs look users up with
+func (s *Server) listSCIMUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	nameFilter, filtered, filterErr := parseSCIMFilter(query.Get("filter"))
+	if filterErr != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidFilter", filterErr.Error())
+		return
+	}
+	startIndex, count := 1, maxSCIMResults
+	for name, value := range map[string]*int{"startIndex": &startIndex, "count": &count} {
+		if text := query.Get(name); text != "" {
+			parsed, parseErr := strconv.Atoi(text)
+			if parseErr != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidValue", name+" must be an integer")
+				return
+			}
+			*value = parsed
+		}
+	}
+	startIndex, count = max(startIndex, 1), min(max(count, 0), maxSCIMResults)
+
+	users, listErr := s.store.ListUsers(r.Context())
+	if listErr != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error listing users: %v", listErr))
+		return
+	}
+	p := requestPrincipal(r)
+	var matching []store.User
+	for _, user := range users {
+		if p.managesTenant(user.Tenant) && !user.Deleted() && (!filtered || user.UserName == nameFilter) {
+			matching = append(matching, user)
+		}
+	}
+	page := matching[min(startIndex-1, len(matching)):min(startIndex-1+count, len(matching))]
+	response := SCIMListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matching),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    make([]SCIMUser, len(page)),
+	}
+	for i, user := range page {
+		response.Resources[i] = newSCIMUser(user)
+	}
+	writeSCIM(w, http.StatusOK, response)
+}
+
+// parseSCIMFilter parses the only filter supported, userName eq "<name>", reporting false for
+// an empty one
+func parseSCIMFilter(filter string) (string, bool, error) {
+	if filter == "" {
+		return "", false, nil
+	}
+	attribute, rest, _ := strings.Cut(strings.TrimSpace(filter), " ")
+	operator, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	name, unquoteErr := strconv.Unquote(strings.TrimSpace(value))
+	if !strings.EqualFold(attribute, "userName") || !strings.EqualFold(operator, "eq") || unquoteErr != nil {
+		return "", false, fmt.Errorf("unsupported filter %q: only userName eq \"<name>\" is supported", filter)
+	}
+	return name, true, nil
+}
+
+// getSCIMUserHandler returns a provisioned user
+func (s *Server) getSCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	if user, found := s.scimUser(w, r, r.PathValue("id")); found {
+		writeSCIM(w, http.StatusOK, newSCIMUser(user))
+	}
+}
+
+// replaceSCIMUserHandler applies a PUT of a user: its active flag and, when the extension carries
+// another cryptoCommitment, the replacement of its commitment. userName and tenant can't change.
+func (s *Server) replaceSCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	var req SCIMUser
+	if decodeErr := decodeSCIM(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeSCIMProblem(w, requestProblem(decodeErr))
+		return
+	}
+	current, found := s.scimUser(w, r, userName)
+	if !found {
+		return
+	}
+	if req.UserName != "" && req.UserName != userName {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "userName can't be changed; delete the user and create another")
+		return
+	}
+	var replacement *RegisterRequest
+	if req.OFA != nil && !s.blinder.matches(current.CryptoCommitment, req.OFA.CryptoCommitment) {
+		if req.OFA.Tenant != "" && req.OFA.Tenant != current.Tenant {
+			writeSCIMError(w, http.StatusBadRequest, "mutability", "tenant can't be changed")
+			return
+		}
+		replacement = &RegisterRequest{
+			UserName:         userName,
+			CryptoCommitment: req.OFA.CryptoCommitment,
+			Salt:             req.OFA.Salt,
+			KDF:              req.OFA.KDF,
+			Curve:            req.OFA.Curve,
+			Tenant:           current.Tenant,
+			PolicyProof:      req.OFA.PolicyProof,
+		}
+		if problem := s.checkSCIMCommitment(r.Context(), replacement); problem != nil {
+			writeSCIMProblem(w, *problem)
+			return
+		}
+	}
+	s.writeSCIMUpdate(w, r, userName, req.Active, replacement)
+}
+
+// checkSCIMCommitment runs the checks of POST /v1/users on a commitment replacing a user's
+func (s *Server) checkSCIMCommitment(ctx context.Context, replacement *RegisterRequest) *Problem {
+	checkErr := replacement.validate()
+	if checkErr == nil {
+		checkErr = s.checkCurve(replacement.Curve, replacement.Tenant)
+	}
+	if checkErr == nil {
+		checkErr = s.checkKDF(replacement)
+	}
+	if checkErr == nil {
+		checkErr = s.checkDuplicate(ctx, *replacement)
+	}
+	if checkErr == nil {
+		checkErr = s.checkDID(ctx, replacement)
+	}
+	if checkErr != nil {
+		problem := requestProblem(checkErr)
+		return &problem
+	}
+	if policyErr := s.checkSecretPolicy(ctx, replacement.CryptoCommitment, replacement.PolicyProof); policyErr != nil {
+		problem := policyProblem(policyErr)
+		return &problem
+	}
+	return nil
+}
+
+// patchSCIMUserHandler applies the operations of a PATCH of a user to its active flag, the only
+// attribute a PATCH can change; operations on others are ignored
+func (s *Server) patchSCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	var req SCIMPatchRequest
+	if decodeErr := decodeSCIM(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeSCIMProblem(w, requestProblem(decodeErr))
+		return
+	}
+	if !slices.Contains(req.Schemas, scimPatchSchema) {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "A patch must have the "+scimPatchSchema+" schema")
+		return
+	}
+	if _, found := s.scimUser(w, r, userName); !found {
+		return
+	}
+	var active *bool
+	for _, operation := range req.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" {
+			continue
+		}
+		value := operation.Value
+		if operation.Path == "" {
+			var attributes map[string]json.RawMessage
+			if json.Unmarshal(value, &attributes) != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidValue", "A patch operation without path needs an object value")
+				return
+			}
+			value = nil
+			for name, attribute := range attributes {
+				if strings.EqualFold(name, "active") {
+					value = attribute
+				}
+			}
+		} else if !strings.EqualFold(operation.Path, "active") {
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		parsed, parseErr := parseSCIMBool(value)
+		if parseErr != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", parseErr.Error())
+			return
+		}
+		active = &parsed
+	}
+	s.writeSCIMUpdate(w, r, userName, active, nil)
+}
+
+// parseSCIMBool decodes a boolean attribute value, which some IdPs send as the string "True" or "False"
+func parseSCIMBool(value json.RawMessage) (bool, error) {
+	var parsed bool
+	if json.Unmarshal(value, &parsed) == nil {
+		return parsed, nil
+	}
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		if parsed, parseErr := strconv.ParseBool(text); parseErr == nil {
+			return parsed, nil
+		}
+	}
+	return false, fmt.Errorf("active must be a boolean, not %s", value)
+}
+
+// writeSCIMUpdate applies an update and answers with the updated user
+func (s *Server) writeSCIMUpdate(w http.ResponseWriter, r *http.Request, userName string, active *bool, replacement *RegisterRequest) {
+	user, updateErr := s.updateSCIMUser(r.Context(), userName, active, replacement)
+	switch {
+	case errors.Is(updateErr, store.ErrUserNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", "Unknown user")
+	case updateErr != nil:
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error updating user: %v", updateErr))
+	default:
+		writeSCIM(w, http.StatusOK, newSCIMUser(user))
+	}
+}
+
+// updateSCIMUser sets a user's active flag and replaces its commitment with that of a checked
+// registration, either being nil to leave it. Deactivating sets the registration's expiry to now,
+// so proofs stop verifying at once, the expiry sweeper publishes its commitments as revoked and its
+// refresh tokens are deleted; reactivating clears the expiry. Offline verifiers keep refusing
+// commitments already published as revoked until a new one replaces them. A replaced commitment
+// is published as revoked.
+func (s *Server) updateSCIMUser(ctx context.Context, userName string, active *bool, replacement *RegisterRequest) (store.User, error) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.getUser(ctx, userName)
+	if getErr != nil {
+		return store.User{}, getErr
+	}
+	now := time.Now().UTC()
+	deactivated := false
+	switch {
+	case active == nil:
+	case !*active && !user.Expired(now):
+		user.ExpiresAt, deactivated = &now, true
+	case *active && user.Expired(now):
+		user.ExpiresAt, user.ExpiredAt = nil, nil
+	}
+	replaced := user.CryptoCommitment
+	if replacement != nil {
+		// The commitment is bound to the circuit of the user's tenant, whatever the replacement names
+		registration := *replacement
+		registration.Tenant = user.Tenant
+		fresh := s.newUser(registration)
+		user.CryptoCommitment, user.Salt, user.KDF = fresh.CryptoCommitment, fresh.Salt, fresh.KDF
+		user.CircuitVersion, user.Curve, user.KeyID, user.DIDKey = fresh.CircuitVersion, fresh.Curve, fresh.KeyID, fresh.DIDKey
+		// A commitment completes the migration of an imported user too, retiring their legacy password
+		user.Legacy = nil
+	}
+	if putErr := s.store.PutUser(ctx, user); putErr != nil {
+		return store.User{}, putErr
+	}
+	if replacement != nil && replaced != "" {
+		s.recordRevocations(ctx, store.RevokedRecovery, []string{replaced})
+		s.notices.send(ctx, SecurityNotice{Type: noticeCommitmentRotated, UserName: user.UserName, Tenant: user.Tenant, Via: "scim"})
+		logf(ctx, "Replaced the commitment of %q through SCIM", userName)
+	}
+	if deactivated {
+		if _, refreshErr := s.refresh.forgetUser(ctx, userName); refreshErr != nil {
+			logf(ctx, "Error deleting refresh tokens of %q: %v", userName, refreshErr)
+		}
+		logf(ctx, "Deactivated user %q through SCIM", userName)
+	}
+	return user, nil
+}
+
+// deleteSCIMUserHandler deletes a deprovisioned user as DELETE /v1/users/{id} does
+func (s *Server) deleteSCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	if _, found := s.scimUser(w, r, userName); !found {
+		return
+	}
+	if _, eraseErr := s.deleteUser(r.Context(), userName, false); eraseErr != nil && !errors.Is(eraseErr, store.ErrUserNotFound) {
+		writeSCIMError(w, http.StatusInternalServerError, "", fmt.Sprintf("Error deleting user: %v", eraseErr))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimConfigHandler describes the SCIM features supported to IdPs
+func (s *Server) scimConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, http.StatusOK, SCIMServiceProviderConfig{
+		Schemas: []string{scimConfigSchema},
+		Patch:   SCIMSupported{Supported: true},
+		Filter:  SCIMFilterSupport{Supported: true, MaxResults: maxSCIMResults},
+		AuthenticationSchemes: []SCIMAuthenticationType{{
+			Type: "oauthbearertoken", Name: "API key", Description: "An API key with the manage_users permission, or the admin token",
+		}},
+	})
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/verifier"
+)
+
+// Outcomes of a self-test and of its checks
+const (
+	selfTestPass = "pass"
+	selfTestFail = "fail"
+	selfTestSkip = "skip" // selfTestSkip marks a check left out because one it depends on failed
+)
+
+// selfTestTokenType is the "typ" header of the token a self-test signs, which no route accepts
+const selfTestTokenType = "self-test+jwt"
+
+// phaseSelfTest is the startup phase running the self-test, after the keys are ready
+const phaseSelfTest = "self-test"
+
+// selfTestFailed is the readiness status of a server whose latest self-test failed
+const selfTestFailed = "failed"
+
+// Checks of a self-test, in the order they run
+const (
+	checkCircuit    = "circuit"
+	checkProve      = "prove"
+	checkVerify     = "verify"
+	checkStorage    = "storage"
+	checkSignatures = "signatures"
+)
+
+// SelfTestReport is the outcome of an end-to-end self-test, as POST /admin/self-test answers and
+// GET /readyz reports the latest one
+type SelfTestReport struct {
+	Status  string          `json:"status"` // Status is "pass" when every check passed and "fail" otherwise
+	KeyID   string          `json:"key_id"` // KeyID is the key version the throwaway proof was made with
+	RanAt   time.Time       `json:"ran_at"`
+	Seconds float64         `json:"seconds"`
+	Checks  []SelfTestCheck `json:"checks"`
+}
+
+// SelfTestCheck is one step of a self-test
+type SelfTestCheck struct {
+	Name    string  `json:"name"`   // Name is "circuit", "prove", "verify", "storage" or "signatures"
+	Status  string  `json:"status"` // Status is "pass", "fail" or "skip"
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// passed reports whether every check of the report passed
+func (r *SelfTestReport) passed() bool {
+	return r == nil || r.Status == selfTestPass
+}
+
+// selfTest runs the circuit, a throwaway proof and its verification, a storage round trip and
+// signatures through the same code that serves requests, so a deploy that can't authenticate
+// anyone is caught before it takes traffic
+func (s *Server) selfTest(ctx context.Context) *SelfTestReport {
+	version := s.keyring.current()
+	report := &SelfTestReport{Status: selfTestPass, KeyID: version.ID, RanAt: time.Now().UTC()}
+	run := func(name string, check func() error) bool {
+		started := time.Now()
+		checkErr := check()
+		result := SelfTestCheck{Name: name, Status: selfTestPass, Seconds: time.Since(started).Seconds()}
+		if checkErr != nil {
+			result.Status, result.Error = selfTestFail, checkErr.Error()
+			report.Status = selfTestFail
+		}
+		report.Checks = append(report.Checks, result)
+		return checkErr == nil
+	}
+	skip := func(names ...string) {
+		for _, name := range names {
+			report.Checks = append(report.Checks, SelfTestCheck{Name: name, Status: selfTestSkip})
+		}
+	}
+
+	var proof []byte
+	var inputs verifier.PublicInputs
+	switch {
+	case !run(checkCircuit, func() error { return checkKeys(version) }):
+		skip(checkProve, checkVerify)
+	case !run(checkProve, func() (proveErr error) { proof, inputs, proveErr = s.selfTestProof(ctx, version); return proveErr }):
+		skip(checkVerify)
+	default:
+		run(checkVerify, func() error { return selfTestVerify(ctx, version, proof, inputs) })
+	}
+	run(checkStorage, func() error { return s.selfTestStorage(ctx) })
+	run(checkSignatures, func() error { return s.selfTestSignatures(ctx, version) })
+	report.Seconds = time.Since(report.RanAt).Seconds()
+	return report
+}
+
+// checkKeys checks that a key version holds a compiled circuit and both keys, over the circuit's curve
+func checkKeys(version *keyVersion) error {
+	switch {
+	case version.keys.ccs == nil || version.keys.ccs.GetNbConstraints() == 0:
+		return errors.New("the circuit is not compiled")
+	case version.keys.provingKey == nil || version.keys.verifyingKey == nil:
+		return errors.New("the keys are not loaded")
+	case version.keys.verifyingKey.CurveID() != circuit.Curve:
+		return fmt.Errorf("the verifying key is over %s, not %s", version.keys.verifyingKey.CurveID(), circuit.Curve)
+	}
+	return nil
+}
+
+// selfTestProof proves knowledge of a random secret against a random nonce with a key version,
+// returning the encoded proof and the public inputs it is for
+func (s *Server) selfTestProof(ctx context.Context, version *keyVersion) ([]byte, verifier.PublicInputs, error) {
+	raw := make([]byte, 32)
+	if _, randErr := rand.Read(raw); randErr != nil {
+		return nil, verifier.PublicInputs{}, randErr
+	}
+	userSecret := secret.FromFieldBytes(raw)
+	defer userSecret.Zero()
+	nonce, nonceErr := rand.Int(rand.Reader, circuit.Curve.ScalarField())
+	if nonceErr != nil {
+		return nil, verifier.PublicInputs{}, nonceErr
+	}
+	commitment, commitErr := s.cfg.Circuit.GenerateCommitment(userSecret)
+	if commitErr != nil {
+		return nil, verifier.PublicInputs{}, commitErr
+	}
+	fullWitness, witnessErr := s.cfg.Circuit.NewWitness(userSecret, nonce)
+	if witnessErr != nil {
+		return nil, verifier.PublicInputs{}, witnessErr
+	}
+	defer circuit.WipeWitness(fullWitness)
+	proof, proveErr := s.prover.Prove(ctx, version.keys.ccs, version.keys.provingKey, fullWitness)
+	if proveErr != nil {
+		return nil, verifier.PublicInputs{}, proveErr
+	}
+	encoded, encodeErr := prover.EncodeProof(proof)
+	return encoded, verifier.PublicInputs{Commitment: commitment, Nonce: nonce}, encodeErr
+}
+
+// selfTestVerify checks that the proof verifies against its inputs and is rejected against another nonce
+func selfTestVerify(ctx context.Context, version *keyVersion, proof []byte, inputs verifier.PublicInputs) error {
+	v := verifier.New(version.keys.verifyingKey)
+	if verifyErr := v.VerifyProof(ctx, proof, inputs); verifyErr != nil {
+		return fmt.Errorf("a valid proof was rejected: %w", verifyErr)
+	}
+	inputs.Nonce = new(big.Int).Add(inputs.Nonce, big.NewInt(1))
+	if v.VerifyProof(ctx, proof, inputs) == nil {
+		return errors.New("a proof verified against another nonce")
+	}
+	return nil
+}
+
+// selfTestStorage looks up, stores, reads back and deletes a throwaway registration. Its name starts
+// with a NUL byte, which no user name may contain, so it can't collide with a real one. A directory
+// store only registers users it has an entry for, and a read replica's store none, so there the
+// lookup alone is checked.
+func (s *Server) selfTestStorage(ctx context.Context) error {
+	token, tokenErr := randomToken()
+	if tokenErr != nil {
+		return tokenErr
+	}
+	probe := store.User{UserName: "\x00self-test:" + token, CryptoCommitment: "1", CircuitVersion: s.circuitVersion, CreatedAt: time.Now().UTC()}
+	if _, lookupErr := s.store.GetUser(ctx, probe.UserName); !errors.Is(lookupErr, store.ErrUserNotFound) {
+		return fmt.Errorf("looking up an unknown user: %v", lookupErr)
+	}
+	putErr := s.store.PutUser(ctx, probe)
+	switch {
+	case errors.Is(putErr, store.ErrNoDirectoryEntry), errors.Is(putErr, store.ErrReadOnly):
+		return nil
+	case putErr != nil:
+		return fmt.Errorf("writing: %w", putErr)
+	}
+	read, getErr := s.store.GetUser(ctx, probe.UserName)
+	deleteErr := s.store.DeleteUser(ctx, probe.UserName)
+	switch {
+	case getErr != nil:
+		return fmt.Errorf("reading back: %w", getErr)
+	case !s.blinder.matches(read.CryptoCommitment, probe.CryptoCommitment) || read.CircuitVersion != probe.CircuitVersion:
+		return errors.New("the registration read back differs from the one written")
+	case deleteErr != nil:
+		return fmt.Errorf("deleting: %w", deleteErr)
+	}
+	if _, goneErr := s.store.GetUser(ctx, probe.UserName); !errors.Is(goneErr, store.ErrUserNotFound) {
+		return fmt.Errorf("the deleted registration is still found: %v", goneErr)
+	}
+	return nil
+}
+
+// selfTestSignatures signs a token and checks it against the published keys, then signs the key
+// version's manifest and checks it as clients pinning the verifying key do
+func (s *Server) selfTestSignatures(ctx context.Context, version *keyVersion) error {
+	issuer := s.cfg.OIDC.issuer()
+	now := time.Now()
+	token, signErr := s.tokens.sign(selfTestTokenType, registeredClaims{Issuer: issuer, Subject: "self-test", Audience: issuer, ExpiresAt: now.Add(time.Minute).Unix(), IssuedAt: now.Unix()})
+	if signErr != nil {
+		return fmt.Errorf("signing a token: %w", signErr)
+	}
+	var claims registeredClaims
+	if verifyErr := s.tokens.verify(token, selfTestTokenType, issuer, &claims); verifyErr != nil {
+		return fmt.Errorf("verifying a token: %w", verifyErr)
+	}
+
+	var key bytes.Buffer
+	if _, writeErr := version.keys.verifyingKey.WriteTo(&key); writeErr != nil {
+		return writeErr
+	}
+	manifest := verifier.KeyManifest{CircuitVersion: version.CircuitVersion, KeyID: version.ID, Curve: circuit.Curve.String(), Digest: sha256Hash(key.Bytes())}
+	signed, manifestErr := s.signingKeys.sign(ctx, verifier.KeyManifestType, manifest)
+	if manifestErr != nil {
+		return fmt.Errorf("signing the key manifest: %w", manifestErr)
+	}
+	signer, currentErr := s.signingKeys.current(ctx)
+	if currentErr != nil {
+		return currentErr
+	}
+	if _, verifyErr := verifier.VerifyKeyManifest(signed, signer.signer.Public(), key.Bytes()); verifyErr != nil {
+		return fmt.Errorf("verifying the key manifest: %w", verifyErr)
+	}
+	return nil
+}
+
+// recordSelfTest keeps report as the latest self-test, which GET /readyz reports and fails on, and logs it
+func (s *Server) recordSelfTest(report *SelfTestReport) {
+	s.lastSelfTest.Store(report)
+	if report.passed() {
+		log.Printf("Self-test passed in %.3fs", report.Seconds)
+		return
+	}
+	var failed []string
+	for _, check := range report.Checks {
+		if check.Status == selfTestFail {
+			failed = append(failed, check.Name+": "+check.Error)
+		}
+	}
+	log.Printf("SELF-TEST FAILED, reporting not ready: %s", strings.Join(failed, "; "))
+}
+
+// selfTestHandler runs the self-test on the worker pool and answers with its report; a failure
+// makes /readyz report the server not ready until a later self-test passes
+func (s *Server) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	var report *SelfTestReport
+	poolErr := s.pool.Do(r.Context(), func() { report = s.selfTest(r.Context()) })
+	switch {
+	case errors.Is(poolErr, ErrPoolBusy):
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	case poolErr != nil:
+		writeProblem(w, http.StatusServiceUnavailable, codeTimeout, fmt.Sprintf("Self-test abandoned: %v", poolErr))
+		return
+	}
+	s.recordSelfTest(report)
+	writeResponse(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,1360 @@
+// Package server is the HTTP API of the one-factor authentication service: registration,
+// challenges and proof verification, plus the OAuth/OIDC provider, credential issuance,
+// key rotation and on-chain verification built on them.
+//
+// New assembles a Server from a Config and Handler mounts it; Main runs the subcommands
+// of the ofa-server binary (serve, backup, restore, import, load, keygen and openapi).
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/did"
+	"A2zkp-circuit/entropy"
+	"A2zkp-circuit/ethereum"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// CircuitMetadata describes a circuit version that stored commitments can be bound to
+type CircuitMetadata struct {
+	Version   string `json:"version"`   // Version is the identifier recorded next to each commitment
+	Curve     string `json:"curve"`     // Curve is the elliptic curve whose scalar field the circuit is compiled over
+	Statement string `json:"statement"` // Statement is a human-readable description of the constraint
+}
+
+// circuitVersions lists the circuit versions every server understands, whatever its composition
+var circuitVersions = map[string]CircuitMetadata{
+	"v1": {Version: "v1", Curve: "bn254", Statement: "crypto_commitment = user_secret^2, bound to a public nonce"},
+}
+
+// knownCircuits returns circuitVersions plus the versions of the configured composition, of those
+// tenant_circuits pins tenants to and of the canary
+func knownCircuits(cfg Config) map[string]CircuitMetadata {
+	known := make(map[string]CircuitMetadata, len(circuitVersions)+1+len(cfg.TenantCircuits))
+	for version, metadata := range circuitVersions {
+		known[version] = metadata
+	}
+	compositions := []circuit.Composition{cfg.Circuit}
+	for _, composition := range cfg.TenantCircuits {
+		compositions = append(compositions, composition)
+	}
+	if cfg.CanaryCircuit.Circuit != nil {
+		compositions = append(compositions, *cfg.CanaryCircuit.Circuit)
+	}
+	for _, composition := range compositions {
+		version := composition.Version()
+		if _, builtIn := known[version]; !builtIn {
+			known[version] = CircuitMetadata{Version: version, Curve: "bn254", Statement: composition.Statement()}
+		}
+	}
+	return known
+}
+
+// verifyCryptoCommitment validates whether the provided commitment matches the stored commitment
+func verifyCryptoCommitment(correctCryptoCommitment string, storedCryptoCommitment string) bool {
+	// Compare the provided commitment with the stored commitment
+	return correctCryptoCommitment == storedCryptoCommitment
+}
+
+// VerifyRequest represents the structure of a JSON request for verifying commitments
+type VerifyRequest struct {
+	CryptoCommitment       string `json:"crypto_commitment"`        // The commitment provided for verification
+	StoredCryptoCommitment string `json:"stored_crypto_commitment"` // The stored commitment for comparison
+}
+
+// validate checks that both commitments are field elements
+func (req VerifyRequest) validate() error {
+	var v validate.Validator
+	v.FieldElement("crypto_commitment", req.CryptoCommitment)
+	v.FieldElement("stored_crypto_commitment", req.StoredCryptoCommitment)
+	return v.Err()
+}
+
+// StatusResponse is the body of successful requests that have nothing else to return
+type StatusResponse struct {
+	Status string `json:"status"`           // Status is a human-readable outcome
+	KeyID  string `json:"key_id,omitempty"` // KeyID is the key version a proof was verified under
+}
+
+// healthHandler answers load balancer and orchestrator health checks with the current key version
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, StatusResponse{Status: "ok", KeyID: s.keyring.current().ID})
+}
+
+// verifyCommitmentHandler handles HTTP requests for verifying cryptographic commitments
+func (s *Server) verifyCommitmentHandler(w http.ResponseWriter, r *http.Request) {
+	// Decode the JSON request body into a VerifyRequest struct
+	var req VerifyRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+
+	// Verify the provided commitment against the stored commitment
+	isValid := verifyCryptoCommitment(req.CryptoCommitment, req.StoredCryptoCommitment)
+	if isValid {
+		// Respond with a success status if the commitment is valid
+		writeResponse(w, r, http.StatusOK, StatusResponse{Status: "Commitment is valid"})
+	} else {
+		// Respond with an error if the commitment is invalid
+		writeProblem(w, http.StatusUnauthorized, codeInvalidCommitment, "Invalid commitment")
+	}
+}
+
+// RegisterRequest represents the structure of a JSON request for registering a user's commitment
+type RegisterRequest struct {
+	UserName         string `json:"user_name"`         // The name the user will authenticate with
+	CryptoCommitment string `json:"crypto_commitment"` // The commitment generated from the user's secret
+	Salt             []byte `json:"salt,omitempty"`    // The optional base64-encoded salt used when deriving the secret
+	// KDF holds the Argon2id parameters used to stretch a PIN or password into the secret; omitted for raw secrets
+	KDF    *secret.KDFParams `json:"kdf,omitempty"`
+	Tenant string            `json:"tenant,omitempty"` // The organisation the user belongs to; omitted for the default tenant
+	// Curve is the curve the commitment is reduced into and proofs will be made over, one of the
+	// configured curves; bn254 when omitted
+	Curve string `json:"curve,omitempty"`
+	// Recovery asks for recovery shares in the response, with which the commitment can be replaced if the secret is lost
+	Recovery *RecoveryOptions `json:"recovery,omitempty"`
+	// ExpiresAt is when the registration stops verifying, e.g. the end of a contract; omitted for none
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PolicyProof proves the secret meets the secret policy, as a proof of circuit.PolicyCircuit;
+	// required when a policy is configured
+	PolicyProof []byte `json:"policy_proof,omitempty"`
+	// DIDBinding binds the commitment to a key of the DID document of user_name, when it is a DID;
+	// required with dids.require_binding
+	DIDBinding *did.Binding `json:"did_binding,omitempty"`
+
+	circuitVersion string // circuitVersion is the version a protobuf commitment declares; empty when it declares none
+	didKey         string // didKey is the verification method of a checked DIDBinding
+}
+
+// Server holds the dependencies shared by the handlers that need persistent state
+type Server struct {
+	cfg        Config
+	store      store.Store
+	keyring    *keyRing
+	snarkJS    *snarkJSKey          // snarkJS verifies snarkjs proofs; nil unless snarkjs_verifying_key is set
+	curves     map[string]*lazyKeys // curves holds the circuit's keys on each of Config.Curves, by curve name
+	challenges *challengeStore
+	replays    *replayCache
+	verdicts   *verifier.VerdictCache
+	pool       *workerPool
+	jobs       *jobStore
+	blinder    *commitmentBlinder // blinder checks commitments against their stored hashes; nil without commitment_blinding
+	// provingMemory is the proving_memory_budget proving jobs are admitted under; nil without one
+	provingMemory *memoryBudget
+	prover        *prover.Backend
+	signer        crypto.Signer // signer is the token signing key held by the key provider; nil when none is configured
+	tokens        *tokenKeys    // tokens signs issued JWTs with signer, or with a generated key when signer is nil
+	dids          *did.Resolver // dids resolves the DID documents of DID user names; nil unless dids.enabled
+	saml          *samlIssuer   // saml signs SAML responses; nil unless saml.entity_id is set
+	// signingKeys signs verdicts and webhook deliveries with rotating Ed25519 keys
+	signingKeys *signingKeySet
+	codes       *codeStore
+	refresh     *refreshStore
+	chain       *ethereum.Client     // chain calls the deployed verifier contract; nil when no RPC endpoint is configured
+	chainKey    *ethereum.PrivateKey // chainKey pays for submitted verifications; nil for read-only use
+	metrics     *requestMetrics
+	webhooks    *webhookNotifier // webhooks posts server events; nil when none are configured
+	bus         *eventBus        // bus publishes authentication events to Kafka or NATS; nil unless event_bus.driver is set
+	notices     *securityNotices // notices alert users to security events on their accounts; nil when no channels are configured
+	anomalies   *anomalyDetector // anomalies watches login failures; nil when detection is disabled
+	events      *eventRecorder   // events writes authentication events to the store for /v1/stats
+	usage       *usageMeter      // usage counts API key requests against their quotas
+	expiry      *periodicTask    // expiry marks expired registrations; nil when expiry_sweep_interval is 0
+	audit       *periodicTask    // audit verifies stored transcripts again; nil unless transcripts are enabled with an audit_interval
+	groups      *groupAuth       // groups serves anonymous group logins; nil unless groups.enabled is set
+	policy      *secretPolicy    // policy is what new secrets must be proven to satisfy; nil when none is configured
+	csrf        *csrfGuard       // csrf checks CSRF tokens on the routes of csrf.routes; nil when none are protected
+	accessLog   *accessLogger    // accessLog writes a line per request; nil when access_log is off
+	limits      *rateLimits      // limits applies rate_limit.rules; nil when there are none
+	shared      *sharedState     // shared holds the Redis of stateless mode; nil outside it
+	startup     *startupProgress // startup holds the phases New went through
+	clockOffset *float64         // clockOffset is how many seconds the clock was behind clock.ntp_server at startup; nil when unchecked
+
+	circuitVersion string                     // circuitVersion is the version of the configured circuit, recorded on new registrations
+	circuits       map[string]CircuitMetadata // circuits lists the versions stored registrations may be bound to
+	tenantCircuits map[string]*tenantCircuit  // tenantCircuits holds the circuits of Config.TenantCircuits and the canary, by circuit version
+	canary         *tenantCircuit             // canary is the circuit of canary_circuit; nil without one
+	restoreRandom  func()                     // restoreRandom ends deterministic mode; a no-op without deterministic_seed
+	decoyKey       []byte                     // decoyKey derives the decoy salts of unknown users
+
+	trustedProxies []netip.Prefix // trustedProxies is trusted_proxies parsed
+
+	lastSelfTest atomic.Pointer[SelfTestReport] // lastSelfTest is the latest self-test; nil before the first
+
+	adminToken    atomic.Pointer[string]        // adminToken is admin_token, swapped by Reload
+	access        atomic.Pointer[accessList]    // access is access_control, swapped by Reload
+	canaryRollout atomic.Pointer[canaryRollout] // canaryRollout is who canary_circuit routes to the canary, swapped by Reload
+	configSource  func() (Config, error)        // configSource rereads the configuration for Reload; nil reuses cfg
+	reloadMu      sync.Mutex                    // reloadMu serializes reloads
+	devicesMu     sync.Mutex                    // devicesMu serializes device edits and recoveries, which rewrite the whole registration
+	comparisonMu  sync.Mutex                    // comparisonMu lets one backend comparison run at a time
+	certsMu       sync.Mutex                    // certsMu guards certificates
+	certificates  map[string]*certificateHolder // certificates holds the TLS certificate of each listener by address
+}
+
+// maxSaltLength bounds the salt stored next to a commitment
+const maxSaltLength = 1024
+
+// maxTenantLength bounds tenant names
+const maxTenantLength = 64
+
+// validate checks the user name, that the commitment is a field element, the salt size and any KDF parameters
+func (req RegisterRequest) validate() error {
+	var v validate.Validator
+	req.validateInto(&v)
+	return v.Err()
+}
+
+// validateInto records the invalid fields of the registration in v
+func (req RegisterRequest) validateInto(v *validate.Validator) {
+	v.UserID("user_name", req.UserName)
+	curve := circuit.Curve
+	if req.Curve != "" {
+		var curveErr error
+		if curve, curveErr = circuit.ParseCurve(req.Curve); curveErr != nil {
+			v.Fail("curve", "is not a supported curve")
+		}
+	}
+	if curve != ecc.UNKNOWN {
+		v.FieldElementOn(curve, "crypto_commitment", req.CryptoCommitment)
+	}
+	v.MaxLength("salt", len(req.Salt), maxSaltLength)
+	if req.Tenant != "" {
+		v.Text("tenant", req.Tenant, maxTenantLength)
+	}
+	if req.KDF != nil {
+		// A parameter set named without its parameters is resolved against the registry by checkKDF
+		if req.KDF.Algorithm != "" || req.KDF.Name == "" {
+			if kdfErr := req.KDF.Validate(); kdfErr != nil {
+				v.Fail("kdf", "is invalid: %v", kdfErr)
+			}
+		}
+		if len(req.Salt) < secret.MinSaltLength {
+			v.Fail("salt", "must be at least %d bytes when kdf is set", secret.MinSaltLength)
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		v.Fail("expires_at", "must be in the future")
+	}
+	v.MaxLength("policy_proof", len(req.PolicyProof), maxProofLength)
+	if req.Recovery != nil {
+		req.Recovery.validateInto(v)
+	}
+	validateDIDBinding(v, req.DIDBinding)
+}
+
+// newUser is the record stored for a validated registration, bound to the current circuit and key
+// version of its tenant
+func (s *Server) newUser(req RegisterRequest) store.User {
+	version, keyID := s.registrationCircuit(req.Tenant, req.UserName, req.Curve)
+	curve := req.Curve
+	if curve == "" {
+		curve = s.circuits[version].Curve
+	}
+	return store.User{
+		UserName:         req.UserName,
+		Tenant:           req.Tenant,
+		CryptoCommitment: req.CryptoCommitment,
+		Salt:             req.Salt,
+		KDF:              req.KDF,
+		CircuitVersion:   version,
+		Curve:            curve,
+		KeyID:            keyID,
+		CreatedAt:        time.Now().UTC(),
+		ExpiresAt:        req.ExpiresAt,
+		DIDKey:           req.didKey,
+	}
+}
+
+// registerHandler handles HTTP requests for storing a new user's commitment
+func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if decodeErr := decodeBody(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	if version, _ := s.registrationCircuit(req.Tenant, req.UserName, req.Curve); req.circuitVersion != "" && req.circuitVersion != version {
+		writeRequestError(w, badRequest("commitment: new registrations use circuit_version %q", version))
+		return
+	}
+	if curveErr := s.checkCurve(req.Curve, req.Tenant); curveErr != nil {
+		writeRequestError(w, curveErr)
+		return
+	}
+	if kdfErr := s.checkKDF(&req); kdfErr != nil {
+		writeRequestError(w, kdfErr)
+		return
+	}
+	if duplicateErr := s.checkDuplicate(r.Context(), req); duplicateErr != nil {
+		writeRequestError(w, duplicateErr)
+		return
+	}
+	if didErr := s.checkDID(r.Context(), &req); didErr != nil {
+		writeRequestError(w, didErr)
+		return
+	}
+	if policyErr := s.checkSecretPolicy(r.Context(), req.CryptoCommitment, req.PolicyProof); policyErr != nil {
+		s.writePolicyError(w, policyErr)
+		return
+	}
+
+	started := time.Now()
+	user := s.newUser(req)
+	var response RegisterResponse
+	if req.Recovery != nil {
+		// Shares are generated whether or not the name is taken, so the answer looks the same either way
+		var recoveryErr error
+		if user.Recovery, response.RecoveryShares, recoveryErr = newRecovery(*req.Recovery); recoveryErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error generating recovery shares: %v", recoveryErr))
+			return
+		}
+	}
+	createErr := s.store.CreateUser(r.Context(), user)
+	if createErr == nil {
+		s.recordRegistration(r.Context(), user)
+	}
+	if !s.cfg.RevealUserExistence {
+		// A taken name, or one the directory doesn't know, answers like a fresh registration after the
+		// same delay; nothing is stored
+		s.padLatency(r.Context(), started)
+		if errors.Is(createErr, store.ErrUserExists) || errors.Is(createErr, store.ErrNoDirectoryEntry) {
+			createErr = nil
+		}
+	}
+	if errors.Is(createErr, store.ErrUserExists) {
+		writeProblem(w, http.StatusConflict, codeUserExists, "User already exists")
+		return
+	}
+	if errors.Is(createErr, store.ErrNoDirectoryEntry) {
+		writeProblem(w, http.StatusNotFound, codeUserNotFound, "The directory has no entry for the user")
+		return
+	}
+	if createErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing user: %v", createErr))
+		return
+	}
+
+	response.Status = "User registered"
+	writeResponse(w, r, http.StatusCreated, response)
+}
+
+// Handler returns the mux serving every endpoint of the route table
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routeTable() {
+		s.handle(mux, rt.pattern, rt.handler)
+	}
+	return s.logAccess(mux)
+}
+
+// routeTable lists every endpoint with its handler and documentation. The mux and the OpenAPI
+// document are both built from it, so the published description can't drift from what is served.
+// A read replica answers the routes it doesn't serve with read_only problems.
+func (s *Server) routeTable() []route {
+	table := []route{
+		{"GET /healthz", s.healthHandler, operation{
+			id: "health", summary: "Report that the server is up and which key version is current", response: StatusResponse{},
+		}},
+		{"GET /readyz", s.readyHandler, operation{
+			id: "ready", summary: "Report that the server is ready and how long each startup phase took", response: ReadinessResponse{},
+		}},
+		{"/verifyCommitment", s.verifyCommitmentHandler, operation{
+			id: "verifyCommitment", summary: "Compare a commitment with a stored one", request: VerifyRequest{}, response: StatusResponse{},
+		}},
+		{"POST /v1/users", s.registerHandler, operation{
+			id: "registerUser", summary: "Register a user's commitment", request: RegisterRequest{}, status: http.StatusCreated, response: RegisterResponse{},
+			protobuf: [2]string{"RegisterRequest", "StatusResponse"},
+		}},
+		{"GET /v1/users/{id}/params", s.userParamsHandler, operation{
+			id: "getUserParams", summary: "Get the public salt, KDF parameters, circuit version and curve a user's witness is built with",
+			response: UserParams{},
+		}},
+		{"DELETE /v1/users/{id}", s.deleteUserHandler, operation{
+			id: "deleteUser", summary: "Soft-delete or erase a user's registration, nonces and refresh tokens and return a deletion receipt", security: "user",
+			query:    []parameter{{name: "purge", description: "true to erase the registration at once despite a deletion_retention"}},
+			response: DeletionReceipt{},
+		}},
+		{"GET /v1/users/{id}/devices", s.listDevicesHandler, operation{
+			id: "listDevices", summary: "List a user's devices and whether each is active", security: "user", response: DeviceList{},
+		}},
+		{"POST /v1/users/{id}/devices", s.addDeviceHandler, operation{
+			id: "addDevice", summary: "Register the commitment of another of a user's devices", security: "user",
+			request: AddDeviceRequest{}, status: http.StatusCreated, response: DeviceResponse{},
+		}},
+		{"DELETE /v1/users/{id}/devices/{label}", s.revokeDeviceHandler, operation{
+			id: "revokeDevice", summary: "Revoke a device so proofs no longer match its commitment", security: "user", response: DeviceResponse{},
+		}},
+		{"GET /v1/users/{id}/totp", s.totpStatusHandler, operation{
+			id: "getTOTP", summary: "Tell whether a user enrolled TOTP and the policy of their tenant", security: "user", response: TOTPStatus{},
+		}},
+		{"POST /v1/users/{id}/totp", s.enrollTOTPHandler, operation{
+			id: "enrollTOTP", summary: "Generate a TOTP secret for a user's authenticator app, asked for once confirmed", security: "user",
+			status: http.StatusCreated, response: TOTPEnrollment{},
+		}},
+		{"POST /v1/users/{id}/totp/confirm", s.confirmTOTPHandler, operation{
+			id: "confirmTOTP", summary: "Confirm a TOTP enrolment with a first code", security: "user",
+			request: TOTPConfirmRequest{}, response: TOTPStatus{},
+		}},
+		{"DELETE /v1/users/{id}/totp", s.removeTOTPHandler, operation{
+			id: "removeTOTP", summary: "Remove a user's TOTP enrolment", security: "user", status: http.StatusNoContent,
+		}},
+		{"GET /v1/users/{id}/webauthn", s.webauthnCredentialHandler, operation{
+			id: "getWebAuthnCredential", summary: "Describe the hardware key bound to a user", security: "user", response: WebAuthnCredentialResponse{},
+		}},
+		{"POST /v1/users/{id}/webauthn", s.bindWebAuthnHandler, operation{
+			id: "bindWebAuthnCredential", summary: "Bind a WebAuthn credential to a user, whose assertion every proof then needs", security: "user",
+			request: BindWebAuthnRequest{}, status: http.StatusCreated, response: WebAuthnCredentialResponse{},
+		}},
+		{"DELETE /v1/users/{id}/webauthn", s.unbindWebAuthnHandler, operation{
+			id: "unbindWebAuthnCredential", summary: "Remove the hardware key bound to a user", security: "user", status: http.StatusNoContent,
+		}},
+		{"POST /v1/users/{id}/recovery", s.recoverHandler, operation{
+			id: "recoverUser", summary: "Replace a lost commitment by proving knowledge of a threshold of recovery shares",
+			request: RecoverRequest{}, response: RegisterResponse{},
+		}},
+		{"POST /v1/users/{id}/migration", s.migrateHandler, operation{
+			id: "migrateUser", summary: "Replace an imported user's legacy password with a commitment on their first login",
+			request: MigrateRequest{}, response: MigrateResponse{},
+		}},
+		{"POST /v1/users:import", s.requirePermission(permManageUsers, s.importHandler), operation{
+			id: "importUsers", summary: "Import users with bcrypt or Argon2 password hashes, pending their migration", security: "admin",
+			request: ImportRequest{}, response: ImportReport{},
+		}},
+		{"POST /v1/users:batch", s.requirePermission(permManageUsers, s.batchRegisterHandler), operation{
+			id: "registerUsers", summary: "Register many users at once, stored in all-or-nothing chunks", security: "admin",
+			request: BatchRegisterRequest{}, response: BatchRegisterResponse{},
+		}},
+		{"GET /scim/v2/ServiceProviderConfig", s.scimConfigHandler, operation{
+			id: "getSCIMServiceProviderConfig", summary: "Describe the SCIM features supported", response: SCIMServiceProviderConfig{}, scim: true,
+		}},
+		{"POST /scim/v2/Users", s.requirePermission(permManageUsers, s.createSCIMUserHandler), operation{
+			id: "createSCIMUser", summary: "Provision a user from an IdP, with the commitment in the ofa extension schema", security: "admin",
+			request: SCIMUser{}, status: http.StatusCreated, response: SCIMUser{}, scim: true,
+		}},
+		{"GET /scim/v2/Users", s.requirePermission(permManageUsers, s.listSCIMUsersHandler), operation{
+			id: "listSCIMUsers", summary: "Page through the provisioned users, optionally filtered by userName eq", security: "admin",
+			query: []parameter{
+				{name: "filter", description: `Only userName eq "<name>" is supported`},
+				{name: "startIndex", description: "The 1-based position of the first user returned"},
+				{name: "count", description: "How many users to return, at most 200"},
+			},
+			response: SCIMListResponse{}, scim: true,
+		}},
+		{"GET /scim/v2/Users/{id}", s.requirePermission(permManageUsers, s.getSCIMUserHandler), operation{
+			id: "getSCIMUser", summary: "Get a provisioned user", security: "admin", response: SCIMUser{}, scim: true,
+		}},
+		{"PUT /scim/v2/Users/{id}", s.requirePermission(permManageUsers, s.replaceSCIMUserHandler), operation{
+			id: "replaceSCIMUser", summary: "Activate or deactivate a user, or replace their commitment", security: "admin",
+			request: SCIMUser{}, response: SCIMUser{}, scim: true,
+		}},
+		{"PATCH /scim/v2/Users/{id}", s.requirePermission(permManageUsers, s.patchSCIMUserHandler), operation{
+			id: "patchSCIMUser", summary: "Activate or deactivate a user", security: "admin",
+			request: SCIMPatchRequest{}, response: SCIMUser{}, scim: true,
+		}},
+		{"DELETE /scim/v2/Users/{id}", s.requirePermission(permManageUsers, s.deleteSCIMUserHandler), operation{
+			id: "deleteSCIMUser", summary: "Erase a deprovisioned user", security: "admin", status: http.StatusNoContent, scim: true,
+		}},
+		{"GET /v1/csrf", s.csrfTokenHandler, operation{
+			id: "getCSRFToken", summary: "Set the CSRF cookie and return its token, which browsers send back on the routes of csrf.routes",
+			response: CSRFResponse{},
+		}},
+		{"POST /v1/challenges", s.challengeHandler, operation{
+			id: "createChallenge", summary: "Issue a single-use nonce to bind a proof to", request: ChallengeRequest{}, response: ChallengeResponse{},
+			protobuf: [2]string{"ChallengeRequest", "ChallengeResponse"},
+		}},
+		{"POST /v1/verify", s.verifyProofHandler, operation{
+			id: "verifyProof", summary: "Verify a proof of knowledge of a user's secret", request: ProofRequest{}, response: VerificationResponse{},
+			protobuf: [2]string{"VerifyRequest", "StatusResponse"},
+		}},
+		{"POST /v1/verify:dryRun", s.requirePermission(permView, s.dryRunVerifyHandler), operation{
+			id: "verifyProofDryRun", summary: "Check a proof as /v1/verify would, without consuming its nonce, counting towards lockouts or issuing anything",
+			request: ProofRequest{}, response: DryRunResponse{},
+		}},
+		{"GET /v1/login/ws", s.interactiveLoginHandler, operation{
+			id: "loginInteractive", summary: "Log in over a WebSocket: challenge, proof and verdict with a session token on one connection",
+			query: []parameter{{name: "user_name", description: "The user who is about to prove knowledge of their secret"}}, status: http.StatusSwitchingProtocols,
+		}},
+		{"POST /v1/logout", s.logoutHandler, operation{
+			id: "logout", summary: "Revoke the session token the request is made with", security: "session", status: http.StatusNoContent,
+		}},
+		{"POST /v1/step-up/challenges", s.stepUpChallengeHandler, operation{
+			id: "requestStepUpChallenge", summary: "Issue a nonce for a fresh proof, bound to the session the request is made with", security: "session",
+			response: ChallengeResponse{}, protobuf: [2]string{"", "ChallengeResponse"},
+		}},
+		{"POST /v1/step-up", s.stepUpHandler, operation{
+			id: "stepUp", summary: "Verify a fresh proof for a step-up challenge and return a short-lived step-up token elevating the session", security: "session",
+			request: ProofRequest{}, response: StepUpResponse{}, protobuf: [2]string{"VerifyRequest", ""},
+		}},
+		{"DELETE /v1/users/{id}/sessions", s.revokeUserSessionsHandler, operation{
+			id: "revokeUserSessions", summary: "Revoke every session token issued to a user so far", security: "user", status: http.StatusNoContent,
+		}},
+		{"POST /v1/credentials", s.issueCredentialHandler, operation{
+			id: "issueCredential", summary: "Verify a proof and issue a Verifiable Credential attesting it",
+			request: CredentialRequest{}, status: http.StatusCreated, response: CredentialResponse{},
+		}},
+		{"POST /v1/saml/responses", s.issueSAMLHandler, operation{
+			id: "issueSAMLResponse", summary: "Verify a proof and issue a signed SAML response for a configured service provider",
+			request: SAMLRequest{}, status: http.StatusCreated, response: SAMLResponse{},
+		}},
+		{"GET /v1/saml/metadata", s.samlMetadataHandler, operation{
+			id: "getSAMLMetadata", summary: "Get the SAML IdP metadata service providers are configured from",
+			contentType: "application/samlmetadata+xml",
+		}},
+		{"GET /v1/revocations", s.revocationsHandler, operation{
+			id: "listRevocations", summary: "Serve the signed list of revoked commitments, or the entries after ?after=", response: RevocationListResponse{},
+		}},
+		{"GET /v1/revocations/jwks", s.revocationKeysHandler, operation{
+			id: "revocationKeys", summary: "Publish the key revocation lists are signed with", response: JSONWebKeySet{},
+		}},
+		{"GET /v1/signing-keys", s.signingKeysHandler, operation{
+			id: "signingKeys", summary: "Publish the current and previous Ed25519 keys verdicts and webhooks are signed with", response: JSONWebKeySet{},
+		}},
+		{"GET /v1/groups/{group}", s.requireGroups(s.groupHandler), operation{
+			id: "getGroup", summary: "Describe a group's members, root and epoch for proving anonymous membership", response: GroupResponse{},
+		}},
+		{"POST /v1/groups/{group}/challenges", s.requireGroups(s.groupChallengeHandler), operation{
+			id: "createGroupChallenge", summary: "Issue a single-use nonce to bind a group membership proof to", response: ChallengeResponse{},
+		}},
+		{"POST /v1/groups/{group}/login", s.requireGroups(s.groupLoginHandler), operation{
+			id: "loginGroup", summary: "Prove membership of a group without naming the member and receive a group token",
+			request: GroupLoginRequest{}, response: GroupSession{},
+		}},
+		{"GET /v1/keys/group/proving", s.requireGroups(s.groupProvingKeyHandler), operation{
+			id: "getGroupProvingKey", summary: "Download the Groth16 proving key of the group membership circuit", contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/keys/group/verifying", s.requireGroups(s.groupVerifyingKeyHandler), operation{
+			id: "getGroupVerifyingKey", summary: "Download the Groth16 verifying key of the group membership circuit", contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/policy", s.requirePolicy(s.policyHandler), operation{
+			id: "getSecretPolicy", summary: "Describe the policy new secrets must be proven to satisfy", response: PolicyResponse{}, cached: true,
+		}},
+		{"GET /v1/keys/policy/proving", s.requirePolicy(s.policyProvingKeyHandler), operation{
+			id: "getPolicyProvingKey", summary: "Download the Groth16 proving key of the secret policy circuit", contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/keys/policy/verifying", s.requirePolicy(s.policyVerifyingKeyHandler), operation{
+			id: "getPolicyVerifyingKey", summary: "Download the Groth16 verifying key of the secret policy circuit", contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/time", s.timeHandler, operation{
+			id: "getTime", summary: "Report the server's time, the clock skew it tolerates and the current group epoch", response: TimeResponse{},
+		}},
+		{"GET /v1/circuit", s.circuitHandler, operation{
+			id: "getCircuit", summary: "Describe the configured circuit: its version, gadgets, statement, public inputs and verifying key hash",
+			query: []parameter{
+				tenantParameter, userNameParameter,
+				{name: "key_id", description: "Key version of the canary circuit, to describe the canary; other key versions describe the configured circuit"},
+			},
+			response: CircuitResponse{}, cached: true,
+		}},
+		{"GET /v1/keys/proving", s.provingKeyHandler, operation{
+			id: "getProvingKey", summary: "Download a Groth16 proving key", query: []parameter{keyIDParameter, curveParameter, tenantParameter, userNameParameter}, contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/keys/verifying", s.verifyingKeyHandler, operation{
+			id: "getVerifyingKey", summary: "Download a Groth16 verifying key", query: []parameter{keyIDParameter, curveParameter, tenantParameter, userNameParameter}, contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/keys/{circuitVersion}", s.keyDocumentHandler, operation{
+			id: "getVerifyingKeyDocument", summary: "Distribute the verifying key of a circuit version in gnark and snarkjs encodings with its digests and a signed manifest",
+			query:    []parameter{keyIDParameter, {name: "format", description: "gnark or snarkjs to download the key alone in that encoding"}},
+			response: VerifyingKeyDocument{}, cached: true,
+		}},
+		{"GET /v1/ceremony", s.ceremonyHandler, operation{
+			id: "getCeremony", summary: "List the contributions and attestations of the setup ceremony the keys come from",
+			query: []parameter{keyIDParameter, tenantParameter}, response: CeremonyResponse{}, cached: true,
+		}},
+		{"GET /v1/ceremony/transcript", s.ceremonyTranscriptHandler, operation{
+			id: "getCeremonyTranscript", summary: "Download the setup ceremony transcript to replay against the keys",
+			query: []parameter{keyIDParameter, tenantParameter}, contentType: "application/octet-stream", cached: true,
+		}},
+		{"GET /v1/keys/verifier.sol", s.verifierContractHandler, operation{
+			id: "getVerifierContract", summary: "Download the Solidity verifier of a key version", query: []parameter{keyIDParameter}, contentType: "text/plain",
+		}},
+		{"GET /v1/wasm/{file}", s.wasmAssetHandler, operation{
+			id: "getWasmAsset", summary: "Download prover.wasm or wasm_exec.js for in-browser proving", contentType: "application/octet-stream",
+		}},
+		{"POST /v1/prove", s.proveHandler, operation{
+			id: "createProvingJob", summary: "Queue a server-side proving job", request: ProveRequest{}, status: http.StatusAccepted, response: JobStatus{},
+		}},
+		{"GET /v1/jobs/{id}", s.jobStatusHandler, operation{
+			id: "getProvingJob", summary: "Get the state of a proving job and its proof once done", response: JobStatus{},
+		}},
+		{"GET /v1/jobs/{id}/events", s.jobEventsHandler, operation{
+			id: "streamProvingJob", summary: "Stream a proving job's state changes and result as Server-Sent Events", contentType: "text/event-stream",
+		}},
+		{"DELETE /v1/jobs/{id}", s.cancelJobHandler, operation{
+			id: "cancelProvingJob", summary: "Cancel a queued or running proving job", response: JobStatus{},
+		}},
+		{"POST /v1/onchain/verify", s.requireChain(s.onchainVerifyHandler), operation{
+			id: "verifyProofOnchain", summary: "Check a proof against the on-chain verifier with eth_call", request: ProofRequest{}, response: ethereum.CallResult{},
+		}},
+		{"GET /v1/onchain/transactions/{hash}", s.requireChain(s.onchainReceiptHandler), operation{
+			id: "getOnchainTransaction", summary: "Get the result of a submitted verification transaction", response: ethereum.Receipt{},
+		}},
+		{"GET /admin/backup", s.requirePermission(permSuperAdmin, s.backupHandler), operation{
+			id: "backup", summary: "Export every registration", security: "admin", response: Snapshot{},
+		}},
+		{"POST /admin/restore", s.requirePermission(permSuperAdmin, s.restoreHandler), operation{
+			id: "restore", summary: "Import a snapshot", security: "admin", request: Snapshot{}, response: RestoreReport{},
+			query: []parameter{{name: "dry_run", description: "Only validate the snapshot when true"}},
+		}},
+		{"GET /admin/keys", s.requirePermission(permView, s.listKeysHandler), operation{
+			id: "listKeyVersions", summary: "List the key versions proofs may target", security: "admin", response: []KeyVersionResponse{},
+		}},
+		{"POST /admin/keys", s.requirePermission(permOperate, s.addKeyHandler), operation{
+			id: "addKeyVersion", summary: "Generate a new key version and make it current", security: "admin",
+			status: http.StatusCreated, response: KeyVersionResponse{},
+		}},
+		{"DELETE /admin/keys/{id}", s.requirePermission(permOperate, s.retireKeyHandler), operation{
+			id: "retireKeyVersion", summary: "Retire a key version before its grace period ends", security: "admin", status: http.StatusNoContent,
+		}},
+		{"GET /admin/signing-keys", s.requirePermission(permView, s.listSigningKeysHandler), operation{
+			id: "listSigningKeys", summary: "List the published signing keys and when the replaced ones stop being published", security: "admin",
+			response: []SigningKeyResponse{},
+		}},
+		{"POST /admin/signing-keys", s.requirePermission(permOperate, s.rotateSigningKeyHandler), operation{
+			id: "rotateSigningKey", summary: "Make a new signing key current; the previous one stays published for signing_keys.overlap", security: "admin",
+			status: http.StatusCreated, response: SigningKeyResponse{},
+		}},
+		{"DELETE /admin/sessions/{id}", s.requirePermission(permOperate, s.revokeSessionHandler), operation{
+			id: "revokeSession", summary: "Revoke one session token by its ID (jti)", security: "admin", status: http.StatusNoContent,
+		}},
+		{"GET /admin/api-keys", s.requirePermission(permSuperAdmin, s.listAPIKeysHandler), operation{
+			id: "listAPIKeys", summary: "List the API keys of the admin API and their roles", security: "admin", response: []APIKeyResponse{},
+		}},
+		{"POST /admin/api-keys", s.requirePermission(permSuperAdmin, s.createAPIKeyHandler), operation{
+			id: "createAPIKey", summary: "Create an API key with a role; the key is only returned once", security: "admin",
+			request: APIKeyRequest{}, status: http.StatusCreated, response: APIKeyResponse{},
+		}},
+		{"PUT /admin/api-keys/{id}/role", s.requirePermission(permSuperAdmin, s.assignRoleHandler), operation{
+			id: "assignAPIKeyRole", summary: "Assign an API key a role", security: "admin", request: APIKeyRequest{}, response: APIKeyResponse{},
+		}},
+		{"PUT /admin/api-keys/{id}/quota", s.requirePermission(permSuperAdmin, s.setQuotaHandler), operation{
+			id: "setAPIKeyQuota", summary: "Set the daily and monthly request quotas of an API key", security: "admin",
+			request: QuotaRequest{}, response: APIKeyResponse{},
+		}},
+		{"DELETE /admin/api-keys/{id}", s.requirePermission(permSuperAdmin, s.deleteAPIKeyHandler), operation{
+			id: "deleteAPIKey", summary: "Delete an API key", security: "admin", status: http.StatusNoContent,
+		}},
+		{"GET /admin/usage", s.requirePermission(permStats, s.usageHandler), operation{
+			id: "getUsage", summary: "Report the requests of each API key today and this month against its quotas", security: "admin",
+			query:    []parameter{{name: "tenant", description: "Only report keys of this tenant"}},
+			response: UsageResponse{},
+		}},
+		{"GET /admin/usage/records", s.requirePermission(permStats, s.usageRecordsHandler), operation{
+			id: "exportUsage", summary: "Export the daily usage records of the API keys for billing", security: "admin",
+			query: []parameter{
+				{name: "from", description: "First day, e.g. 2024-05-01; the first of this month when omitted"},
+				{name: "to", description: "Day after the last one; tomorrow when omitted"},
+				{name: "tenant", description: "Only export usage of this tenant"},
+				{name: "export", description: "csv or json to download the records as a file"},
+			},
+			response: UsageRecords{},
+		}},
+		{"POST /admin/users/{id}/restore", s.requirePermission(permManageUsers, s.restoreUserHandler), operation{
+			id: "restoreUser", summary: "Bring back a soft-deleted user before deletion_retention passes", security: "admin",
+			response: StatusResponse{},
+		}},
+		{"GET /admin/auth-policies", s.requirePermission(permManageUsers, s.listAuthPoliciesHandler), operation{
+			id: "listAuthPolicies", summary: "List the authentication policies of tenants and users", security: "admin",
+			query:    []parameter{{name: "tenant", description: "Only list policies of this tenant and its users"}},
+			response: AuthPolicyList{},
+		}},
+		{"GET /admin/tenants/{tenant}/auth-policy", s.requirePermission(permManageUsers, s.getAuthPolicyHandler), operation{
+			id: "getTenantAuthPolicy", summary: "Get the authentication policy of a tenant, - for the default one", security: "admin",
+			response: store.AuthPolicy{},
+		}},
+		{"PUT /admin/tenants/{tenant}/auth-policy", s.requirePermission(permManageUsers, s.putAuthPolicyHandler), operation{
+			id: "putTenantAuthPolicy", summary: "Set the login rules every user of a tenant is held to", security: "admin",
+			request: AuthPolicyRequest{}, response: store.AuthPolicy{},
+		}},
+		{"DELETE /admin/tenants/{tenant}/auth-policy", s.requirePermission(permManageUsers, s.deleteAuthPolicyHandler), operation{
+			id: "deleteTenantAuthPolicy", summary: "Remove the authentication policy of a tenant", security: "admin", status: http.StatusNoContent,
+		}},
+		{"GET /admin/users/{id}/auth-policy", s.requirePermission(permManageUsers, s.getAuthPolicyHandler), operation{
+			id: "getUserAuthPolicy", summary: "Get the authentication policy of a user", security: "admin",
+			response: store.AuthPolicy{},
+		}},
+		{"PUT /admin/users/{id}/auth-policy", s.requirePermission(permManageUsers, s.putAuthPolicyHandler), operation{
+			id: "putUserAuthPolicy", summary: "Set the login rules a user is held to on top of the tenant's", security: "admin",
+			request: AuthPolicyRequest{}, response: store.AuthPolicy{},
+		}},
+		{"DELETE /admin/users/{id}/auth-policy", s.requirePermission(permManageUsers, s.deleteAuthPolicyHandler), operation{
+			id: "deleteUserAuthPolicy", summary: "Remove the authentication policy of a user", security: "admin", status: http.StatusNoContent,
+		}},
+		{"GET /admin/transcripts", s.requirePermission(permAudit, s.listTranscriptsHandler), operation{
+			id: "listTranscripts", summary: "List the proof transcripts of accepted logins", security: "admin",
+			query: []parameter{
+				{name: "user_name", description: "Only list transcripts of this user"},
+				{name: "from", description: "Start of the period as an RFC 3339 time; 24h before to when omitted"},
+				{name: "to", description: "End of the period as an RFC 3339 time; now when omitted"},
+			},
+			response: TranscriptList{},
+		}},
+		{"GET /admin/transcripts/{id}", s.requirePermission(permAudit, s.getTranscriptHandler), operation{
+			id: "getTranscript", summary: "Download a proof transcript: the proof, its public inputs, key version and verdict", security: "admin",
+			response: store.Transcript{},
+		}},
+		{"POST /admin/transcripts/{id}/verify", s.requirePermission(permAudit, s.verifyTranscriptHandler), operation{
+			id: "verifyTranscript", summary: "Run the pairing check of a proof transcript again", security: "admin",
+			response: TranscriptVerification{},
+		}},
+		{"GET /admin/users", s.requirePermission(permManageUsers, s.listUsersHandler), operation{
+			id: "listUsers", summary: "List or export the registered users, filtered and a page at a time", security: "admin",
+			query: []parameter{
+				{name: "tenant", description: "Only list users of this tenant"},
+				{name: "created_after", description: "Only list users registered at or after this RFC 3339 time"},
+				{name: "created_before", description: "Only list users registered before this RFC 3339 time"},
+				{name: "revoked", description: "true for expired or deactivated users only, false for the others"},
+				{name: "locked", description: "true for users with a brute_force anomaly in the window only, false for the others"},
+				{name: "deleted", description: "true for soft-deleted users only, false for the others"},
+				{name: "cursor", description: "next_cursor of the previous page"},
+				{name: "limit", description: "Users per page, at most 1000; 100 when omitted"},
+				{name: "export", description: "csv or json to download every matching user at once instead of a page"},
+			},
+			response: UserPage{},
+		}},
+		{"GET /admin/commitments/collisions", s.requirePermission(permManageUsers, s.collisionsHandler), operation{
+			id: "listCommitmentCollisions", summary: "Report the commitments more than one user registered, as the same unsalted secret gives", security: "admin",
+			response: CommitmentCollisions{},
+		}},
+		{"GET /admin/expired", s.requirePermission(permView, s.expiredHandler), operation{
+			id: "listExpired", summary: "List the registrations past their expiry", security: "admin", response: ExpiredList{},
+		}},
+		{"GET /admin/anomalies", s.requirePermission(permView, s.anomaliesHandler), operation{
+			id: "listAnomalies", summary: "List the brute-force patterns detected in recent login failures", security: "admin", response: AnomalyList{},
+		}},
+		{"GET /v1/stats", s.requirePermission(permStats, s.statsHandler), operation{
+			id: "getStats", summary: "Aggregate registrations, verifications and proof latency per time bucket and tenant", security: "admin",
+			query: []parameter{
+				{name: "from", description: "Start of the period, RFC 3339; 24 hours before to when omitted"},
+				{name: "to", description: "End of the period, RFC 3339; now when omitted"},
+				{name: "bucket", description: "Bucket width, e.g. 1h or 15m; 1h when omitted"},
+				{name: "tenant", description: "Only count events of this tenant"},
+			},
+			response: StatsResponse{},
+		}},
+		{"POST /admin/verify:bulk", s.requirePermission(permOperate, s.bulkVerifyHandler), operation{
+			id: "verifyProofsBulk", summary: "Re-verify a stream of earlier proofs, streaming NDJSON results as they complete", security: "admin",
+			contentType: ndjsonContentType,
+		}},
+		{"POST /admin/users:load", s.requirePermission(permManageUsers, s.loadHandler), operation{
+			id: "loadCommitments", summary: "Store a CSV or NDJSON file of commitments generated elsewhere, streaming a per-record report", security: "admin",
+			contentType: ndjsonContentType,
+		}},
+		{"POST /admin/backends/compare", s.requirePermission(permOperate, s.compareBackendsHandler), operation{
+			id: "compareBackends", summary: "Set up, prove and verify the circuit once with Groth16 and with PLONK and report the costs", security: "admin",
+			response: BackendComparison{},
+		}},
+		{"POST /admin/self-test", s.requirePermission(permOperate, s.selfTestHandler), operation{
+			id: "runSelfTest", summary: "Prove and verify a throwaway proof, round-trip the store and check signatures, failing /readyz on any error", security: "admin",
+			response: SelfTestReport{},
+		}},
+		{"POST /admin/reload", s.requirePermission(permOperate, s.reloadHandler), operation{
+			id: "reloadConfiguration", summary: "Reread TLS certificates, key versions and reloadable settings, like SIGHUP", security: "admin",
+			response: StatusResponse{},
+		}},
+		{"POST /admin/onchain/submit", s.requirePermission(permOperate, s.requireChain(s.onchainSubmitHandler)), operation{
+			id: "submitProofOnchain", summary: "Record a proof verification on chain as a transaction", security: "admin",
+			request: ProofRequest{}, status: http.StatusAccepted, response: OnchainSubmission{},
+		}},
+		{"GET /.well-known/openid-configuration", s.requireOIDC(s.discoveryHandler), operation{
+			id: "getProviderMetadata", summary: "OpenID Connect discovery document", response: ProviderMetadata{},
+		}},
+		{"GET /oauth/jwks", s.requireOIDC(s.jwksHandler), operation{
+			id: "getJWKS", summary: "Public keys verifying issued tokens", response: JSONWebKeySet{}, cached: true,
+		}},
+		{"GET /oauth/authorize", s.requireOIDC(s.authorizeHandler), operation{
+			id: "authorize", summary: "Render the sign-in page of an authorization request", contentType: "text/html",
+			query: []parameter{
+				{name: "client_id"}, {name: "redirect_uri"}, {name: "response_type", description: "Always code"}, {name: "scope"},
+				{name: "state"}, {name: "nonce"}, {name: "code_challenge"}, {name: "code_challenge_method", description: "Always S256"},
+			},
+		}},
+		{"POST /oauth/authorize", s.requireOIDC(s.authorizeSubmitHandler), operation{
+			id: "submitAuthorization", summary: "Verify the sign-in proof and redirect back with a code", form: AuthorizeSubmission{}, status: http.StatusFound,
+		}},
+		{"POST /oauth/token", s.requireOIDC(s.tokenHandler), operation{
+			id: "requestTokens", summary: "Redeem a code, refresh token or zk-proof for tokens", security: "client",
+			form: TokenRequest{}, response: TokenResponse{}, oauthErrors: true,
+		}},
+		{"GET /oauth/userinfo", s.requireOIDC(s.userinfoHandler), operation{
+			id: "getUserInfo", summary: "Claims about the user an access token was issued for", security: "bearer",
+			response: UserInfo{}, oauthErrors: true,
+		}},
+		{"POST /v1/introspect", s.requireOIDC(s.introspectHandler), operation{
+			id: "introspectToken", summary: "Report whether an access or refresh token is active (RFC 7662)", security: "confidential",
+			form: IntrospectionRequest{}, response: IntrospectionResponse{}, oauthErrors: true,
+		}},
+		{"GET /.well-known/jwks.json", s.jwksHandler, operation{
+			id: "getWellKnownJWKS", summary: "Current and previous public keys verifying issued tokens", response: JSONWebKeySet{}, cached: true,
+		}},
+		{"GET /.well-known/did.json", s.didDocumentHandler, operation{
+			id: "getDIDDocument", summary: "did:web document of the credential issuer", contentType: "application/did+json",
+		}},
+		{"GET /openapi.json", s.openAPIHandler, operation{
+			id: "getOpenAPI", summary: "This document", contentType: "application/json",
+		}},
+	}
+	if s.cfg.ReadOnly {
+		return replicaRouteTable(table)
+	}
+	return table
+}
+
+// streamingRoutes hold their response, or the WebSocket they upgrade to, open until the client or the work behind them is done,
+// so handler timeouts don't apply to them
+var streamingRoutes = map[string]bool{
+	"GET /v1/jobs/{id}/events": true,
+	"GET /v1/login/ws":         true,
+	"POST /admin/users:load":   true,
+	"POST /admin/verify:bulk":  true,
+}
+
+// handle registers a handler bounded by the timeout configured for its pattern and counted in /metrics.
+// When the timeout fires the request context is cancelled and the client receives a 503.
+func (s *Server) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	handler = s.guard(pattern, s.limitRate(pattern, s.requireCSRF(pattern, negotiate(handler))))
+	timeout := s.cfg.HandlerTimeout.Duration
+	if override, overridden := s.cfg.EndpointTimeouts[pattern]; overridden {
+		timeout = override.Duration
+	}
+	if timeout <= 0 || streamingRoutes[pattern] {
+		mux.Handle(pattern, withRequestID(s.metrics.instrument(pattern, handler)))
+		return
+	}
+	// TimeoutHandler gives the handler a header map of its own, so the ID is set on it again
+	timeoutHandler := http.TimeoutHandler(withRequestID(handler), timeout, timeoutProblemBody())
+	mux.Handle(pattern, withRequestID(s.metrics.instrument(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeoutHandler.ServeHTTP(timeoutProblemWriter{w}, r)
+	}))))
+}
+
+// openStore opens the configured backend: the shared Redis in stateless mode, a directory when
+// ldap.url is set, SQLite when a database path is, memory otherwise, wrapped in envelope encryption
+// when a master key is configured and in commitment blinding outside that. A read replica opens it
+// read-only.
+func openStore(ctx context.Context, cfg Config, shared *sharedState, blinder *commitmentBlinder) (store.Store, error) {
+	var userStore store.Store = store.NewMemory()
+	switch {
+	case shared != nil:
+		userStore = store.OpenRedis(shared.client, shared.key("store", ""))
+	case cfg.LDAP.URL != "" && cfg.DatabasePath != "":
+		return nil, errors.New("database_path and ldap.url are mutually exclusive")
+	case cfg.LDAP.URL != "":
+		directory, openErr := store.OpenLDAP(ctx, cfg.LDAP)
+		if openErr != nil {
+			return nil, fmt.Errorf("opening LDAP store: %w", openErr)
+		}
+		userStore = directory
+	case cfg.DatabasePath != "" && cfg.ReadOnly:
+		sqlite, openErr := store.OpenSQLiteReadOnly(cfg.DatabasePath)
+		if openErr != nil {
+			return nil, openErr
+		}
+		userStore = sqlite
+	case cfg.DatabasePath != "":
+		sqlite, openErr := store.OpenSQLite(cfg.DatabasePath)
+		if openErr != nil {
+			return nil, openErr
+		}
+		userStore = sqlite
+	}
+
+	if cfg.MasterKeyID != "" {
+		keyring, keyringErr := store.NewMasterKeyring(cfg.MasterKeyID, cfg.MasterKeys)
+		if keyringErr != nil {
+			userStore.Close()
+			return nil, keyringErr
+		}
+		userStore = store.NewEncrypted(userStore, keyring)
+	}
+	if blinder != nil {
+		userStore = store.NewBlinded(userStore, blinder.pepper)
+	}
+	if cfg.ReadOnly {
+		userStore = store.NewReadOnly(userStore)
+	}
+	return userStore, nil
+}
+
+// checkMockProver refuses mock_prover in a configuration that looks like production: one with
+// TLS, a key provider, stored keys, Vault, master keys or a chain to submit to
+func checkMockProver(cfg Config) error {
+	if !cfg.MockProver {
+		return nil
+	}
+	usesTLS := cfg.TLSCertFile != "" || cfg.TLSCert != ""
+	for _, listener := range cfg.Listeners {
+		usesTLS = usesTLS || listener.TLSCertFile != "" || listener.TLSCert != ""
+	}
+	var setting string
+	switch {
+	case usesTLS:
+		setting = "TLS"
+	case cfg.KeyProvider != "" || cfg.SigningKey != "":
+		setting = "key_provider"
+	case cfg.ArtifactsDir != "" || cfg.ArtifactsURL != "" || embeddedArtifacts != nil:
+		setting = "artifacts"
+	case cfg.KeyDir != "":
+		setting = "key_dir"
+	case cfg.Vault.Address != "" || cfg.Vault.ArtifactsPath != "":
+		setting = "vault"
+	case cfg.MasterKeyID != "" || len(cfg.MasterKeys) > 0:
+		setting = "master_keys"
+	case cfg.Ethereum.RPCURL != "":
+		setting = "ethereum"
+	default:
+		return nil
+	}
+	return fmt.Errorf("mock_prover is for local development and can't be combined with %s", setting)
+}
+
+// New validates cfg, loads or generates the circuit keys and opens the store, returning a server
+// ready to be mounted with Handler. The context bounds startup only, and records its phases when it
+// carries a startupProgress; Close releases the store.
+// With deterministic_seed set, the randomness of the whole process comes from the seed until Close.
+// With mock_prover set, proofs are fakes that prove nothing.
+func New(ctx context.Context, cfg Config) (*Server, error) {
+	if mockErr := checkMockProver(cfg); mockErr != nil {
+		return nil, mockErr
+	}
+	if cfg.MockProver {
+		log.Println("MOCK PROVER: proofs are fakes that anyone can forge; this server authenticates no one")
+	}
+	restoreRandom := func() {}
+	if cfg.DeterministicSeed != "" {
+		log.Println("Deterministic mode: all randomness derives from deterministic_seed; never use it in production")
+		restoreRandom = entropy.UseSeed(cfg.DeterministicSeed)
+	}
+	progress := startupProgressFrom(ctx)
+	if progress == nil {
+		progress = newStartupProgress()
+		ctx = withStartupProgress(ctx, progress)
+	}
+	srv, newErr := newServer(ctx, cfg)
+	if newErr != nil {
+		restoreRandom()
+		return nil, newErr
+	}
+	srv.restoreRandom = restoreRandom
+	srv.startup = progress
+	if cfg.SelfTest {
+		done := progress.begin(phaseSelfTest, srv.circuitVersion, circuit.Curve)
+		srv.recordSelfTest(srv.selfTest(ctx))
+		done(srv.keyring.current().keys.ccs.GetNbConstraints())
+	}
+	progress.ready()
+	return srv, nil
+}
+
+// newServer builds the server New returns
+func newServer(ctx context.Context, cfg Config) (*Server, error) {
+	if circuitErr := cfg.Circuit.Validate(); circuitErr != nil {
+		return nil, fmt.Errorf("circuit: %w", circuitErr)
+	}
+	if oidcErr := cfg.OIDC.validate(); oidcErr != nil {
+		return nil, oidcErr
+	}
+	if credentialsErr := cfg.Credentials.validate(); credentialsErr != nil {
+		return nil, credentialsErr
+	}
+	if kdfErr := cfg.KDFs.validate(); kdfErr != nil {
+		return nil, kdfErr
+	}
+	if duplicatesErr := validateDuplicates(cfg.DuplicateCommitments); duplicatesErr != nil {
+		return nil, duplicatesErr
+	}
+	if clockErr := cfg.Clock.validate(); clockErr != nil {
+		return nil, clockErr
+	}
+	clockOffset, clockChecked, clockErr := checkClock(ctx, cfg.Clock)
+	if clockErr != nil {
+		return nil, clockErr
+	}
+	access, accessErr := parseAccessControl(cfg.AccessControl)
+	if accessErr != nil {
+		return nil, accessErr
+	}
+	trustedProxies, proxiesErr := parsePrefixes("trusted_proxies", cfg.TrustedProxies)
+	if proxiesErr != nil {
+		return nil, proxiesErr
+	}
+	groups, groupsErr := newGroupAuth(cfg.Groups, cfg.Clock.Skew.Duration, cfg.MockProver)
+	if groupsErr != nil {
+		return nil, groupsErr
+	}
+	policy, policyErr := newSecretPolicy(cfg.SecretPolicy, cfg.MockProver)
+	if policyErr != nil {
+		return nil, policyErr
+	}
+	if readOnlyErr := validateReadOnly(cfg); readOnlyErr != nil {
+		return nil, readOnlyErr
+	}
+	shared, sharedErr := newSharedState(cfg)
+	if sharedErr != nil {
+		return nil, sharedErr
+	}
+
+	keyProvider, providerErr := newKeyProvider(cfg)
+	if providerErr != nil {
+		return nil, providerErr
+	}
+	blinder, blinderErr := newCommitmentBlinder(ctx, cfg, keyProvider, shared)
+	if blinderErr != nil {
+		return nil, blinderErr
+	}
+	keys, setupErr := setupCircuitKeys(ctx, cfg, keyProvider)
+	if setupErr != nil {
+		return nil, setupErr
+	}
+	keyring, keyringErr := newKeyRing(ctx, keys, cfg, keyProvider)
+	if keyringErr != nil {
+		return nil, keyringErr
+	}
+	log.Printf("Current key version is %s", keyring.current().ID)
+	snarkJS, snarkJSErr := loadSnarkJSKey(cfg.SnarkJSVerifyingKey)
+	if snarkJSErr != nil {
+		return nil, snarkJSErr
+	}
+	curves, curvesErr := newCurveKeys(ctx, cfg, keyProvider)
+	if curvesErr != nil {
+		return nil, curvesErr
+	}
+	tenantCircuits, tenantCircuitsErr := newTenantCircuits(ctx, cfg, keyProvider)
+	if tenantCircuitsErr != nil {
+		return nil, tenantCircuitsErr
+	}
+	rollout, rolloutErr := newCanaryRollout(cfg.CanaryCircuit)
+	if rolloutErr != nil {
+		return nil, rolloutErr
+	}
+	var canary *tenantCircuit
+	if cfg.CanaryCircuit.Circuit != nil {
+		canary = tenantCircuits[cfg.CanaryCircuit.Circuit.Version()]
+	}
+	// Resolve the token signing key up front so a missing or inaccessible key fails at startup
+	var tokenSigner crypto.Signer
+	switch {
+	case cfg.SigningKey != "":
+		if keyProvider == nil {
+			return nil, fmt.Errorf("signing_key needs a key_provider")
+		}
+		var signerErr error
+		if tokenSigner, signerErr = keyProvider.Signer(ctx, cfg.SigningKey); signerErr != nil {
+			return nil, fmt.Errorf("loading signing key: %w", signerErr)
+		}
+	case shared != nil:
+		// Every replica must sign tokens the others' JWKS verifies
+		derived, deriveErr := shared.signingKey()
+		if deriveErr != nil {
+			return nil, fmt.Errorf("deriving signing key: %w", deriveErr)
+		}
+		tokenSigner = derived
+	}
+	currentToken, tokensErr := newTokenSigner(tokenSigner)
+	if tokensErr != nil {
+		return nil, fmt.Errorf("loading signing key: %w", tokensErr)
+	}
+	previousTokens, previousErr := loadPreviousTokenSigners(ctx, cfg, keyProvider)
+	if previousErr != nil {
+		return nil, previousErr
+	}
+	tokens := newTokenKeys(currentToken, cfg.SigningKey, previousTokens, cfg)
+	if (cfg.OIDC.Issuer != "" || cfg.Credentials.IssuerDID != "") && tokenSigner == nil {
+		log.Println("No signing_key configured: tokens and credentials are signed with a generated key that changes on restart")
+	}
+	signingKeys, signingKeysErr := newSigningKeySet(ctx, cfg.SigningKeys, keyProvider, shared)
+	if signingKeysErr != nil {
+		return nil, fmt.Errorf("loading signing keys: %w", signingKeysErr)
+	}
+	if (cfg.VerdictSigning.Enabled || len(cfg.Webhooks) > 0) && cfg.SigningKeys.Dir == "" && shared == nil {
+		log.Println("No signing_keys.dir configured: verdicts and webhooks are signed with a generated key that changes on restart")
+	}
+	if totpErr := validateTOTPConfig(cfg.TOTP); totpErr != nil {
+		return nil, totpErr
+	}
+	if webauthnErr := validateWebAuthnConfig(cfg.WebAuthn); webauthnErr != nil {
+		return nil, webauthnErr
+	}
+	saml, samlErr := newSAMLIssuer(cfg.SAML)
+	if samlErr != nil {
+		return nil, samlErr
+	}
+	webhooks, webhooksErr := newWebhookNotifier(cfg.Webhooks, signingKeys)
+	if webhooksErr != nil {
+		return nil, webhooksErr
+	}
+	notices, noticesErr := newSecurityNotices(cfg.Notifications)
+	if noticesErr != nil {
+		return nil, noticesErr
+	}
+	csrfConfig := cfg.CSRF
+	if shared != nil && csrfConfig.Secret == "" {
+		csrfConfig.Secret = hex.EncodeToString(shared.derive("csrf secret"))
+	}
+	csrf, csrfErr := newCSRFGuard(csrfConfig)
+	if csrfErr != nil {
+		return nil, csrfErr
+	}
+	limits, limitsErr := newRateLimits(cfg.RateLimit, shared)
+	if limitsErr != nil {
+		return nil, limitsErr
+	}
+	chain, chainKey, chainErr := newChainClient(cfg.Ethereum)
+	if chainErr != nil {
+		return nil, chainErr
+	}
+	backend, backendErr := prover.NewBackend(cfg.ProverAcceleration)
+	if backendErr != nil {
+		return nil, backendErr
+	}
+	provingMemory, budgetErr := newMemoryBudget(cfg.ProvingMemoryBudget, keys.ccs)
+	if budgetErr != nil {
+		return nil, budgetErr
+	}
+	workers := cfg.PoolWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	challengePoolSize := cfg.ChallengePoolSize
+	if cfg.DeterministicSeed != "" {
+		challengePoolSize = 0
+	}
+	// Replicas in stateless mode must salt the decoys of unknown users alike, or comparing them tells users apart
+	decoyKey := make([]byte, sha256.Size)
+	if shared != nil {
+		decoyKey = shared.derive("decoy key")
+	} else if _, randErr := rand.Read(decoyKey); randErr != nil {
+		return nil, randErr
+	}
+
+	// Started and opened last so none of the failures above leaves them running
+	accessLog, accessLogErr := newAccessLogger(cfg.AccessLog)
+	if accessLogErr != nil {
+		return nil, accessLogErr
+	}
+	bus, busErr := newEventBus(cfg.EventBus)
+	if busErr != nil {
+		accessLog.close()
+		return nil, busErr
+	}
+	userStore, openErr := openStore(ctx, cfg, shared, blinder)
+	if openErr != nil {
+		bus.close()
+		accessLog.close()
+		return nil, openErr
+	}
+	srv := &Server{
+		cfg:           cfg,
+		store:         userStore,
+		keyring:       keyring,
+		blinder:       blinder,
+		snarkJS:       snarkJS,
+		curves:        curves,
+		challenges:    newChallengeStore(cfg.ChallengeTTL.Duration, entropy.Source(cfg.DeterministicSeed, "nonces"), shared, challengePoolSize),
+		replays:       newReplayCache(cfg.ReplayCacheTTL.Duration, shared),
+		verdicts:      verifier.NewVerdictCache(cfg.VerdictCacheTTL.Duration),
+		pool:          newWorkerPool(workers, cfg.PoolQueueSize, cfg.PoolAdmissionQueueSize, cfg.PoolAdmissionWait.Duration),
+		jobs:          newJobStore(cfg.JobRetention.Duration),
+		provingMemory: provingMemory,
+		prover:        backend,
+		signer:        tokenSigner,
+		tokens:        tokens,
+		signingKeys:   signingKeys,
+		dids:          newDIDResolver(cfg.DIDs),
+		saml:          saml,
+		codes:         newCodeStore(cfg.OIDC.CodeTTL.Duration, shared),
+		refresh:       newRefreshStore(userStore, cfg.OIDC.RefreshTokenTTL.Duration, cfg.OIDC.RefreshFamilyTTL.Duration),
+		chain:         chain,
+		chainKey:      chainKey,
+		metrics:       newRequestMetrics(),
+		webhooks:      webhooks,
+		bus:           bus,
+		notices:       notices,
+		groups:        groups,
+		policy:        policy,
+		csrf:          csrf,
+		limits:        limits,
+		shared:        shared,
+		accessLog:     accessLog,
+
+		circuitVersion: cfg.Circuit.Version(),
+		circuits:       knownCircuits(cfg),
+		tenantCircuits: tenantCircuits,
+		canary:         canary,
+		decoyKey:       decoyKey,
+		trustedProxies: trustedProxies,
+		certificates:   make(map[string]*certificateHolder),
+	}
+	srv.anomalies = newAnomalyDetector(cfg.Anomalies, srv.announceAnomaly, shared)
+	// A read replica leaves pruning events and marking expiries to the primary
+	retention, sweepInterval := cfg.StatsRetention.Duration, cfg.ExpirySweepInterval.Duration
+	if cfg.ReadOnly {
+		retention, sweepInterval = 0, 0
+	}
+	srv.events = newEventRecorder(userStore, retention)
+	srv.usage = newUsageMeter(userStore)
+	srv.expiry = startPeriodicTask("Expiry sweep", sweepInterval, func(ctx context.Context) error {
+		_, sweepErr := srv.sweep(ctx)
+		return sweepErr
+	})
+	if cfg.Transcripts.Enabled {
+		srv.audit = startPeriodicTask("Transcript audit", cfg.Transcripts.AuditInterval.Duration, func(ctx context.Context) error {
+			_, auditErr := srv.auditTranscripts(ctx)
+			return auditErr
+		})
+	}
+	if clockChecked {
+		seconds := clockOffset.Seconds()
+		srv.clockOffset = &seconds
+	}
+	srv.adminToken.Store(&cfg.AdminToken)
+	srv.access.Store(access)
+	srv.canaryRollout.Store(rollout)
+	return srv, nil
+}
+
+// Close stops the expiry sweeper and transcript audits, publishes the queued bus events, releases
+// the user store and ends deterministic mode
+func (s *Server) Close() error {
+	s.expiry.close()
+	s.audit.close()
+	s.challenges.close()
+	s.events.close()
+	s.bus.close()
+	s.limits.close()
+	s.accessLog.close()
+	defer s.restoreRandom()
+	return s.store.Close()
+}
+
+// runServeCommand implements the default "serve" subcommand
+func runServeCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the JSON configuration file")
+	addr := flags.String("addr", "", "listen address (overrides the config)")
+	databasePath := flags.String("db", "", "SQLite database path (overrides the config)")
+	unixSocket := flags.String("socket", "", "Unix socket path to serve on as well (overrides the config)")
+	flags.Parse(args)
+
+	// Read at startup and again on every reload, so the flags keep overriding the file
+	loadConfig := func() (Config, error) {
+		cfg, configErr := LoadConfig(*configPath)
+		if configErr != nil {
+			return cfg, configErr
+		}
+		if *addr != "" {
+			cfg.Addr = *addr
+		}
+		if *databasePath != "" {
+			cfg.DatabasePath = *databasePath
+		}
+		if *unixSocket != "" {
+			cfg.UnixSocket = *unixSocket
+		}
+		return cfg, nil
+	}
+	cfg, configErr := loadConfig()
+	if configErr != nil {
+		return configErr
+	}
+
+	// Cancelled on SIGINT/SIGTERM: aborts a slow startup and triggers a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP rereads the configuration file and applies what can change without a restart
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	// The listeners open first and answer /readyz with the startup phase while New runs
+	progress := newStartupProgress()
+	var srv *Server
+	defer func() {
+		if srv != nil {
+			srv.Close()
+		}
+	}()
+	return serveListeners(ctx, cfg, cfg.listenerConfigs(), progress, func() (*Server, error) {
+		var newErr error
+		if srv, newErr = New(withStartupProgress(ctx, progress), cfg); newErr != nil {
+			return nil, newErr
+		}
+		srv.configSource = loadConfig
+		go func() {
+			for range hangups {
+				if reloadErr := srv.reload(ctx); reloadErr != nil {
+					log.Println("Reload failed:", reloadErr)
+				}
+			}
+		}()
+
+		// Keep the Vault token and any leases behind the resolved configuration alive
+		if cfg.vault != nil {
+			go cfg.vault.keepAlive(ctx)
+		}
+		return srv, nil
+	})
+}
+
+// Main runs the subcommand named by the first argument, serving by default
+func Main(args []string) error {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return runServeCommand(args)
+	case "backup":
+		return runBackupCommand(args)
+	case "restore":
+		return runRestoreCommand(args)
+	case "import":
+		return runImportCommand(args)
+	case "load":
+		return runLoadCommand(args)
+	case "keygen":
+		return runKeygenCommand(args)
+	case "ceremony":
+		return runCeremonyCommand(args)
+	case "openapi":
+		return runOpenAPICommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (want serve, backup, restore, import, load, keygen, ceremony or openapi)", command)
+	}
+}
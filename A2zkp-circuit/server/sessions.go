@@ -0,0 +1,135 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// sessionRevokedEvent is the webhook event type announcing a SessionRevocation
+const sessionRevokedEvent = "session.revoked"
+
+// Reasons for a SessionRevocation
+const (
+	sessionLogout      = "logout"       // sessionLogout is a session token revoked by its holder
+	sessionAllRevoked  = "all_sessions" // sessionAllRevoked is every session of a user revoked at once
+	sessionRevokedByID = "token_id"     // sessionRevokedByID is one session token revoked by the admin by its ID
+)
+
+// SessionRevocation describes a revocation of session tokens in the log and to webhooks
+type SessionRevocation struct {
+	UserName  string    `json:"user_name,omitempty"` // UserName is unknown when the admin revoked a token by its ID
+	TokenID   string    `json:"token_id,omitempty"`  // TokenID is set when a single session was revoked
+	Reason    string    `json:"reason"`              // Reason is "logout", "all_sessions" or "token_id"
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// maxSessionIDLength bounds the token IDs accepted by DELETE /admin/sessions/{id}
+const maxSessionIDLength = 128
+
+// sessionClaims returns the claims of the session token a request carries as its bearer token,
+// reporting whether it verifies and was not revoked. Revocations are looked up in the store on
+// every request, so they take effect at once on every replica sharing it; a store that can't
+// answer fails closed.
+func (s *Server) sessionClaims(r *http.Request) (SessionClaims, bool) {
+	token, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var claims SessionClaims
+	if !hasBearer || s.tokens.verify(token, sessionTokenType, s.cfg.OIDC.issuer(), &claims) != nil {
+		return SessionClaims{}, false
+	}
+	revoked, checkErr := s.store.SessionRevoked(r.Context(), claims.Subject, claims.JWTID, time.Unix(claims.IssuedAt, 0))
+	return claims, checkErr == nil && !revoked
+}
+
+// logoutHandler revokes the session token the request is made with
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, valid := s.sessionClaims(r)
+	if !valid {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Logging out needs a valid session token")
+		return
+	}
+	s.writeSessionRevocation(w, r, store.SessionRevocation{
+		UserName:  claims.Subject,
+		TokenID:   claims.JWTID,
+		RevokedAt: time.Now().UTC(),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, sessionLogout)
+}
+
+// revokeUserSessionsHandler revokes every session token issued to a user so far, the one the
+// request is made with included. Tokens issued within the same second as the revocation are
+// revoked too, as session tokens carry their issue time in whole seconds.
+func (s *Server) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.PathValue("id")
+	if !s.authorizedFor(r, userName) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Revoking sessions needs the admin token or a session token of that user")
+		return
+	}
+	now := time.Now().UTC()
+	s.writeSessionRevocation(w, r, store.SessionRevocation{
+		UserName:  userName,
+		RevokedAt: now,
+		ExpiresAt: now.Add(s.cfg.SessionTTL.Duration),
+	}, sessionAllRevoked)
+}
+
+// revokeSessionHandler revokes one session token by its ID, the "jti" claim, e.g. one found in a
+// log. Unknown IDs are recorded all the same, as the server keeps no list of issued sessions.
+func (s *Server) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.PathValue("id")
+	var v validate.Validator
+	v.Text("id", tokenID, maxSessionIDLength)
+	if validateErr := v.Err(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	now := time.Now().UTC()
+	s.writeSessionRevocation(w, r, store.SessionRevocation{
+		TokenID:   tokenID,
+		RevokedAt: now,
+		ExpiresAt: now.Add(s.cfg.SessionTTL.Duration),
+	}, sessionRevokedByID)
+}
+
+// writeSessionRevocation records a revocation and answers 204, or the problem when it can't be stored
+func (s *Server) writeSessionRevocation(w http.ResponseWriter, r *http.Request, revocation store.SessionRevocation, reason string) {
+	if revokeErr := s.revokeSessions(r.Context(), revocation, reason); revokeErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error revoking sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSessions stores a revocation, dropping entries whose tokens have all lapsed, and reports it
+// in the log, the statistics, the webhooks and the event bus
+func (s *Server) revokeSessions(ctx context.Context, revocation store.SessionRevocation, reason string) error {
+	if _, pruneErr := s.store.PruneSessionRevocations(ctx, revocation.RevokedAt); pruneErr != nil {
+		return pruneErr
+	}
+	if revokeErr := s.store.RevokeSessions(ctx, revocation); revokeErr != nil {
+		return revokeErr
+	}
+	var tenant string
+	if revocation.UserName != "" {
+		user, _ := s.store.GetUser(ctx, revocation.UserName)
+		tenant = user.Tenant
+	}
+	logf(ctx, "Revoked sessions (%s): user %q, token %q", reason, revocation.UserName, revocation.TokenID)
+	s.events.add(store.Event{Kind: store.EventSessionRevocation, Tenant: tenant, At: revocation.RevokedAt})
+	announced := SessionRevocation{
+		UserName:  revocation.UserName,
+		TokenID:   revocation.TokenID,
+		Reason:    reason,
+		RevokedAt: revocation.RevokedAt,
+	}
+	s.webhooks.publish(ctx, sessionRevokedEvent, announced)
+	s.bus.emit(ctx, busSessionRevoked, tenant, cmp.Or(revocation.UserName, revocation.TokenID), announced)
+	return nil
+}
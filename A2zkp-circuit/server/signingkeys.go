@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/secret"
+)
+
+// Files signing_keys.dir keeps the keys in, in the clear or sealed through the key provider
+const (
+	signingKeysFile       = "signing-keys.json"
+	signingKeysSealedFile = "signing-keys.sealed"
+)
+
+// signingKey is one Ed25519 key of a signingKeySet
+type signingKey struct {
+	ID        string     `json:"id"` // ID is the RFC 7638 thumbprint of the public key, the "kid" of what it signs
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // ExpiresAt is set once a newer key replaces this one
+	Seed      []byte     `json:"seed"`                 // Seed is the private key as RFC 8032 stores it
+
+	signer *tokenSigner
+}
+
+// SigningKeyResponse describes a signing key in GET /admin/signing-keys
+type SigningKeyResponse struct {
+	KeyID     string     `json:"kid"`
+	Algorithm string     `json:"alg"` // Algorithm is "EdDSA"
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // ExpiresAt is when a replaced key stops being published
+	Current   bool       `json:"current"`              // Current marks the key signing from now on
+}
+
+// signingKeySet holds the Ed25519 keys responses and webhook deliveries are signed with. The newest
+// is current and signs; the keys it replaced stay published until their overlap ends, so what they
+// signed keeps verifying.
+type signingKeySet struct {
+	mu          sync.Mutex
+	keys        []*signingKey // keys is ordered oldest first; the last one is current
+	rotateEvery time.Duration
+	overlap     time.Duration
+	dir         string       // dir persists the keys; empty keeps them in memory
+	provider    KeyProvider  // provider seals the keys written to dir, when configured
+	shared      *sharedState // shared derives the keys instead in stateless mode, one per rotation period
+}
+
+// newSigningKeySet restores the keys saved in cfg.Dir or starts with a new one
+func newSigningKeySet(ctx context.Context, cfg SigningKeysConfig, provider KeyProvider, shared *sharedState) (*signingKeySet, error) {
+	set := &signingKeySet{rotateEvery: cfg.RotateEvery.Duration, overlap: cfg.Overlap.Duration, dir: cfg.Dir, provider: provider, shared: shared}
+	now := time.Now()
+	switch {
+	case shared != nil:
+		// Starting from the key of a period ago publishes the previous key when it is still in its overlap
+		first, firstErr := set.nextKey(now.Add(-set.overlap))
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		set.keys = []*signingKey{first}
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		if set.dueLocked(now) {
+			if rotateErr := set.rotateLocked(ctx, now); rotateErr != nil {
+				return nil, rotateErr
+			}
+		}
+		return set, nil
+	case set.dir != "":
+		if mkdirErr := os.MkdirAll(set.dir, 0o700); mkdirErr != nil {
+			return nil, mkdirErr
+		}
+		loaded, loadErr := set.load(ctx)
+		if loadErr != nil || loaded {
+			return set, loadErr
+		}
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if rotateErr := set.rotateLocked(ctx, now); rotateErr != nil {
+		return nil, rotateErr
+	}
+	return set, nil
+}
+
+// current returns the signer of the current key, first rotating it when rotate_every has passed
+func (k *signingKeySet) current(ctx context.Context) (*tokenSigner, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now := time.Now(); k.dueLocked(now) {
+		if rotateErr := k.rotateLocked(ctx, now); rotateErr != nil {
+			return nil, fmt.Errorf("rotating signing key: %w", rotateErr)
+		}
+	}
+	return k.keys[len(k.keys)-1].signer, nil
+}
+
+// sign serializes claims as a compact JWS signed with the current key
+func (k *signingKeySet) sign(ctx context.Context, typ string, claims any) (string, error) {
+	signer, currentErr := k.current(ctx)
+	if currentErr != nil {
+		return "", currentErr
+	}
+	return signer.sign(typ, claims)
+}
+
+// signMessage signs message itself with the current key, returning the key's ID and the signature
+func (k *signingKeySet) signMessage(ctx context.Context, message []byte) (string, []byte, error) {
+	signer, currentErr := k.current(ctx)
+	if currentErr != nil {
+		return "", nil, currentErr
+	}
+	signature, signErr := signer.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	return signer.keyID, signature, signErr
+}
+
+// rotate makes a new key current; the previous ones stay published until their overlap ends.
+// Stateless replicas only rotate on their schedule, since each would otherwise pick its own key.
+func (k *signingKeySet) rotate(ctx context.Context) (*signingKey, error) {
+	if k.shared != nil {
+		return nil, errors.New("signing keys are derived from stateless.secret and only rotate every signing_keys.rotate_every")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if rotateErr := k.rotateLocked(ctx, time.Now()); rotateErr != nil {
+		return nil, rotateErr
+	}
+	return k.keys[len(k.keys)-1], nil
+}
+
+// list describes every published key, oldest first
+func (k *signingKeySet) list() []SigningKeyResponse {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pruneLocked(time.Now())
+	keys := make([]SigningKeyResponse, len(k.keys))
+	for i, key := range k.keys {
+		keys[i] = SigningKeyResponse{KeyID: key.ID, Algorithm: key.signer.alg, CreatedAt: key.CreatedAt, ExpiresAt: key.ExpiresAt, Current: i == len(k.keys)-1}
+	}
+	return keys
+}
+
+// jwks is the JWKS document of the published keys, current first
+func (k *signingKeySet) jwks() JSONWebKeySet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pruneLocked(time.Now())
+	document := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(k.keys))}
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		document.Keys = append(document.Keys, k.keys[i].signer.jwk)
+	}
+	return document
+}
+
+// dueLocked reports whether the current key has signed for rotate_every
+func (k *signingKeySet) dueLocked(now time.Time) bool {
+	return k.rotateEvery > 0 && now.Sub(k.keys[len(k.keys)-1].CreatedAt) >= k.rotateEvery
+}
+
+// rotateLocked appends the key for now, sets the overlap of the ones it replaces and saves the set
+func (k *signingKeySet) rotateLocked(ctx context.Context, now time.Time) error {
+	next, nextErr := k.nextKey(now)
+	if nextErr != nil {
+		return nextErr
+	}
+	expiresAt := next.CreatedAt.Add(k.overlap)
+	for _, previous := range k.keys {
+		if previous.ExpiresAt == nil || previous.ExpiresAt.After(expiresAt) {
+			previous.ExpiresAt = &expiresAt
+		}
+	}
+	k.keys = append(k.keys, next)
+	k.pruneLocked(now)
+	return k.saveLocked(ctx)
+}
+
+// nextKey generates a key created at now or, in stateless mode, derives the key of the rotation
+// period now falls in, created when the period began
+func (k *signingKeySet) nextKey(now time.Time) (*signingKey, error) {
+	if k.shared == nil {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, randErr := rand.Read(seed); randErr != nil {
+			return nil, randErr
+		}
+		return newSigningKey(seed, now.UTC())
+	}
+	var period int64
+	createdAt := time.Unix(0, 0).UTC()
+	if k.rotateEvery > 0 {
+		period = now.UnixNano() / int64(k.rotateEvery)
+		createdAt = time.Unix(0, period*int64(k.rotateEvery)).UTC()
+	}
+	return newSigningKey(k.shared.derive("signing key "+strconv.FormatInt(period, 10)), createdAt)
+}
+
+// newSigningKey wraps the Ed25519 key of seed
+func newSigningKey(seed []byte, createdAt time.Time) (*signingKey, error) {
+	signer, signerErr := newTokenSigner(ed25519.NewKeyFromSeed(seed))
+	if signerErr != nil {
+		return nil, signerErr
+	}
+	return &signingKey{ID: signer.keyID, CreatedAt: createdAt, Seed: seed, signer: signer}, nil
+}
+
+// pruneLocked drops the keys whose overlap has ended
+func (k *signingKeySet) pruneLocked(now time.Time) {
+	kept := k.keys[:0]
+	for _, key := range k.keys {
+		if key.ExpiresAt == nil || now.Before(*key.ExpiresAt) {
+			kept = append(kept, key)
+		}
+	}
+	k.keys = kept
+}
+
+// saveLocked writes the keys to dir, sealed when a provider is configured
+func (k *signingKeySet) saveLocked(ctx context.Context) error {
+	if k.dir == "" || k.shared != nil {
+		return nil
+	}
+	encoded, encodeErr := json.MarshalIndent(k.keys, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	defer secret.WipeBytes(encoded)
+	if k.provider == nil {
+		return os.WriteFile(filepath.Join(k.dir, signingKeysFile), encoded, 0o600)
+	}
+	sealed, sealErr := sealWithProvider(ctx, k.provider, signingKeysFile, encoded)
+	if sealErr != nil {
+		return sealErr
+	}
+	return os.WriteFile(filepath.Join(k.dir, signingKeysSealedFile), sealed, 0o600)
+}
+
+// load restores the unexpired keys saved in dir; it reports false when dir holds none
+func (k *signingKeySet) load(ctx context.Context) (bool, error) {
+	name := signingKeysFile
+	if k.provider != nil {
+		name = signingKeysSealedFile
+	}
+	data, readErr := os.ReadFile(filepath.Join(k.dir, name))
+	if errors.Is(readErr, os.ErrNotExist) {
+		return false, nil
+	}
+	if readErr != nil {
+		return false, readErr
+	}
+	if k.provider != nil {
+		var openErr error
+		if data, openErr = openWithProvider(ctx, k.provider, signingKeysFile, data); openErr != nil {
+			return false, openErr
+		}
+	}
+	defer secret.WipeBytes(data)
+
+	var saved []*signingKey
+	if decodeErr := json.Unmarshal(data, &saved); decodeErr != nil {
+		return false, fmt.Errorf("parsing %s: %w", name, decodeErr)
+	}
+	for _, key := range saved {
+		if len(key.Seed) != ed25519.SeedSize {
+			return false, fmt.Errorf("signing key %s in %s is malformed", key.ID, name)
+		}
+		restored, restoreErr := newSigningKey(key.Seed, key.CreatedAt)
+		if restoreErr != nil {
+			return false, restoreErr
+		}
+		restored.ExpiresAt = key.ExpiresAt
+		k.keys = append(k.keys, restored)
+	}
+	k.pruneLocked(time.Now())
+	return len(k.keys) > 0, nil
+}
+
+// signingKeysHandler publishes the current signing key and those it replaced that are still in
+// their overlap
+func (s *Server) signingKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, s.signingKeys.jwks())
+}
+
+// listSigningKeysHandler lists the published signing keys with their lifetimes
+func (s *Server) listSigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, s.signingKeys.list())
+}
+
+// rotateSigningKeyHandler makes a new signing key current ahead of rotate_every
+func (s *Server) rotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shared != nil {
+		writeProblem(w, http.StatusForbidden, codeFeatureDisabled, "Signing keys can't be rotated in stateless mode, where they rotate every signing_keys.rotate_every")
+		return
+	}
+	key, rotateErr := s.signingKeys.rotate(r.Context())
+	if rotateErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error rotating signing key: %v", rotateErr))
+		return
+	}
+	writeResponse(w, r, http.StatusCreated, SigningKeyResponse{KeyID: key.ID, Algorithm: key.signer.alg, CreatedAt: key.CreatedAt, Current: true})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// Startup phases of a circuit's keys, and of the server around them
+const (
+	phaseStarting    = "starting" // phaseStarting is everything between the phases below, such as opening the store
+	phaseLoadingKeys = "loading-keys"
+	phaseCompiling   = "compiling"
+	phaseSettingUp   = "setting-up"
+	phaseReady       = "ready"
+)
+
+// startupRetryAfter is the Retry-After hint of the 503 responses sent while the server starts
+const startupRetryAfter = 5 * time.Second
+
+// ReadinessResponse is the body of GET /readyz
+type ReadinessResponse struct {
+	// Status is "starting" until the server can serve its routes, then "ready", or "failed" while the
+	// latest self-test failed
+	Status string `json:"status"`
+	// Phase is the startup phase running, e.g. "setting-up", or "ready"
+	Phase  string         `json:"phase"`
+	Phases []StartupPhase `json:"phases"` // Phases lists the finished phases, oldest first
+	// StartupSeconds is how long startup took, once ready
+	StartupSeconds float64 `json:"startup_seconds,omitempty"`
+	// SelfTest is the latest self-test, run at startup with self_test set or by POST /admin/self-test
+	SelfTest *SelfTestReport `json:"self_test,omitempty"`
+	// ReadOnly is set on a read replica, which serves verification, key and metadata routes alone
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// StartupPhase is a finished step of getting a circuit's keys ready at startup
+type StartupPhase struct {
+	Phase   string  `json:"phase"`   // Phase is "loading-keys", "compiling" or "setting-up"
+	Circuit string  `json:"circuit"` // Circuit is the circuit version
+	Curve   string  `json:"curve"`
+	Seconds float64 `json:"seconds"`
+	// Constraints counts the constraints of the circuit compiled or loaded
+	Constraints int `json:"constraints,omitempty"`
+}
+
+// startupProgress records the phases of a startup as they run, for logs, /readyz and /metrics
+type startupProgress struct {
+	started time.Time
+
+	mu      sync.Mutex
+	current string         // current is the phase running
+	phases  []StartupPhase // phases holds the finished phases, oldest first
+	took    time.Duration  // took is how long startup took; 0 until it is over
+}
+
+// newStartupProgress starts recording a startup
+func newStartupProgress() *startupProgress {
+	return &startupProgress{started: time.Now(), current: phaseStarting}
+}
+
+// startupProgressKey is the context key of the startupProgress New records into
+type startupProgressKey struct{}
+
+// withStartupProgress returns a context whose startup phases are recorded in progress
+func withStartupProgress(ctx context.Context, progress *startupProgress) context.Context {
+	return context.WithValue(ctx, startupProgressKey{}, progress)
+}
+
+// startupProgressFrom returns the progress ctx records into; nil outside startup
+func startupProgressFrom(ctx context.Context) *startupProgress {
+	progress, _ := ctx.Value(startupProgressKey{}).(*startupProgress)
+	return progress
+}
+
+// begin starts phase for a circuit version over curve and returns the function ending it with the
+// number of constraints involved; a nil receiver records nothing
+func (p *startupProgress) begin(phase, version string, curve ecc.ID) func(constraints int) {
+	if p == nil {
+		return func(int) {}
+	}
+	log.Printf("Startup phase=%s circuit=%s curve=%s started", phase, version, curve)
+	p.mu.Lock()
+	p.current = phase
+	p.mu.Unlock()
+	began := time.Now()
+	return func(constraints int) {
+		finished := StartupPhase{Phase: phase, Circuit: version, Curve: curve.String(), Seconds: time.Since(began).Seconds(), Constraints: constraints}
+		log.Printf("Startup phase=%s circuit=%s curve=%s seconds=%.3f constraints=%d", phase, version, curve, finished.Seconds, constraints)
+		p.mu.Lock()
+		p.current = phaseStarting
+		p.phases = append(p.phases, finished)
+		p.mu.Unlock()
+	}
+}
+
+// ready ends the startup
+func (p *startupProgress) ready() {
+	p.mu.Lock()
+	p.current, p.took = phaseReady, time.Since(p.started)
+	p.mu.Unlock()
+	log.Printf("Startup phase=%s seconds=%.3f", phaseReady, p.took.Seconds())
+}
+
+// readiness describes the startup as GET /readyz reports it
+func (p *startupProgress) readiness() ReadinessResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	response := ReadinessResponse{Status: phaseStarting, Phase: p.current, Phases: slices.Clone(p.phases), StartupSeconds: p.took.Seconds()}
+	if p.current == phaseReady {
+		response.Status = phaseReady
+	}
+	if response.Phases == nil {
+		response.Phases = []StartupPhase{}
+	}
+	return response
+}
+
+// readyHandler reports that the server is ready, with the phases its startup went through, or
+// answers 503 while the latest self-test failed
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := s.startup.readiness()
+	readiness.SelfTest = s.lastSelfTest.Load()
+	readiness.ReadOnly = s.cfg.ReadOnly
+	if !readiness.SelfTest.passed() {
+		readiness.Status = selfTestFailed
+		writeResponse(w, r, http.StatusServiceUnavailable, readiness)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, readiness)
+}
+
+// startingHandler is what listeners serve while New runs: /healthz answers that the process is
+// alive, /readyz which phase startup is in, and every other route 503
+func startingHandler(progress *startupProgress) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, r, http.StatusOK, StatusResponse{Status: phaseStarting})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, r, http.StatusServiceUnavailable, progress.readiness())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfterSeconds(startupRetryAfter))
+		writeProblem(w, http.StatusServiceUnavailable, codeStarting, "Server is starting, retry later")
+	})
+	return withRequestID(mux)
+}
+
+// switchHandler serves with the handler stored last, so a listener can open before the server it
+// serves is built
+type switchHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+// newSwitchHandler creates a switchHandler serving with handler
+func newSwitchHandler(handler http.Handler) *switchHandler {
+	h := &switchHandler{}
+	h.store(handler)
+	return h
+}
+
+// store makes handler serve the requests from now on
+func (h *switchHandler) store(handler http.Handler) {
+	h.current.Store(&handler)
+}
+
+// ServeHTTP implements http.Handler
+func (h *switchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*h.current.Load()).ServeHTTP(w, r)
+}
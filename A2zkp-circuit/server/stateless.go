@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTxAttempts bounds how often a transaction runs again after a key it watched changed
+const maxTxAttempts = 10
+
+// sharedState is where stateless mode keeps what every replica must see: the Redis client and the
+// prefix of the keys written
+type sharedState struct {
+	client *redis.Client
+	prefix string
+	secret string // secret is stateless.secret, which shared keys are derived from
+}
+
+// newSharedState checks the stateless settings against the rest of cfg; it returns nil outside stateless mode
+func newSharedState(cfg Config) (*sharedState, error) {
+	if !cfg.Stateless.Enabled {
+		return nil, nil
+	}
+	var refused string
+	switch {
+	case cfg.Stateless.Redis.Addr == "":
+		return nil, errors.New("stateless.redis.addr is required in stateless mode")
+	case cfg.Stateless.Secret == "":
+		return nil, errors.New("stateless.secret is required in stateless mode, the same on every replica")
+	case embeddedArtifacts == nil && cfg.Vault.ArtifactsPath == "" && cfg.ArtifactsDir == "" && cfg.ArtifactsURL == "":
+		return nil, errors.New("stateless mode needs artifacts every replica loads: embedded, vault.artifacts_path, artifacts_dir or artifacts_url")
+	case cfg.DatabasePath != "":
+		refused = "database_path"
+	case cfg.LDAP.URL != "":
+		refused = "ldap.url"
+	case cfg.Groups.Enabled:
+		refused = "groups.enabled"
+	case cfg.SecretPolicy.MinBits != 0 || len(cfg.SecretPolicy.Denylist) > 0:
+		refused = "secret_policy"
+	case cfg.EnableProvingAPI:
+		refused = "enable_proving_api"
+	case cfg.RateLimit.Backend == rateLimitMemory && len(cfg.RateLimit.Rules) > 0:
+		refused = "rate_limit.backend memory"
+	}
+	if refused != "" {
+		return nil, fmt.Errorf("stateless mode can't be combined with %s: replicas would each keep state of their own", refused)
+	}
+	client, clientErr := newRedisClient(cfg.Stateless.Redis)
+	if clientErr != nil {
+		return nil, fmt.Errorf("stateless.redis: %w", clientErr)
+	}
+	return &sharedState{client: client, prefix: cfg.Stateless.Redis.KeyPrefix, secret: cfg.Stateless.Secret}, nil
+}
+
+// key joins the prefix and the parts of a key
+func (st *sharedState) key(parts ...string) string {
+	return st.prefix + strings.Join(parts, ":")
+}
+
+// watch runs fn in a transaction watching keys, starting over while a watched key changes before
+// the commands fn queues are executed
+func (st *sharedState) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		watchErr := st.client.Watch(ctx, fn, keys...)
+		if !errors.Is(watchErr, redis.TxFailedErr) || attempt == maxTxAttempts {
+			return watchErr
+		}
+	}
+}
+
+// derive returns the key for purpose derived from stateless.secret, the same on every replica
+func (st *sharedState) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(st.secret))
+	mac.Write([]byte("ofa stateless " + purpose))
+	return mac.Sum(nil)
+}
+
+// signingKey derives the P-256 token signing key replicas share when no signing_key is configured
+func (st *sharedState) signingKey() (*ecdsa.PrivateKey, error) {
+	// A derived scalar falls outside [1, n-1] with negligible odds; the counter draws another one
+	for counter := 0; ; counter++ {
+		scalar := st.derive("token signing key " + strconv.Itoa(counter))
+		private, keyErr := ecdh.P256().NewPrivateKey(scalar)
+		if keyErr != nil {
+			continue
+		}
+		point := private.PublicKey().Bytes() // point is 0x04 || X || Y
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(point[1:33]), Y: new(big.Int).SetBytes(point[33:])},
+			D:         new(big.Int).SetBytes(scalar),
+		}, nil
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// StatsResponse is the response of GET /v1/stats
+type StatsResponse struct {
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Bucket  Duration        `json:"bucket"`  // Bucket is the width of each entry of Buckets
+	Total   StatsCounters   `json:"total"`   // Total counts the whole period across tenants
+	Tenants []StatsCounters `json:"tenants"` // Tenants counts the whole period per tenant, ordered by tenant
+	// Buckets counts each bucket per tenant, by start time then tenant; buckets without events are left out
+	Buckets []StatsCounters `json:"buckets"`
+}
+
+// StatsCounters aggregates the authentication events of a period
+type StatsCounters struct {
+	Start         time.Time `json:"start"`  // Start opens the bucket; the zero time in totals
+	Tenant        string    `json:"tenant"` // Tenant is empty for the default tenant and in Total
+	Registrations int       `json:"registrations"`
+	Verifications int       `json:"verifications"` // Verifications counts verdicts on login proofs
+	Successes     int       `json:"successes"`     // Successes counts the proofs that verified
+	SuccessRate   float64   `json:"success_rate"`  // SuccessRate is Successes over Verifications; 0 without verifications
+	// ProofLatencyP50 and ProofLatencyP95 are percentiles of the pairing check time in milliseconds
+	ProofLatencyP50 float64 `json:"proof_latency_p50_ms"`
+	ProofLatencyP95 float64 `json:"proof_latency_p95_ms"`
+	// Anomalies counts the brute-force patterns detected, the server's stand-in for lockouts; only in Total
+	Anomalies int `json:"anomalies"`
+
+	latencies []time.Duration
+}
+
+// maxStatsBuckets bounds the buckets one GET /v1/stats may span
+const maxStatsBuckets = 10000
+
+// statsHandler aggregates the stored authentication events of a period into time buckets per tenant
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to, toErr := parseStatsTime(query.Get("to"), time.Now().UTC())
+	from, fromErr := parseStatsTime(query.Get("from"), to.Add(-24*time.Hour))
+	bucket := time.Hour
+	var bucketErr error
+	if text := query.Get("bucket"); text != "" {
+		bucket, bucketErr = time.ParseDuration(text)
+	}
+	switch {
+	case toErr != nil || fromErr != nil:
+		writeRequestError(w, badRequest("from and to must be RFC 3339 times"))
+		return
+	case bucketErr != nil || bucket < time.Second:
+		writeRequestError(w, badRequest("bucket must be a duration of at least 1s, e.g. 1h"))
+		return
+	case !from.Before(to):
+		writeRequestError(w, badRequest("from must be before to"))
+		return
+	case to.Sub(from)/bucket > maxStatsBuckets:
+		writeRequestError(w, badRequest("The period spans more than %d buckets", maxStatsBuckets))
+		return
+	}
+
+	s.events.flush(r.Context())
+	events, listErr := s.store.ListEvents(r.Context(), from, to)
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading events: %v", listErr))
+		return
+	}
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		// A tenant-admin only sees its own tenant, whatever it asks for
+		query.Set("tenant", p.tenant)
+	}
+	if tenant := query.Get("tenant"); query.Has("tenant") {
+		events = slices.DeleteFunc(events, func(event store.Event) bool { return event.Tenant != tenant })
+	}
+	writeResponse(w, r, http.StatusOK, aggregateStats(events, from, to, bucket))
+}
+
+// parseStatsTime parses an RFC 3339 query value, which falls back to fallback when empty
+func parseStatsTime(text string, fallback time.Time) (time.Time, error) {
+	if text == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339, text)
+}
+
+// statsKey identifies one bucket of one tenant
+type statsKey struct {
+	start  time.Time
+	tenant string
+}
+
+// aggregateStats counts events, oldest first, per bucket of the given width starting at from
+func aggregateStats(events []store.Event, from, to time.Time, bucket time.Duration) StatsResponse {
+	total := &StatsCounters{}
+	tenants := map[string]*StatsCounters{}
+	buckets := map[statsKey]*StatsCounters{}
+	for _, event := range events {
+		key := statsKey{start: from.Add(event.At.Sub(from) / bucket * bucket), tenant: event.Tenant}
+		if event.Kind == store.EventAnomaly {
+			total.Anomalies++
+			continue
+		}
+		if tenants[key.tenant] == nil {
+			tenants[key.tenant] = &StatsCounters{Tenant: key.tenant}
+		}
+		if buckets[key] == nil {
+			buckets[key] = &StatsCounters{Start: key.start, Tenant: key.tenant}
+		}
+		for _, counters := range []*StatsCounters{total, tenants[key.tenant], buckets[key]} {
+			counters.count(event)
+		}
+	}
+
+	response := StatsResponse{From: from, To: to, Bucket: Duration{bucket}, Total: total.finish()}
+	for _, counters := range tenants {
+		response.Tenants = append(response.Tenants, counters.finish())
+	}
+	slices.SortFunc(response.Tenants, func(a, b StatsCounters) int { return strings.Compare(a.Tenant, b.Tenant) })
+	for _, counters := range buckets {
+		response.Buckets = append(response.Buckets, counters.finish())
+	}
+	slices.SortFunc(response.Buckets, func(a, b StatsCounters) int {
+		if byStart := a.Start.Compare(b.Start); byStart != 0 {
+			return byStart
+		}
+		return strings.Compare(a.Tenant, b.Tenant)
+	})
+	return response
+}
+
+// count adds a registration or verification event
+func (c *StatsCounters) count(event store.Event) {
+	switch event.Kind {
+	case store.EventRegistration:
+		c.Registrations++
+	case store.EventVerification:
+		c.Verifications++
+		if event.Success {
+			c.Successes++
+		}
+		c.latencies = append(c.latencies, event.Latency)
+	}
+}
+
+// finish derives the success rate and latency percentiles from the counts
+func (c *StatsCounters) finish() StatsCounters {
+	if c.Verifications > 0 {
+		c.SuccessRate = float64(c.Successes) / float64(c.Verifications)
+	}
+	slices.Sort(c.latencies)
+	c.ProofLatencyP50, c.ProofLatencyP95 = percentile(c.latencies, 50), percentile(c.latencies, 95)
+	return *c
+}
+
+// percentile is the nearest-rank percentile of sorted durations in milliseconds; 0 when empty
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return float64(sorted[max(rank, 1)-1]) / float64(time.Millisecond)
+}
+
+// recordRegistration counts a newly stored user for the statistics and announces it on the event bus
+func (s *Server) recordRegistration(ctx context.Context, user store.User) {
+	s.events.add(store.Event{Kind: store.EventRegistration, Tenant: user.Tenant, At: user.CreatedAt})
+	s.bus.emit(ctx, busRegistrationCreated, user.Tenant, user.UserName, RegistrationCreated{
+		UserName:       user.UserName,
+		CircuitVersion: user.CircuitVersion,
+		Curve:          user.Curve,
+		CreatedAt:      user.CreatedAt,
+	})
+}
+
+// eventFlushInterval is how often buffered events are written to the store
+const eventFlushInterval = time.Second
+
+// eventRecorder buffers authentication events and writes them to the store in batches, off the
+// request path, pruning those older than the retention as it goes
+type eventRecorder struct {
+	store     store.Store
+	retention time.Duration
+	events    chan store.Event
+	flushes   chan chan struct{} // flushes asks for the buffer to be written now, closing the channel when done
+	done      chan struct{}
+
+	closeMu sync.RWMutex // closeMu keeps add from sending on events once close has closed it
+	closed  bool
+}
+
+// newEventRecorder starts writing events to st
+func newEventRecorder(st store.Store, retention time.Duration) *eventRecorder {
+	r := &eventRecorder{
+		store:     st,
+		retention: retention,
+		events:    make(chan store.Event, 1024),
+		flushes:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// add queues an event; when the queue is full the event is dropped rather than slowing down a request
+func (r *eventRecorder) add(event store.Event) {
+	r.closeMu.RLock()
+	defer r.closeMu.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.events <- event:
+	default:
+		log.Printf("Dropping %s event: the event queue is full", event.Kind)
+	}
+}
+
+// flush writes the queued events before returning, or gives up when ctx is done
+func (r *eventRecorder) flush(ctx context.Context) {
+	flushed := make(chan struct{})
+	select {
+	case r.flushes <- flushed:
+	case <-ctx.Done():
+		return
+	case <-r.done:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+	}
+}
+
+// close writes the queued events and stops the recorder
+func (r *eventRecorder) close() {
+	r.closeMu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+	}
+	r.closeMu.Unlock()
+	<-r.done
+}
+
+// run collects events and writes them every eventFlushInterval, on request and when closed
+func (r *eventRecorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+	var pending []store.Event
+	var lastPrune time.Time
+	write := func() {
+		for drained := false; !drained; {
+			select {
+			case event, open := <-r.events:
+				if !open {
+					drained = true
+					break
+				}
+				pending = append(pending, event)
+			default:
+				drained = true
+			}
+		}
+		if len(pending) > 0 {
+			// A read replica's events are dropped: the stats are the primary's
+			if recordErr := r.store.RecordEvents(context.Background(), pending); recordErr != nil && !errors.Is(recordErr, store.ErrReadOnly) {
+				log.Printf("Dropping %d events: %v", len(pending), recordErr)
+			}
+			pending = pending[:0]
+		}
+		if r.retention > 0 && time.Since(lastPrune) > time.Hour {
+			if _, pruneErr := r.store.PruneEvents(context.Background(), time.Now().Add(-r.retention)); pruneErr != nil {
+				log.Printf("Error pruning events: %v", pruneErr)
+			}
+			lastPrune = time.Now()
+		}
+	}
+	for {
+		select {
+		case event, open := <-r.events:
+			if !open {
+				write()
+				return
+			}
+			pending = append(pending, event)
+		case flushed := <-r.flushes:
+			write()
+			close(flushed)
+		case <-ticker.C:
+			write()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/validate"
+)
+
+// assuranceStepUp is the "acr" of step-up tokens: a session whose user proved knowledge of the
+// secret again
+const assuranceStepUp = "zkp-step-up"
+
+// stepUpTokenType is the "typ" header of step-up tokens, keeping them apart from the session
+// tokens they elevate
+const stepUpTokenType = "step-up+jwt"
+
+// StepUpClaims are the claims of a step-up token: a short-lived attestation that the holder of a
+// session proved knowledge of the secret again, for relying parties guarding sensitive operations
+type StepUpClaims struct {
+	registeredClaims
+	SessionID      string `json:"sid"`       // SessionID is the jti of the session token the step-up elevates
+	AssuranceLevel string `json:"acr"`       // AssuranceLevel is assuranceStepUp
+	AuthTime       int64  `json:"auth_time"` // AuthTime is when the fresh proof verified
+	KeyID          string `json:"key_id"`    // KeyID is the key version the fresh proof verified under
+	JWTID          string `json:"jti"`
+}
+
+// StepUpResponse carries the step-up token of an elevated session
+type StepUpResponse struct {
+	StepUpToken    string `json:"step_up_token"`
+	AssuranceLevel string `json:"acr"`
+	SessionID      string `json:"session_id"` // SessionID is the jti of the session token elevated
+	KeyID          string `json:"key_id"`
+	ExpiresIn      int64  `json:"expires_in"` // ExpiresIn is the step-up token's lifetime in seconds, at most the session's
+}
+
+// stepUpChallengeKey is what step-up challenges are issued to in the challenge store, binding the
+// nonce to one session; the prefix keeps them apart from user names, as for groupChallengeKey
+func stepUpChallengeKey(sessionID string) string {
+	return "\x00step-up:" + sessionID
+}
+
+// stepUpChallengeHandler issues a nonce for the user of the session token the request carries to
+// prove knowledge of their secret again; only that session can redeem it
+func (s *Server) stepUpChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, valid := s.sessionClaims(r)
+	if !valid {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "A step-up needs a valid session token")
+		return
+	}
+	keyID := s.keyring.current().ID
+	user, _ := s.getUser(r.Context(), claims.Subject)
+	pinned := s.pinnedCircuit(user.Tenant)
+	if pinned == nil && s.boundToCanary(user) {
+		pinned = s.canary
+	}
+	if pinned != nil {
+		version, keyErr := pinned.keyVersion(r.Context(), ProofRequest{})
+		if keyErr != nil {
+			writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up circuit %s: %v", pinned.composition.Version(), keyErr))
+			return
+		}
+		keyID = version.ID
+	}
+	nonce, expiresAt, issueErr := s.challenges.issue(r.Context(), stepUpChallengeKey(claims.JWTID))
+	if issueErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error issuing challenge: %v", issueErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, ChallengeResponse{Nonce: nonce.String(), ExpiresAt: expiresAt, KeyID: keyID})
+}
+
+// stepUpHandler checks a fresh proof against a step-up challenge of the session the request is
+// made with, as a login proof is checked, and answers with a step-up token elevating that session.
+// The token lives for step_up_ttl, never past the session, and is revoked with it.
+func (s *Server) stepUpHandler(w http.ResponseWriter, r *http.Request) {
+	claims, valid := s.sessionClaims(r)
+	if !valid {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "A step-up needs a valid session token")
+		return
+	}
+	var req ProofRequest
+	if decodeErr := decodeBody(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr == nil && req.UserName != claims.Subject {
+		var v validate.Validator
+		v.Fail("user_name", "must be the user of the session token")
+		validateErr = v.Err()
+	}
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	req.stepUpSession = claims.JWTID
+
+	_, version, authErr := s.authenticate(r.Context(), req, nonce)
+	if authErr != nil {
+		s.writeAuthError(w, req, authErr)
+		return
+	}
+	tokenID, idErr := randomToken()
+	if idErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error signing step-up token")
+		return
+	}
+	now := time.Now()
+	expiresAt := min(now.Add(s.cfg.StepUpTTL.Duration).Unix(), claims.ExpiresAt)
+	token, signErr := s.tokens.sign(stepUpTokenType, StepUpClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    claims.Issuer,
+			Subject:   claims.Subject,
+			Audience:  claims.Audience,
+			ExpiresAt: expiresAt,
+			IssuedAt:  now.Unix(),
+		},
+		SessionID:      claims.JWTID,
+		AssuranceLevel: assuranceStepUp,
+		AuthTime:       now.Unix(),
+		KeyID:          version.ID,
+		JWTID:          tokenID,
+	})
+	if signErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Error signing step-up token")
+		return
+	}
+	logf(r.Context(), "Stepped up session %s of %q until %s", claims.JWTID, claims.Subject, time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	writeResponse(w, r, http.StatusOK, StepUpResponse{
+		StepUpToken:    token,
+		AssuranceLevel: assuranceStepUp,
+		SessionID:      claims.JWTID,
+		KeyID:          version.ID,
+		ExpiresIn:      expiresAt - now.Unix(),
+	})
+}
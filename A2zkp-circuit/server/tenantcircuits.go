@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/verifier"
+)
+
+// tenantCircuit is a circuit tenant_circuits pins tenants to, with its single key version, which
+// the key ring does not rotate. Tenants pinned to the same composition share it.
+type tenantCircuit struct {
+	composition circuit.Composition
+	keys        *lazyKeys
+}
+
+// pinnedComposition is the composition tenant_circuits pins a tenant to, "-" naming the default one
+func (c Config) pinnedComposition(tenant string) (circuit.Composition, bool) {
+	if tenant == "" {
+		tenant = "-"
+	}
+	composition, pinned := c.TenantCircuits[tenant]
+	return composition, pinned
+}
+
+// tenantCircuitVersions maps the tenants tenant_circuits pins to the version of their circuit
+func (c Config) tenantCircuitVersions() map[string]string {
+	versions := make(map[string]string, len(c.TenantCircuits))
+	for tenant, composition := range c.TenantCircuits {
+		if tenant == "-" {
+			tenant = ""
+		}
+		versions[tenant] = composition.Version()
+	}
+	return versions
+}
+
+// newTenantCircuits prepares the circuits of cfg.TenantCircuits and of cfg.CanaryCircuit, by
+// circuit version. Keys written by keygen -tenant to artifacts_dir/<circuit version> are loaded now;
+// circuits without them are set up on first use and lose their keys on restart, like the additional curves.
+func newTenantCircuits(ctx context.Context, cfg Config, provider KeyProvider) (map[string]*tenantCircuit, error) {
+	circuits := make(map[string]*tenantCircuit)
+	for _, tenant := range slices.Sorted(maps.Keys(cfg.TenantCircuits)) {
+		composition := cfg.TenantCircuits[tenant]
+		version := composition.Version()
+		validateErr := composition.Validate()
+		switch {
+		case validateErr != nil:
+			return nil, fmt.Errorf("tenant_circuits: %s: %w", tenant, validateErr)
+		case version == cfg.Circuit.Version():
+			return nil, fmt.Errorf("tenant_circuits: %s is pinned to the configured circuit; leave it out instead", tenant)
+		case circuits[version] != nil:
+			continue
+		}
+		pinned, prepareErr := prepareCircuit(ctx, cfg, provider, composition)
+		if prepareErr != nil {
+			return nil, fmt.Errorf("tenant_circuits: %s: %w", tenant, prepareErr)
+		}
+		circuits[version] = pinned
+	}
+	if canary := cfg.CanaryCircuit.Circuit; canary != nil {
+		version := canary.Version()
+		validateErr := canary.Validate()
+		switch {
+		case validateErr != nil:
+			return nil, fmt.Errorf("canary_circuit: %w", validateErr)
+		case version == cfg.Circuit.Version():
+			return nil, errors.New("canary_circuit: the canary is the configured circuit; leave it out instead")
+		case circuits[version] == nil:
+			prepared, prepareErr := prepareCircuit(ctx, cfg, provider, *canary)
+			if prepareErr != nil {
+				return nil, fmt.Errorf("canary_circuit: %w", prepareErr)
+			}
+			circuits[version] = prepared
+		}
+	}
+	return circuits, nil
+}
+
+// prepareCircuit loads the keys of a circuit besides the configured one from artifacts_dir, or
+// leaves them to be set up on first use
+func prepareCircuit(ctx context.Context, cfg Config, provider KeyProvider, composition circuit.Composition) (*tenantCircuit, error) {
+	version := composition.Version()
+	keys := &lazyKeys{version: version, compile: composition.Compile, mock: cfg.MockProver}
+	location := filepath.Join(cfg.ArtifactsDir, version)
+	if _, statErr := os.Stat(location); cfg.ArtifactsDir != "" && statErr == nil {
+		loaded, loadErr := loadCircuitArtifacts(ctx, os.DirFS(location), provider, version, circuit.Curve)
+		if loadErr != nil {
+			return nil, fmt.Errorf("loading artifacts from %s: %w", location, loadErr)
+		}
+		keyID, idErr := verifier.KeyID(loaded.verifyingKey)
+		if idErr != nil {
+			return nil, idErr
+		}
+		keys.keys, keys.keyID = loaded, keyID
+		log.Printf("Circuit %s loaded from %s: key version %s", version, location, keyID)
+	}
+	if keys.keys == nil && cfg.Stateless.Enabled {
+		return nil, fmt.Errorf("circuit %s has no artifacts; stateless replicas can't each set up keys of their own", version)
+	}
+	return &tenantCircuit{composition: composition, keys: keys}, nil
+}
+
+// pinnedCircuit is the circuit tenant_circuits pins a tenant to; nil for a tenant on the configured circuit
+func (s *Server) pinnedCircuit(tenant string) *tenantCircuit {
+	composition, pinned := s.cfg.pinnedComposition(tenant)
+	if !pinned {
+		return nil
+	}
+	return s.tenantCircuits[composition.Version()]
+}
+
+// registrationCircuit is the circuit version and key version new registrations of a user of a
+// tenant over curve are bound to: the tenant's pinned circuit, the canary for users routed to it, or
+// the configured circuit. The key version is empty while a pinned or canary circuit hasn't been set up yet.
+func (s *Server) registrationCircuit(tenant, userName, curve string) (string, string) {
+	if pinned := s.pinnedCircuit(tenant); pinned != nil {
+		return pinned.composition.Version(), pinned.keys.id()
+	}
+	if s.routesToCanary(tenant, userName, curve) {
+		return s.canary.composition.Version(), s.canary.keys.id()
+	}
+	return s.circuitVersion, s.keyring.current().ID
+}
+
+// userCircuit is the pinned circuit a proof for a user verifies against: the one their registration
+// is bound to, unless the proof is over another curve or made with snarkjs, which only the
+// configured circuit verifies; those fail like any proof that doesn't match the registration
+func (s *Server) userCircuit(user store.User, req ProofRequest) *tenantCircuit {
+	if req.curve() != circuit.Curve.String() || req.SnarkJSProof != nil {
+		return nil
+	}
+	return s.tenantCircuits[user.CircuitVersion]
+}
+
+// keyVersion resolves the key of a proof made under the circuit, setting it up if needed; key_id may name it
+func (c *tenantCircuit) keyVersion(ctx context.Context, req ProofRequest) (*keyVersion, error) {
+	version := c.composition.Version()
+	switch {
+	case req.circuitVersion != "" && req.circuitVersion != version:
+		return nil, badRequest("proof: this registration is verified under circuit_version %q", version)
+	case req.curve() != circuit.Curve.String():
+		return nil, badRequest("curve: circuit %s is verified over %s only", version, circuit.Curve)
+	}
+	keys, keyID, keysErr := c.keys.get(ctx)
+	switch {
+	case keysErr != nil:
+		return nil, keysErr
+	case req.KeyID != "" && req.KeyID != keyID:
+		return nil, ErrKeyNotFound
+	}
+	return &keyVersion{ID: keyID, CircuitVersion: version, keys: keys}, nil
+}
+
+// tenantCircuitHandler describes a circuit a tenant is pinned to, or the canary, as circuitHandler does the configured one
+func (s *Server) tenantCircuitHandler(w http.ResponseWriter, r *http.Request, pinned *tenantCircuit) {
+	version, keyErr := pinned.keyVersion(r.Context(), ProofRequest{})
+	if keyErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error setting up circuit %s: %v", pinned.composition.Version(), keyErr))
+		return
+	}
+	keyHash, hashErr := verifier.KeyHash(version.keys.verifyingKey)
+	if hashErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error hashing verifying key: %v", hashErr))
+		return
+	}
+	backend := "groth16"
+	if s.cfg.MockProver {
+		backend = "mock"
+	}
+	s.writeCachedResponse(w, r, CircuitResponse{
+		Version:          version.CircuitVersion,
+		Composition:      pinned.composition,
+		Curve:            circuit.Curve.String(),
+		Curves:           []string{circuit.Curve.String()},
+		Backend:          backend,
+		Statement:        pinned.composition.Statement(),
+		Constraints:      version.keys.ccs.GetNbConstraints(),
+		PublicInputs:     pinned.composition.PublicInputs(),
+		KeyID:            version.ID,
+		VerifyingKeyHash: keyHash,
+		Mock:             s.cfg.MockProver,
+		KDFs:             s.kdfRegistry(),
+	})
+}
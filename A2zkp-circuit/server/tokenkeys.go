@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retiredSigner is a token signing key that signing_key no longer names, kept so the tokens it
+// signed keep verifying
+type retiredSigner struct {
+	signer *tokenSigner
+	until  time.Time // until is when its tokens have all expired; zero for previous_signing_keys, kept until removed
+}
+
+// tokenKeys holds the key issued JWTs are signed with and the previous ones still verifying them,
+// all published at /.well-known/jwks.json. Changing signing_key and reloading rotates the current
+// key; the one it replaces stays published until the longest-lived token it could have signed expires.
+type tokenKeys struct {
+	mu       sync.RWMutex
+	current  *tokenSigner
+	keyRef   string // keyRef is the signing_key current was loaded from; empty for a derived or generated key
+	previous []retiredSigner
+	overlap  time.Duration // overlap is the lifetime of the longest-lived tokens the keys sign
+}
+
+// newTokenKeys starts with current, the key of keyRef, and the keys of previous_signing_keys
+func newTokenKeys(current *tokenSigner, keyRef string, previous []*tokenSigner, cfg Config) *tokenKeys {
+	keys := &tokenKeys{current: current, keyRef: keyRef, overlap: max(cfg.OIDC.TokenTTL.Duration, cfg.SessionTTL.Duration, cfg.Groups.TokenTTL.Duration)}
+	for _, signer := range previous {
+		keys.previous = append(keys.previous, retiredSigner{signer: signer})
+	}
+	return keys
+}
+
+// loadPreviousTokenSigners loads the keys of previous_signing_keys from the key provider
+func loadPreviousTokenSigners(ctx context.Context, cfg Config, provider KeyProvider) ([]*tokenSigner, error) {
+	if len(cfg.PreviousSigningKeys) > 0 && provider == nil {
+		return nil, fmt.Errorf("previous_signing_keys need a key_provider")
+	}
+	signers := make([]*tokenSigner, 0, len(cfg.PreviousSigningKeys))
+	for _, keyRef := range cfg.PreviousSigningKeys {
+		signer, signerErr := loadTokenSigner(ctx, provider, keyRef)
+		if signerErr != nil {
+			return nil, fmt.Errorf("loading previous signing key %s: %w", keyRef, signerErr)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// loadTokenSigner wraps the provider's key keyRef for signing tokens
+func loadTokenSigner(ctx context.Context, provider KeyProvider, keyRef string) (*tokenSigner, error) {
+	signer, signerErr := provider.Signer(ctx, keyRef)
+	if signerErr != nil {
+		return nil, signerErr
+	}
+	return newTokenSigner(signer)
+}
+
+// signer returns the current key
+func (k *tokenKeys) signer() *tokenSigner {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// sign serializes claims as a compact JWS signed with the current key
+func (k *tokenKeys) sign(typ string, claims any) (string, error) {
+	return k.signer().sign(typ, claims)
+}
+
+// signWithKeyID is sign with a caller-chosen "kid", such as a DID URL naming the key
+func (k *tokenKeys) signWithKeyID(typ, keyID string, claims any) (string, error) {
+	return k.signer().signWithKeyID(typ, keyID, claims)
+}
+
+// verify is tokenSigner.verify with whichever published key the token names
+func (k *tokenKeys) verify(token, typ, issuer string, claims any) error {
+	for _, signer := range k.published(time.Now()) {
+		if signer.verify(token, typ, issuer, claims) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidToken
+}
+
+// rotate makes next, loaded from keyRef, the current key
+func (k *tokenKeys) rotate(next *tokenSigner, keyRef string, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.previous = append(k.previous, retiredSigner{signer: k.current, until: now.Add(k.overlap)})
+	k.current, k.keyRef = next, keyRef
+}
+
+// rotateTokenKey makes the provider's key keyRef the current token signing key when signing_key
+// names another one than it did
+func (s *Server) rotateTokenKey(ctx context.Context, keyRef string) error {
+	s.tokens.mu.RLock()
+	unchanged := keyRef == s.tokens.keyRef
+	s.tokens.mu.RUnlock()
+	switch {
+	case unchanged:
+		return nil
+	case keyRef == "" || s.keyring.provider == nil:
+		log.Printf("Changing signing_key to a key outside a key_provider takes effect after a restart")
+		return nil
+	}
+	next, loadErr := loadTokenSigner(ctx, s.keyring.provider, keyRef)
+	if loadErr != nil {
+		return loadErr
+	}
+	previous := s.tokens.signer().keyID
+	s.tokens.rotate(next, keyRef, time.Now())
+	logf(ctx, "Token signing key rotated to %s; %s stays published for %s", next.keyID, previous, s.tokens.overlap)
+	return nil
+}
+
+// published lists the current key and the previous ones whose tokens may not have expired, current first
+func (k *tokenKeys) published(now time.Time) []*tokenSigner {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kept := k.previous[:0]
+	for _, retired := range k.previous {
+		if retired.until.IsZero() || now.Before(retired.until) {
+			kept = append(kept, retired)
+		}
+	}
+	k.previous = kept
+	signers := []*tokenSigner{k.current}
+	for i := len(kept) - 1; i >= 0; i-- {
+		signers = append(signers, kept[i].signer)
+	}
+	return signers
+}
+
+// jwks is the JWKS document of the published keys, current first
+func (k *tokenKeys) jwks() JSONWebKeySet {
+	signers := k.published(time.Now())
+	document := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(signers))}
+	for _, signer := range signers {
+		document.Keys = append(document.Keys, signer.jwk)
+	}
+	return document
+}
+
+// jwksHandler publishes the keys verifying issued tokens, at the OIDC jwks_uri and at
+// /.well-known/jwks.json for relying parties of session and group tokens
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeCachedResponse(w, r, s.tokens.jwks())
+}
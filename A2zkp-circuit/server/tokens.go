@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, not signed by this server, of the wrong type or expired
+var ErrInvalidToken = errors.New("invalid token")
+
+// tokenSigner signs and verifies the JWTs issued by the server with a single asymmetric key
+type tokenSigner struct {
+	signer crypto.Signer
+	alg    string      // alg is the JWS algorithm, ES256, ES384, RS256 or EdDSA
+	hash   crypto.Hash // hash is the digest the algorithm signs; 0 for EdDSA, which signs the input itself
+	keyID  string      // keyID is the RFC 7638 thumbprint of the public key, sent as "kid"
+	jwk    JSONWebKey
+}
+
+// JSONWebKey is the public half of the signing key as published in the JWKS document
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"` // Curve, X and Y describe an EC key; Curve and X an Ed25519 (OKP) one
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	Modulus   string `json:"n,omitempty"` // Modulus and Exponent describe an RSA key
+	Exponent  string `json:"e,omitempty"`
+}
+
+// registeredClaims are the JWT claims every token issued by the server carries
+type registeredClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// newTokenSigner wraps signer, usually the provider's signing_key. Without one an ECDSA P-256 key
+// is generated, so tokens stop verifying when the server restarts.
+func newTokenSigner(signer crypto.Signer) (*tokenSigner, error) {
+	if signer == nil {
+		generated, generateErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if generateErr != nil {
+			return nil, generateErr
+		}
+		signer = generated
+	}
+
+	t := &tokenSigner{signer: signer}
+	var thumbprintInput string
+	switch publicKey := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		t.jwk = JSONWebKey{
+			KeyType: "EC",
+			Curve:   publicKey.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size))),
+			Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size))),
+		}
+		switch t.jwk.Curve {
+		case "P-256":
+			t.alg, t.hash = "ES256", crypto.SHA256
+		case "P-384":
+			t.alg, t.hash = "ES384", crypto.SHA384
+		default:
+			return nil, fmt.Errorf("unsupported signing key curve %s", t.jwk.Curve)
+		}
+		thumbprintInput = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, t.jwk.Curve, t.jwk.X, t.jwk.Y)
+	case *rsa.PublicKey:
+		t.jwk = JSONWebKey{
+			KeyType:  "RSA",
+			Modulus:  base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}
+		t.alg, t.hash = "RS256", crypto.SHA256
+		thumbprintInput = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, t.jwk.Exponent, t.jwk.Modulus)
+	case ed25519.PublicKey:
+		t.jwk = JSONWebKey{KeyType: "OKP", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(publicKey)}
+		t.alg = "EdDSA"
+		thumbprintInput = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, t.jwk.X)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", publicKey)
+	}
+
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+	t.keyID = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	t.jwk.Use, t.jwk.Algorithm, t.jwk.KeyID = "sig", t.alg, t.keyID
+	return t, nil
+}
+
+// sign serializes claims as a compact JWS with the given "typ" header
+func (t *tokenSigner) sign(typ string, claims any) (string, error) {
+	return t.signWithKeyID(typ, t.keyID, claims)
+}
+
+// signWithKeyID is sign with a caller-chosen "kid", such as a DID URL naming the key
+func (t *tokenSigner) signWithKeyID(typ, keyID string, claims any) (string, error) {
+	header, headerErr := json.Marshal(map[string]string{"alg": t.alg, "typ": typ, "kid": keyID})
+	if headerErr != nil {
+		return "", headerErr
+	}
+	payload, payloadErr := json.Marshal(claims)
+	if payloadErr != nil {
+		return "", payloadErr
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := t.digest(signingInput)
+	signature, signErr := t.signer.Sign(rand.Reader, digest, t.hash)
+	if signErr != nil {
+		return "", fmt.Errorf("signing token: %w", signErr)
+	}
+	// JWS wants ECDSA signatures as fixed-size r||s rather than the ASN.1 DER crypto.Signer returns
+	if t.jwk.KeyType == "EC" {
+		var parsed struct{ R, S *big.Int }
+		if _, parseErr := asn1.Unmarshal(signature, &parsed); parseErr != nil {
+			return "", fmt.Errorf("decoding ECDSA signature: %w", parseErr)
+		}
+		size := len(digest)
+		signature = append(parsed.R.FillBytes(make([]byte, size)), parsed.S.FillBytes(make([]byte, size))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verify checks the signature, "typ", issuer and expiry of a token and decodes its payload into claims
+func (t *tokenSigner) verify(token, typ, issuer string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		Type      string `json:"typ"`
+		KeyID     string `json:"kid"`
+	}
+	headerJSON, headerErr := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, payloadErr := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(parts[2])
+	if headerErr != nil || payloadErr != nil || signatureErr != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return ErrInvalidToken
+	}
+	if header.Algorithm != t.alg || header.KeyID != t.keyID || header.Type != typ {
+		return ErrInvalidToken
+	}
+
+	digest := t.digest(parts[0] + "." + parts[1])
+	switch publicKey := t.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		if len(signature) != 2*len(digest) {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:len(digest)])
+		s := new(big.Int).SetBytes(signature[len(digest):])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return ErrInvalidToken
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(publicKey, t.hash, digest, signature) != nil {
+			return ErrInvalidToken
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, digest, signature) {
+			return ErrInvalidToken
+		}
+	}
+
+	var registered registeredClaims
+	if json.Unmarshal(payload, &registered) != nil {
+		return ErrInvalidToken
+	}
+	if registered.Issuer != issuer || time.Now().Unix() >= registered.ExpiresAt {
+		return ErrInvalidToken
+	}
+	if json.Unmarshal(payload, claims) != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// digest hashes the JWS signing input with the algorithm's hash, or returns it as is for EdDSA
+func (t *tokenSigner) digest(signingInput string) []byte {
+	if t.hash == 0 {
+		return []byte(signingInput)
+	}
+	h := t.hash.New()
+	h.Write([]byte(signingInput))
+	return h.Sum(nil)
+}
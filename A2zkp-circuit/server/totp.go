@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// TOTP policies of a tenant, set through totp.policy and totp.tenants
+const (
+	totpOff      = "off"      // totpOff never asks for a code, and enrolments are refused
+	totpEnrolled = "enrolled" // totpEnrolled asks users who confirmed an enrolment for a code
+	totpRequired = "required" // totpRequired also refuses the users who didn't
+)
+
+// The codes are those of RFC 6238's defaults, which every authenticator app supports
+const (
+	totpDigits      = 6
+	totpPeriod      = 30 // totpPeriod is the lifetime of a code in seconds
+	totpSecretBytes = 20 // totpSecretBytes is the HMAC-SHA1 key length RFC 4226 recommends
+	maxTOTPSkew     = 10
+)
+
+// ErrTOTPRequired is returned for a proof without a one-time code from a user who enrolled
+var ErrTOTPRequired = errors.New("a one-time code is required")
+
+// ErrTOTPInvalid is returned for a one-time code that is wrong, out of date or already used
+var ErrTOTPInvalid = errors.New("one-time code is wrong, expired or already used")
+
+// ErrTOTPEnrollmentRequired is returned for a proof from a user of a tenant requiring TOTP who
+// hasn't confirmed an enrolment
+var ErrTOTPEnrollmentRequired = errors.New("the tenant requires a TOTP enrolment")
+
+// totpEncoding is unpadded base32, the form authenticator apps take secrets in
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is the secret of a new enrolment, to load into an authenticator app. It is only
+// returned once; codes aren't asked for until one is confirmed.
+type TOTPEnrollment struct {
+	Secret    string `json:"secret"`    // Secret is the key in unpadded base32, for typing into an app
+	URI       string `json:"uri"`       // URI is the otpauth:// URI apps read from a QR code
+	Digits    int    `json:"digits"`    // Digits is the length of a code
+	Period    int    `json:"period"`    // Period is the lifetime of a code in seconds
+	Algorithm string `json:"algorithm"` // Algorithm is the HMAC hash, always SHA1
+}
+
+// TOTPStatus describes a user's TOTP enrolment
+type TOTPStatus struct {
+	UserName string `json:"user_name"`
+	Policy   string `json:"policy"` // Policy is the user's tenant's: off, enrolled or required
+	// Enrolled reports whether a confirmed enrolment makes the user's logins ask for a code
+	Enrolled    bool       `json:"enrolled"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`   // CreatedAt is when the secret was generated
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"` // ConfirmedAt is when a first code was checked
+}
+
+// TOTPConfirmRequest confirms an enrolment with the code the authenticator app shows
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// validateTOTPConfig checks the TOTP policies and skew
+func validateTOTPConfig(cfg TOTPConfig) error {
+	policies := map[string]string{"totp.policy": cfg.Policy}
+	for tenant, policy := range cfg.Tenants {
+		policies[fmt.Sprintf("totp.tenants[%q]", tenant)] = policy
+	}
+	for field, policy := range policies {
+		switch policy {
+		case "", totpOff, totpEnrolled, totpRequired:
+		default:
+			return fmt.Errorf("%s: unknown policy %q, want off, enrolled or required", field, policy)
+		}
+	}
+	if cfg.Skew < 0 || cfg.Skew > maxTOTPSkew {
+		return fmt.Errorf("totp.skew: must be between 0 and %d steps", maxTOTPSkew)
+	}
+	return nil
+}
+
+// policy is the TOTP policy of a tenant, "-" naming the default one in totp.tenants
+func (cfg TOTPConfig) policy(tenant string) string {
+	if tenant == "" {
+		tenant = "-"
+	}
+	policy, listed := cfg.Tenants[tenant]
+	if !listed {
+		policy = cfg.Policy
+	}
+	if policy == "" {
+		return totpOff
+	}
+	return policy
+}
+
+// totpCode is the RFC 6238 code of a key for a time step: the dynamically truncated HMAC-SHA1 of
+// the step, as RFC 4226 computes it from the counter
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// matchTOTP returns the time step within skew steps of now a code is for, which must come after
+// the step last accepted; false when there is none
+func matchTOTP(key []byte, code string, now time.Time, skew int, last int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - int64(skew); step <= current+int64(skew); step++ {
+		if step > last && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// validTOTPCode reports whether a code has the form of one: totpDigits decimal digits
+func validTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTOTP checks the one-time code sent with a proof that verified for a user, as the policy of
+// their tenant asks. The code's time step is recorded so the code can't log in twice, by a write
+// the store makes only if no other login recorded that step first, on this replica or another.
+func (s *Server) checkTOTP(ctx context.Context, req ProofRequest, userName, tenant string) error {
+	policy := s.cfg.TOTP.policy(tenant)
+	if policy == totpOff {
+		return nil
+	}
+	user, getErr := s.getUser(ctx, userName)
+	if getErr != nil {
+		return getErr
+	}
+	if user.TOTP == nil || user.TOTP.ConfirmedAt == nil {
+		if policy == totpRequired {
+			return ErrTOTPEnrollmentRequired
+		}
+		return nil
+	}
+	if req.TOTPCode == "" {
+		return ErrTOTPRequired
+	}
+	step, matched := matchTOTP(user.TOTP.Secret, req.TOTPCode, time.Now(), s.cfg.TOTP.Skew, user.TOTP.LastStep)
+	if !matched {
+		return ErrTOTPInvalid
+	}
+	advanceErr := s.store.AdvanceTOTPStep(ctx, userName, step)
+	if errors.Is(advanceErr, store.ErrTOTPStepUsed) {
+		return ErrTOTPInvalid
+	}
+	return advanceErr
+}
+
+// authorizeTOTP checks the caller may manage the TOTP enrolment of the user in the path, writing
+// the problem when not
+func (s *Server) authorizeTOTP(w http.ResponseWriter, r *http.Request) bool {
+	if !s.authorizedFor(r, r.PathValue("id")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Managing TOTP needs the admin token or a session token of that user")
+		return false
+	}
+	return true
+}
+
+// newTOTPStatus describes the enrolment of a user
+func (s *Server) newTOTPStatus(user store.User) TOTPStatus {
+	status := TOTPStatus{UserName: user.UserName, Policy: s.cfg.TOTP.policy(user.Tenant)}
+	if user.TOTP != nil {
+		createdAt := user.TOTP.CreatedAt
+		status.CreatedAt, status.ConfirmedAt, status.Enrolled = &createdAt, user.TOTP.ConfirmedAt, user.TOTP.ConfirmedAt != nil
+	}
+	return status
+}
+
+// totpStatusHandler reports whether a user enrolled and their tenant's policy
+func (s *Server) totpStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeTOTP(w, r) {
+		return
+	}
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	writeResponse(w, r, http.StatusOK, s.newTOTPStatus(user))
+}
+
+// enrollTOTPHandler generates a TOTP secret for a user. Logins don't ask for codes until one is
+// confirmed, and an unconfirmed secret is replaced by enrolling again; a confirmed one must be
+// removed first. In tenants requiring TOTP, where users can't log in before enrolling, an admin
+// enrolls them and hands the URI over.
+func (s *Server) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeTOTP(w, r) {
+		return
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if s.cfg.TOTP.policy(user.Tenant) == totpOff {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "TOTP is off for the user's tenant")
+		return
+	}
+	if user.TOTP != nil && user.TOTP.ConfirmedAt != nil {
+		writeProblem(w, http.StatusConflict, codeTOTPEnrolled, "The user already confirmed a TOTP enrolment; remove it first")
+		return
+	}
+	key := make([]byte, totpSecretBytes)
+	if _, randErr := rand.Read(key); randErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error generating the TOTP secret: %v", randErr))
+		return
+	}
+	user.TOTP = &store.TOTP{Secret: key, CreatedAt: time.Now().UTC()}
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing the TOTP enrolment: %v", putErr))
+		return
+	}
+
+	encoded := totpEncoding.EncodeToString(key)
+	query := url.Values{
+		"secret":    {encoded},
+		"issuer":    {s.cfg.TOTP.Issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + s.cfg.TOTP.Issuer + ":" + user.UserName, RawQuery: query.Encode()}
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, http.StatusCreated, TOTPEnrollment{Secret: encoded, URI: uri.String(), Digits: totpDigits, Period: totpPeriod, Algorithm: "SHA1"})
+}
+
+// confirmTOTPHandler confirms an enrolment with a code from the authenticator app, after which
+// logins ask for codes. The code itself can't then be used to log in.
+func (s *Server) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeTOTP(w, r) {
+		return
+	}
+	var req TOTPConfirmRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if !validTOTPCode(req.Code) {
+		writeRequestError(w, badRequest("code: must be %d digits", totpDigits))
+		return
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTP == nil {
+		writeProblem(w, http.StatusNotFound, codeTOTPNotEnrolled, "The user has no TOTP enrolment to confirm")
+		return
+	}
+	if user.TOTP.ConfirmedAt != nil {
+		writeProblem(w, http.StatusConflict, codeTOTPEnrolled, "The TOTP enrolment is already confirmed")
+		return
+	}
+	step, matched := matchTOTP(user.TOTP.Secret, req.Code, time.Now(), s.cfg.TOTP.Skew, user.TOTP.LastStep)
+	if !matched {
+		writeProblem(w, http.StatusUnprocessableEntity, codeTOTPInvalid, "The code doesn't match the enrolled secret; check the device's clock")
+		return
+	}
+	confirmedAt := time.Now().UTC()
+	totp := *user.TOTP
+	totp.ConfirmedAt, totp.LastStep = &confirmedAt, step
+	user.TOTP = &totp
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing the TOTP enrolment: %v", putErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, s.newTOTPStatus(user))
+}
+
+// removeTOTPHandler removes a user's enrolment, after which logins no longer ask for codes. In
+// tenants requiring TOTP only admins may, as the user couldn't log in afterwards.
+func (s *Server) removeTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeTOTP(w, r) {
+		return
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTP == nil {
+		writeProblem(w, http.StatusNotFound, codeTOTPNotEnrolled, "The user has no TOTP enrolment")
+		return
+	}
+	if s.cfg.TOTP.policy(user.Tenant) == totpRequired {
+		if p, known, _ := s.adminPrincipal(r); !known || !p.can(permManageUsers) {
+			writeProblem(w, http.StatusForbidden, codePermissionDenied, "The user's tenant requires TOTP; only an admin may remove the enrolment")
+			return
+		}
+	}
+	user.TOTP = nil
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error removing the TOTP enrolment: %v", putErr))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
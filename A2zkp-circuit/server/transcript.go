@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+	"A2zkp-circuit/verifier"
+)
+
+// transcriptInvalid is the verdict on a transcript whose proof no longer verifies; one that does
+// reads store.TranscriptValid
+const transcriptInvalid = "invalid"
+
+// transcriptCorrupt is the reason of an invalid transcript whose fields no longer decode
+const transcriptCorrupt = "transcript_corrupt"
+
+// transcriptInvalidEvent is the webhook event type announcing an InvalidTranscript
+const transcriptInvalidEvent = "transcript.invalid"
+
+// TranscriptList lists proof transcripts, oldest first
+type TranscriptList struct {
+	Transcripts []store.Transcript `json:"transcripts"`
+}
+
+// TranscriptVerification is the outcome of verifying a transcript's proof again against the public
+// inputs it recorded, under the key version it verified with
+type TranscriptVerification struct {
+	TranscriptID string `json:"transcript_id"`
+	Verdict      string `json:"verdict"` // Verdict is "valid" or "invalid"
+	// Reason is why an invalid proof failed: pairing_check_failed, proof_malformed or transcript_corrupt
+	Reason    string    `json:"reason,omitempty"`
+	KeyID     string    `json:"key_id"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// InvalidTranscript describes a transcript of an accepted proof that an audit found no longer
+// verifies, a sign that the keys or the store are corrupt
+type InvalidTranscript struct {
+	TranscriptVerification
+	UserName   string    `json:"user_name"`
+	Tenant     string    `json:"tenant,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"` // VerifiedAt is when the proof was accepted
+}
+
+// recordTranscript keeps the transcript of a proof authenticate accepted when transcripts are
+// enabled, with user.CryptoCommitment the commitment it matched under version. Transcripts past
+// the retention are pruned as new ones are recorded.
+func (s *Server) recordTranscript(ctx context.Context, req ProofRequest, user store.User, version *keyVersion, nonce *big.Int) error {
+	if !s.cfg.Transcripts.Enabled {
+		return nil
+	}
+	id, idErr := randomToken()
+	if idErr != nil {
+		return &requestError{status: http.StatusInternalServerError, code: codeInternal, message: "Error recording the proof transcript"}
+	}
+	now := time.Now().UTC()
+	transcript := store.Transcript{
+		ID:             id,
+		UserName:       user.UserName,
+		Tenant:         user.Tenant,
+		KeyID:          version.ID,
+		CircuitVersion: user.CircuitVersion,
+		Curve:          req.curve(),
+		Commitment:     user.CryptoCommitment,
+		Nonce:          nonce.String(),
+		Verdict:        store.TranscriptValid,
+		VerifiedAt:     now,
+	}
+	if req.SnarkJSProof != nil {
+		transcript.SnarkJSProof, _ = json.Marshal(req.SnarkJSProof)
+	} else {
+		transcript.Proof, transcript.ProofEncoding = req.Proof, req.proofEncoding()
+	}
+	if recordErr := s.store.RecordTranscript(ctx, transcript); recordErr != nil {
+		return &requestError{status: http.StatusInternalServerError, code: codeInternal, message: fmt.Sprintf("Error recording the proof transcript: %v", recordErr)}
+	}
+	if retention := s.cfg.Transcripts.Retention.Duration; retention > 0 {
+		if _, pruneErr := s.store.PruneTranscripts(ctx, now.Add(-retention)); pruneErr != nil {
+			logf(ctx, "Error pruning proof transcripts: %v", pruneErr)
+		}
+	}
+	return nil
+}
+
+// renameTranscripts moves the transcripts of the user name from to the user name to, returning
+// their IDs. They are recorded again under their own IDs, so a sealing store seals them for to.
+func (s *Server) renameTranscripts(ctx context.Context, from, to string) ([]string, error) {
+	transcripts, listErr := s.store.ListTranscripts(ctx, from, time.Time{}, time.Now().Add(time.Second))
+	if listErr != nil {
+		return nil, listErr
+	}
+	if _, deleteErr := s.store.DeleteUserTranscripts(ctx, from); deleteErr != nil {
+		return nil, deleteErr
+	}
+	ids := make([]string, 0, len(transcripts))
+	for _, transcript := range transcripts {
+		transcript.UserName = to
+		if recordErr := s.store.RecordTranscript(ctx, transcript); recordErr != nil {
+			return ids, fmt.Errorf("recording transcript %q again: %w", transcript.ID, recordErr)
+		}
+		ids = append(ids, transcript.ID)
+	}
+	return ids, nil
+}
+
+// listTranscriptsHandler lists the transcripts of a period, the last day by default, of one user
+// when user_name is given
+func (s *Server) listTranscriptsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to, toErr := parseStatsTime(query.Get("to"), time.Now().UTC())
+	from, fromErr := parseStatsTime(query.Get("from"), to.Add(-24*time.Hour))
+	var v validate.Validator
+	if userName := query.Get("user_name"); userName != "" {
+		v.UserID("user_name", userName)
+	}
+	switch {
+	case toErr != nil || fromErr != nil:
+		writeRequestError(w, badRequest("from and to must be RFC 3339 times"))
+		return
+	case !from.Before(to):
+		writeRequestError(w, badRequest("from must be before to"))
+		return
+	case v.Err() != nil:
+		writeRequestError(w, v.Err())
+		return
+	}
+	transcripts, listErr := s.store.ListTranscripts(r.Context(), query.Get("user_name"), from, to)
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading proof transcripts: %v", listErr))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, TranscriptList{Transcripts: transcripts})
+}
+
+// transcript loads the transcript the {id} of the path names, reporting a missing one
+func (s *Server) transcript(w http.ResponseWriter, r *http.Request) (store.Transcript, bool) {
+	transcript, getErr := s.store.GetTranscript(r.Context(), r.PathValue("id"))
+	switch {
+	case errors.Is(getErr, store.ErrTranscriptNotFound):
+		writeProblem(w, http.StatusNotFound, codeTranscriptNotFound, fmt.Sprintf("No proof transcript %q", r.PathValue("id")))
+		return store.Transcript{}, false
+	case getErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading proof transcript: %v", getErr))
+		return store.Transcript{}, false
+	}
+	return transcript, true
+}
+
+// getTranscriptHandler downloads a transcript as a file
+func (s *Server) getTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	transcript, found := s.transcript(w, r)
+	if !found {
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "ofa-transcript-"+transcript.ID+".json"))
+	writeResponse(w, r, http.StatusOK, transcript)
+}
+
+// verifyTranscriptHandler runs the pairing check of a transcript's proof again, against the
+// commitment and nonce it recorded and the key version it verified under, which has to be one the
+// server still holds. Nothing is consumed or cached, so each call checks the proof afresh.
+func (s *Server) verifyTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	transcript, found := s.transcript(w, r)
+	if !found {
+		return
+	}
+	result, verifyErr := s.reverifyTranscript(r.Context(), transcript)
+	switch {
+	case errors.Is(verifyErr, ErrPoolBusy):
+		writeBusy(w, s.cfg.PoolRetryAfter.Duration)
+		return
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		writeProblem(w, http.StatusServiceUnavailable, codeTimeout, "Request cancelled")
+		return
+	case verifyErr != nil:
+		writeProblem(w, http.StatusConflict, keyProblemCode(verifyErr), fmt.Sprintf("Key version %q the proof verified under: %v", transcript.KeyID, verifyErr))
+		return
+	}
+	logf(r.Context(), "Verified proof transcript %s of %q again: %s", transcript.ID, transcript.UserName, result.Verdict)
+	writeResponse(w, r, http.StatusOK, result)
+}
+
+// reverifyTranscript checks a transcript's proof again on the worker pool. A transcript whose
+// nonce or snarkjs proof no longer decodes is invalid for transcriptCorrupt. It fails with the
+// key lookup's error when the server no longer holds the key version, with ErrPoolBusy when the
+// queue is full, and when ctx ends.
+func (s *Server) reverifyTranscript(ctx context.Context, transcript store.Transcript) (TranscriptVerification, error) {
+	result := TranscriptVerification{TranscriptID: transcript.ID, Verdict: store.TranscriptValid, KeyID: transcript.KeyID}
+	nonce, nonceOK := new(big.Int).SetString(transcript.Nonce, 10)
+	req := ProofRequest{
+		UserName:      transcript.UserName,
+		KeyID:         transcript.KeyID,
+		Curve:         transcript.Curve,
+		Proof:         transcript.Proof,
+		ProofEncoding: transcript.ProofEncoding,
+	}
+	var decodeErr error
+	if len(transcript.SnarkJSProof) > 0 {
+		req.SnarkJSProof = &verifier.SnarkJSProof{}
+		decodeErr = json.Unmarshal(transcript.SnarkJSProof, req.SnarkJSProof)
+	}
+	if !nonceOK || decodeErr != nil {
+		result.Verdict, result.Reason, result.CheckedAt = transcriptInvalid, transcriptCorrupt, time.Now().UTC()
+		return result, nil
+	}
+	user := store.User{UserName: transcript.UserName, Tenant: transcript.Tenant, CircuitVersion: transcript.CircuitVersion}
+	version, keyErr := s.proofKeyVersion(ctx, req, user)
+	if keyErr != nil {
+		return TranscriptVerification{}, keyErr
+	}
+
+	var verifyErr error
+	poolErr := s.pool.Do(ctx, func() {
+		inputs := verifier.PublicInputs{Commitment: transcript.Commitment, Nonce: nonce}
+		if req.SnarkJSProof != nil {
+			verifyErr = s.snarkJS.verifier.VerifyProof(ctx, *req.SnarkJSProof, inputs)
+		} else {
+			verifyErr = verifier.New(version.keys.verifyingKey).VerifyProof(ctx, req.Proof, inputs)
+		}
+	})
+	switch {
+	case poolErr != nil:
+		return TranscriptVerification{}, poolErr
+	case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+		return TranscriptVerification{}, verifyErr
+	}
+	result.KeyID, result.CheckedAt = version.ID, time.Now().UTC()
+	if verifyErr != nil {
+		result.Verdict, result.Reason = transcriptInvalid, failureReason(invalidProof(verifyErr))
+	}
+	return result, nil
+}
+
+// auditTranscripts verifies a random sample of audit_sample stored transcripts again, logging and
+// reporting to the webhooks each that no longer verifies, and returns those. Transcripts whose key
+// version the server no longer holds are skipped. Verifications yield to logins, waiting out a
+// full worker pool.
+func (s *Server) auditTranscripts(ctx context.Context) ([]InvalidTranscript, error) {
+	transcripts, listErr := s.store.ListTranscripts(ctx, "", time.Time{}, time.Now())
+	if listErr != nil {
+		return nil, fmt.Errorf("listing transcripts: %w", listErr)
+	}
+	sample, sampleErr := sampleTranscripts(transcripts, s.cfg.Transcripts.AuditSample)
+	if sampleErr != nil {
+		return nil, sampleErr
+	}
+	var invalid []InvalidTranscript
+	for _, transcript := range sample {
+		result, verifyErr := s.reverifyTranscript(ctx, transcript)
+		for errors.Is(verifyErr, ErrPoolBusy) {
+			select {
+			case <-ctx.Done():
+				return invalid, ctx.Err()
+			case <-time.After(s.cfg.PoolRetryAfter.Duration):
+			}
+			result, verifyErr = s.reverifyTranscript(ctx, transcript)
+		}
+		switch {
+		case errors.Is(verifyErr, context.Canceled) || errors.Is(verifyErr, context.DeadlineExceeded):
+			return invalid, verifyErr
+		case verifyErr != nil:
+			s.metrics.observeTranscriptAudit("skipped")
+			continue
+		}
+		s.metrics.observeTranscriptAudit(result.Verdict)
+		if result.Verdict == store.TranscriptValid {
+			continue
+		}
+		found := InvalidTranscript{TranscriptVerification: result, UserName: transcript.UserName, Tenant: transcript.Tenant, VerifiedAt: transcript.VerifiedAt}
+		logf(ctx, "Proof transcript %s of %q, accepted at %s, no longer verifies: %s", transcript.ID, transcript.UserName, transcript.VerifiedAt.Format(time.RFC3339), result.Reason)
+		s.webhooks.publish(ctx, transcriptInvalidEvent, found)
+		invalid = append(invalid, found)
+	}
+	return invalid, nil
+}
+
+// sampleTranscripts picks size transcripts at random, or returns all of them when there are no more
+func sampleTranscripts(transcripts []store.Transcript, size int) ([]store.Transcript, error) {
+	if size <= 0 || len(transcripts) <= size {
+		return transcripts, nil
+	}
+	// A partial Fisher-Yates shuffle moves the sample to the front
+	for i := range size {
+		pick, randErr := rand.Int(rand.Reader, big.NewInt(int64(len(transcripts)-i)))
+		if randErr != nil {
+			return nil, randErr
+		}
+		j := i + int(pick.Int64())
+		transcripts[i], transcripts[j] = transcripts[j], transcripts[i]
+	}
+	return transcripts[:size], nil
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// usageDayLayout is how usage records and the from and to of their export name days
+const usageDayLayout = "2006-01-02"
+
+// maxUsageExportDays bounds the period of a usage export
+const maxUsageExportDays = 366
+
+// usageColumns are the columns of a CSV export of GET /admin/usage/records, in order
+var usageColumns = []string{"day", "api_key_id", "tenant", "requests"}
+
+// usageMeter counts the requests made with API keys and holds them to the keys' quotas. Each day
+// is counted in the store, so replicas sharing it share the counts; the meter only keeps the
+// month's usage up to the start of the day, which no longer changes, to check monthly quotas with.
+type usageMeter struct {
+	store store.Store
+
+	mu     sync.Mutex
+	day    time.Time        // day is the UTC day before is as of
+	before map[string]int64 // before is the usage of each key this month before day
+}
+
+// newUsageMeter creates a meter counting in st
+func newUsageMeter(st store.Store) *usageMeter {
+	return &usageMeter{store: st}
+}
+
+// monthBefore is the usage of a key in the month of day, up to the start of day
+func (m *usageMeter) monthBefore(ctx context.Context, keyID string, day time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.day.Equal(day) {
+		month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		usage, listErr := m.store.ListUsage(ctx, month, day)
+		if listErr != nil {
+			return 0, listErr
+		}
+		m.day, m.before = day, make(map[string]int64)
+		for _, record := range usage {
+			m.before[record.APIKeyID] += record.Requests
+		}
+	}
+	return m.before[keyID], nil
+}
+
+// quotaError is a request refused for exceeding a quota of its API key, until retryAfter passes
+type quotaError struct {
+	period     string
+	quota      int64
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("The API key's %s quota of %d requests is used up", e.period, e.quota)
+}
+
+// meter counts a request made by an API key principal. A request over one of the key's quotas is
+// refused with a quotaError and not counted.
+func (m *usageMeter) meter(ctx context.Context, p principal, now time.Time) error {
+	day := store.UsageDay(now)
+	usage, addErr := m.store.AddUsage(ctx, p.keyID, p.tenant, day, 1)
+	if addErr != nil {
+		return addErr
+	}
+	var refused *quotaError
+	switch {
+	case p.dailyQuota > 0 && usage.Requests > p.dailyQuota:
+		refused = &quotaError{period: "daily", quota: p.dailyQuota, retryAfter: day.AddDate(0, 0, 1).Sub(now)}
+	case p.monthlyQuota > 0:
+		before, monthErr := m.monthBefore(ctx, p.keyID, day)
+		if monthErr != nil {
+			return monthErr
+		}
+		if before+usage.Requests > p.monthlyQuota {
+			nextMonth := time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			refused = &quotaError{period: "monthly", quota: p.monthlyQuota, retryAfter: nextMonth.Sub(now)}
+		}
+	}
+	if refused == nil {
+		return nil
+	}
+	if _, undoErr := m.store.AddUsage(ctx, p.keyID, p.tenant, day, -1); undoErr != nil {
+		return undoErr
+	}
+	return refused
+}
+
+// writeMeterError answers a request meter refused or failed to count
+func writeMeterError(w http.ResponseWriter, meterErr error) {
+	var refused *quotaError
+	if errors.As(meterErr, &refused) {
+		w.Header().Set("Retry-After", retryAfterSeconds(refused.retryAfter))
+		writeProblem(w, http.StatusTooManyRequests, codeQuotaExceeded, refused.Error())
+		return
+	}
+	writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error metering API key usage: %v", meterErr))
+}
+
+// QuotaRequest sets the quotas of an API key; 0 leaves a period unbounded
+type QuotaRequest struct {
+	DailyQuota   int64 `json:"daily_quota"`
+	MonthlyQuota int64 `json:"monthly_quota"`
+}
+
+// validate checks that the quotas aren't negative
+func (req QuotaRequest) validate() error {
+	var v validate.Validator
+	if req.DailyQuota < 0 {
+		v.Fail("daily_quota", "must not be negative")
+	}
+	if req.MonthlyQuota < 0 {
+		v.Fail("monthly_quota", "must not be negative")
+	}
+	return v.Err()
+}
+
+// setQuotaHandler replaces the quotas of an API key. The change applies to the next request made
+// with the key, counting what it already used today and this month.
+func (s *Server) setQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	var req QuotaRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	if validateErr := req.validate(); validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	key, getErr := s.store.GetAPIKey(r.Context(), r.PathValue("id"))
+	switch {
+	case errors.Is(getErr, store.ErrAPIKeyNotFound):
+		writeProblem(w, http.StatusNotFound, codeAPIKeyNotFound, "Unknown API key")
+		return
+	case getErr != nil:
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error loading API key: %v", getErr))
+		return
+	}
+	key.DailyQuota, key.MonthlyQuota, key.UpdatedAt = req.DailyQuota, req.MonthlyQuota, time.Now().UTC()
+	if putErr := s.store.PutAPIKey(r.Context(), key); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing API key: %v", putErr))
+		return
+	}
+	logf(r.Context(), "Set the quotas of API key %s to %d a day and %d a month", key.ID, key.DailyQuota, key.MonthlyQuota)
+	writeResponse(w, r, http.StatusOK, newAPIKeyResponse(key))
+}
+
+// KeyUsage is the usage of an API key today and this month, UTC, against its quotas
+type KeyUsage struct {
+	APIKeyID     string `json:"api_key_id"`
+	Name         string `json:"name"`
+	Tenant       string `json:"tenant,omitempty"`
+	Daily        int64  `json:"daily"`
+	DailyQuota   int64  `json:"daily_quota,omitempty"` // DailyQuota is omitted for a key without one
+	Monthly      int64  `json:"monthly"`
+	MonthlyQuota int64  `json:"monthly_quota,omitempty"` // MonthlyQuota is omitted for a key without one
+}
+
+// UsageResponse is the response of GET /admin/usage
+type UsageResponse struct {
+	Day  string     `json:"day"` // Day is the UTC day the daily usage is of
+	Keys []KeyUsage `json:"keys"`
+}
+
+// usageHandler reports the usage of each API key today and this month. A tenant-admin only sees
+// the keys of its own tenant, whatever it asks for.
+func (s *Server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		query.Set("tenant", p.tenant)
+	}
+	keys, listErr := s.store.ListAPIKeys(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing API keys: %v", listErr))
+		return
+	}
+	day := store.UsageDay(time.Now())
+	month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	usage, usageErr := s.store.ListUsage(r.Context(), month, day.AddDate(0, 0, 1))
+	if usageErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading usage: %v", usageErr))
+		return
+	}
+	daily, monthly := make(map[string]int64), make(map[string]int64)
+	for _, record := range usage {
+		monthly[record.APIKeyID] += record.Requests
+		if record.Day.Equal(day) {
+			daily[record.APIKeyID] = record.Requests
+		}
+	}
+
+	response := UsageResponse{Day: day.Format(usageDayLayout), Keys: []KeyUsage{}}
+	for _, key := range keys {
+		if tenant := query.Get("tenant"); query.Has("tenant") && key.Tenant != tenant {
+			continue
+		}
+		response.Keys = append(response.Keys, KeyUsage{
+			APIKeyID:     key.ID,
+			Name:         key.Name,
+			Tenant:       key.Tenant,
+			Daily:        daily[key.ID],
+			DailyQuota:   key.DailyQuota,
+			Monthly:      monthly[key.ID],
+			MonthlyQuota: key.MonthlyQuota,
+		})
+	}
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// UsageRecord is the usage of an API key on one UTC day, the unit of a billing export
+type UsageRecord struct {
+	Day      string `json:"day"`
+	APIKeyID string `json:"api_key_id"`
+	Tenant   string `json:"tenant,omitempty"`
+	Requests int64  `json:"requests"`
+}
+
+// UsageRecords is the response of GET /admin/usage/records
+type UsageRecords struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"` // To is the day after the last one included
+	Records []UsageRecord `json:"records"`
+}
+
+// record is the row of a CSV export describing the usage
+func (u UsageRecord) record() []string {
+	return []string{u.Day, u.APIKeyID, u.Tenant, strconv.FormatInt(u.Requests, 10)}
+}
+
+// parseUsageDay parses a day of a usage export, which falls back to fallback when empty
+func parseUsageDay(text string, fallback time.Time) (time.Time, error) {
+	if text == "" {
+		return fallback, nil
+	}
+	return time.Parse(usageDayLayout, text)
+}
+
+// usageRecordsHandler exports the daily usage records of the API keys from ?from= up to but
+// excluding ?to=, by default this month so far, for billing. ?export=csv or ?export=json downloads
+// them as a file instead. A tenant-admin only sees its own tenant, whatever it asks for.
+func (s *Server) usageRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		query.Set("tenant", p.tenant)
+	}
+	today := store.UsageDay(time.Now())
+	to, toErr := parseUsageDay(query.Get("to"), today.AddDate(0, 0, 1))
+	from, fromErr := parseUsageDay(query.Get("from"), time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC))
+	export := query.Get("export")
+	switch {
+	case toErr != nil || fromErr != nil:
+		writeRequestError(w, badRequest("from and to must be days, e.g. 2024-05-01"))
+		return
+	case !from.Before(to):
+		writeRequestError(w, badRequest("from must be before to"))
+		return
+	case to.Sub(from) > maxUsageExportDays*24*time.Hour:
+		writeRequestError(w, badRequest("The period spans more than %d days", maxUsageExportDays))
+		return
+	case export != "" && export != "csv" && export != "json":
+		writeRequestError(w, badRequest("export must be csv or json"))
+		return
+	}
+
+	usage, listErr := s.store.ListUsage(r.Context(), from, to)
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading usage: %v", listErr))
+		return
+	}
+	response := UsageRecords{From: from.Format(usageDayLayout), To: to.Format(usageDayLayout), Records: []UsageRecord{}}
+	for _, record := range usage {
+		if tenant := query.Get("tenant"); query.Has("tenant") && record.Tenant != tenant {
+			continue
+		}
+		response.Records = append(response.Records, UsageRecord{
+			Day:      record.Day.Format(usageDayLayout),
+			APIKeyID: record.APIKeyID,
+			Tenant:   record.Tenant,
+			Requests: record.Requests,
+		})
+	}
+
+	filename := fmt.Sprintf("ofa-usage-%s-%s", response.From, response.To)
+	switch export {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+		writer := csv.NewWriter(w)
+		writer.Write(usageColumns)
+		for _, record := range response.Records {
+			writer.Write(record.record())
+		}
+		writer.Flush()
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		json.NewEncoder(w).Encode(response.Records)
+	default:
+		writeResponse(w, r, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"A2zkp-circuit/store"
+)
+
+// Page sizes of GET /admin/users
+const (
+	defaultUserPageSize = 100
+	maxUserPageSize     = 1000
+)
+
+// userColumns are the columns of a CSV export of GET /admin/users, in order
+var userColumns = []string{
+	"user_name", "tenant", "created_at", "circuit_version", "curve", "key_id", "devices",
+	"expires_at", "deleted_at", "revoked", "locked", "pending", "totp", "webauthn",
+}
+
+// UserSummary describes a registration for audits, without its commitments or any other secret material
+type UserSummary struct {
+	UserName       string     `json:"user_name"`
+	Tenant         string     `json:"tenant,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CircuitVersion string     `json:"circuit_version,omitempty"` // CircuitVersion is empty for a pending user
+	Curve          string     `json:"curve,omitempty"`
+	KeyID          string     `json:"key_id,omitempty"`
+	Devices        int        `json:"devices"` // Devices counts the active device commitments besides the first one
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	// DeletedAt is when the user was soft-deleted; the registration is purged once deletion_retention passes
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Revoked is true once the registration stopped verifying: it expired, or was deactivated with SCIM
+	Revoked bool `json:"revoked"`
+	// Locked is true while a brute_force anomaly detected for the user is within the anomaly window
+	Locked   bool `json:"locked"`
+	Pending  bool `json:"pending"`  // Pending is true for an imported user who hasn't migrated yet
+	TOTP     bool `json:"totp"`     // TOTP is true once the user confirmed a TOTP enrollment
+	WebAuthn bool `json:"webauthn"` // WebAuthn is true when a hardware key is bound to the registration
+}
+
+// UserPage is the response of GET /admin/users: one page of the matching users, by user name
+type UserPage struct {
+	Users []UserSummary `json:"users"`
+	// NextCursor continues the listing after this page as ?cursor=; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// userFilter selects the users of a listing
+type userFilter struct {
+	tenant        *string // tenant is nil to list every tenant
+	createdAfter  time.Time
+	createdBefore time.Time
+	revoked       *bool
+	locked        *bool
+	deleted       *bool
+}
+
+// parseUserFilter reads the filters of a listing from its query
+func parseUserFilter(query url.Values) (userFilter, error) {
+	var filter userFilter
+	if query.Has("tenant") {
+		tenant := query.Get("tenant")
+		filter.tenant = &tenant
+	}
+	for name, at := range map[string]*time.Time{"created_after": &filter.createdAfter, "created_before": &filter.createdBefore} {
+		if text := query.Get(name); text != "" {
+			parsed, parseErr := time.Parse(time.RFC3339, text)
+			if parseErr != nil {
+				return filter, badRequest("%s must be an RFC 3339 time", name)
+			}
+			*at = parsed
+		}
+	}
+	if !filter.createdAfter.IsZero() && !filter.createdBefore.IsZero() && !filter.createdAfter.Before(filter.createdBefore) {
+		return filter, badRequest("created_after must be before created_before")
+	}
+	for name, flag := range map[string]**bool{"revoked": &filter.revoked, "locked": &filter.locked, "deleted": &filter.deleted} {
+		if text := query.Get(name); text != "" {
+			parsed, parseErr := strconv.ParseBool(text)
+			if parseErr != nil {
+				return filter, badRequest("%s must be true or false", name)
+			}
+			*flag = &parsed
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether the filter selects a user
+func (f userFilter) matches(summary UserSummary) bool {
+	switch {
+	case f.tenant != nil && summary.Tenant != *f.tenant:
+		return false
+	case !f.createdAfter.IsZero() && summary.CreatedAt.Before(f.createdAfter):
+		return false
+	case !f.createdBefore.IsZero() && !summary.CreatedAt.Before(f.createdBefore):
+		return false
+	case f.revoked != nil && summary.Revoked != *f.revoked:
+		return false
+	case f.locked != nil && summary.Locked != *f.locked:
+		return false
+	case f.deleted != nil && (summary.DeletedAt != nil) != *f.deleted:
+		return false
+	}
+	return true
+}
+
+// newUserSummary describes a stored registration
+func newUserSummary(user store.User, now time.Time, locked bool) UserSummary {
+	summary := UserSummary{
+		UserName:       user.UserName,
+		Tenant:         user.Tenant,
+		CreatedAt:      user.CreatedAt,
+		CircuitVersion: user.CircuitVersion,
+		Curve:          user.Curve,
+		KeyID:          user.KeyID,
+		ExpiresAt:      user.ExpiresAt,
+		DeletedAt:      user.DeletedAt,
+		Revoked:        user.Expired(now),
+		Locked:         locked,
+		Pending:        user.Pending(),
+		TOTP:           user.TOTP != nil && user.TOTP.ConfirmedAt != nil,
+		WebAuthn:       user.WebAuthn != nil,
+	}
+	for _, device := range user.Devices {
+		if device.RevokedAt == nil {
+			summary.Devices++
+		}
+	}
+	return summary
+}
+
+// record is the row of a CSV export describing the user
+func (u UserSummary) record() []string {
+	optionalTime := func(at *time.Time) string {
+		if at == nil {
+			return ""
+		}
+		return at.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		u.UserName, u.Tenant, u.CreatedAt.UTC().Format(time.RFC3339), u.CircuitVersion, u.Curve, u.KeyID,
+		strconv.Itoa(u.Devices), optionalTime(u.ExpiresAt), optionalTime(u.DeletedAt), strconv.FormatBool(u.Revoked),
+		strconv.FormatBool(u.Locked), strconv.FormatBool(u.Pending), strconv.FormatBool(u.TOTP), strconv.FormatBool(u.WebAuthn),
+	}
+}
+
+// lockedUsers are the users with a brute_force anomaly detected within the anomaly window
+func (s *Server) lockedUsers(ctx context.Context, now time.Time) (map[string]bool, error) {
+	locked := make(map[string]bool)
+	if s.anomalies == nil {
+		return locked, nil
+	}
+	anomalies, listErr := s.anomalies.list(ctx)
+	if listErr != nil {
+		return nil, listErr
+	}
+	since := now.Add(-s.cfg.Anomalies.Window.Duration)
+	for _, anomaly := range anomalies {
+		if anomaly.Kind == "brute_force" && anomaly.DetectedAt.After(since) {
+			locked[anomaly.UserName] = true
+		}
+	}
+	return locked, nil
+}
+
+// encodeUserCursor is the cursor continuing a listing after a user name
+func encodeUserCursor(userName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(userName))
+}
+
+// listUsersHandler lists the registered users, soft-deleted ones included, filtered by tenant,
+// creation time, revocation, lockout and deletion, a page of up to ?limit= at a time. ?export=csv
+// or ?export=json instead downloads every matching user at once. A tenant-admin only sees its own
+// tenant, whatever it asks for.
+func (s *Server) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if p := requestPrincipal(r); p.role == RoleTenantAdmin {
+		query.Set("tenant", p.tenant)
+	}
+	filter, filterErr := parseUserFilter(query)
+	if filterErr != nil {
+		writeRequestError(w, filterErr)
+		return
+	}
+	export := query.Get("export")
+	if export != "" && export != "csv" && export != "json" {
+		writeRequestError(w, badRequest("export must be csv or json"))
+		return
+	}
+	limit := defaultUserPageSize
+	if text := query.Get("limit"); text != "" {
+		parsed, parseErr := strconv.Atoi(text)
+		if parseErr != nil || parsed < 1 || parsed > maxUserPageSize {
+			writeRequestError(w, badRequest("limit must be between 1 and %d", maxUserPageSize))
+			return
+		}
+		limit = parsed
+	}
+	var after string
+	if cursor := query.Get("cursor"); cursor != "" {
+		decoded, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+		if decodeErr != nil {
+			writeRequestError(w, badRequest("cursor is not one a listing returned"))
+			return
+		}
+		after = string(decoded)
+	}
+
+	users, listErr := s.store.ListUsers(r.Context())
+	if listErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing users: %v", listErr))
+		return
+	}
+	now := time.Now()
+	locked, lockedErr := s.lockedUsers(r.Context(), now)
+	if lockedErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error listing anomalies: %v", lockedErr))
+		return
+	}
+
+	page := UserPage{Users: []UserSummary{}}
+	for _, user := range users {
+		if export == "" && user.UserName <= after {
+			continue
+		}
+		summary := newUserSummary(user, now, locked[user.UserName])
+		if !filter.matches(summary) {
+			continue
+		}
+		if export == "" && len(page.Users) == limit {
+			page.NextCursor = encodeUserCursor(page.Users[limit-1].UserName)
+			break
+		}
+		page.Users = append(page.Users, summary)
+	}
+
+	switch export {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"ofa-users.csv\"")
+		writer := csv.NewWriter(w)
+		writer.Write(userColumns)
+		for _, summary := range page.Users {
+			writer.Write(summary.record())
+		}
+		writer.Flush()
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"ofa-users.json\"")
+		json.NewEncoder(w).Encode(page.Users)
+	default:
+		writeResponse(w, r, http.StatusOK, page)
+	}
+}
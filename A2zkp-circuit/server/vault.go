@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// vaultRefPrefix marks a configuration value to be read from Vault KV v2, as "vault:<mount>/<path>#<field>"
+const vaultRefPrefix = "vault:"
+
+// VaultConfig selects the Vault server and how to authenticate to it. Either a token
+// (preferably $VAULT_TOKEN) or an AppRole role_id with $VAULT_SECRET_ID is required.
+type VaultConfig struct {
+	Address      string `json:"address"`       // Address is the Vault base URL; defaults to $VAULT_ADDR
+	Token        string `json:"token"`         // Token is a Vault token; prefer $VAULT_TOKEN
+	RoleID       string `json:"role_id"`       // RoleID enables AppRole login together with SecretID
+	SecretID     string `json:"secret_id"`     // SecretID is the AppRole secret; prefer $VAULT_SECRET_ID
+	AppRolePath  string `json:"approle_path"`  // AppRolePath is the AppRole auth mount, "approle" by default
+	TransitMount string `json:"transit_mount"` // TransitMount is the transit engine mount, "transit" by default
+	TransitKey   string `json:"transit_key"`   // TransitKey wraps data keys for key_provider "vault-transit"
+	// ArtifactsPath is a KV v2 secret, as "<mount>/<path>", whose fields hold base64 circuit artifacts
+	// named like the keygen output files ("verifying.key", "circuit.r1cs", ...)
+	ArtifactsPath string `json:"artifacts_path"`
+}
+
+// enabled reports whether a Vault server is configured
+func (c VaultConfig) enabled() bool {
+	return c.Address != ""
+}
+
+// vaultClient talks to the Vault HTTP API and keeps its token and any secret leases alive
+type vaultClient struct {
+	cfg        VaultConfig
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	token    string
+	tokenTTL time.Duration
+	leases   map[string]time.Duration // leases maps renewable lease IDs to their last granted duration
+}
+
+// newVaultClient authenticates to Vault with the configured token or AppRole credentials
+func newVaultClient(ctx context.Context, cfg VaultConfig) (*vaultClient, error) {
+	if cfg.AppRolePath == "" {
+		cfg.AppRolePath = "approle"
+	}
+	if cfg.TransitMount == "" {
+		cfg.TransitMount = "transit"
+	}
+	client := &vaultClient{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		token:      cfg.Token,
+		leases:     make(map[string]time.Duration),
+	}
+
+	if cfg.RoleID != "" {
+		if loginErr := client.login(ctx); loginErr != nil {
+			return nil, loginErr
+		}
+		return client, nil
+	}
+	if client.token == "" {
+		return nil, errors.New("vault needs a token or an AppRole role_id and secret_id")
+	}
+	// Look the token up so a bad one fails at startup and its TTL is known for renewal
+	var lookup struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	if lookupErr := client.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &lookup); lookupErr != nil {
+		return nil, fmt.Errorf("vault token lookup: %w", lookupErr)
+	}
+	if lookup.Data.Renewable {
+		client.tokenTTL = time.Duration(lookup.Data.TTL) * time.Second
+	}
+	return client, nil
+}
+
+// login exchanges AppRole credentials for a token
+func (v *vaultClient) login(ctx context.Context) error {
+	var resp vaultAuthResponse
+	body := map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	if loginErr := v.do(ctx, http.MethodPost, "auth/"+v.cfg.AppRolePath+"/login", body, &resp); loginErr != nil {
+		return fmt.Errorf("vault approle login: %w", loginErr)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = resp.Auth.ClientToken
+	v.tokenTTL = 0
+	if resp.Auth.Renewable {
+		v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+	}
+	return nil
+}
+
+// vaultAuthResponse is the auth block returned by logins and token renewals
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// readKV reads the latest version of a KV v2 secret given as "<mount>/<path>"
+func (v *vaultClient) readKV(ctx context.Context, mountPath string) (map[string]any, error) {
+	mount, path, found := strings.Cut(mountPath, "/")
+	if !found || path == "" {
+		return nil, fmt.Errorf("vault path %q must be <mount>/<path>", mountPath)
+	}
+	var resp struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if readErr := v.do(ctx, http.MethodGet, mount+"/data/"+path, nil, &resp); readErr != nil {
+		return nil, fmt.Errorf("reading vault secret %s: %w", mountPath, readErr)
+	}
+	// KV secrets carry no lease, but mounts serving dynamic credentials do; track those for renewal
+	if resp.LeaseID != "" && resp.Renewable {
+		v.mu.Lock()
+		v.leases[resp.LeaseID] = time.Duration(resp.LeaseDuration) * time.Second
+		v.mu.Unlock()
+	}
+	return resp.Data.Data, nil
+}
+
+// readField resolves a "vault:<mount>/<path>#<field>" reference to its string value
+func (v *vaultClient) readField(ctx context.Context, reference string) (string, error) {
+	mountPath, field, found := strings.Cut(strings.TrimPrefix(reference, vaultRefPrefix), "#")
+	if !found || field == "" {
+		return "", fmt.Errorf("vault reference %q must be vault:<mount>/<path>#<field>", reference)
+	}
+	data, readErr := v.readKV(ctx, mountPath)
+	if readErr != nil {
+		return "", readErr
+	}
+	value, isString := data[field].(string)
+	if !isString {
+		return "", fmt.Errorf("vault secret %s has no string field %q", mountPath, field)
+	}
+	return value, nil
+}
+
+// keepAlive renews the token and tracked leases at two thirds of their duration until ctx ends.
+// A token that can no longer be renewed is replaced by logging in again when AppRole is configured.
+func (v *vaultClient) keepAlive(ctx context.Context) {
+	for {
+		v.mu.Lock()
+		wait := v.tokenTTL
+		for _, lease := range v.leases {
+			if wait == 0 || (lease > 0 && lease < wait) {
+				wait = lease
+			}
+		}
+		v.mu.Unlock()
+		if wait <= 0 {
+			return // nothing expires
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait * 2 / 3):
+		}
+		v.renew(ctx)
+	}
+}
+
+// renew extends the token and every tracked lease once
+func (v *vaultClient) renew(ctx context.Context) {
+	v.mu.Lock()
+	renewToken := v.tokenTTL > 0
+	leaseIDs := make([]string, 0, len(v.leases))
+	for id := range v.leases {
+		leaseIDs = append(leaseIDs, id)
+	}
+	v.mu.Unlock()
+
+	if renewToken {
+		var resp vaultAuthResponse
+		renewErr := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]any{}, &resp)
+		switch {
+		case renewErr == nil:
+			v.mu.Lock()
+			v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+			v.mu.Unlock()
+		case v.cfg.RoleID != "":
+			log.Printf("Renewing vault token failed, logging in again: %v", renewErr)
+			if loginErr := v.login(ctx); loginErr != nil {
+				log.Printf("Vault login failed: %v", loginErr)
+			}
+		default:
+			log.Printf("Renewing vault token failed: %v", renewErr)
+		}
+	}
+
+	for _, id := range leaseIDs {
+		var resp struct {
+			LeaseDuration int  `json:"lease_duration"`
+			Renewable     bool `json:"renewable"`
+		}
+		renewErr := v.do(ctx, http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": id}, &resp)
+		v.mu.Lock()
+		if renewErr != nil || !resp.Renewable {
+			log.Printf("Vault lease %s can no longer be renewed: %v", id, renewErr)
+			delete(v.leases, id)
+		} else {
+			v.leases[id] = time.Duration(resp.LeaseDuration) * time.Second
+		}
+		v.mu.Unlock()
+	}
+}
+
+// do sends one Vault API request with the current token and decodes the JSON response
+func (v *vaultClient) do(ctx context.Context, method, path string, body, response any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, encodeErr := json.Marshal(body)
+		if encodeErr != nil {
+			return encodeErr
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, method, strings.TrimRight(v.cfg.Address, "/")+"/v1/"+path, reader)
+	if reqErr != nil {
+		return reqErr
+	}
+	forwardRequestID(req)
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, doErr := v.httpClient.Do(req)
+	if doErr != nil {
+		return doErr
+	}
+	defer resp.Body.Close()
+	respBody, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if readErr != nil {
+		return readErr
+	}
+	if resp.StatusCode/100 != 2 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(respBody, &vaultErr)
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+	}
+	if response == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, response)
+}
+
+// resolveVaultReferences connects to Vault when configured and replaces every supported
+// "vault:" configuration value with the secret it points to
+func resolveVaultReferences(ctx context.Context, cfg *Config) error {
+	if cfg.Vault.Address == "" {
+		cfg.Vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if !cfg.Vault.enabled() {
+		return nil
+	}
+	client, clientErr := newVaultClient(ctx, cfg.Vault)
+	if clientErr != nil {
+		return clientErr
+	}
+	cfg.vault = client
+
+	// Only secrets are looked up; everything else stays in the configuration file
+	references := []*string{
+		&cfg.AdminToken, &cfg.DatabasePath, &cfg.PKCS11.PIN, &cfg.TLSCert, &cfg.TLSKey, &cfg.Ethereum.SenderKey, &cfg.LDAP.BindPassword,
+		&cfg.Stateless.Secret, &cfg.Stateless.Redis.Password,
+	}
+	for i := range cfg.Listeners {
+		references = append(references, &cfg.Listeners[i].TLSCert, &cfg.Listeners[i].TLSKey)
+	}
+	for id, key := range cfg.MasterKeys {
+		if strings.HasPrefix(key, vaultRefPrefix) {
+			value, readErr := client.readField(ctx, key)
+			if readErr != nil {
+				return readErr
+			}
+			cfg.MasterKeys[id] = value
+		}
+	}
+	for _, reference := range references {
+		if !strings.HasPrefix(*reference, vaultRefPrefix) {
+			continue
+		}
+		value, readErr := client.readField(ctx, *reference)
+		if readErr != nil {
+			return readErr
+		}
+		*reference = value
+	}
+	return nil
+}
+
+// readVaultArtifacts reads a KV v2 secret whose fields are base64 artifact files into an in-memory file system
+func readVaultArtifacts(ctx context.Context, vault *vaultClient, mountPath string) (fs.FS, error) {
+	data, readErr := vault.readKV(ctx, mountPath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	files := fstest.MapFS{}
+	for name, value := range data {
+		encoded, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("vault artifact field %q is not a base64 string", name)
+		}
+		decoded, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("decoding vault artifact %q: %w", name, decodeErr)
+		}
+		files[name] = &fstest.MapFile{Data: decoded}
+	}
+	return files, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"A2zkp-circuit/verifier"
+)
+
+// VerificationResponse is the body of an accepted POST /v1/verify
+type VerificationResponse struct {
+	StatusResponse
+	// Verdict is a compact JWS of type verifier.VerdictType whose payload is a verifier.Verdict,
+	// signed with a key published at /v1/signing-keys; set when verdict_signing is enabled
+	Verdict string `json:"verdict,omitempty"`
+}
+
+// signVerdict signs the statement that userName proved their secret against nonce under keyID;
+// without verdict signing it returns ""
+func (s *Server) signVerdict(ctx context.Context, userName, keyID string, nonce *big.Int) (string, error) {
+	if !s.cfg.VerdictSigning.Enabled {
+		return "", nil
+	}
+	tokenID, idErr := randomToken()
+	if idErr != nil {
+		return "", idErr
+	}
+	return s.signingKeys.sign(ctx, verifier.VerdictType, verifier.Verdict{
+		Issuer:   s.cfg.OIDC.issuer(),
+		UserName: userName,
+		Status:   "valid",
+		KeyID:    keyID,
+		Nonce:    nonce.String(),
+		IssuedAt: time.Now().Unix(),
+		JWTID:    tokenID,
+	})
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// wasmAssets maps the browser prover files that may be served to their content types
+var wasmAssets = map[string]string{
+	"prover.wasm":  "application/wasm",
+	"wasm_exec.js": "text/javascript; charset=utf-8",
+}
+
+// wasmAssetHandler serves the js/wasm prover build and its Go runtime loader from the configured directory
+func (s *Server) wasmAssetHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	contentType, allowed := wasmAssets[name]
+	if s.cfg.WasmDir == "" || !allowed {
+		writeProblem(w, http.StatusNotFound, codeNotFound, "No such prover asset")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, filepath.Join(s.cfg.WasmDir, name))
+}
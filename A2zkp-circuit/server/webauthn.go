@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"time"
+
+	"A2zkp-circuit/store"
+	"A2zkp-circuit/validate"
+)
+
+// COSE algorithms a bound credential may sign with, as navigator.credentials.create() reports them
+const (
+	coseES256 = -7   // coseES256 is ECDSA over P-256 with SHA-256
+	coseEdDSA = -8   // coseEdDSA is Ed25519
+	coseRS256 = -257 // coseRS256 is RSASSA-PKCS1-v1_5 with SHA-256
+)
+
+// Bounds of the fields of a WebAuthn binding and assertion
+const (
+	maxCredentialIDLength      = 1023 // maxCredentialIDLength is the longest credential ID WebAuthn allows
+	maxCredentialKeyLength     = 2048
+	maxAuthenticatorDataLength = 1024
+	maxClientDataLength        = 2048
+	minWebAuthnRSABits         = 2048
+)
+
+// authenticatorDataFlags are the flags of authenticator data checked
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+)
+
+// ErrWebAuthnRequired is returned for a proof without an assertion from a user bound to a hardware key
+var ErrWebAuthnRequired = errors.New("an assertion of the bound WebAuthn credential is required")
+
+// ErrWebAuthnInvalid is returned for an assertion that doesn't check out
+var ErrWebAuthnInvalid = errors.New("invalid WebAuthn assertion")
+
+// WebAuthnAssertion is the response of navigator.credentials.get() for the bound credential, its
+// challenge the SHA-256 of the decimal challenge nonce
+type WebAuthnAssertion struct {
+	CredentialID      []byte `json:"credential_id"`      // CredentialID is the credential's rawId
+	AuthenticatorData []byte `json:"authenticator_data"` // AuthenticatorData is response.authenticatorData
+	ClientDataJSON    []byte `json:"client_data_json"`   // ClientDataJSON is response.clientDataJSON
+	Signature         []byte `json:"signature"`          // Signature is response.signature
+}
+
+// BindWebAuthnRequest binds a credential to a user's registration, with an assertion over a
+// challenge from POST /v1/challenges proving the key is at hand
+type BindWebAuthnRequest struct {
+	CredentialID []byte `json:"credential_id"` // CredentialID is the rawId navigator.credentials.create() returned
+	// PublicKey is the DER SubjectPublicKeyInfo response.getPublicKey() returns
+	PublicKey []byte            `json:"public_key"`
+	Algorithm int               `json:"algorithm"` // Algorithm is response.getPublicKeyAlgorithm(): -7, -8 or -257
+	Nonce     string            `json:"nonce"`     // Nonce is the challenge nonce the assertion was made over
+	Assertion WebAuthnAssertion `json:"assertion"`
+}
+
+// WebAuthnCredentialResponse describes the credential bound to a user; the key isn't returned
+type WebAuthnCredentialResponse struct {
+	UserName     string    `json:"user_name"`
+	CredentialID []byte    `json:"credential_id"`
+	Algorithm    int       `json:"algorithm"`
+	SignCount    uint32    `json:"sign_count"` // SignCount is the signature counter of the last assertion accepted
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// clientData is the part of the client data JSON checked
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// validateInto records the invalid fields of an assertion in v, under prefix
+func (a WebAuthnAssertion) validateInto(v *validate.Validator, prefix string) {
+	for _, field := range []struct {
+		name  string
+		value []byte
+		max   int
+	}{
+		{"credential_id", a.CredentialID, maxCredentialIDLength},
+		{"authenticator_data", a.AuthenticatorData, maxAuthenticatorDataLength},
+		{"client_data_json", a.ClientDataJSON, maxClientDataLength},
+		{"signature", a.Signature, maxCredentialKeyLength},
+	} {
+		if len(field.value) == 0 {
+			v.Fail(prefix+field.name, "is required")
+		} else {
+			v.MaxLength(prefix+field.name, len(field.value), field.max)
+		}
+	}
+}
+
+// validate checks the request fields and returns the parsed nonce
+func (req BindWebAuthnRequest) validate() (*big.Int, error) {
+	var v validate.Validator
+	if len(req.CredentialID) == 0 {
+		v.Fail("credential_id", "is required")
+	} else {
+		v.MaxLength("credential_id", len(req.CredentialID), maxCredentialIDLength)
+	}
+	if len(req.PublicKey) == 0 {
+		v.Fail("public_key", "is required")
+	} else if v.MaxLength("public_key", len(req.PublicKey), maxCredentialKeyLength) {
+		if _, keyErr := parseCredentialKey(req.PublicKey, req.Algorithm); keyErr != nil {
+			v.Fail("public_key", "%v", keyErr)
+		}
+	}
+	nonce := v.FieldElement("nonce", req.Nonce)
+	req.Assertion.validateInto(&v, "assertion.")
+	if !bytes.Equal(req.Assertion.CredentialID, req.CredentialID) {
+		v.Fail("assertion.credential_id", "must be the credential being bound")
+	}
+	return nonce, v.Err()
+}
+
+// validateWebAuthnConfig checks that binding is either off or has origins to accept assertions from
+func validateWebAuthnConfig(cfg WebAuthnConfig) error {
+	if cfg.RPID != "" && len(cfg.Origins) == 0 {
+		return errors.New("webauthn.origins: at least one origin is required with webauthn.rp_id")
+	}
+	return nil
+}
+
+// parseCredentialKey parses a SubjectPublicKeyInfo as a key of the COSE algorithm
+func parseCredentialKey(der []byte, algorithm int) (crypto.PublicKey, error) {
+	key, parseErr := x509.ParsePKIXPublicKey(der)
+	if parseErr != nil {
+		return nil, fmt.Errorf("must be a DER SubjectPublicKeyInfo: %v", parseErr)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if algorithm == coseES256 && key.Curve == elliptic.P256() {
+			return key, nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == coseEdDSA {
+			return key, nil
+		}
+	case *rsa.PublicKey:
+		if algorithm == coseRS256 {
+			if key.N.BitLen() < minWebAuthnRSABits {
+				return nil, fmt.Errorf("RSA keys must have at least %d bits", minWebAuthnRSABits)
+			}
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("is not a key of algorithm %d; keys must be ES256 (-7) on P-256, EdDSA (-8) or RS256 (-257)", algorithm)
+}
+
+// webauthnChallenge is the WebAuthn challenge an assertion accompanying a proof is made over: the
+// SHA-256 of the decimal nonce, so the assertion is as single-use as the nonce
+func webauthnChallenge(nonce string) []byte {
+	digest := sha256.Sum256([]byte(nonce))
+	return digest[:]
+}
+
+// verifyAssertion checks an assertion of a credential over the challenge of a nonce: the client
+// data, the relying party and flags of the authenticator data, the signature over both and that
+// the signature counter went up. It returns the new counter.
+func (s *Server) verifyAssertion(credential store.WebAuthnCredential, assertion WebAuthnAssertion, nonce string) (uint32, error) {
+	cfg := s.cfg.WebAuthn
+	if cfg.RPID == "" {
+		return 0, fmt.Errorf("%w: webauthn.rp_id is not configured", ErrWebAuthnInvalid)
+	}
+	if !bytes.Equal(assertion.CredentialID, credential.CredentialID) {
+		return 0, fmt.Errorf("%w: not the bound credential", ErrWebAuthnInvalid)
+	}
+	var client clientData
+	if decodeErr := json.Unmarshal(assertion.ClientDataJSON, &client); decodeErr != nil {
+		return 0, fmt.Errorf("%w: malformed client data: %v", ErrWebAuthnInvalid, decodeErr)
+	}
+	switch {
+	case client.Type != "webauthn.get":
+		return 0, fmt.Errorf("%w: client data type is %q, want webauthn.get", ErrWebAuthnInvalid, client.Type)
+	case client.Challenge != base64.RawURLEncoding.EncodeToString(webauthnChallenge(nonce)):
+		return 0, fmt.Errorf("%w: the challenge isn't the nonce's", ErrWebAuthnInvalid)
+	case !slices.Contains(cfg.Origins, client.Origin):
+		return 0, fmt.Errorf("%w: origin %q is not accepted", ErrWebAuthnInvalid, client.Origin)
+	}
+
+	// Authenticator data starts with the relying party ID hash, the flags and the counter
+	data := assertion.AuthenticatorData
+	if len(data) < 37 {
+		return 0, fmt.Errorf("%w: authenticator data is too short", ErrWebAuthnInvalid)
+	}
+	rpIDHash := sha256.Sum256([]byte(cfg.RPID))
+	flags := data[32]
+	switch {
+	case !bytes.Equal(data[:32], rpIDHash[:]):
+		return 0, fmt.Errorf("%w: the credential is scoped to another relying party", ErrWebAuthnInvalid)
+	case flags&flagUserPresent == 0:
+		return 0, fmt.Errorf("%w: the user was not present", ErrWebAuthnInvalid)
+	case cfg.RequireUserVerification && flags&flagUserVerified == 0:
+		return 0, fmt.Errorf("%w: the authenticator didn't verify the user", ErrWebAuthnInvalid)
+	}
+	signCount := binary.BigEndian.Uint32(data[33:37])
+
+	key, keyErr := parseCredentialKey(credential.PublicKey, credential.Algorithm)
+	if keyErr != nil {
+		return 0, fmt.Errorf("%w: bound key %v", ErrWebAuthnInvalid, keyErr)
+	}
+	clientDataHash := sha256.Sum256(assertion.ClientDataJSON)
+	signed := append(slices.Clone(data), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+	var valid bool
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], assertion.Signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, signed, assertion.Signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], assertion.Signature) == nil
+	}
+	if !valid {
+		return 0, fmt.Errorf("%w: the signature doesn't verify", ErrWebAuthnInvalid)
+	}
+	// Authenticators without a counter always report 0; one that went backwards was cloned
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return 0, fmt.Errorf("%w: the signature counter didn't increase, the credential may be cloned", ErrWebAuthnInvalid)
+	}
+	return signCount, nil
+}
+
+// checkWebAuthn checks the assertion sent with a proof that verified for a user bound to a hardware
+// key, and records its counter. Bound users are checked even with webauthn.rp_id unset, and fail.
+func (s *Server) checkWebAuthn(ctx context.Context, req ProofRequest, userName string, nonce *big.Int) error {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, getErr := s.getUser(ctx, userName)
+	if getErr != nil {
+		return getErr
+	}
+	if user.WebAuthn == nil {
+		return nil
+	}
+	if req.WebAuthn == nil {
+		return ErrWebAuthnRequired
+	}
+	signCount, verifyErr := s.verifyAssertion(*user.WebAuthn, *req.WebAuthn, nonce.String())
+	if verifyErr != nil {
+		return verifyErr
+	}
+	credential := *user.WebAuthn
+	credential.SignCount = signCount
+	user.WebAuthn = &credential
+	return s.store.PutUser(ctx, user)
+}
+
+// formAssertion parses the webauthn field of a sign-in form, an assertion as JSON; nil when empty
+func formAssertion(value string) (*WebAuthnAssertion, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var assertion WebAuthnAssertion
+	if decodeErr := json.Unmarshal([]byte(value), &assertion); decodeErr != nil {
+		return nil, fmt.Errorf("webauthn: must be an assertion as JSON: %v", decodeErr)
+	}
+	return &assertion, nil
+}
+
+// authorizeWebAuthn checks the caller may manage the WebAuthn credential of the user in the path,
+// writing the problem when not
+func (s *Server) authorizeWebAuthn(w http.ResponseWriter, r *http.Request) bool {
+	if !s.authorizedFor(r, r.PathValue("id")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "Managing the WebAuthn credential needs the admin token or a session token of that user")
+		return false
+	}
+	return true
+}
+
+// newWebAuthnCredentialResponse describes the credential bound to a user
+func newWebAuthnCredentialResponse(user store.User) WebAuthnCredentialResponse {
+	credential := user.WebAuthn
+	return WebAuthnCredentialResponse{
+		UserName:     user.UserName,
+		CredentialID: credential.CredentialID,
+		Algorithm:    credential.Algorithm,
+		SignCount:    credential.SignCount,
+		CreatedAt:    credential.CreatedAt,
+	}
+}
+
+// bindWebAuthnHandler binds a WebAuthn credential to a user's registration, after which proofs for
+// the user must come with an assertion from it. The request's own assertion, over a challenge
+// nonce issued to the user, shows the key is at hand; a user has one credential at a time.
+func (s *Server) bindWebAuthnHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeWebAuthn(w, r) {
+		return
+	}
+	if s.cfg.WebAuthn.RPID == "" {
+		writeProblem(w, http.StatusNotFound, codeFeatureDisabled, "WebAuthn binding is disabled: no webauthn.rp_id is configured")
+		return
+	}
+	var req BindWebAuthnRequest
+	if decodeErr := decodeJSON(w, r, s.cfg.MaxBodyBytes, &req); decodeErr != nil {
+		writeRequestError(w, decodeErr)
+		return
+	}
+	nonce, validateErr := req.validate()
+	if validateErr != nil {
+		writeRequestError(w, validateErr)
+		return
+	}
+	userName := r.PathValue("id")
+	if consumeErr := s.challenges.consume(r.Context(), userName, nonce); consumeErr != nil {
+		s.writeAuthError(w, ProofRequest{}, consumeErr)
+		return
+	}
+
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if user.WebAuthn != nil {
+		writeProblem(w, http.StatusConflict, codeWebAuthnBound, "The user is already bound to a WebAuthn credential; unbind it first")
+		return
+	}
+	credential := store.WebAuthnCredential{CredentialID: req.CredentialID, PublicKey: req.PublicKey, Algorithm: req.Algorithm, CreatedAt: time.Now().UTC()}
+	signCount, verifyErr := s.verifyAssertion(credential, req.Assertion, nonce.String())
+	if verifyErr != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, codeWebAuthnInvalid, verifyErr.Error())
+		return
+	}
+	credential.SignCount = signCount
+	user.WebAuthn = &credential
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error storing the WebAuthn credential: %v", putErr))
+		return
+	}
+	writeResponse(w, r, http.StatusCreated, newWebAuthnCredentialResponse(user))
+}
+
+// webauthnCredentialHandler describes the credential bound to a user
+func (s *Server) webauthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeWebAuthn(w, r) {
+		return
+	}
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if user.WebAuthn == nil {
+		writeProblem(w, http.StatusNotFound, codeWebAuthnNotBound, "The user is not bound to a WebAuthn credential")
+		return
+	}
+	writeResponse(w, r, http.StatusOK, newWebAuthnCredentialResponse(user))
+}
+
+// unbindWebAuthnHandler removes the credential bound to a user, e.g. after the key was lost, so
+// proofs alone log them in again
+func (s *Server) unbindWebAuthnHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeWebAuthn(w, r) {
+		return
+	}
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	user, ok := s.deviceUser(w, r)
+	if !ok {
+		return
+	}
+	if user.WebAuthn == nil {
+		writeProblem(w, http.StatusNotFound, codeWebAuthnNotBound, "The user is not bound to a WebAuthn credential")
+		return
+	}
+	user.WebAuthn = nil
+	if putErr := s.store.PutUser(r.Context(), user); putErr != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error removing the WebAuthn credential: %v", putErr))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// WebhookEvent is the JSON body posted to webhooks
+type WebhookEvent struct {
+	ID        string    `json:"id"`         // ID is unique per event, so receivers can drop redelivered ones
+	Type      string    `json:"type"`       // Type is the event type, e.g. "anomaly.detected"
+	CreatedAt time.Time `json:"created_at"` // CreatedAt is when the event happened
+	Data      any       `json:"data"`       // Data is the event's payload, e.g. an Anomaly
+	// RequestID is the X-Request-ID of the request that caused the event; empty for background work
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// webhookSignatureHeader carries the HMAC-SHA256 of a webhook body under the hook's secret
+const webhookSignatureHeader = "X-OFA-Signature"
+
+// Every delivery carries the base64url Ed25519 signature of its body and the ID of the key in
+// /v1/signing-keys that made it, so receivers can check it without sharing a secret
+const (
+	webhookEd25519Header = "X-OFA-Signature-Ed25519"
+	webhookKeyIDHeader   = "X-OFA-Signature-Key"
+)
+
+// webhookAttempts is how often a delivery is tried before it is given up
+const webhookAttempts = 3
+
+// webhookNotifier posts events to the configured webhooks in the background
+type webhookNotifier struct {
+	hooks  []WebhookConfig
+	client *http.Client
+	retry  time.Duration // retry is the pause before the second attempt, doubled before each further one
+	keys   *signingKeySet
+}
+
+// newWebhookNotifier checks the webhook URLs; it returns nil when there are none. Deliveries are
+// signed with keys.
+func newWebhookNotifier(hooks []WebhookConfig, keys *signingKeySet) (*webhookNotifier, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	for _, hook := range hooks {
+		parsed, parseErr := url.Parse(hook.URL)
+		if parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("webhook URL %q must be an absolute http or https URL", hook.URL)
+		}
+	}
+	return &webhookNotifier{hooks: hooks, client: &http.Client{Timeout: 10 * time.Second}, retry: time.Second, keys: keys}, nil
+}
+
+// publish sends an event to every webhook subscribed to its type without waiting for the deliveries,
+// along with the ID of the request ctx belongs to; a nil receiver drops it
+func (n *webhookNotifier) publish(ctx context.Context, eventType string, data any) {
+	if n == nil {
+		return
+	}
+	eventID, idErr := randomToken()
+	if idErr != nil {
+		logf(ctx, "Dropping %s event: %v", eventType, idErr)
+		return
+	}
+	event := WebhookEvent{ID: eventID, Type: eventType, CreatedAt: time.Now().UTC(), Data: data, RequestID: requestID(ctx)}
+	body, encodeErr := json.Marshal(event)
+	if encodeErr != nil {
+		logf(ctx, "Dropping %s event: %v", eventType, encodeErr)
+		return
+	}
+	for _, hook := range n.hooks {
+		if len(hook.Events) == 0 || slices.Contains(hook.Events, eventType) {
+			// The delivery outlives the request, so it only keeps the request's ID
+			go n.deliver(context.WithValue(context.Background(), requestIDKey{}, event.RequestID), hook, eventType, body)
+		}
+	}
+}
+
+// deliver posts body to one webhook, retrying network errors and 5xx answers with a growing pause
+func (n *webhookNotifier) deliver(ctx context.Context, hook WebhookConfig, eventType string, body []byte) {
+	pause := n.retry
+	for attempt := 1; ; attempt++ {
+		deliveryErr := n.post(ctx, hook, eventType, body)
+		if deliveryErr == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			logf(ctx, "Giving up delivering %s to %s: %v", eventType, hook.URL, deliveryErr)
+			return
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// post makes one delivery attempt; 4xx answers count as delivered since retrying won't change them
+func (n *webhookNotifier) post(ctx context.Context, hook WebhookConfig, eventType string, body []byte) error {
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-OFA-Event", eventType)
+	forwardRequestID(req)
+	if hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(hook.Secret, body))
+	}
+	keyID, signature, signErr := n.keys.signMessage(ctx, body)
+	if signErr != nil {
+		return signErr
+	}
+	req.Header.Set(webhookKeyIDHeader, keyID)
+	req.Header.Set(webhookEd25519Header, base64.RawURLEncoding.EncodeToString(signature))
+	resp, postErr := n.client.Do(req)
+	if postErr != nil {
+		return postErr
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		logf(ctx, "Webhook %s rejected %s: %s", hook.URL, eventType, resp.Status)
+	}
+	return nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of body under secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
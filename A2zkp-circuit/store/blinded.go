@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// blindedPrefix marks a commitment replaced by its keyed hash in a blindedStore
+const blindedPrefix = "ofablind1:"
+
+// BlindCommitment returns the form a blinded store keeps of a commitment: the HMAC-SHA256 of its
+// decimal digits under pepper. Empty and already blinded commitments are returned as they are.
+// verifier.BlindCommitment hashes the same way for offline verifiers checking revocations.
+func BlindCommitment(pepper []byte, commitment string) string {
+	if commitment == "" || IsBlinded(commitment) {
+		return commitment
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(commitment))
+	return blindedPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsBlinded reports whether a stored commitment is the keyed hash BlindCommitment makes
+func IsBlinded(commitment string) bool {
+	return strings.HasPrefix(commitment, blindedPrefix)
+}
+
+// blindedStore wraps another Store, replacing the commitments of users and their devices with their
+// keyed hashes before they reach it, so a leaked database holds no commitment to brute-force secrets
+// against without the pepper as well. The hash is deterministic, so equal commitments still compare
+// equal; a proof is checked against the commitment its client sends, once that blinds to a stored one.
+// Recovery shares are kept as they are: they commit to random values, which no brute force finds.
+type blindedStore struct {
+	Store
+	pepper []byte
+}
+
+// NewBlinded returns a Store that keeps only keyed hashes of commitments under pepper. Registrations
+// stored before are read as they are, and blinded the next time they are written.
+func NewBlinded(inner Store, pepper []byte) Store {
+	return &blindedStore{Store: inner, pepper: pepper}
+}
+
+func (s *blindedStore) CreateUser(ctx context.Context, user User) error {
+	return s.Store.CreateUser(ctx, s.blind(user))
+}
+
+func (s *blindedStore) CreateUsers(ctx context.Context, users []User) error {
+	blinded := make([]User, len(users))
+	for i, user := range users {
+		blinded[i] = s.blind(user)
+	}
+	return s.Store.CreateUsers(ctx, blinded)
+}
+
+func (s *blindedStore) PutUser(ctx context.Context, user User) error {
+	return s.Store.PutUser(ctx, s.blind(user))
+}
+
+// blind replaces the commitments of a user and their devices with their keyed hashes
+func (s *blindedStore) blind(user User) User {
+	user.CryptoCommitment = BlindCommitment(s.pepper, user.CryptoCommitment)
+	if len(user.Devices) > 0 {
+		devices := make([]Device, len(user.Devices))
+		for i, device := range user.Devices {
+			device.CryptoCommitment = BlindCommitment(s.pepper, device.CryptoCommitment)
+			devices[i] = device
+		}
+		user.Devices = devices
+	}
+	return user
+}
@@ -0,0 +1,498 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// envelopePrefix marks a field value produced by the envelope encryption of encryptedStore
+const envelopePrefix = "ofaenc1"
+
+// ErrUnknownMasterKey is returned when a stored envelope references a master key that is not configured
+var ErrUnknownMasterKey = errors.New("envelope references an unknown master key")
+
+// MasterKeyring holds the key-encryption keys that wrap per-record data keys
+type MasterKeyring struct {
+	ActiveID string            // ActiveID names the key used to wrap newly written data keys
+	Keys     map[string][]byte // Keys maps a key ID to its 32-byte AES-256 key
+}
+
+// NewMasterKeyring decodes base64 master keys and checks that the active one is present
+func NewMasterKeyring(activeID string, encodedKeys map[string]string) (*MasterKeyring, error) {
+	keyring := &MasterKeyring{ActiveID: activeID, Keys: make(map[string][]byte)}
+	for id, encoded := range encodedKeys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid master key ID %q", id)
+		}
+		key, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("decoding master key %q: %w", id, decodeErr)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes, got %d", id, len(key))
+		}
+		keyring.Keys[id] = key
+	}
+	if _, ok := keyring.Keys[activeID]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured", activeID)
+	}
+	return keyring, nil
+}
+
+// encryptedStore wraps another Store, encrypting commitments and salts before they reach it.
+// Each field is sealed with a fresh AES-GCM data key, and that data key is itself sealed with
+// the active master key. The master key ID is kept in the envelope, so records written under an
+// older master key stay readable after rotation and are re-wrapped the next time they are written.
+type encryptedStore struct {
+	inner   Store
+	keyring *MasterKeyring
+}
+
+// NewEncrypted returns a Store that encrypts sensitive fields at rest
+func NewEncrypted(inner Store, keyring *MasterKeyring) Store {
+	return &encryptedStore{inner: inner, keyring: keyring}
+}
+
+func (s *encryptedStore) CreateUser(ctx context.Context, user User) error {
+	sealed, sealErr := s.seal(user)
+	if sealErr != nil {
+		return sealErr
+	}
+	return s.inner.CreateUser(ctx, sealed)
+}
+
+func (s *encryptedStore) CreateUsers(ctx context.Context, users []User) error {
+	sealed := make([]User, len(users))
+	for i, user := range users {
+		var sealErr error
+		if sealed[i], sealErr = s.seal(user); sealErr != nil {
+			return &BatchError{Index: i, Err: sealErr}
+		}
+	}
+	return s.inner.CreateUsers(ctx, sealed)
+}
+
+func (s *encryptedStore) PutUser(ctx context.Context, user User) error {
+	sealed, sealErr := s.seal(user)
+	if sealErr != nil {
+		return sealErr
+	}
+	return s.inner.PutUser(ctx, sealed)
+}
+
+func (s *encryptedStore) GetUser(ctx context.Context, userName string) (User, error) {
+	user, getErr := s.inner.GetUser(ctx, userName)
+	if getErr != nil {
+		return User{}, getErr
+	}
+	return s.open(user)
+}
+
+func (s *encryptedStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	return s.inner.AdvanceTOTPStep(ctx, userName, step)
+}
+
+func (s *encryptedStore) DeleteUser(ctx context.Context, userName string) error {
+	return s.inner.DeleteUser(ctx, userName)
+}
+
+func (s *encryptedStore) ListUsers(ctx context.Context) ([]User, error) {
+	users, listErr := s.inner.ListUsers(ctx)
+	if listErr != nil {
+		return nil, listErr
+	}
+	for i := range users {
+		opened, openErr := s.open(users[i])
+		if openErr != nil {
+			return nil, openErr
+		}
+		users[i] = opened
+	}
+	return users, nil
+}
+
+func (s *encryptedStore) RecordEvents(ctx context.Context, events []Event) error {
+	return s.inner.RecordEvents(ctx, events)
+}
+
+func (s *encryptedStore) ListEvents(ctx context.Context, from, to time.Time) ([]Event, error) {
+	return s.inner.ListEvents(ctx, from, to)
+}
+
+func (s *encryptedStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	return s.inner.PruneEvents(ctx, before)
+}
+
+func (s *encryptedStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	// The revocation log is published, so sealing its commitments would protect nothing
+	return s.inner.AppendRevocations(ctx, revocations)
+}
+
+func (s *encryptedStore) ListRevocations(ctx context.Context, after uint64) ([]Revocation, error) {
+	return s.inner.ListRevocations(ctx, after)
+}
+
+func (s *encryptedStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	// Refresh tokens are kept by hash and hold none of the user's secrets, so they are stored as they are
+	return s.inner.PutRefreshToken(ctx, token)
+}
+
+func (s *encryptedStore) GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	return s.inner.GetRefreshToken(ctx, hash)
+}
+
+func (s *encryptedStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	return s.inner.RotateRefreshToken(ctx, hash, next)
+}
+
+func (s *encryptedStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	return s.inner.RevokeRefreshFamily(ctx, family)
+}
+
+func (s *encryptedStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	return s.inner.DeleteUserRefreshTokens(ctx, userName)
+}
+
+func (s *encryptedStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	return s.inner.PruneRefreshTokens(ctx, before)
+}
+
+func (s *encryptedStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	return s.inner.RevokeSessions(ctx, revocation)
+}
+
+func (s *encryptedStore) SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error) {
+	return s.inner.SessionRevoked(ctx, userName, tokenID, issuedAt)
+}
+
+func (s *encryptedStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	return s.inner.PruneSessionRevocations(ctx, before)
+}
+
+func (s *encryptedStore) RecordSession(ctx context.Context, session Session) error {
+	return s.inner.RecordSession(ctx, session)
+}
+
+func (s *encryptedStore) CountSessions(ctx context.Context, userName string, at time.Time) (int, error) {
+	return s.inner.CountSessions(ctx, userName, at)
+}
+
+func (s *encryptedStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	return s.inner.PruneSessions(ctx, before)
+}
+
+func (s *encryptedStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	return s.inner.PutAuthPolicy(ctx, policy)
+}
+
+func (s *encryptedStore) GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error) {
+	return s.inner.GetAuthPolicy(ctx, tenant, userName)
+}
+
+func (s *encryptedStore) ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error) {
+	return s.inner.ListAuthPolicies(ctx)
+}
+
+func (s *encryptedStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	return s.inner.DeleteAuthPolicy(ctx, tenant, userName)
+}
+
+func (s *encryptedStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	return s.inner.PutAPIKey(ctx, key)
+}
+
+func (s *encryptedStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	return s.inner.GetAPIKey(ctx, id)
+}
+
+func (s *encryptedStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return s.inner.ListAPIKeys(ctx)
+}
+
+func (s *encryptedStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.inner.DeleteAPIKey(ctx, id)
+}
+
+func (s *encryptedStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	return s.inner.AddUsage(ctx, keyID, tenant, day, requests)
+}
+
+func (s *encryptedStore) ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+	return s.inner.ListUsage(ctx, from, to)
+}
+
+func (s *encryptedStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	commitment, sealErr := s.encryptField([]byte(transcript.Commitment), transcript.UserName, "transcript:"+transcript.ID)
+	if sealErr != nil {
+		return sealErr
+	}
+	transcript.Commitment = commitment
+	return s.inner.RecordTranscript(ctx, transcript)
+}
+
+func (s *encryptedStore) GetTranscript(ctx context.Context, id string) (Transcript, error) {
+	transcript, getErr := s.inner.GetTranscript(ctx, id)
+	if getErr != nil {
+		return Transcript{}, getErr
+	}
+	return s.openTranscript(transcript)
+}
+
+func (s *encryptedStore) ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	transcripts, listErr := s.inner.ListTranscripts(ctx, userName, from, to)
+	if listErr != nil {
+		return nil, listErr
+	}
+	for i, transcript := range transcripts {
+		opened, openErr := s.openTranscript(transcript)
+		if openErr != nil {
+			return nil, openErr
+		}
+		transcripts[i] = opened
+	}
+	return transcripts, nil
+}
+
+func (s *encryptedStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	return s.inner.PruneTranscripts(ctx, before)
+}
+
+func (s *encryptedStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	return s.inner.DeleteUserTranscripts(ctx, userName)
+}
+
+// openTranscript decrypts the commitment of a transcript, which is sealed as the user's own commitments are
+func (s *encryptedStore) openTranscript(transcript Transcript) (Transcript, error) {
+	if !strings.HasPrefix(transcript.Commitment, envelopePrefix+".") {
+		return transcript, nil
+	}
+	commitment, openErr := s.decryptField(transcript.Commitment, transcript.UserName, "transcript:"+transcript.ID)
+	if openErr != nil {
+		return Transcript{}, openErr
+	}
+	transcript.Commitment = string(commitment)
+	return transcript, nil
+}
+
+func (s *encryptedStore) Close() error {
+	return s.inner.Close()
+}
+
+// seal encrypts the sensitive fields of a user record
+func (s *encryptedStore) seal(user User) (User, error) {
+	commitment, commitmentErr := s.encryptField([]byte(user.CryptoCommitment), user.UserName, "crypto_commitment")
+	if commitmentErr != nil {
+		return User{}, commitmentErr
+	}
+	user.CryptoCommitment = commitment
+
+	if len(user.Salt) > 0 {
+		salt, saltErr := s.encryptField(user.Salt, user.UserName, "salt")
+		if saltErr != nil {
+			return User{}, saltErr
+		}
+		user.Salt = []byte(salt)
+	}
+
+	devices := make([]Device, len(user.Devices))
+	for i, device := range user.Devices {
+		commitment, deviceErr := s.encryptField([]byte(device.CryptoCommitment), user.UserName, "device:"+device.Label)
+		if deviceErr != nil {
+			return User{}, deviceErr
+		}
+		device.CryptoCommitment = commitment
+		devices[i] = device
+	}
+	if len(devices) > 0 {
+		user.Devices = devices
+	}
+	if user.Recovery != nil {
+		recovery := *user.Recovery
+		recovery.Shares = make([]RecoveryShare, len(user.Recovery.Shares))
+		for i, share := range user.Recovery.Shares {
+			commitment, shareErr := s.encryptField([]byte(share.CryptoCommitment), user.UserName, fmt.Sprintf("recovery:%d", share.Index))
+			if shareErr != nil {
+				return User{}, shareErr
+			}
+			share.CryptoCommitment = commitment
+			recovery.Shares[i] = share
+		}
+		user.Recovery = &recovery
+	}
+	if user.TOTP != nil {
+		totp := *user.TOTP
+		sealed, totpErr := s.encryptField(totp.Secret, user.UserName, "totp")
+		if totpErr != nil {
+			return User{}, totpErr
+		}
+		totp.Secret = []byte(sealed)
+		user.TOTP = &totp
+	}
+	if user.Legacy != nil {
+		legacy := *user.Legacy
+		sealed, legacyErr := s.encryptField([]byte(legacy.Hash), user.UserName, "legacy")
+		if legacyErr != nil {
+			return User{}, legacyErr
+		}
+		legacy.Hash = sealed
+		user.Legacy = &legacy
+	}
+	return user, nil
+}
+
+// open decrypts the sensitive fields of a user record; plaintext values written before encryption was enabled pass through
+func (s *encryptedStore) open(user User) (User, error) {
+	if strings.HasPrefix(user.CryptoCommitment, envelopePrefix+".") {
+		commitment, commitmentErr := s.decryptField(user.CryptoCommitment, user.UserName, "crypto_commitment")
+		if commitmentErr != nil {
+			return User{}, commitmentErr
+		}
+		user.CryptoCommitment = string(commitment)
+	}
+	if strings.HasPrefix(string(user.Salt), envelopePrefix+".") {
+		salt, saltErr := s.decryptField(string(user.Salt), user.UserName, "salt")
+		if saltErr != nil {
+			return User{}, saltErr
+		}
+		user.Salt = salt
+	}
+
+	devices := make([]Device, len(user.Devices))
+	for i, device := range user.Devices {
+		if strings.HasPrefix(device.CryptoCommitment, envelopePrefix+".") {
+			commitment, deviceErr := s.decryptField(device.CryptoCommitment, user.UserName, "device:"+device.Label)
+			if deviceErr != nil {
+				return User{}, deviceErr
+			}
+			device.CryptoCommitment = string(commitment)
+		}
+		devices[i] = device
+	}
+	if len(devices) > 0 {
+		user.Devices = devices
+	}
+	if user.Recovery != nil {
+		recovery := *user.Recovery
+		recovery.Shares = make([]RecoveryShare, len(user.Recovery.Shares))
+		for i, share := range user.Recovery.Shares {
+			if strings.HasPrefix(share.CryptoCommitment, envelopePrefix+".") {
+				commitment, shareErr := s.decryptField(share.CryptoCommitment, user.UserName, fmt.Sprintf("recovery:%d", share.Index))
+				if shareErr != nil {
+					return User{}, shareErr
+				}
+				share.CryptoCommitment = string(commitment)
+			}
+			recovery.Shares[i] = share
+		}
+		user.Recovery = &recovery
+	}
+	if user.TOTP != nil && strings.HasPrefix(string(user.TOTP.Secret), envelopePrefix+".") {
+		totp := *user.TOTP
+		opened, totpErr := s.decryptField(string(totp.Secret), user.UserName, "totp")
+		if totpErr != nil {
+			return User{}, totpErr
+		}
+		totp.Secret = opened
+		user.TOTP = &totp
+	}
+	if user.Legacy != nil && strings.HasPrefix(user.Legacy.Hash, envelopePrefix+".") {
+		legacy := *user.Legacy
+		opened, legacyErr := s.decryptField(legacy.Hash, user.UserName, "legacy")
+		if legacyErr != nil {
+			return User{}, legacyErr
+		}
+		legacy.Hash = string(opened)
+		user.Legacy = &legacy
+	}
+	return user, nil
+}
+
+// encryptField seals a value as "ofaenc1.<key ID>.<wrapped data key>.<ciphertext>"
+func (s *encryptedStore) encryptField(plaintext []byte, userName, field string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, randErr := rand.Read(dataKey); randErr != nil {
+		return "", randErr
+	}
+
+	// Bind both layers to the record and field so ciphertexts can't be swapped between rows
+	aad := []byte(userName + "\x00" + field)
+	ciphertext, encryptErr := SealAESGCM(dataKey, plaintext, aad)
+	if encryptErr != nil {
+		return "", encryptErr
+	}
+	wrappedKey, wrapErr := SealAESGCM(s.keyring.Keys[s.keyring.ActiveID], dataKey, aad)
+	if wrapErr != nil {
+		return "", wrapErr
+	}
+
+	return strings.Join([]string{
+		envelopePrefix,
+		s.keyring.ActiveID,
+		base64.RawURLEncoding.EncodeToString(wrappedKey),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+	}, "."), nil
+}
+
+// decryptField reverses encryptField using whichever master key the envelope names
+func (s *encryptedStore) decryptField(envelope, userName, field string) ([]byte, error) {
+	parts := strings.Split(envelope, ".")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed %s envelope for %q", field, userName)
+	}
+	masterKey, known := s.keyring.Keys[parts[1]]
+	if !known {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMasterKey, parts[1])
+	}
+	wrappedKey, wrappedErr := base64.RawURLEncoding.DecodeString(parts[2])
+	ciphertext, ciphertextErr := base64.RawURLEncoding.DecodeString(parts[3])
+	if wrappedErr != nil || ciphertextErr != nil {
+		return nil, fmt.Errorf("malformed %s envelope for %q", field, userName)
+	}
+
+	aad := []byte(userName + "\x00" + field)
+	dataKey, unwrapErr := OpenAESGCM(masterKey, wrappedKey, aad)
+	if unwrapErr != nil {
+		return nil, fmt.Errorf("unwrapping %s data key for %q: %w", field, userName, unwrapErr)
+	}
+	return OpenAESGCM(dataKey, ciphertext, aad)
+}
+
+// SealAESGCM encrypts plaintext under key, prefixing the random nonce to the ciphertext
+func SealAESGCM(key, plaintext, aad []byte) ([]byte, error) {
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+	aead, aeadErr := cipher.NewGCM(block)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, randErr := rand.Read(nonce); randErr != nil {
+		return nil, randErr
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// OpenAESGCM decrypts a value produced by SealAESGCM
+func OpenAESGCM(key, sealed, aad []byte) ([]byte, error) {
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+	aead, aeadErr := cipher.NewGCM(block)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
@@ -0,0 +1,751 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/secret"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrNoDirectoryEntry is returned by the LDAP store when registering a user the directory has no entry for
+var ErrNoDirectoryEntry = errors.New("no directory entry for the user")
+
+// LDAPConfig points the LDAP store at the directory the users already live in
+type LDAPConfig struct {
+	URL          string `json:"url"`           // URL is ldap://host[:port] or ldaps://host[:port]; setting it selects the LDAP store
+	StartTLS     bool   `json:"start_tls"`     // StartTLS upgrades an ldap:// connection to TLS before binding
+	BindDN       string `json:"bind_dn"`       // BindDN is the account the server binds as; it needs write access to the commitment attributes
+	BindPassword string `json:"bind_password"` // BindPassword may be a vault: reference
+	BaseDN       string `json:"base_dn"`       // BaseDN is the subtree searched for user entries
+	// UserFilter narrows the search to user entries, e.g. "(objectClass=inetOrgPerson)"
+	UserFilter    string         `json:"user_filter"`
+	TLSCAFile     string         `json:"tls_ca_file"`     // TLSCAFile is a PEM bundle to verify the directory with instead of the system roots
+	TLSServerName string         `json:"tls_server_name"` // TLSServerName overrides the host name the certificate must match
+	Attributes    LDAPAttributes `json:"attributes"`
+}
+
+// LDAPAttributes names the attributes of a user entry; empty names fall back to the defaults of
+// DefaultLDAPAttributes
+type LDAPAttributes struct {
+	UserName         string `json:"user_name"` // UserName holds the name users log in with and is not written
+	CryptoCommitment string `json:"crypto_commitment"`
+	Salt             string `json:"salt"` // Salt holds the salt in standard base64
+	KDF              string `json:"kdf"`  // KDF holds the KDF parameters as JSON
+	CircuitVersion   string `json:"circuit_version"`
+	Curve            string `json:"curve"`
+	KeyID            string `json:"key_id"`
+	CreatedAt        string `json:"created_at"` // CreatedAt holds the registration time as a GeneralizedTime
+	Tenant           string `json:"tenant"`
+	Devices          string `json:"devices"`    // Devices holds one JSON-encoded device per value
+	Recovery         string `json:"recovery"`   // Recovery holds the recovery share commitments as JSON
+	ExpiresAt        string `json:"expires_at"` // ExpiresAt and ExpiredAt hold GeneralizedTime values
+	ExpiredAt        string `json:"expired_at"`
+	DIDKey           string `json:"did_key"`
+	TOTP             string `json:"totp"`       // TOTP holds the TOTP enrolment as JSON
+	WebAuthn         string `json:"webauthn"`   // WebAuthn holds the bound WebAuthn credential as JSON
+	Legacy           string `json:"legacy"`     // Legacy holds the imported password hash of a pending user as JSON
+	DeletedAt        string `json:"deleted_at"` // DeletedAt holds the soft deletion time as a GeneralizedTime
+}
+
+// DefaultLDAPAttributes are the attribute names used unless configured otherwise
+var DefaultLDAPAttributes = LDAPAttributes{
+	UserName:         "uid",
+	CryptoCommitment: "ofaCryptoCommitment",
+	Salt:             "ofaSalt",
+	KDF:              "ofaKdfParams",
+	CircuitVersion:   "ofaCircuitVersion",
+	Curve:            "ofaCurve",
+	KeyID:            "ofaKeyId",
+	CreatedAt:        "ofaCreatedAt",
+	Tenant:           "ofaTenant",
+	Devices:          "ofaDevice",
+	Recovery:         "ofaRecovery",
+	ExpiresAt:        "ofaExpiresAt",
+	ExpiredAt:        "ofaExpiredAt",
+	DIDKey:           "ofaDidKey",
+	TOTP:             "ofaTotp",
+	WebAuthn:         "ofaWebAuthn",
+	Legacy:           "ofaLegacyPassword",
+	DeletedAt:        "ofaDeletedAt",
+}
+
+// generalizedTime is the layout of GeneralizedTime values, in UTC
+const generalizedTime = "20060102150405.999999999Z"
+
+// ldapTimeout bounds each directory operation that has no earlier context deadline
+const ldapTimeout = 10 * time.Second
+
+// ldapStore is a Store keeping registrations as attributes of existing directory entries. Events,
+// the revocation log, refresh tokens, sessions and their revocations, API keys and authentication
+// policies are not directory data and stay in process memory.
+type ldapStore struct {
+	cfg    LDAPConfig
+	attrs  LDAPAttributes
+	filter string // filter is ldap.user_filter, or one matching every entry
+	tls    *tls.Config
+	events Store
+
+	mu   sync.Mutex // mu serializes directory operations, so a check and the write after it are atomic here
+	conn *ldap.Conn
+}
+
+// OpenLDAP checks cfg and binds to the directory once, so a bad URL or password fails at startup
+func OpenLDAP(ctx context.Context, cfg LDAPConfig) (Store, error) {
+	if cfg.BaseDN == "" {
+		return nil, errors.New("ldap.base_dn is required")
+	}
+	directory, parseErr := url.Parse(cfg.URL)
+	if parseErr != nil || (directory.Scheme != "ldap" && directory.Scheme != "ldaps") {
+		return nil, fmt.Errorf("ldap.url %q must be an ldap:// or ldaps:// URL", cfg.URL)
+	}
+	s := &ldapStore{cfg: cfg, attrs: cfg.Attributes.withDefaults(), events: NewMemory()}
+	s.filter = "(objectClass=*)"
+	if cfg.UserFilter != "" {
+		if _, filterErr := ldap.CompileFilter(cfg.UserFilter); filterErr != nil {
+			return nil, fmt.Errorf("ldap.user_filter: %w", filterErr)
+		}
+		s.filter = cfg.UserFilter
+	}
+	s.tls = &tls.Config{ServerName: cfg.TLSServerName}
+	if s.tls.ServerName == "" {
+		s.tls.ServerName = directory.Hostname()
+	}
+	if cfg.TLSCAFile != "" {
+		pem, readErr := os.ReadFile(cfg.TLSCAFile)
+		if readErr != nil {
+			return nil, fmt.Errorf("ldap.tls_ca_file: %w", readErr)
+		}
+		s.tls.RootCAs = x509.NewCertPool()
+		if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap.tls_ca_file: no certificates in %s", cfg.TLSCAFile)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connectErr := s.connect(ctx); connectErr != nil {
+		return nil, connectErr
+	}
+	return s, nil
+}
+
+// withDefaults fills the empty names in with those of DefaultLDAPAttributes
+func (a LDAPAttributes) withDefaults() LDAPAttributes {
+	pick := func(name, fallback string) string {
+		if name == "" {
+			return fallback
+		}
+		return name
+	}
+	d := DefaultLDAPAttributes
+	return LDAPAttributes{
+		UserName:         pick(a.UserName, d.UserName),
+		CryptoCommitment: pick(a.CryptoCommitment, d.CryptoCommitment),
+		Salt:             pick(a.Salt, d.Salt),
+		KDF:              pick(a.KDF, d.KDF),
+		CircuitVersion:   pick(a.CircuitVersion, d.CircuitVersion),
+		Curve:            pick(a.Curve, d.Curve),
+		KeyID:            pick(a.KeyID, d.KeyID),
+		CreatedAt:        pick(a.CreatedAt, d.CreatedAt),
+		Tenant:           pick(a.Tenant, d.Tenant),
+		Devices:          pick(a.Devices, d.Devices),
+		Recovery:         pick(a.Recovery, d.Recovery),
+		ExpiresAt:        pick(a.ExpiresAt, d.ExpiresAt),
+		ExpiredAt:        pick(a.ExpiredAt, d.ExpiredAt),
+		DIDKey:           pick(a.DIDKey, d.DIDKey),
+		TOTP:             pick(a.TOTP, d.TOTP),
+		WebAuthn:         pick(a.WebAuthn, d.WebAuthn),
+		Legacy:           pick(a.Legacy, d.Legacy),
+		DeletedAt:        pick(a.DeletedAt, d.DeletedAt),
+	}
+}
+
+// connect dials, secures and binds a fresh connection
+func (s *ldapStore) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Deadline: operationDeadline(ctx)}
+	conn, dialErr := ldap.DialURL(s.cfg.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(s.tls))
+	if dialErr != nil {
+		return dialErr
+	}
+	conn.SetTimeout(time.Until(operationDeadline(ctx)))
+	if s.cfg.StartTLS {
+		if tlsErr := conn.StartTLS(s.tls); tlsErr != nil {
+			conn.Close()
+			return tlsErr
+		}
+	}
+	if bindErr := conn.Bind(s.cfg.BindDN, s.cfg.BindPassword); bindErr != nil {
+		conn.Close()
+		return bindErr
+	}
+	s.conn = conn
+	return nil
+}
+
+// operationDeadline is the context's deadline, or ldapTimeout from now
+func operationDeadline(ctx context.Context) time.Time {
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		return deadline
+	}
+	return time.Now().Add(ldapTimeout)
+}
+
+// do runs op on the connection under mu, connecting first if needed. When the connection itself
+// fails, as when the directory restarted, op is retried once on a new one; results the directory
+// returned are not retried.
+func (s *ldapStore) do(ctx context.Context, op func(conn *ldap.Conn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 1; ; attempt++ {
+		if s.conn == nil {
+			if connectErr := s.connect(ctx); connectErr != nil {
+				return connectErr
+			}
+		}
+		s.conn.SetTimeout(time.Until(operationDeadline(ctx)))
+		opErr := op(s.conn)
+		if !connectionFailed(s.conn, opErr) {
+			return opErr
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt == 2 {
+			return opErr
+		}
+	}
+}
+
+// connectionFailed reports whether err came from the connection rather than from the directory.
+// Once the connection broke go-ldap reports the read error as text, so a closing conn counts too.
+func connectionFailed(conn *ldap.Conn, err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || conn.IsClosing()
+}
+
+// search returns the entries under ldap.base_dn matching both ldap.user_filter and filter
+func (s *ldapStore) search(conn *ldap.Conn, filter string, sizeLimit int) ([]*ldap.Entry, error) {
+	result, searchErr := conn.Search(ldap.NewSearchRequest(
+		s.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, sizeLimit, 0, false,
+		"(&"+s.filter+filter+")", s.attributeNames(), nil,
+	))
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	return result.Entries, nil
+}
+
+// find returns the entry of a user, or ErrNoDirectoryEntry
+func (s *ldapStore) find(conn *ldap.Conn, userName string) (*ldap.Entry, error) {
+	entries, searchErr := s.search(conn, "("+s.attrs.UserName+"="+ldap.EscapeFilter(userName)+")", 2)
+	switch {
+	case ldap.IsErrorWithCode(searchErr, ldap.LDAPResultSizeLimitExceeded) || len(entries) > 1:
+		return nil, fmt.Errorf("several directory entries have %s=%s", s.attrs.UserName, userName)
+	case searchErr != nil:
+		return nil, searchErr
+	case len(entries) == 0:
+		return nil, ErrNoDirectoryEntry
+	}
+	return entries[0], nil
+}
+
+// modify replaces attributes of the entry dn, removing those given no values
+func modify(conn *ldap.Conn, dn string, attributes []ldap.PartialAttribute) error {
+	request := ldap.NewModifyRequest(dn, nil)
+	for _, attribute := range attributes {
+		request.Replace(attribute.Type, attribute.Vals)
+	}
+	return conn.Modify(request)
+}
+
+// attributeNames lists every attribute the store reads
+func (s *ldapStore) attributeNames() []string {
+	return []string{s.attrs.UserName, s.attrs.CryptoCommitment, s.attrs.Salt, s.attrs.KDF, s.attrs.CircuitVersion, s.attrs.Curve, s.attrs.KeyID, s.attrs.CreatedAt, s.attrs.Tenant, s.attrs.Devices, s.attrs.Recovery, s.attrs.ExpiresAt, s.attrs.ExpiredAt, s.attrs.DIDKey, s.attrs.TOTP, s.attrs.WebAuthn, s.attrs.Legacy, s.attrs.DeletedAt}
+}
+
+// registered reports whether an entry holds a registration, or the legacy password of a pending one
+func (s *ldapStore) registered(entry *ldap.Entry) bool {
+	return entry.GetEqualFoldAttributeValue(s.attrs.CryptoCommitment) != "" || entry.GetEqualFoldAttributeValue(s.attrs.Legacy) != ""
+}
+
+// decodeUser reads the registration of an entry
+func (s *ldapStore) decodeUser(entry *ldap.Entry) (User, error) {
+	user := User{
+		UserName:         entry.GetEqualFoldAttributeValue(s.attrs.UserName),
+		Tenant:           entry.GetEqualFoldAttributeValue(s.attrs.Tenant),
+		CryptoCommitment: entry.GetEqualFoldAttributeValue(s.attrs.CryptoCommitment),
+		CircuitVersion:   entry.GetEqualFoldAttributeValue(s.attrs.CircuitVersion),
+		Curve:            entry.GetEqualFoldAttributeValue(s.attrs.Curve),
+		KeyID:            entry.GetEqualFoldAttributeValue(s.attrs.KeyID),
+		DIDKey:           entry.GetEqualFoldAttributeValue(s.attrs.DIDKey),
+	}
+	if salt := entry.GetEqualFoldAttributeValue(s.attrs.Salt); salt != "" {
+		decoded, decodeErr := base64.StdEncoding.DecodeString(salt)
+		if decodeErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.Salt, entry.DN, decodeErr)
+		}
+		user.Salt = decoded
+	}
+	if kdf := entry.GetEqualFoldAttributeValue(s.attrs.KDF); kdf != "" {
+		user.KDF = new(secret.KDFParams)
+		if kdfErr := json.Unmarshal([]byte(kdf), user.KDF); kdfErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.KDF, entry.DN, kdfErr)
+		}
+	}
+	for _, encoded := range entry.GetEqualFoldAttributeValues(s.attrs.Devices) {
+		var device Device
+		if deviceErr := json.Unmarshal([]byte(encoded), &device); deviceErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.Devices, entry.DN, deviceErr)
+		}
+		user.Devices = append(user.Devices, device)
+	}
+	if recovery := entry.GetEqualFoldAttributeValue(s.attrs.Recovery); recovery != "" {
+		user.Recovery = new(Recovery)
+		if recoveryErr := json.Unmarshal([]byte(recovery), user.Recovery); recoveryErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.Recovery, entry.DN, recoveryErr)
+		}
+	}
+	if totp := entry.GetEqualFoldAttributeValue(s.attrs.TOTP); totp != "" {
+		user.TOTP = new(TOTP)
+		if totpErr := json.Unmarshal([]byte(totp), user.TOTP); totpErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.TOTP, entry.DN, totpErr)
+		}
+	}
+	if webauthn := entry.GetEqualFoldAttributeValue(s.attrs.WebAuthn); webauthn != "" {
+		user.WebAuthn = new(WebAuthnCredential)
+		if webauthnErr := json.Unmarshal([]byte(webauthn), user.WebAuthn); webauthnErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.WebAuthn, entry.DN, webauthnErr)
+		}
+	}
+	if legacy := entry.GetEqualFoldAttributeValue(s.attrs.Legacy); legacy != "" {
+		user.Legacy = new(LegacyPassword)
+		if legacyErr := json.Unmarshal([]byte(legacy), user.Legacy); legacyErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.Legacy, entry.DN, legacyErr)
+		}
+	}
+	createdAt, parseErr := time.Parse(generalizedTime, entry.GetEqualFoldAttributeValue(s.attrs.CreatedAt))
+	if parseErr != nil {
+		return User{}, fmt.Errorf("parsing %s of %q: %w", s.attrs.CreatedAt, entry.DN, parseErr)
+	}
+	user.CreatedAt = createdAt
+	for _, attribute := range []struct {
+		name string
+		dst  **time.Time
+	}{{s.attrs.ExpiresAt, &user.ExpiresAt}, {s.attrs.ExpiredAt, &user.ExpiredAt}, {s.attrs.DeletedAt, &user.DeletedAt}} {
+		value := entry.GetEqualFoldAttributeValue(attribute.name)
+		if value == "" {
+			continue
+		}
+		parsed, parseErr := time.Parse(generalizedTime, value)
+		if parseErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", attribute.name, entry.DN, parseErr)
+		}
+		*attribute.dst = &parsed
+	}
+	return user, nil
+}
+
+// encodeUser replaces every registration attribute of an entry with those of user
+func (s *ldapStore) encodeUser(user User) ([]ldap.PartialAttribute, error) {
+	var salt, kdf, recovery, totp, webauthn, legacy []string
+	if len(user.Salt) > 0 {
+		salt = []string{base64.StdEncoding.EncodeToString(user.Salt)}
+	}
+	if user.KDF != nil {
+		encoded, encodeErr := json.Marshal(user.KDF)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		kdf = []string{string(encoded)}
+	}
+	var devices []string
+	for _, device := range user.Devices {
+		encoded, encodeErr := json.Marshal(device)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		devices = append(devices, string(encoded))
+	}
+	if user.Recovery != nil {
+		encoded, encodeErr := json.Marshal(user.Recovery)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		recovery = []string{string(encoded)}
+	}
+	if user.TOTP != nil {
+		encoded, encodeErr := json.Marshal(user.TOTP)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		totp = []string{string(encoded)}
+	}
+	if user.WebAuthn != nil {
+		encoded, encodeErr := json.Marshal(user.WebAuthn)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		webauthn = []string{string(encoded)}
+	}
+	if user.Legacy != nil {
+		encoded, encodeErr := json.Marshal(user.Legacy)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		legacy = []string{string(encoded)}
+	}
+	optional := func(value string) []string {
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	}
+	optionalTime := func(t *time.Time) []string {
+		if t == nil {
+			return nil
+		}
+		return []string{t.UTC().Format(generalizedTime)}
+	}
+	return []ldap.PartialAttribute{
+		{Type: s.attrs.CryptoCommitment, Vals: optional(user.CryptoCommitment)},
+		{Type: s.attrs.Salt, Vals: salt},
+		{Type: s.attrs.KDF, Vals: kdf},
+		{Type: s.attrs.CircuitVersion, Vals: optional(user.CircuitVersion)},
+		{Type: s.attrs.Curve, Vals: optional(user.Curve)},
+		{Type: s.attrs.KeyID, Vals: optional(user.KeyID)},
+		{Type: s.attrs.CreatedAt, Vals: []string{user.CreatedAt.UTC().Format(generalizedTime)}},
+		{Type: s.attrs.Tenant, Vals: optional(user.Tenant)},
+		{Type: s.attrs.Devices, Vals: devices},
+		{Type: s.attrs.Recovery, Vals: recovery},
+		{Type: s.attrs.ExpiresAt, Vals: optionalTime(user.ExpiresAt)},
+		{Type: s.attrs.ExpiredAt, Vals: optionalTime(user.ExpiredAt)},
+		{Type: s.attrs.DIDKey, Vals: optional(user.DIDKey)},
+		{Type: s.attrs.TOTP, Vals: totp},
+		{Type: s.attrs.WebAuthn, Vals: webauthn},
+		{Type: s.attrs.Legacy, Vals: legacy},
+		{Type: s.attrs.DeletedAt, Vals: optionalTime(user.DeletedAt)},
+	}, nil
+}
+
+// clearUser removes every registration attribute of an entry
+func (s *ldapStore) clearUser() []ldap.PartialAttribute {
+	names := s.attributeNames()[1:]
+	changes := make([]ldap.PartialAttribute, len(names))
+	for i, name := range names {
+		changes[i] = ldap.PartialAttribute{Type: name}
+	}
+	return changes
+}
+
+func (s *ldapStore) CreateUser(ctx context.Context, user User) error {
+	changes, encodeErr := s.encodeUser(user)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return s.do(ctx, func(conn *ldap.Conn) error {
+		entry, findErr := s.find(conn, user.UserName)
+		if findErr != nil {
+			return findErr
+		}
+		if s.registered(entry) {
+			return ErrUserExists
+		}
+		return modify(conn, entry.DN, changes)
+	})
+}
+
+// CreateUsers checks the whole batch before writing any of it. A directory offers no transaction
+// across entries, so when a write still fails the ones before it are undone on a best-effort basis.
+func (s *ldapStore) CreateUsers(ctx context.Context, users []User) error {
+	changes := make([][]ldap.PartialAttribute, len(users))
+	for i, user := range users {
+		encoded, encodeErr := s.encodeUser(user)
+		if encodeErr != nil {
+			return &BatchError{Index: i, Err: encodeErr}
+		}
+		changes[i] = encoded
+	}
+	return s.do(ctx, func(conn *ldap.Conn) error {
+		dns := make([]string, len(users))
+		for i, user := range users {
+			entry, findErr := s.find(conn, user.UserName)
+			if findErr != nil {
+				return &BatchError{Index: i, Err: findErr}
+			}
+			if s.registered(entry) || slices.Contains(dns[:i], entry.DN) {
+				return &BatchError{Index: i, Err: ErrUserExists}
+			}
+			dns[i] = entry.DN
+		}
+		for i, dn := range dns {
+			if modifyErr := modify(conn, dn, changes[i]); modifyErr != nil {
+				for _, written := range dns[:i] {
+					modify(conn, written, s.clearUser())
+				}
+				return &BatchError{Index: i, Err: modifyErr}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ldapStore) PutUser(ctx context.Context, user User) error {
+	changes, encodeErr := s.encodeUser(user)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return s.do(ctx, func(conn *ldap.Conn) error {
+		entry, findErr := s.find(conn, user.UserName)
+		if findErr != nil {
+			return findErr
+		}
+		return modify(conn, entry.DN, changes)
+	})
+}
+
+func (s *ldapStore) GetUser(ctx context.Context, userName string) (User, error) {
+	var user User
+	getErr := s.do(ctx, func(conn *ldap.Conn) error {
+		entry, findErr := s.find(conn, userName)
+		switch {
+		case errors.Is(findErr, ErrNoDirectoryEntry):
+			return ErrUserNotFound
+		case findErr != nil:
+			return findErr
+		case !s.registered(entry):
+			return ErrUserNotFound
+		}
+		decoded, decodeErr := s.decodeUser(entry)
+		user = decoded
+		return decodeErr
+	})
+	return user, getErr
+}
+
+func (s *ldapStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	return s.do(ctx, func(conn *ldap.Conn) error {
+		entry, findErr := s.find(conn, userName)
+		switch {
+		case errors.Is(findErr, ErrNoDirectoryEntry):
+			return ErrUserNotFound
+		case findErr != nil:
+			return findErr
+		case !s.registered(entry):
+			return ErrUserNotFound
+		}
+		current := entry.GetEqualFoldAttributeValue(s.attrs.TOTP)
+		if current == "" {
+			return ErrTOTPStepUsed
+		}
+		var totp TOTP
+		if decodeErr := json.Unmarshal([]byte(current), &totp); decodeErr != nil {
+			return fmt.Errorf("parsing %s of %q: %w", s.attrs.TOTP, entry.DN, decodeErr)
+		}
+		if totp.LastStep >= step {
+			return ErrTOTPStepUsed
+		}
+		totp.LastStep = step
+		advanced, _ := json.Marshal(totp)
+		// Deleting the value read fails with noSuchAttribute if another writer changed it since
+		request := ldap.NewModifyRequest(entry.DN, nil)
+		request.Delete(s.attrs.TOTP, []string{current})
+		request.Add(s.attrs.TOTP, []string{string(advanced)})
+		modifyErr := conn.Modify(request)
+		if ldap.IsErrorWithCode(modifyErr, ldap.LDAPResultNoSuchAttribute) {
+			return ErrTOTPStepUsed
+		}
+		return modifyErr
+	})
+}
+
+func (s *ldapStore) DeleteUser(ctx context.Context, userName string) error {
+	return s.do(ctx, func(conn *ldap.Conn) error {
+		entry, findErr := s.find(conn, userName)
+		switch {
+		case errors.Is(findErr, ErrNoDirectoryEntry):
+			return ErrUserNotFound
+		case findErr != nil:
+			return findErr
+		case !s.registered(entry):
+			return ErrUserNotFound
+		}
+		return modify(conn, entry.DN, s.clearUser())
+	})
+}
+
+func (s *ldapStore) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	listErr := s.do(ctx, func(conn *ldap.Conn) error {
+		entries, searchErr := s.search(conn, "(|("+s.attrs.CryptoCommitment+"=*)("+s.attrs.Legacy+"=*))", 0)
+		if searchErr != nil {
+			return searchErr
+		}
+		users = make([]User, 0, len(entries))
+		for _, entry := range entries {
+			user, decodeErr := s.decodeUser(entry)
+			if decodeErr != nil {
+				return decodeErr
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.UserName, b.UserName) })
+	return users, listErr
+}
+
+func (s *ldapStore) RecordEvents(ctx context.Context, events []Event) error {
+	return s.events.RecordEvents(ctx, events)
+}
+
+func (s *ldapStore) ListEvents(ctx context.Context, from, to time.Time) ([]Event, error) {
+	return s.events.ListEvents(ctx, from, to)
+}
+
+func (s *ldapStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	return s.events.PruneEvents(ctx, before)
+}
+
+func (s *ldapStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	return s.events.AppendRevocations(ctx, revocations)
+}
+
+func (s *ldapStore) ListRevocations(ctx context.Context, after uint64) ([]Revocation, error) {
+	return s.events.ListRevocations(ctx, after)
+}
+
+func (s *ldapStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	return s.events.PutRefreshToken(ctx, token)
+}
+
+func (s *ldapStore) GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	return s.events.GetRefreshToken(ctx, hash)
+}
+
+func (s *ldapStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	return s.events.RotateRefreshToken(ctx, hash, next)
+}
+
+func (s *ldapStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	return s.events.RevokeRefreshFamily(ctx, family)
+}
+
+func (s *ldapStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	return s.events.DeleteUserRefreshTokens(ctx, userName)
+}
+
+func (s *ldapStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	return s.events.PruneRefreshTokens(ctx, before)
+}
+
+func (s *ldapStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	return s.events.RevokeSessions(ctx, revocation)
+}
+
+func (s *ldapStore) SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error) {
+	return s.events.SessionRevoked(ctx, userName, tokenID, issuedAt)
+}
+
+func (s *ldapStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	return s.events.PruneSessionRevocations(ctx, before)
+}
+
+func (s *ldapStore) RecordSession(ctx context.Context, session Session) error {
+	return s.events.RecordSession(ctx, session)
+}
+
+func (s *ldapStore) CountSessions(ctx context.Context, userName string, at time.Time) (int, error) {
+	return s.events.CountSessions(ctx, userName, at)
+}
+
+func (s *ldapStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	return s.events.PruneSessions(ctx, before)
+}
+
+func (s *ldapStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	return s.events.PutAuthPolicy(ctx, policy)
+}
+
+func (s *ldapStore) GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error) {
+	return s.events.GetAuthPolicy(ctx, tenant, userName)
+}
+
+func (s *ldapStore) ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error) {
+	return s.events.ListAuthPolicies(ctx)
+}
+
+func (s *ldapStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	return s.events.DeleteAuthPolicy(ctx, tenant, userName)
+}
+
+func (s *ldapStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	return s.events.PutAPIKey(ctx, key)
+}
+
+func (s *ldapStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	return s.events.GetAPIKey(ctx, id)
+}
+
+func (s *ldapStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return s.events.ListAPIKeys(ctx)
+}
+
+func (s *ldapStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.events.DeleteAPIKey(ctx, id)
+}
+
+func (s *ldapStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	return s.events.AddUsage(ctx, keyID, tenant, day, requests)
+}
+
+func (s *ldapStore) ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+	return s.events.ListUsage(ctx, from, to)
+}
+
+func (s *ldapStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	return s.events.RecordTranscript(ctx, transcript)
+}
+
+func (s *ldapStore) GetTranscript(ctx context.Context, id string) (Transcript, error) {
+	return s.events.GetTranscript(ctx, id)
+}
+
+func (s *ldapStore) ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	return s.events.ListTranscripts(ctx, userName, from, to)
+}
+
+func (s *ldapStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	return s.events.PruneTranscripts(ctx, before)
+}
+
+func (s *ldapStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	return s.events.DeleteUserTranscripts(ctx, userName)
+}
+
+func (s *ldapStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	closeErr := s.conn.Close()
+	s.conn = nil
+	return closeErr
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrReadOnly is returned by every write to a store opened read-only, such as a read replica
+var ErrReadOnly = errors.New("the store is read-only")
+
+// readOnlyStore wraps another Store, passing reads through and refusing writes with ErrReadOnly,
+// so nothing a read replica serves can write to the store it shares with the primary
+type readOnlyStore struct {
+	Store
+}
+
+// NewReadOnly returns a Store serving the reads of inner and refusing its writes
+func NewReadOnly(inner Store) Store {
+	return &readOnlyStore{Store: inner}
+}
+
+func (s *readOnlyStore) CreateUser(ctx context.Context, user User) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) CreateUsers(ctx context.Context, users []User) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PutUser(ctx context.Context, user User) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) DeleteUser(ctx context.Context, userName string) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) RecordEvents(ctx context.Context, events []Event) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *readOnlyStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *readOnlyStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStore) RecordSession(ctx context.Context, session Session) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	return Usage{}, ErrReadOnly
+}
+
+func (s *readOnlyStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	return ErrReadOnly
+}
+
+func (s *readOnlyStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	return nil, ErrReadOnly
+}
@@ -0,0 +1,1004 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTxAttempts bounds how often a transaction runs again after a key it watched changed
+const maxTxAttempts = 10
+
+// redisStore is a Store kept in Redis, so every replica of the server sees the same state. Each
+// record is JSON under its own key, with sets and sorted sets indexing them; changes spanning
+// several keys run as MULTI/EXEC transactions, watching the keys they read first.
+//
+// Keys, after the prefix:
+//
+//	user:<name>               a registration; users is the set of names
+//	events                    events, scored by their time in milliseconds
+//	revocations               the revocation log, scored by sequence; revocations:last is the last sequence
+//	refresh:<hash>            a refresh token; refresh-family:<family> and refresh-user:<name> are sets of
+//	                          hashes and refresh-expiry scores the hashes by expiry
+//	session-token:<id>        a revocation of one session; session-user:<name> scores the revocations of
+//	                          all of a user's sessions by their time and sessions scores both kinds by expiry
+//	session-issued:<name>     the sessions issued to a user, scored by expiry; sessions-issued scores
+//	                          every user's by expiry
+//	apikey:<id>               an API key; apikeys is the set of IDs
+//	auth-policy:<key>         an authentication policy, keyed by authPolicyKey; auth-policies is the set of keys
+//	transcript:<id>           a proof transcript; transcripts scores the IDs by verification time and
+//	                          transcripts-user:<name> scores a user's
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// OpenRedis returns a store keeping its data in Redis under keys starting with prefix. Closing
+// the store closes the client.
+func OpenRedis(client *redis.Client, prefix string) Store {
+	return &redisStore{client: client, prefix: prefix}
+}
+
+// key joins the prefix and the parts of a key
+func (s *redisStore) key(parts ...string) string {
+	return s.prefix + strings.Join(parts, ":")
+}
+
+// millis is a time as a bound of a range of sorted set scores
+func millis(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// score is a time as the score of a sorted set
+func score(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// nonce returns a random value that keeps equal entries of a sorted set apart
+func nonce() string {
+	value := make([]byte, 8)
+	rand.Read(value)
+	return hex.EncodeToString(value)
+}
+
+// watch runs fn in a transaction watching keys, starting over while a watched key changes before
+// the commands fn queues are executed
+func (s *redisStore) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		watchErr := s.client.Watch(ctx, fn, keys...)
+		if !errors.Is(watchErr, redis.TxFailedErr) || attempt == maxTxAttempts {
+			return watchErr
+		}
+	}
+}
+
+// getJSON decodes the value a GET returned into v, reporting false for a missing key
+func getJSON(get *redis.StringCmd, v any) (bool, error) {
+	value, getErr := get.Result()
+	if errors.Is(getErr, redis.Nil) {
+		return false, nil
+	}
+	if getErr != nil {
+		return false, getErr
+	}
+	if decodeErr := json.Unmarshal([]byte(value), v); decodeErr != nil {
+		return false, fmt.Errorf("decode redis value: %w", decodeErr)
+	}
+	return true, nil
+}
+
+// mget returns the values of keys, empty for those missing
+func mget(ctx context.Context, c redis.Cmdable, keys []string) ([]string, error) {
+	values, getErr := c.MGet(ctx, keys...).Result()
+	if getErr != nil {
+		return nil, getErr
+	}
+	texts := make([]string, len(values))
+	for i, value := range values {
+		texts[i], _ = value.(string)
+	}
+	return texts, nil
+}
+
+// encode returns v as JSON
+func encode(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func (s *redisStore) CreateUser(ctx context.Context, user User) error {
+	createErr := s.CreateUsers(ctx, []User{user})
+	var batchErr *BatchError
+	if errors.As(createErr, &batchErr) {
+		return batchErr.Err
+	}
+	return createErr
+}
+
+func (s *redisStore) CreateUsers(ctx context.Context, users []User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	keys := make([]string, len(users))
+	for i, user := range users {
+		keys[i] = s.key("user", user.UserName)
+	}
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		taken, mgetErr := mget(ctx, tx, keys)
+		if mgetErr != nil {
+			return mgetErr
+		}
+		batch := make(map[string]bool, len(users))
+		for i, user := range users {
+			if taken[i] != "" || batch[user.UserName] {
+				return &BatchError{Index: i, Err: ErrUserExists}
+			}
+			batch[user.UserName] = true
+		}
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, user := range users {
+				pipe.Set(ctx, keys[i], encode(user), 0)
+				pipe.SAdd(ctx, s.key("users"), user.UserName)
+			}
+			return nil
+		})
+		return execErr
+	}, keys...)
+}
+
+func (s *redisStore) PutUser(ctx context.Context, user User) error {
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key("user", user.UserName), encode(user), 0)
+		pipe.SAdd(ctx, s.key("users"), user.UserName)
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) GetUser(ctx context.Context, userName string) (User, error) {
+	var user User
+	found, getErr := getJSON(s.client.Get(ctx, s.key("user", userName)), &user)
+	if getErr != nil {
+		return User{}, getErr
+	}
+	if !found {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *redisStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	key := s.key("user", userName)
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		var user User
+		found, getErr := getJSON(tx.Get(ctx, key), &user)
+		switch {
+		case getErr != nil:
+			return getErr
+		case !found:
+			return ErrUserNotFound
+		case user.TOTP == nil || user.TOTP.LastStep >= step:
+			return ErrTOTPStepUsed
+		}
+		totp := *user.TOTP
+		totp.LastStep = step
+		user.TOTP = &totp
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encode(user), 0)
+			return nil
+		})
+		return execErr
+	}, key)
+}
+
+func (s *redisStore) DeleteUser(ctx context.Context, userName string) error {
+	var deleted *redis.IntCmd
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, s.key("user", userName))
+		pipe.SRem(ctx, s.key("users"), userName)
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+	if deleted.Val() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *redisStore) ListUsers(ctx context.Context) ([]User, error) {
+	names, listErr := s.client.SMembers(ctx, s.key("users")).Result()
+	if listErr != nil {
+		return nil, listErr
+	}
+	users := make([]User, 0, len(names))
+	if len(names) == 0 {
+		return users, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = s.key("user", name)
+	}
+	values, getErr := mget(ctx, s.client, keys)
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, value := range values {
+		if value == "" {
+			continue // deleted since SMEMBERS
+		}
+		var user User
+		if decodeErr := json.Unmarshal([]byte(value), &user); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis value: %w", decodeErr)
+		}
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.UserName, b.UserName) })
+	return users, nil
+}
+
+// redisEvent is an event as a member of the events sorted set; Nonce keeps equal events apart
+type redisEvent struct {
+	Event Event  `json:"event"`
+	Nonce string `json:"nonce"`
+}
+
+func (s *redisStore) RecordEvents(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	members := make([]redis.Z, len(events))
+	for i, event := range events {
+		members[i] = redis.Z{Score: score(event.At), Member: encode(redisEvent{Event: event, Nonce: nonce()})}
+	}
+	return s.client.ZAdd(ctx, s.key("events"), members...).Err()
+}
+
+// eventsBetween returns the members of the events sorted set scored within the milliseconds of
+// from and to, with the events they hold
+func (s *redisStore) eventsBetween(ctx context.Context, from, to string) ([]string, []Event, error) {
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("events"), &redis.ZRangeBy{Min: from, Max: to}).Result()
+	if rangeErr != nil {
+		return nil, nil, rangeErr
+	}
+	events := make([]Event, len(members))
+	for i, member := range members {
+		var stored redisEvent
+		if decodeErr := json.Unmarshal([]byte(member), &stored); decodeErr != nil {
+			return nil, nil, fmt.Errorf("decode redis event: %w", decodeErr)
+		}
+		events[i] = stored.Event
+	}
+	return members, events, nil
+}
+
+func (s *redisStore) ListEvents(ctx context.Context, from, to time.Time) ([]Event, error) {
+	_, candidates, listErr := s.eventsBetween(ctx, millis(from), millis(to))
+	if listErr != nil {
+		return nil, listErr
+	}
+	var events []Event
+	for _, event := range candidates {
+		if !event.At.Before(from) && event.At.Before(to) {
+			events = append(events, event)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b Event) int { return a.At.Compare(b.At) })
+	return events, nil
+}
+
+func (s *redisStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	members, events, listErr := s.eventsBetween(ctx, "-inf", millis(before))
+	if listErr != nil {
+		return 0, listErr
+	}
+	var stale []any
+	for i, event := range events {
+		if event.At.Before(before) {
+			stale = append(stale, members[i])
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	pruned, removeErr := s.client.ZRem(ctx, s.key("events"), stale...).Result()
+	return int(pruned), removeErr
+}
+
+func (s *redisStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	last := s.key("revocations", "last")
+	appended := make([]Revocation, len(revocations))
+	txErr := s.watch(ctx, func(tx *redis.Tx) error {
+		value, getErr := tx.Get(ctx, last).Result()
+		if getErr != nil && !errors.Is(getErr, redis.Nil) {
+			return getErr
+		}
+		sequence, _ := strconv.ParseUint(value, 10, 64)
+		members := make([]redis.Z, len(revocations))
+		for i, revocation := range revocations {
+			revocation.Sequence = sequence + uint64(i) + 1
+			appended[i] = revocation
+			members[i] = redis.Z{Score: float64(revocation.Sequence), Member: encode(revocation)}
+		}
+		if len(revocations) == 0 {
+			return nil
+		}
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, s.key("revocations"), members...)
+			pipe.Set(ctx, last, strconv.FormatUint(sequence+uint64(len(revocations)), 10), 0)
+			return nil
+		})
+		return execErr
+	}, last)
+	if txErr != nil {
+		return nil, txErr
+	}
+	return appended, nil
+}
+
+func (s *redisStore) ListRevocations(ctx context.Context, after uint64) ([]Revocation, error) {
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("revocations"), &redis.ZRangeBy{Min: "(" + strconv.FormatUint(after, 10), Max: "+inf"}).Result()
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	var revocations []Revocation
+	for _, member := range members {
+		var revocation Revocation
+		if decodeErr := json.Unmarshal([]byte(member), &revocation); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis revocation: %w", decodeErr)
+		}
+		revocations = append(revocations, revocation)
+	}
+	return revocations, nil
+}
+
+// queueRefreshToken queues the commands storing a refresh token and indexing it
+func (s *redisStore) queueRefreshToken(ctx context.Context, pipe redis.Pipeliner, token RefreshToken) {
+	pipe.Set(ctx, s.key("refresh", token.Hash), encode(token), 0)
+	pipe.SAdd(ctx, s.key("refresh-family", token.Family), token.Hash)
+	pipe.SAdd(ctx, s.key("refresh-user", token.UserName), token.Hash)
+	pipe.ZAdd(ctx, s.key("refresh-expiry"), redis.Z{Score: score(token.ExpiresAt), Member: token.Hash})
+}
+
+// queueRefreshDeletion queues the commands removing a refresh token and its index entries
+func (s *redisStore) queueRefreshDeletion(ctx context.Context, pipe redis.Pipeliner, token RefreshToken) {
+	pipe.Del(ctx, s.key("refresh", token.Hash))
+	pipe.SRem(ctx, s.key("refresh-family", token.Family), token.Hash)
+	pipe.SRem(ctx, s.key("refresh-user", token.UserName), token.Hash)
+	pipe.ZRem(ctx, s.key("refresh-expiry"), token.Hash)
+}
+
+// refreshTokens reads the refresh tokens stored under hashes within a transaction, skipping those gone
+func (s *redisStore) refreshTokens(ctx context.Context, tx *redis.Tx, hashes []string) ([]RefreshToken, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	values, getErr := mget(ctx, tx, s.refreshKeys(hashes))
+	if getErr != nil {
+		return nil, getErr
+	}
+	var tokens []RefreshToken
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		var token RefreshToken
+		if decodeErr := json.Unmarshal([]byte(value), &token); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis refresh token: %w", decodeErr)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// refreshKeys returns the keys of the refresh tokens stored under hashes, for a transaction to watch
+func (s *redisStore) refreshKeys(hashes []string) []string {
+	keys := make([]string, len(hashes))
+	for i, hash := range hashes {
+		keys[i] = s.key("refresh", hash)
+	}
+	return keys
+}
+
+func (s *redisStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.queueRefreshToken(ctx, pipe, token)
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	var token RefreshToken
+	found, getErr := getJSON(s.client.Get(ctx, s.key("refresh", hash)), &token)
+	if getErr != nil {
+		return RefreshToken{}, getErr
+	}
+	if !found {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *redisStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	key := s.key("refresh", hash)
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		var token RefreshToken
+		found, getErr := getJSON(tx.Get(ctx, key), &token)
+		switch {
+		case getErr != nil:
+			return getErr
+		case !found:
+			return ErrRefreshTokenNotFound
+		case token.RotatedAt != nil:
+			return ErrRefreshTokenRotated
+		}
+		rotatedAt := next.IssuedAt
+		token.RotatedAt = &rotatedAt
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encode(token), 0)
+			s.queueRefreshToken(ctx, pipe, next)
+			return nil
+		})
+		return execErr
+	}, key)
+}
+
+func (s *redisStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	hashes, listErr := s.client.SMembers(ctx, s.key("refresh-family", family)).Result()
+	if listErr != nil {
+		return listErr
+	}
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		tokens, getErr := s.refreshTokens(ctx, tx, hashes)
+		if getErr != nil {
+			return getErr
+		}
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, token := range tokens {
+				if token.RotatedAt == nil {
+					s.queueRefreshDeletion(ctx, pipe, token)
+				}
+			}
+			return nil
+		})
+		return execErr
+	}, s.refreshKeys(hashes)...)
+}
+
+func (s *redisStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	hashes, listErr := s.client.SMembers(ctx, s.key("refresh-user", userName)).Result()
+	if listErr != nil {
+		return nil, listErr
+	}
+	var deleted []string
+	txErr := s.watch(ctx, func(tx *redis.Tx) error {
+		tokens, getErr := s.refreshTokens(ctx, tx, hashes)
+		if getErr != nil {
+			return getErr
+		}
+		deleted = nil
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, token := range tokens {
+				s.queueRefreshDeletion(ctx, pipe, token)
+				deleted = append(deleted, token.Hash)
+			}
+			return nil
+		})
+		return execErr
+	}, s.refreshKeys(hashes)...)
+	if txErr != nil {
+		return nil, txErr
+	}
+	slices.Sort(deleted)
+	return deleted, nil
+}
+
+func (s *redisStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	hashes, listErr := s.client.ZRangeByScore(ctx, s.key("refresh-expiry"), &redis.ZRangeBy{Min: "-inf", Max: millis(before)}).Result()
+	if listErr != nil {
+		return 0, listErr
+	}
+	pruned := 0
+	txErr := s.watch(ctx, func(tx *redis.Tx) error {
+		tokens, getErr := s.refreshTokens(ctx, tx, hashes)
+		if getErr != nil {
+			return getErr
+		}
+		pruned = 0
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, token := range tokens {
+				if token.ExpiresAt.Before(before) {
+					s.queueRefreshDeletion(ctx, pipe, token)
+					pruned++
+				}
+			}
+			return nil
+		})
+		return execErr
+	}, s.refreshKeys(hashes)...)
+	if txErr != nil {
+		return 0, txErr
+	}
+	return pruned, nil
+}
+
+func (s *redisStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	index := s.key("transcripts-user", userName)
+	ids, rangeErr := s.client.ZRange(ctx, index, 0, -1).Result()
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Del(ctx, s.key("transcript", id))
+			pipe.ZRem(ctx, s.key("transcripts"), id)
+		}
+		pipe.Del(ctx, index)
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// redisSessionRevocation is a session revocation as a member of a sorted set; Nonce keeps equal
+// revocations apart
+type redisSessionRevocation struct {
+	Revocation SessionRevocation `json:"revocation"`
+	Nonce      string            `json:"nonce"`
+}
+
+func (s *redisStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	member := encode(redisSessionRevocation{Revocation: revocation, Nonce: nonce()})
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if revocation.TokenID != "" {
+			pipe.Set(ctx, s.key("session-token", revocation.TokenID), member, 0)
+		} else {
+			pipe.ZAdd(ctx, s.key("session-user", revocation.UserName), redis.Z{Score: score(revocation.RevokedAt), Member: member})
+		}
+		pipe.ZAdd(ctx, s.key("sessions"), redis.Z{Score: score(revocation.ExpiresAt), Member: member})
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error) {
+	if tokenID != "" {
+		revoked, existsErr := s.client.Exists(ctx, s.key("session-token", tokenID)).Result()
+		if existsErr != nil || revoked > 0 {
+			return revoked > 0, existsErr
+		}
+	}
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("session-user", userName), &redis.ZRangeBy{Min: millis(issuedAt), Max: "+inf"}).Result()
+	if rangeErr != nil {
+		return false, rangeErr
+	}
+	for _, member := range members {
+		var stored redisSessionRevocation
+		if decodeErr := json.Unmarshal([]byte(member), &stored); decodeErr != nil {
+			return false, fmt.Errorf("decode redis session revocation: %w", decodeErr)
+		}
+		if !issuedAt.After(stored.Revocation.RevokedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *redisStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("sessions"), &redis.ZRangeBy{Min: "-inf", Max: millis(before)}).Result()
+	if rangeErr != nil {
+		return 0, rangeErr
+	}
+	pruned := 0
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, member := range members {
+			var stored redisSessionRevocation
+			if decodeErr := json.Unmarshal([]byte(member), &stored); decodeErr != nil {
+				return fmt.Errorf("decode redis session revocation: %w", decodeErr)
+			}
+			revocation := stored.Revocation
+			if !revocation.ExpiresAt.Before(before) {
+				continue
+			}
+			if revocation.TokenID != "" {
+				pipe.Del(ctx, s.key("session-token", revocation.TokenID))
+			} else {
+				pipe.ZRem(ctx, s.key("session-user", revocation.UserName), member)
+			}
+			pipe.ZRem(ctx, s.key("sessions"), member)
+			pruned++
+		}
+		return nil
+	})
+	if txErr != nil {
+		return 0, txErr
+	}
+	return pruned, nil
+}
+
+func (s *redisStore) RecordSession(ctx context.Context, session Session) error {
+	member := encode(session)
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, s.key("session-issued", session.UserName), redis.Z{Score: score(session.ExpiresAt), Member: member})
+		pipe.ZAdd(ctx, s.key("sessions-issued"), redis.Z{Score: score(session.ExpiresAt), Member: member})
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) CountSessions(ctx context.Context, userName string, at time.Time) (int, error) {
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("session-issued", userName), &redis.ZRangeBy{Min: "(" + millis(at), Max: "+inf"}).Result()
+	if rangeErr != nil {
+		return 0, rangeErr
+	}
+	count := 0
+	for _, member := range members {
+		var session Session
+		if decodeErr := json.Unmarshal([]byte(member), &session); decodeErr != nil {
+			return 0, fmt.Errorf("decode redis session: %w", decodeErr)
+		}
+		if !session.ExpiresAt.After(at) {
+			continue
+		}
+		revoked, revokedErr := s.SessionRevoked(ctx, userName, session.TokenID, session.IssuedAt)
+		if revokedErr != nil {
+			return 0, revokedErr
+		}
+		if !revoked {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *redisStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	members, rangeErr := s.client.ZRangeByScore(ctx, s.key("sessions-issued"), &redis.ZRangeBy{Min: "-inf", Max: "(" + millis(before)}).Result()
+	if rangeErr != nil {
+		return 0, rangeErr
+	}
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, member := range members {
+			var session Session
+			if decodeErr := json.Unmarshal([]byte(member), &session); decodeErr != nil {
+				return fmt.Errorf("decode redis session: %w", decodeErr)
+			}
+			pipe.ZRem(ctx, s.key("session-issued", session.UserName), member)
+			pipe.ZRem(ctx, s.key("sessions-issued"), member)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return 0, txErr
+	}
+	return len(members), nil
+}
+
+// authPolicyKey names the policy of a tenant, or of one of its users, unambiguously whatever the
+// names hold
+func authPolicyKey(tenant, userName string) string {
+	return encode([]string{tenant, userName})
+}
+
+func (s *redisStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	key := authPolicyKey(policy.Tenant, policy.UserName)
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key("auth-policy", key), encode(policy), 0)
+		pipe.SAdd(ctx, s.key("auth-policies"), key)
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error) {
+	var policy AuthPolicy
+	found, getErr := getJSON(s.client.Get(ctx, s.key("auth-policy", authPolicyKey(tenant, userName))), &policy)
+	if getErr != nil {
+		return AuthPolicy{}, getErr
+	}
+	if !found {
+		return AuthPolicy{}, ErrAuthPolicyNotFound
+	}
+	return policy, nil
+}
+
+func (s *redisStore) ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error) {
+	keys, listErr := s.client.SMembers(ctx, s.key("auth-policies")).Result()
+	if listErr != nil {
+		return nil, listErr
+	}
+	policies := make([]AuthPolicy, 0, len(keys))
+	if len(keys) == 0 {
+		return policies, nil
+	}
+	policyKeys := make([]string, len(keys))
+	for i, key := range keys {
+		policyKeys[i] = s.key("auth-policy", key)
+	}
+	values, getErr := mget(ctx, s.client, policyKeys)
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		var policy AuthPolicy
+		if decodeErr := json.Unmarshal([]byte(value), &policy); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis authentication policy: %w", decodeErr)
+		}
+		policies = append(policies, policy)
+	}
+	sortAuthPolicies(policies)
+	return policies, nil
+}
+
+func (s *redisStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	key := authPolicyKey(tenant, userName)
+	var deleted *redis.IntCmd
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, s.key("auth-policy", key))
+		pipe.SRem(ctx, s.key("auth-policies"), key)
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+	if deleted.Val() == 0 {
+		return ErrAuthPolicyNotFound
+	}
+	return nil
+}
+
+func (s *redisStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key("apikey", key.ID), encode(key), 0)
+		pipe.SAdd(ctx, s.key("apikeys"), key.ID)
+		return nil
+	})
+	return txErr
+}
+
+func (s *redisStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	var key APIKey
+	found, getErr := getJSON(s.client.Get(ctx, s.key("apikey", id)), &key)
+	if getErr != nil {
+		return APIKey{}, getErr
+	}
+	if !found {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *redisStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ids, listErr := s.client.SMembers(ctx, s.key("apikeys")).Result()
+	if listErr != nil {
+		return nil, listErr
+	}
+	keys := make([]APIKey, 0, len(ids))
+	if len(ids) == 0 {
+		return keys, nil
+	}
+	idKeys := make([]string, len(ids))
+	for i, id := range ids {
+		idKeys[i] = s.key("apikey", id)
+	}
+	values, getErr := mget(ctx, s.client, idKeys)
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		var key APIKey
+		if decodeErr := json.Unmarshal([]byte(value), &key); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis API key: %w", decodeErr)
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return strings.Compare(a.ID, b.ID) })
+	return keys, nil
+}
+
+func (s *redisStore) DeleteAPIKey(ctx context.Context, id string) error {
+	var deleted *redis.IntCmd
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, s.key("apikey", id))
+		pipe.SRem(ctx, s.key("apikeys"), id)
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+	if deleted.Val() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// usageDayLayout names the hash counting the usage of a day
+const usageDayLayout = "2006-01-02"
+
+func (s *redisStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	usage := Usage{APIKeyID: keyID, Tenant: tenant, Day: UsageDay(day)}
+	name := usage.Day.Format(usageDayLayout)
+	var count *redis.IntCmd
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.HIncrBy(ctx, s.key("usage", name), keyID, requests)
+		pipe.Set(ctx, s.key("usage-tenant", name, keyID), tenant, 0)
+		pipe.ZAdd(ctx, s.key("usage-days"), redis.Z{Score: score(usage.Day), Member: name})
+		return nil
+	})
+	if txErr != nil {
+		return Usage{}, txErr
+	}
+	usage.Requests = count.Val()
+	return usage, nil
+}
+
+func (s *redisStore) ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+	days, rangeErr := s.client.ZRangeByScore(ctx, s.key("usage-days"), &redis.ZRangeBy{Min: millis(from), Max: "(" + millis(to)}).Result()
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	usage := []Usage{}
+	for _, name := range days {
+		day, parseErr := time.Parse(usageDayLayout, name)
+		if parseErr != nil {
+			return nil, fmt.Errorf("decode redis usage day: %w", parseErr)
+		}
+		counts, getErr := s.client.HGetAll(ctx, s.key("usage", name)).Result()
+		if getErr != nil {
+			return nil, getErr
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		records := make([]Usage, 0, len(counts))
+		tenantKeys := make([]string, 0, len(counts))
+		for keyID, count := range counts {
+			requests, countErr := strconv.ParseInt(count, 10, 64)
+			if countErr != nil {
+				return nil, fmt.Errorf("decode redis usage of API key %q: %w", keyID, countErr)
+			}
+			records = append(records, Usage{APIKeyID: keyID, Day: day, Requests: requests})
+			tenantKeys = append(tenantKeys, s.key("usage-tenant", name, keyID))
+		}
+		tenants, tenantsErr := mget(ctx, s.client, tenantKeys)
+		if tenantsErr != nil {
+			return nil, tenantsErr
+		}
+		for i := range records {
+			records[i].Tenant = tenants[i]
+		}
+		usage = append(usage, records...)
+	}
+	sortUsage(usage)
+	return usage, nil
+}
+
+func (s *redisStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	key := s.key("transcript", transcript.ID)
+	return s.watch(ctx, func(tx *redis.Tx) error {
+		exists, existsErr := tx.Exists(ctx, key).Result()
+		if existsErr != nil {
+			return existsErr
+		}
+		if exists != 0 {
+			return ErrTranscriptExists
+		}
+		member := redis.Z{Score: score(transcript.VerifiedAt), Member: transcript.ID}
+		_, execErr := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encode(transcript), 0)
+			pipe.ZAdd(ctx, s.key("transcripts"), member)
+			pipe.ZAdd(ctx, s.key("transcripts-user", transcript.UserName), member)
+			return nil
+		})
+		return execErr
+	}, key)
+}
+
+func (s *redisStore) GetTranscript(ctx context.Context, id string) (Transcript, error) {
+	var transcript Transcript
+	found, getErr := getJSON(s.client.Get(ctx, s.key("transcript", id)), &transcript)
+	if getErr != nil {
+		return Transcript{}, getErr
+	}
+	if !found {
+		return Transcript{}, ErrTranscriptNotFound
+	}
+	return transcript, nil
+}
+
+// transcriptsScored returns the transcripts an index scores within the milliseconds of from and to
+func (s *redisStore) transcriptsScored(ctx context.Context, index, from, to string) ([]Transcript, error) {
+	ids, rangeErr := s.client.ZRangeByScore(ctx, index, &redis.ZRangeBy{Min: from, Max: to}).Result()
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+	transcripts := make([]Transcript, 0, len(ids))
+	if len(ids) == 0 {
+		return transcripts, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.key("transcript", id)
+	}
+	values, getErr := mget(ctx, s.client, keys)
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		var transcript Transcript
+		if decodeErr := json.Unmarshal([]byte(value), &transcript); decodeErr != nil {
+			return nil, fmt.Errorf("decode redis transcript: %w", decodeErr)
+		}
+		transcripts = append(transcripts, transcript)
+	}
+	return transcripts, nil
+}
+
+func (s *redisStore) ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	index := s.key("transcripts")
+	if userName != "" {
+		index = s.key("transcripts-user", userName)
+	}
+	candidates, listErr := s.transcriptsScored(ctx, index, millis(from), millis(to))
+	if listErr != nil {
+		return nil, listErr
+	}
+	transcripts := []Transcript{}
+	for _, transcript := range candidates {
+		if !transcript.VerifiedAt.Before(from) && transcript.VerifiedAt.Before(to) {
+			transcripts = append(transcripts, transcript)
+		}
+	}
+	sortTranscripts(transcripts)
+	return transcripts, nil
+}
+
+func (s *redisStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	candidates, listErr := s.transcriptsScored(ctx, s.key("transcripts"), "-inf", millis(before))
+	if listErr != nil {
+		return 0, listErr
+	}
+	pruned := 0
+	_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, transcript := range candidates {
+			if !transcript.VerifiedAt.Before(before) {
+				continue
+			}
+			pipe.Del(ctx, s.key("transcript", transcript.ID))
+			pipe.ZRem(ctx, s.key("transcripts"), transcript.ID)
+			pipe.ZRem(ctx, s.key("transcripts-user", transcript.UserName), transcript.ID)
+			pruned++
+		}
+		return nil
+	})
+	if txErr != nil {
+		return 0, txErr
+	}
+	return pruned, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,1036 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"A2zkp-circuit/secret"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore is a Store backed by a SQLite database file
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (or creates) the database file and ensures the users table exists
+func OpenSQLite(path string) (Store, error) {
+	db, openErr := sql.Open("sqlite3", path)
+	if openErr != nil {
+		return nil, fmt.Errorf("opening database: %w", openErr)
+	}
+
+	_, createErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			user_name         TEXT PRIMARY KEY,
+			tenant            TEXT,
+			crypto_commitment TEXT NOT NULL,
+			salt              BLOB,
+			kdf               TEXT,
+			circuit_version   TEXT NOT NULL,
+			curve             TEXT,
+			key_id            TEXT,
+			created_at        TEXT NOT NULL,
+			devices           TEXT,
+			recovery          TEXT,
+			expires_at        TEXT,
+			expired_at        TEXT,
+			did_key           TEXT,
+			totp              TEXT,
+			webauthn          TEXT,
+			legacy            TEXT,
+			deleted_at        TEXT
+		)`)
+	if createErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating users table: %w", createErr)
+	}
+
+	// Databases created before salts were stored lack the column
+	if migrateErr := ensureColumn(db, "users", "salt", "BLOB"); migrateErr != nil {
+		db.Close()
+		return nil, migrateErr
+	}
+	// Likewise for the KDF parameters, devices and recovery shares, stored as JSON, the key version,
+	// the tenant, the expiry times, the curve, the DID key, the TOTP enrolment, the WebAuthn credential,
+	// the legacy password hash and the soft deletion time
+	for _, column := range []string{"kdf", "key_id", "tenant", "devices", "recovery", "expires_at", "expired_at", "curve", "did_key", "totp", "webauthn", "legacy", "deleted_at"} {
+		if migrateErr := ensureColumn(db, "users", column, "TEXT"); migrateErr != nil {
+			db.Close()
+			return nil, migrateErr
+		}
+	}
+
+	_, eventsErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS events (
+			kind       TEXT NOT NULL,
+			tenant     TEXT NOT NULL,
+			success    INTEGER NOT NULL,
+			latency_us INTEGER NOT NULL,
+			at         TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS events_at ON events (at)`)
+	if eventsErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating events table: %w", eventsErr)
+	}
+
+	_, revocationsErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS revocations (
+			sequence          INTEGER PRIMARY KEY AUTOINCREMENT,
+			crypto_commitment TEXT NOT NULL,
+			reason            TEXT NOT NULL,
+			revoked_at        TEXT NOT NULL
+		)`)
+	if revocationsErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating revocations table: %w", revocationsErr)
+	}
+
+	_, refreshErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			hash              TEXT PRIMARY KEY,
+			family            TEXT NOT NULL,
+			user_name         TEXT NOT NULL,
+			client_id         TEXT NOT NULL,
+			scope             TEXT NOT NULL,
+			issued_at         TEXT NOT NULL,
+			expires_at        TEXT NOT NULL,
+			family_expires_at TEXT,
+			rotated_at        TEXT
+		);
+		CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens (family);
+		CREATE INDEX IF NOT EXISTS refresh_tokens_user_name ON refresh_tokens (user_name)`)
+	if refreshErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating refresh_tokens table: %w", refreshErr)
+	}
+
+	_, sessionsErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS session_revocations (
+			user_name  TEXT NOT NULL,
+			token_id   TEXT NOT NULL,
+			revoked_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS session_revocations_token_id ON session_revocations (token_id);
+		CREATE INDEX IF NOT EXISTS session_revocations_user_name ON session_revocations (user_name)`)
+	if sessionsErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating session_revocations table: %w", sessionsErr)
+	}
+
+	_, issuedErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_id   TEXT PRIMARY KEY,
+			user_name  TEXT NOT NULL,
+			issued_at  TEXT NOT NULL,
+			expires_at TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_name ON sessions (user_name)`)
+	if issuedErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sessions table: %w", issuedErr)
+	}
+
+	_, apiKeysErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id         TEXT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			hash       TEXT NOT NULL,
+			role       TEXT NOT NULL,
+			tenant     TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`)
+	if apiKeysErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating api_keys table: %w", apiKeysErr)
+	}
+	// Keys created before quotas were stored lack their columns
+	for _, column := range []string{"daily_quota", "monthly_quota"} {
+		if migrateErr := ensureColumn(db, "api_keys", column, "INTEGER NOT NULL DEFAULT 0"); migrateErr != nil {
+			db.Close()
+			return nil, migrateErr
+		}
+	}
+
+	_, usageErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS usage (
+			api_key_id TEXT NOT NULL,
+			day        TEXT NOT NULL,
+			tenant     TEXT NOT NULL,
+			requests   INTEGER NOT NULL,
+			PRIMARY KEY (api_key_id, day)
+		);
+		CREATE INDEX IF NOT EXISTS usage_day ON usage (day)`)
+	if usageErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating usage table: %w", usageErr)
+	}
+
+	// The rules of a policy are JSON, as they are only ever read whole
+	_, policiesErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS auth_policies (
+			tenant     TEXT NOT NULL,
+			user_name  TEXT NOT NULL,
+			rules      TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			PRIMARY KEY (tenant, user_name)
+		)`)
+	if policiesErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating auth_policies table: %w", policiesErr)
+	}
+
+	// A transcript is JSON too, with the columns it is looked up by beside it
+	_, transcriptsErr := db.Exec(`
+		CREATE TABLE IF NOT EXISTS transcripts (
+			id          TEXT PRIMARY KEY,
+			user_name   TEXT NOT NULL,
+			verified_at TEXT NOT NULL,
+			record      TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS transcripts_user ON transcripts (user_name, verified_at);
+		CREATE INDEX IF NOT EXISTS transcripts_verified ON transcripts (verified_at)`)
+	if transcriptsErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating transcripts table: %w", transcriptsErr)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// OpenSQLiteReadOnly opens the database file of a read replica, such as one a primary's database is
+// replicated to, without creating or migrating anything: the primary owns the schema. Reads go to
+// the file as it is; writes fail with ErrReadOnly.
+func OpenSQLiteReadOnly(path string) (Store, error) {
+	db, openErr := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if openErr != nil {
+		return nil, fmt.Errorf("opening database: %w", openErr)
+	}
+	if _, queryErr := db.Exec("SELECT 1 FROM users LIMIT 1"); queryErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening database read-only: %w", queryErr)
+	}
+	return NewReadOnly(&sqliteStore{db: db}), nil
+}
+
+// ensureColumn adds a column to an existing table if it is not there yet
+func ensureColumn(db *sql.DB, table, column, declaration string) error {
+	rows, queryErr := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if queryErr != nil {
+		return queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if scanErr := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); scanErr != nil {
+			return scanErr
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return rowsErr
+	}
+	_, alterErr := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, declaration))
+	return alterErr
+}
+
+// execer is the part of *sql.DB and *sql.Tx that inserts rows
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, user User) error {
+	return insertUser(ctx, s.db, user)
+}
+
+func (s *sqliteStore) CreateUsers(ctx context.Context, users []User) error {
+	tx, beginErr := s.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return beginErr
+	}
+	for i, user := range users {
+		if insertErr := insertUser(ctx, tx, user); insertErr != nil {
+			tx.Rollback()
+			return &BatchError{Index: i, Err: insertErr}
+		}
+	}
+	return tx.Commit()
+}
+
+// insertUser adds one registration, failing with ErrUserExists if the name is taken
+func insertUser(ctx context.Context, db execer, user User) error {
+	columns, encodeErr := encodeJSONColumns(user)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, insertErr := db.ExecContext(ctx,
+		`INSERT INTO users (user_name, tenant, crypto_commitment, salt, kdf, circuit_version, curve, key_id, created_at, devices, recovery, expires_at, expired_at, did_key, totp, webauthn, legacy, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.UserName, user.Tenant, user.CryptoCommitment, user.Salt, columns[0], user.CircuitVersion, user.Curve, user.KeyID, user.CreatedAt.UTC().Format(time.RFC3339Nano), columns[1], columns[2],
+		nullTime(user.ExpiresAt), nullTime(user.ExpiredAt), user.DIDKey, columns[3], columns[4], columns[5], nullTime(user.DeletedAt))
+	var sqliteErr sqlite3.Error
+	if errors.As(insertErr, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrUserExists
+	}
+	return insertErr
+}
+
+func (s *sqliteStore) PutUser(ctx context.Context, user User) error {
+	columns, encodeErr := encodeJSONColumns(user)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, upsertErr := s.db.ExecContext(ctx,
+		`INSERT INTO users (user_name, tenant, crypto_commitment, salt, kdf, circuit_version, curve, key_id, created_at, devices, recovery, expires_at, expired_at, did_key, totp, webauthn, legacy, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(user_name) DO UPDATE SET
+			tenant            = excluded.tenant,
+			crypto_commitment = excluded.crypto_commitment,
+			salt              = excluded.salt,
+			kdf               = excluded.kdf,
+			circuit_version   = excluded.circuit_version,
+			curve             = excluded.curve,
+			key_id            = excluded.key_id,
+			created_at        = excluded.created_at,
+			devices           = excluded.devices,
+			recovery          = excluded.recovery,
+			expires_at        = excluded.expires_at,
+			expired_at        = excluded.expired_at,
+			did_key           = excluded.did_key,
+			totp              = excluded.totp,
+			webauthn          = excluded.webauthn,
+			legacy            = excluded.legacy,
+			deleted_at        = excluded.deleted_at`,
+		user.UserName, user.Tenant, user.CryptoCommitment, user.Salt, columns[0], user.CircuitVersion, user.Curve, user.KeyID, user.CreatedAt.UTC().Format(time.RFC3339Nano), columns[1], columns[2],
+		nullTime(user.ExpiresAt), nullTime(user.ExpiredAt), user.DIDKey, columns[3], columns[4], columns[5], nullTime(user.DeletedAt))
+	return upsertErr
+}
+
+func (s *sqliteStore) GetUser(ctx context.Context, userName string) (User, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT user_name, tenant, crypto_commitment, salt, kdf, circuit_version, curve, key_id, created_at, devices, recovery, expires_at, expired_at, did_key, totp, webauthn, legacy, deleted_at FROM users WHERE user_name = ?`, userName)
+	user, scanErr := scanUser(row)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, scanErr
+}
+
+func (s *sqliteStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	result, updateErr := s.db.ExecContext(ctx,
+		`UPDATE users SET totp = json_set(totp, '$.last_step', ?) WHERE user_name = ? AND totp IS NOT NULL AND COALESCE(json_extract(totp, '$.last_step'), 0) < ?`,
+		step, userName, step)
+	if updateErr != nil {
+		return updateErr
+	}
+	if updated, countErr := result.RowsAffected(); countErr != nil || updated == 0 {
+		// Tell a step used already from a user that is gone
+		var exists bool
+		existsErr := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE user_name = ?)`, userName).Scan(&exists)
+		switch {
+		case countErr != nil || existsErr != nil:
+			return errors.Join(countErr, existsErr)
+		case exists:
+			return ErrTOTPStepUsed
+		}
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteUser(ctx context.Context, userName string) error {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM users WHERE user_name = ?`, userName)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if deleted, countErr := result.RowsAffected(); countErr != nil || deleted == 0 {
+		return errors.Join(ErrUserNotFound, countErr)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, queryErr := s.db.QueryContext(ctx,
+		`SELECT user_name, tenant, crypto_commitment, salt, kdf, circuit_version, curve, key_id, created_at, devices, recovery, expires_at, expired_at, did_key, totp, webauthn, legacy, deleted_at FROM users ORDER BY user_name`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, scanErr := scanUser(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteStore) RecordEvents(ctx context.Context, events []Event) error {
+	tx, beginErr := s.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return beginErr
+	}
+	for _, event := range events {
+		_, insertErr := tx.ExecContext(ctx, `INSERT INTO events (kind, tenant, success, latency_us, at) VALUES (?, ?, ?, ?, ?)`,
+			event.Kind, event.Tenant, event.Success, event.Latency.Microseconds(), formatEventTime(event.At))
+		if insertErr != nil {
+			tx.Rollback()
+			return insertErr
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ListEvents(ctx context.Context, from, to time.Time) ([]Event, error) {
+	rows, queryErr := s.db.QueryContext(ctx,
+		`SELECT kind, tenant, success, latency_us, at FROM events WHERE at >= ? AND at < ? ORDER BY at`, formatEventTime(from), formatEventTime(to))
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		var latency int64
+		var at string
+		if scanErr := rows.Scan(&event.Kind, &event.Tenant, &event.Success, &latency, &at); scanErr != nil {
+			return nil, scanErr
+		}
+		parsed, parseErr := time.Parse(eventTimeLayout, at)
+		if parseErr != nil {
+			return nil, fmt.Errorf("parsing event time: %w", parseErr)
+		}
+		event.Latency, event.At = time.Duration(latency)*time.Microsecond, parsed
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqliteStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM events WHERE at < ?`, formatEventTime(before))
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	pruned, countErr := result.RowsAffected()
+	return int(pruned), countErr
+}
+
+func (s *sqliteStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	tx, beginErr := s.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return nil, beginErr
+	}
+	appended := make([]Revocation, len(revocations))
+	for i, revocation := range revocations {
+		result, insertErr := tx.ExecContext(ctx, `INSERT INTO revocations (crypto_commitment, reason, revoked_at) VALUES (?, ?, ?)`,
+			revocation.CryptoCommitment, revocation.Reason, formatEventTime(revocation.RevokedAt))
+		if insertErr != nil {
+			tx.Rollback()
+			return nil, insertErr
+		}
+		sequence, idErr := result.LastInsertId()
+		if idErr != nil {
+			tx.Rollback()
+			return nil, idErr
+		}
+		revocation.Sequence = uint64(sequence)
+		appended[i] = revocation
+	}
+	return appended, tx.Commit()
+}
+
+func (s *sqliteStore) ListRevocations(ctx context.Context, after uint64) ([]Revocation, error) {
+	rows, queryErr := s.db.QueryContext(ctx,
+		`SELECT sequence, crypto_commitment, reason, revoked_at FROM revocations WHERE sequence > ? ORDER BY sequence`, after)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	var revocations []Revocation
+	for rows.Next() {
+		var revocation Revocation
+		var revokedAt string
+		if scanErr := rows.Scan(&revocation.Sequence, &revocation.CryptoCommitment, &revocation.Reason, &revokedAt); scanErr != nil {
+			return nil, scanErr
+		}
+		parsed, parseErr := time.Parse(eventTimeLayout, revokedAt)
+		if parseErr != nil {
+			return nil, fmt.Errorf("parsing revocation time: %w", parseErr)
+		}
+		revocation.RevokedAt = parsed
+		revocations = append(revocations, revocation)
+	}
+	return revocations, rows.Err()
+}
+
+func (s *sqliteStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	return insertRefreshToken(ctx, s.db, token)
+}
+
+// insertRefreshToken adds one refresh token row
+func insertRefreshToken(ctx context.Context, db execer, token RefreshToken) error {
+	var familyExpiresAt sql.NullString
+	if !token.FamilyExpiresAt.IsZero() {
+		familyExpiresAt = sql.NullString{String: formatEventTime(token.FamilyExpiresAt), Valid: true}
+	}
+	var rotatedAt sql.NullString
+	if token.RotatedAt != nil {
+		rotatedAt = sql.NullString{String: formatEventTime(*token.RotatedAt), Valid: true}
+	}
+	_, insertErr := db.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (hash, family, user_name, client_id, scope, issued_at, expires_at, family_expires_at, rotated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.Hash, token.Family, token.UserName, token.ClientID, token.Scope, formatEventTime(token.IssuedAt), formatEventTime(token.ExpiresAt),
+		familyExpiresAt, rotatedAt)
+	return insertErr
+}
+
+func (s *sqliteStore) GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	var token RefreshToken
+	var issuedAt, expiresAt, familyExpiresAt, rotatedAt sql.NullString
+	scanErr := s.db.QueryRowContext(ctx,
+		`SELECT hash, family, user_name, client_id, scope, issued_at, expires_at, family_expires_at, rotated_at FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&token.Hash, &token.Family, &token.UserName, &token.ClientID, &token.Scope, &issuedAt, &expiresAt, &familyExpiresAt, &rotatedAt)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if scanErr != nil {
+		return RefreshToken{}, scanErr
+	}
+	for _, column := range []struct {
+		name  string
+		value sql.NullString
+		dst   *time.Time
+	}{
+		{"issued_at", issuedAt, &token.IssuedAt},
+		{"expires_at", expiresAt, &token.ExpiresAt},
+		{"family_expires_at", familyExpiresAt, &token.FamilyExpiresAt},
+	} {
+		if !column.value.Valid {
+			continue
+		}
+		parsed, parseErr := time.Parse(eventTimeLayout, column.value.String)
+		if parseErr != nil {
+			return RefreshToken{}, fmt.Errorf("parsing refresh token %s: %w", column.name, parseErr)
+		}
+		*column.dst = parsed
+	}
+	if rotatedAt.Valid {
+		parsed, parseErr := time.Parse(eventTimeLayout, rotatedAt.String)
+		if parseErr != nil {
+			return RefreshToken{}, fmt.Errorf("parsing refresh token rotated_at: %w", parseErr)
+		}
+		token.RotatedAt = &parsed
+	}
+	return token, nil
+}
+
+func (s *sqliteStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	tx, beginErr := s.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return beginErr
+	}
+	result, updateErr := tx.ExecContext(ctx, `UPDATE refresh_tokens SET rotated_at = ? WHERE hash = ? AND rotated_at IS NULL`,
+		formatEventTime(next.IssuedAt), hash)
+	if updateErr != nil {
+		tx.Rollback()
+		return updateErr
+	}
+	if updated, countErr := result.RowsAffected(); countErr != nil || updated == 0 {
+		// Tell a token that was rotated already from one that is gone
+		var exists bool
+		existsErr := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE hash = ?)`, hash).Scan(&exists)
+		tx.Rollback()
+		switch {
+		case countErr != nil || existsErr != nil:
+			return errors.Join(countErr, existsErr)
+		case exists:
+			return ErrRefreshTokenRotated
+		}
+		return ErrRefreshTokenNotFound
+	}
+	if insertErr := insertRefreshToken(ctx, tx, next); insertErr != nil {
+		tx.Rollback()
+		return insertErr
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	_, deleteErr := s.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE family = ? AND rotated_at IS NULL`, family)
+	return deleteErr
+}
+
+func (s *sqliteStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	rows, deleteErr := s.db.QueryContext(ctx, `DELETE FROM refresh_tokens WHERE user_name = ? RETURNING hash`, userName)
+	if deleteErr != nil {
+		return nil, deleteErr
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if scanErr := rows.Scan(&hash); scanErr != nil {
+			return nil, scanErr
+		}
+		hashes = append(hashes, hash)
+	}
+	slices.Sort(hashes)
+	return hashes, rows.Err()
+}
+
+func (s *sqliteStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < ?`, formatEventTime(before))
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	pruned, countErr := result.RowsAffected()
+	return int(pruned), countErr
+}
+
+func (s *sqliteStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	_, insertErr := s.db.ExecContext(ctx, `INSERT INTO session_revocations (user_name, token_id, revoked_at, expires_at) VALUES (?, ?, ?, ?)`,
+		revocation.UserName, revocation.TokenID, formatEventTime(revocation.RevokedAt), formatEventTime(revocation.ExpiresAt))
+	return insertErr
+}
+
+func (s *sqliteStore) SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	scanErr := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM session_revocations WHERE (token_id != '' AND token_id = ?) OR (token_id = '' AND user_name = ? AND revoked_at >= ?))`,
+		tokenID, userName, formatEventTime(issuedAt)).Scan(&revoked)
+	return revoked, scanErr
+}
+
+func (s *sqliteStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM session_revocations WHERE expires_at < ?`, formatEventTime(before))
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	pruned, countErr := result.RowsAffected()
+	return int(pruned), countErr
+}
+
+func (s *sqliteStore) RecordSession(ctx context.Context, session Session) error {
+	_, insertErr := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO sessions (token_id, user_name, issued_at, expires_at) VALUES (?, ?, ?, ?)`,
+		session.TokenID, session.UserName, formatEventTime(session.IssuedAt), formatEventTime(session.ExpiresAt))
+	return insertErr
+}
+
+func (s *sqliteStore) CountSessions(ctx context.Context, userName string, at time.Time) (int, error) {
+	var count int
+	scanErr := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM sessions WHERE user_name = ? AND expires_at > ? AND NOT EXISTS (
+			SELECT 1 FROM session_revocations r WHERE (r.token_id != '' AND r.token_id = sessions.token_id)
+				OR (r.token_id = '' AND r.user_name = sessions.user_name AND r.revoked_at >= sessions.issued_at))`,
+		userName, formatEventTime(at)).Scan(&count)
+	return count, scanErr
+}
+
+func (s *sqliteStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < ?`, formatEventTime(before))
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	pruned, countErr := result.RowsAffected()
+	return int(pruned), countErr
+}
+
+func (s *sqliteStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	rules, encodeErr := json.Marshal(policy.LoginRules)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, upsertErr := s.db.ExecContext(ctx,
+		`INSERT INTO auth_policies (tenant, user_name, rules, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(tenant, user_name) DO UPDATE SET rules = excluded.rules, updated_at = excluded.updated_at`,
+		policy.Tenant, policy.UserName, string(rules), formatEventTime(policy.UpdatedAt))
+	return upsertErr
+}
+
+func (s *sqliteStore) GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT tenant, user_name, rules, updated_at FROM auth_policies WHERE tenant = ? AND user_name = ?`, tenant, userName)
+	policy, scanErr := scanAuthPolicy(row)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return AuthPolicy{}, ErrAuthPolicyNotFound
+	}
+	return policy, scanErr
+}
+
+func (s *sqliteStore) ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error) {
+	rows, queryErr := s.db.QueryContext(ctx, `SELECT tenant, user_name, rules, updated_at FROM auth_policies ORDER BY tenant, user_name`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	policies := []AuthPolicy{}
+	for rows.Next() {
+		policy, scanErr := scanAuthPolicy(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func (s *sqliteStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM auth_policies WHERE tenant = ? AND user_name = ?`, tenant, userName)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if deleted, countErr := result.RowsAffected(); countErr != nil || deleted == 0 {
+		return errors.Join(ErrAuthPolicyNotFound, countErr)
+	}
+	return nil
+}
+
+func (s *sqliteStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	_, upsertErr := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys (id, name, hash, role, tenant, daily_quota, monthly_quota, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO UPDATE SET
+			name          = excluded.name,
+			hash          = excluded.hash,
+			role          = excluded.role,
+			tenant        = excluded.tenant,
+			daily_quota   = excluded.daily_quota,
+			monthly_quota = excluded.monthly_quota,
+			created_at    = excluded.created_at,
+			updated_at    = excluded.updated_at`,
+		key.ID, key.Name, key.Hash, key.Role, key.Tenant, key.DailyQuota, key.MonthlyQuota, formatEventTime(key.CreatedAt), formatEventTime(key.UpdatedAt))
+	return upsertErr
+}
+
+func (s *sqliteStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, name, hash, role, tenant, daily_quota, monthly_quota, created_at, updated_at FROM api_keys WHERE id = ?`, id)
+	key, scanErr := scanAPIKey(row)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, scanErr
+}
+
+func (s *sqliteStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, queryErr := s.db.QueryContext(ctx, `SELECT id, name, hash, role, tenant, daily_quota, monthly_quota, created_at, updated_at FROM api_keys ORDER BY id`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, scanErr := scanAPIKey(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) DeleteAPIKey(ctx context.Context, id string) error {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`, id)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if deleted, countErr := result.RowsAffected(); countErr != nil || deleted == 0 {
+		return errors.Join(ErrAPIKeyNotFound, countErr)
+	}
+	return nil
+}
+
+func (s *sqliteStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	usage := Usage{APIKeyID: keyID, Tenant: tenant, Day: UsageDay(day)}
+	row := s.db.QueryRowContext(ctx,
+		`INSERT INTO usage (api_key_id, day, tenant, requests) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(api_key_id, day) DO UPDATE SET
+			tenant   = excluded.tenant,
+			requests = requests + excluded.requests
+		 RETURNING requests`,
+		keyID, formatEventTime(usage.Day), tenant, requests)
+	if scanErr := row.Scan(&usage.Requests); scanErr != nil {
+		return Usage{}, scanErr
+	}
+	return usage, nil
+}
+
+func (s *sqliteStore) ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+	rows, queryErr := s.db.QueryContext(ctx,
+		`SELECT api_key_id, day, tenant, requests FROM usage WHERE day >= ? AND day < ? ORDER BY day, api_key_id`,
+		formatEventTime(from), formatEventTime(to))
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	usage := []Usage{}
+	for rows.Next() {
+		var day Usage
+		var dayText string
+		if scanErr := rows.Scan(&day.APIKeyID, &dayText, &day.Tenant, &day.Requests); scanErr != nil {
+			return nil, scanErr
+		}
+		parsed, parseErr := time.Parse(eventTimeLayout, dayText)
+		if parseErr != nil {
+			return nil, fmt.Errorf("parsing day of usage of API key %q: %w", day.APIKeyID, parseErr)
+		}
+		day.Day = parsed
+		usage = append(usage, day)
+	}
+	return usage, rows.Err()
+}
+
+func (s *sqliteStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	record, encodeErr := json.Marshal(transcript)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, insertErr := s.db.ExecContext(ctx, `INSERT INTO transcripts (id, user_name, verified_at, record) VALUES (?, ?, ?, ?)`,
+		transcript.ID, transcript.UserName, formatEventTime(transcript.VerifiedAt), string(record))
+	var sqliteErr sqlite3.Error
+	if errors.As(insertErr, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrTranscriptExists
+	}
+	return insertErr
+}
+
+func (s *sqliteStore) GetTranscript(ctx context.Context, id string) (Transcript, error) {
+	var record string
+	scanErr := s.db.QueryRowContext(ctx, `SELECT record FROM transcripts WHERE id = ?`, id).Scan(&record)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return Transcript{}, ErrTranscriptNotFound
+	}
+	if scanErr != nil {
+		return Transcript{}, scanErr
+	}
+	var transcript Transcript
+	if decodeErr := json.Unmarshal([]byte(record), &transcript); decodeErr != nil {
+		return Transcript{}, fmt.Errorf("parsing transcript %q: %w", id, decodeErr)
+	}
+	return transcript, nil
+}
+
+func (s *sqliteStore) ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	rows, queryErr := s.db.QueryContext(ctx,
+		`SELECT id, record FROM transcripts WHERE (? = '' OR user_name = ?) AND verified_at >= ? AND verified_at < ? ORDER BY verified_at, id`,
+		userName, userName, formatEventTime(from), formatEventTime(to))
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	transcripts := []Transcript{}
+	for rows.Next() {
+		var id, record string
+		if scanErr := rows.Scan(&id, &record); scanErr != nil {
+			return nil, scanErr
+		}
+		var transcript Transcript
+		if decodeErr := json.Unmarshal([]byte(record), &transcript); decodeErr != nil {
+			return nil, fmt.Errorf("parsing transcript %q: %w", id, decodeErr)
+		}
+		transcripts = append(transcripts, transcript)
+	}
+	return transcripts, rows.Err()
+}
+
+func (s *sqliteStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	result, deleteErr := s.db.ExecContext(ctx, `DELETE FROM transcripts WHERE verified_at < ?`, formatEventTime(before))
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	pruned, countErr := result.RowsAffected()
+	return int(pruned), countErr
+}
+
+func (s *sqliteStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	rows, deleteErr := s.db.QueryContext(ctx, `DELETE FROM transcripts WHERE user_name = ? RETURNING id`, userName)
+	if deleteErr != nil {
+		return nil, deleteErr
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if scanErr := rows.Scan(&id); scanErr != nil {
+			return nil, scanErr
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, rows.Err()
+}
+
+// scanAPIKey reads one api_keys row into an APIKey
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var createdAt, updatedAt string
+	if scanErr := row.Scan(&key.ID, &key.Name, &key.Hash, &key.Role, &key.Tenant, &key.DailyQuota, &key.MonthlyQuota, &createdAt, &updatedAt); scanErr != nil {
+		return APIKey{}, scanErr
+	}
+	for _, column := range []struct {
+		value string
+		dst   *time.Time
+	}{{createdAt, &key.CreatedAt}, {updatedAt, &key.UpdatedAt}} {
+		parsed, parseErr := time.Parse(eventTimeLayout, column.value)
+		if parseErr != nil {
+			return APIKey{}, fmt.Errorf("parsing times of API key %q: %w", key.ID, parseErr)
+		}
+		*column.dst = parsed
+	}
+	return key, nil
+}
+
+// scanAuthPolicy reads one auth_policies row into an AuthPolicy
+func scanAuthPolicy(row rowScanner) (AuthPolicy, error) {
+	var policy AuthPolicy
+	var rules, updatedAt string
+	if scanErr := row.Scan(&policy.Tenant, &policy.UserName, &rules, &updatedAt); scanErr != nil {
+		return AuthPolicy{}, scanErr
+	}
+	if decodeErr := json.Unmarshal([]byte(rules), &policy.LoginRules); decodeErr != nil {
+		return AuthPolicy{}, fmt.Errorf("parsing rules of the policy of %q/%q: %w", policy.Tenant, policy.UserName, decodeErr)
+	}
+	parsed, parseErr := time.Parse(eventTimeLayout, updatedAt)
+	if parseErr != nil {
+		return AuthPolicy{}, fmt.Errorf("parsing update time of the policy of %q/%q: %w", policy.Tenant, policy.UserName, parseErr)
+	}
+	policy.UpdatedAt = parsed
+	return policy, nil
+}
+
+// eventTimeLayout stores event times with a fixed width, so comparing the text orders them in time
+const eventTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// formatEventTime renders t in UTC with eventTimeLayout
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format(eventTimeLayout)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// encodeJSONColumns serializes the KDF parameters, devices, recovery shares, TOTP enrolment,
+// WebAuthn credential and legacy password of a user for their columns, in that order; each is NULL
+// when unset
+func encodeJSONColumns(user User) ([6]sql.NullString, error) {
+	var columns [6]sql.NullString
+	for i, column := range []struct {
+		value any
+		set   bool
+	}{
+		{user.KDF, user.KDF != nil},
+		{user.Devices, len(user.Devices) > 0},
+		{user.Recovery, user.Recovery != nil},
+		{user.TOTP, user.TOTP != nil},
+		{user.WebAuthn, user.WebAuthn != nil},
+		{user.Legacy, user.Legacy != nil},
+	} {
+		if !column.set {
+			continue
+		}
+		encoded, encodeErr := json.Marshal(column.value)
+		if encodeErr != nil {
+			return columns, encodeErr
+		}
+		columns[i] = sql.NullString{String: string(encoded), Valid: true}
+	}
+	return columns, nil
+}
+
+// rowScanner is the subset of *sql.Row and *sql.Rows used by scanUser
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser reads one users row into a User
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var tenant, kdf, curve, keyID, devices, recovery, expiresAt, expiredAt, didKey, totp, webauthn, legacy, deletedAt sql.NullString
+	var createdAt string
+	if scanErr := row.Scan(&user.UserName, &tenant, &user.CryptoCommitment, &user.Salt, &kdf, &user.CircuitVersion, &curve, &keyID, &createdAt, &devices, &recovery, &expiresAt, &expiredAt, &didKey, &totp, &webauthn, &legacy, &deletedAt); scanErr != nil {
+		return User{}, scanErr
+	}
+	user.Tenant, user.Curve, user.KeyID, user.DIDKey = tenant.String, curve.String, keyID.String, didKey.String
+	if kdf.Valid && kdf.String != "" {
+		user.KDF = new(secret.KDFParams)
+		if kdfErr := json.Unmarshal([]byte(kdf.String), user.KDF); kdfErr != nil {
+			return User{}, fmt.Errorf("parsing kdf of %q: %w", user.UserName, kdfErr)
+		}
+	}
+	if devices.Valid && devices.String != "" {
+		if devicesErr := json.Unmarshal([]byte(devices.String), &user.Devices); devicesErr != nil {
+			return User{}, fmt.Errorf("parsing devices of %q: %w", user.UserName, devicesErr)
+		}
+	}
+	if recovery.Valid && recovery.String != "" {
+		user.Recovery = new(Recovery)
+		if recoveryErr := json.Unmarshal([]byte(recovery.String), user.Recovery); recoveryErr != nil {
+			return User{}, fmt.Errorf("parsing recovery of %q: %w", user.UserName, recoveryErr)
+		}
+	}
+	if totp.Valid && totp.String != "" {
+		user.TOTP = new(TOTP)
+		if totpErr := json.Unmarshal([]byte(totp.String), user.TOTP); totpErr != nil {
+			return User{}, fmt.Errorf("parsing totp of %q: %w", user.UserName, totpErr)
+		}
+	}
+	if webauthn.Valid && webauthn.String != "" {
+		user.WebAuthn = new(WebAuthnCredential)
+		if webauthnErr := json.Unmarshal([]byte(webauthn.String), user.WebAuthn); webauthnErr != nil {
+			return User{}, fmt.Errorf("parsing webauthn of %q: %w", user.UserName, webauthnErr)
+		}
+	}
+	if legacy.Valid && legacy.String != "" {
+		user.Legacy = new(LegacyPassword)
+		if legacyErr := json.Unmarshal([]byte(legacy.String), user.Legacy); legacyErr != nil {
+			return User{}, fmt.Errorf("parsing legacy of %q: %w", user.UserName, legacyErr)
+		}
+	}
+	parsed, parseErr := time.Parse(time.RFC3339Nano, createdAt)
+	if parseErr != nil {
+		return User{}, fmt.Errorf("parsing created_at of %q: %w", user.UserName, parseErr)
+	}
+	user.CreatedAt = parsed
+	for _, column := range []struct {
+		name  string
+		value sql.NullString
+		dst   **time.Time
+	}{{"expires_at", expiresAt, &user.ExpiresAt}, {"expired_at", expiredAt, &user.ExpiredAt}, {"deleted_at", deletedAt, &user.DeletedAt}} {
+		if !column.value.Valid || column.value.String == "" {
+			continue
+		}
+		parsed, parseErr := time.Parse(time.RFC3339Nano, column.value.String)
+		if parseErr != nil {
+			return User{}, fmt.Errorf("parsing %s of %q: %w", column.name, user.UserName, parseErr)
+		}
+		*column.dst = &parsed
+	}
+	return user, nil
+}
+
+// nullTime formats an optional time for a TEXT column, NULL when unset
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.RFC3339Nano), Valid: true}
+}
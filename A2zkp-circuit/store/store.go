@@ -0,0 +1,986 @@
+// Package store persists registered users and the commitments bound to their secrets.
+//
+// Backends implement Store: NewMemory for tests and throwaway servers, OpenSQLite for a
+// database file, OpenLDAP for attributes of existing directory entries, OpenRedis for state
+// shared by replicas, and NewEncrypted to seal commitments and salts at rest around any of them.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"A2zkp-circuit/secret"
+)
+
+// ErrUserNotFound is returned when no registration exists for the requested user
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists is returned when registering a user name that is already taken
+var ErrUserExists = errors.New("user already exists")
+
+// ErrTOTPStepUsed is returned when recording a TOTP time step that isn't past the last one
+// recorded, as when the same code logs in twice
+var ErrTOTPStepUsed = errors.New("TOTP time step already used")
+
+// ErrRefreshTokenNotFound is returned when no refresh token is stored under the requested hash
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// ErrRefreshTokenRotated is returned when rotating a refresh token that was already rotated
+var ErrRefreshTokenRotated = errors.New("refresh token was already rotated")
+
+// ErrAPIKeyNotFound is returned when no API key exists with the requested ID
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// ErrAuthPolicyNotFound is returned when no authentication policy exists for the requested tenant or user
+var ErrAuthPolicyNotFound = errors.New("authentication policy not found")
+
+// ErrTranscriptNotFound is returned when no proof transcript exists with the requested ID
+var ErrTranscriptNotFound = errors.New("proof transcript not found")
+
+// ErrTranscriptExists is returned when recording a transcript under an ID already taken; a
+// transcript is never replaced
+var ErrTranscriptExists = errors.New("proof transcript already exists")
+
+// BatchError reports the registration that made CreateUsers fail; none of the batch was stored
+type BatchError struct {
+	Index int   // Index is the position of the failed registration in the batch
+	Err   error // Err is why it failed, such as ErrUserExists
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("registration %d of the batch: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// User is a registered user together with the commitment bound to their secret
+type User struct {
+	UserName         string `json:"user_name"`         // UserName uniquely identifies the user
+	Tenant           string `json:"tenant,omitempty"`  // Tenant is the organisation the user belongs to; empty for the default tenant
+	CryptoCommitment string `json:"crypto_commitment"` // CryptoCommitment is the public output of the circuit for the user's secret
+	Salt             []byte `json:"salt,omitempty"`    // Salt is the optional per-user salt mixed into the secret before commitment
+	// KDF holds the public key-derivation parameters the secret was stretched with, if any
+	KDF            *secret.KDFParams `json:"kdf,omitempty"`
+	CircuitVersion string            `json:"circuit_version"` // CircuitVersion identifies the circuit the commitment was produced with
+	// Curve names the curve whose scalar field the circuit is compiled over, e.g. "bn254"; registrations
+	// stored before it was recorded leave it empty, and are all on bn254
+	Curve     string    `json:"curve,omitempty"`
+	KeyID     string    `json:"key_id,omitempty"` // KeyID is the key version that was current when the commitment was registered
+	CreatedAt time.Time `json:"created_at"`       // CreatedAt is the registration time
+	// Devices are further commitments the user registered, one per device, each to that device's own secret
+	Devices []Device `json:"devices,omitempty"`
+	// Recovery holds the commitments to the shares of a recovery secret; nil when none were issued
+	Recovery *Recovery `json:"recovery,omitempty"`
+	// ExpiresAt is when the registration stops verifying, e.g. the end of a contract; nil never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ExpiredAt is when the expiry sweeper found the registration expired; nil until then
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+	// DIDKey is the verification method of the DID document of UserName that signed the commitment
+	// into the registration; empty when the commitment isn't bound to a DID key
+	DIDKey string `json:"did_key,omitempty"`
+	// TOTP is the one-time password generator the user enrolled as a second check; nil when none was
+	TOTP *TOTP `json:"totp,omitempty"`
+	// WebAuthn is the hardware key bound to the registration, an assertion of which must come with
+	// every proof; nil when none is
+	WebAuthn *WebAuthnCredential `json:"webauthn,omitempty"`
+	// Legacy is the password hash of a user imported from another system, who has no commitment
+	// until they complete their migration on a first login; nil for every other user
+	Legacy *LegacyPassword `json:"legacy,omitempty"`
+	// DeletedAt is when the user was soft-deleted: the registration no longer verifies and is purged
+	// once the deletion retention passes, unless it is restored first; nil for every other user
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Expired reports whether the registration has an expiry no later than now
+func (u User) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
+}
+
+// Deleted reports whether the user was soft-deleted and not restored
+func (u User) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+// Pending reports whether the user was imported with a legacy password hash and hasn't yet
+// replaced it with a commitment
+func (u User) Pending() bool {
+	return u.Legacy != nil
+}
+
+// Device is a commitment a user registered for one of their devices besides CryptoCommitment
+type Device struct {
+	Label            string     `json:"label"`                // Label names the device and is unique among the user's devices
+	CryptoCommitment string     `json:"crypto_commitment"`    // CryptoCommitment is the commitment to the device's secret
+	CreatedAt        time.Time  `json:"created_at"`           // CreatedAt is when the device was added
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"` // RevokedAt is when the device was revoked; nil while it is active
+}
+
+// Recovery is what the store keeps of a recovery secret split into shares: a commitment to each
+// share, and how many of them must be proven to replace the user's commitment
+type Recovery struct {
+	Threshold int             `json:"threshold"`
+	Shares    []RecoveryShare `json:"shares"`
+	CreatedAt time.Time       `json:"created_at"` // CreatedAt is when the shares were issued
+}
+
+// TOTP is a time-based one-time password (RFC 6238) enrolment: the key shared with the user's
+// authenticator app, and the last time step a code was accepted for so no code is accepted twice
+type TOTP struct {
+	Secret      []byte     `json:"secret"`                 // Secret is the HMAC key the codes are derived from
+	CreatedAt   time.Time  `json:"created_at"`             // CreatedAt is when the secret was generated
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"` // ConfirmedAt is when a first code was checked; nil until then
+	LastStep    int64      `json:"last_step,omitempty"`    // LastStep is the time step of the last code accepted
+}
+
+// WebAuthnCredential is a WebAuthn/FIDO2 credential a registration is bound to
+type WebAuthnCredential struct {
+	CredentialID []byte `json:"credential_id"` // CredentialID is the ID the authenticator gave the credential
+	PublicKey    []byte `json:"public_key"`    // PublicKey is the credential's key as a DER SubjectPublicKeyInfo
+	// Algorithm is the COSE algorithm the key signs with: -7 (ES256), -8 (EdDSA) or -257 (RS256)
+	Algorithm int       `json:"algorithm"`
+	SignCount uint32    `json:"sign_count,omitempty"` // SignCount is the signature counter of the last assertion accepted
+	CreatedAt time.Time `json:"created_at"`           // CreatedAt is when the credential was bound
+}
+
+// LegacyPassword is what the store keeps of a password imported from another system until the
+// user's first login checks it, and replaces it with a commitment
+type LegacyPassword struct {
+	Hash       string    `json:"hash"`        // Hash is a bcrypt hash, or an Argon2 one in PHC string format
+	ImportedAt time.Time `json:"imported_at"` // ImportedAt is when the hash was imported
+}
+
+// RecoveryShare is the commitment to one share of a recovery secret
+type RecoveryShare struct {
+	Index            int    `json:"index"`             // Index is the share's evaluation point
+	CryptoCommitment string `json:"crypto_commitment"` // CryptoCommitment is the circuit's commitment to the share's value
+}
+
+// ActiveCommitments lists the commitments a proof for the user may match: CryptoCommitment, then
+// those of the devices not revoked. A pending user has none.
+func (u User) ActiveCommitments() []string {
+	if u.Pending() {
+		return nil
+	}
+	commitments := []string{u.CryptoCommitment}
+	for _, device := range u.Devices {
+		if device.RevokedAt == nil {
+			commitments = append(commitments, device.CryptoCommitment)
+		}
+	}
+	return commitments
+}
+
+// Kinds of Event
+const (
+	EventRegistration = "registration" // EventRegistration is a new user stored
+	EventVerification = "verification" // EventVerification is a verdict on a login proof
+	EventAnomaly      = "anomaly"      // EventAnomaly is a brute-force pattern detected in failed logins
+	// EventSessionRevocation is a logout or another revocation of session tokens
+	EventSessionRevocation = "session_revocation"
+)
+
+// Event is one authentication outcome kept for statistics
+type Event struct {
+	Kind    string        `json:"kind"`    // Kind is EventRegistration, EventVerification, EventAnomaly or EventSessionRevocation
+	Tenant  string        `json:"tenant"`  // Tenant is the tenant of the user involved
+	Success bool          `json:"success"` // Success reports whether a verification's proof verified
+	Latency time.Duration `json:"latency"` // Latency is how long a verification's pairing check took
+	At      time.Time     `json:"at"`
+}
+
+// Reasons for a Revocation
+const (
+	RevokedDevice   = "device_revoked"      // RevokedDevice is a device revoked by its user
+	RevokedDeletion = "user_deleted"        // RevokedDeletion is a commitment of a deleted user
+	RevokedRecovery = "commitment_replaced" // RevokedRecovery is a commitment replaced through recovery shares
+	RevokedExpiry   = "commitment_expired"  // RevokedExpiry is a commitment of a registration past its expiry
+)
+
+// Revocation is one entry of the append-only log of commitments that must no longer verify
+type Revocation struct {
+	Sequence         uint64    `json:"sequence"` // Sequence numbers entries from 1 in the order they were appended
+	CryptoCommitment string    `json:"crypto_commitment"`
+	Reason           string    `json:"reason"` // Reason is RevokedDevice, RevokedDeletion, RevokedRecovery or RevokedExpiry
+	RevokedAt        time.Time `json:"revoked_at"`
+}
+
+// APIKey is a credential for the admin API with a role; the store keeps the hash of its secret only
+type APIKey struct {
+	ID     string `json:"id"`   // ID is public and names the key in the management API and in the key itself
+	Name   string `json:"name"` // Name says who or what the key is for
+	Hash   string `json:"hash"` // Hash is the base64url SHA-256 of the key's secret
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"` // Tenant confines a tenant-admin key to the users of one tenant
+	// DailyQuota and MonthlyQuota bound the requests made with the key per UTC day and calendar
+	// month; 0 leaves them unbounded
+	DailyQuota   int64 `json:"daily_quota,omitempty"`
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+	// CreatedAt is when the key was created and UpdatedAt when its role or quotas were last assigned
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Usage counts the requests made with an API key on one UTC day, for quotas and billing
+type Usage struct {
+	APIKeyID string    `json:"api_key_id"`
+	Tenant   string    `json:"tenant,omitempty"` // Tenant is the key's tenant as of its last request that day
+	Day      time.Time `json:"day"`              // Day is the UTC midnight the day starts at
+	Requests int64     `json:"requests"`
+}
+
+// SessionRevocation stops session tokens from being accepted before they expire: the one with
+// TokenID, or when TokenID is empty every session of UserName issued up to RevokedAt
+type SessionRevocation struct {
+	UserName  string    `json:"user_name,omitempty"` // UserName may be unknown when a single token is revoked by its ID
+	TokenID   string    `json:"token_id,omitempty"`  // TokenID is the "jti" of the revoked session token
+	RevokedAt time.Time `json:"revoked_at"`
+	// ExpiresAt is when every token the entry covers has lapsed anyway, after which it can be pruned
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Session is a session token issued to a user, recorded so a policy can bound how many they hold
+type Session struct {
+	TokenID   string    `json:"token_id"` // TokenID is the "jti" of the session token
+	UserName  string    `json:"user_name"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AuthPolicy restricts the logins of one user, or of every user of a tenant when UserName is
+// empty. A user is held to both their tenant's policy and their own.
+type AuthPolicy struct {
+	Tenant   string `json:"tenant,omitempty"`    // Tenant is the tenant of the policy, or of its user; empty for the default tenant
+	UserName string `json:"user_name,omitempty"` // UserName is set for the policy of one user
+	LoginRules
+	UpdatedAt time.Time `json:"updated_at"` // UpdatedAt is when the policy was last set
+}
+
+// LoginRules are the conditions an AuthPolicy puts on logins; each is left out at its zero value
+type LoginRules struct {
+	AllowedHours *HourWindow `json:"allowed_hours,omitempty"` // AllowedHours is when logins are accepted
+	MaxSessions  int         `json:"max_sessions,omitempty"`  // MaxSessions bounds the session tokens a user holds at once
+	// CircuitVersion is the circuit proofs must verify under, refusing ones made with older keys
+	CircuitVersion string `json:"circuit_version,omitempty"`
+	// RequireDevice refuses proofs that match the user's primary commitment alone, rather than one of
+	// a registered device, unless the user is bound to a WebAuthn credential
+	RequireDevice bool `json:"require_device,omitempty"`
+	// AllowedCountries and BlockedCountries are ISO 3166-1 alpha-2 codes of the client's country, as
+	// a trusted proxy reports it; with AllowedCountries a client of unknown country is refused
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+}
+
+// HourWindow is a daily span of local time, such as office hours
+type HourWindow struct {
+	From     string   `json:"from"`                // From is when the window opens, as "09:00"
+	To       string   `json:"to"`                  // To is when it closes; before From, the window spans midnight
+	TimeZone string   `json:"time_zone,omitempty"` // TimeZone is an IANA zone such as "Europe/Berlin"; UTC when empty
+	Weekdays []string `json:"weekdays,omitempty"`  // Weekdays are the days the window opens on, as "mon"; every day when empty
+}
+
+// Weekdays are the names of HourWindow.Weekdays, indexed by time.Weekday
+var Weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// HourLayout is the layout of HourWindow.From and To
+const HourLayout = "15:04"
+
+// Contains reports whether the window is open at t. A window spanning midnight belongs to the
+// weekday it opens on; one whose times or time zone don't parse is never open.
+func (w HourWindow) Contains(t time.Time) bool {
+	location, zoneErr := time.LoadLocation(w.TimeZone)
+	from, fromErr := time.Parse(HourLayout, w.From)
+	to, toErr := time.Parse(HourLayout, w.To)
+	if zoneErr != nil || fromErr != nil || toErr != nil {
+		return false
+	}
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	opens, closes := from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	switch {
+	case opens < closes:
+		return minute >= opens && minute < closes && w.opensOn(local.Weekday())
+	case minute >= opens:
+		return w.opensOn(local.Weekday())
+	case minute < closes:
+		return w.opensOn((local.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+// opensOn reports whether the window opens on a weekday
+func (w HourWindow) opensOn(day time.Weekday) bool {
+	return len(w.Weekdays) == 0 || slices.Contains(w.Weekdays, Weekdays[day])
+}
+
+// TranscriptValid is the Verdict of a transcript whose proof verified
+const TranscriptValid = "valid"
+
+// Transcript records a proof a login was accepted on, with what it verified against, so an
+// auditor can verify it again after the fact. Transcripts are written once and never changed; they
+// are only removed, by their age or with their user.
+type Transcript struct {
+	ID             string `json:"id"`
+	UserName       string `json:"user_name"`
+	Tenant         string `json:"tenant,omitempty"`
+	KeyID          string `json:"key_id"` // KeyID is the key version the proof verified under
+	CircuitVersion string `json:"circuit_version"`
+	Curve          string `json:"curve"`
+	// Proof is the proof in gnark binary encoding, in ProofEncoding; SnarkJSProof holds the
+	// proof.json of a snarkjs proof instead
+	Proof         []byte          `json:"proof,omitempty"`
+	ProofEncoding string          `json:"proof_encoding,omitempty"`
+	SnarkJSProof  json.RawMessage `json:"snarkjs_proof,omitempty"`
+	// Commitment and Nonce are the public inputs the proof verified against, as decimal strings
+	Commitment string    `json:"commitment"`
+	Nonce      string    `json:"nonce"`
+	Verdict    string    `json:"verdict"` // Verdict is TranscriptValid
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// sortTranscripts orders transcripts by when they verified and then ID
+func sortTranscripts(transcripts []Transcript) {
+	sort.Slice(transcripts, func(i, j int) bool {
+		if !transcripts[i].VerifiedAt.Equal(transcripts[j].VerifiedAt) {
+			return transcripts[i].VerifiedAt.Before(transcripts[j].VerifiedAt)
+		}
+		return transcripts[i].ID < transcripts[j].ID
+	})
+}
+
+// RefreshToken is a refresh token kept by the hash of its value, so the store holds nothing a
+// client could redeem. Each redemption rotates it: the token is marked rotated and a successor is
+// stored in the same family, and rotated tokens are kept until they expire so a reuse is noticed.
+type RefreshToken struct {
+	Hash     string    `json:"hash"`   // Hash is the base64url SHA-256 of the token
+	Family   string    `json:"family"` // Family is shared by every token rotated from the same grant
+	UserName string    `json:"user_name"`
+	ClientID string    `json:"client_id"`
+	Scope    string    `json:"scope"`
+	IssuedAt time.Time `json:"issued_at"`
+	// ExpiresAt is when the token stops being redeemable, never after FamilyExpiresAt
+	ExpiresAt time.Time `json:"expires_at"`
+	// FamilyExpiresAt is when the family ends however often it is rotated; zero when it has no end
+	FamilyExpiresAt time.Time `json:"family_expires_at,omitempty"`
+	// RotatedAt is when the token was redeemed for its successor; nil while it is active
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// Store persists registered users and their commitments
+type Store interface {
+	// CreateUser stores a new registration, failing with ErrUserExists if the name is taken
+	CreateUser(ctx context.Context, user User) error
+	// CreateUsers stores several new registrations atomically: all of them, or none and a *BatchError
+	// naming the first that failed, e.g. with ErrUserExists when a name is taken or repeated in the batch
+	CreateUsers(ctx context.Context, users []User) error
+	// PutUser creates or replaces a registration
+	PutUser(ctx context.Context, user User) error
+	// GetUser returns the registration for a user name or ErrUserNotFound
+	GetUser(ctx context.Context, userName string) (User, error)
+	// AdvanceTOTPStep atomically records step as the time step of the last code the TOTP enrolment of
+	// a user accepted, failing with ErrTOTPStepUsed unless the user is enrolled with an earlier step
+	// recorded, and with ErrUserNotFound if there is no such user. Replicas racing for one code thus
+	// let only one of them accept it.
+	AdvanceTOTPStep(ctx context.Context, userName string, step int64) error
+	// DeleteUser removes a registration, failing with ErrUserNotFound if there is none
+	DeleteUser(ctx context.Context, userName string) error
+	// ListUsers returns every registration ordered by user name
+	ListUsers(ctx context.Context) ([]User, error)
+	// RecordEvents appends authentication events for statistics
+	RecordEvents(ctx context.Context, events []Event) error
+	// ListEvents returns the events from from up to but excluding to, oldest first
+	ListEvents(ctx context.Context, from, to time.Time) ([]Event, error)
+	// PruneEvents removes the events older than before, returning how many there were
+	PruneEvents(ctx context.Context, before time.Time) (int, error)
+	// AppendRevocations adds entries to the revocation log, numbering them after the last one, and
+	// returns them with Sequence set
+	AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error)
+	// ListRevocations returns the revocations numbered after after, in sequence order
+	ListRevocations(ctx context.Context, after uint64) ([]Revocation, error)
+	// PutRefreshToken stores the first token of a new family
+	PutRefreshToken(ctx context.Context, token RefreshToken) error
+	// GetRefreshToken returns the token stored under a hash, rotated or not, or ErrRefreshTokenNotFound
+	GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error)
+	// RotateRefreshToken atomically marks a token rotated at next.IssuedAt and stores next, its
+	// successor; it fails with ErrRefreshTokenRotated if the token was rotated already and with
+	// ErrRefreshTokenNotFound if it is gone, e.g. because its family was revoked
+	RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error
+	// RevokeRefreshFamily removes the active tokens of a family; rotated ones are kept so their
+	// reuse is still detected
+	RevokeRefreshFamily(ctx context.Context, family string) error
+	// DeleteUserRefreshTokens removes every refresh token of a user, rotated ones included, and
+	// returns their hashes
+	DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error)
+	// PruneRefreshTokens removes the tokens that expired before before, returning how many there were
+	PruneRefreshTokens(ctx context.Context, before time.Time) (int, error)
+	// RevokeSessions records a session revocation
+	RevokeSessions(ctx context.Context, revocation SessionRevocation) error
+	// SessionRevoked reports whether the session token of userName with tokenID, issued at issuedAt,
+	// was revoked by its ID or by a revocation of all the user's sessions at or after issuedAt
+	SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error)
+	// PruneSessionRevocations removes the entries that expired before before, returning how many there were
+	PruneSessionRevocations(ctx context.Context, before time.Time) (int, error)
+	// RecordSession records a session token issued to a user
+	RecordSession(ctx context.Context, session Session) error
+	// CountSessions counts the recorded sessions of a user that are live at at: not expired, and not
+	// revoked as SessionRevoked tells
+	CountSessions(ctx context.Context, userName string, at time.Time) (int, error)
+	// PruneSessions removes the sessions that expired before before, returning how many there were
+	PruneSessions(ctx context.Context, before time.Time) (int, error)
+	// PutAuthPolicy creates or replaces the policy of a tenant or user
+	PutAuthPolicy(ctx context.Context, policy AuthPolicy) error
+	// GetAuthPolicy returns the policy of a user of tenant, or of the tenant itself when userName is
+	// empty, or ErrAuthPolicyNotFound
+	GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error)
+	// ListAuthPolicies returns every policy ordered by tenant, the tenant's own before its users' by user name
+	ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error)
+	// DeleteAuthPolicy removes a policy, failing with ErrAuthPolicyNotFound if there is none
+	DeleteAuthPolicy(ctx context.Context, tenant, userName string) error
+	// PutAPIKey creates or replaces an API key
+	PutAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKey returns the API key with an ID or ErrAPIKeyNotFound
+	GetAPIKey(ctx context.Context, id string) (APIKey, error)
+	// ListAPIKeys returns every API key ordered by ID
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// DeleteAPIKey removes an API key, failing with ErrAPIKeyNotFound if there is none
+	DeleteAPIKey(ctx context.Context, id string) error
+	// AddUsage atomically adds requests to the usage of an API key on the UTC day of day, recording
+	// tenant, and returns the day's usage
+	AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error)
+	// ListUsage returns the usage of the UTC days starting from from up to but excluding to, by day
+	// and then API key ID
+	ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error)
+	// RecordTranscript stores the transcript of an accepted proof, failing with ErrTranscriptExists
+	// if its ID is taken
+	RecordTranscript(ctx context.Context, transcript Transcript) error
+	// GetTranscript returns the transcript with an ID or ErrTranscriptNotFound
+	GetTranscript(ctx context.Context, id string) (Transcript, error)
+	// ListTranscripts returns the transcripts of a user, or of every user when userName is empty,
+	// verified from from up to but excluding to, oldest first
+	ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error)
+	// PruneTranscripts removes the transcripts verified before before, returning how many there were
+	PruneTranscripts(ctx context.Context, before time.Time) (int, error)
+	// DeleteUserTranscripts removes every transcript of a user and returns their sorted IDs
+	DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// memoryStore is a Store kept entirely in process memory
+type memoryStore struct {
+	mu          sync.RWMutex
+	users       map[string]User
+	events      []Event
+	revocations []Revocation
+	refresh     map[string]RefreshToken
+	sessions    []SessionRevocation
+	issued      map[string]Session
+	apiKeys     map[string]APIKey
+	usage       map[usageKey]Usage
+	policies    map[policyKey]AuthPolicy
+	transcripts map[string]Transcript
+}
+
+// policyKey identifies the authentication policy of a tenant, or of one of its users
+type policyKey struct {
+	tenant   string
+	userName string
+}
+
+// sortAuthPolicies orders policies by tenant, each tenant's own before its users' by user name
+func sortAuthPolicies(policies []AuthPolicy) {
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Tenant != policies[j].Tenant {
+			return policies[i].Tenant < policies[j].Tenant
+		}
+		return policies[i].UserName < policies[j].UserName
+	})
+}
+
+// usageKey identifies the usage of an API key on a day
+type usageKey struct {
+	keyID string
+	day   time.Time
+}
+
+// UsageDay is the UTC midnight that starts the day of t, which usage is counted by
+func UsageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() Store {
+	return &memoryStore{
+		users:       make(map[string]User),
+		refresh:     make(map[string]RefreshToken),
+		issued:      make(map[string]Session),
+		apiKeys:     make(map[string]APIKey),
+		usage:       make(map[usageKey]Usage),
+		policies:    make(map[policyKey]AuthPolicy),
+		transcripts: make(map[string]Transcript),
+	}
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[user.UserName]; exists {
+		return ErrUserExists
+	}
+	s.users[user.UserName] = user
+	return nil
+}
+
+func (s *memoryStore) CreateUsers(ctx context.Context, users []User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := make(map[string]bool, len(users))
+	for i, user := range users {
+		if _, exists := s.users[user.UserName]; exists || batch[user.UserName] {
+			return &BatchError{Index: i, Err: ErrUserExists}
+		}
+		batch[user.UserName] = true
+	}
+	for _, user := range users {
+		s.users[user.UserName] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) PutUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.UserName] = user
+	return nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, userName string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[userName]
+	if !exists {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) AdvanceTOTPStep(ctx context.Context, userName string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userName]
+	switch {
+	case !exists:
+		return ErrUserNotFound
+	case user.TOTP == nil || user.TOTP.LastStep >= step:
+		return ErrTOTPStepUsed
+	}
+	totp := *user.TOTP
+	totp.LastStep = step
+	user.TOTP = &totp
+	s.users[userName] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[userName]; !exists {
+		return ErrUserNotFound
+	}
+	delete(s.users, userName)
+	return nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+	return users, nil
+}
+
+func (s *memoryStore) RecordEvents(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *memoryStore) ListEvents(ctx context.Context, from, to time.Time) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []Event
+	for _, event := range s.events {
+		if !event.At.Before(from) && event.At.Before(to) {
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events, nil
+}
+
+func (s *memoryStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if !event.At.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	pruned := len(s.events) - len(kept)
+	s.events = kept
+	return pruned, nil
+}
+
+func (s *memoryStore) AppendRevocations(ctx context.Context, revocations []Revocation) ([]Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	appended := make([]Revocation, len(revocations))
+	for i, revocation := range revocations {
+		revocation.Sequence = uint64(len(s.revocations)) + 1
+		s.revocations = append(s.revocations, revocation)
+		appended[i] = revocation
+	}
+	return appended, nil
+}
+
+func (s *memoryStore) ListRevocations(ctx context.Context, after uint64) ([]Revocation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if after >= uint64(len(s.revocations)) {
+		return nil, nil
+	}
+	return slices.Clone(s.revocations[after:]), nil
+}
+
+func (s *memoryStore) PutRefreshToken(ctx context.Context, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[token.Hash] = token
+	return nil
+}
+
+func (s *memoryStore) GetRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, exists := s.refresh[hash]
+	if !exists {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *memoryStore) RotateRefreshToken(ctx context.Context, hash string, next RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, exists := s.refresh[hash]
+	switch {
+	case !exists:
+		return ErrRefreshTokenNotFound
+	case token.RotatedAt != nil:
+		return ErrRefreshTokenRotated
+	}
+	rotatedAt := next.IssuedAt
+	token.RotatedAt = &rotatedAt
+	s.refresh[hash] = token
+	s.refresh[next.Hash] = next
+	return nil
+}
+
+func (s *memoryStore) RevokeRefreshFamily(ctx context.Context, family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.refresh {
+		if token.Family == family && token.RotatedAt == nil {
+			delete(s.refresh, hash)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUserRefreshTokens(ctx context.Context, userName string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes []string
+	for hash, token := range s.refresh {
+		if token.UserName == userName {
+			hashes = append(hashes, hash)
+			delete(s.refresh, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+func (s *memoryStore) PruneRefreshTokens(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for hash, token := range s.refresh {
+		if token.ExpiresAt.Before(before) {
+			delete(s.refresh, hash)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (s *memoryStore) RevokeSessions(ctx context.Context, revocation SessionRevocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = append(s.sessions, revocation)
+	return nil
+}
+
+func (s *memoryStore) SessionRevoked(ctx context.Context, userName, tokenID string, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, revocation := range s.sessions {
+		switch {
+		case revocation.TokenID != "" && revocation.TokenID == tokenID:
+			return true, nil
+		case revocation.TokenID == "" && revocation.UserName == userName && !issuedAt.After(revocation.RevokedAt):
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) PruneSessionRevocations(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.sessions[:0]
+	for _, revocation := range s.sessions {
+		if !revocation.ExpiresAt.Before(before) {
+			kept = append(kept, revocation)
+		}
+	}
+	pruned := len(s.sessions) - len(kept)
+	s.sessions = kept
+	return pruned, nil
+}
+
+func (s *memoryStore) RecordSession(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issued[session.TokenID] = session
+	return nil
+}
+
+func (s *memoryStore) CountSessions(ctx context.Context, userName string, at time.Time) (int, error) {
+	s.mu.RLock()
+	var live []Session
+	for _, session := range s.issued {
+		if session.UserName == userName && session.ExpiresAt.After(at) {
+			live = append(live, session)
+		}
+	}
+	s.mu.RUnlock()
+	count := 0
+	for _, session := range live {
+		revoked, _ := s.SessionRevoked(ctx, userName, session.TokenID, session.IssuedAt)
+		if !revoked {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) PruneSessions(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for id, session := range s.issued {
+		if session.ExpiresAt.Before(before) {
+			delete(s.issued, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (s *memoryStore) PutAuthPolicy(ctx context.Context, policy AuthPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[policyKey{policy.Tenant, policy.UserName}] = policy
+	return nil
+}
+
+func (s *memoryStore) GetAuthPolicy(ctx context.Context, tenant, userName string) (AuthPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policy, exists := s.policies[policyKey{tenant, userName}]
+	if !exists {
+		return AuthPolicy{}, ErrAuthPolicyNotFound
+	}
+	return policy, nil
+}
+
+func (s *memoryStore) ListAuthPolicies(ctx context.Context) ([]AuthPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := make([]AuthPolicy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	sortAuthPolicies(policies)
+	return policies, nil
+}
+
+func (s *memoryStore) DeleteAuthPolicy(ctx context.Context, tenant, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := policyKey{tenant, userName}
+	if _, exists := s.policies[key]; !exists {
+		return ErrAuthPolicyNotFound
+	}
+	delete(s.policies, key)
+	return nil
+}
+
+func (s *memoryStore) PutAPIKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+func (s *memoryStore) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *memoryStore) DeleteAPIKey(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.apiKeys[id]; !exists {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.apiKeys, id)
+	return nil
+}
+
+func (s *memoryStore) AddUsage(ctx context.Context, keyID, tenant string, day time.Time, requests int64) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := usageKey{keyID: keyID, day: UsageDay(day)}
+	usage := s.usage[key]
+	usage.APIKeyID, usage.Tenant, usage.Day = keyID, tenant, key.day
+	usage.Requests += requests
+	s.usage[key] = usage
+	return usage, nil
+}
+
+func (s *memoryStore) ListUsage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usage := []Usage{}
+	for key, day := range s.usage {
+		if !key.day.Before(from) && key.day.Before(to) {
+			usage = append(usage, day)
+		}
+	}
+	sortUsage(usage)
+	return usage, nil
+}
+
+// sortUsage orders usage by day and then API key ID
+func sortUsage(usage []Usage) {
+	sort.Slice(usage, func(i, j int) bool {
+		if !usage[i].Day.Equal(usage[j].Day) {
+			return usage[i].Day.Before(usage[j].Day)
+		}
+		return usage[i].APIKeyID < usage[j].APIKeyID
+	})
+}
+
+func (s *memoryStore) RecordTranscript(ctx context.Context, transcript Transcript) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.transcripts[transcript.ID]; exists {
+		return ErrTranscriptExists
+	}
+	s.transcripts[transcript.ID] = transcript
+	return nil
+}
+
+func (s *memoryStore) GetTranscript(ctx context.Context, id string) (Transcript, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	transcript, exists := s.transcripts[id]
+	if !exists {
+		return Transcript{}, ErrTranscriptNotFound
+	}
+	return transcript, nil
+}
+
+func (s *memoryStore) ListTranscripts(ctx context.Context, userName string, from, to time.Time) ([]Transcript, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	transcripts := []Transcript{}
+	for _, transcript := range s.transcripts {
+		if (userName == "" || transcript.UserName == userName) && !transcript.VerifiedAt.Before(from) && transcript.VerifiedAt.Before(to) {
+			transcripts = append(transcripts, transcript)
+		}
+	}
+	sortTranscripts(transcripts)
+	return transcripts, nil
+}
+
+func (s *memoryStore) PruneTranscripts(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for id, transcript := range s.transcripts {
+		if transcript.VerifiedAt.Before(before) {
+			delete(s.transcripts, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (s *memoryStore) DeleteUserTranscripts(ctx context.Context, userName string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, transcript := range s.transcripts {
+		if transcript.UserName == userName {
+			delete(s.transcripts, id)
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,813 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"A2zkp-circuit/ldap/ldaptest"
+	"A2zkp-circuit/secret"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/redis/go-redis/v9"
+)
+
+// testUser returns a fully populated registration
+func testUser(name string) User {
+	kdf := secret.DefaultArgon2idParams()
+	revokedAt := time.Date(2024, 5, 3, 8, 30, 0, 0, time.UTC)
+	expiresAt := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	expiredAt := expiresAt.Add(time.Hour)
+	confirmedAt := time.Date(2024, 5, 1, 12, 5, 0, 0, time.UTC)
+	deletedAt := time.Date(2024, 9, 1, 7, 0, 0, 0, time.UTC)
+	return User{
+		UserName:         name,
+		Tenant:           "acme",
+		CryptoCommitment: "152399025",
+		Salt:             []byte("0123456789abcdef"),
+		KDF:              &kdf,
+		CircuitVersion:   "v1",
+		Curve:            "bn254",
+		KeyID:            "vk-test",
+		CreatedAt:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Devices: []Device{
+			{Label: "phone", CryptoCommitment: "49", CreatedAt: time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)},
+			{Label: "old laptop", CryptoCommitment: "64", CreatedAt: time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC), RevokedAt: &revokedAt},
+		},
+		Recovery: &Recovery{
+			Threshold: 2,
+			Shares:    []RecoveryShare{{Index: 1, CryptoCommitment: "81"}, {Index: 2, CryptoCommitment: "100"}, {Index: 3, CryptoCommitment: "121"}},
+			CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		},
+		ExpiresAt: &expiresAt,
+		ExpiredAt: &expiredAt,
+		DIDKey:    "did:web:example.com:users:alice#key-1",
+		TOTP:      &TOTP{Secret: []byte("12345678901234567890"), CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ConfirmedAt: &confirmedAt, LastStep: 57134410},
+		WebAuthn:  &WebAuthnCredential{CredentialID: []byte("credential-1"), PublicKey: []byte("0Y0\x13"), Algorithm: -7, SignCount: 41, CreatedAt: time.Date(2024, 5, 1, 12, 10, 0, 0, time.UTC)},
+		DeletedAt: &deletedAt,
+	}
+}
+
+// testKeyring returns a master keyring holding a key derived from each ID, the first one active
+func testKeyring(t *testing.T, ids ...string) *MasterKeyring {
+	t.Helper()
+	encoded := map[string]string{}
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		encoded[id] = base64.StdEncoding.EncodeToString(key[:])
+	}
+	keyring, keyringErr := NewMasterKeyring(ids[0], encoded)
+	if keyringErr != nil {
+		t.Fatal(keyringErr)
+	}
+	return keyring
+}
+
+// testStoreContract checks the behaviour every Store backend must share
+func testStoreContract(t *testing.T, s Store) {
+	ctx := context.Background()
+	defer s.Close()
+
+	if _, getErr := s.GetUser(ctx, "alice"); !errors.Is(getErr, ErrUserNotFound) {
+		t.Fatalf("GetUser before CreateUser = %v, want ErrUserNotFound", getErr)
+	}
+	alice := testUser("alice")
+	if createErr := s.CreateUser(ctx, alice); createErr != nil {
+		t.Fatal(createErr)
+	}
+	if createErr := s.CreateUser(ctx, alice); !errors.Is(createErr, ErrUserExists) {
+		t.Errorf("second CreateUser = %v, want ErrUserExists", createErr)
+	}
+	got, getErr := s.GetUser(ctx, "alice")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if !reflect.DeepEqual(got, alice) {
+		t.Errorf("GetUser = %+v, want %+v", got, alice)
+	}
+
+	raw := User{UserName: "bob", CryptoCommitment: "4", CircuitVersion: "v1", CreatedAt: alice.CreatedAt}
+	if putErr := s.PutUser(ctx, raw); putErr != nil {
+		t.Fatal(putErr)
+	}
+	raw.CryptoCommitment = "9"
+	if putErr := s.PutUser(ctx, raw); putErr != nil {
+		t.Fatal(putErr)
+	}
+	users, listErr := s.ListUsers(ctx)
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if len(users) != 2 || users[0].UserName != "alice" || users[1].UserName != "bob" {
+		t.Fatalf("ListUsers = %+v, want alice then bob", users)
+	}
+	if users[1].CryptoCommitment != "9" || users[1].KDF != nil || len(users[1].Salt) != 0 || users[1].Devices != nil || users[1].Recovery != nil || users[1].ExpiresAt != nil || users[1].TOTP != nil || users[1].WebAuthn != nil {
+		t.Errorf("PutUser did not replace bob: %+v", users[1])
+	}
+
+	// A batch is stored entirely or not at all
+	for _, batch := range []struct {
+		names     []string
+		wantIndex int
+	}{
+		{[]string{"carol", "alice", "dave"}, 1},
+		{[]string{"carol", "dave", "carol"}, 2},
+	} {
+		var users []User
+		for _, name := range batch.names {
+			users = append(users, testUser(name))
+		}
+		var batchErr *BatchError
+		if createErr := s.CreateUsers(ctx, users); !errors.As(createErr, &batchErr) || batchErr.Index != batch.wantIndex || !errors.Is(createErr, ErrUserExists) {
+			t.Errorf("CreateUsers(%v) = %v, want ErrUserExists at %d", batch.names, createErr, batch.wantIndex)
+		}
+		if _, getErr := s.GetUser(ctx, "carol"); !errors.Is(getErr, ErrUserNotFound) {
+			t.Errorf("CreateUsers(%v) stored carol despite failing", batch.names)
+		}
+	}
+	if createErr := s.CreateUsers(ctx, []User{testUser("carol"), testUser("dave")}); createErr != nil {
+		t.Fatal(createErr)
+	}
+	if users, _ := s.ListUsers(ctx); len(users) != 4 {
+		t.Errorf("ListUsers after CreateUsers has %d users, want 4", len(users))
+	}
+
+	if deleteErr := s.DeleteUser(ctx, "carol"); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if _, getErr := s.GetUser(ctx, "carol"); !errors.Is(getErr, ErrUserNotFound) {
+		t.Errorf("GetUser after DeleteUser = %v, want ErrUserNotFound", getErr)
+	}
+	if deleteErr := s.DeleteUser(ctx, "carol"); !errors.Is(deleteErr, ErrUserNotFound) {
+		t.Errorf("second DeleteUser = %v, want ErrUserNotFound", deleteErr)
+	}
+
+	// An imported user has a legacy password hash in place of a commitment until they migrate
+	pending := User{UserName: "carol", Tenant: "acme", CreatedAt: alice.CreatedAt, Legacy: &LegacyPassword{Hash: "$2a$04$abcdefghijklmnopqrstuu5Lz0ikcxJzW1xh8M6ve6Wbd5e8jNRxG", ImportedAt: alice.CreatedAt}}
+	if createErr := s.CreateUser(ctx, pending); createErr != nil {
+		t.Fatal(createErr)
+	}
+	if got, getErr := s.GetUser(ctx, "carol"); getErr != nil || !reflect.DeepEqual(got, pending) {
+		t.Errorf("GetUser of a pending user = %+v, %v, want %+v", got, getErr, pending)
+	}
+	if users, _ := s.ListUsers(ctx); len(users) != 4 {
+		t.Errorf("ListUsers with a pending user has %d users, want 4", len(users))
+	}
+	if deleteErr := s.DeleteUser(ctx, "carol"); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+
+	// A TOTP time step is recorded only past the last one, so one code can't be accepted twice
+	if advanceErr := s.AdvanceTOTPStep(ctx, "dave", 57134411); advanceErr != nil {
+		t.Fatal(advanceErr)
+	}
+	for _, step := range []int64{57134411, 57134400} {
+		if advanceErr := s.AdvanceTOTPStep(ctx, "dave", step); !errors.Is(advanceErr, ErrTOTPStepUsed) {
+			t.Errorf("AdvanceTOTPStep(%d) after 57134411 = %v, want ErrTOTPStepUsed", step, advanceErr)
+		}
+	}
+	wantDave := testUser("dave")
+	wantDave.TOTP.LastStep = 57134411
+	if got, getErr := s.GetUser(ctx, "dave"); getErr != nil || !reflect.DeepEqual(got, wantDave) {
+		t.Errorf("GetUser after AdvanceTOTPStep = %+v, %v, want %+v", got, getErr, wantDave)
+	}
+	if advanceErr := s.AdvanceTOTPStep(ctx, "bob", 1); !errors.Is(advanceErr, ErrTOTPStepUsed) {
+		t.Errorf("AdvanceTOTPStep of a user without TOTP = %v, want ErrTOTPStepUsed", advanceErr)
+	}
+	if advanceErr := s.AdvanceTOTPStep(ctx, "nobody", 1); !errors.Is(advanceErr, ErrUserNotFound) {
+		t.Errorf("AdvanceTOTPStep of an unknown user = %v, want ErrUserNotFound", advanceErr)
+	}
+
+	// Events come back oldest first within the range and are pruned by age
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Kind: EventVerification, Tenant: "acme", Success: true, Latency: 3 * time.Millisecond, At: start.Add(2 * time.Minute)},
+		{Kind: EventRegistration, Tenant: "acme", At: start},
+		{Kind: EventVerification, At: start.Add(time.Hour)},
+	}
+	if recordErr := s.RecordEvents(ctx, events); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	listed, listEventsErr := s.ListEvents(ctx, start, start.Add(time.Hour))
+	if listEventsErr != nil {
+		t.Fatal(listEventsErr)
+	}
+	if !reflect.DeepEqual(listed, []Event{events[1], events[0]}) {
+		t.Errorf("ListEvents = %+v, want the registration then the first verification", listed)
+	}
+	if pruned, pruneErr := s.PruneEvents(ctx, start.Add(time.Minute)); pruneErr != nil || pruned != 1 {
+		t.Errorf("PruneEvents = %d, %v, want 1", pruned, pruneErr)
+	}
+	if remaining, _ := s.ListEvents(ctx, start, start.Add(2*time.Hour)); len(remaining) != 2 {
+		t.Errorf("%d events left after pruning, want 2", len(remaining))
+	}
+
+	// Revocations are numbered in the order they are appended, across calls
+	first, appendErr := s.AppendRevocations(ctx, []Revocation{
+		{CryptoCommitment: "49", Reason: RevokedDevice, RevokedAt: start},
+		{CryptoCommitment: "64", Reason: RevokedDeletion, RevokedAt: start.Add(time.Second)},
+	})
+	if appendErr != nil {
+		t.Fatal(appendErr)
+	}
+	second, appendErr := s.AppendRevocations(ctx, []Revocation{{CryptoCommitment: "81", Reason: RevokedRecovery, RevokedAt: start.Add(time.Minute)}})
+	if appendErr != nil {
+		t.Fatal(appendErr)
+	}
+	if first[0].Sequence != 1 || first[1].Sequence != 2 || second[0].Sequence != 3 {
+		t.Errorf("appended sequences %d, %d, %d, want 1, 2, 3", first[0].Sequence, first[1].Sequence, second[0].Sequence)
+	}
+	all, listRevocationsErr := s.ListRevocations(ctx, 0)
+	if listRevocationsErr != nil {
+		t.Fatal(listRevocationsErr)
+	}
+	if !reflect.DeepEqual(all, append(first, second...)) {
+		t.Errorf("ListRevocations(0) = %+v", all)
+	}
+	if later, _ := s.ListRevocations(ctx, 2); len(later) != 1 || later[0].CryptoCommitment != "81" {
+		t.Errorf("ListRevocations(2) = %+v, want the third", later)
+	}
+	if none, _ := s.ListRevocations(ctx, 3); len(none) != 0 {
+		t.Errorf("ListRevocations(3) = %+v, want none", none)
+	}
+
+	// Rotating a refresh token marks it and stores its successor; a second rotation is refused, and
+	// revoking the family leaves only the rotated tokens
+	issued := RefreshToken{Hash: "h1", Family: "f1", UserName: "alice", ClientID: "app", Scope: "profile",
+		IssuedAt: start, ExpiresAt: start.Add(time.Hour), FamilyExpiresAt: start.Add(24 * time.Hour)}
+	if putErr := s.PutRefreshToken(ctx, issued); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if got, getErr := s.GetRefreshToken(ctx, "h1"); getErr != nil || !reflect.DeepEqual(got, issued) {
+		t.Errorf("GetRefreshToken = %+v, %v, want %+v", got, getErr, issued)
+	}
+	next := issued
+	next.Hash, next.IssuedAt = "h2", start.Add(time.Minute)
+	if rotateErr := s.RotateRefreshToken(ctx, "h1", next); rotateErr != nil {
+		t.Fatal(rotateErr)
+	}
+	if rotated, _ := s.GetRefreshToken(ctx, "h1"); rotated.RotatedAt == nil || !rotated.RotatedAt.Equal(next.IssuedAt) {
+		t.Errorf("rotated token has RotatedAt %v, want %v", rotated.RotatedAt, next.IssuedAt)
+	}
+	again := next
+	again.Hash = "h3"
+	if rotateErr := s.RotateRefreshToken(ctx, "h1", again); !errors.Is(rotateErr, ErrRefreshTokenRotated) {
+		t.Errorf("second rotation = %v, want ErrRefreshTokenRotated", rotateErr)
+	}
+	if _, getErr := s.GetRefreshToken(ctx, "h3"); !errors.Is(getErr, ErrRefreshTokenNotFound) {
+		t.Errorf("refused rotation stored its successor: %v", getErr)
+	}
+	if revokeErr := s.RevokeRefreshFamily(ctx, "f1"); revokeErr != nil {
+		t.Fatal(revokeErr)
+	}
+	if _, getErr := s.GetRefreshToken(ctx, "h2"); !errors.Is(getErr, ErrRefreshTokenNotFound) {
+		t.Errorf("active token survived revoking its family: %v", getErr)
+	}
+	if rotateErr := s.RotateRefreshToken(ctx, "h2", again); !errors.Is(rotateErr, ErrRefreshTokenNotFound) {
+		t.Errorf("rotating a revoked token = %v, want ErrRefreshTokenNotFound", rotateErr)
+	}
+	other := RefreshToken{Hash: "h4", Family: "f2", UserName: "bob", ClientID: "app", IssuedAt: start, ExpiresAt: start.Add(2 * time.Hour)}
+	if putErr := s.PutRefreshToken(ctx, other); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if hashes, deleteErr := s.DeleteUserRefreshTokens(ctx, "alice"); deleteErr != nil || !reflect.DeepEqual(hashes, []string{"h1"}) {
+		t.Errorf("DeleteUserRefreshTokens = %v, %v, want [h1]", hashes, deleteErr)
+	}
+	if pruned, pruneErr := s.PruneRefreshTokens(ctx, start.Add(3*time.Hour)); pruneErr != nil || pruned != 1 {
+		t.Errorf("PruneRefreshTokens = %d, %v, want 1", pruned, pruneErr)
+	}
+
+	// A session is revoked by its ID, or by revoking every session its user had at the time
+	for _, revocation := range []SessionRevocation{
+		{TokenID: "s1", RevokedAt: start, ExpiresAt: start.Add(time.Hour)},
+		{UserName: "bob", RevokedAt: start.Add(time.Minute), ExpiresAt: start.Add(2 * time.Hour)},
+	} {
+		if revokeErr := s.RevokeSessions(ctx, revocation); revokeErr != nil {
+			t.Fatal(revokeErr)
+		}
+	}
+	for _, session := range []struct {
+		userName, tokenID string
+		issuedAt          time.Time
+		want              bool
+	}{
+		{"alice", "s1", start, true},
+		{"alice", "s2", start, false},
+		{"bob", "s3", start.Add(time.Minute), true},
+		{"bob", "s4", start.Add(2 * time.Minute), false},
+		{"carol", "", start, false},
+	} {
+		if revoked, checkErr := s.SessionRevoked(ctx, session.userName, session.tokenID, session.issuedAt); checkErr != nil || revoked != session.want {
+			t.Errorf("SessionRevoked(%s, %s) = %v, %v, want %v", session.userName, session.tokenID, revoked, checkErr, session.want)
+		}
+	}
+	if pruned, pruneErr := s.PruneSessionRevocations(ctx, start.Add(90*time.Minute)); pruneErr != nil || pruned != 1 {
+		t.Errorf("PruneSessionRevocations = %d, %v, want 1", pruned, pruneErr)
+	}
+
+	// API keys are replaced by ID and listed in ID order
+	keys := []APIKey{
+		{ID: "k2", Name: "ops", Hash: "h2", Role: "operator", CreatedAt: start, UpdatedAt: start},
+		{ID: "k1", Name: "acme", Hash: "h1", Role: "tenant-admin", Tenant: "acme", CreatedAt: start, UpdatedAt: start},
+	}
+	for _, key := range keys {
+		if putErr := s.PutAPIKey(ctx, key); putErr != nil {
+			t.Fatal(putErr)
+		}
+	}
+	keys[0].Role, keys[0].DailyQuota, keys[0].MonthlyQuota, keys[0].UpdatedAt = "viewer", 100, 2000, start.Add(time.Minute)
+	if putErr := s.PutAPIKey(ctx, keys[0]); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if got, getErr := s.GetAPIKey(ctx, "k2"); getErr != nil || !reflect.DeepEqual(got, keys[0]) {
+		t.Errorf("GetAPIKey = %+v, %v, want %+v", got, getErr, keys[0])
+	}
+	if listed, listErr := s.ListAPIKeys(ctx); listErr != nil || !reflect.DeepEqual(listed, []APIKey{keys[1], keys[0]}) {
+		t.Errorf("ListAPIKeys = %+v, %v", listed, listErr)
+	}
+	if deleteErr := s.DeleteAPIKey(ctx, "k1"); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if _, getErr := s.GetAPIKey(ctx, "k1"); !errors.Is(getErr, ErrAPIKeyNotFound) {
+		t.Errorf("GetAPIKey after delete = %v, want ErrAPIKeyNotFound", getErr)
+	}
+	if deleteErr := s.DeleteAPIKey(ctx, "k1"); !errors.Is(deleteErr, ErrAPIKeyNotFound) {
+		t.Errorf("second DeleteAPIKey = %v, want ErrAPIKeyNotFound", deleteErr)
+	}
+
+	// Usage adds up per key and UTC day, and lists by day and then key
+	day := UsageDay(start)
+	for _, add := range []struct {
+		keyID, tenant string
+		at            time.Time
+		requests      int64
+		want          int64
+	}{
+		{"k2", "", day.Add(time.Hour), 2, 2},
+		{"k1", "acme", day.Add(2 * time.Hour), 1, 1},
+		{"k2", "", day.Add(23 * time.Hour), 3, 5},
+		{"k2", "", day.Add(25 * time.Hour), 1, 1},
+	} {
+		usage, addErr := s.AddUsage(ctx, add.keyID, add.tenant, add.at, add.requests)
+		if addErr != nil || usage.Requests != add.want {
+			t.Errorf("AddUsage(%s, %v) = %+v, %v, want %d", add.keyID, add.at, usage, addErr, add.want)
+		}
+	}
+	wantUsage := []Usage{
+		{APIKeyID: "k1", Tenant: "acme", Day: day, Requests: 1},
+		{APIKeyID: "k2", Day: day, Requests: 5},
+		{APIKeyID: "k2", Day: day.Add(24 * time.Hour), Requests: 1},
+	}
+	if usage, listErr := s.ListUsage(ctx, day, day.Add(48*time.Hour)); listErr != nil || !reflect.DeepEqual(usage, wantUsage) {
+		t.Errorf("ListUsage = %+v, %v, want %+v", usage, listErr, wantUsage)
+	}
+	if usage, listErr := s.ListUsage(ctx, day.Add(24*time.Hour), day.Add(48*time.Hour)); listErr != nil || !reflect.DeepEqual(usage, wantUsage[2:]) {
+		t.Errorf("ListUsage of the second day = %+v, %v, want %+v", usage, listErr, wantUsage[2:])
+	}
+
+	// Sessions count while they are live and not revoked, by their ID or with all of their user's
+	for _, session := range []Session{
+		{TokenID: "d1", UserName: "dave", IssuedAt: start, ExpiresAt: start.Add(time.Hour)},
+		{TokenID: "d2", UserName: "dave", IssuedAt: start, ExpiresAt: start.Add(3 * time.Hour)},
+		{TokenID: "d3", UserName: "dave", IssuedAt: start, ExpiresAt: start.Add(3 * time.Hour)},
+		{TokenID: "b1", UserName: "bob", IssuedAt: start, ExpiresAt: start.Add(3 * time.Hour)},
+	} {
+		if recordErr := s.RecordSession(ctx, session); recordErr != nil {
+			t.Fatal(recordErr)
+		}
+	}
+	if revokeErr := s.RevokeSessions(ctx, SessionRevocation{TokenID: "d3", RevokedAt: start, ExpiresAt: start.Add(3 * time.Hour)}); revokeErr != nil {
+		t.Fatal(revokeErr)
+	}
+	for _, count := range []struct {
+		userName string
+		at       time.Time
+		want     int
+	}{
+		{"dave", start.Add(30 * time.Minute), 2},
+		{"dave", start.Add(2 * time.Hour), 1},
+		{"bob", start.Add(30 * time.Minute), 0},
+		{"carol", start, 0},
+	} {
+		if live, countErr := s.CountSessions(ctx, count.userName, count.at); countErr != nil || live != count.want {
+			t.Errorf("CountSessions(%s, %v) = %d, %v, want %d", count.userName, count.at, live, countErr, count.want)
+		}
+	}
+	if pruned, pruneErr := s.PruneSessions(ctx, start.Add(2*time.Hour)); pruneErr != nil || pruned != 1 {
+		t.Errorf("PruneSessions = %d, %v, want 1", pruned, pruneErr)
+	}
+
+	// Authentication policies are replaced by tenant and user name and listed tenant by tenant
+	policies := []AuthPolicy{
+		{Tenant: "acme", UserName: "alice", LoginRules: LoginRules{RequireDevice: true}, UpdatedAt: start},
+		{Tenant: "acme", LoginRules: LoginRules{MaxSessions: 3, AllowedCountries: []string{"DE", "FR"}}, UpdatedAt: start},
+		{LoginRules: LoginRules{AllowedHours: &HourWindow{From: "09:00", To: "17:00", TimeZone: "Europe/Berlin", Weekdays: []string{"mon"}}}, UpdatedAt: start},
+	}
+	for _, policy := range policies {
+		if putErr := s.PutAuthPolicy(ctx, policy); putErr != nil {
+			t.Fatal(putErr)
+		}
+	}
+	policies[1].CircuitVersion, policies[1].UpdatedAt = "v2", start.Add(time.Minute)
+	if putErr := s.PutAuthPolicy(ctx, policies[1]); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if got, getErr := s.GetAuthPolicy(ctx, "acme", ""); getErr != nil || !reflect.DeepEqual(got, policies[1]) {
+		t.Errorf("GetAuthPolicy = %+v, %v, want %+v", got, getErr, policies[1])
+	}
+	if listed, listErr := s.ListAuthPolicies(ctx); listErr != nil || !reflect.DeepEqual(listed, []AuthPolicy{policies[2], policies[1], policies[0]}) {
+		t.Errorf("ListAuthPolicies = %+v, %v", listed, listErr)
+	}
+	if deleteErr := s.DeleteAuthPolicy(ctx, "acme", "alice"); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if _, getErr := s.GetAuthPolicy(ctx, "acme", "alice"); !errors.Is(getErr, ErrAuthPolicyNotFound) {
+		t.Errorf("GetAuthPolicy after delete = %v, want ErrAuthPolicyNotFound", getErr)
+	}
+	if deleteErr := s.DeleteAuthPolicy(ctx, "", "alice"); !errors.Is(deleteErr, ErrAuthPolicyNotFound) {
+		t.Errorf("DeleteAuthPolicy of another tenant = %v, want ErrAuthPolicyNotFound", deleteErr)
+	}
+
+	// Transcripts are never replaced, and are listed by user and time
+	transcripts := []Transcript{
+		{ID: "t1", UserName: "dave", KeyID: "v1", CircuitVersion: "v1", Curve: "bn254", Proof: []byte{1, 2, 3}, ProofEncoding: "compressed", Commitment: "42", Nonce: "7", Verdict: TranscriptValid, VerifiedAt: start},
+		{ID: "t2", UserName: "bob", Tenant: "acme", KeyID: "v1", CircuitVersion: "v1", Curve: "bn254", SnarkJSProof: []byte(`{"protocol":"groth16"}`), Commitment: "43", Nonce: "8", Verdict: TranscriptValid, VerifiedAt: start.Add(time.Hour)},
+		{ID: "t3", UserName: "dave", KeyID: "v2", CircuitVersion: "v2", Curve: "bn254", Proof: []byte{4}, Commitment: "42", Nonce: "9", Verdict: TranscriptValid, VerifiedAt: start.Add(2 * time.Hour)},
+	}
+	for _, transcript := range transcripts {
+		if recordErr := s.RecordTranscript(ctx, transcript); recordErr != nil {
+			t.Fatal(recordErr)
+		}
+	}
+	if recordErr := s.RecordTranscript(ctx, Transcript{ID: "t1", UserName: "mallory", VerifiedAt: start}); !errors.Is(recordErr, ErrTranscriptExists) {
+		t.Errorf("RecordTranscript of a taken ID = %v, want ErrTranscriptExists", recordErr)
+	}
+	if got, getErr := s.GetTranscript(ctx, "t1"); getErr != nil || !reflect.DeepEqual(got, transcripts[0]) {
+		t.Errorf("GetTranscript = %+v, %v, want %+v", got, getErr, transcripts[0])
+	}
+	if _, getErr := s.GetTranscript(ctx, "t9"); !errors.Is(getErr, ErrTranscriptNotFound) {
+		t.Errorf("GetTranscript of an unknown ID = %v, want ErrTranscriptNotFound", getErr)
+	}
+	if listed, listErr := s.ListTranscripts(ctx, "", start, start.Add(2*time.Hour)); listErr != nil || !reflect.DeepEqual(listed, transcripts[:2]) {
+		t.Errorf("ListTranscripts = %+v, %v, want %+v", listed, listErr, transcripts[:2])
+	}
+	if listed, listErr := s.ListTranscripts(ctx, "dave", start, start.Add(3*time.Hour)); listErr != nil || !reflect.DeepEqual(listed, []Transcript{transcripts[0], transcripts[2]}) {
+		t.Errorf("ListTranscripts of dave = %+v, %v", listed, listErr)
+	}
+	if pruned, pruneErr := s.PruneTranscripts(ctx, start.Add(90*time.Minute)); pruneErr != nil || pruned != 2 {
+		t.Errorf("PruneTranscripts = %d, %v, want 2", pruned, pruneErr)
+	}
+	if listed, listErr := s.ListTranscripts(ctx, "", start, start.Add(3*time.Hour)); listErr != nil || !reflect.DeepEqual(listed, transcripts[2:]) {
+		t.Errorf("ListTranscripts after pruning = %+v, %v, want %+v", listed, listErr, transcripts[2:])
+	}
+
+	// A user's transcripts are deleted with them, whatever their age
+	if recordErr := s.RecordTranscript(ctx, Transcript{ID: "t4", UserName: "dave", Verdict: TranscriptValid, VerifiedAt: start}); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if deleted, deleteErr := s.DeleteUserTranscripts(ctx, "dave"); deleteErr != nil || !reflect.DeepEqual(deleted, []string{"t3", "t4"}) {
+		t.Errorf("DeleteUserTranscripts = %v, %v, want t3 and t4", deleted, deleteErr)
+	}
+	if listed, listErr := s.ListTranscripts(ctx, "", time.Time{}, start.Add(3*time.Hour)); listErr != nil || len(listed) != 0 {
+		t.Errorf("ListTranscripts after DeleteUserTranscripts = %+v, %v, want none", listed, listErr)
+	}
+	if deleted, deleteErr := s.DeleteUserTranscripts(ctx, "dave"); deleteErr != nil || len(deleted) != 0 {
+		t.Errorf("DeleteUserTranscripts again = %v, %v, want none", deleted, deleteErr)
+	}
+}
+
+func TestActiveCommitments(t *testing.T) {
+	if got := testUser("alice").ActiveCommitments(); !reflect.DeepEqual(got, []string{"152399025", "49"}) {
+		t.Errorf("ActiveCommitments = %v, want the user's and the phone's", got)
+	}
+	pending := User{UserName: "erin", Legacy: &LegacyPassword{Hash: "$2a$04$..."}}
+	if got := pending.ActiveCommitments(); len(got) != 0 {
+		t.Errorf("ActiveCommitments of a pending user = %v, want none", got)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	alice := testUser("alice")
+	if alice.Expired(alice.ExpiresAt.Add(-time.Nanosecond)) || !alice.Expired(*alice.ExpiresAt) {
+		t.Error("Expired should turn true exactly at ExpiresAt")
+	}
+	if (User{}).Expired(time.Now()) {
+		t.Error("a registration without expiry expired")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreContract(t, NewMemory())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	sqlite, openErr := OpenSQLite(filepath.Join(t.TempDir(), "users.db"))
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	testStoreContract(t, sqlite)
+}
+
+func TestSQLiteStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	first, openErr := OpenSQLite(path)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if createErr := first.CreateUser(context.Background(), testUser("alice")); createErr != nil {
+		t.Fatal(createErr)
+	}
+	first.Close()
+
+	reopened, reopenErr := OpenSQLite(path)
+	if reopenErr != nil {
+		t.Fatal(reopenErr)
+	}
+	defer reopened.Close()
+	if _, getErr := reopened.GetUser(context.Background(), "alice"); getErr != nil {
+		t.Errorf("user lost across reopen: %v", getErr)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	testStoreContract(t, NewEncrypted(NewMemory(), testKeyring(t, "k1")))
+}
+
+func TestEncryptedStoreSealsAtRest(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemory()
+	encrypted := NewEncrypted(inner, testKeyring(t, "k1"))
+	alice := testUser("alice")
+	if createErr := encrypted.CreateUser(ctx, alice); createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	stored, _ := inner.GetUser(ctx, "alice")
+	if !strings.HasPrefix(stored.CryptoCommitment, envelopePrefix+".k1.") {
+		t.Errorf("commitment stored as %q, want an envelope under k1", stored.CryptoCommitment)
+	}
+	if !strings.HasPrefix(string(stored.Salt), envelopePrefix+".k1.") {
+		t.Errorf("salt stored as %q, want an envelope under k1", stored.Salt)
+	}
+	if !strings.HasPrefix(stored.Devices[0].CryptoCommitment, envelopePrefix+".k1.") {
+		t.Errorf("device commitment stored as %q, want an envelope under k1", stored.Devices[0].CryptoCommitment)
+	}
+	if !strings.HasPrefix(stored.Recovery.Shares[2].CryptoCommitment, envelopePrefix+".k1.") {
+		t.Errorf("recovery share commitment stored as %q, want an envelope under k1", stored.Recovery.Shares[2].CryptoCommitment)
+	}
+	if !strings.HasPrefix(string(stored.TOTP.Secret), envelopePrefix+".k1.") {
+		t.Errorf("TOTP secret stored as %q, want an envelope under k1", stored.TOTP.Secret)
+	}
+	if recordErr := encrypted.RecordTranscript(ctx, Transcript{ID: "t1", UserName: "alice", Commitment: alice.CryptoCommitment}); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if transcript, _ := inner.GetTranscript(ctx, "t1"); !strings.HasPrefix(transcript.Commitment, envelopePrefix+".k1.") {
+		t.Errorf("transcript commitment stored as %q, want an envelope under k1", transcript.Commitment)
+	}
+
+	// Moving a sealed field to another record must fail: the envelope is bound to its user name
+	stored.UserName = "mallory"
+	inner.PutUser(ctx, stored)
+	if _, getErr := encrypted.GetUser(ctx, "mallory"); getErr == nil {
+		t.Error("envelope copied to another user decrypted")
+	}
+}
+
+func TestBlindedStore(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemory()
+	pepper := []byte("0123456789abcdef0123456789abcdef")
+	blinded := NewBlinded(inner, pepper)
+	alice := testUser("alice")
+	if createErr := blinded.CreateUser(ctx, alice); createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	stored, _ := blinded.GetUser(ctx, "alice")
+	if want := BlindCommitment(pepper, alice.CryptoCommitment); stored.CryptoCommitment != want || !IsBlinded(want) {
+		t.Errorf("commitment stored as %q, want its keyed hash %q", stored.CryptoCommitment, want)
+	}
+	if stored.Devices[0].CryptoCommitment != BlindCommitment(pepper, "49") {
+		t.Errorf("device commitment stored as %q, want its keyed hash", stored.Devices[0].CryptoCommitment)
+	}
+	if stored.Recovery.Shares[2].CryptoCommitment != alice.Recovery.Shares[2].CryptoCommitment {
+		t.Errorf("recovery share commitment stored as %q, want it kept", stored.Recovery.Shares[2].CryptoCommitment)
+	}
+	if alice.Devices[0].CryptoCommitment != "49" {
+		t.Error("blinding changed the caller's devices")
+	}
+	if BlindCommitment([]byte("another pepper"), alice.CryptoCommitment) == stored.CryptoCommitment {
+		t.Error("another pepper blinds the commitment the same way")
+	}
+
+	// Writing a stored user back doesn't blind it twice, and rows from before blinding are blinded when written
+	if putErr := blinded.PutUser(ctx, stored); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if again, _ := inner.GetUser(ctx, "alice"); again.CryptoCommitment != stored.CryptoCommitment {
+		t.Errorf("rewriting a blinded user stored %q, want %q", again.CryptoCommitment, stored.CryptoCommitment)
+	}
+	inner.PutUser(ctx, User{UserName: "legacy", CryptoCommitment: "16", CircuitVersion: "v1"})
+	legacy, _ := blinded.GetUser(ctx, "legacy")
+	if legacy.CryptoCommitment != "16" {
+		t.Errorf("legacy commitment read as %q, want it as stored", legacy.CryptoCommitment)
+	}
+	blinded.PutUser(ctx, legacy)
+	if legacy, _ = inner.GetUser(ctx, "legacy"); legacy.CryptoCommitment != BlindCommitment(pepper, "16") {
+		t.Errorf("rewritten legacy commitment stored as %q, want its keyed hash", legacy.CryptoCommitment)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	if _, openErr := OpenSQLiteReadOnly(path); openErr == nil {
+		t.Error("a missing database opened read-only")
+	}
+	primary, openErr := OpenSQLite(path)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer primary.Close()
+	if createErr := primary.CreateUser(ctx, testUser("alice")); createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	replica, openErr := OpenSQLiteReadOnly(path)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer replica.Close()
+	if user, getErr := replica.GetUser(ctx, "alice"); getErr != nil || user.CryptoCommitment != testUser("alice").CryptoCommitment {
+		t.Errorf("replica read alice as %+v, %v", user, getErr)
+	}
+	writes := map[string]error{
+		"CreateUser":      replica.CreateUser(ctx, testUser("bob")),
+		"PutUser":         replica.PutUser(ctx, testUser("alice")),
+		"AdvanceTOTPStep": replica.AdvanceTOTPStep(ctx, "alice", 57134411),
+		"DeleteUser":      replica.DeleteUser(ctx, "alice"),
+		"RecordSession":   replica.RecordSession(ctx, Session{TokenID: "t1", UserName: "alice"}),
+		"PutAPIKey":       replica.PutAPIKey(ctx, APIKey{ID: "k1"}),
+	}
+	for name, writeErr := range writes {
+		if !errors.Is(writeErr, ErrReadOnly) {
+			t.Errorf("%s on the replica = %v, want %v", name, writeErr, ErrReadOnly)
+		}
+	}
+	if _, getErr := primary.GetUser(ctx, "bob"); !errors.Is(getErr, ErrUserNotFound) {
+		t.Errorf("bob reached the database: %v", getErr)
+	}
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemory()
+	if createErr := NewEncrypted(inner, testKeyring(t, "k1")).CreateUser(ctx, testUser("alice")); createErr != nil {
+		t.Fatal(createErr)
+	}
+	// Plaintext rows written before encryption was enabled pass through
+	inner.PutUser(ctx, User{UserName: "legacy", CryptoCommitment: "16", CircuitVersion: "v1"})
+
+	// k2 is active but k1 is still configured, so old envelopes stay readable
+	rotated := NewEncrypted(inner, testKeyring(t, "k2", "k1"))
+	users, listErr := rotated.ListUsers(ctx)
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if users[0].CryptoCommitment != "152399025" || users[1].CryptoCommitment != "16" {
+		t.Errorf("ListUsers after rotation = %+v", users)
+	}
+
+	// Once k1 is dropped its envelopes can't be opened
+	if _, getErr := NewEncrypted(inner, testKeyring(t, "k2")).GetUser(ctx, "alice"); !errors.Is(getErr, ErrUnknownMasterKey) {
+		t.Errorf("GetUser without k1 = %v, want ErrUnknownMasterKey", getErr)
+	}
+}
+
+// testDirectory starts a directory holding person entries for the given users
+func testDirectory(t *testing.T, users ...string) *ldaptest.Server {
+	t.Helper()
+	directory, startErr := ldaptest.NewServer("cn=ofa,dc=example,dc=com", "s3cret")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	t.Cleanup(directory.Close)
+	directory.AddEntry("ou=people,dc=example,dc=com", map[string][]string{"objectClass": {"organizationalUnit"}})
+	for _, name := range users {
+		directory.AddEntry("uid="+name+",ou=people,dc=example,dc=com", map[string][]string{"objectClass": {"person"}, "uid": {name}, "cn": {name}})
+	}
+	return directory
+}
+
+// testLDAPConfig points the LDAP store at a test directory
+func testLDAPConfig(directory *ldaptest.Server) LDAPConfig {
+	return LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=ofa,dc=example,dc=com",
+		BindPassword: "s3cret",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(objectClass=person)",
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	testStoreContract(t, OpenRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}), "ofa:"))
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "ofa:") {
+			t.Errorf("key %q is outside the prefix", key)
+		}
+	}
+}
+
+func TestLDAPStore(t *testing.T) {
+	directory := testDirectory(t, "alice", "bob", "carol", "dave")
+	directoryStore, openErr := OpenLDAP(context.Background(), testLDAPConfig(directory))
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	testStoreContract(t, directoryStore)
+
+	// Deleting a registration leaves the directory entry itself alone
+	carol := directory.Entry("uid=carol,ou=people,dc=example,dc=com")
+	if carol == nil || carol["ofaCryptoCommitment"] != nil || carol["cn"][0] != "carol" {
+		t.Errorf("carol's entry after DeleteUser = %v", carol)
+	}
+}
+
+func TestLDAPStoreDirectory(t *testing.T) {
+	ctx := context.Background()
+	directory := testDirectory(t, "alice")
+	cfg := testLDAPConfig(directory)
+	cfg.Attributes.CryptoCommitment = "description"
+
+	badPassword := cfg
+	badPassword.BindPassword = "wrong"
+	if _, openErr := OpenLDAP(ctx, badPassword); !ldap.IsErrorWithCode(openErr, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("OpenLDAP with a wrong password = %v, want invalidCredentials", openErr)
+	}
+	directoryStore, openErr := OpenLDAP(ctx, cfg)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer directoryStore.Close()
+
+	// Only users with a directory entry can register, in the configured attributes
+	if createErr := directoryStore.CreateUser(ctx, testUser("mallory")); !errors.Is(createErr, ErrNoDirectoryEntry) {
+		t.Errorf("CreateUser without an entry = %v, want ErrNoDirectoryEntry", createErr)
+	}
+	if createErr := directoryStore.CreateUser(ctx, testUser("alice")); createErr != nil {
+		t.Fatal(createErr)
+	}
+	alice := directory.Entry("uid=alice,ou=people,dc=example,dc=com")
+	if alice["description"][0] != "152399025" || alice["ofaCreatedAt"][0] != "20240501120000Z" {
+		t.Errorf("alice's entry = %v", alice)
+	}
+
+	// A dropped connection is replaced transparently
+	directory.DropConnections()
+	if got, getErr := directoryStore.GetUser(ctx, "alice"); getErr != nil || !reflect.DeepEqual(got, testUser("alice")) {
+		t.Errorf("GetUser after the directory dropped the connection = %+v, %v", got, getErr)
+	}
+}
+
+func TestNewMasterKeyringValidation(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name   string
+		active string
+		keys   map[string]string
+	}{
+		{name: "active missing", active: "k2", keys: map[string]string{"k1": key}},
+		{name: "short key", active: "k1", keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(make([]byte, 16))}},
+		{name: "not base64", active: "k1", keys: map[string]string{"k1": "%%%"}},
+		{name: "dotted ID", active: "k.1", keys: map[string]string{"k.1": key}},
+	}
+	for _, test := range tests {
+		if _, keyringErr := NewMasterKeyring(test.active, test.keys); keyringErr == nil {
+			t.Errorf("%s: keyring accepted", test.name)
+		}
+	}
+}
+
+func TestAESGCMRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	sealed, sealErr := SealAESGCM(key, []byte("proving key"), []byte("aad"))
+	if sealErr != nil {
+		t.Fatal(sealErr)
+	}
+	opened, openErr := OpenAESGCM(key, sealed, []byte("aad"))
+	if openErr != nil || string(opened) != "proving key" {
+		t.Errorf("OpenAESGCM = %q, %v", opened, openErr)
+	}
+	if _, openErr := OpenAESGCM(key, sealed, []byte("other aad")); openErr == nil {
+		t.Error("ciphertext opened with the wrong additional data")
+	}
+}
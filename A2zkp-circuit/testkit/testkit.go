@@ -0,0 +1,208 @@
+// Package testkit runs the full server in-process for integration tests of the auth flows built on
+// it. A Kit serves every route of package server on a loopback port with an in-memory store, and
+// knows the secrets of the fixture users it registers, so a test can log them in, make proofs for
+// them or make ones that fail without deploying the service or handling secrets itself.
+//
+// Proofs are real Groth16 proofs of the configured circuit. Tests of large circuits can trade that
+// for speed with WithConfig and mock_prover, whose proofs prove nothing.
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+
+	"A2zkp-circuit/client"
+	"A2zkp-circuit/secret"
+	"A2zkp-circuit/server"
+)
+
+// AdminToken is the admin token a kit's server accepts, unless WithConfig sets another
+const AdminToken = "testkit-admin-token"
+
+// User is a fixture user: the name registered and the secret the kit proves with on their behalf
+type User struct {
+	Name   string
+	Secret int64
+	Tenant string // Tenant is the organisation the user is registered in; empty for the default tenant
+}
+
+// Option adjusts how Start starts a kit
+type Option func(*settings)
+
+// settings is what the options of Start set
+type settings struct {
+	configure []func(*server.Config)
+	users     []User
+}
+
+// WithConfig adjusts the configuration the server starts with. It is applied on top of the kit's
+// own: the defaults with an in-memory store and AdminToken.
+func WithConfig(configure func(*server.Config)) Option {
+	return func(s *settings) { s.configure = append(s.configure, configure) }
+}
+
+// WithUsers registers fixture users once the server is up
+func WithUsers(users ...User) Option {
+	return func(s *settings) { s.users = append(s.users, users...) }
+}
+
+// Kit is a running server, clients of it and the fixture users registered through it
+type Kit struct {
+	Server *server.Server
+	URL    string         // URL is the base URL the server is served on, e.g. "http://127.0.0.1:41234"
+	Client *client.Client // Client calls the server as an application of the default tenant would
+	Admin  *client.Client // Admin calls it with the admin token
+
+	httpServer *httptest.Server
+
+	mu      sync.Mutex
+	users   map[string]User
+	tenants map[string]*client.Client // tenants holds the clients of tenants' users, which cache proving keys
+}
+
+// Start starts a server and registers the users of WithUsers; Close stops it
+func Start(ctx context.Context, opts ...Option) (*Kit, error) {
+	var set settings
+	for _, opt := range opts {
+		opt(&set)
+	}
+	cfg := server.DefaultConfig()
+	cfg.DatabasePath = ""
+	cfg.AdminToken = AdminToken
+	for _, configure := range set.configure {
+		configure(&cfg)
+	}
+	srv, newErr := server.New(ctx, cfg)
+	if newErr != nil {
+		return nil, fmt.Errorf("testkit: starting the server: %w", newErr)
+	}
+
+	httpServer := httptest.NewServer(srv.Handler())
+	kit := &Kit{
+		Server:     srv,
+		URL:        httpServer.URL,
+		Client:     client.New(httpServer.URL),
+		Admin:      client.New(httpServer.URL, client.WithAdminToken(cfg.AdminToken)),
+		httpServer: httpServer,
+		users:      make(map[string]User),
+		tenants:    make(map[string]*client.Client),
+	}
+	for _, user := range set.users {
+		if registerErr := kit.Register(ctx, user); registerErr != nil {
+			kit.Close()
+			return nil, registerErr
+		}
+	}
+	return kit, nil
+}
+
+// Close stops the server and releases what it holds
+func (k *Kit) Close() error {
+	k.httpServer.Close()
+	return k.Server.Close()
+}
+
+// Register registers a fixture user under the commitment of their secret, which the kit keeps
+// for the proofs it makes for them
+func (k *Kit) Register(ctx context.Context, user User) error {
+	sdk := k.clientFor(user)
+	commitment, commitErr := sdk.UserCommitment(ctx, user.Name, secret.FromInt64(user.Secret))
+	if commitErr != nil {
+		return fmt.Errorf("testkit: computing the commitment of %q: %w", user.Name, commitErr)
+	}
+	registration := client.Registration{UserName: user.Name, CryptoCommitment: commitment, Tenant: user.Tenant}
+	if registerErr := sdk.Register(ctx, registration); registerErr != nil {
+		return fmt.Errorf("testkit: registering %q: %w", user.Name, registerErr)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.users[user.Name] = user
+	return nil
+}
+
+// User returns the fixture user registered under name
+func (k *Kit) User(name string) (User, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	user, registered := k.users[name]
+	return user, registered
+}
+
+// Commitment returns the commitment a fixture user was registered under
+func (k *Kit) Commitment(ctx context.Context, name string) (string, error) {
+	user, userErr := k.fixture(name)
+	if userErr != nil {
+		return "", userErr
+	}
+	return k.clientFor(user).UserCommitment(ctx, user.Name, secret.FromInt64(user.Secret))
+}
+
+// Proof requests a challenge for a fixture user and proves it with their secret. The submission
+// verifies once, through Client.Verify or any route taking a proof.
+func (k *Kit) Proof(ctx context.Context, name string) (client.ProofSubmission, error) {
+	user, userErr := k.fixture(name)
+	if userErr != nil {
+		return client.ProofSubmission{}, userErr
+	}
+	return k.prove(ctx, user, user.Secret)
+}
+
+// ProofWithSecret is Proof with another secret than the fixture user's, for tests of rejected
+// logins: the submission is well-formed and fails verification
+func (k *Kit) ProofWithSecret(ctx context.Context, name string, userSecret int64) (client.ProofSubmission, error) {
+	user, userErr := k.fixture(name)
+	if userErr != nil {
+		return client.ProofSubmission{}, userErr
+	}
+	return k.prove(ctx, user, userSecret)
+}
+
+// Login runs the whole login of a fixture user: a challenge, a proof with their secret and its
+// verification
+func (k *Kit) Login(ctx context.Context, name string) (client.Verdict, error) {
+	user, userErr := k.fixture(name)
+	if userErr != nil {
+		return client.Verdict{}, userErr
+	}
+	submission, proofErr := k.prove(ctx, user, user.Secret)
+	if proofErr != nil {
+		return client.Verdict{}, proofErr
+	}
+	return k.clientFor(user).Verify(ctx, submission)
+}
+
+// prove requests a challenge for user and proves it with userSecret
+func (k *Kit) prove(ctx context.Context, user User, userSecret int64) (client.ProofSubmission, error) {
+	sdk := k.clientFor(user)
+	challenge, challengeErr := sdk.RequestChallenge(ctx, user.Name)
+	if challengeErr != nil {
+		return client.ProofSubmission{}, challengeErr
+	}
+	return sdk.Prove(ctx, user.Name, secret.FromInt64(userSecret), challenge)
+}
+
+// fixture returns the fixture user registered under name, or an error naming it
+func (k *Kit) fixture(name string) (User, error) {
+	user, registered := k.User(name)
+	if !registered {
+		return User{}, fmt.Errorf("testkit: %q is not a fixture user of this kit", name)
+	}
+	return user, nil
+}
+
+// clientFor returns the client calling the server in user's tenant
+func (k *Kit) clientFor(user User) *client.Client {
+	if user.Tenant == "" {
+		return k.Client
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	sdk, cached := k.tenants[user.Tenant]
+	if !cached {
+		sdk = client.New(k.URL, client.WithTenant(user.Tenant))
+		k.tenants[user.Tenant] = sdk
+	}
+	return sdk
+}
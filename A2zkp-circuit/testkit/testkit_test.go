@@ -0,0 +1,52 @@
+package testkit
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"A2zkp-circuit/client"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark/logger"
+)
+
+func TestKit(t *testing.T) {
+	logger.Disable()
+	ctx := context.Background()
+	kit, startErr := Start(ctx, WithUsers(User{Name: "alice", Secret: 12345}))
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	defer kit.Close()
+
+	verdict, loginErr := kit.Login(ctx, "alice")
+	if loginErr != nil || verdict.KeyID == "" {
+		t.Fatalf("logging alice in = %+v, %v", verdict, loginErr)
+	}
+	commitment, commitErr := kit.Commitment(ctx, "alice")
+	if want, _ := kit.Client.Commitment(ctx, secret.FromInt64(12345)); commitErr != nil || commitment != want {
+		t.Errorf("alice's commitment = %q, %v; want %q", commitment, commitErr, want)
+	}
+
+	// A proof with another secret is well-formed and rejected by the server
+	submission, proofErr := kit.ProofWithSecret(ctx, "alice", 54321)
+	if proofErr != nil {
+		t.Fatal(proofErr)
+	}
+	var apiErr *client.APIError
+	if _, verifyErr := kit.Client.Verify(ctx, submission); !errors.As(verifyErr, &apiErr) || apiErr.Code != "proof_invalid" {
+		t.Errorf("proof with the wrong secret = %v, want proof_invalid", verifyErr)
+	}
+
+	// A user registered later through the kit logs in too, one it never registered doesn't
+	if registerErr := kit.Register(ctx, User{Name: "bob", Secret: 777}); registerErr != nil {
+		t.Fatal(registerErr)
+	}
+	if _, loginErr := kit.Login(ctx, "bob"); loginErr != nil {
+		t.Errorf("logging bob in: %v", loginErr)
+	}
+	if _, loginErr := kit.Login(ctx, "mallory"); loginErr == nil {
+		t.Error("logged in a user the kit never registered")
+	}
+}
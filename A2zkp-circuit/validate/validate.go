@@ -0,0 +1,185 @@
+// Package validate checks the shape of request fields before any cryptographic work is done on them.
+//
+// A Validator collects a FieldError for every field that is missing, too long or malformed, so a
+// client learns about all of them from one response. The checks are cheap and bounded: lengths are
+// checked before anything is decoded or parsed, and field elements are canonical decimal strings
+// below the modulus of the circuit's scalar field, so nothing out of range reaches a witness.
+package validate
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"A2zkp-circuit/circuit"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// MaxUserIDLength bounds user names accepted by every endpoint
+const MaxUserIDLength = 256
+
+// keyIDHexLength is the length of the hex digest that ends a key ID such as "vk-0123456789abcdef"
+const keyIDHexLength = 16
+
+// maxFieldElementDigits is the number of decimal digits of the largest scalar field element of any curve
+var maxFieldElementDigits = func() int {
+	var digits int
+	for _, curve := range circuit.Curves {
+		digits = max(digits, len(new(big.Int).Sub(curve.ScalarField(), big.NewInt(1)).String()))
+	}
+	return digits
+}()
+
+// FieldError is one invalid field, in the shape of the "invalid-params" members of RFC 7807
+type FieldError struct {
+	Name   string `json:"name"`   // Name is the JSON name of the field, with an index for list items, e.g. "proofs[1].proof"
+	Reason string `json:"reason"` // Reason says what is wrong with it, e.g. "is required"
+}
+
+// Errors lists the invalid fields of a request
+type Errors []FieldError
+
+// Error joins the fields and their reasons, e.g. "user_name is required; nonce must be ..."
+func (e Errors) Error() string {
+	parts := make([]string, len(e))
+	for i, fieldErr := range e {
+		parts[i] = fieldErr.Name + " " + fieldErr.Reason
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Validator collects the field errors of one request. The zero value is ready to use.
+type Validator struct {
+	errs Errors
+}
+
+// Fail records that a field is invalid for a formatted reason
+func (v *Validator) Fail(name, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Name: name, Reason: fmt.Sprintf(format, args...)})
+}
+
+// Err returns the collected field errors as Errors, or nil when every field is valid
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Required reports whether a field is present, failing it when it is empty
+func (v *Validator) Required(name, value string) bool {
+	if value == "" {
+		v.Fail(name, "is required")
+		return false
+	}
+	return true
+}
+
+// MaxLength reports whether a field of length bytes fits in max, failing it when it doesn't
+func (v *Validator) MaxLength(name string, length, max int) bool {
+	if length > max {
+		v.Fail(name, "exceeds %d bytes", max)
+		return false
+	}
+	return true
+}
+
+// Text checks that a field is present, at most max bytes of UTF-8 and free of control characters
+func (v *Validator) Text(name, value string, max int) {
+	switch {
+	case !v.Required(name, value) || !v.MaxLength(name, len(value), max):
+	case !utf8.ValidString(value):
+		v.Fail(name, "must be valid UTF-8")
+	case strings.ContainsFunc(value, unicode.IsControl):
+		v.Fail(name, "must not contain control characters")
+	}
+}
+
+// UserID checks the format of a user name
+func (v *Validator) UserID(name, id string) {
+	v.Text(name, id, MaxUserIDLength)
+}
+
+// FieldElement parses a required decimal field element, such as a commitment, nonce or nullifier.
+// It must be canonical, without sign or leading zeros, and below the scalar field modulus. It
+// returns nil when the field is invalid.
+func (v *Validator) FieldElement(name, text string) *big.Int {
+	return v.FieldElementOn(circuit.Curve, name, text)
+}
+
+// FieldElementOn parses a required decimal element of the scalar field of curve, as FieldElement
+// does for circuit.Curve
+func (v *Validator) FieldElementOn(curve ecc.ID, name, text string) *big.Int {
+	if !v.Required(name, text) {
+		return nil
+	}
+	canonical := len(text) <= maxFieldElementDigits && (text == "0" || text[0] != '0')
+	for i := 0; canonical && i < len(text); i++ {
+		canonical = text[i] >= '0' && text[i] <= '9'
+	}
+	value, parsed := new(big.Int), false
+	if canonical {
+		_, parsed = value.SetString(text, 10)
+	}
+	if !parsed || value.Cmp(curve.ScalarField()) >= 0 {
+		v.Fail(name, "must be a decimal integer in [0, field modulus) without sign or leading zeros")
+		return nil
+	}
+	return value
+}
+
+// Hex decodes a required field of exactly size hex-encoded bytes, returning nil when it is invalid
+func (v *Validator) Hex(name, text string, size int) []byte {
+	if !v.Required(name, text) {
+		return nil
+	}
+	if len(text) != hex.EncodedLen(size) {
+		v.Fail(name, "must be %d hex-encoded bytes", size)
+		return nil
+	}
+	decoded, decodeErr := hex.DecodeString(text)
+	if decodeErr != nil {
+		v.Fail(name, "must be %d hex-encoded bytes", size)
+		return nil
+	}
+	return decoded
+}
+
+// Base64 decodes a field of at most max bytes in standard base64, returning nil when it is empty or invalid
+func (v *Validator) Base64(name, text string, max int) []byte {
+	// Anything longer than the encoding of max bytes decodes to more than max bytes
+	if len(text) > base64.StdEncoding.EncodedLen(max) {
+		v.Fail(name, "exceeds %d bytes", max)
+		return nil
+	}
+	decoded, decodeErr := base64.StdEncoding.DecodeString(text)
+	switch {
+	case decodeErr != nil:
+		v.Fail(name, "must be base64-encoded")
+		return nil
+	case !v.MaxLength(name, len(decoded), max):
+		return nil
+	}
+	return decoded
+}
+
+// KeyID checks an optional key version ID: a lowercase name, a dash and 8 hex-encoded bytes, as
+// in "vk-0123456789abcdef"
+func (v *Validator) KeyID(name, id string) {
+	if id == "" {
+		return
+	}
+	prefix, digest, found := strings.Cut(id, "-")
+	valid := found && prefix != "" && len(prefix) <= 16 && len(digest) == keyIDHexLength
+	for _, letter := range prefix {
+		valid = valid && letter >= 'a' && letter <= 'z'
+	}
+	if _, decodeErr := hex.DecodeString(digest); !valid || decodeErr != nil || strings.ToLower(digest) != digest {
+		v.Fail(name, "must be a key version such as vk-0123456789abcdef")
+	}
+}
@@ -0,0 +1,64 @@
+package validate
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"A2zkp-circuit/circuit"
+)
+
+func TestFieldElement(t *testing.T) {
+	modulus := circuit.Curve.ScalarField()
+	maxElement := new(big.Int).Sub(modulus, big.NewInt(1)).String()
+	for text, want := range map[string]bool{
+		"0": true, "49": true, maxElement: true,
+		"": false, "-1": false, "+1": false, "007": false, "0x10": false, "1_000": false, " 1": false,
+		modulus.String(): false, strings.Repeat("9", 200): false,
+	} {
+		var v Validator
+		value := v.FieldElement("nonce", text)
+		if got := v.Err() == nil; got != want || (value != nil) != want {
+			t.Errorf("FieldElement(%q) valid = %v (value %v), want %v", text, got, value, want)
+		}
+	}
+}
+
+func TestValidator(t *testing.T) {
+	var v Validator
+	v.UserID("user_name", "")
+	v.UserID("device", "phone\n")
+	v.Text("label", strings.Repeat("a", 65), 64)
+	v.KeyID("key_id", "vk-0123456789ABCDEF")
+	if decoded := v.Hex("salt", "00ff", 2); len(decoded) != 2 {
+		t.Errorf("Hex(00ff) = %x", decoded)
+	}
+	v.Hex("digest", "00f", 2)
+	if decoded := v.Base64("proof", "AAEC", 3); len(decoded) != 3 {
+		t.Errorf("Base64(AAEC) = %x", decoded)
+	}
+	v.Base64("policy_proof", "AAECAw==", 3)
+	v.Base64("snarkjs", "not base64!", 16)
+
+	// Every invalid field is reported, in order, and nothing else
+	var fieldErrs Errors
+	if !errors.As(v.Err(), &fieldErrs) {
+		t.Fatalf("Err() = %v, want Errors", v.Err())
+	}
+	var names []string
+	for _, fieldErr := range fieldErrs {
+		names = append(names, fieldErr.Name)
+	}
+	if got, want := strings.Join(names, ","), "user_name,device,label,key_id,digest,policy_proof,snarkjs"; got != want {
+		t.Errorf("invalid fields = %s, want %s (%v)", got, want, fieldErrs)
+	}
+
+	var valid Validator
+	valid.UserID("user_name", "alice")
+	valid.KeyID("key_id", "")
+	valid.KeyID("key_id", "snarkjs-0123456789abcdef")
+	if validErr := valid.Err(); validErr != nil {
+		t.Errorf("valid fields rejected: %v", validErr)
+	}
+}
@@ -0,0 +1,185 @@
+package verifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// ErrKeyMismatch is returned when a fetched verifying key doesn't hash to the key ID it was requested under
+var ErrKeyMismatch = errors.New("verifying key does not match its key ID")
+
+// KeyFetcher downloads the verifying key of a key version; an empty keyID selects the current one.
+// *client.Client implements it against the server's /v1/keys/verifying endpoint.
+type KeyFetcher interface {
+	VerifyingKey(ctx context.Context, keyID string) (groth16.VerifyingKey, error)
+}
+
+// KeyCache fetches verifying keys on first use and keeps them. A key ID is a digest of its key,
+// so a version never changes once fetched and is cached for the life of the cache; only which
+// version is current is looked up again, once currentTTL has passed.
+type KeyCache struct {
+	fetcher    KeyFetcher
+	currentTTL time.Duration
+
+	mu        sync.Mutex
+	verifiers map[string]*Verifier
+	currentID string
+	checkedAt time.Time // checkedAt is when currentID was last resolved
+}
+
+// NewKeyCache creates a cache fetching through fetcher, re-resolving the current key version
+// after currentTTL (every time when zero)
+func NewKeyCache(fetcher KeyFetcher, currentTTL time.Duration) *KeyCache {
+	return &KeyCache{fetcher: fetcher, currentTTL: currentTTL, verifiers: make(map[string]*Verifier)}
+}
+
+// Verifier returns the verifier of a key version, or of the current one for an empty keyID
+func (c *KeyCache) Verifier(ctx context.Context, keyID string) (*Verifier, error) {
+	c.mu.Lock()
+	if keyID == "" && c.currentID != "" && time.Since(c.checkedAt) < c.currentTTL {
+		keyID = c.currentID
+	}
+	cached, found := c.verifiers[keyID]
+	c.mu.Unlock()
+	if found {
+		return cached, nil
+	}
+
+	// Fetched without holding the lock; concurrent misses may download the same key twice
+	verifyingKey, fetchErr := c.fetcher.VerifyingKey(ctx, keyID)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("fetching verifying key: %w", fetchErr)
+	}
+	fetchedID, idErr := KeyID(verifyingKey)
+	if idErr != nil {
+		return nil, idErr
+	}
+	if keyID != "" && fetchedID != keyID {
+		return nil, fmt.Errorf("%w: requested %s, got %s", ErrKeyMismatch, keyID, fetchedID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if keyID == "" {
+		c.currentID, c.checkedAt = fetchedID, time.Now()
+	}
+	if existing, found := c.verifiers[fetchedID]; found {
+		return existing, nil
+	}
+	verifier := New(verifyingKey)
+	c.verifiers[fetchedID] = verifier
+	return verifier, nil
+}
+
+// VerifyProof checks a proof with the verifying key of a key version, or of the current one for an empty keyID
+func (c *KeyCache) VerifyProof(ctx context.Context, keyID string, proofBytes []byte, inputs PublicInputs) error {
+	verifier, keyErr := c.Verifier(ctx, keyID)
+	if keyErr != nil {
+		return keyErr
+	}
+	return verifier.VerifyProof(ctx, proofBytes, inputs)
+}
+
+// VerdictCache remembers the outcome of checking a proof against a key and public inputs for a
+// while, so an identical submission, such as a client retrying after a dropped response, gets the
+// same verdict without another pairing check. Only deterministic verdicts are kept: acceptance, and
+// failures other than a cancelled or expired context.
+type VerdictCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	verdicts map[[sha256.Size]byte]cachedVerdict
+
+	hits, misses atomic.Uint64
+}
+
+// cachedVerdict is the result of a check and when it is forgotten
+type cachedVerdict struct {
+	err   error
+	until time.Time
+}
+
+// NewVerdictCache creates a cache keeping verdicts for ttl; 0 disables it
+func NewVerdictCache(ttl time.Duration) *VerdictCache {
+	return &VerdictCache{ttl: ttl, verdicts: make(map[[sha256.Size]byte]cachedVerdict)}
+}
+
+// SetTTL changes how long verdicts reached from now on are kept
+func (c *VerdictCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// verdictKey hashes what a verdict depends on; every field is length-prefixed so no two
+// submissions share an encoding
+func verdictKey(keyID string, proof []byte, inputs PublicInputs) [sha256.Size]byte {
+	digest := sha256.New()
+	for _, field := range [][]byte{[]byte(keyID), proof, []byte(inputs.Commitment), inputs.Nonce.Bytes(), []byte(inputs.DeviceID)} {
+		binary.Write(digest, binary.BigEndian, uint64(len(field)))
+		digest.Write(field)
+	}
+	var key [sha256.Size]byte
+	digest.Sum(key[:0])
+	return key
+}
+
+// Lookup returns the verdict reached for a proof against the key keyID and inputs, if one is
+// cached, counting a hit or a miss. Expired verdicts are dropped on the way.
+func (c *VerdictCache) Lookup(keyID string, proof []byte, inputs PublicInputs) (verdict error, found bool) {
+	if inputs.Nonce == nil {
+		return nil, false
+	}
+	key := verdictKey(keyID, proof, inputs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for cachedKey, cached := range c.verdicts {
+		if !now.Before(cached.until) {
+			delete(c.verdicts, cachedKey)
+		}
+	}
+	cached, found := c.verdicts[key]
+	if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return cached.err, found
+}
+
+// Store caches the verdict reached for a proof against the key keyID and inputs, unless it is a
+// cancelled or expired context, which says nothing about the proof
+func (c *VerdictCache) Store(keyID string, proof []byte, inputs PublicInputs, verdict error) {
+	if errors.Is(verdict, context.Canceled) || errors.Is(verdict, context.DeadlineExceeded) || inputs.Nonce == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl > 0 {
+		c.verdicts[verdictKey(keyID, proof, inputs)] = cachedVerdict{err: verdict, until: time.Now().Add(c.ttl)}
+	}
+}
+
+// Verify returns the cached verdict for a proof against the key keyID and inputs, or runs check,
+// which performs the actual verification, and caches its verdict
+func (c *VerdictCache) Verify(keyID string, proof []byte, inputs PublicInputs, check func() error) error {
+	if verdict, found := c.Lookup(keyID, proof, inputs); found {
+		return verdict
+	}
+	verdict := check()
+	c.Store(keyID, proof, inputs, verdict)
+	return verdict
+}
+
+// Stats returns how many lookups found a cached verdict and how many did not
+func (c *VerdictCache) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,112 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// fakeFetcher serves one verifying key as the current version and counts downloads
+type fakeFetcher struct {
+	verifyingKey groth16.VerifyingKey
+	fetches      int
+}
+
+// VerifyingKey returns the fixture key for any key ID
+func (f *fakeFetcher) VerifyingKey(ctx context.Context, keyID string) (groth16.VerifyingKey, error) {
+	f.fetches++
+	return f.verifyingKey, nil
+}
+
+func TestKeyCache(t *testing.T) {
+	fixture := newFixture(t)
+	keyID, idErr := KeyID(fixture.verifyingKey)
+	if idErr != nil {
+		t.Fatal(idErr)
+	}
+
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		keyIDs      []string
+		wantFetches int
+	}{
+		{name: "current key is cached for the TTL", ttl: time.Hour, keyIDs: []string{"", "", ""}, wantFetches: 1},
+		{name: "current key is resolved again without a TTL", keyIDs: []string{"", ""}, wantFetches: 2},
+		{name: "named key is cached for good", keyIDs: []string{keyID, keyID}, wantFetches: 1},
+		{name: "current key fills the named entry", ttl: time.Hour, keyIDs: []string{"", keyID}, wantFetches: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := &fakeFetcher{verifyingKey: fixture.verifyingKey}
+			cache := NewKeyCache(fetcher, test.ttl)
+			for _, id := range test.keyIDs {
+				if verifyErr := cache.VerifyProof(context.Background(), id, fixture.proof, validInputs); verifyErr != nil {
+					t.Fatalf("VerifyProof(%q) = %v", id, verifyErr)
+				}
+			}
+			if fetcher.fetches != test.wantFetches {
+				t.Errorf("%d fetches, want %d", fetcher.fetches, test.wantFetches)
+			}
+		})
+	}
+}
+
+func TestKeyCacheRejectsMismatchedKey(t *testing.T) {
+	fixture := newFixture(t)
+	cache := NewKeyCache(&fakeFetcher{verifyingKey: fixture.verifyingKey}, time.Hour)
+	if _, keyErr := cache.Verifier(context.Background(), "vk-0000000000000000"); !errors.Is(keyErr, ErrKeyMismatch) {
+		t.Errorf("Verifier for another key ID = %v, want ErrKeyMismatch", keyErr)
+	}
+}
+
+func TestVerdictCache(t *testing.T) {
+	fixture := newFixture(t)
+	v := New(fixture.verifyingKey)
+	cache := NewVerdictCache(time.Hour)
+	wrongInputs := PublicInputs{Commitment: "49", Nonce: validInputs.Nonce}
+	checks := 0
+	verify := func(inputs PublicInputs) error {
+		return cache.Verify("vk-test", fixture.proof, inputs, func() error {
+			checks++
+			return v.VerifyProof(context.Background(), fixture.proof, inputs)
+		})
+	}
+
+	for range 2 {
+		if verifyErr := verify(validInputs); verifyErr != nil {
+			t.Fatalf("valid proof = %v", verifyErr)
+		}
+		if verifyErr := verify(wrongInputs); !errors.Is(verifyErr, ErrRejected) {
+			t.Fatalf("wrong commitment = %v, want ErrRejected", verifyErr)
+		}
+	}
+	if checks != 2 {
+		t.Errorf("%d checks for two submissions made twice, want 2", checks)
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 2 {
+		t.Errorf("stats = %d hits, %d misses, want 2 and 2", hits, misses)
+	}
+
+	// Verdicts are per key, and cancelled checks aren't kept
+	if _, found := cache.Lookup("vk-other", fixture.proof, validInputs); found {
+		t.Error("verdict reused under another key ID")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelledInputs := PublicInputs{Commitment: commitment12345, Nonce: big.NewInt(78)}
+	cache.Store("vk-test", fixture.proof, cancelledInputs, v.VerifyProof(cancelled, fixture.proof, cancelledInputs))
+	if _, found := cache.Lookup("vk-test", fixture.proof, cancelledInputs); found {
+		t.Error("verdict of a cancelled check was cached")
+	}
+
+	disabled := NewVerdictCache(0)
+	disabled.Store("vk-test", fixture.proof, validInputs, nil)
+	if _, found := disabled.Lookup("vk-test", fixture.proof, validInputs); found {
+		t.Error("a cache without a TTL kept a verdict")
+	}
+}
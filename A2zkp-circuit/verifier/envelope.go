@@ -0,0 +1,120 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"A2zkp-circuit/circuit"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark/backend/groth16"
+)
+
+// ProofEnvelopeVersion is the format_version of the envelopes NewProofEnvelope writes and the
+// newest Open reads
+const ProofEnvelopeVersion = 1
+
+// BackendGroth16 is the backend of an envelope holding a Groth16 proof, the only one verified
+const BackendGroth16 = "groth16"
+
+// ErrProofEnvelope is returned for an envelope this package can't read, such as one of a newer
+// format_version or another backend
+var ErrProofEnvelope = errors.New("unsupported proof envelope")
+
+// ProofEnvelope wraps an encoded proof with what it takes to decode it, so a verifier can tell a
+// proof it can't read, or one it has to translate, from a malformed one
+type ProofEnvelope struct {
+	FormatVersion  int    `json:"format_version"`            // FormatVersion is the layout of the envelope, ProofEnvelopeVersion
+	Curve          string `json:"curve"`                     // Curve is the curve the proof was made over, as circuit.ParseCurve takes it
+	Backend        string `json:"backend"`                   // Backend is the proof system, BackendGroth16
+	CircuitVersion string `json:"circuit_version,omitempty"` // CircuitVersion is the version of the circuit the proof is for
+	Encoding       string `json:"encoding,omitempty"`        // Encoding is ProofCompressed, the default, or ProofUncompressed
+	Payload        []byte `json:"payload"`                   // Payload is the proof in gnark binary encoding, base64
+}
+
+// NewProofEnvelope wraps a proof of a circuit version, with compressed points
+func NewProofEnvelope(circuitVersion string, proof groth16.Proof) (ProofEnvelope, error) {
+	var payload bytes.Buffer
+	if _, writeErr := proof.WriteTo(&payload); writeErr != nil {
+		return ProofEnvelope{}, fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	return ProofEnvelope{
+		FormatVersion:  ProofEnvelopeVersion,
+		Curve:          proof.CurveID().String(),
+		Backend:        BackendGroth16,
+		CircuitVersion: circuitVersion,
+		Encoding:       ProofCompressed,
+		Payload:        payload.Bytes(),
+	}, nil
+}
+
+// Open checks that the envelope is one this package reads and returns its payload as ReadProofOn
+// takes it. Payloads of gnark releases before v0.8, whose proofs ended after their three points,
+// are translated by appending the empty commitment list later releases write.
+func (e ProofEnvelope) Open() ([]byte, error) {
+	switch {
+	case e.FormatVersion == 0:
+		return nil, fmt.Errorf("%w: format_version is required", ErrProofEnvelope)
+	case e.FormatVersion > ProofEnvelopeVersion:
+		return nil, fmt.Errorf("%w: format_version %d is newer than the %d this verifier reads", ErrProofEnvelope, e.FormatVersion, ProofEnvelopeVersion)
+	case e.FormatVersion < 0:
+		return nil, fmt.Errorf("%w: format_version %d is not a version", ErrProofEnvelope, e.FormatVersion)
+	case e.Backend != BackendGroth16:
+		return nil, fmt.Errorf("%w: backend %q is not %s", ErrProofEnvelope, e.Backend, BackendGroth16)
+	case e.Encoding != "" && e.Encoding != ProofCompressed && e.Encoding != ProofUncompressed:
+		return nil, fmt.Errorf("%w: encoding %q is not %s or %s", ErrProofEnvelope, e.Encoding, ProofCompressed, ProofUncompressed)
+	case len(e.Payload) == 0:
+		return nil, fmt.Errorf("%w: payload is required", ErrProofEnvelope)
+	}
+	curve, curveErr := circuit.ParseCurve(e.Curve)
+	if curveErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProofEnvelope, curveErr)
+	}
+	if len(e.Payload) != legacyProofLength(curve, e.Encoding) {
+		return e.Payload, nil
+	}
+	zero := groth16.NewProof(curve)
+	var encoded bytes.Buffer
+	write := zero.WriteTo
+	if e.Encoding == ProofUncompressed {
+		write = zero.WriteRawTo
+	}
+	if _, writeErr := write(&encoded); writeErr != nil {
+		return nil, fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	return append(bytes.Clone(e.Payload), encoded.Bytes()[len(e.Payload):]...), nil
+}
+
+// legacyProofLength is the size of a proof's Ar, Bs and Krs over curve in an encoding: the whole
+// proof as gnark releases before v0.8 wrote it
+func legacyProofLength(curve ecc.ID, encoding string) int {
+	uncompressed := encoding == ProofUncompressed
+	switch {
+	case curve == ecc.BN254 && uncompressed:
+		return 2*bn254.SizeOfG1AffineUncompressed + bn254.SizeOfG2AffineUncompressed
+	case curve == ecc.BN254:
+		return 2*bn254.SizeOfG1AffineCompressed + bn254.SizeOfG2AffineCompressed
+	case curve == ecc.BLS12_381 && uncompressed:
+		return 2*bls12381.SizeOfG1AffineUncompressed + bls12381.SizeOfG2AffineUncompressed
+	case curve == ecc.BLS12_381:
+		return 2*bls12381.SizeOfG1AffineCompressed + bls12381.SizeOfG2AffineCompressed
+	}
+	return -1
+}
+
+// VerifyEnvelope is VerifyProof for the proof in an envelope, which has to be over the curve of
+// the verifying key; the circuit version it names is left for the caller to check
+func (v *Verifier) VerifyEnvelope(ctx context.Context, envelope ProofEnvelope, inputs PublicInputs) error {
+	proofBytes, openErr := envelope.Open()
+	if openErr != nil {
+		return openErr
+	}
+	if curve := v.verifyingKey.CurveID(); envelope.Curve != curve.String() {
+		return fmt.Errorf("%w: the proof is over %s, the verifying key over %s", ErrProofEnvelope, envelope.Curve, curve)
+	}
+	return v.VerifyProof(ctx, proofBytes, inputs)
+}
@@ -0,0 +1,45 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"A2zkp-circuit/circuit"
+)
+
+// GroupInputs are the public inputs of a circuit.GroupCircuit proof
+type GroupInputs struct {
+	MembersRoot string   // MembersRoot is the root of the group's member tree the proof must be under
+	Group       string   // Group is the group name
+	Epoch       uint64   // Epoch is the epoch the nullifier is for
+	Nonce       *big.Int // Nonce is the challenge nonce the proof was bound to
+	Nullifier   string   // Nullifier is the prover's nullifier for the group and epoch
+}
+
+// VerifyGroupProof checks an encoded group membership proof against its public inputs, with the
+// context checked as in VerifyProof. It needs a verifying key from a setup of circuit.GroupCircuit;
+// revocations don't apply, since the proof doesn't name a commitment.
+func (v *Verifier) VerifyGroupProof(ctx context.Context, proofBytes []byte, inputs GroupInputs) error {
+	if inputs.Nonce == nil {
+		return errors.New("missing nonce")
+	}
+	proof, readErr := ReadProof(proofBytes)
+	if readErr != nil {
+		return readErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	publicWitness, witnessErr := circuit.NewGroupPublicWitness(inputs.MembersRoot, inputs.Group, inputs.Epoch, inputs.Nonce, inputs.Nullifier)
+	if witnessErr != nil {
+		return witnessErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if verifyErr := verify(proof, v.verifyingKey, publicWitness); verifyErr != nil {
+		return errors.Join(ErrRejected, verifyErr)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// KeyManifestType is the JWS "typ" header of a signed verifying key manifest
+const KeyManifestType = "verifying-key+jwt"
+
+// ErrKeyManifest is returned for a signed key manifest that is malformed, not signed by the
+// expected key, or for other key bytes than the ones it is checked against
+var ErrKeyManifest = errors.New("invalid verifying key manifest")
+
+// KeyManifest is the payload of a signed key manifest: the server's statement that a verifying key,
+// by the SHA-256 of its encodings, is the one of a circuit version
+type KeyManifest struct {
+	CircuitVersion string `json:"circuit_version"`
+	KeyID          string `json:"key_id"`
+	Curve          string `json:"curve"`
+	Digest         string `json:"digest"` // Digest is the KeyHash of the key's gnark binary encoding, "sha256:" and hex
+	// SnarkJSDigest is the same of the key as snarkjs's verification_key.json, as GET
+	// /v1/keys/{circuitVersion}?format=snarkjs serves it; empty for keys snarkjs can't verify with
+	SnarkJSDigest string `json:"snarkjs_digest,omitempty"`
+}
+
+// VerifyKeyManifest checks a manifest from GET /v1/keys/{circuitVersion}: its signature by
+// publicKey, usually the key of /v1/signing-keys that KeySet.Key finds for it, and that key is the
+// manifest's verifying key, in gnark binary encoding or as snarkjs JSON. Embedded verifiers pin the
+// manifest's key ID or digest once it checks out.
+func VerifyKeyManifest(signed string, publicKey crypto.PublicKey, key []byte) (KeyManifest, error) {
+	payload, verifyErr := verifyJWS(signed, KeyManifestType, publicKey, ErrKeyManifest)
+	if verifyErr != nil {
+		return KeyManifest{}, verifyErr
+	}
+	var manifest KeyManifest
+	if decodeErr := json.Unmarshal(payload, &manifest); decodeErr != nil {
+		return KeyManifest{}, fmt.Errorf("%w: %v", ErrKeyManifest, decodeErr)
+	}
+	digest := sha256.Sum256(key)
+	if hash := "sha256:" + hex.EncodeToString(digest[:]); hash != manifest.Digest && hash != manifest.SnarkJSDigest {
+		return KeyManifest{}, fmt.Errorf("%w: the key hashes to %s, which the manifest of %s doesn't name", ErrKeyManifest, hash, manifest.KeyID)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,79 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownKey is returned for a signature by a key a KeySet doesn't hold, such as one whose
+// overlap has ended since the set was fetched
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// ErrSignature is returned for a signature that doesn't match the message it came with
+var ErrSignature = errors.New("invalid signature")
+
+// KeySet holds the public keys of a JWKS document by key ID, such as the current and previous keys
+// of /v1/signing-keys
+type KeySet map[string]crypto.PublicKey
+
+// ParseJSONWebKeySet decodes every key of a JWKS document
+func ParseJSONWebKeySet(data []byte) (KeySet, error) {
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if decodeErr := json.Unmarshal(data, &jwks); decodeErr != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", decodeErr)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, errors.New("JWKS holds no keys")
+	}
+	keys := make(KeySet, len(jwks.Keys))
+	for _, raw := range jwks.Keys {
+		var jwk struct {
+			KeyID string `json:"kid"`
+		}
+		json.Unmarshal(raw, &jwk)
+		key, parseErr := ParseJSONWebKey(raw)
+		if parseErr != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.KeyID, parseErr)
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+// Key returns the key named by the "kid" header of a compact JWS, to check it with, e.g. a signed
+// verdict passed on to VerifyVerdict
+func (s KeySet) Key(token string) (crypto.PublicKey, error) {
+	encodedHeader, _, _ := strings.Cut(token, ".")
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	headerJSON, decodeErr := base64.RawURLEncoding.DecodeString(encodedHeader)
+	if decodeErr != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed JWS header")
+	}
+	key, found := s[header.KeyID]
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, header.KeyID)
+	}
+	return key, nil
+}
+
+// VerifySignature checks an Ed25519 signature over message by the key keyID, such as a webhook
+// body with its X-OFA-Signature-Ed25519 and X-OFA-Signature-Key headers, base64url decoded
+func (s KeySet) VerifySignature(keyID string, message, signature []byte) error {
+	key, found := s[keyID].(ed25519.PublicKey)
+	switch {
+	case !found:
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	case !ed25519.Verify(key, message, signature):
+		return ErrSignature
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+
+	"A2zkp-circuit/circuit"
+)
+
+// VerifyPolicyProof checks an encoded proof that the secret behind a commitment meets a secret
+// policy, with the context checked as in VerifyProof. It needs a verifying key from a setup of
+// circuit.PolicyCircuit.
+func (v *Verifier) VerifyPolicyProof(ctx context.Context, proofBytes []byte, commitment string, policy circuit.SecretPolicy) error {
+	proof, readErr := ReadProof(proofBytes)
+	if readErr != nil {
+		return readErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	publicWitness, witnessErr := circuit.NewPolicyPublicWitness(commitment, policy)
+	if witnessErr != nil {
+		return witnessErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if verifyErr := verify(proof, v.verifyingKey, publicWitness); verifyErr != nil {
+		return errors.Join(ErrRejected, verifyErr)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package verifier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/consensys/gnark-crypto/ecc"
+)
+
+// Point encodings a proof's proof_encoding names. ReadProof and VerifyProof take either.
+const (
+	ProofCompressed   = "compressed"   // ProofCompressed is gnark's WriteTo: each point as one coordinate and a flag, the smallest proofs
+	ProofUncompressed = "uncompressed" // ProofUncompressed is gnark's WriteRawTo: both coordinates, twice the size but quicker to decode
+)
+
+// ErrProofEncoding is returned for proof bytes that are neither encoding throughout, such as
+// compressed points followed by uncompressed ones or trailing bytes
+var ErrProofEncoding = errors.New("proof is in no single point encoding")
+
+// ProofEncoding reports which of ProofCompressed and ProofUncompressed a proof made over curve is
+// in, by encoding the decoded proof both ways; it fails as ReadProofOn does for bytes that aren't a proof
+func ProofEncoding(curve ecc.ID, proofBytes []byte) (string, error) {
+	proof, readErr := ReadProofOn(curve, proofBytes)
+	if readErr != nil {
+		return "", readErr
+	}
+	var compressed, uncompressed bytes.Buffer
+	if _, writeErr := proof.WriteTo(&compressed); writeErr != nil {
+		return "", fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	if bytes.Equal(compressed.Bytes(), proofBytes) {
+		return ProofCompressed, nil
+	}
+	if _, writeErr := proof.WriteRawTo(&uncompressed); writeErr != nil {
+		return "", fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	if bytes.Equal(uncompressed.Bytes(), proofBytes) {
+		return ProofUncompressed, nil
+	}
+	return "", ErrProofEncoding
+}
+
+// CompressProof re-encodes a proof made over curve with compressed points, so both encodings of
+// one proof compare equal; compressed proofs are returned as they are
+func CompressProof(curve ecc.ID, proofBytes []byte) ([]byte, error) {
+	proof, readErr := ReadProofOn(curve, proofBytes)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var compressed bytes.Buffer
+	if _, writeErr := proof.WriteTo(&compressed); writeErr != nil {
+		return nil, fmt.Errorf("encoding proof: %w", writeErr)
+	}
+	return compressed.Bytes(), nil
+}
@@ -0,0 +1,328 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevocationType is the JWS "typ" header of a signed revocation list
+const RevocationType = "revocations+jwt"
+
+// ErrRevoked is returned by VerifyProof for a commitment on the verifier's revocation list
+var ErrRevoked = errors.New("commitment revoked")
+
+// ErrRevocationList is returned for a revocation list update that is malformed, not signed by the
+// expected key, or inconsistent with the entries already applied
+var ErrRevocationList = errors.New("invalid revocation list")
+
+// RevocationEntry is one commitment of the revocation log
+type RevocationEntry struct {
+	Sequence         uint64    `json:"sequence"` // Sequence numbers entries from 1 in the order they were revoked
+	CryptoCommitment string    `json:"crypto_commitment"`
+	Reason           string    `json:"reason"`
+	RevokedAt        time.Time `json:"revoked_at"`
+}
+
+// RevocationUpdate is the payload of a signed revocation list: the entries numbered after After,
+// and the sequence number and Merkle root of the whole log once they are appended. After is 0 for
+// the full list.
+type RevocationUpdate struct {
+	IssuedAt int64             `json:"iat"`
+	After    uint64            `json:"after"`
+	Sequence uint64            `json:"sequence"`
+	Root     string            `json:"root"` // Root is the hex RevocationRoot of entries 1 through Sequence
+	Entries  []RevocationEntry `json:"entries"`
+}
+
+// RevocationLeaf hashes an entry into its Merkle tree leaf: SHA-256 of a zero byte, the sequence
+// number in 8 big-endian bytes and the decimal commitment
+func RevocationLeaf(entry RevocationEntry) [sha256.Size]byte {
+	input := []byte{0}
+	input = binary.BigEndian.AppendUint64(input, entry.Sequence)
+	return sha256.Sum256(append(input, entry.CryptoCommitment...))
+}
+
+// RevocationRoot computes the Merkle tree hash of RFC 6962 over leaves in sequence order: inner
+// nodes hash a one byte and their children, and the left subtree holds the largest power of two
+// of leaves smaller than the total
+func RevocationRoot(leaves [][sha256.Size]byte) [sha256.Size]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	left, right := RevocationRoot(leaves[:split]), RevocationRoot(leaves[split:])
+	input := append([]byte{1}, left[:]...)
+	return sha256.Sum256(append(input, right[:]...))
+}
+
+// blindedPrefix marks a commitment the server keeps as its keyed hash under commitment_blinding
+const blindedPrefix = "ofablind1:"
+
+// BlindCommitment returns the keyed hash a server with commitment_blinding stores, and revokes, in
+// place of a commitment: the HMAC-SHA256 of its decimal digits under pepper. It matches
+// store.BlindCommitment, which this package can't import.
+func BlindCommitment(pepper []byte, commitment string) string {
+	if commitment == "" || strings.HasPrefix(commitment, blindedPrefix) {
+		return commitment
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(commitment))
+	return blindedPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RevocationList is the set of revoked commitments as known to an offline verifier, kept up to
+// date by applying signed updates from the server's /v1/revocations. It is safe for concurrent use.
+type RevocationList struct {
+	publicKey crypto.PublicKey
+	pepper    []byte // pepper is the commitment_blinding pepper the revoked commitments are hashed under; nil for a server without blinding
+
+	mu       sync.RWMutex
+	leaves   [][sha256.Size]byte
+	revoked  map[string]bool
+	issuedAt time.Time
+}
+
+// NewRevocationList creates an empty list accepting updates signed by publicKey, an ECDSA P-256 or
+// P-384, RSA or Ed25519 key, usually the one published at /v1/revocations/jwks
+func NewRevocationList(publicKey crypto.PublicKey) *RevocationList {
+	return &RevocationList{publicKey: publicKey, revoked: make(map[string]bool)}
+}
+
+// WithPepper sets the pepper of a server with commitment_blinding, which can only revoke the keyed
+// hashes it stores: Revoked then also looks up the hash of the commitment a proof claims. The pepper
+// is the unsealed content of the server's commitment_blinding.pepper_file; hand it to offline
+// verifiers as carefully as the database, since the two together expose the commitments.
+func (l *RevocationList) WithPepper(pepper []byte) *RevocationList {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pepper = pepper
+	return l
+}
+
+// Apply checks the signature of an update and that it extends the entries already applied, then
+// adds its entries. Entries the list already holds must be identical; an update may not skip any.
+// A rejected update leaves the list unchanged.
+func (l *RevocationList) Apply(signed string) error {
+	payload, verifyErr := verifyJWS(signed, RevocationType, l.publicKey, ErrRevocationList)
+	if verifyErr != nil {
+		return verifyErr
+	}
+	var update RevocationUpdate
+	if decodeErr := json.Unmarshal(payload, &update); decodeErr != nil {
+		return fmt.Errorf("%w: %v", ErrRevocationList, decodeErr)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	known := uint64(len(l.leaves))
+	if update.After > known {
+		return fmt.Errorf("%w: update starts after entry %d but %d are applied", ErrRevocationList, update.After, known)
+	}
+	if update.Sequence != update.After+uint64(len(update.Entries)) || update.Sequence < known {
+		return fmt.Errorf("%w: %d entries after %d don't end at %d", ErrRevocationList, len(update.Entries), update.After, update.Sequence)
+	}
+	leaves := l.leaves[:update.After:update.After]
+	for i, entry := range update.Entries {
+		if entry.Sequence != update.After+uint64(i)+1 {
+			return fmt.Errorf("%w: entry %d is numbered %d", ErrRevocationList, update.After+uint64(i)+1, entry.Sequence)
+		}
+		leaf := RevocationLeaf(entry)
+		if entry.Sequence <= known && leaf != l.leaves[entry.Sequence-1] {
+			return fmt.Errorf("%w: entry %d differs from the one applied", ErrRevocationList, entry.Sequence)
+		}
+		leaves = append(leaves, leaf)
+	}
+	if root := RevocationRoot(leaves); hex.EncodeToString(root[:]) != update.Root {
+		return fmt.Errorf("%w: Merkle root mismatch", ErrRevocationList)
+	}
+
+	for _, entry := range update.Entries {
+		l.revoked[entry.CryptoCommitment] = true
+	}
+	l.leaves = leaves
+	l.issuedAt = time.Unix(update.IssuedAt, 0)
+	return nil
+}
+
+// Revoked reports whether a commitment is on the list, as it is or, with WithPepper, as its keyed hash
+func (l *RevocationList) Revoked(commitment string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.revoked[commitment] || l.pepper != nil && l.revoked[BlindCommitment(l.pepper, commitment)]
+}
+
+// Sequence is the number of the last entry applied, to pass as ?after= when fetching the next update
+func (l *RevocationList) Sequence() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return uint64(len(l.leaves))
+}
+
+// Root is the hex Merkle root of the entries applied
+func (l *RevocationList) Root() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	root := RevocationRoot(l.leaves)
+	return hex.EncodeToString(root[:])
+}
+
+// IssuedAt is when the server signed the last update applied, so callers can tell how stale the list may be
+func (l *RevocationList) IssuedAt() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.issuedAt
+}
+
+// verifyJWS checks the "typ" header and signature of a compact JWS and returns its payload. Its
+// errors wrap invalid, which names what the JWS was supposed to be.
+func verifyJWS(token, typ string, publicKey crypto.PublicKey, invalid error) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", invalid)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		Type      string `json:"typ"`
+	}
+	headerJSON, headerErr := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, payloadErr := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(parts[2])
+	if headerErr != nil || payloadErr != nil || signatureErr != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, fmt.Errorf("%w: malformed JWS", invalid)
+	}
+	if header.Type != typ {
+		return nil, fmt.Errorf("%w: typ %q, want %q", invalid, header.Type, typ)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	valid := false
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case header.Algorithm == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(signingInput)
+			digest = sum[:]
+		case header.Algorithm == "ES384" && key.Curve == elliptic.P384():
+			sum := sha512.Sum384(signingInput)
+			digest = sum[:]
+		default:
+			return nil, fmt.Errorf("%w: alg %q doesn't match the key", invalid, header.Algorithm)
+		}
+		if len(signature) == 2*len(digest) {
+			r := new(big.Int).SetBytes(signature[:len(digest)])
+			s := new(big.Int).SetBytes(signature[len(digest):])
+			valid = ecdsa.Verify(key, digest, r, s)
+		}
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" {
+			return nil, fmt.Errorf("%w: alg %q doesn't match the key", invalid, header.Algorithm)
+		}
+		digest := sha256.Sum256(signingInput)
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		if header.Algorithm != "EdDSA" {
+			return nil, fmt.Errorf("%w: alg %q doesn't match the key", invalid, header.Algorithm)
+		}
+		valid = ed25519.Verify(key, signingInput, signature)
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", invalid, publicKey)
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: bad signature", invalid)
+	}
+	return payload, nil
+}
+
+// ParseJSONWebKey decodes the public EC P-256 or P-384, RSA or Ed25519 key of a JWK, or of the
+// first key of a JWKS document such as /v1/revocations/jwks
+func ParseJSONWebKey(data []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Keys     []json.RawMessage `json:"keys"`
+		KeyType  string            `json:"kty"`
+		Curve    string            `json:"crv"`
+		X        string            `json:"x"`
+		Y        string            `json:"y"`
+		Modulus  string            `json:"n"`
+		Exponent string            `json:"e"`
+	}
+	if decodeErr := json.Unmarshal(data, &jwk); decodeErr != nil {
+		return nil, fmt.Errorf("decoding JWK: %w", decodeErr)
+	}
+	if jwk.Keys != nil {
+		if len(jwk.Keys) == 0 {
+			return nil, errors.New("JWKS holds no keys")
+		}
+		return ParseJSONWebKey(jwk.Keys[0])
+	}
+	number := func(encoded string) (*big.Int, error) {
+		raw, decodeErr := base64.RawURLEncoding.DecodeString(encoded)
+		if decodeErr != nil || len(raw) == 0 {
+			return nil, errors.New("JWK has a missing or malformed number")
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+	switch jwk.KeyType {
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported JWK curve %q", jwk.Curve)
+		}
+		x, xErr := number(jwk.X)
+		y, yErr := number(jwk.Y)
+		if xErr != nil || yErr != nil {
+			return nil, errors.Join(xErr, yErr)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("JWK point is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, nErr := number(jwk.Modulus)
+		e, eErr := number(jwk.Exponent)
+		if nErr != nil || eErr != nil {
+			return nil, errors.Join(nErr, eErr)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("JWK RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "OKP":
+		x, xErr := base64.RawURLEncoding.DecodeString(jwk.X)
+		switch {
+		case jwk.Curve != "Ed25519":
+			return nil, fmt.Errorf("unsupported JWK curve %q", jwk.Curve)
+		case xErr != nil || len(x) != ed25519.PublicKeySize:
+			return nil, errors.New("JWK has a missing or malformed Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", jwk.KeyType)
+}
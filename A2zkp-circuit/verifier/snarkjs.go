@@ -0,0 +1,193 @@
+package verifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fp"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+)
+
+// snarkJSPublicSignals is how many public signals a circuit equivalent to circuit.Circuit has:
+// the commitment, then the nonce
+const snarkJSPublicSignals = 2
+
+// SnarkJSVerifyingKey is a Groth16 verifying key as snarkjs writes it to verification_key.json.
+// Points are decimal coordinates; G1 points are [x, y, "1"], G2 points [[x0, x1], [y0, y1], ["1", "0"]].
+type SnarkJSVerifyingKey struct {
+	Protocol string     `json:"protocol"` // Protocol must be "groth16"
+	Curve    string     `json:"curve"`    // Curve must be "bn128", snarkjs's name for BN254
+	NPublic  int        `json:"nPublic"`
+	Alpha1   []string   `json:"vk_alpha_1"`
+	Beta2    [][]string `json:"vk_beta_2"`
+	Gamma2   [][]string `json:"vk_gamma_2"`
+	Delta2   [][]string `json:"vk_delta_2"`
+	IC       [][]string `json:"IC"`
+}
+
+// SnarkJSProof is a Groth16 proof as snarkjs writes it to proof.json
+type SnarkJSProof struct {
+	PiA      []string   `json:"pi_a"`
+	PiB      [][]string `json:"pi_b"`
+	PiC      []string   `json:"pi_c"`
+	Protocol string     `json:"protocol,omitempty"`
+	Curve    string     `json:"curve,omitempty"`
+}
+
+// SnarkJSVerifier checks snarkjs proofs of a circom circuit equivalent to circuit.Circuit: one whose
+// public signals are the commitment and then the nonce, with the commitment the square of the secret
+type SnarkJSVerifier struct {
+	id                 string
+	alpha              bn254.G1Affine
+	beta, gamma, delta bn254.G2Affine
+	ic                 []bn254.G1Affine
+}
+
+// LoadSnarkJSVerifyingKey creates a verifier from a snarkjs verification_key.json
+func LoadSnarkJSVerifyingKey(r io.Reader) (*SnarkJSVerifier, error) {
+	encoded, readErr := io.ReadAll(r)
+	if readErr != nil {
+		return nil, fmt.Errorf("reading snarkjs verifying key: %w", readErr)
+	}
+	var key SnarkJSVerifyingKey
+	if decodeErr := json.Unmarshal(encoded, &key); decodeErr != nil {
+		return nil, fmt.Errorf("decoding snarkjs verifying key: %w", decodeErr)
+	}
+	switch {
+	case key.Protocol != "groth16":
+		return nil, fmt.Errorf("snarkjs verifying key is for %q, want groth16", key.Protocol)
+	case !isBN254(key.Curve):
+		return nil, fmt.Errorf("snarkjs verifying key is over %q, want bn128", key.Curve)
+	case key.NPublic != snarkJSPublicSignals || len(key.IC) != snarkJSPublicSignals+1:
+		return nil, fmt.Errorf("snarkjs verifying key has %d public signals, want %d: the commitment and the nonce", key.NPublic, snarkJSPublicSignals)
+	}
+
+	v := &SnarkJSVerifier{ic: make([]bn254.G1Affine, len(key.IC))}
+	pointErrs := []error{
+		parseG1("vk_alpha_1", key.Alpha1, &v.alpha),
+		parseG2("vk_beta_2", key.Beta2, &v.beta),
+		parseG2("vk_gamma_2", key.Gamma2, &v.gamma),
+		parseG2("vk_delta_2", key.Delta2, &v.delta),
+	}
+	for i, point := range key.IC {
+		pointErrs = append(pointErrs, parseG1(fmt.Sprintf("IC[%d]", i), point, &v.ic[i]))
+	}
+	if pointErr := errors.Join(pointErrs...); pointErr != nil {
+		return nil, fmt.Errorf("snarkjs verifying key: %w", pointErr)
+	}
+	digest := sha256.Sum256(encoded)
+	v.id = "snarkjs-" + hex.EncodeToString(digest[:8])
+	return v, nil
+}
+
+// KeyID names the key after the first 8 bytes of the SHA-256 of its JSON, prefixed "snarkjs-"
+func (v *SnarkJSVerifier) KeyID() string {
+	return v.id
+}
+
+// VerifyProof checks a snarkjs proof against its public inputs, which are mapped to the public
+// signals [commitment, nonce]. The context is checked before the pairing check.
+func (v *SnarkJSVerifier) VerifyProof(ctx context.Context, proof SnarkJSProof, inputs PublicInputs) error {
+	if inputs.Nonce == nil {
+		return errors.New("missing nonce")
+	}
+	if inputs.DeviceID != "" {
+		return errors.New("device-bound proofs must be gnark proofs of circuit.DeviceCircuit")
+	}
+	if (proof.Protocol != "" && proof.Protocol != "groth16") || (proof.Curve != "" && !isBN254(proof.Curve)) {
+		return fmt.Errorf("decoding proof: a %s proof over %s is not a groth16 one over bn128", proof.Protocol, proof.Curve)
+	}
+	var a, c bn254.G1Affine
+	var b bn254.G2Affine
+	if pointErr := errors.Join(parseG1("pi_a", proof.PiA, &a), parseG2("pi_b", proof.PiB, &b), parseG1("pi_c", proof.PiC, &c)); pointErr != nil {
+		return fmt.Errorf("decoding proof: %w", pointErr)
+	}
+	commitment, ok := new(big.Int).SetString(inputs.Commitment, 10)
+	if !ok {
+		return fmt.Errorf("commitment %q is not a decimal field element", inputs.Commitment)
+	}
+	var signals [snarkJSPublicSignals]fr.Element
+	signals[0].SetBigInt(commitment)
+	signals[1].SetBigInt(inputs.Nonce)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// vk_x = IC[0] + Σ signal_i·IC[i+1], then e(A, B) = e(α, β)·e(vk_x, γ)·e(C, δ)
+	vkX := v.ic[0]
+	for i := range signals {
+		var term bn254.G1Affine
+		term.ScalarMultiplication(&v.ic[i+1], signals[i].BigInt(new(big.Int)))
+		vkX.Add(&vkX, &term)
+	}
+	var negAlpha, negVKX, negC bn254.G1Affine
+	negAlpha.Neg(&v.alpha)
+	negVKX.Neg(&vkX)
+	negC.Neg(&c)
+	valid, pairingErr := bn254.PairingCheck(
+		[]bn254.G1Affine{a, negAlpha, negVKX, negC},
+		[]bn254.G2Affine{b, v.beta, v.gamma, v.delta})
+	if pairingErr != nil {
+		return errors.Join(ErrRejected, pairingErr)
+	}
+	if !valid {
+		return ErrRejected
+	}
+	return nil
+}
+
+// isBN254 reports whether a snarkjs curve name denotes BN254
+func isBN254(curve string) bool {
+	return strings.EqualFold(curve, "bn128") || strings.EqualFold(curve, "bn254")
+}
+
+// parseFp parses a decimal coordinate, which must be reduced modulo the base field
+func parseFp(name, text string, out *fp.Element) error {
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok || value.Sign() < 0 || value.Cmp(fp.Modulus()) >= 0 {
+		return fmt.Errorf("%s: %q is not a base field element", name, text)
+	}
+	out.SetBigInt(value)
+	return nil
+}
+
+// parseG1 parses an affine G1 point [x, y, "1"] and checks it lies on the curve
+func parseG1(name string, coordinates []string, out *bn254.G1Affine) error {
+	if len(coordinates) != 3 || coordinates[2] != "1" {
+		return fmt.Errorf("%s: want [x, y, \"1\"]", name)
+	}
+	if coordinateErr := errors.Join(parseFp(name, coordinates[0], &out.X), parseFp(name, coordinates[1], &out.Y)); coordinateErr != nil {
+		return coordinateErr
+	}
+	if !out.IsOnCurve() {
+		return fmt.Errorf("%s: not a point on the curve", name)
+	}
+	return nil
+}
+
+// parseG2 parses an affine G2 point [[x0, x1], [y0, y1], ["1", "0"]] and checks it lies in the
+// prime-order subgroup, which pairings rely on
+func parseG2(name string, coordinates [][]string, out *bn254.G2Affine) error {
+	if len(coordinates) != 3 || len(coordinates[0]) != 2 || len(coordinates[1]) != 2 ||
+		len(coordinates[2]) != 2 || coordinates[2][0] != "1" || coordinates[2][1] != "0" {
+		return fmt.Errorf("%s: want [[x0, x1], [y0, y1], [\"1\", \"0\"]]", name)
+	}
+	coordinateErr := errors.Join(
+		parseFp(name, coordinates[0][0], &out.X.A0), parseFp(name, coordinates[0][1], &out.X.A1),
+		parseFp(name, coordinates[1][0], &out.Y.A0), parseFp(name, coordinates[1][1], &out.Y.A1))
+	if coordinateErr != nil {
+		return coordinateErr
+	}
+	if !out.IsOnCurve() || !out.IsInSubGroup() {
+		return fmt.Errorf("%s: not a point of the G2 subgroup", name)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package verifier
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// VerdictType is the JWS "typ" header of a signed verification verdict
+const VerdictType = "verdict+jwt"
+
+// ErrVerdict is returned for a signed verdict that is malformed, not signed by the expected key,
+// for another challenge or too old
+var ErrVerdict = errors.New("invalid verdict")
+
+// maxVerdictSkew is how far in the future a verdict's issue time may lie, for clock differences
+const maxVerdictSkew = time.Minute
+
+// Verdict is the payload of a signed verdict: the server's statement that a user proved knowledge
+// of their secret against a challenge nonce
+type Verdict struct {
+	Issuer   string `json:"iss,omitempty"` // Issuer is oidc.issuer, when set
+	UserName string `json:"sub"`
+	Status   string `json:"status"` // Status is "valid"; only accepted proofs are signed
+	KeyID    string `json:"key_id"` // KeyID is the key version the proof verified under
+	Nonce    string `json:"nonce"`  // Nonce is the challenge nonce the proof was bound to
+	IssuedAt int64  `json:"iat"`
+	JWTID    string `json:"jti"`
+}
+
+// VerifyVerdict checks a verdict relayed from the server's POST /v1/verify: its signature by
+// publicKey, usually the key of /v1/signing-keys that KeySet.Key finds for it, that it answers the
+// challenge nonce the caller issued and that it was signed within maxAge. A nonce is only ever
+// proven once, so a verdict can't be replayed for another login; callers should still remember
+// the jti of verdicts accepted within maxAge.
+func VerifyVerdict(signed string, publicKey crypto.PublicKey, nonce string, maxAge time.Duration) (Verdict, error) {
+	payload, verifyErr := verifyJWS(signed, VerdictType, publicKey, ErrVerdict)
+	if verifyErr != nil {
+		return Verdict{}, verifyErr
+	}
+	var verdict Verdict
+	if decodeErr := json.Unmarshal(payload, &verdict); decodeErr != nil {
+		return Verdict{}, fmt.Errorf("%w: %v", ErrVerdict, decodeErr)
+	}
+	issuedAt := time.Unix(verdict.IssuedAt, 0)
+	switch {
+	case verdict.Nonce != nonce:
+		return Verdict{}, fmt.Errorf("%w: for nonce %q, want %q", ErrVerdict, verdict.Nonce, nonce)
+	case time.Since(issuedAt) > maxAge:
+		return Verdict{}, fmt.Errorf("%w: signed at %s, more than %s ago", ErrVerdict, issuedAt.UTC().Format(time.RFC3339), maxAge)
+	case time.Until(issuedAt) > maxVerdictSkew:
+		return Verdict{}, fmt.Errorf("%w: signed in the future, at %s", ErrVerdict, issuedAt.UTC().Format(time.RFC3339))
+	}
+	return verdict, nil
+}
@@ -0,0 +1,166 @@
+// Package verifier checks proofs of knowledge of the secret behind a commitment.
+//
+// It is the counterpart of package prover and lets other Go services verify proofs
+// locally instead of calling the HTTP API: load a Groth16 verifying key, or let a
+// KeyCache fetch it from the server's /v1/keys/verifying endpoint, then call VerifyProof
+// with the proof, the registered commitment and the challenge nonce it was bound to.
+// It holds no state about users or challenges; consuming the nonce exactly once is the
+// caller's job. Proofs of the device-bound circuit are checked the same way, with the device ID
+// among the inputs. SnarkJSVerifier does the same for snarkjs proofs of an equivalent circom circuit.
+// A RevocationList kept current from the server's signed /v1/revocations lets a verifier reject
+// revoked commitments without asking the server.
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/mockzk"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+)
+
+// ErrRejected is returned when a well-formed proof fails the pairing check
+var ErrRejected = errors.New("proof rejected")
+
+// PublicInputs are the circuit's public inputs a proof is checked against
+type PublicInputs struct {
+	Commitment string   // Commitment is the user's registered commitment as a decimal field element
+	Nonce      *big.Int // Nonce is the challenge nonce the proof was bound to
+	DeviceID   string   // DeviceID is the device a proof of circuit.DeviceCircuit was made on; empty for circuit.Circuit
+}
+
+// Verifier checks proofs against one verifying key
+type Verifier struct {
+	verifyingKey groth16.VerifyingKey
+	revocations  *RevocationList // revocations rejects revoked commitments; nil checks none
+}
+
+// New creates a verifier for a verifying key
+func New(verifyingKey groth16.VerifyingKey) *Verifier {
+	return &Verifier{verifyingKey: verifyingKey}
+}
+
+// WithRevocations returns a verifier for the same key that fails with ErrRevoked, before any
+// pairing check, for commitments on the list
+func (v *Verifier) WithRevocations(list *RevocationList) *Verifier {
+	return &Verifier{verifyingKey: v.verifyingKey, revocations: list}
+}
+
+// LoadVerifyingKey creates a verifier from a verifying key in gnark binary encoding,
+// as written by keygen or served at /v1/keys/verifying
+func LoadVerifyingKey(r io.Reader) (*Verifier, error) {
+	verifyingKey := groth16.NewVerifyingKey(circuit.Curve)
+	if _, readErr := verifyingKey.ReadFrom(r); readErr != nil {
+		return nil, fmt.Errorf("decoding verifying key: %w", readErr)
+	}
+	return New(verifyingKey), nil
+}
+
+// KeyID names a key version after the first 8 bytes of the SHA-256 of its verifying key,
+// matching the key_id the server reports. Mock keys are named "mock-" rather than "vk-".
+func KeyID(verifyingKey groth16.VerifyingKey) (string, error) {
+	digest, digestErr := keyDigest(verifyingKey)
+	if digestErr != nil {
+		return "", digestErr
+	}
+	prefix := "vk-"
+	if mockzk.IsVerifyingKey(verifyingKey) {
+		prefix = "mock-"
+	}
+	return prefix + hex.EncodeToString(digest[:8]), nil
+}
+
+// KeyHash is the whole SHA-256 of a verifying key in gnark binary encoding, as "sha256:" followed
+// by hex, matching the verifying_key_hash of GET /v1/circuit
+func KeyHash(verifyingKey groth16.VerifyingKey) (string, error) {
+	digest, digestErr := keyDigest(verifyingKey)
+	if digestErr != nil {
+		return "", digestErr
+	}
+	return "sha256:" + hex.EncodeToString(digest), nil
+}
+
+// keyDigest hashes a verifying key in gnark binary encoding
+func keyDigest(verifyingKey groth16.VerifyingKey) ([]byte, error) {
+	digest := sha256.New()
+	if _, writeErr := verifyingKey.WriteTo(digest); writeErr != nil {
+		return nil, writeErr
+	}
+	return digest.Sum(nil), nil
+}
+
+// verify checks a Groth16 proof, or a mock one for a mock verifying key
+func verify(proof groth16.Proof, verifyingKey groth16.VerifyingKey, publicWitness witness.Witness) error {
+	if mockzk.IsVerifyingKey(verifyingKey) {
+		return mockzk.Verify(proof, verifyingKey, publicWitness)
+	}
+	return groth16.Verify(proof, verifyingKey, publicWitness)
+}
+
+// ReadProof decodes a proof in gnark binary encoding
+func ReadProof(proofBytes []byte) (groth16.Proof, error) {
+	return ReadProofOn(circuit.Curve, proofBytes)
+}
+
+// ReadProofOn decodes a proof made over curve in gnark binary encoding
+func ReadProofOn(curve ecc.ID, proofBytes []byte) (groth16.Proof, error) {
+	proof := groth16.NewProof(curve)
+	if _, readErr := proof.ReadFrom(bytes.NewReader(proofBytes)); readErr != nil {
+		return nil, fmt.Errorf("decoding proof: %w", readErr)
+	}
+	return proof, nil
+}
+
+// newPublicWitness builds the public witness over curve of the circuit the inputs are for: the
+// device-bound variant, which only exists on circuit.Curve, when they name a device
+func newPublicWitness(curve ecc.ID, inputs PublicInputs) (witness.Witness, error) {
+	switch {
+	case inputs.DeviceID != "" && curve != circuit.Curve:
+		return nil, fmt.Errorf("the device-bound circuit is not available on %s", curve)
+	case inputs.DeviceID != "":
+		return circuit.NewDevicePublicWitness(inputs.Commitment, inputs.DeviceID, inputs.Nonce)
+	}
+	return circuit.NewPublicWitnessOn(curve, inputs.Commitment, inputs.Nonce)
+}
+
+// VerifyProof checks an encoded proof against its public inputs. The context is checked
+// between decoding, witness construction and the pairing check. Inputs naming a device need
+// a verifying key from a setup of circuit.DeviceCircuit. The proof and inputs are read on the
+// curve of the verifying key, so a key set up over BLS12-381 checks BLS12-381 proofs.
+func (v *Verifier) VerifyProof(ctx context.Context, proofBytes []byte, inputs PublicInputs) error {
+	if inputs.Nonce == nil {
+		return errors.New("missing nonce")
+	}
+	if v.revocations != nil && v.revocations.Revoked(inputs.Commitment) {
+		return ErrRevoked
+	}
+	curve := v.verifyingKey.CurveID()
+	proof, readErr := ReadProofOn(curve, proofBytes)
+	if readErr != nil {
+		return readErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	publicWitness, witnessErr := newPublicWitness(curve, inputs)
+	if witnessErr != nil {
+		return witnessErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if verifyErr := verify(proof, v.verifyingKey, publicWitness); verifyErr != nil {
+		return errors.Join(ErrRejected, verifyErr)
+	}
+	return nil
+}
@@ -0,0 +1,610 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"A2zkp-circuit/circuit"
+	"A2zkp-circuit/prover"
+	"A2zkp-circuit/secret"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+)
+
+// proofFixture is a verifying key and an encoded proof for secret 12345 bound to nonce 77
+type proofFixture struct {
+	verifyingKey groth16.VerifyingKey
+	proof        []byte
+}
+
+// commitment12345 is the commitment to secret 12345
+const commitment12345 = "152399025"
+
+// validInputs are the public inputs the fixture proof was made for
+var validInputs = PublicInputs{Commitment: commitment12345, Nonce: big.NewInt(77)}
+
+// newFixture runs a throwaway setup and proves once
+func newFixture(t *testing.T) proofFixture {
+	t.Helper()
+	ccs, compileErr := circuit.Compile()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := prover.New(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), big.NewInt(77))
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	var encoded bytes.Buffer
+	if _, writeErr := proof.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	return proofFixture{verifyingKey: verifyingKey, proof: encoded.Bytes()}
+}
+
+func TestVerifyProof(t *testing.T) {
+	fixture := newFixture(t)
+	v := New(fixture.verifyingKey)
+
+	tests := []struct {
+		name       string
+		commitment string
+		nonce      int64
+		proof      []byte
+		wantErr    error // nil for success; ErrRejected for a failed pairing check
+		wantAnyErr bool
+	}{
+		{name: "valid", commitment: commitment12345, nonce: 77, proof: fixture.proof},
+		{name: "other nonce", commitment: commitment12345, nonce: 78, proof: fixture.proof, wantErr: ErrRejected},
+		{name: "other commitment", commitment: "4", nonce: 77, proof: fixture.proof, wantErr: ErrRejected},
+		{name: "truncated proof", commitment: commitment12345, nonce: 77, proof: fixture.proof[:10], wantAnyErr: true},
+		{name: "malformed commitment", commitment: "x", nonce: 77, proof: fixture.proof, wantAnyErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifyErr := v.VerifyProof(context.Background(), test.proof, PublicInputs{Commitment: test.commitment, Nonce: big.NewInt(test.nonce)})
+			switch {
+			case test.wantErr == nil && !test.wantAnyErr && verifyErr != nil:
+				t.Errorf("VerifyProof = %v, want success", verifyErr)
+			case test.wantErr != nil && !errors.Is(verifyErr, test.wantErr):
+				t.Errorf("VerifyProof = %v, want %v", verifyErr, test.wantErr)
+			case test.wantAnyErr && (verifyErr == nil || errors.Is(verifyErr, ErrRejected)):
+				t.Errorf("VerifyProof = %v, want a decoding error", verifyErr)
+			}
+		})
+	}
+}
+
+func TestVerifyProofHonoursCancellation(t *testing.T) {
+	fixture := newFixture(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	verifyErr := New(fixture.verifyingKey).VerifyProof(ctx, fixture.proof, validInputs)
+	if !errors.Is(verifyErr, context.Canceled) {
+		t.Errorf("VerifyProof on a cancelled context = %v, want context.Canceled", verifyErr)
+	}
+}
+
+func TestProofEncoding(t *testing.T) {
+	fixture := newFixture(t)
+	proof, readErr := ReadProof(fixture.proof)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	uncompressed, encodeErr := prover.EncodeUncompressedProof(proof)
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	for encoded, want := range map[string]string{string(fixture.proof): ProofCompressed, string(uncompressed): ProofUncompressed} {
+		if encoding, encodingErr := ProofEncoding(circuit.Curve, []byte(encoded)); encoding != want || encodingErr != nil {
+			t.Errorf("ProofEncoding of %d bytes = %q, %v; want %s", len(encoded), encoding, encodingErr, want)
+		}
+	}
+	if _, encodingErr := ProofEncoding(circuit.Curve, append(bytes.Clone(fixture.proof), 0)); !errors.Is(encodingErr, ErrProofEncoding) {
+		t.Errorf("ProofEncoding with a trailing byte = %v, want ErrProofEncoding", encodingErr)
+	}
+
+	// Both encodings verify, and compress to the same bytes
+	if verifyErr := New(fixture.verifyingKey).VerifyProof(context.Background(), uncompressed, validInputs); verifyErr != nil {
+		t.Errorf("VerifyProof of the uncompressed proof = %v", verifyErr)
+	}
+	if compressed, compressErr := CompressProof(circuit.Curve, uncompressed); compressErr != nil || !bytes.Equal(compressed, fixture.proof) {
+		t.Errorf("CompressProof = %x, %v; want %x", compressed, compressErr, fixture.proof)
+	}
+}
+
+func TestProofEnvelope(t *testing.T) {
+	fixture := newFixture(t)
+	proof, _ := ReadProof(fixture.proof)
+	envelope, envelopeErr := NewProofEnvelope(circuit.Version, proof)
+	if envelopeErr != nil {
+		t.Fatal(envelopeErr)
+	}
+	v := New(fixture.verifyingKey)
+	if verifyErr := v.VerifyEnvelope(context.Background(), envelope, validInputs); verifyErr != nil {
+		t.Fatalf("VerifyEnvelope = %v", verifyErr)
+	}
+
+	// gnark before v0.8 wrote no commitments after the three points; such proofs are translated
+	legacy := envelope
+	legacy.Payload = fixture.proof[:legacyProofLength(circuit.Curve, ProofCompressed)]
+	if verifyErr := v.VerifyEnvelope(context.Background(), legacy, validInputs); verifyErr != nil {
+		t.Errorf("VerifyEnvelope of a pre-v0.8 proof = %v", verifyErr)
+	}
+
+	for name, change := range map[string]func(*ProofEnvelope){
+		"newer format":  func(e *ProofEnvelope) { e.FormatVersion = ProofEnvelopeVersion + 1 },
+		"no format":     func(e *ProofEnvelope) { e.FormatVersion = 0 },
+		"other backend": func(e *ProofEnvelope) { e.Backend = "plonk" },
+		"other curve":   func(e *ProofEnvelope) { e.Curve = "bw6-761" },
+		"no payload":    func(e *ProofEnvelope) { e.Payload = nil },
+		"bad encoding":  func(e *ProofEnvelope) { e.Encoding = "packed" },
+	} {
+		changed := envelope
+		change(&changed)
+		if verifyErr := v.VerifyEnvelope(context.Background(), changed, validInputs); !errors.Is(verifyErr, ErrProofEnvelope) {
+			t.Errorf("%s: VerifyEnvelope = %v, want ErrProofEnvelope", name, verifyErr)
+		}
+	}
+}
+
+func TestLoadVerifyingKeyRoundTrip(t *testing.T) {
+	fixture := newFixture(t)
+	var encoded bytes.Buffer
+	if _, writeErr := fixture.verifyingKey.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	decoded, loadErr := LoadVerifyingKey(&encoded)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if verifyErr := decoded.VerifyProof(context.Background(), fixture.proof, validInputs); verifyErr != nil {
+		t.Errorf("decoded key rejects a valid proof: %v", verifyErr)
+	}
+}
+
+func TestVerifyDeviceProof(t *testing.T) {
+	ccs, compileErr := circuit.CompileDevice()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := prover.NewDevice(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), "laptop-a", big.NewInt(77))
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	var encoded bytes.Buffer
+	if _, writeErr := proof.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	commitmentA, _ := prover.DeviceCommitment(secret.FromInt64(12345), "laptop-a")
+	commitmentB, _ := prover.DeviceCommitment(secret.FromInt64(12345), "laptop-b")
+
+	v := New(verifyingKey)
+	nonce := big.NewInt(77)
+	if verifyErr := v.VerifyProof(context.Background(), encoded.Bytes(), PublicInputs{Commitment: commitmentA, Nonce: nonce, DeviceID: "laptop-a"}); verifyErr != nil {
+		t.Errorf("device proof rejected: %v", verifyErr)
+	}
+	for name, inputs := range map[string]PublicInputs{
+		"other device":              {Commitment: commitmentA, Nonce: nonce, DeviceID: "laptop-b"},
+		"other device's commitment": {Commitment: commitmentB, Nonce: nonce, DeviceID: "laptop-b"},
+		"without a device":          {Commitment: commitmentA, Nonce: nonce},
+	} {
+		if verifyErr := v.VerifyProof(context.Background(), encoded.Bytes(), inputs); !errors.Is(verifyErr, ErrRejected) {
+			t.Errorf("%s: VerifyProof = %v, want ErrRejected", name, verifyErr)
+		}
+	}
+}
+
+func TestVerifyGroupProof(t *testing.T) {
+	ccs, compileErr := circuit.CompileGroup()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := prover.NewGroup(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	other, _ := prover.Commitment(secret.FromInt64(777))
+	tree, treeErr := circuit.NewGroupTree([]string{commitment12345, other})
+	if treeErr != nil {
+		t.Fatal(treeErr)
+	}
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), tree, "acme", 9, big.NewInt(77))
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	var encoded bytes.Buffer
+	if _, writeErr := proof.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	nullifier, _ := prover.Nullifier(secret.FromInt64(12345), "acme", 9)
+	otherNullifier, _ := prover.Nullifier(secret.FromInt64(777), "acme", 9)
+	smaller, _ := circuit.NewGroupTree([]string{other})
+
+	v := New(verifyingKey)
+	valid := GroupInputs{MembersRoot: tree.Root(), Group: "acme", Epoch: 9, Nonce: big.NewInt(77), Nullifier: nullifier}
+	if verifyErr := v.VerifyGroupProof(context.Background(), encoded.Bytes(), valid); verifyErr != nil {
+		t.Errorf("group proof rejected: %v", verifyErr)
+	}
+	for name, inputs := range map[string]GroupInputs{
+		"other root":      {MembersRoot: smaller.Root(), Group: "acme", Epoch: 9, Nonce: big.NewInt(77), Nullifier: nullifier},
+		"other group":     {MembersRoot: tree.Root(), Group: "globex", Epoch: 9, Nonce: big.NewInt(77), Nullifier: nullifier},
+		"other epoch":     {MembersRoot: tree.Root(), Group: "acme", Epoch: 10, Nonce: big.NewInt(77), Nullifier: nullifier},
+		"other nullifier": {MembersRoot: tree.Root(), Group: "acme", Epoch: 9, Nonce: big.NewInt(77), Nullifier: otherNullifier},
+	} {
+		if verifyErr := v.VerifyGroupProof(context.Background(), encoded.Bytes(), inputs); !errors.Is(verifyErr, ErrRejected) {
+			t.Errorf("%s: VerifyGroupProof = %v, want ErrRejected", name, verifyErr)
+		}
+	}
+}
+
+func TestVerifyPolicyProof(t *testing.T) {
+	ccs, compileErr := circuit.CompilePolicy()
+	if compileErr != nil {
+		t.Fatal(compileErr)
+	}
+	provingKey, verifyingKey, setupErr := groth16.Setup(ccs)
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	p, newErr := prover.NewPolicy(context.Background(), provingKey)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	policy := circuit.SecretPolicy{MinBits: 12, Denylist: []int64{4321}}
+	proof, proveErr := p.Prove(context.Background(), secret.FromInt64(12345), policy)
+	if proveErr != nil {
+		t.Fatal(proveErr)
+	}
+	var encoded bytes.Buffer
+	if _, writeErr := proof.WriteTo(&encoded); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, weakErr := p.Prove(context.Background(), secret.FromInt64(4321), policy); !errors.Is(weakErr, circuit.ErrWeakSecret) {
+		t.Errorf("proving a denied secret = %v, want ErrWeakSecret", weakErr)
+	}
+
+	v := New(verifyingKey)
+	if verifyErr := v.VerifyPolicyProof(context.Background(), encoded.Bytes(), commitment12345, policy); verifyErr != nil {
+		t.Errorf("policy proof rejected: %v", verifyErr)
+	}
+	other, _ := prover.Commitment(secret.FromInt64(54321))
+	for name, tt := range map[string]struct {
+		commitment string
+		policy     circuit.SecretPolicy
+	}{
+		"other commitment": {other, policy},
+		"stricter policy":  {commitment12345, circuit.SecretPolicy{MinBits: 20, Denylist: []int64{4321}}},
+		"other denylist":   {commitment12345, circuit.SecretPolicy{MinBits: 12}},
+	} {
+		if verifyErr := v.VerifyPolicyProof(context.Background(), encoded.Bytes(), tt.commitment, tt.policy); !errors.Is(verifyErr, ErrRejected) {
+			t.Errorf("%s: VerifyPolicyProof = %v, want ErrRejected", name, verifyErr)
+		}
+	}
+}
+
+// snarkJSG1 and snarkJSG2 write points the way snarkjs does
+func snarkJSG1(p bn254.G1Affine) []string {
+	return []string{p.X.String(), p.Y.String(), "1"}
+}
+
+func snarkJSG2(p bn254.G2Affine) [][]string {
+	return [][]string{{p.X.A0.String(), p.X.A1.String()}, {p.Y.A0.String(), p.Y.A1.String()}, {"1", "0"}}
+}
+
+// snarkJSFixture converts the fixture to snarkjs JSON, as snarkjs would have written it for an
+// equivalent circom circuit: without Pedersen commitments, a gnark Groth16 key and proof are plain ones
+func snarkJSFixture(t *testing.T, fixture proofFixture) (SnarkJSVerifyingKey, SnarkJSProof) {
+	t.Helper()
+	vk := fixture.verifyingKey.(*groth16bn254.VerifyingKey)
+	key := SnarkJSVerifyingKey{
+		Protocol: "groth16", Curve: "bn128", NPublic: len(vk.G1.K) - 1,
+		Alpha1: snarkJSG1(vk.G1.Alpha), Beta2: snarkJSG2(vk.G2.Beta), Gamma2: snarkJSG2(vk.G2.Gamma), Delta2: snarkJSG2(vk.G2.Delta),
+	}
+	for _, point := range vk.G1.K {
+		key.IC = append(key.IC, snarkJSG1(point))
+	}
+	proof, readErr := ReadProof(fixture.proof)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	gnarkProof := proof.(*groth16bn254.Proof)
+	return key, SnarkJSProof{PiA: snarkJSG1(gnarkProof.Ar), PiB: snarkJSG2(gnarkProof.Bs), PiC: snarkJSG1(gnarkProof.Krs), Protocol: "groth16", Curve: "bn128"}
+}
+
+func TestSnarkJSVerifier(t *testing.T) {
+	key, proof := snarkJSFixture(t, newFixture(t))
+	encoded, _ := json.Marshal(key)
+	v, loadErr := LoadSnarkJSVerifyingKey(bytes.NewReader(encoded))
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if verifyErr := v.VerifyProof(context.Background(), proof, validInputs); verifyErr != nil {
+		t.Errorf("VerifyProof = %v, want success", verifyErr)
+	}
+	if verifyErr := v.VerifyProof(context.Background(), proof, PublicInputs{Commitment: commitment12345, Nonce: big.NewInt(78)}); !errors.Is(verifyErr, ErrRejected) {
+		t.Errorf("VerifyProof with another nonce = %v, want ErrRejected", verifyErr)
+	}
+	tampered := proof
+	tampered.PiA = []string{"1", "3", "1"}
+	if verifyErr := v.VerifyProof(context.Background(), tampered, validInputs); verifyErr == nil || errors.Is(verifyErr, ErrRejected) {
+		t.Errorf("VerifyProof with pi_a off the curve = %v, want a decoding error", verifyErr)
+	}
+
+	// Keys for other curves or other public signals are refused
+	for _, change := range []func(*SnarkJSVerifyingKey){
+		func(k *SnarkJSVerifyingKey) { k.Curve = "bls12381" },
+		func(k *SnarkJSVerifyingKey) { k.Protocol = "plonk" },
+		func(k *SnarkJSVerifyingKey) { k.NPublic, k.IC = 1, k.IC[:2] },
+		func(k *SnarkJSVerifyingKey) { k.Gamma2 = [][]string{{"1", "0"}, {"2", "0"}, {"1", "0"}} },
+	} {
+		changed := key
+		change(&changed)
+		encoded, _ := json.Marshal(changed)
+		if _, loadErr := LoadSnarkJSVerifyingKey(bytes.NewReader(encoded)); loadErr == nil {
+			t.Errorf("LoadSnarkJSVerifyingKey accepted %+v", changed)
+		}
+	}
+}
+
+// signRevocations signs an update as the server would, as an ES256 compact JWS of typ typ
+func signRevocations(t *testing.T, key *ecdsa.PrivateKey, typ string, update RevocationUpdate) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": typ})
+	payload, _ := json.Marshal(update)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, signErr := ecdsa.Sign(rand.Reader, key, digest[:])
+	if signErr != nil {
+		t.Fatal(signErr)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// revocationUpdate is the update holding entries after after, with the root of all entries
+func revocationUpdate(entries []RevocationEntry, after int) RevocationUpdate {
+	leaves := make([][sha256.Size]byte, len(entries))
+	for i, entry := range entries {
+		leaves[i] = RevocationLeaf(entry)
+	}
+	root := RevocationRoot(leaves)
+	return RevocationUpdate{IssuedAt: 1700000000, After: uint64(after), Sequence: uint64(len(entries)), Root: hex.EncodeToString(root[:]), Entries: entries[after:]}
+}
+
+func TestRevocationRoot(t *testing.T) {
+	entries := []RevocationEntry{{Sequence: 1, CryptoCommitment: "4"}, {Sequence: 2, CryptoCommitment: "9"}, {Sequence: 3, CryptoCommitment: "16"}}
+	leaves := [][sha256.Size]byte{RevocationLeaf(entries[0]), RevocationLeaf(entries[1]), RevocationLeaf(entries[2])}
+	node := func(left, right [sha256.Size]byte) [sha256.Size]byte {
+		return sha256.Sum256(append(append([]byte{1}, left[:]...), right[:]...))
+	}
+	if got, want := RevocationRoot(leaves), node(node(leaves[0], leaves[1]), leaves[2]); got != want {
+		t.Errorf("root of three leaves = %x, want %x", got, want)
+	}
+	if got := RevocationRoot(nil); got != sha256.Sum256(nil) {
+		t.Errorf("root of no leaves = %x", got)
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []RevocationEntry{
+		{Sequence: 1, CryptoCommitment: "49", Reason: "device_revoked", RevokedAt: at},
+		{Sequence: 2, CryptoCommitment: commitment12345, Reason: "user_deleted", RevokedAt: at},
+		{Sequence: 3, CryptoCommitment: "81", Reason: "commitment_replaced", RevokedAt: at},
+	}
+	list := NewRevocationList(&key.PublicKey)
+	if applyErr := list.Apply(signRevocations(t, key, RevocationType, revocationUpdate(entries[:2], 0))); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+	if !list.Revoked(commitment12345) || list.Revoked("81") || list.Sequence() != 2 {
+		t.Errorf("after the first update: sequence %d, revoked 12345 %v, 81 %v", list.Sequence(), list.Revoked(commitment12345), list.Revoked("81"))
+	}
+
+	tampered := revocationUpdate(entries, 1)
+	tampered.Entries = []RevocationEntry{{Sequence: 2, CryptoCommitment: "1"}, entries[2]}
+	wrongRoot := revocationUpdate(entries, 2)
+	wrongRoot.Root = revocationUpdate(entries[:2], 0).Root
+	for name, signed := range map[string]string{
+		"another key":     signRevocations(t, other, RevocationType, revocationUpdate(entries, 2)),
+		"another type":    signRevocations(t, key, "JWT", revocationUpdate(entries, 2)),
+		"a gap":           signRevocations(t, key, RevocationType, RevocationUpdate{After: 3, Sequence: 3, Root: revocationUpdate(entries, 2).Root}),
+		"a wrong root":    signRevocations(t, key, RevocationType, wrongRoot),
+		"a changed entry": signRevocations(t, key, RevocationType, tampered),
+		"an older list":   signRevocations(t, key, RevocationType, revocationUpdate(entries[:1], 0)),
+		"garbage":         "not.a.jws",
+		"too few entries": signRevocations(t, key, RevocationType, RevocationUpdate{After: 2, Sequence: 3, Root: revocationUpdate(entries, 2).Root}),
+	} {
+		if applyErr := list.Apply(signed); !errors.Is(applyErr, ErrRevocationList) {
+			t.Errorf("update with %s: Apply = %v, want ErrRevocationList", name, applyErr)
+		}
+	}
+	if list.Sequence() != 2 || list.Root() != revocationUpdate(entries[:2], 0).Root {
+		t.Error("a rejected update changed the list")
+	}
+
+	// Overlapping and incremental updates both extend the list
+	if applyErr := list.Apply(signRevocations(t, key, RevocationType, revocationUpdate(entries, 1))); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+	if !list.Revoked("81") || list.Sequence() != 3 || !list.IssuedAt().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("after the overlapping update: sequence %d, revoked 81 %v", list.Sequence(), list.Revoked("81"))
+	}
+	if applyErr := list.Apply(signRevocations(t, key, RevocationType, revocationUpdate(entries, 3))); applyErr != nil {
+		t.Errorf("empty update: %v", applyErr)
+	}
+
+	// A verifier holding the list rejects the revoked commitment before checking the proof
+	fixture := newFixture(t)
+	if verifyErr := New(fixture.verifyingKey).WithRevocations(list).VerifyProof(context.Background(), fixture.proof, validInputs); !errors.Is(verifyErr, ErrRevoked) {
+		t.Errorf("VerifyProof of a revoked commitment = %v, want ErrRevoked", verifyErr)
+	}
+	if verifyErr := New(fixture.verifyingKey).WithRevocations(NewRevocationList(&key.PublicKey)).VerifyProof(context.Background(), fixture.proof, validInputs); verifyErr != nil {
+		t.Errorf("VerifyProof with an empty list: %v", verifyErr)
+	}
+}
+
+func TestParseJSONWebKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))), base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	parsed, parseErr := ParseJSONWebKey([]byte(jwks))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if !key.PublicKey.Equal(parsed) {
+		t.Error("parsed JWK differs from the key")
+	}
+	for _, bad := range []string{`{"keys":[]}`, `{"kty":"EC","crv":"P-521","x":"AQ","y":"AQ"}`, `{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}`, `{"kty":"oct"}`} {
+		if _, parseErr := ParseJSONWebKey([]byte(bad)); parseErr == nil {
+			t.Errorf("ParseJSONWebKey(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestVerifyVerdict(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(typ string, verdict Verdict) string {
+		header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": typ})
+		payload, _ := json.Marshal(verdict)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signingInput)))
+	}
+	now := time.Now().Unix()
+	fresh := Verdict{UserName: "alice", Status: "valid", KeyID: "vk-1", Nonce: "77", IssuedAt: now, JWTID: "a"}
+	verdict, verifyErr := VerifyVerdict(sign(VerdictType, fresh), publicKey, "77", time.Minute)
+	if verifyErr != nil || verdict != fresh {
+		t.Fatalf("VerifyVerdict = %+v, %v", verdict, verifyErr)
+	}
+
+	stale, future := fresh, fresh
+	stale.IssuedAt, future.IssuedAt = now-120, now+600
+	for _, bad := range []struct {
+		name, signed, nonce string
+		key                 ed25519.PublicKey
+	}{
+		{"another key", sign(VerdictType, fresh), "77", otherKey},
+		{"another nonce", sign(VerdictType, fresh), "78", publicKey},
+		{"another type", sign(RevocationType, fresh), "77", publicKey},
+		{"a stale one", sign(VerdictType, stale), "77", publicKey},
+		{"a future one", sign(VerdictType, future), "77", publicKey},
+		{"garbage", "not.a.jws", "77", publicKey},
+	} {
+		if _, verifyErr := VerifyVerdict(bad.signed, bad.key, bad.nonce, time.Minute); !errors.Is(verifyErr, ErrVerdict) {
+			t.Errorf("verdict with %s = %v, want ErrVerdict", bad.name, verifyErr)
+		}
+	}
+
+	jwk := fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","x":%q}`, base64.RawURLEncoding.EncodeToString(publicKey))
+	if parsed, parseErr := ParseJSONWebKey([]byte(jwk)); parseErr != nil || !publicKey.Equal(parsed) {
+		t.Errorf("Ed25519 JWK = %v, %v", parsed, parseErr)
+	}
+}
+
+func TestVerifyKeyManifest(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(typ string, manifest KeyManifest) string {
+		header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": typ})
+		payload, _ := json.Marshal(manifest)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signingInput)))
+	}
+	binary, snarkJS := []byte("gnark key"), []byte(`{"protocol":"groth16"}`)
+	digest := func(key []byte) string {
+		sum := sha256.Sum256(key)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	manifest := KeyManifest{CircuitVersion: "v1", KeyID: "vk-1", Curve: "bn254", Digest: digest(binary), SnarkJSDigest: digest(snarkJS)}
+	signed := sign(KeyManifestType, manifest)
+	for _, key := range [][]byte{binary, snarkJS} {
+		if verified, verifyErr := VerifyKeyManifest(signed, publicKey, key); verifyErr != nil || verified != manifest {
+			t.Errorf("VerifyKeyManifest(%s) = %+v, %v", key, verified, verifyErr)
+		}
+	}
+
+	for _, bad := range []struct {
+		name, signed string
+		key          ed25519.PublicKey
+		bytes        []byte
+	}{
+		{"another signing key", signed, otherKey, binary},
+		{"another verifying key", signed, publicKey, []byte("other key")},
+		{"another type", sign(VerdictType, manifest), publicKey, binary},
+		{"garbage", "not.a.jws", publicKey, binary},
+	} {
+		if _, verifyErr := VerifyKeyManifest(bad.signed, bad.key, bad.bytes); !errors.Is(verifyErr, ErrKeyManifest) {
+			t.Errorf("manifest with %s = %v, want ErrKeyManifest", bad.name, verifyErr)
+		}
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	current, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	previous, _, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k2","x":%q},{"kty":"OKP","crv":"Ed25519","kid":"k1","x":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(current), base64.RawURLEncoding.EncodeToString(previous))
+	keys, parseErr := ParseJSONWebKeySet([]byte(jwks))
+	if parseErr != nil || len(keys) != 2 {
+		t.Fatalf("ParseJSONWebKeySet = %v, %v", keys, parseErr)
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k1"}`))
+	if key, keyErr := keys.Key(header + ".e30.sig"); keyErr != nil || !previous.Equal(key) {
+		t.Errorf("Key for kid k1 = %v, %v", key, keyErr)
+	}
+	unknown := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k0"}`))
+	if _, keyErr := keys.Key(unknown + ".e30.sig"); !errors.Is(keyErr, ErrUnknownKey) {
+		t.Errorf("Key for an unknown kid = %v, want ErrUnknownKey", keyErr)
+	}
+
+	message := []byte(`{"type":"anomaly.detected"}`)
+	signature := ed25519.Sign(privateKey, message)
+	if verifyErr := keys.VerifySignature("k2", message, signature); verifyErr != nil {
+		t.Errorf("VerifySignature = %v", verifyErr)
+	}
+	if verifyErr := keys.VerifySignature("k1", message, signature); !errors.Is(verifyErr, ErrSignature) {
+		t.Errorf("signature checked against another key = %v, want ErrSignature", verifyErr)
+	}
+	if verifyErr := keys.VerifySignature("k0", message, signature); !errors.Is(verifyErr, ErrUnknownKey) {
+		t.Errorf("signature by an unknown key = %v, want ErrUnknownKey", verifyErr)
+	}
+}
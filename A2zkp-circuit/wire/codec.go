@@ -0,0 +1,127 @@
+// Package wire holds the messages of ofa.proto, generated into ofa.pb.go by protoc-gen-go,
+// and the google.protobuf.Value encoding of endpoints without a message of their own.
+//
+// Values are encoded with the small encoder below, which writes the keys of an object in
+// sorted order so equal documents give equal bytes, and read back with decodeFields.
+// Unknown fields are skipped, as protobuf requires.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ErrTruncated is returned when a message ends in the middle of a field
+var ErrTruncated = errors.New("truncated protobuf message")
+
+// encoder appends fields to a message, omitting proto3 default values
+type encoder struct {
+	buf []byte
+}
+
+// tag appends a field key
+func (e *encoder) tag(field int, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// bytes appends a length-delimited field
+func (e *encoder) bytes(field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+// string appends a string field
+func (e *encoder) string(field int, value string) {
+	e.bytes(field, []byte(value))
+}
+
+// message appends an embedded message; a present but empty message is still written
+func (e *encoder) message(field int, encoded []byte) {
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(encoded)))
+	e.buf = append(e.buf, encoded...)
+}
+
+// field is one decoded field: value holds varints, payload length-delimited contents
+type field struct {
+	number   int
+	wireType int
+	value    uint64
+	payload  []byte
+}
+
+// decodeFields calls visit for every field of a message in wire order
+func decodeFields(data []byte, visit func(f field) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		data = data[n:]
+		f := field{number: int(key >> 3), wireType: int(key & 7)}
+		if f.number <= 0 || key>>3 > math.MaxInt32 {
+			return fmt.Errorf("invalid field number %d", key>>3)
+		}
+
+		switch f.wireType {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(data); n <= 0 {
+				return ErrTruncated
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return ErrTruncated
+			}
+			f.payload = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			f.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			f.value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d for field %d", f.wireType, f.number)
+		}
+		if visitErr := visit(f); visitErr != nil {
+			return visitErr
+		}
+	}
+	return nil
+}
+
+// expect checks that a known field arrived with the wire type its declaration implies
+func (f field) expect(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("field %d has wire type %d, want %d", f.number, f.wireType, wireType)
+	}
+	return nil
+}
+
+// string reads a string field
+func (f field) string() (string, error) {
+	if typeErr := f.expect(wireBytes); typeErr != nil {
+		return "", typeErr
+	}
+	return string(f.payload), nil
+}
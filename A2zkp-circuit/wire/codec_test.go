@@ -0,0 +1,84 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	var e encoder
+	e.string(valueString, "alice")
+	e.tag(9, wireVarint) // unknown varint
+	e.buf = append(e.buf, 7)
+	e.string(10, "later") // unknown length-delimited
+	e.tag(11, wireFixed64)
+	e.buf = append(e.buf, make([]byte, 8)...)
+	if document, decodeErr := JSONFromValue(e.buf); decodeErr != nil || string(document) != `"alice"` {
+		t.Errorf("JSONFromValue = %s, %v", document, decodeErr)
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated length":    {0x1a, 0x05, 'a'},
+		"truncated varint":    {0x20, 0x80},
+		"field zero":          {0x00, 0x01},
+		"wrong wire type":     {0x18, 0x01}, // string_value sent as a varint
+		"group wire type":     {0x0b},
+		"bad embedded struct": {0x2a, 0x02, 0x0a, 0x05},
+		"truncated fixed32":   {0x4d, 0x00},
+		"truncated fixed64":   {0x11, 0x00, 0x00},
+		"length past the end": {0x1a, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		"number without JSON": {0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x7f}, // NaN
+	}
+	for name, data := range tests {
+		if _, decodeErr := JSONFromValue(data); decodeErr == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, decodeErr := JSONFromValue([]byte{0x1a, 0x05, 'a'}); !errors.Is(decodeErr, ErrTruncated) {
+		t.Errorf("truncated message = %v, want ErrTruncated", decodeErr)
+	}
+}
+
+func TestParseFieldElement(t *testing.T) {
+	value, parseErr := ParseFieldElement(FieldElement(big.NewInt(99)))
+	if parseErr != nil || value.Int64() != 99 {
+		t.Errorf("ParseFieldElement = %v, %v", value, parseErr)
+	}
+	if _, parseErr := ParseFieldElement(make([]byte, 33)); parseErr == nil {
+		t.Error("33-byte field element accepted")
+	}
+}
+
+func TestValue(t *testing.T) {
+	// {"a":true} as protoc-generated code writes it: Value.struct_value, one fields entry, Value.bool_value
+	got, encodeErr := ValueFromJSON([]byte(`{"a":true}`))
+	want := []byte{0x2a, 0x09, 0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x20, 0x01}
+	if encodeErr != nil || !bytes.Equal(got, want) {
+		t.Errorf("ValueFromJSON = % x, %v; want % x", got, encodeErr, want)
+	}
+
+	document := `{"count":1000000,"empty":{},"list":[null,false,"",0,-1.5,[]],"name":"alice"}`
+	message, encodeErr := ValueFromJSON([]byte(document))
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	if decoded, decodeErr := JSONFromValue(message); decodeErr != nil || string(decoded) != document {
+		t.Errorf("JSONFromValue = %s, %v; want %s", decoded, decodeErr, document)
+	}
+
+	nested := []byte{0x32, 0x00} // an empty list_value
+	for range maxValueDepth + 1 {
+		var e encoder
+		e.message(listValues, nested)
+		var outer encoder
+		outer.message(valueList, e.buf)
+		nested = outer.buf
+	}
+	if _, decodeErr := JSONFromValue(nested); !errors.Is(decodeErr, ErrValueDepth) {
+		t.Errorf("deeply nested value = %v, want ErrValueDepth", decodeErr)
+	}
+}
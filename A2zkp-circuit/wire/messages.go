@@ -0,0 +1,27 @@
+package wire
+
+//go:generate go run ./protogen
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ContentType is the media type of protobuf request and response bodies
+const ContentType = "application/x-protobuf"
+
+// fieldElementLength is the size of a big-endian BN254 or BLS12-381 scalar
+const fieldElementLength = 32
+
+// FieldElement encodes a non-negative integer as a 32-byte big-endian value
+func FieldElement(value *big.Int) []byte {
+	return value.FillBytes(make([]byte, fieldElementLength))
+}
+
+// ParseFieldElement decodes a big-endian value of at most 32 bytes
+func ParseFieldElement(value []byte) (*big.Int, error) {
+	if len(value) > fieldElementLength {
+		return nil, fmt.Errorf("field element is %d bytes, at most %d allowed", len(value), fieldElementLength)
+	}
+	return new(big.Int).SetBytes(value), nil
+}
@@ -0,0 +1,927 @@
+// Protobuf encoding of the authentication API, accepted and served as
+// application/x-protobuf by POST /v1/users, /v1/challenges and /v1/verify.
+//
+// Field elements (commitments, nonces, public inputs) are 32-byte big-endian
+// integers rather than decimal strings, and proofs are raw bytes rather than
+// base64, which is where most of the size saving over JSON comes from.
+//
+// Package wire's Go types are generated from this file into ofa.pb.go by
+// protoc-gen-go: run go generate ./wire after editing.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        (unknown)
+// source: ofa.proto
+
+package wire
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Curve int32
+
+const (
+	Curve_CURVE_UNSPECIFIED Curve = 0
+	Curve_CURVE_BN254       Curve = 1
+	Curve_CURVE_BLS12_381   Curve = 2
+)
+
+// Enum value maps for Curve.
+var (
+	Curve_name = map[int32]string{
+		0: "CURVE_UNSPECIFIED",
+		1: "CURVE_BN254",
+		2: "CURVE_BLS12_381",
+	}
+	Curve_value = map[string]int32{
+		"CURVE_UNSPECIFIED": 0,
+		"CURVE_BN254":       1,
+		"CURVE_BLS12_381":   2,
+	}
+)
+
+func (x Curve) Enum() *Curve {
+	p := new(Curve)
+	*p = x
+	return p
+}
+
+func (x Curve) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Curve) Descriptor() protoreflect.EnumDescriptor {
+	return file_ofa_proto_enumTypes[0].Descriptor()
+}
+
+func (Curve) Type() protoreflect.EnumType {
+	return &file_ofa_proto_enumTypes[0]
+}
+
+func (x Curve) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Curve.Descriptor instead.
+func (Curve) EnumDescriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{0}
+}
+
+type Encoding int32
+
+const (
+	Encoding_ENCODING_UNSPECIFIED Encoding = 0
+	// gnark's binary serialization (WriteTo), compressed points
+	Encoding_ENCODING_GNARK_BINARY Encoding = 1
+	// a fixed-size big-endian integer
+	Encoding_ENCODING_BIG_ENDIAN Encoding = 2
+	// gnark's raw serialization (WriteRawTo), uncompressed points
+	Encoding_ENCODING_GNARK_RAW Encoding = 3
+)
+
+// Enum value maps for Encoding.
+var (
+	Encoding_name = map[int32]string{
+		0: "ENCODING_UNSPECIFIED",
+		1: "ENCODING_GNARK_BINARY",
+		2: "ENCODING_BIG_ENDIAN",
+		3: "ENCODING_GNARK_RAW",
+	}
+	Encoding_value = map[string]int32{
+		"ENCODING_UNSPECIFIED":  0,
+		"ENCODING_GNARK_BINARY": 1,
+		"ENCODING_BIG_ENDIAN":   2,
+		"ENCODING_GNARK_RAW":    3,
+	}
+)
+
+func (x Encoding) Enum() *Encoding {
+	p := new(Encoding)
+	*p = x
+	return p
+}
+
+func (x Encoding) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Encoding) Descriptor() protoreflect.EnumDescriptor {
+	return file_ofa_proto_enumTypes[1].Descriptor()
+}
+
+func (Encoding) Type() protoreflect.EnumType {
+	return &file_ofa_proto_enumTypes[1]
+}
+
+func (x Encoding) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Encoding.Descriptor instead.
+func (Encoding) EnumDescriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{1}
+}
+
+// Commitment is the public value a user registers
+type Commitment struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Curve          Curve                  `protobuf:"varint,1,opt,name=curve,proto3,enum=ofa.v1.Curve" json:"curve,omitempty"`
+	CircuitVersion string                 `protobuf:"bytes,2,opt,name=circuit_version,json=circuitVersion,proto3" json:"circuit_version,omitempty"`
+	Encoding       Encoding               `protobuf:"varint,3,opt,name=encoding,proto3,enum=ofa.v1.Encoding" json:"encoding,omitempty"` // ENCODING_BIG_ENDIAN
+	Value          []byte                 `protobuf:"bytes,4,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Commitment) Reset() {
+	*x = Commitment{}
+	mi := &file_ofa_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Commitment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Commitment) ProtoMessage() {}
+
+func (x *Commitment) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Commitment.ProtoReflect.Descriptor instead.
+func (*Commitment) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Commitment) GetCurve() Curve {
+	if x != nil {
+		return x.Curve
+	}
+	return Curve_CURVE_UNSPECIFIED
+}
+
+func (x *Commitment) GetCircuitVersion() string {
+	if x != nil {
+		return x.CircuitVersion
+	}
+	return ""
+}
+
+func (x *Commitment) GetEncoding() Encoding {
+	if x != nil {
+		return x.Encoding
+	}
+	return Encoding_ENCODING_UNSPECIFIED
+}
+
+func (x *Commitment) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// Proof is a Groth16 proof of knowledge of the secret behind a commitment
+type Proof struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Curve          Curve                  `protobuf:"varint,1,opt,name=curve,proto3,enum=ofa.v1.Curve" json:"curve,omitempty"`
+	CircuitVersion string                 `protobuf:"bytes,2,opt,name=circuit_version,json=circuitVersion,proto3" json:"circuit_version,omitempty"`
+	Encoding       Encoding               `protobuf:"varint,3,opt,name=encoding,proto3,enum=ofa.v1.Encoding" json:"encoding,omitempty"` // ENCODING_GNARK_BINARY, or ENCODING_GNARK_RAW
+	Data           []byte                 `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	// the proof envelope format; 0 from clients that predate it
+	FormatVersion uint32 `protobuf:"varint,5,opt,name=format_version,json=formatVersion,proto3" json:"format_version,omitempty"`
+	Backend       string `protobuf:"bytes,6,opt,name=backend,proto3" json:"backend,omitempty"` // "groth16"
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Proof) Reset() {
+	*x = Proof{}
+	mi := &file_ofa_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Proof) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Proof) ProtoMessage() {}
+
+func (x *Proof) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Proof.ProtoReflect.Descriptor instead.
+func (*Proof) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Proof) GetCurve() Curve {
+	if x != nil {
+		return x.Curve
+	}
+	return Curve_CURVE_UNSPECIFIED
+}
+
+func (x *Proof) GetCircuitVersion() string {
+	if x != nil {
+		return x.CircuitVersion
+	}
+	return ""
+}
+
+func (x *Proof) GetEncoding() Encoding {
+	if x != nil {
+		return x.Encoding
+	}
+	return Encoding_ENCODING_UNSPECIFIED
+}
+
+func (x *Proof) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Proof) GetFormatVersion() uint32 {
+	if x != nil {
+		return x.FormatVersion
+	}
+	return 0
+}
+
+func (x *Proof) GetBackend() string {
+	if x != nil {
+		return x.Backend
+	}
+	return ""
+}
+
+// PublicWitness holds the public inputs of the circuit in declaration order:
+// crypto_commitment, then nonce
+type PublicWitness struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Curve          Curve                  `protobuf:"varint,1,opt,name=curve,proto3,enum=ofa.v1.Curve" json:"curve,omitempty"`
+	CircuitVersion string                 `protobuf:"bytes,2,opt,name=circuit_version,json=circuitVersion,proto3" json:"circuit_version,omitempty"`
+	Encoding       Encoding               `protobuf:"varint,3,opt,name=encoding,proto3,enum=ofa.v1.Encoding" json:"encoding,omitempty"` // ENCODING_BIG_ENDIAN
+	Inputs         [][]byte               `protobuf:"bytes,4,rep,name=inputs,proto3" json:"inputs,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *PublicWitness) Reset() {
+	*x = PublicWitness{}
+	mi := &file_ofa_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublicWitness) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublicWitness) ProtoMessage() {}
+
+func (x *PublicWitness) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublicWitness.ProtoReflect.Descriptor instead.
+func (*PublicWitness) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PublicWitness) GetCurve() Curve {
+	if x != nil {
+		return x.Curve
+	}
+	return Curve_CURVE_UNSPECIFIED
+}
+
+func (x *PublicWitness) GetCircuitVersion() string {
+	if x != nil {
+		return x.CircuitVersion
+	}
+	return ""
+}
+
+func (x *PublicWitness) GetEncoding() Encoding {
+	if x != nil {
+		return x.Encoding
+	}
+	return Encoding_ENCODING_UNSPECIFIED
+}
+
+func (x *PublicWitness) GetInputs() [][]byte {
+	if x != nil {
+		return x.Inputs
+	}
+	return nil
+}
+
+type KDFParams struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Algorithm     string                 `protobuf:"bytes,1,opt,name=algorithm,proto3" json:"algorithm,omitempty"`
+	MemoryKib     uint32                 `protobuf:"varint,2,opt,name=memory_kib,json=memoryKib,proto3" json:"memory_kib,omitempty"`
+	Time          uint32                 `protobuf:"varint,3,opt,name=time,proto3" json:"time,omitempty"`
+	Parallelism   uint32                 `protobuf:"varint,4,opt,name=parallelism,proto3" json:"parallelism,omitempty"`
+	Name          string                 `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"` // registered parameter set, with its version
+	Version       uint32                 `protobuf:"varint,6,opt,name=version,proto3" json:"version,omitempty"`
+	Cost          uint32                 `protobuf:"varint,7,opt,name=cost,proto3" json:"cost,omitempty"`                            // scrypt N
+	BlockSize     uint32                 `protobuf:"varint,8,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"` // scrypt r
+	Iterations    uint32                 `protobuf:"varint,9,opt,name=iterations,proto3" json:"iterations,omitempty"`                // PBKDF2
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KDFParams) Reset() {
+	*x = KDFParams{}
+	mi := &file_ofa_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KDFParams) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KDFParams) ProtoMessage() {}
+
+func (x *KDFParams) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KDFParams.ProtoReflect.Descriptor instead.
+func (*KDFParams) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *KDFParams) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *KDFParams) GetMemoryKib() uint32 {
+	if x != nil {
+		return x.MemoryKib
+	}
+	return 0
+}
+
+func (x *KDFParams) GetTime() uint32 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *KDFParams) GetParallelism() uint32 {
+	if x != nil {
+		return x.Parallelism
+	}
+	return 0
+}
+
+func (x *KDFParams) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *KDFParams) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *KDFParams) GetCost() uint32 {
+	if x != nil {
+		return x.Cost
+	}
+	return 0
+}
+
+func (x *KDFParams) GetBlockSize() uint32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *KDFParams) GetIterations() uint32 {
+	if x != nil {
+		return x.Iterations
+	}
+	return 0
+}
+
+type RegisterRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserName      string                 `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3" json:"user_name,omitempty"`
+	Commitment    *Commitment            `protobuf:"bytes,2,opt,name=commitment,proto3" json:"commitment,omitempty"`
+	Salt          []byte                 `protobuf:"bytes,3,opt,name=salt,proto3" json:"salt,omitempty"`
+	Kdf           *KDFParams             `protobuf:"bytes,4,opt,name=kdf,proto3" json:"kdf,omitempty"`
+	PolicyProof   []byte                 `protobuf:"bytes,5,opt,name=policy_proof,json=policyProof,proto3" json:"policy_proof,omitempty"` // gnark proof of the secret policy circuit
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterRequest) Reset() {
+	*x = RegisterRequest{}
+	mi := &file_ofa_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRequest) ProtoMessage() {}
+
+func (x *RegisterRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRequest.ProtoReflect.Descriptor instead.
+func (*RegisterRequest) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *RegisterRequest) GetUserName() string {
+	if x != nil {
+		return x.UserName
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetCommitment() *Commitment {
+	if x != nil {
+		return x.Commitment
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetKdf() *KDFParams {
+	if x != nil {
+		return x.Kdf
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetPolicyProof() []byte {
+	if x != nil {
+		return x.PolicyProof
+	}
+	return nil
+}
+
+type ChallengeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserName      string                 `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3" json:"user_name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChallengeRequest) Reset() {
+	*x = ChallengeRequest{}
+	mi := &file_ofa_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChallengeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChallengeRequest) ProtoMessage() {}
+
+func (x *ChallengeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChallengeRequest.ProtoReflect.Descriptor instead.
+func (*ChallengeRequest) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ChallengeRequest) GetUserName() string {
+	if x != nil {
+		return x.UserName
+	}
+	return ""
+}
+
+type ChallengeResponse struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Nonce           []byte                 `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"` // big-endian field element
+	ExpiresAtUnixMs int64                  `protobuf:"varint,2,opt,name=expires_at_unix_ms,json=expiresAtUnixMs,proto3" json:"expires_at_unix_ms,omitempty"`
+	KeyId           string                 `protobuf:"bytes,3,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ChallengeResponse) Reset() {
+	*x = ChallengeResponse{}
+	mi := &file_ofa_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChallengeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChallengeResponse) ProtoMessage() {}
+
+func (x *ChallengeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChallengeResponse.ProtoReflect.Descriptor instead.
+func (*ChallengeResponse) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ChallengeResponse) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *ChallengeResponse) GetExpiresAtUnixMs() int64 {
+	if x != nil {
+		return x.ExpiresAtUnixMs
+	}
+	return 0
+}
+
+func (x *ChallengeResponse) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+type VerifyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserName      string                 `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3" json:"user_name,omitempty"`
+	Nonce         []byte                 `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"` // big-endian field element
+	Proof         *Proof                 `protobuf:"bytes,3,opt,name=proof,proto3" json:"proof,omitempty"`
+	KeyId         string                 `protobuf:"bytes,4,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Commitment    []byte                 `protobuf:"bytes,5,opt,name=commitment,proto3" json:"commitment,omitempty"` // big-endian commitment the proof is for, for servers with commitment_blinding
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyRequest) Reset() {
+	*x = VerifyRequest{}
+	mi := &file_ofa_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyRequest) ProtoMessage() {}
+
+func (x *VerifyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyRequest.ProtoReflect.Descriptor instead.
+func (*VerifyRequest) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *VerifyRequest) GetUserName() string {
+	if x != nil {
+		return x.UserName
+	}
+	return ""
+}
+
+func (x *VerifyRequest) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *VerifyRequest) GetProof() *Proof {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+func (x *VerifyRequest) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *VerifyRequest) GetCommitment() []byte {
+	if x != nil {
+		return x.Commitment
+	}
+	return nil
+}
+
+type StatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	KeyId         string                 `protobuf:"bytes,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Verdict       string                 `protobuf:"bytes,3,opt,name=verdict,proto3" json:"verdict,omitempty"` // signed verdict of an accepted POST /v1/verify, with verdict_signing enabled
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusResponse) Reset() {
+	*x = StatusResponse{}
+	mi := &file_ofa_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusResponse) ProtoMessage() {}
+
+func (x *StatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ofa_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusResponse.ProtoReflect.Descriptor instead.
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return file_ofa_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *StatusResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetVerdict() string {
+	if x != nil {
+		return x.Verdict
+	}
+	return ""
+}
+
+var File_ofa_proto protoreflect.FileDescriptor
+
+const file_ofa_proto_rawDesc = "" +
+	"\n" +
+	"\tofa.proto\x12\x06ofa.v1\"\x9e\x01\n" +
+	"\n" +
+	"Commitment\x12#\n" +
+	"\x05curve\x18\x01 \x01(\x0e2\r.ofa.v1.CurveR\x05curve\x12'\n" +
+	"\x0fcircuit_version\x18\x02 \x01(\tR\x0ecircuitVersion\x12,\n" +
+	"\bencoding\x18\x03 \x01(\x0e2\x10.ofa.v1.EncodingR\bencoding\x12\x14\n" +
+	"\x05value\x18\x04 \x01(\fR\x05value\"\xd8\x01\n" +
+	"\x05Proof\x12#\n" +
+	"\x05curve\x18\x01 \x01(\x0e2\r.ofa.v1.CurveR\x05curve\x12'\n" +
+	"\x0fcircuit_version\x18\x02 \x01(\tR\x0ecircuitVersion\x12,\n" +
+	"\bencoding\x18\x03 \x01(\x0e2\x10.ofa.v1.EncodingR\bencoding\x12\x12\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\x12%\n" +
+	"\x0eformat_version\x18\x05 \x01(\rR\rformatVersion\x12\x18\n" +
+	"\abackend\x18\x06 \x01(\tR\abackend\"\xa3\x01\n" +
+	"\rPublicWitness\x12#\n" +
+	"\x05curve\x18\x01 \x01(\x0e2\r.ofa.v1.CurveR\x05curve\x12'\n" +
+	"\x0fcircuit_version\x18\x02 \x01(\tR\x0ecircuitVersion\x12,\n" +
+	"\bencoding\x18\x03 \x01(\x0e2\x10.ofa.v1.EncodingR\bencoding\x12\x16\n" +
+	"\x06inputs\x18\x04 \x03(\fR\x06inputs\"\xff\x01\n" +
+	"\tKDFParams\x12\x1c\n" +
+	"\talgorithm\x18\x01 \x01(\tR\talgorithm\x12\x1d\n" +
+	"\n" +
+	"memory_kib\x18\x02 \x01(\rR\tmemoryKib\x12\x12\n" +
+	"\x04time\x18\x03 \x01(\rR\x04time\x12 \n" +
+	"\vparallelism\x18\x04 \x01(\rR\vparallelism\x12\x12\n" +
+	"\x04name\x18\x05 \x01(\tR\x04name\x12\x18\n" +
+	"\aversion\x18\x06 \x01(\rR\aversion\x12\x12\n" +
+	"\x04cost\x18\a \x01(\rR\x04cost\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\b \x01(\rR\tblockSize\x12\x1e\n" +
+	"\n" +
+	"iterations\x18\t \x01(\rR\n" +
+	"iterations\"\xbe\x01\n" +
+	"\x0fRegisterRequest\x12\x1b\n" +
+	"\tuser_name\x18\x01 \x01(\tR\buserName\x122\n" +
+	"\n" +
+	"commitment\x18\x02 \x01(\v2\x12.ofa.v1.CommitmentR\n" +
+	"commitment\x12\x12\n" +
+	"\x04salt\x18\x03 \x01(\fR\x04salt\x12#\n" +
+	"\x03kdf\x18\x04 \x01(\v2\x11.ofa.v1.KDFParamsR\x03kdf\x12!\n" +
+	"\fpolicy_proof\x18\x05 \x01(\fR\vpolicyProof\"/\n" +
+	"\x10ChallengeRequest\x12\x1b\n" +
+	"\tuser_name\x18\x01 \x01(\tR\buserName\"m\n" +
+	"\x11ChallengeResponse\x12\x14\n" +
+	"\x05nonce\x18\x01 \x01(\fR\x05nonce\x12+\n" +
+	"\x12expires_at_unix_ms\x18\x02 \x01(\x03R\x0fexpiresAtUnixMs\x12\x15\n" +
+	"\x06key_id\x18\x03 \x01(\tR\x05keyId\"\x9e\x01\n" +
+	"\rVerifyRequest\x12\x1b\n" +
+	"\tuser_name\x18\x01 \x01(\tR\buserName\x12\x14\n" +
+	"\x05nonce\x18\x02 \x01(\fR\x05nonce\x12#\n" +
+	"\x05proof\x18\x03 \x01(\v2\r.ofa.v1.ProofR\x05proof\x12\x15\n" +
+	"\x06key_id\x18\x04 \x01(\tR\x05keyId\x12\x1e\n" +
+	"\n" +
+	"commitment\x18\x05 \x01(\fR\n" +
+	"commitment\"Y\n" +
+	"\x0eStatusResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\tR\x05keyId\x12\x18\n" +
+	"\averdict\x18\x03 \x01(\tR\averdict*D\n" +
+	"\x05Curve\x12\x15\n" +
+	"\x11CURVE_UNSPECIFIED\x10\x00\x12\x0f\n" +
+	"\vCURVE_BN254\x10\x01\x12\x13\n" +
+	"\x0fCURVE_BLS12_381\x10\x02*p\n" +
+	"\bEncoding\x12\x18\n" +
+	"\x14ENCODING_UNSPECIFIED\x10\x00\x12\x19\n" +
+	"\x15ENCODING_GNARK_BINARY\x10\x01\x12\x17\n" +
+	"\x13ENCODING_BIG_ENDIAN\x10\x02\x12\x16\n" +
+	"\x12ENCODING_GNARK_RAW\x10\x03B\x14Z\x12A2zkp-circuit/wireb\x06proto3"
+
+var (
+	file_ofa_proto_rawDescOnce sync.Once
+	file_ofa_proto_rawDescData []byte
+)
+
+func file_ofa_proto_rawDescGZIP() []byte {
+	file_ofa_proto_rawDescOnce.Do(func() {
+		file_ofa_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ofa_proto_rawDesc), len(file_ofa_proto_rawDesc)))
+	})
+	return file_ofa_proto_rawDescData
+}
+
+var file_ofa_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_ofa_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_ofa_proto_goTypes = []any{
+	(Curve)(0),                // 0: ofa.v1.Curve
+	(Encoding)(0),             // 1: ofa.v1.Encoding
+	(*Commitment)(nil),        // 2: ofa.v1.Commitment
+	(*Proof)(nil),             // 3: ofa.v1.Proof
+	(*PublicWitness)(nil),     // 4: ofa.v1.PublicWitness
+	(*KDFParams)(nil),         // 5: ofa.v1.KDFParams
+	(*RegisterRequest)(nil),   // 6: ofa.v1.RegisterRequest
+	(*ChallengeRequest)(nil),  // 7: ofa.v1.ChallengeRequest
+	(*ChallengeResponse)(nil), // 8: ofa.v1.ChallengeResponse
+	(*VerifyRequest)(nil),     // 9: ofa.v1.VerifyRequest
+	(*StatusResponse)(nil),    // 10: ofa.v1.StatusResponse
+}
+var file_ofa_proto_depIdxs = []int32{
+	0, // 0: ofa.v1.Commitment.curve:type_name -> ofa.v1.Curve
+	1, // 1: ofa.v1.Commitment.encoding:type_name -> ofa.v1.Encoding
+	0, // 2: ofa.v1.Proof.curve:type_name -> ofa.v1.Curve
+	1, // 3: ofa.v1.Proof.encoding:type_name -> ofa.v1.Encoding
+	0, // 4: ofa.v1.PublicWitness.curve:type_name -> ofa.v1.Curve
+	1, // 5: ofa.v1.PublicWitness.encoding:type_name -> ofa.v1.Encoding
+	2, // 6: ofa.v1.RegisterRequest.commitment:type_name -> ofa.v1.Commitment
+	5, // 7: ofa.v1.RegisterRequest.kdf:type_name -> ofa.v1.KDFParams
+	3, // 8: ofa.v1.VerifyRequest.proof:type_name -> ofa.v1.Proof
+	9, // [9:9] is the sub-list for method output_type
+	9, // [9:9] is the sub-list for method input_type
+	9, // [9:9] is the sub-list for extension type_name
+	9, // [9:9] is the sub-list for extension extendee
+	0, // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_ofa_proto_init() }
+func file_ofa_proto_init() {
+	if File_ofa_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ofa_proto_rawDesc), len(file_ofa_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_ofa_proto_goTypes,
+		DependencyIndexes: file_ofa_proto_depIdxs,
+		EnumInfos:         file_ofa_proto_enumTypes,
+		MessageInfos:      file_ofa_proto_msgTypes,
+	}.Build()
+	File_ofa_proto = out.File
+	file_ofa_proto_goTypes = nil
+	file_ofa_proto_depIdxs = nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestGeneratedCodeIsCurrent(t *testing.T) {
+	generated, generateErr := generate("..", schema)
+	if generateErr != nil {
+		t.Fatal(generateErr)
+	}
+	checkedIn, readErr := os.ReadFile("../ofa.pb.go")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(generated, checkedIn) {
+		t.Errorf("wire/ofa.pb.go doesn't match %s: run go generate ./wire and commit the result", schema)
+	}
+}
@@ -0,0 +1,202 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// ValueMessage names google.protobuf.Value, which endpoints without a message of their own in
+// ofa.proto exchange: their JSON request or response document, field for field
+const ValueMessage = "google.protobuf.Value"
+
+// ValueContentType is the Content-Type of a body holding a ValueMessage
+const ValueContentType = ContentType + "; proto=" + ValueMessage
+
+// maxValueDepth bounds the nesting of a decoded Value, so a hostile message can't exhaust the stack
+const maxValueDepth = 64
+
+// ErrValueDepth is returned for a Value nested deeper than maxValueDepth
+var ErrValueDepth = errors.New("protobuf value nested too deeply")
+
+// Fields of google.protobuf.Value, Struct, Struct's map entries and ListValue
+const (
+	valueNull   = 1
+	valueNumber = 2
+	valueString = 3
+	valueBool   = 4
+	valueStruct = 5
+	valueList   = 6
+
+	structFields = 1
+	entryKey     = 1
+	entryValue   = 2
+	listValues   = 1
+)
+
+// ValueFromJSON encodes a JSON document as a google.protobuf.Value. Numbers become doubles, as in
+// protobuf's own JSON mapping, so integers beyond 2^53 lose precision; the API sends those as strings.
+func ValueFromJSON(document []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value any
+	if decodeErr := decoder.Decode(&value); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return appendValue(nil, value)
+}
+
+// appendValue appends the fields of a Value holding a decoded JSON value. The oneof field is written
+// even when it holds its default, as protobuf does for oneof members.
+func appendValue(buf []byte, value any) ([]byte, error) {
+	e := encoder{buf: buf}
+	switch value := value.(type) {
+	case nil:
+		e.tag(valueNull, wireVarint)
+		e.buf = append(e.buf, 0)
+	case bool:
+		e.tag(valueBool, wireVarint)
+		e.buf = append(e.buf, map[bool]byte{false: 0, true: 1}[value])
+	case json.Number:
+		number, parseErr := strconv.ParseFloat(string(value), 64)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		e.tag(valueNumber, wireFixed64)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(number))
+	case string:
+		e.tag(valueString, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+		e.buf = append(e.buf, value...)
+	case map[string]any:
+		var fields encoder
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			entry := encoder{}
+			entry.string(entryKey, key)
+			encoded, encodeErr := appendValue(nil, value[key])
+			if encodeErr != nil {
+				return nil, encodeErr
+			}
+			entry.message(entryValue, encoded)
+			fields.message(structFields, entry.buf)
+		}
+		e.message(valueStruct, fields.buf)
+	case []any:
+		var values encoder
+		for _, element := range value {
+			encoded, encodeErr := appendValue(nil, element)
+			if encodeErr != nil {
+				return nil, encodeErr
+			}
+			values.message(listValues, encoded)
+		}
+		e.message(valueList, values.buf)
+	default:
+		return nil, fmt.Errorf("unsupported JSON value %T", value)
+	}
+	return e.buf, nil
+}
+
+// JSONFromValue decodes a google.protobuf.Value into the JSON document it stands for. A Value with
+// no kind set is null.
+func JSONFromValue(message []byte) ([]byte, error) {
+	value, decodeErr := decodeValue(message, 0)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return json.Marshal(value)
+}
+
+// decodeValue decodes a Value nested depth levels deep; the last kind on the wire wins, as for any oneof
+func decodeValue(message []byte, depth int) (any, error) {
+	if depth > maxValueDepth {
+		return nil, ErrValueDepth
+	}
+	var value any
+	decodeErr := decodeFields(message, func(f field) (err error) {
+		switch f.number {
+		case valueNull:
+			value, err = nil, f.expect(wireVarint)
+		case valueNumber:
+			if err = f.expect(wireFixed64); err == nil {
+				number := math.Float64frombits(f.value)
+				if math.IsNaN(number) || math.IsInf(number, 0) {
+					return fmt.Errorf("field %d: %v has no JSON form", f.number, number)
+				}
+				value = number
+			}
+		case valueString:
+			value, err = f.string()
+		case valueBool:
+			if err = f.expect(wireVarint); err == nil {
+				value = f.value != 0
+			}
+		case valueStruct:
+			if err = f.expect(wireBytes); err == nil {
+				value, err = decodeStruct(f.payload, depth)
+			}
+		case valueList:
+			if err = f.expect(wireBytes); err == nil {
+				value, err = decodeList(f.payload, depth)
+			}
+		}
+		return err
+	})
+	return value, decodeErr
+}
+
+// decodeStruct decodes the fields of a Struct inside a Value depth levels deep
+func decodeStruct(message []byte, depth int) (map[string]any, error) {
+	fields := map[string]any{}
+	decodeErr := decodeFields(message, func(f field) error {
+		if f.number != structFields {
+			return nil
+		}
+		if typeErr := f.expect(wireBytes); typeErr != nil {
+			return typeErr
+		}
+		var key string
+		var value any
+		entryErr := decodeFields(f.payload, func(entry field) (err error) {
+			switch entry.number {
+			case entryKey:
+				key, err = entry.string()
+			case entryValue:
+				if err = entry.expect(wireBytes); err == nil {
+					value, err = decodeValue(entry.payload, depth+1)
+				}
+			}
+			return err
+		})
+		fields[key] = value
+		return entryErr
+	})
+	return fields, decodeErr
+}
+
+// decodeList decodes the values of a ListValue inside a Value depth levels deep
+func decodeList(message []byte, depth int) ([]any, error) {
+	values := []any{}
+	decodeErr := decodeFields(message, func(f field) error {
+		if f.number != listValues {
+			return nil
+		}
+		if typeErr := f.expect(wireBytes); typeErr != nil {
+			return typeErr
+		}
+		value, valueErr := decodeValue(f.payload, depth+1)
+		values = append(values, value)
+		return valueErr
+	})
+	return values, decodeErr
+}
@@ -91,32 +91,47 @@ def sign_in(user_name, user_secret):
     except requests.exceptions.RequestException as e:
         logging.error(f"Error signing in: {e}")
 
+# Order of the BN254 scalar field the Go circuit is compiled over
+BN254_SCALAR_FIELD = 21888242871839275222246405745257275088548364400416034343698204186575808495617
+
+# Domain of integer secrets accepted by the Go circuit: -s would share the commitment of s
+SECRET_MIN = 1
+SECRET_MAX = 2**63 - 1
+
+# Parse a secret typed by the user
+def parse_secret(text):
+    """
+    Parse a decimal secret and check it lies in the secret domain.
+
+    Raises:
+        ValueError: If the text is not an integer between SECRET_MIN and SECRET_MAX.
+    """
+    user_secret = int(text)
+    if not SECRET_MIN <= user_secret <= SECRET_MAX:
+        raise ValueError(f"secret must be an integer between {SECRET_MIN} and {SECRET_MAX}")
+    return user_secret
+
 # Generate a cryptographic commitment based on the user's secret
 def generate_crypto_commitment(user_secret):
     """
-    Generate a cryptographic commitment by sending the user's secret to the server.
+    Compute the cryptographic commitment for the user's secret locally.
+
+    The commitment is user_secret^2 reduced into the BN254 scalar field, encoded as a
+    decimal string, which is what the Go circuit exposes as its public output. The
+    secret itself is never sent to any server.
 
     Args:
-        user_secret (int): The user's secret value.
+        user_secret (int): The user's secret value, between SECRET_MIN and SECRET_MAX.
 
     Returns:
-        str: The generated cryptographic commitment or None if an error occurs.
-    """
-    url = 'http://localhost:8080/generateCommitment'
-    params = {'user_secret': user_secret}
+        str: The generated cryptographic commitment.
 
-    try:
-        response = requests.get(url, params=params)
-        response.raise_for_status()
-        data = response.json()
-        if 'crypto_commitment' in data:
-            return data['crypto_commitment']
-        else:
-            logging.error("Crypto commitment not found in response.")
-            return None
-    except requests.exceptions.RequestException as e:
-        logging.error(f"Error generating crypto commitment: {e}")
-        return None
+    Raises:
+        ValueError: If the secret is outside the secret domain.
+    """
+    if not SECRET_MIN <= user_secret <= SECRET_MAX:
+        raise ValueError(f"secret must be an integer between {SECRET_MIN} and {SECRET_MAX}")
+    return str((user_secret * user_secret) % BN254_SCALAR_FIELD)
 
 # Main function to manage user interactions for sign-up and sign-in
 def main():
@@ -130,9 +145,9 @@ def main():
     if choice == '1':
         user_name = input("Enter username: ")
         try:
-            user_secret = int(input("Enter secret (e.g., 123): "))
+            user_secret = parse_secret(input("Enter secret (e.g., 123): "))
         except ValueError:
-            logging.error("Invalid secret format. Please enter a number.")
+            logging.error(f"Invalid secret. Please enter a number between {SECRET_MIN} and {SECRET_MAX}.")
             return
 
         crypto_commitment = generate_crypto_commitment(user_secret)
@@ -146,9 +161,9 @@ def main():
     elif choice == '2':
         user_name = input("Enter username: ")
         try:
-            user_secret = int(input("Enter secret: "))
+            user_secret = parse_secret(input("Enter secret: "))
         except ValueError:
-            logging.error("Invalid secret format. Please enter a number.")
+            logging.error(f"Invalid secret. Please enter a number between {SECRET_MIN} and {SECRET_MAX}.")
             return
 
         sign_in(user_name, user_secret)